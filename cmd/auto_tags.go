@@ -0,0 +1,82 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+
+	"github.com/APTrust/dart-runner/bagit"
+	"github.com/APTrust/dart-runner/util"
+)
+
+// calculatedTags are the tags in autoGeneratedTags that describe the
+// payload, so the user can't set them. A bag whose Payload-Oxum doesn't
+// match its payload is invalid.
+var calculatedTags = []string{
+	"bag-info.txt/Payload-Oxum",
+}
+
+// userAutoTagValues returns copies of the tags in autoGeneratedTags to
+// which the user gave values in profile, as PrepareProfile does. The
+// bagger replaces these values with its own while bagging, so call this
+// first, then put them back with OverrideAutoTags.
+func userAutoTagValues(profile *bagit.Profile) []*bagit.TagDefinition {
+	values := make([]*bagit.TagDefinition, 0)
+	for _, tag := range profile.Tags {
+		key := tag.TagFile + "/" + tag.TagName
+		if tag.UserValue != "" && util.StringListContains(autoGeneratedTags, key) && !util.StringListContains(calculatedTags, key) {
+			values = append(values, tag.Copy())
+		}
+	}
+	return values
+}
+
+// OverrideAutoTags replaces the values the bagger wrote for tags like
+// Bagging-Date in the tarred bag at pathToTar with the values in tags,
+// and updates the tag manifests to match. That lets users pin the
+// Bagging-Date of a bag of historical content, or of a reproducible
+// bag. Call this before RewriteManifestEncoding, since it expects hex
+// digests. Like WriteManifests, this writes a new tar file next to the
+// original, then replaces the original.
+func OverrideAutoTags(pathToTar string, tags []*bagit.TagDefinition) error {
+	if len(tags) == 0 {
+		return nil
+	}
+	tagFiles, err := readTarFiles(pathToTar, func(pathInBag string) bool {
+		return manifestRegex.MatchString(pathInBag) || containsTagFile(tags, pathInBag)
+	})
+	if err != nil {
+		return err
+	}
+	replacements := make(map[string][]byte)
+	for _, tag := range tags {
+		data, ok := replacements[tag.TagFile]
+		if !ok {
+			data = tagFiles[tag.TagFile]
+		}
+		tagLine := regexp.MustCompile(`(?m)^` + regexp.QuoteMeta(tag.TagName) + `:.*\n`)
+		if !tagLine.Match(data) {
+			return fmt.Errorf("the bagger didn't write %s to %s", tag.TagName, tag.TagFile)
+		}
+		replacements[tag.TagFile] = tagLine.ReplaceAllLiteral(data, []byte(tag.TagName+": "+tag.UserValue+"\n"))
+	}
+	if err = updateTagManifests(tagFiles, replacements); err != nil {
+		return err
+	}
+	tmpPath := pathToTar + ".tmp"
+	err = copyTarReplacing(pathToTar, tmpPath, replacements, nil)
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return os.Rename(tmpPath, pathToTar)
+}
+
+func containsTagFile(tags []*bagit.TagDefinition, tagFile string) bool {
+	for _, tag := range tags {
+		if tag.TagFile == tagFile {
+			return true
+		}
+	}
+	return false
+}
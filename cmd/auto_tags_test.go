@@ -0,0 +1,44 @@
+package cmd_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/APTrust/apt-cmd/cmd"
+	"github.com/APTrust/dart-runner/bagit"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRunBagCreate_OverrideAutoTags(t *testing.T) {
+	opts := newBagCreateOptions(t)
+	opts.Tags = append(opts.Tags,
+		&bagit.TagDefinition{TagFile: "bag-info.txt", TagName: "Bagging-Date", UserValue: "2009-04-17"},
+		&bagit.TagDefinition{TagFile: "bag-info.txt", TagName: "Bagging-Software", UserValue: "Original Bagger 1.2"},
+	)
+	opts.Verify = true
+	result, err := cmd.RunBagCreate(opts)
+	require.Nil(t, err, err)
+	assert.Equal(t, "OK", result.Result)
+
+	bagInfo := tarFileContent(t, opts.OutputFile, "library/bag-info.txt")
+	assert.Contains(t, bagInfo, "Bagging-Date: 2009-04-17\n")
+	assert.Contains(t, bagInfo, "Bagging-Software: Original Bagger 1.2\n")
+	assert.Contains(t, bagInfo, "Payload-Oxum: 8.2\n")
+	validator, err := cmd.ValidateBag(context.Background(), opts.OutputFile, opts.Profile)
+	require.Nil(t, err)
+	assert.Empty(t, validator.Errors)
+
+	// The bagger still fills in the tags the user didn't set.
+	opts = newBagCreateOptions(t)
+	_, err = cmd.RunBagCreate(opts)
+	require.Nil(t, err, err)
+	assert.Contains(t, tarFileContent(t, opts.OutputFile, "library/bag-info.txt"), "Bagging-Date: 20")
+
+	// Payload-Oxum describes the payload, so users can't set it.
+	opts.Tags = append(opts.Tags, &bagit.TagDefinition{TagFile: "bag-info.txt", TagName: "Payload-Oxum", UserValue: "1.1"})
+	_, err = cmd.RunBagCreate(opts)
+	require.NotNil(t, err)
+	assert.Equal(t, cmd.EXIT_USER_ERR, cmd.BagCreateExitCode(err))
+	assert.Contains(t, err.Error(), "Tag bag-info.txt/Payload-Oxum is calculated from the payload")
+}
@@ -1,52 +1,91 @@
 package cmd
 
 import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
 	"fmt"
+	"io"
 	"os"
-	"path"
 	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/APTrust/dart-runner/bagit"
 	"github.com/APTrust/dart-runner/util"
+	"github.com/dustin/go-humanize"
+	"github.com/google/uuid"
 	"github.com/spf13/cobra"
 )
 
+// DefaultManifestAlg is the manifest algorithm bag create uses if
+// the user omits --manifest-algs and the config doesn't specify
+// APTRUST_DEFAULT_MANIFEST_ALGS.
+const DefaultManifestAlg = "sha256"
+
+// MaxRehashAttempts is the number of times bag create will try to
+// bag a directory with --rehash-changed before giving up on files
+// that keep changing.
+const MaxRehashAttempts = 3
+
 var manifestAlgs []string
 var userSuppliedTags []string
+var excludePatterns []string
+var fetchEntries []string
+
+// autoGeneratedTags are tags the bagger fills in on its own while
+// building the bag. Some profiles, like BTR, mark these as required,
+// but users can't know values like Payload-Oxum in advance, so we
+// don't make them supply these tags. Users can still set them with
+// --tags, as when re-bagging old content with its original
+// Bagging-Date, and their values replace the bagger's.
+var autoGeneratedTags = []string{
+	"bag-info.txt/Bag-Size",
+	"bag-info.txt/Bagging-Date",
+	"bag-info.txt/Bagging-Software",
+	"bag-info.txt/BagIt-Profile-Identifier",
+	"bag-info.txt/Payload-Oxum",
+}
 
 // createCmd represents the create command
 var createCmd = &cobra.Command{
-	Use:   "create",
-	Short: "Create a BagIt bag",
+	Use:     "create",
+	Short:   "Create a BagIt bag",
+	Example: `apt-cmd bag create --profile=aptrust --manifest-algs=md5,sha256 --output-file=/path/to/my_bag.tar --bag-dir=/path/to/my_files --tags=aptrust-info.txt/Title=My-Bag --tags=aptrust-info.txt/Access=Institution --tags=aptrust-info.txt/Storage-Option=Standard --tags=bag-info.txt/Source-Organization=Example-College`,
 	Long: `Package a directory into a BagIt bag using a specific
-BagIt profile, manifest algorithms, and tag values. The example
-below demonstrates how to speficy flags and tag values.
+BagIt profile, manifest algorithms, and tag values. The examples
+below demonstrate how to specify flags and tag values. This help is a
+summary; see the online documentation at the end for the details of
+each option.
 
 For tag values, use the format "filename.txt/Tag-Name=tag value". If you
 omit the file name, it defaults to bag-info.txt. For example, the following
-two tags will both be written into the Source-Organization tag in 
+two tags will both be written into the Source-Organization tag in
 bag-info.txt:
 
-  --tags="bag-info.txt/Source-Organization=Faber College" 
+  --tags="bag-info.txt/Source-Organization=Faber College"
   --tags="Source-Organization=Faber College"
 
 Note that tag values are quoted in their entirety, both the name and
-the value.
+the value. Everything after the first equal sign is the value.
 
-Apply double quotes to values containing special characters such as 
-spaces and symbols and to values containing environment variables that 
+Apply double quotes to values containing special characters such as
+spaces and symbols and to values containing environment variables that
 you want to expand, such as "$HOME".
 
 Apply single quotes to values containing symbols that you don't want
-the shell to expand, such as curly braces, ampersands, and random dollar 
+the shell to expand, such as curly braces, ampersands, and random dollar
 signs.
 
-You can specify any tag files and tag names you want.
+You can specify any tag files and tag names you want. Repeat a tag
+to give it several values. Tag values can be templates, which bag
+create expands itself: {{.Date}}, {{.BagName}} and {{.Env "NAME"}}.
+Tags can also come from a --tags-file, or from APTRUST_TAGS in your
+config file, and --tags replaces tags from either with the same name.
 
 The following example packages the directory /home/josie/photos according
-to the APTrust BagIt profile and writes the tarred bag into 
+to the APTrust BagIt profile and writes the tarred bag into
 /home/josie/bags/photos.tar.
 
 This bag will include md5 and sha256 manifests and tag manifests. It will
@@ -64,22 +103,67 @@ apt-cmd bag create \
     --tags='bag-info.txt/Source-Organization=Faber College' \
     --tags='Custom-Tag=Single quoted because it {contains} $weird &characters'
 
+Common options:
+
+  Output         --format (tar, directory, zip or tgz), --bag-name,
+                 --payload-dir, --reproducible, --no-clobber, --force
+  Payload        --bag-dir (repeatable), --exclude, --exclude-from,
+                 --symlinks, --keep-empty-dirs, --skip-unreadable,
+                 --rehash-changed, --fetch, --fetch-from
+  Several bags   --split-by-dir, --max-bag-size, --concurrency
+  Checking       --dry-run, --verify, --strict-tags,
+                 --report-duplicates, --fail-on-duplicates
+  Uploading      --upload-to, --upload-key, --stream, --keep-local
+  Progress       --progress, --tui
+  Other          --hash-encoding, --emit-job-file
+
+If you omit --manifest-algs, bag create uses APTRUST_DEFAULT_MANIFEST_ALGS
+from your config file or environment, or sha256 if that's not set.
+--profile also accepts the path to a BagIt profile JSON file.
+
+To upload the bag to an S3 bucket once it's created and validated:
+
+apt-cmd bag create \
+    --profile=aptrust \
+    --manifest-algs='md5,sha256' \
+    --output-file='/home/josie/bags/photos.tar' \
+    --bag-dir='/home/josie/photos' \
+    --tags-file='/home/josie/photos-tags.csv' \
+    --upload-to=s3.amazonaws.com/my-receiving-bucket
+
+To create a separate bag for each directory under /home/josie/collection,
+writing box_01.tar, box_02.tar, etc. into /home/josie/bags:
+
+apt-cmd bag create \
+    --profile=empty \
+    --output-file='/home/josie/bags' \
+    --bag-dir='/home/josie/collection' \
+    --split-by-dir
+
+To leave files out of the bag. Quote patterns so your shell doesn't
+expand them. A .bagignore file at the top of --bag-dir works the same way.
+
+apt-cmd bag create \
+    --profile=empty \
+    --output-file='/home/josie/project.tar' \
+    --bag-dir='/home/josie/project' \
+    --exclude='.git/**' \
+    --exclude='**/.DS_Store'
+
 Troubleshooting:
 
 1. Use the --debug flag to get the program to tell what it thinks it's
    supposed to be doing.
-2. If you use backslashes, as in the example able, be sure there are no
-   trailing spaces or any characters other than a newline following the 
+2. If you use backslashes, as in the examples above, be sure there are no
+   trailing spaces or any characters other than a newline following the
    backslash.
+3. Use --dry-run to check your tags, manifest algorithms and files
+   without writing the bag.
 
 Limitations:
 
-1. This tool currently supports only APTrust, BTR, and empty/generic 
-   BagIt profiles.
-2. For now, all bags will be output as tar files.
-3. This tool currently supports only the md5, sha1, sha256, and sha512 
-   algorithms for manifests and tag manifests.
-4. This tool currently will not generate a fetch.txt file.
+This tool currently supports only the md5, sha1, sha256, sha512,
+sha3-256 and sha3-512 algorithms for manifests and tag manifests.
 
 See also:
 
@@ -90,117 +174,665 @@ Full online documentation:
 https://aptrust.github.io/userguide/partner_tools/
 	`,
 	Run: func(cmd *cobra.Command, args []string) {
+		manifestAlgs = ResolveManifestAlgs(cmd.Flags().Changed("manifest-algs"), manifestAlgs, config)
 		if len(manifestAlgs) == 0 {
-			fmt.Println("You must specify at least one manifest algorithm. See `aptrust bag create --help`.")
-			os.Exit(EXIT_USER_ERR)
+			Fail(EXIT_USER_ERR, "You must specify at least one manifest algorithm. See `apt-cmd bag create --help`.")
 		}
 		outputFile := GetFlagValue(cmd.Flags(), "output-file", "Flag --output-file is required.")
+		if bagName := GetFlagValue(cmd.Flags(), "bag-name", ""); bagName != "" {
+			if split, _ := cmd.Flags().GetBool("split-by-dir"); split {
+				Fail(EXIT_USER_ERR, "--bag-name can't be used with --split-by-dir, which names each bag after its directory.")
+			}
+			if err := ValidateBagName(bagName); err != nil {
+				Fail(EXIT_USER_ERR, "Invalid --bag-name:", err)
+			}
+			// --output-file is the directory the bag goes into.
+			outputFile = filepath.Join(outputFile, bagName+".tar")
+		}
 		profileName := GetFlagValue(cmd.Flags(), "profile", "Flag --profile is required.")
-		bagDir := GetFlagValue(cmd.Flags(), "bag-dir", "Flag --bag-dir is required.")
+		bagDirs, _ := cmd.Flags().GetStringArray("bag-dir")
+		if len(bagDirs) == 0 {
+			Fail(EXIT_USER_ERR, "Flag --bag-dir is required.")
+		}
+
+		// Check the upload target before we spend time bagging.
+		uploadTo := GetFlagValue(cmd.Flags(), "upload-to", "")
+		uploadHost, uploadBucket := "", ""
+		if uploadTo != "" {
+			var err error
+			uploadHost, uploadBucket, err = ParseUploadTarget(uploadTo)
+			if err != nil {
+				Fail(EXIT_USER_ERR, err.Error())
+			}
+			if LooksLikePreservationBucket(uploadBucket) {
+				Fail(EXIT_USER_ERR, "Upload to preservation bucket not allowed")
+			}
+			if err = config.ValidateAWSCredentials(); err != nil {
+				Fail(EXIT_USER_ERR, "Missing S3 connection info:", err)
+			}
+		}
+
 		profile, err := LoadProfile(profileName)
 		if err != nil {
-			fmt.Fprintln(os.Stderr, err.Error())
-			os.Exit(EXIT_RUNTIME_ERR)
+			Fail(EXIT_USER_ERR, err.Error())
 		}
 
-		tags := GetTagValues(userSuppliedTags)
-		tags = EnsureDefaultTags(tags)
+		// Tags in the config are defaults. Tags on the command line
+		// replace config tags with the same file and name.
+		configTags, err := GetTagValues(config.DefaultTags)
+		if err != nil {
+			Failf(EXIT_USER_ERR, "Invalid tag in APTRUST_TAGS in %s: %s", config.ConfigSource, err.Error())
+		}
+		fileTags := make([]*bagit.TagDefinition, 0)
+		if tagsFile := cmd.Flag("tags-file").Value.String(); tagsFile != "" {
+			fileTags, err = ReadTagsFile(tagsFile)
+			if err != nil {
+				Fail(EXIT_USER_ERR, err.Error())
+			}
+		}
+		tags, err := GetTagValues(userSuppliedTags)
+		if err != nil {
+			Fail(EXIT_USER_ERR, err.Error())
+		}
+		tags = EnsureDefaultTags(MergeTags(configTags, fileTags, tags))
 
-		logger.Debug("Directory to Bag:   ", bagDir)
-		logger.Debug("Output File:        ", outputFile)
-		logger.Debug("Profile Name:       ", profileName)
-		logger.Debug("Profile:            ", profile.Name)
-		logger.Debug("Manifest Algorithms:", strings.Join(manifestAlgs, ", "))
-		logger.Debug("Tag Values:")
+		logger.Debug("Creating bag", LogFields{
+			"bagDirs":      strings.Join(bagDirs, ", "),
+			"outputFile":   outputFile,
+			"profileName":  profileName,
+			"profile":      profile.Name,
+			"manifestAlgs": strings.Join(manifestAlgs, ", "),
+			"uploadTo":     uploadTo,
+		})
+		logger.Debugf("Tag Values (%d from config and %d from --tags-file, merged with --tags):", len(configTags), len(fileTags))
 		for _, t := range tags {
-			logger.Debug("File:", t.TagFile, "Name:", t.TagName, "Value:", t.GetValue())
+			logger.Debug("Tag", LogFields{"file": t.TagFile, "name": t.TagName, "value": t.GetValue()})
 		}
 		if debug {
-			// On Linux, if the call to ValidateTags below causes an
+			// On Linux, if the call to opts.Validate below causes an
 			// exit, we exit so quickly that log messages don't get
 			// flushed to stderr. So we force that here.
 			os.Stderr.Sync()
 			time.Sleep(500 * time.Millisecond)
 		}
-		errors := ValidateTags(profile, tags)
-		if len(errors) > 0 {
-			PrintErrors(errors)
-			os.Exit(EXIT_USER_ERR)
+		// Patterns on the command line come after those in
+		// --exclude-from, so they win.
+		if excludeFrom := cmd.Flag("exclude-from").Value.String(); excludeFrom != "" {
+			patterns, err := ReadExcludeFile(excludeFrom)
+			if err != nil {
+				Fail(EXIT_USER_ERR, err.Error())
+			}
+			excludePatterns = append(patterns, excludePatterns...)
 		}
 
-		errors = ValidateManifestAlgorithms(profile, manifestAlgs)
-		if len(errors) > 0 {
-			PrintErrors(errors)
-			os.Exit(EXIT_USER_ERR)
+		format := cmd.Flag("format").Value.String()
+		compressionLevel, _ := cmd.Flags().GetInt("compression-level")
+		if cmd.Flags().Changed("compression-level") {
+			if format != BagFormatTgz {
+				Fail(EXIT_USER_ERR, "--compression-level applies only to --format=tgz.")
+			}
+			if compressionLevel < gzip.BestSpeed || compressionLevel > gzip.BestCompression {
+				Failf(EXIT_USER_ERR, "Invalid --compression-level %d. Use a number from %d to %d.", compressionLevel, gzip.BestSpeed, gzip.BestCompression)
+			}
 		}
-
-		absPath, err := filepath.Abs(bagDir)
-		if err != nil {
-			fmt.Fprintln(os.Stderr, "Can't convert", bagDir, "to absolute path.", err.Error())
-			os.Exit(EXIT_USER_ERR)
+		opts := BagCreateOptions{
+			Context:          cmd.Context(),
+			Profile:          profile,
+			BagDirs:          bagDirs,
+			OutputFile:       outputFile,
+			ManifestAlgs:     manifestAlgs,
+			Tags:             tags,
+			Format:           format,
+			CompressionLevel: compressionLevel,
+			HashEncoding:     cmd.Flag("hash-encoding").Value.String(),
+			Symlinks:         cmd.Flag("symlinks").Value.String(),
+			ExcludePatterns:  excludePatterns,
+			UploadHost:       uploadHost,
+			UploadBucket:     uploadBucket,
+			Config:           config,
+			Concurrency:      GetConcurrency(cmd.Flags()),
+			Logger:           logger,
 		}
-
-		files, err := util.RecursiveFileList(absPath)
-		if err != nil {
-			fmt.Fprintln(os.Stderr, "Cannot build list of all files to be bagged. Be sure you have read permissions on all of these files.", err.Error())
-			os.Exit(EXIT_USER_ERR)
+		opts.NoBagignore, _ = cmd.Flags().GetBool("no-bagignore")
+		opts.SkipUnreadable, _ = cmd.Flags().GetBool("skip-unreadable")
+		opts.KeepEmptyDirs, _ = cmd.Flags().GetBool("keep-empty-dirs")
+		opts.Reproducible, _ = cmd.Flags().GetBool("reproducible")
+		opts.PayloadDir = cmd.Flag("payload-dir").Value.String()
+		opts.StrictTags, _ = cmd.Flags().GetBool("strict-tags")
+		opts.RehashChanged, _ = cmd.Flags().GetBool("rehash-changed")
+		opts.ReportDuplicates, _ = cmd.Flags().GetBool("report-duplicates")
+		opts.FailOnDuplicates, _ = cmd.Flags().GetBool("fail-on-duplicates")
+		opts.DryRun, _ = cmd.Flags().GetBool("dry-run")
+		opts.NoClobber, _ = cmd.Flags().GetBool("no-clobber")
+		opts.Force, _ = cmd.Flags().GetBool("force")
+		opts.Progress, _ = cmd.Flags().GetBool("progress")
+		opts.TUI, _ = cmd.Flags().GetBool("tui")
+		opts.SkipValidation, _ = cmd.Flags().GetBool("skip-validation")
+		opts.Verify, _ = cmd.Flags().GetBool("verify")
+		opts.Stream, _ = cmd.Flags().GetBool("stream")
+		opts.KeepLocal, _ = cmd.Flags().GetBool("keep-local")
+		opts.UploadKey = cmd.Flag("upload-key").Value.String()
+		if fetchFrom := cmd.Flag("fetch-from").Value.String(); fetchFrom != "" {
+			if opts.Fetch, err = ReadFetchFile(fetchFrom); err != nil {
+				Fail(EXIT_USER_ERR, err.Error())
+			}
 		}
-
-		// Don't loop through these unless we have to.
-		// There could be a million of them.
-		if debug {
-			logger.Debug("Absolute path of directory to bag:", absPath)
-			logger.Debug("Files to bag:")
-			for _, f := range files {
-				logger.Debug(f.FullPath)
+		for _, line := range fetchEntries {
+			entry, err := ParseFetchEntry(line)
+			if err != nil {
+				Fail(EXIT_USER_ERR, "Invalid --fetch:", err)
 			}
+			opts.Fetch = append(opts.Fetch, entry)
 		}
-
-		// Apply the user-supplied tag values
-		for _, tag := range tags {
-			profile.SetTagValue(tag.TagFile, tag.TagName, tag.GetValue())
+		if err = opts.Validate(); err != nil {
+			Fail(EXIT_USER_ERR, err.Error())
 		}
-
-		absOutputPath, err := filepath.Abs(outputFile)
-		if err != nil {
-			fmt.Fprintln(os.Stderr, "Cannot determine absolute output path.", err)
-			os.Exit(EXIT_RUNTIME_ERR)
+		if !opts.StrictTags {
+			for _, problem := range UnknownTags(profile, tags) {
+				fmt.Fprintln(os.Stderr, "Warning:", problem)
+			}
 		}
-		logger.Debug("Absolute path of output file:", absOutputPath)
 
-		// Make sure the directory for our output target exists
-		outputDir := path.Dir(absOutputPath)
-		if !util.FileExists(outputDir) {
-			logger.Debugf("Creating directory %s because it doesn't exist.", outputDir)
-			err = os.MkdirAll(outputDir, 0755)
+		splitByDir, _ := cmd.Flags().GetBool("split-by-dir")
+		if splitByDir && len(bagDirs) > 1 {
+			Fail(EXIT_USER_ERR, "--split-by-dir can't be used with more than one --bag-dir.")
+		}
+		if splitByDir && opts.UploadKey != "" {
+			Fail(EXIT_USER_ERR, "--upload-key can't be used with --split-by-dir, since each bag needs its own key.")
+		}
+		if splitByDir && len(opts.Fetch) > 0 {
+			Fail(EXIT_USER_ERR, "--fetch can't be used with --split-by-dir, since each bag has its own payload.")
+		}
+		maxBagSize := int64(0)
+		if maxBagSizeFlag := cmd.Flag("max-bag-size").Value.String(); maxBagSizeFlag != "" {
+			size, err := humanize.ParseBytes(maxBagSizeFlag)
+			if err != nil || size == 0 {
+				Fail(EXIT_USER_ERR, "Invalid --max-bag-size", maxBagSizeFlag, "- try a number of bytes, or a size like 500GB")
+			}
+			maxBagSize = int64(size)
+			if splitByDir {
+				Fail(EXIT_USER_ERR, "--max-bag-size can't be used with --split-by-dir.")
+			}
+			if opts.UploadKey != "" {
+				Fail(EXIT_USER_ERR, "--upload-key can't be used with --max-bag-size, since each bag needs its own key.")
+			}
+			if len(opts.Fetch) > 0 {
+				Fail(EXIT_USER_ERR, "--fetch can't be used with --max-bag-size, since each bag has its own payload.")
+			}
+			if FindTag(tags, "bag-info.txt", "Bag-Count") != nil {
+				Fail(EXIT_USER_ERR, "--max-bag-size sets Bag-Count itself, so don't set it with --tags.")
+			}
+		}
+		if opts.TUI && opts.Progress {
+			Fail(EXIT_USER_ERR, "--progress can't be used with --tui, which already shows progress.")
+		}
+		if jobFile := cmd.Flag("emit-job-file").Value.String(); jobFile != "" {
+			if opts.DryRun {
+				Fail(EXIT_USER_ERR, "--emit-job-file can't be used with --dry-run, since a dry run doesn't write anything.")
+			}
+			if splitByDir {
+				Fail(EXIT_USER_ERR, "--emit-job-file can't be used with --split-by-dir, since a DART job creates only one bag.")
+			}
+			if maxBagSize > 0 {
+				Fail(EXIT_USER_ERR, "--emit-job-file can't be used with --max-bag-size, since a DART job creates only one bag.")
+			}
+			if format == BagFormatTgz {
+				Fail(EXIT_USER_ERR, "--emit-job-file can't be used with --format=tgz, since DART jobs don't compress bags.")
+			}
+			if len(BaggerAlgorithms(manifestAlgs)) < len(manifestAlgs) {
+				Failf(EXIT_USER_ERR, "--emit-job-file can't be used with the %s manifest algorithms, since DART doesn't support them.", strings.Join(ExtraManifestAlgorithms, " or "))
+			}
+			if len(excludePatterns) > 0 {
+				Fail(EXIT_USER_ERR, "--emit-job-file can't be used with --exclude or --exclude-from, since a DART job bags everything in --bag-dir.")
+			}
+			if len(opts.Fetch) > 0 {
+				Fail(EXIT_USER_ERR, "--emit-job-file can't be used with --fetch or --fetch-from, since DART jobs don't write fetch.txt.")
+			}
+			if !opts.NoBagignore {
+				for _, bagDir := range bagDirs {
+					if util.FileExists(filepath.Join(bagDir, BagignoreFile)) {
+						Failf(EXIT_USER_ERR, "--emit-job-file can't honor %s, since a DART job bags everything in --bag-dir. Add --no-bagignore to bag everything.", filepath.Join(bagDir, BagignoreFile))
+					}
+				}
+			}
+			job, err := NewDartJob(PrepareProfile(profile, manifestAlgs, tags), bagDirs, outputFile, format, uploadHost, uploadBucket)
+			if err == nil {
+				err = WriteDartJob(job, jobFile)
+			}
 			if err != nil {
-				fmt.Fprintln(os.Stderr, "Error creating output directory", outputDir, ":", err)
-				os.Exit(EXIT_RUNTIME_ERR)
+				Fail(EXIT_RUNTIME_ERR, "Error writing job file:", err)
 			}
+			logger.Debugf("Wrote DART job file %s", jobFile)
+		}
+		if maxBagSize > 0 {
+			parts, err := PlanBagParts(opts, maxBagSize)
+			if err != nil {
+				Fail(BagCreateExitCode(err), err.Error())
+			}
+			if len(parts) > 1 {
+				os.Exit(createMultipartBag(cmd.Context(), opts, parts, maxBagSize, GetConcurrency(cmd.Flags())))
+			}
+		}
+		if !splitByDir {
+			result, exitCode := createBag(cmd.Context(), opts, "")
+			if result != "" {
+				printResult(json.RawMessage(result))
+			}
+			os.Exit(exitCode)
 		}
 
-		// Create the bag
-		bagger := bagit.NewBagger(absOutputPath, profile, files)
-		ok := bagger.Run()
-		if !ok {
-			for key, value := range bagger.Errors {
-				fmt.Fprintln(os.Stderr, key, ":", value)
+		// One bag per top-level directory, all with the same tags.
+		// --output-file is the directory we write the bags into.
+		bagDirs, looseFiles, err := ListChildDirs(bagDirs[0], outputFile)
+		if err != nil {
+			Fail(EXIT_USER_ERR, err.Error())
+		}
+		for _, looseFile := range looseFiles {
+			logger.Warningf("Not bagging %s because --split-by-dir bags only directories.", looseFile)
+		}
+		childOpts := make([]BagCreateOptions, len(bagDirs))
+		extras := make([]string, len(bagDirs))
+		for i, childDir := range bagDirs {
+			childOpts[i] = opts
+			childOpts[i].BagDirs = []string{childDir}
+			childOpts[i].OutputFile = filepath.Join(outputFile, filepath.Base(childDir)+".tar")
+			extras[i] = fmt.Sprintf(`, "bagDir": %s`, jsonString(childDir))
+		}
+		results, exitCodes := createBags(cmd.Context(), childOpts, extras, GetConcurrency(cmd.Flags()), func(i int) {
+			logger.Infof("Bagging %s into %s", bagDirs[i], childOpts[i].OutputFile)
+		})
+		exitCode := EXIT_OK
+		for i, childDir := range bagDirs {
+			if results[i] == "" {
+				results[i] = fmt.Sprintf(`{ "result": "Failed", "outputFile": %s, "bagDir": %s }`, jsonString(BagOutputPath(childOpts[i].OutputFile, format)), jsonString(childDir))
+			}
+			if exitCodes[i] != EXIT_OK && exitCode == EXIT_OK {
+				exitCode = exitCodes[i]
 			}
-			os.Exit(EXIT_RUNTIME_ERR)
 		}
-		msg := fmt.Sprintf(`{ "result": "OK", "outputFile": "%s" }`, bagger.OutputPath)
-		fmt.Println(msg)
-		os.Exit(EXIT_OK)
+		printResult(json.RawMessage(fmt.Sprintf("[\n  %s\n]", strings.Join(results, ",\n  "))))
+		os.Exit(exitCode)
 	},
 }
 
 func init() {
 	bagCmd.AddCommand(createCmd)
-	createCmd.Flags().StringP("profile", "p", "", "BagIt profile: 'aptrust', 'btr' or 'empty'")
-	createCmd.Flags().StringP("bag-dir", "b", "", "Directory containing files you want to package into a bag")
+	createCmd.Flags().StringP("profile", "p", "", "BagIt profile: 'aptrust', 'btr', 'empty', or the path to a .json profile")
+	createCmd.Flags().StringArrayVar(&excludePatterns, "exclude", []string{}, "Leave out files and directories matching this glob pattern, such as '*.tmp', '.git/**' or '**/.DS_Store'. You can specify this flag multiple times.")
+	createCmd.Flags().String("exclude-from", "", "Leave out files and directories matching the patterns in this file, one per line")
+	createCmd.Flags().Bool("no-bagignore", false, "Ignore the .bagignore file in --bag-dir")
+	createCmd.Flags().Bool("keep-empty-dirs", false, "Add an empty .keep file to each empty directory, so the bag preserves the directory structure")
+	createCmd.Flags().Bool("strict-tags", false, "Treat tags that the profile doesn't define as errors, instead of warning about them")
+	createCmd.Flags().String("payload-dir", DefaultPayloadDir, "Name of the bag's payload directory, for repositories that don't use data")
+	createCmd.Flags().Bool("reproducible", false, "Make the same files and options always give a byte-identical bag, with fixed timestamps and owners and no volatile Bagging-Date")
+	createCmd.Flags().String("symlinks", SymlinksSkip, "What to do with symbolic links: skip them, follow them and bag what they point to, or exit with an error")
+	createCmd.Flags().StringArrayVar(&fetchEntries, "fetch", []string{}, "Leave this payload file out of the bag and list it in fetch.txt, given as 'URL LENGTH FILENAME'. You can specify this flag multiple times.")
+	createCmd.Flags().String("fetch-from", "", "Leave out the payload files listed in this file, one 'URL LENGTH FILENAME' entry per line, and list them in fetch.txt")
+	createCmd.Flags().StringArrayP("bag-dir", "b", []string{}, "Directory containing files you want to package into a bag. Repeat to bag several directories into one bag.")
 	createCmd.Flags().StringP("output-file", "o", "", "Output file. Where should we write the bag?")
-	createCmd.Flags().StringSliceVarP(&manifestAlgs, "manifest-algs", "m", []string{""}, "Manifest algorithms. Specify one, or use comma-separated list for multiple. Supported algorithms: md5, sha1, sha256, sha512. Default is sha256.")
-	createCmd.Flags().StringSliceVarP(&userSuppliedTags, "tags", "t", []string{""}, "Tag values to write into tag files. You can specify this flag multiple times. See --help for full documentation.")
+	createCmd.Flags().String("bag-name", "", "Name of the bag, without an extension. --output-file is then the directory to write the bag into.")
+	createCmd.Flags().StringSliceVarP(&manifestAlgs, "manifest-algs", "m", []string{DefaultManifestAlg}, "Manifest algorithms. Specify one, or use comma-separated list for multiple. Supported algorithms: md5, sha1, sha256, sha512, sha3-256, sha3-512. If omitted, uses APTRUST_DEFAULT_MANIFEST_ALGS from your config, or sha256.")
+	createCmd.Flags().String("format", BagFormatTar, "Bag format: tar, directory, zip or tgz")
+	createCmd.Flags().Int("compression-level", DefaultCompressionLevel, "Gzip compression level for --format=tgz, from 1 (fastest) to 9 (smallest)")
+	createCmd.Flags().String("hash-encoding", HashEncodingHexLower, "Encoding for digests in manifests and tag manifests: hex-lower, hex-upper, or base64")
+	createCmd.Flags().StringP("upload-to", "u", "", "Upload the bag to this S3 host and bucket after creating it. E.g. s3.amazonaws.com/my-bucket")
+	createCmd.Flags().String("upload-key", "", "With --upload-to, the bag's key in the bucket. Defaults to the name of the output file.")
+	createCmd.Flags().Bool("stream", false, "With --upload-to, bag straight into the upload without writing the bag to disk")
+	createCmd.Flags().Bool("keep-local", false, "With --stream, write the bag to --output-file too, in the same pass")
+	createCmd.Flags().Bool("report-duplicates", false, "List payload files with identical contents in the output")
+	createCmd.Flags().Bool("fail-on-duplicates", false, "Delete the bag and exit with an error if any payload files have identical contents")
+	createCmd.Flags().String("emit-job-file", "", "Write a DART job file describing this bagging operation to this path")
+	createCmd.Flags().Bool("progress", false, "Print bagging progress to stderr, as a line of text on a terminal or as JSON lines otherwise")
+	createCmd.Flags().Bool("no-clobber", false, "Exit with an error instead of replacing an existing bag at the output path")
+	createCmd.Flags().Bool("force", false, "Replace an existing tar, zip or tgz bag at the output path without a warning")
+	createCmd.Flags().Bool("dry-run", false, "Check tags, manifest algorithms and files, and print what would be bagged, without writing anything")
+	createCmd.Flags().Bool("verify", false, "Validate the bag after creating it, and exit with an error if it's invalid")
+	createCmd.Flags().Bool("skip-validation", false, "With --upload-to, upload the bag without validating it first")
+	createCmd.Flags().Bool("tui", false, "Show the progress of each phase of bagging and uploading. Draws a dashboard on a terminal, or writes progress lines to stderr otherwise.")
+	createCmd.Flags().Bool("rehash-changed", false, "If files change while they're being bagged, bag them again instead of exiting with an error. Changed files are listed in the output.")
+	createCmd.Flags().Bool("split-by-dir", false, "Create a separate bag for each directory directly under --bag-dir, named after that directory. --output-file is the directory for the bags.")
+	createCmd.Flags().String("max-bag-size", "", "Split the payload into several bags of at most this size, such as 500GB, if it doesn't fit in one")
+	createCmd.Flags().Bool("skip-unreadable", false, "Leave out files that can't be read instead of exiting before bagging begins. Skipped files are listed in the output.")
+	createCmd.Flags().String("tags-file", "", "JSON or CSV file of tag values to write into tag files. --tags replaces tags in this file with the same file and name.")
+	createCmd.Flags().StringArrayVarP(&userSuppliedTags, "tags", "t", []string{}, "Tag values to write into tag files. You can specify this flag multiple times. See --help for full documentation.")
+	registerFlagCompletion(createCmd, "profile", completeProfile)
+	registerFlagCompletion(createCmd, "format", completeValues(BagFormats...))
+	registerFlagCompletion(createCmd, "hash-encoding", completeValues(HashEncodings...))
+	registerFlagCompletion(createCmd, "symlinks", completeValues(SymlinkPolicies...))
+	registerFlagCompletion(createCmd, "manifest-algs", completeValues(SupportedManifestAlgorithms...))
+}
+
+// ResolveManifestAlgs returns the manifest algorithms bag create should
+// use. If the user set the --manifest-algs flag (flagChanged), that's
+// flagAlgs. Otherwise, it's the comma-separated list in the config's
+// DefaultManifestAlgs, or DefaultManifestAlg if the config doesn't
+// specify a default.
+//
+// This drops blank entries, so --manifest-algs="" and --manifest-algs=","
+// resolve to an empty list rather than a list containing an empty
+// algorithm name. The caller should tell the user they need to specify
+// at least one algorithm.
+func ResolveManifestAlgs(flagChanged bool, flagAlgs []string, config *Config) []string {
+	if flagChanged {
+		return cleanAlgList(flagAlgs)
+	}
+	if config != nil && config.DefaultManifestAlgs != "" {
+		return cleanAlgList(strings.Split(config.DefaultManifestAlgs, ","))
+	}
+	return []string{DefaultManifestAlg}
+}
+
+// cleanAlgList trims whitespace from algorithm names and
+// removes empty names.
+func cleanAlgList(algs []string) []string {
+	cleanAlgs := make([]string, 0, len(algs))
+	for _, alg := range algs {
+		alg = strings.TrimSpace(alg)
+		if alg != "" {
+			cleanAlgs = append(cleanAlgs, alg)
+		}
+	}
+	return cleanAlgs
+}
+
+// createBag runs RunBagCreate for bag create. It prints errors to
+// stderr and returns the result JSON, which is empty if no bag was
+// created, plus the exit code. Param resultExtras contains extra fields
+// for the result JSON. This exits with EXIT_CANCELED if ctx is
+// canceled.
+func createBag(ctx context.Context, opts BagCreateOptions, resultExtras string) (string, int) {
+	result, err := RunBagCreate(opts)
+	if err != nil {
+		ExitIfCanceled(ctx)
+		if jsonErrors {
+			exitCode := BagCreateExitCode(err)
+			return NewErrorResult(exitCode, strings.Split(err.Error(), "\n")...).JSON(resultExtras), exitCode
+		}
+		fmt.Fprintln(os.Stderr, err.Error())
+	}
+	if result == nil {
+		return "", BagCreateExitCode(err)
+	}
+	return result.JSON(resultExtras), BagCreateExitCode(err)
+}
+
+// createBags runs createBag for each of opts, concurrency at a time,
+// and returns the result JSON and exit code of each, in the order of
+// opts. resultExtras holds the extra result fields of each bag. If
+// start isn't nil, it's called with the index of each bag as bagging
+// begins. Bags with progress or a dashboard are created one at a time,
+// since they share the terminal.
+func createBags(ctx context.Context, opts []BagCreateOptions, resultExtras []string, concurrency int, start func(int)) ([]string, []int) {
+	results := make([]string, len(opts))
+	exitCodes := make([]int, len(opts))
+	if concurrency < 1 || (len(opts) > 0 && (opts[0].Progress || opts[0].TUI)) {
+		concurrency = 1
+	}
+	pending := make(chan int, len(opts))
+	for i := range opts {
+		pending <- i
+	}
+	close(pending)
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for index := range pending {
+				if start != nil {
+					start(index)
+				}
+				results[index], exitCodes[index] = createBag(ctx, opts[index], resultExtras[index])
+			}
+		}()
+	}
+	wg.Wait()
+	return results, exitCodes
+}
+
+// createMultipartBag creates one bag for each of parts, which come from
+// PlanBagParts, for bag create --max-bag-size, concurrency at a time.
+// Each bag gets a numbered output file and the BagIt Bag-Count and
+// Bag-Group-Identifier tags. The group identifier is the name of the
+// unsplit bag, unless the user set one. It prints a JSON array with one
+// result per bag, in order, and returns the exit code. As with
+// --split-by-dir, if one bag fails, the others are still created, and
+// the exit code is that of the first failure.
+func createMultipartBag(ctx context.Context, opts BagCreateOptions, parts [][]string, maxBagSize int64, concurrency int) int {
+	groupTags := make([]*bagit.TagDefinition, 0, 2)
+	if FindTag(opts.Tags, "bag-info.txt", "Bag-Group-Identifier") == nil {
+		groupTags = append(groupTags, &bagit.TagDefinition{
+			TagFile:   "bag-info.txt",
+			TagName:   "Bag-Group-Identifier",
+			UserValue: util.CleanBagName(filepath.Base(opts.OutputFile)),
+		})
+	}
+	partOpts := make([]BagCreateOptions, len(parts))
+	bagCounts := make([]string, len(parts))
+	extras := make([]string, len(parts))
+	for i, part := range parts {
+		bagCounts[i] = fmt.Sprintf("%d of %d", i+1, len(parts))
+		partOpts[i] = opts
+		partOpts[i].Files = part
+		partOpts[i].OutputFile = MultipartOutputFile(opts.OutputFile, i+1, len(parts))
+		partOpts[i].Tags = append(append(append([]*bagit.TagDefinition{}, opts.Tags...), groupTags...), &bagit.TagDefinition{
+			TagFile:   "bag-info.txt",
+			TagName:   "Bag-Count",
+			UserValue: bagCounts[i],
+		})
+		extras[i] = fmt.Sprintf(`, "bagCount": "%s"`, bagCounts[i])
+	}
+	results, exitCodes := createBags(ctx, partOpts, extras, concurrency, func(i int) {
+		logger.Infof("Bagging part %s into %s", bagCounts[i], partOpts[i].OutputFile)
+	})
+	exitCode := EXIT_OK
+	for i := range parts {
+		outputPath := BagOutputPath(partOpts[i].OutputFile, partOpts[i].Format)
+		if results[i] == "" {
+			results[i] = fmt.Sprintf(`{ "result": "Failed", "outputFile": %s, "bagCount": "%s" }`, jsonString(outputPath), bagCounts[i])
+		}
+		// Tag files and manifests add a little to the payload.
+		if stat, err := os.Stat(outputPath); exitCodes[i] == EXIT_OK && err == nil && !stat.IsDir() && stat.Size() > maxBagSize {
+			logger.Warningf("Bag %s is %d bytes, which is more than --max-bag-size, because of its tag files and manifests.", outputPath, stat.Size())
+		}
+		if exitCodes[i] != EXIT_OK && exitCode == EXIT_OK {
+			exitCode = exitCodes[i]
+		}
+	}
+	printResult(json.RawMessage(fmt.Sprintf("[\n  %s\n]", strings.Join(results, ",\n  "))))
+	return exitCode
+}
+
+// watchBagger updates the dashboard's hashing and writing phases from
+// the size of the tar file the bagger is writing, since the bagger
+// doesn't report its progress. The bagger hashes each payload file as
+// it writes it into the tar file, then writes the tag files and
+// manifests. This returns a function that stops watching and marks
+// both phases finished.
+func watchBagger(dashboard *Dashboard, outputPath string, files []*util.ExtendedFileInfo) func() {
+	if dashboard == nil {
+		return func() {}
+	}
+	// Each tar entry is a 512-byte header, followed by the file's
+	// data padded to a multiple of 512 bytes.
+	payloadBytes, payloadTarBytes := int64(0), int64(0)
+	for _, f := range files {
+		payloadTarBytes += 512
+		if f.FileInfo != nil && f.Mode().IsRegular() {
+			payloadBytes += f.Size()
+			payloadTarBytes += (f.Size() + 511) / 512 * 512
+		}
+	}
+	outputSize := func() int64 {
+		if stat, err := os.Stat(outputPath); err == nil {
+			return stat.Size()
+		}
+		return 0
+	}
+	dashboard.Start("hashing", "bytes", payloadBytes)
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(DashboardInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				size := outputSize()
+				if size < payloadTarBytes {
+					// Bytes written is a close enough estimate of
+					// payload bytes hashed.
+					dashboard.Set("hashing", size*payloadBytes/payloadTarBytes)
+				} else if !dashboard.Phase("hashing").IsFinished() {
+					dashboard.Finish("hashing", payloadBytes)
+					dashboard.Start("writing", "bytes", 0)
+				} else {
+					dashboard.Set("writing", size-payloadTarBytes)
+				}
+			}
+		}
+	}()
+	return func() {
+		close(stop)
+		<-stopped
+		if !dashboard.Phase("hashing").IsFinished() {
+			dashboard.Finish("hashing", payloadBytes)
+			dashboard.Start("writing", "bytes", 0)
+		}
+		tagBytes := outputSize() - payloadTarBytes
+		if tagBytes < 0 {
+			tagBytes = 0
+		}
+		dashboard.Finish("writing", tagBytes)
+	}
+}
+
+// ListChildDirs returns the absolute paths of the immediate child
+// directories of bagDir, sorted by name, for bag create --split-by-dir.
+// It skips outputDir, in case the user writes bags into bagDir. It also
+// returns the files directly under bagDir, which aren't in any child
+// directory, so the caller can warn that they won't be bagged.
+func ListChildDirs(bagDir, outputDir string) ([]string, []string, error) {
+	absBagDir, err := filepath.Abs(bagDir)
+	if err != nil {
+		return nil, nil, fmt.Errorf("can't convert %s to absolute path: %w", bagDir, err)
+	}
+	absOutputDir, err := filepath.Abs(outputDir)
+	if err != nil {
+		return nil, nil, fmt.Errorf("can't convert %s to absolute path: %w", outputDir, err)
+	}
+	entries, err := os.ReadDir(absBagDir)
+	if err != nil {
+		return nil, nil, fmt.Errorf("can't read directory %s: %w", bagDir, err)
+	}
+	childDirs := make([]string, 0)
+	looseFiles := make([]string, 0)
+	for _, entry := range entries {
+		childDir := filepath.Join(absBagDir, entry.Name())
+		if !entry.IsDir() {
+			looseFiles = append(looseFiles, childDir)
+			continue
+		}
+		if childDir == absOutputDir {
+			continue
+		}
+		childDirs = append(childDirs, childDir)
+	}
+	if len(childDirs) == 0 {
+		return nil, nil, fmt.Errorf("--split-by-dir found no directories in %s", bagDir)
+	}
+	return childDirs, looseFiles, nil
+}
+
+// ParseUploadTarget parses the value of the --upload-to flag, which
+// should be an S3 host and bucket separated by a slash, such as
+// "s3.amazonaws.com/my-bucket". It returns the host and bucket.
+func ParseUploadTarget(target string) (string, string, error) {
+	parts := strings.Split(strings.Trim(target, "/"), "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", fmt.Errorf("invalid upload target '%s'. Use host/bucket, e.g. s3.amazonaws.com/my-bucket", target)
+	}
+	return parts[0], parts[1], nil
+}
+
+// PayloadSize returns the number of regular files in files and their
+// total size in bytes. It skips directories and files we couldn't stat.
+func PayloadSize(files []*util.ExtendedFileInfo) (int, int64) {
+	count, size := 0, int64(0)
+	for _, f := range files {
+		if f.FileInfo != nil && f.Mode().IsRegular() {
+			count++
+			size += f.Size()
+		}
+	}
+	return count, size
+}
+
+// FindUnreadableFiles checks that each file in the list can be opened
+// for reading. It returns the files that can be read, plus a map of
+// unreadable file paths to the reason they can't be read. Entries with
+// no file info are ones the directory walk couldn't stat.
+func FindUnreadableFiles(files []*util.ExtendedFileInfo) ([]*util.ExtendedFileInfo, map[string]string) {
+	readable := make([]*util.ExtendedFileInfo, 0, len(files))
+	unreadable := make(map[string]string)
+	for _, f := range files {
+		// The directory walk lists an unreadable directory a second
+		// time after it fails to read the directory's contents.
+		if _, alreadyFound := unreadable[f.FullPath]; alreadyFound {
+			continue
+		}
+		if f.FileInfo == nil {
+			unreadable[f.FullPath] = "cannot stat file"
+			continue
+		}
+		file, err := os.Open(f.FullPath)
+		if err == nil && f.IsDir() {
+			_, err = file.Readdirnames(1)
+			if err == io.EOF {
+				err = nil
+			}
+		}
+		if file != nil {
+			file.Close()
+		}
+		if err != nil {
+			unreadable[f.FullPath] = err.Error()
+			continue
+		}
+		readable = append(readable, f)
+	}
+	return readable, unreadable
+}
+
+// FindChangedFiles checks whether any of the files in the list have
+// changed size or modification time since they were listed. It returns
+// an updated file list, and the paths of the files that changed.
+// Changed files get fresh file info in the updated list, and files
+// that were deleted are dropped from it. Directories are not checked.
+func FindChangedFiles(files []*util.ExtendedFileInfo) ([]*util.ExtendedFileInfo, []string) {
+	updated := make([]*util.ExtendedFileInfo, 0, len(files))
+	changed := make([]string, 0)
+	for _, f := range files {
+		if f.FileInfo == nil || !f.Mode().IsRegular() {
+			updated = append(updated, f)
+			continue
+		}
+		current, err := os.Stat(f.FullPath)
+		if err != nil {
+			changed = append(changed, f.FullPath)
+			continue
+		}
+		if current.Size() != f.Size() || !current.ModTime().Equal(f.ModTime()) {
+			changed = append(changed, f.FullPath)
+			updated = append(updated, util.NewExtendedFileInfo(f.FullPath, current))
+			continue
+		}
+		updated = append(updated, f)
+	}
+	return updated, changed
 }
 
 func EnsureDefaultTags(tags []*bagit.TagDefinition) []*bagit.TagDefinition {
@@ -229,36 +861,193 @@ func EnsureDefaultTags(tags []*bagit.TagDefinition) []*bagit.TagDefinition {
 	return tags
 }
 
+// SetTagValues sets the user's tag values in the profile, so the
+// bagger writes them to the tag files. Unlike profile.SetTagValue,
+// which keeps one value per tag, this allows a tag to repeat, as with
+// several Contact-Name tags in bag-info.txt. The first value of each
+// tag goes into the profile's definition of the tag. Each additional
+// value goes into a copy of the definition, just after the previous
+// one, so the bagger writes the values on separate lines in the order
+// they're given.
+//
+// Tag files and names match the profile's regardless of case, and the
+// tag files get the profile's casing, so source-organization sets the
+// profile's Source-Organization. See CanonicalTagName.
+func SetTagValues(profile *bagit.Profile, tags []*bagit.TagDefinition) {
+	lastDefs := make(map[string]*bagit.TagDefinition)
+	for _, tag := range tags {
+		key := tagKey(tag.TagFile, tag.TagName)
+		lastDef := lastDefs[key]
+		if lastDef == nil {
+			tagFile, tagName := CanonicalTagName(profile, tag.TagFile, tag.TagName)
+			profile.SetTagValue(tagFile, tagName, tag.GetValue())
+			lastDefs[key] = FindTag(profile.Tags, tagFile, tagName)
+			continue
+		}
+		repeated := lastDef.Copy()
+		repeated.ID = uuid.New().String()
+		repeated.UserValue = tag.GetValue()
+		for i, tagDef := range profile.Tags {
+			if tagDef == lastDef {
+				profile.Tags = append(profile.Tags[:i+1], append([]*bagit.TagDefinition{repeated}, profile.Tags[i+1:]...)...)
+				break
+			}
+		}
+		lastDefs[key] = repeated
+	}
+}
+
 // ValidateTags verifies that tags required by the BagIt profile are
 // present and contain valid values. We check this BEFORE bagging because
 // in case where the user is packaging 500+ GB, they don't want to wait
 // two hours to find out their bag is invalid.
+//
+// This skips tags in autoGeneratedTags that the user didn't supply,
+// since the bagger will set those. Values the user does supply replace
+// the bagger's, except for calculatedTags, which the user can't set.
+// The user may repeat a tag. Each
+// value must be legal, and a required tag needs only one non-empty
+// value. Tag files and names match regardless of case.
 func ValidateTags(profile *bagit.Profile, tags []*bagit.TagDefinition) []string {
 	errors := make([]string, 0)
 	for _, tagDef := range profile.Tags {
 		hasValue := false
-		userTag := FindTag(tags, tagDef.TagFile, tagDef.TagName)
-		if tagDef.Required && userTag == nil {
+		userTags := FindTags(tags, tagDef.TagFile, tagDef.TagName)
+		if len(userTags) == 0 && util.StringListContains(autoGeneratedTags, tagDef.TagFile+"/"+tagDef.TagName) {
+			continue
+		}
+		if tagDef.Required && len(userTags) == 0 {
 			errors = append(errors, fmt.Sprintf("Required tag %s/%s is missing.", tagDef.TagFile, tagDef.TagName))
 			continue
 		}
-		if userTag != nil && userTag.UserValue != "" {
-			hasValue = true
+		hasIllegalValue := false
+		for _, userTag := range userTags {
+			if userTag.UserValue != "" {
+				hasValue = true
+			}
+			if !tagDef.IsLegalValue(userTag.UserValue) {
+				errors = append(errors, fmt.Sprintf("Tag %s/%s assigned illegal value '%s'. Valid values are: %s.", tagDef.TagFile, tagDef.TagName, userTag.UserValue, strings.Join(tagDef.Values, ",")))
+				hasIllegalValue = true
+			} else if problem := tagPatternProblem(profile, tagDef, userTag.UserValue); problem != "" {
+				errors = append(errors, problem)
+				hasIllegalValue = true
+			}
 		}
-		if userTag != nil && !tagDef.IsLegalValue(userTag.UserValue) {
-			errors = append(errors, fmt.Sprintf("Tag %s/%s assigned illegal value '%s'. Valid values are: %s.", tagDef.TagFile, tagDef.TagName, userTag.UserValue, strings.Join(tagDef.Values, ",")))
+		if hasIllegalValue {
 			continue
 		}
 		if tagDef.Required && !tagDef.EmptyOK && !hasValue {
 			errors = append(errors, fmt.Sprintf("Tag %s/%s is present but value cannot be empty. Please assign a value.", tagDef.TagFile, tagDef.TagName))
 		}
 	}
+	for _, key := range calculatedTags {
+		parts := strings.SplitN(key, "/", 2)
+		if FindTag(tags, parts[0], parts[1]) != nil {
+			errors = append(errors, fmt.Sprintf("Tag %s is calculated from the payload, so it can't be set.", key))
+		}
+	}
 	return errors
 }
 
+// standardTags are the tags the BagIt spec defines for bagit.txt and
+// bag-info.txt, along with the ones bag create adds. They're never
+// unknown, even if a profile doesn't list them.
+var standardTags = append([]string{
+	"bagit.txt/BagIt-Version",
+	"bagit.txt/Tag-File-Character-Encoding",
+	"bag-info.txt/Source-Organization",
+	"bag-info.txt/Organization-Address",
+	"bag-info.txt/Contact-Name",
+	"bag-info.txt/Contact-Phone",
+	"bag-info.txt/Contact-Email",
+	"bag-info.txt/External-Description",
+	"bag-info.txt/External-Identifier",
+	"bag-info.txt/Bag-Group-Identifier",
+	"bag-info.txt/Bag-Count",
+	"bag-info.txt/Internal-Sender-Identifier",
+	"bag-info.txt/Internal-Sender-Description",
+}, autoGeneratedTags...)
+
+// UnknownTags describes each tag in tags that profile doesn't define
+// and that isn't one of the BagIt spec's standard tags, which is often
+// a typo. When a known tag's name is close to the unknown one, the
+// description suggests it. bag create warns about these, or with
+// --strict-tags, treats them as errors, along with those
+// ValidateTags reports.
+func UnknownTags(profile *bagit.Profile, tags []*bagit.TagDefinition) []string {
+	known := append([]string{}, standardTags...)
+	for _, tagDef := range profile.Tags {
+		known = append(known, tagDef.TagFile+"/"+tagDef.TagName)
+	}
+	isKnown := make(map[string]bool)
+	for _, key := range known {
+		isKnown[strings.ToLower(key)] = true
+	}
+	problems := make([]string, 0)
+	reported := make(map[string]bool)
+	for _, tag := range tags {
+		key := tag.TagFile + "/" + tag.TagName
+		if isKnown[strings.ToLower(key)] || reported[strings.ToLower(key)] {
+			continue
+		}
+		reported[strings.ToLower(key)] = true
+		problem := fmt.Sprintf("Tag %s is not defined in profile %s.", key, profile.Name)
+		if suggestion := closestName(key, known); suggestion != "" {
+			problem += fmt.Sprintf(" Did you mean %s?", suggestion)
+		}
+		problems = append(problems, problem)
+	}
+	return problems
+}
+
+// closestName returns the name in known that's closest to key, such
+// as the tag with the closest file and name, ignoring case, if it's
+// close enough to be a likely typo.
+func closestName(key string, known []string) string {
+	closest := ""
+	closestDistance := len(key)/3 + 1
+	for _, candidate := range known {
+		distance := editDistance(strings.ToLower(key), strings.ToLower(candidate))
+		if distance < closestDistance {
+			closest, closestDistance = candidate, distance
+		}
+	}
+	return closest
+}
+
+// editDistance returns the Levenshtein distance between a and b: the
+// number of single-character insertions, deletions and substitutions
+// that turn one into the other.
+func editDistance(a, b string) int {
+	s, t := []rune(a), []rune(b)
+	previous := make([]int, len(t)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+	for i := 1; i <= len(s); i++ {
+		current := make([]int, len(t)+1)
+		current[0] = i
+		for j := 1; j <= len(t); j++ {
+			cost := 1
+			if s[i-1] == t[j-1] {
+				cost = 0
+			}
+			current[j] = previous[j-1] + cost
+			if previous[j]+1 < current[j] {
+				current[j] = previous[j] + 1
+			}
+			if current[j-1]+1 < current[j] {
+				current[j] = current[j-1] + 1
+			}
+		}
+		previous = current
+	}
+	return previous[len(t)]
+}
+
 // ValidateManifestAlgorithms checks to see whether the user-specified manifest
-// algorithms are allowed by the profile, and whether the user specified all
-// of the profile's required algorithms. We do this work up front, before creating
+// algorithms are supported and allowed by the profile, and whether the user
+// specified all of the profile's required algorithms. We do this work up front, before creating
 // the bag, to avoid creating an invalid bag.
 func ValidateManifestAlgorithms(profile *bagit.Profile, algs []string) []string {
 	errors := make([]string, 0)
@@ -271,6 +1060,9 @@ func ValidateManifestAlgorithms(profile *bagit.Profile, algs []string) []string
 		}
 		if !isAllowed {
 			errors = append(errors, fmt.Sprintf("Manifest algorithm '%s' is not allowed in profile %s.", alg, profile.Name))
+		} else if !util.StringListContains(SupportedManifestAlgorithms, alg) {
+			// Profiles may allow algorithms we can't calculate.
+			errors = append(errors, fmt.Sprintf("Manifest algorithm '%s' is not supported. Supported algorithms: %s.", alg, strings.Join(SupportedManifestAlgorithms, ", ")))
 		}
 	}
 	for _, requiredAlg := range profile.ManifestsRequired {
@@ -287,12 +1079,50 @@ func ValidateManifestAlgorithms(profile *bagit.Profile, algs []string) []string
 	return errors
 }
 
-// TODO: Change this to find tags? Tags can repeat.
+// FindTag returns the first tag in tags with the specified tag file and
+// tag name, or nil. Use FindTags for tags that may repeat. As in BagIt,
+// tag names are case-insensitive, and so are tag file names, so
+// bag-info.txt/source-organization finds Source-Organization.
 func FindTag(tags []*bagit.TagDefinition, tagFile, tagName string) *bagit.TagDefinition {
 	for _, tag := range tags {
-		if tag.TagFile == tagFile && tag.TagName == tagName {
+		if strings.EqualFold(tag.TagFile, tagFile) && strings.EqualFold(tag.TagName, tagName) {
 			return tag
 		}
 	}
 	return nil
 }
+
+// FindTags returns all of the tags in tags with the specified tag file
+// and tag name, in order, ignoring case, as FindTag does.
+func FindTags(tags []*bagit.TagDefinition, tagFile, tagName string) []*bagit.TagDefinition {
+	found := make([]*bagit.TagDefinition, 0)
+	for _, tag := range tags {
+		if strings.EqualFold(tag.TagFile, tagFile) && strings.EqualFold(tag.TagName, tagName) {
+			found = append(found, tag)
+		}
+	}
+	return found
+}
+
+// CanonicalTagName returns the tag file and name of the tag that
+// profile defines as tagFile/tagName, ignoring case, with the casing
+// the profile gives them. Standard BagIt tags the profile doesn't
+// define get the spec's casing. Other tags are returned as they are.
+func CanonicalTagName(profile *bagit.Profile, tagFile, tagName string) (string, string) {
+	if tagDef := FindTag(profile.Tags, tagFile, tagName); tagDef != nil {
+		return tagDef.TagFile, tagDef.TagName
+	}
+	for _, key := range standardTags {
+		if strings.EqualFold(key, tagFile+"/"+tagName) {
+			parts := strings.SplitN(key, "/", 2)
+			return parts[0], parts[1]
+		}
+	}
+	return tagFile, tagName
+}
+
+// tagKey returns a key for the tag tagFile/tagName that's the same
+// regardless of case, for maps of tags.
+func tagKey(tagFile, tagName string) string {
+	return strings.ToLower(tagFile + "/" + tagName)
+}
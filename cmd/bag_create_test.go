@@ -2,10 +2,15 @@ package cmd_test
 
 import (
 	"fmt"
+	"os"
+	"path"
+	"sort"
 	"testing"
+	"time"
 
 	"github.com/APTrust/apt-cmd/cmd"
 	"github.com/APTrust/dart-runner/bagit"
+	"github.com/APTrust/dart-runner/util"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -108,6 +113,105 @@ func TestFindTag(t *testing.T) {
 	assert.Equal(t, "BagIt-Version", version.TagName)
 }
 
+func TestFindTags(t *testing.T) {
+	tags := []*bagit.TagDefinition{
+		{TagFile: "bag-info.txt", TagName: "Contact-Name", UserValue: "One"},
+		{TagFile: "bag-info.txt", TagName: "Source-Organization", UserValue: "APTrust"},
+		{TagFile: "bag-info.txt", TagName: "Contact-Name", UserValue: "Two"},
+	}
+	found := cmd.FindTags(tags, "bag-info.txt", "Contact-Name")
+	require.Equal(t, 2, len(found))
+	assert.Equal(t, "One", found[0].UserValue)
+	assert.Equal(t, "Two", found[1].UserValue)
+	assert.Empty(t, cmd.FindTags(tags, "aptrust-info.txt", "Contact-Name"))
+}
+
+func TestValidateTags_RepeatedTags(t *testing.T) {
+	profile, err := cmd.LoadProfile("aptrust")
+	require.Nil(t, err)
+	tags := cmd.EnsureDefaultTags([]*bagit.TagDefinition{
+		{TagFile: "bag-info.txt", TagName: "Source-Organization", UserValue: "APTrust"},
+		{TagFile: "aptrust-info.txt", TagName: "Title", UserValue: ""},
+		{TagFile: "aptrust-info.txt", TagName: "Title", UserValue: "Bag Title"},
+		{TagFile: "aptrust-info.txt", TagName: "Access", UserValue: "Consortia"},
+		{TagFile: "aptrust-info.txt", TagName: "Storage-Option", UserValue: "Standard"},
+		{TagFile: "bag-info.txt", TagName: "Contact-Name", UserValue: "One"},
+		{TagFile: "bag-info.txt", TagName: "Contact-Name", UserValue: "Two"},
+	})
+	assert.Empty(t, cmd.ValidateTags(profile, tags))
+
+	// Every value of a repeated tag must be legal.
+	tags = append(tags, &bagit.TagDefinition{TagFile: "aptrust-info.txt", TagName: "Access", UserValue: "invalid"})
+	expected := []string{
+		"Tag aptrust-info.txt/Access assigned illegal value 'invalid'. Valid values are: Consortia,Institution,Restricted.",
+	}
+	assert.Equal(t, expected, cmd.ValidateTags(profile, tags))
+}
+
+func TestSetTagValues(t *testing.T) {
+	profile, err := cmd.LoadProfile("aptrust")
+	require.Nil(t, err)
+	tags := []*bagit.TagDefinition{
+		{TagFile: "bag-info.txt", TagName: "Contact-Name", UserValue: "One"},
+		{TagFile: "bag-info.txt", TagName: "Source-Organization", UserValue: "APTrust"},
+		{TagFile: "bag-info.txt", TagName: "Contact-Name", UserValue: "Two"},
+		{TagFile: "bag-info.txt", TagName: "Contact-Name", UserValue: "Three"},
+		{TagFile: "custom-tags.txt", TagName: "Keyword", UserValue: "Alpha"},
+		{TagFile: "custom-tags.txt", TagName: "Keyword", UserValue: "Beta"},
+	}
+	cmd.SetTagValues(profile, tags)
+
+	bagInfo, err := profile.GetTagFileContents("bag-info.txt")
+	require.Nil(t, err)
+	assert.Contains(t, bagInfo, "Contact-Name: One\nContact-Name: Two\nContact-Name: Three\n")
+	assert.Contains(t, bagInfo, "Source-Organization: APTrust\n")
+	customTags, err := profile.GetTagFileContents("custom-tags.txt")
+	require.Nil(t, err)
+	assert.Equal(t, "Keyword: Alpha\nKeyword: Beta\n", customTags)
+
+	// Each repeated tag has its own definition.
+	ids := make(map[string]bool)
+	for _, tagDef := range profile.Tags {
+		assert.False(t, ids[tagDef.ID], tagDef.TagName)
+		ids[tagDef.ID] = true
+	}
+}
+
+func TestTagCase(t *testing.T) {
+	profile, err := cmd.LoadProfile("aptrust")
+	require.Nil(t, err)
+	tags := cmd.EnsureDefaultTags([]*bagit.TagDefinition{
+		{TagFile: "BAG-INFO.TXT", TagName: "source-organization", UserValue: "Faber College"},
+		{TagFile: "aptrust-info.txt", TagName: "TITLE", UserValue: "Bag Title"},
+		{TagFile: "Aptrust-Info.txt", TagName: "access", UserValue: "Institution"},
+		{TagFile: "aptrust-info.txt", TagName: "Storage-option", UserValue: "Standard"},
+		{TagFile: "bag-info.txt", TagName: "contact-name", UserValue: "One"},
+		{TagFile: "bag-info.txt", TagName: "Contact-Name", UserValue: "Two"},
+	})
+	assert.NotNil(t, cmd.FindTag(tags, "bag-info.txt", "Source-Organization"))
+	assert.Len(t, cmd.FindTags(tags, "BAG-INFO.txt", "CONTACT-NAME"), 2)
+	assert.Empty(t, cmd.ValidateTags(profile, tags))
+	assert.Empty(t, cmd.UnknownTags(profile, tags))
+
+	cmd.SetTagValues(profile, tags)
+	bagInfo, err := profile.GetTagFileContents("bag-info.txt")
+	require.Nil(t, err)
+	assert.Contains(t, bagInfo, "Source-Organization: Faber College\n")
+	assert.Contains(t, bagInfo, "Contact-Name: One\nContact-Name: Two\n")
+	aptrustInfo, err := profile.GetTagFileContents("aptrust-info.txt")
+	require.Nil(t, err)
+	assert.Contains(t, aptrustInfo, "Title: Bag Title\n")
+	assert.Contains(t, aptrustInfo, "Access: Institution\n")
+	assert.Contains(t, aptrustInfo, "Storage-Option: Standard\n")
+	assert.Equal(t, []string{"aptrust-info.txt", "bag-info.txt", "bagit.txt"}, sortedTagFileNames(profile))
+}
+
+func sortedTagFileNames(profile *bagit.Profile) []string {
+	names := profile.TagFileNames()
+	sort.Strings(names)
+	return names
+}
+
 func TestValidateManifestAlgorithms(t *testing.T) {
 	profile, err := cmd.LoadProfile("aptrust")
 	require.Nil(t, err)
@@ -149,3 +253,208 @@ func TestValidateManifestAlgorithms(t *testing.T) {
 	assert.Equal(t, expected, errors)
 
 }
+
+func TestValidateTags_BTR(t *testing.T) {
+	profile, err := cmd.LoadProfile("btr")
+	require.Nil(t, err)
+
+	// Bagging-Date, Payload-Oxum and BagIt-Profile-Identifier are
+	// required by BTR, but the bagger sets them, so users don't
+	// have to.
+	expected := []string{
+		"Required tag bag-info.txt/Source-Organization is missing.",
+	}
+	tags := cmd.EnsureDefaultTags(make([]*bagit.TagDefinition, 0))
+	errors := cmd.ValidateTags(profile, tags)
+	assert.Equal(t, expected, errors)
+
+	// BTR should not supply a default Source-Organization.
+	// The user has to tell us who they are.
+	tags = append(tags, &bagit.TagDefinition{TagFile: "bag-info.txt", TagName: "Source-Organization", UserValue: ""})
+	expected = []string{
+		"Tag bag-info.txt/Source-Organization is present but value cannot be empty. Please assign a value.",
+	}
+	errors = cmd.ValidateTags(profile, tags)
+	assert.Equal(t, expected, errors)
+
+	tags[len(tags)-1].UserValue = "Faber College"
+	errors = cmd.ValidateTags(profile, tags)
+	assert.Empty(t, errors)
+
+	// BTR requires UTF-8 tag files.
+	encoding := cmd.FindTag(tags, "bagit.txt", "Tag-File-Character-Encoding")
+	require.NotNil(t, encoding)
+	encoding.UserValue = "ascii"
+	expected = []string{
+		"Tag bagit.txt/Tag-File-Character-Encoding assigned illegal value 'ascii'. Valid values are: UTF-8.",
+	}
+	errors = cmd.ValidateTags(profile, tags)
+	assert.Equal(t, expected, errors)
+}
+
+func TestUnknownTags(t *testing.T) {
+	profile, err := cmd.LoadProfile("aptrust")
+	require.Nil(t, err)
+	tags := cmd.EnsureDefaultTags([]*bagit.TagDefinition{
+		{TagFile: "bag-info.txt", TagName: "Source-Organisation", UserValue: "Faber College"},
+		{TagFile: "bag-info.txt", TagName: "Contact-Name", UserValue: "Dean Wormer"},
+		{TagFile: "aptrust-info.txt", TagName: "Title", UserValue: "Bag Title"},
+		{TagFile: "custom-info.txt", TagName: "Mascot", UserValue: "Pig"},
+		{TagFile: "custom-info.txt", TagName: "Mascot", UserValue: "Horse"},
+	})
+	expected := []string{
+		"Tag bag-info.txt/Source-Organisation is not defined in profile APTrust. Did you mean bag-info.txt/Source-Organization?",
+		"Tag custom-info.txt/Mascot is not defined in profile APTrust.",
+	}
+	assert.Equal(t, expected, cmd.UnknownTags(profile, tags))
+}
+
+func TestValidateManifestAlgorithms_BTR(t *testing.T) {
+	profile, err := cmd.LoadProfile("btr")
+	require.Nil(t, err)
+	require.NotNil(t, profile)
+
+	// BTR doesn't require any one algorithm, but the
+	// bag must use one or more of the allowed algorithms.
+	assert.Empty(t, profile.ManifestsRequired)
+	for _, alg := range []string{"md5", "sha1", "sha256", "sha512"} {
+		errors := cmd.ValidateManifestAlgorithms(profile, []string{alg})
+		assert.Empty(t, errors, alg)
+	}
+	errors := cmd.ValidateManifestAlgorithms(profile, []string{"sha256", "sha512"})
+	assert.Empty(t, errors)
+
+	expected := []string{
+		"Manifest algorithm 'sha224' is not allowed in profile BTR SHA-512.",
+	}
+	errors = cmd.ValidateManifestAlgorithms(profile, []string{"sha224", "sha512"})
+	assert.Equal(t, expected, errors)
+}
+
+func TestParseUploadTarget(t *testing.T) {
+	host, bucket, err := cmd.ParseUploadTarget("s3.amazonaws.com/my-bucket")
+	require.Nil(t, err)
+	assert.Equal(t, "s3.amazonaws.com", host)
+	assert.Equal(t, "my-bucket", bucket)
+
+	host, bucket, err = cmd.ParseUploadTarget("localhost:9899/my-bucket/")
+	require.Nil(t, err)
+	assert.Equal(t, "localhost:9899", host)
+	assert.Equal(t, "my-bucket", bucket)
+
+	for _, target := range []string{"", "s3.amazonaws.com", "s3.amazonaws.com/", "/my-bucket", "host/bucket/extra"} {
+		_, _, err = cmd.ParseUploadTarget(target)
+		assert.NotNil(t, err, target)
+	}
+}
+
+func TestResolveManifestAlgs(t *testing.T) {
+	config := getTestConfig(false)
+
+	// Flag not set and no config default
+	assert.Equal(t, []string{cmd.DefaultManifestAlg}, cmd.ResolveManifestAlgs(false, []string{}, config))
+	assert.Equal(t, []string{"sha256"}, cmd.ResolveManifestAlgs(false, []string{}, nil))
+
+	// Flag not set, config has default
+	config.DefaultManifestAlgs = "md5, sha512"
+	assert.Equal(t, []string{"md5", "sha512"}, cmd.ResolveManifestAlgs(false, []string{}, config))
+
+	// Flag set overrides the config
+	assert.Equal(t, []string{"sha1"}, cmd.ResolveManifestAlgs(true, []string{"sha1"}, config))
+
+	// Comma-separated values, as parsed by the flag
+	assert.Equal(t, []string{"md5", "sha256"}, cmd.ResolveManifestAlgs(true, []string{"md5", "sha256"}, config))
+
+	// Empty values should not produce an empty algorithm
+	assert.Empty(t, cmd.ResolveManifestAlgs(true, []string{}, config))
+	assert.Empty(t, cmd.ResolveManifestAlgs(true, []string{""}, config))
+	assert.Empty(t, cmd.ResolveManifestAlgs(true, []string{"", " "}, config))
+	assert.Equal(t, []string{"md5", "sha256"}, cmd.ResolveManifestAlgs(true, []string{"md5", "", " sha256"}, config))
+
+	config.DefaultManifestAlgs = "md5,,sha512,"
+	assert.Equal(t, []string{"md5", "sha512"}, cmd.ResolveManifestAlgs(false, []string{cmd.DefaultManifestAlg}, config))
+}
+
+func TestFindUnreadableFiles(t *testing.T) {
+	dir := t.TempDir()
+	goodFile := path.Join(dir, "good.txt")
+	missingFile := path.Join(dir, "missing.txt")
+	require.Nil(t, os.WriteFile(goodFile, []byte("readable"), 0644))
+
+	goodInfo, err := os.Stat(goodFile)
+	require.Nil(t, err)
+	dirInfo, err := os.Stat(dir)
+	require.Nil(t, err)
+
+	files := []*util.ExtendedFileInfo{
+		util.NewExtendedFileInfo(dir, dirInfo),
+		util.NewExtendedFileInfo(goodFile, goodInfo),
+		// Deleted after the directory walk
+		util.NewExtendedFileInfo(missingFile, goodInfo),
+		// Directory walk couldn't stat this one
+		util.NewExtendedFileInfo(path.Join(dir, "no-stat"), nil),
+	}
+	readable, unreadable := cmd.FindUnreadableFiles(files)
+	require.Equal(t, 2, len(readable))
+	assert.Equal(t, dir, readable[0].FullPath)
+	assert.Equal(t, goodFile, readable[1].FullPath)
+	require.Equal(t, 2, len(unreadable))
+	assert.Contains(t, unreadable[missingFile], "no such file")
+	assert.Equal(t, "cannot stat file", unreadable[path.Join(dir, "no-stat")])
+}
+
+func TestFindChangedFiles(t *testing.T) {
+	dir := t.TempDir()
+	sameFile := path.Join(dir, "same.txt")
+	grownFile := path.Join(dir, "grown.txt")
+	touchedFile := path.Join(dir, "touched.txt")
+	deletedFile := path.Join(dir, "deleted.txt")
+	for _, f := range []string{sameFile, grownFile, touchedFile, deletedFile} {
+		require.Nil(t, os.WriteFile(f, []byte("original"), 0644))
+	}
+	files, err := util.RecursiveFileList(dir)
+	require.Nil(t, err)
+
+	_, changed := cmd.FindChangedFiles(files)
+	assert.Empty(t, changed)
+
+	require.Nil(t, os.WriteFile(grownFile, []byte("original plus more"), 0644))
+	later := time.Now().Add(time.Hour)
+	require.Nil(t, os.Chtimes(touchedFile, later, later))
+	require.Nil(t, os.Remove(deletedFile))
+
+	updated, changed := cmd.FindChangedFiles(files)
+	assert.ElementsMatch(t, []string{grownFile, touchedFile, deletedFile}, changed)
+	require.Equal(t, len(files)-1, len(updated))
+	for _, f := range updated {
+		assert.NotEqual(t, deletedFile, f.FullPath)
+		if f.FullPath == grownFile {
+			assert.Equal(t, int64(len("original plus more")), f.Size())
+		}
+	}
+
+	// Updated list reflects the changes, so nothing new has changed.
+	_, changed = cmd.FindChangedFiles(updated)
+	assert.Empty(t, changed)
+}
+
+func TestListChildDirs(t *testing.T) {
+	bagDir := t.TempDir()
+	for _, name := range []string{"box_02", "box_01", "bags"} {
+		require.Nil(t, os.Mkdir(path.Join(bagDir, name), 0755))
+	}
+	require.Nil(t, os.WriteFile(path.Join(bagDir, "loose.txt"), []byte("not in a box"), 0644))
+
+	// Output dir inside bagDir is not bagged.
+	childDirs, looseFiles, err := cmd.ListChildDirs(bagDir, path.Join(bagDir, "bags"))
+	require.Nil(t, err)
+	assert.Equal(t, []string{path.Join(bagDir, "box_01"), path.Join(bagDir, "box_02")}, childDirs)
+	assert.Equal(t, []string{path.Join(bagDir, "loose.txt")}, looseFiles)
+
+	_, _, err = cmd.ListChildDirs(path.Join(bagDir, "box_01"), t.TempDir())
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), "found no directories")
+
+	_, _, err = cmd.ListChildDirs(path.Join(bagDir, "does-not-exist"), t.TempDir())
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,952 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/APTrust/dart-runner/bagit"
+	"github.com/APTrust/dart-runner/util"
+	"github.com/minio/minio-go/v7"
+	"github.com/op/go-logging"
+)
+
+// BagCreateOptions describes a bag for RunBagCreate to create. Each
+// field corresponds to one of bag create's flags. Profile, BagDirs,
+// OutputFile and ManifestAlgs are required. The rest are optional.
+type BagCreateOptions struct {
+	// Context cancels bagging, validation and uploading. It defaults
+	// to context.Background().
+	Context context.Context
+
+	// Profile is the BagIt profile to bag with. RunBagCreate applies
+	// ManifestAlgs and Tags to a copy, so the profile doesn't change.
+	Profile *bagit.Profile
+
+	// BagDirs are the directories to bag. Each one goes into the bag's
+	// data directory under its own name.
+	BagDirs []string
+
+	// OutputFile is where to write the bag. BagOutputPath describes
+	// how Format changes its name.
+	OutputFile string
+
+	// ManifestAlgs are the manifest and tag manifest algorithms.
+	ManifestAlgs []string
+
+	// Tags are the tag values to write into the tag files. Pass them
+	// through EnsureDefaultTags to set the bagit.txt tags.
+	Tags []*bagit.TagDefinition
+
+	// Format is one of BagFormats. It defaults to BagFormatTar.
+	Format string
+
+	// CompressionLevel is the gzip level, from 1 to 9, for
+	// BagFormatTgz. It defaults to DefaultCompressionLevel.
+	CompressionLevel int
+
+	// HashEncoding is one of HashEncodings. It defaults to
+	// HashEncodingHexLower.
+	HashEncoding string
+
+	// ExcludePatterns lists files to leave out of the bag, as with
+	// --exclude. Each bag directory's .bagignore patterns come first,
+	// unless NoBagignore is set.
+	ExcludePatterns []string
+	NoBagignore     bool
+
+	// Fetch lists payload files to leave out of the bag and list in
+	// fetch.txt instead, as with --fetch. The files must be in BagDirs,
+	// since the manifests list their checksums. The profile must allow
+	// fetch.txt.
+	Fetch []*FetchEntry
+
+	// Files, if it's not nil, limits the bag to these files in
+	// BagDirs, by absolute path, as bag create --max-bag-size does for
+	// each part of a multipart bag. PlanBagParts returns a list for
+	// each part. Directories are bagged only if they hold one of the
+	// files.
+	Files []string
+
+	// Symlinks is one of SymlinkPolicies. It defaults to SymlinksSkip.
+	Symlinks string
+
+	// KeepEmptyDirs adds an empty KeepFile to each empty payload
+	// directory, as --keep-empty-dirs does, so the directory survives
+	// unpacking the bag.
+	KeepEmptyDirs bool
+
+	// Reproducible makes the bag's bytes depend only on the files and
+	// options, as --reproducible does. Every entry gets the same
+	// modification time and no owner, and bag-info.txt has no
+	// Bagging-Date unless Tags sets one, in which case that's the
+	// modification time. See MakeReproducible.
+	Reproducible bool
+
+	// StrictTags makes tags that Profile doesn't define errors, as
+	// --strict-tags does. See UnknownTags.
+	StrictTags bool
+
+	// PayloadDir is the name of the bag's payload directory, as with
+	// --payload-dir. It defaults to DefaultPayloadDir, data, which is
+	// the only name the BagIt spec allows. See RenamePayloadDir.
+	PayloadDir string
+
+	SkipUnreadable   bool
+	RehashChanged    bool
+	ReportDuplicates bool
+	FailOnDuplicates bool
+	DryRun           bool
+
+	// NoClobber refuses to replace an existing tar file at the output
+	// path. Force replaces existing tar, zip and tgz files without the
+	// warning RunBagCreate otherwise logs, and without the error it
+	// otherwise returns for zip and tgz files. Existing directories are
+	// never replaced.
+	NoClobber bool
+	Force     bool
+
+	// Verify validates the bag after bagging, whether or not it's
+	// uploaded, and treats an invalid bag as a failure to create it.
+	Verify bool
+
+	// AfterBagging, if set, is called with the path of the tar file
+	// after the bagger writes it, before the bag is verified, validated
+	// or converted to Format. Callers can use it to inspect or add to
+	// the bag, and tests use it to damage bags.
+	AfterBagging func(pathToTar string) error
+
+	// Progress writes bagging progress to stderr, as --progress does.
+	// TUI shows the dashboard, as --tui does.
+	Progress bool
+	TUI      bool
+
+	// UploadHost and UploadBucket say where to upload the bag. Leave
+	// them empty to skip the upload. SkipValidation uploads without
+	// validating the bag first.
+	UploadHost     string
+	UploadBucket   string
+	SkipValidation bool
+
+	// UploadKey is the bag's key in UploadBucket. It defaults to the
+	// name of the bag's output file.
+	UploadKey string
+
+	// Stream bags straight into the upload, without writing the bag to
+	// disk, as --stream does. It requires UploadHost, a tar Format, and
+	// no Verify, RehashChanged, AfterBagging, Progress or TUI, all of
+	// which need a local bag.
+	Stream bool
+
+	// KeepLocal makes Stream write the bag to OutputFile as well, in
+	// the same pass, as --keep-local does. The upload isn't completed
+	// until the local bag has been validated, so it allows Verify.
+	KeepLocal bool
+
+	// S3Client uploads the bag. If it's nil, RunBagCreate creates one
+	// for UploadHost with the credentials in Config.
+	S3Client *minio.Client
+
+	// Config has the S3 credentials for the upload, if S3Client is nil.
+	Config *Config
+
+	// Concurrency is the number of threads for the upload. It defaults
+	// to DefaultConcurrency.
+	Concurrency int
+
+	// Logger gets debug messages and warnings. It defaults to one that
+	// discards them. The files to bag are logged only if it's enabled
+	// for DEBUG.
+	Logger *logging.Logger
+}
+
+// BagCreateResult describes the bag RunBagCreate created, or would
+// have created, for a dry run.
+type BagCreateResult struct {
+	// Result is "OK", or for a bag that was created but not uploaded,
+	// "ValidationFailed", "Invalid" or "UploadFailed", or for a bag
+	// that failed Verify, "VerifyFailed".
+	Result string
+
+	// Bagger is the bagger that created the bag, with the bag's
+	// payload files and their checksums. It's nil for dry runs.
+	Bagger *bagit.Bagger
+
+	// OutputPath is the absolute path of the bag.
+	OutputPath string
+
+	// DryRun is true if the bag wasn't written. FileCount and
+	// TotalBytes are the number and size of the payload files that
+	// would be bagged.
+	DryRun     bool
+	FileCount  int
+	TotalBytes int64
+
+	// Skipped lists unreadable files that were left out of the bag.
+	// It's nil unless SkipUnreadable was set.
+	Skipped []string
+
+	// Rehashed lists files that changed during bagging and were
+	// bagged again. It's nil unless RehashChanged was set.
+	Rehashed []string
+
+	// KeepFiles lists the paths in the bag of the placeholders added to
+	// empty directories. It's nil unless KeepEmptyDirs was set.
+	KeepFiles []string
+
+	// Duplicates lists sets of payload files with identical contents.
+	// It's nil unless ReportDuplicates or FailOnDuplicates was set.
+	Duplicates [][]string
+
+	// ValidationErrors are the errors that kept an invalid bag from
+	// being uploaded.
+	ValidationErrors map[string]string
+
+	// UploadTo is the host, bucket and key of the uploaded bag, and
+	// ETag is its ETag. UploadTo is set even if the upload failed.
+	UploadTo string
+	ETag     string
+
+	// Streamed is true if the bag went straight to S3, and was never
+	// written to OutputPath.
+	Streamed bool
+}
+
+// JSON returns the result as bag create prints it. Param extras
+// contains extra fields to include, such as `, "bagDir": "/path"`.
+func (r *BagCreateResult) JSON(extras string) string {
+	// Marshalling string slices can't fail.
+	if r.Skipped != nil {
+		skippedBytes, _ := json.Marshal(r.Skipped)
+		extras += fmt.Sprintf(`, "skipped": %s`, string(skippedBytes))
+	}
+	if r.DryRun {
+		return fmt.Sprintf(`{ "result": "OK", "wouldWrite": %s, "fileCount": %d, "totalBytes": %d%s }`, jsonString(r.OutputPath), r.FileCount, r.TotalBytes, extras)
+	}
+	if r.Duplicates != nil {
+		duplicateBytes, _ := json.Marshal(r.Duplicates)
+		extras += fmt.Sprintf(`, "duplicates": %s`, string(duplicateBytes))
+	}
+	if r.Rehashed != nil {
+		rehashedBytes, _ := json.Marshal(r.Rehashed)
+		extras += fmt.Sprintf(`, "rehashed": %s`, string(rehashedBytes))
+	}
+	if r.KeepFiles != nil {
+		keepFileBytes, _ := json.Marshal(r.KeepFiles)
+		extras += fmt.Sprintf(`, "keepFiles": %s`, string(keepFileBytes))
+	}
+	if r.Streamed && r.Result == "OK" {
+		return fmt.Sprintf(`{ "result": "OK", "uploadTo": %s, "etag": %s, "streamed": true%s }`, jsonString(r.UploadTo), jsonString(r.ETag), extras)
+	}
+	if r.Streamed {
+		return fmt.Sprintf(`{ "result": "%s", "uploadTo": %s, "streamed": true%s }`, r.Result, jsonString(r.UploadTo), extras)
+	}
+	if r.UploadTo == "" {
+		return fmt.Sprintf(`{ "result": "%s", "outputFile": %s%s }`, r.Result, jsonString(r.OutputPath), extras)
+	}
+	if r.Result != "OK" {
+		return fmt.Sprintf(`{ "result": "%s", "outputFile": %s, "uploadTo": %s%s }`, r.Result, jsonString(r.OutputPath), jsonString(r.UploadTo), extras)
+	}
+	return fmt.Sprintf(`{ "result": "OK", "outputFile": %s, "uploadTo": %s, "etag": %s%s }`, jsonString(r.OutputPath), jsonString(r.UploadTo), jsonString(r.ETag), extras)
+}
+
+// BagCreateError is an error from RunBagCreate. ExitCode is the status
+// bag create exits with for the error, such as EXIT_USER_ERR for bad
+// options or EXIT_BAG_INVALID for a bag that failed validation.
+type BagCreateError struct {
+	ExitCode int
+	Err      error
+}
+
+func (e *BagCreateError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *BagCreateError) Unwrap() error {
+	return e.Err
+}
+
+// BagCreateExitCode returns the exit status for an error from
+// RunBagCreate: EXIT_OK if err is nil, the error's ExitCode if it's a
+// BagCreateError, and EXIT_RUNTIME_ERR otherwise.
+func BagCreateExitCode(err error) int {
+	if err == nil {
+		return EXIT_OK
+	}
+	var bagCreateError *BagCreateError
+	if errors.As(err, &bagCreateError) {
+		return bagCreateError.ExitCode
+	}
+	return EXIT_RUNTIME_ERR
+}
+
+func bagCreateError(exitCode int, format string, args ...interface{}) *BagCreateError {
+	return &BagCreateError{ExitCode: exitCode, Err: fmt.Errorf(format, args...)}
+}
+
+// setDefaults fills in the optional fields that have defaults.
+func (opts *BagCreateOptions) setDefaults() {
+	if opts.Context == nil {
+		opts.Context = context.Background()
+	}
+	if opts.Format == "" {
+		opts.Format = BagFormatTar
+	}
+	if opts.CompressionLevel == 0 {
+		opts.CompressionLevel = DefaultCompressionLevel
+	}
+	if opts.HashEncoding == "" {
+		opts.HashEncoding = HashEncodingHexLower
+	}
+	if opts.Symlinks == "" {
+		opts.Symlinks = SymlinksSkip
+	}
+	if opts.PayloadDir == "" {
+		opts.PayloadDir = DefaultPayloadDir
+	}
+	if opts.Concurrency < 1 {
+		opts.Concurrency = DefaultConcurrency
+	}
+	if opts.Logger == nil {
+		opts.Logger = logging.MustGetLogger("apt-cmd")
+		opts.Logger.SetBackend(logging.AddModuleLevel(logging.NewLogBackend(io.Discard, "", 0)))
+	}
+}
+
+// Validate fills in the defaults for optional fields, then checks the
+// options before anything is bagged, so that when the user is
+// packaging 500+ GB, they don't wait two hours to find out the bag is
+// invalid. Tag values are checked with their templates expanded, as
+// RunBagCreate will expand them. It returns a BagCreateError with
+// EXIT_USER_ERR describing the problems it finds. RunBagCreate calls
+// this, so callers need to call it only to check the options
+// beforehand.
+func (opts *BagCreateOptions) Validate() error {
+	opts.setDefaults()
+	if opts.Profile == nil {
+		return bagCreateError(EXIT_USER_ERR, "a BagIt profile is required")
+	}
+	if len(opts.BagDirs) == 0 {
+		return bagCreateError(EXIT_USER_ERR, "at least one directory to bag is required")
+	}
+	if opts.OutputFile == "" {
+		return bagCreateError(EXIT_USER_ERR, "an output file is required")
+	}
+	if len(opts.ManifestAlgs) == 0 {
+		return bagCreateError(EXIT_USER_ERR, "at least one manifest algorithm is required")
+	}
+	// Check the values the bag will get, not their templates.
+	tags, err := ExpandTagTemplates(opts.Tags, NewTagTemplateData(util.CleanBagName(filepath.Base(opts.OutputFile))))
+	if err != nil {
+		return &BagCreateError{ExitCode: EXIT_USER_ERR, Err: err}
+	}
+	problems := ValidateTags(opts.Profile, tags)
+	if opts.StrictTags {
+		problems = append(problems, UnknownTags(opts.Profile, tags)...)
+	}
+	if len(problems) > 0 {
+		return bagCreateError(EXIT_USER_ERR, "%s", strings.Join(problems, "\n"))
+	}
+	if !util.StringListContains(BagFormats, opts.Format) {
+		return bagCreateError(EXIT_USER_ERR, "Invalid --format '%s'. Use one of: %s", opts.Format, strings.Join(BagFormats, ", "))
+	}
+	if opts.Format == BagFormatDirectory && opts.UploadHost != "" {
+		return bagCreateError(EXIT_USER_ERR, "--upload-to can't upload --format=directory bags. Use a tar file instead.")
+	}
+	if opts.CompressionLevel < 1 || opts.CompressionLevel > 9 {
+		return bagCreateError(EXIT_USER_ERR, "invalid compression level %d. Use a number from 1 to 9.", opts.CompressionLevel)
+	}
+	if opts.Verify && opts.SkipValidation {
+		return bagCreateError(EXIT_USER_ERR, "--verify can't be used with --skip-validation.")
+	}
+	if opts.NoClobber && opts.Force {
+		return bagCreateError(EXIT_USER_ERR, "--no-clobber can't be used with --force.")
+	}
+	if opts.UploadKey != "" && opts.UploadHost == "" {
+		return bagCreateError(EXIT_USER_ERR, "--upload-key requires --upload-to.")
+	}
+	if len(opts.Fetch) > 0 && !opts.Profile.AllowFetchTxt {
+		return bagCreateError(EXIT_USER_ERR, "--fetch can't be used with profile %s, which doesn't allow fetch.txt.", opts.Profile.Name)
+	}
+	if err := ValidatePayloadDir(opts.PayloadDir); err != nil {
+		return &BagCreateError{ExitCode: EXIT_USER_ERR, Err: err}
+	}
+	if len(opts.Fetch) > 0 && opts.PayloadDir != DefaultPayloadDir {
+		return bagCreateError(EXIT_USER_ERR, "--fetch can't be used with --payload-dir, since fetch.txt lists files in data/.")
+	}
+	if opts.KeepLocal && !opts.Stream {
+		return bagCreateError(EXIT_USER_ERR, "--keep-local requires --stream.")
+	}
+	if opts.Stream {
+		if err := opts.validateStream(); err != nil {
+			return err
+		}
+	}
+	if opts.Reproducible {
+		if err := opts.validateReproducible(tags); err != nil {
+			return err
+		}
+	}
+	if !util.StringListContains(HashEncodings, opts.HashEncoding) {
+		return bagCreateError(EXIT_USER_ERR, "Invalid --hash-encoding '%s'. Use one of: %s", opts.HashEncoding, strings.Join(HashEncodings, ", "))
+	}
+	if !util.StringListContains(SymlinkPolicies, opts.Symlinks) {
+		return bagCreateError(EXIT_USER_ERR, "Invalid --symlinks '%s'. Use one of: %s", opts.Symlinks, strings.Join(SymlinkPolicies, ", "))
+	}
+	if err := ValidateExcludePatterns(opts.ExcludePatterns); err != nil {
+		return &BagCreateError{ExitCode: EXIT_USER_ERR, Err: err}
+	}
+	if problems := ValidateManifestAlgorithms(opts.Profile, opts.ManifestAlgs); len(problems) > 0 {
+		return bagCreateError(EXIT_USER_ERR, "%s", strings.Join(problems, "\n"))
+	}
+	return nil
+}
+
+// validateStream checks that nothing in opts needs the local bag that
+// Stream doesn't write.
+func (opts *BagCreateOptions) validateStream() error {
+	switch {
+	case opts.UploadHost == "":
+		return bagCreateError(EXIT_USER_ERR, "--stream requires --upload-to.")
+	case opts.Format != BagFormatTar:
+		return bagCreateError(EXIT_USER_ERR, "--stream can upload only --format=tar bags.")
+	case opts.Verify && !opts.KeepLocal:
+		return bagCreateError(EXIT_USER_ERR, "--verify can't be used with --stream, since there's no local bag to verify. Add --keep-local to keep one.")
+	case opts.RehashChanged:
+		return bagCreateError(EXIT_USER_ERR, "--rehash-changed can't be used with --stream, since streamed files can't be bagged again.")
+	case opts.AfterBagging != nil:
+		return bagCreateError(EXIT_USER_ERR, "AfterBagging can't be used with Stream, since there's no local bag.")
+	case opts.Progress || opts.TUI:
+		return bagCreateError(EXIT_USER_ERR, "--progress and --tui can't be used with --stream.")
+	case len(opts.Fetch) > 0:
+		return bagCreateError(EXIT_USER_ERR, "--fetch can't be used with --stream, since streamed files can't be taken back out of the bag.")
+	case opts.KeepEmptyDirs:
+		return bagCreateError(EXIT_USER_ERR, "--keep-empty-dirs can't be used with --stream, since placeholders can't be added to a streamed bag.")
+	case opts.Reproducible:
+		return bagCreateError(EXIT_USER_ERR, "--reproducible can't be used with --stream, since a streamed bag can't be rewritten.")
+	case opts.PayloadDir != DefaultPayloadDir:
+		return bagCreateError(EXIT_USER_ERR, "--payload-dir can't be used with --stream, since a streamed bag can't be rewritten.")
+	}
+	return nil
+}
+
+// validateReproducible checks that opts can make a reproducible bag.
+// The bag can't have the time it was made as its Bagging-Date, so if
+// the profile requires one, the user has to pin it with Tags. Param
+// tags is opts.Tags with their templates expanded.
+func (opts *BagCreateOptions) validateReproducible(tags []*bagit.TagDefinition) error {
+	if _, err := ReproducibleTimestamp(tags); err != nil {
+		return &BagCreateError{ExitCode: EXIT_USER_ERR, Err: err}
+	}
+	pinned := FindTag(tags, "bag-info.txt", "Bagging-Date") != nil
+	if required := FindTag(opts.Profile.Tags, "bag-info.txt", "Bagging-Date"); required != nil && required.Required && !pinned {
+		return bagCreateError(EXIT_USER_ERR, "Profile %s requires a Bagging-Date, so --reproducible needs one. Set it with --tags='bag-info.txt/Bagging-Date=2023-06-01'.", opts.Profile.Name)
+	}
+	return nil
+}
+
+// PrepareProfile returns a copy of profile to bag with. The copy has
+// algs as its required manifest algorithms, since the bagger writes
+// manifests only for those, and it has the tag values in tags. Unlike
+// bagit.CloneProfile alone, this keeps the profile's required tag files
+// and its fetch.txt setting.
+func PrepareProfile(profile *bagit.Profile, algs []string, tags []*bagit.TagDefinition) *bagit.Profile {
+	prepared := bagit.CloneProfile(profile)
+	prepared.AllowFetchTxt = profile.AllowFetchTxt
+	prepared.TagFilesRequired = append([]string{}, profile.TagFilesRequired...)
+	prepared.ManifestsRequired = append([]string{}, algs...)
+	SetTagValues(prepared, tags)
+	return prepared
+}
+
+// baggerProfile returns a copy of profile for the bagger, without the
+// ExtraManifestAlgorithms, which it can't calculate. If that leaves no
+// algorithms, the bagger writes DefaultManifestAlg manifests, which
+// WriteManifests replaces.
+func baggerProfile(profile *bagit.Profile) *bagit.Profile {
+	copied := *profile
+	copied.ManifestsRequired = BaggerAlgorithms(profile.ManifestsRequired)
+	copied.TagManifestsRequired = BaggerAlgorithms(profile.TagManifestsRequired)
+	if len(copied.ManifestsRequired) == 0 && len(copied.TagManifestsRequired) == 0 {
+		copied.ManifestsRequired = []string{DefaultManifestAlg}
+	}
+	return &copied
+}
+
+// tagManifestAlgorithms returns the algorithms of the tag manifests in
+// bags made with profile. Like the bagger, we write a tag manifest for
+// each manifest, and for each required tag manifest.
+func tagManifestAlgorithms(profile *bagit.Profile) []string {
+	algs := append([]string{}, profile.ManifestsRequired...)
+	for _, alg := range profile.TagManifestsRequired {
+		if !util.StringListContains(algs, alg) {
+			algs = append(algs, alg)
+		}
+	}
+	return algs
+}
+
+// listFiles returns the files in absDirs that aren't excluded by
+// opts.ExcludePatterns or the directories' .bagignore files, plus the
+// paths of the excluded files and directories. It handles symbolic
+// links as opts.Symlinks says.
+func (opts *BagCreateOptions) listFiles(absDirs []string) ([]*util.ExtendedFileInfo, []string, error) {
+	files, links, err := ListBagDirFiles(absDirs, opts.Symlinks)
+	if err != nil {
+		return nil, nil, &BagCreateError{ExitCode: EXIT_USER_ERR, Err: err}
+	}
+	for _, link := range links {
+		if opts.Symlinks == SymlinksFollow {
+			opts.Logger.Debugf("Following symbolic link %s", link)
+		} else {
+			opts.Logger.Warningf("Skipping symbolic link %s. Use --symlinks=follow to bag the file it points to.", link)
+		}
+	}
+	// Each directory's .bagignore patterns come before the other
+	// patterns, so that the command line can override them.
+	patterns := make(map[string][]string)
+	for _, absDir := range absDirs {
+		patterns[absDir] = opts.ExcludePatterns
+		if opts.NoBagignore {
+			continue
+		}
+		bagignore, err := ReadBagignore(absDir)
+		if err != nil {
+			return nil, nil, &BagCreateError{ExitCode: EXIT_USER_ERR, Err: err}
+		}
+		if len(bagignore) > 0 {
+			opts.Logger.Debugf("Read %d patterns from %s", len(bagignore), filepath.Join(absDir, BagignoreFile))
+			patterns[absDir] = append(bagignore, opts.ExcludePatterns...)
+		}
+	}
+	files, excluded := ExcludeFiles(absDirs, files, patterns)
+	return files, excluded, nil
+}
+
+// RunBagCreate does the work of apt-cmd bag create, so that other Go
+// code can create bags without running apt-cmd. It bags the files in
+// opts.BagDirs into opts.OutputFile, then validates and uploads the bag
+// if opts.UploadHost is set. For tar bags that need nothing done to
+// them after bagging, it writes and uploads the bag in a single pass.
+// With opts.Stream, it bags straight into the upload instead, without
+// writing opts.OutputFile unless opts.KeepLocal is set.
+//
+// If the bag was created, this returns a result describing it. The
+// result comes with an error if the bag was created but not uploaded,
+// because it was invalid or the upload failed. Errors are always
+// BagCreateErrors. Use BagCreateExitCode to get the exit status.
+//
+// Templates in the values of opts.Tags, such as {{.BagName}}, are
+// expanded first. See ExpandTagTemplates.
+//
+// This doesn't print anything, unless opts.Progress or opts.TUI is set,
+// and never exits. It uses only opts, not apt-cmd's flags, config or
+// logger, so callers set opts.S3Client or opts.Config to upload, and
+// opts.Logger to see warnings. If opts.Context is canceled before the bag is finished, this removes
+// the partial bag and returns an error with EXIT_CANCELED.
+func RunBagCreate(opts BagCreateOptions) (*BagCreateResult, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+	tags, err := ExpandTagTemplates(opts.Tags, NewTagTemplateData(util.CleanBagName(filepath.Base(opts.OutputFile))))
+	if err != nil {
+		return nil, &BagCreateError{ExitCode: EXIT_USER_ERR, Err: err}
+	}
+	opts.Tags = tags
+	ctx, log := opts.Context, opts.Logger
+	if opts.UploadHost != "" && opts.S3Client == nil {
+		// Check the credentials before bagging, not after.
+		if opts.S3Client, err = CreateS3Client(opts.Config, opts.UploadHost); err != nil {
+			return nil, &BagCreateError{ExitCode: EXIT_USER_ERR, Err: err}
+		}
+	}
+	profile := PrepareProfile(opts.Profile, opts.ManifestAlgs, opts.Tags)
+	absDirs, err := AbsBagDirs(opts.BagDirs)
+	if err != nil {
+		return nil, &BagCreateError{ExitCode: EXIT_USER_ERR, Err: err}
+	}
+
+	var progressPrinter *ProgressPrinter
+	if opts.Progress {
+		// Progress goes to stderr, so the result JSON on stdout stays
+		// the same. JSON progress suits scripts that capture stdout.
+		progressPrinter = NewProgressPrinter(os.Stderr, !IsTerminal(os.Stdout))
+	}
+	var dashboard *Dashboard
+	if opts.TUI {
+		phases := []string{"walking", "hashing", "writing"}
+		if opts.DryRun {
+			phases = []string{"walking"}
+		} else if opts.UploadHost != "" {
+			if !opts.SkipValidation {
+				phases = append(phases, "validating")
+			}
+			phases = append(phases, "uploading")
+		}
+		if IsTerminal(os.Stdout) {
+			dashboard = NewDashboard(os.Stdout, true, phases...)
+		} else {
+			dashboard = NewDashboard(os.Stderr, false, phases...)
+		}
+		dashboard.Run()
+		defer dashboard.Stop()
+	}
+
+	dashboard.Start("walking", "files", 0)
+	files, excluded, err := opts.listFiles(absDirs)
+	if err != nil {
+		return nil, err
+	}
+	for _, filePath := range excluded {
+		log.Debugf("Excluding %s", filePath)
+	}
+	log.Debugf("Excluded %d files and directories", len(excluded))
+	if opts.Files != nil {
+		files = OnlyFiles(files, opts.Files)
+		log.Debugf("Bagging %d of the files in the bag directories", len(files))
+	}
+	dashboard.Finish("walking", int64(len(files)))
+
+	// Check that we can read everything before we start hashing,
+	// so the user doesn't find out an hour into the job.
+	result := &BagCreateResult{Result: "OK"}
+	files, unreadable := FindUnreadableFiles(files)
+	skipped := make([]string, 0, len(unreadable))
+	for filePath := range unreadable {
+		skipped = append(skipped, filePath)
+	}
+	sort.Strings(skipped)
+	if len(skipped) > 0 && !opts.SkipUnreadable {
+		lines := []string{"Cannot read the following files. Fix their permissions or use --skip-unreadable to bag without them."}
+		for _, filePath := range skipped {
+			lines = append(lines, filePath+" : "+unreadable[filePath])
+		}
+		return nil, bagCreateError(EXIT_USER_ERR, "%s", strings.Join(lines, "\n"))
+	}
+	if opts.SkipUnreadable {
+		for _, filePath := range skipped {
+			log.Warningf("Skipping unreadable file %s: %s", filePath, unreadable[filePath])
+		}
+		result.Skipped = skipped
+	}
+
+	// Don't loop through these unless we have to.
+	// There could be a million of them.
+	if log.IsEnabledFor(logging.DEBUG) {
+		log.Debug("Absolute paths of directories to bag:", strings.Join(absDirs, ", "))
+		log.Debug("Files to bag:")
+		for _, f := range files {
+			log.Debug(f.FullPath)
+		}
+	}
+
+	absOutputPath, err := filepath.Abs(opts.OutputFile)
+	if err != nil {
+		return nil, bagCreateError(EXIT_RUNTIME_ERR, "Cannot determine absolute output path. %v", err)
+	}
+	log.Debug("Absolute path of output file:", absOutputPath)
+
+	// A dry run stops here, with the tags, manifest algorithms and
+	// payload files checked, before we write anything.
+	format := opts.Format
+	outputPath := BagOutputPath(absOutputPath, format)
+	result.OutputPath = outputPath
+	// Streaming doesn't write the output file, unless we keep a local
+	// copy, so it doesn't matter whether it exists.
+	streamOnly := opts.Stream && !opts.KeepLocal
+	outputExists := util.FileExists(outputPath) && !streamOnly
+	if outputExists && (opts.NoClobber || format == BagFormatDirectory || (format != BagFormatTar && !opts.Force)) {
+		return nil, bagCreateError(EXIT_USER_ERR, "Not creating bag because %s already exists.", outputPath)
+	}
+	if opts.DryRun {
+		result.DryRun = true
+		result.FileCount, result.TotalBytes = PayloadSize(files)
+		return result, nil
+	}
+	if streamOnly {
+		return streamBagToS3(opts, result, profile, absDirs, files, "")
+	}
+	if outputExists && opts.Force {
+		log.Debugf("Replacing %s because of --force.", outputPath)
+	} else if outputExists {
+		log.Warningf("Replacing existing bag %s. Use --no-clobber to keep existing bags, or --force to replace them without this warning.", outputPath)
+	}
+
+	// Make sure the directory for our output target exists
+	outputDir := path.Dir(absOutputPath)
+	if !util.FileExists(outputDir) {
+		log.Debugf("Creating directory %s because it doesn't exist.", outputDir)
+		err = os.MkdirAll(outputDir, 0755)
+		if err != nil {
+			return nil, bagCreateError(EXIT_RUNTIME_ERR, "Error creating output directory %s: %v", outputDir, err)
+		}
+	}
+
+	// If there's nothing to do to the bag once it's bagged, we write
+	// the tar file and upload it in a single pass.
+	if opts.singlePassUpload() {
+		return streamBagToS3(opts, result, profile, absDirs, files, absOutputPath)
+	}
+
+	// The bagger writes only tar files, so for other formats we bag
+	// into a temp tar file and convert it when we're done.
+	tarPath, removeTempTar := absOutputPath, func() {}
+	if format != BagFormatTar {
+		tarPath, removeTempTar, err = TempTarPath(outputPath)
+		if err != nil {
+			return nil, bagCreateError(EXIT_RUNTIME_ERR, "Error creating temp directory for bag: %v", err)
+		}
+		defer removeTempTar()
+	}
+
+	// With more than one bag directory, the bagger bags the files
+	// through symlinks in a staging directory, so each directory lands
+	// directly under data/.
+	stageDir, removeStageDir := "", func() {}
+	if len(absDirs) > 1 {
+		stageDir, removeStageDir, err = StageBagDirs(absDirs)
+		if err != nil {
+			return nil, bagCreateError(EXIT_RUNTIME_ERR, "Error staging directories to bag: %v", err)
+		}
+		defer removeStageDir()
+	}
+
+	// Create the bag. If files change while we're bagging, the
+	// manifests won't match what's on disk, so we either quit or
+	// bag them again with their new sizes and timestamps.
+	rehashed := make([]string, 0)
+	userValues := userAutoTagValues(profile)
+	var bagger *bagit.Bagger
+	for attempt := 1; ; attempt++ {
+		bagFiles := files
+		if stageDir != "" {
+			// This can't fail, since files all come from absDirs.
+			bagFiles, _ = StagedFiles(stageDir, absDirs, files)
+		}
+		bagger = bagit.NewBagger(tarPath, baggerProfile(profile), bagFiles)
+		ok := false
+		stopWatching := watchBagger(dashboard, tarPath, files)
+		stopProgress := func() {}
+		if progressPrinter != nil {
+			stopProgress = WatchBagProgress(tarPath, files, ProgressInterval, progressPrinter.Print)
+		}
+		if err = RunCancelable(ctx, func() { ok = bagger.Run() }); err != nil {
+			// Don't leave a partial bag behind.
+			stopWatching()
+			stopProgress()
+			os.Remove(tarPath)
+			return nil, &BagCreateError{ExitCode: EXIT_CANCELED, Err: err}
+		}
+		stopWatching()
+		stopProgress()
+		var changed []string
+		files, changed = FindChangedFiles(files)
+		if len(changed) == 0 {
+			if !ok {
+				lines := make([]string, 0, len(bagger.Errors))
+				for key, value := range bagger.Errors {
+					lines = append(lines, key+" : "+value)
+				}
+				return nil, bagCreateError(EXIT_RUNTIME_ERR, "%s", strings.Join(lines, "\n"))
+			}
+			break
+		}
+		os.Remove(tarPath)
+		if !opts.RehashChanged {
+			lines := append([]string{"The following files changed while they were being bagged, so the bag would not match them. Bag them when they're not in use, or use --rehash-changed to bag them again."}, changed...)
+			return nil, bagCreateError(EXIT_RUNTIME_ERR, "%s", strings.Join(lines, "\n"))
+		}
+		if attempt == MaxRehashAttempts {
+			lines := append([]string{fmt.Sprintf("Files were still changing after %d attempts to bag them:", attempt)}, changed...)
+			return nil, bagCreateError(EXIT_RUNTIME_ERR, "%s", strings.Join(lines, "\n"))
+		}
+		for _, filePath := range changed {
+			log.Warningf("File %s changed while it was being bagged. Bagging it again.", filePath)
+			if !util.StringListContains(rehashed, filePath) {
+				rehashed = append(rehashed, filePath)
+			}
+		}
+	}
+	result.Bagger = bagger
+
+	// The steps below rewrite or read the whole bag, and most of them
+	// can't be interrupted, so on Ctrl-C we stop between them. A bag
+	// that wasn't finished isn't worth keeping.
+	stopIfCanceled := func() *BagCreateError {
+		if ctx.Err() == nil {
+			return nil
+		}
+		os.Remove(tarPath)
+		return &BagCreateError{ExitCode: EXIT_CANCELED, Err: ctx.Err()}
+	}
+	if err := stopIfCanceled(); err != nil {
+		return nil, err
+	}
+	if err = WriteManifests(tarPath, profile.ManifestsRequired, tagManifestAlgorithms(profile)); err != nil {
+		os.Remove(tarPath)
+		return nil, bagCreateError(EXIT_RUNTIME_ERR, "Error writing manifests: %v", err)
+	}
+	if err = OverrideAutoTags(tarPath, userValues); err != nil {
+		os.Remove(tarPath)
+		return nil, bagCreateError(EXIT_RUNTIME_ERR, "Error writing your tag values: %v", err)
+	}
+	if opts.KeepEmptyDirs {
+		if result.KeepFiles, err = AddKeepFiles(tarPath); err != nil {
+			os.Remove(tarPath)
+			return nil, bagCreateError(EXIT_RUNTIME_ERR, "Error adding %s files to empty directories: %v", KeepFile, err)
+		}
+		log.Debugf("Added %d %s files to empty directories", len(result.KeepFiles), KeepFile)
+	}
+	if len(opts.Fetch) > 0 {
+		if err = CheckFetchEntries(opts.Fetch, bagger.PayloadFiles); err != nil {
+			os.Remove(tarPath)
+			return nil, &BagCreateError{ExitCode: EXIT_USER_ERR, Err: err}
+		}
+		if err = WriteFetchTxt(tarPath, opts.Fetch); err != nil {
+			os.Remove(tarPath)
+			return nil, bagCreateError(EXIT_RUNTIME_ERR, "Error writing %s: %v", FetchTxtFile, err)
+		}
+	}
+	if err := stopIfCanceled(); err != nil {
+		return nil, err
+	}
+	if opts.Reproducible {
+		// Validate has already checked the Bagging-Date.
+		timestamp, _ := ReproducibleTimestamp(opts.Tags)
+		pinned := FindTag(opts.Tags, "bag-info.txt", "Bagging-Date") != nil
+		if err = MakeReproducible(tarPath, timestamp, !pinned); err != nil {
+			os.Remove(tarPath)
+			return nil, bagCreateError(EXIT_RUNTIME_ERR, "Error making bag reproducible: %v", err)
+		}
+	}
+	if err = RenamePayloadDir(tarPath, opts.PayloadDir); err != nil {
+		os.Remove(tarPath)
+		return nil, bagCreateError(EXIT_RUNTIME_ERR, "Error renaming payload directory to %s: %v", opts.PayloadDir, err)
+	}
+	if err := stopIfCanceled(); err != nil {
+		return nil, err
+	}
+	if err = RewriteManifestEncoding(tarPath, opts.HashEncoding); err != nil {
+		os.Remove(tarPath)
+		return nil, bagCreateError(EXIT_RUNTIME_ERR, "Error writing manifests in %s encoding: %v", opts.HashEncoding, err)
+	}
+	if opts.ReportDuplicates || opts.FailOnDuplicates {
+		duplicates := FindDuplicateFiles(bagger.PayloadFiles)
+		if opts.FailOnDuplicates && len(duplicates) > 0 {
+			os.Remove(tarPath)
+			lines := []string{"Bag was not created because the following sets of files have identical contents:"}
+			for _, set := range duplicates {
+				lines = append(lines, strings.Join(set, ", "))
+			}
+			return nil, bagCreateError(EXIT_RUNTIME_ERR, "%s", strings.Join(lines, "\n"))
+		}
+		result.Duplicates = append([][]string{}, duplicates...)
+	}
+	if opts.RehashChanged {
+		sort.Strings(rehashed)
+		result.Rehashed = rehashed
+	}
+
+	if opts.AfterBagging != nil {
+		if err = opts.AfterBagging(tarPath); err != nil {
+			return nil, bagCreateError(EXIT_RUNTIME_ERR, "Error after bagging %s: %v", tarPath, err)
+		}
+	}
+
+	// Never upload an invalid bag. We leave it in place, so the user
+	// can see what's wrong with it. The validator reads only tar files,
+	// so we validate before converting to other formats. With Verify,
+	// we read the tar file back to catch disk errors and bagger bugs.
+	if opts.Verify || (opts.UploadHost != "" && !opts.SkipValidation) {
+		dashboard.Start("validating", "files", int64(len(bagger.PayloadFiles.Files)))
+		if opts.Verify {
+			log.Debugf("Verifying bag %s", tarPath)
+		} else {
+			log.Debugf("Validating bag %s before upload", tarPath)
+		}
+		validator, err := ValidateBagWithPayloadDir(ctx, tarPath, profile, opts.PayloadDir)
+		if err := stopIfCanceled(); err != nil {
+			return nil, err
+		}
+		if err != nil {
+			// Keep the bag, so the user can find out why.
+			ConvertTarredBag(tarPath, outputPath, format, opts.CompressionLevel)
+			result.Result = "ValidationFailed"
+			if opts.UploadHost == "" {
+				return result, bagCreateError(EXIT_RUNTIME_ERR, "Bag was created at %s, but it can't be verified: %v", outputPath, err)
+			}
+			return result, bagCreateError(EXIT_RUNTIME_ERR, "Bag was created at %s, but it was not uploaded because it can't be validated: %v", outputPath, err)
+		}
+		result.ValidationErrors = validator.Errors
+		if len(validator.Errors) == 0 {
+			dashboard.Finish("validating", int64(len(validator.PayloadFiles.Files)))
+		}
+	}
+
+	if err := stopIfCanceled(); err != nil {
+		return nil, err
+	}
+	if err = ConvertTarredBag(tarPath, outputPath, format, opts.CompressionLevel); err != nil {
+		os.RemoveAll(outputPath)
+		return nil, bagCreateError(EXIT_RUNTIME_ERR, "Error writing bag to %s: %v", outputPath, err)
+	}
+	if err := stopIfCanceled(); err != nil {
+		if outputPath != tarPath {
+			os.RemoveAll(outputPath)
+		}
+		return nil, err
+	}
+	removeTempTar()
+	// From here on, the bag is the converted one, not the temp tar.
+	bagger.OutputPath = outputPath
+	if len(result.ValidationErrors) > 0 && opts.Verify {
+		lines := []string{fmt.Sprintf("Bag was created at %s, but verification failed due to the following errors:", outputPath)}
+		for key, value := range result.ValidationErrors {
+			lines = append(lines, key+" :  "+value)
+		}
+		result.Result = "VerifyFailed"
+		return result, bagCreateError(EXIT_RUNTIME_ERR, "%s", strings.Join(lines, "\n"))
+	}
+	if len(result.ValidationErrors) > 0 {
+		lines := []string{fmt.Sprintf("Bag was created at %s, but it was not uploaded because it is invalid due to the following errors:", outputPath)}
+		for key, value := range result.ValidationErrors {
+			lines = append(lines, key+" :  "+value)
+		}
+		result.Result = "Invalid"
+		return result, bagCreateError(EXIT_BAG_INVALID, "%s", strings.Join(lines, "\n"))
+	}
+	if opts.UploadHost == "" {
+		return result, nil
+	}
+
+	// Upload the bag. If this fails, the local bag is still good,
+	// so tell the user where it is.
+	key := path.Base(outputPath)
+	if opts.UploadKey != "" {
+		key = opts.UploadKey
+	}
+	result.UploadTo = opts.UploadHost + "/" + opts.UploadBucket + "/" + key
+	log.Debugf("Uploading bag %s to %s", outputPath, result.UploadTo)
+	putOptions := minio.PutObjectOptions{NumThreads: uint(opts.Concurrency)}
+	if dashboard != nil {
+		if stat, err := os.Stat(outputPath); err == nil {
+			dashboard.Start("uploading", "bytes", stat.Size())
+		}
+		putOptions.Progress = &progressReader{dashboard: dashboard, phase: "uploading"}
+	}
+	uploadInfo, err := opts.S3Client.FPutObject(ctx, opts.UploadBucket, key, outputPath, putOptions)
+	if err != nil {
+		result.Result = "UploadFailed"
+		return result, bagCreateError(EXIT_REQUEST_ERROR, "Bag was created at %s, but upload to %s/%s failed: %v", outputPath, opts.UploadHost, opts.UploadBucket, err)
+	}
+	dashboard.Finish("uploading", uploadInfo.Size)
+	result.ETag = uploadInfo.ETag
+	return result, nil
+}
@@ -0,0 +1,340 @@
+package cmd_test
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/APTrust/apt-cmd/cmd"
+	"github.com/APTrust/dart-runner/bagit"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newBagCreateOptions(t *testing.T) cmd.BagCreateOptions {
+	bagDir := path.Join(t.TempDir(), "files")
+	require.Nil(t, os.MkdirAll(path.Join(bagDir, "sub"), 0755))
+	require.Nil(t, os.WriteFile(path.Join(bagDir, "file.txt"), []byte("data"), 0644))
+	require.Nil(t, os.WriteFile(path.Join(bagDir, "sub", "copy.txt"), []byte("data"), 0644))
+	profile, err := cmd.LoadProfile("empty")
+	require.Nil(t, err)
+	return cmd.BagCreateOptions{
+		Profile:      profile,
+		BagDirs:      []string{bagDir},
+		OutputFile:   path.Join(t.TempDir(), "library.tar"),
+		ManifestAlgs: []string{"md5", "sha256"},
+		Tags: cmd.EnsureDefaultTags([]*bagit.TagDefinition{
+			{TagFile: "bag-info.txt", TagName: "Source-Organization", UserValue: "Faber College"},
+		}),
+	}
+}
+
+func TestRunBagCreate(t *testing.T) {
+	opts := newBagCreateOptions(t)
+	opts.ReportDuplicates = true
+	tagCount := len(opts.Profile.Tags)
+	result, err := cmd.RunBagCreate(opts)
+	require.Nil(t, err)
+	require.NotNil(t, result)
+	assert.Equal(t, "OK", result.Result)
+	assert.Equal(t, opts.OutputFile, result.OutputPath)
+	require.NotNil(t, result.Bagger)
+	assert.Equal(t, 2, len(result.Bagger.PayloadFiles.Files))
+	assert.Equal(t, [][]string{{"data/files/file.txt", "data/files/sub/copy.txt"}}, result.Duplicates)
+	assert.Nil(t, result.Skipped)
+	assert.Nil(t, result.Rehashed)
+	assert.FileExists(t, opts.OutputFile)
+
+	// The caller's profile doesn't change.
+	assert.Equal(t, tagCount, len(opts.Profile.Tags))
+	assert.Empty(t, opts.Profile.ManifestsRequired)
+
+	bagInfo := tarFileContent(t, opts.OutputFile, "library/bag-info.txt")
+	assert.Contains(t, bagInfo, "Source-Organization: Faber College")
+	assert.NotEmpty(t, tarFileContent(t, opts.OutputFile, "library/manifest-md5.txt"))
+
+	validator, err := cmd.ValidateBag(context.Background(), opts.OutputFile, opts.Profile)
+	require.Nil(t, err)
+	assert.Empty(t, validator.Errors)
+
+	parsed := make(map[string]interface{})
+	require.Nil(t, json.Unmarshal([]byte(result.JSON(`, "bagDir": "x"`)), &parsed))
+	assert.Equal(t, "OK", parsed["result"])
+	assert.Equal(t, opts.OutputFile, parsed["outputFile"])
+	assert.Equal(t, "x", parsed["bagDir"])
+	assert.NotNil(t, parsed["duplicates"])
+}
+
+func TestBagCreateResult_JSONEscaping(t *testing.T) {
+	// Upload keys can hold any character, and some S3 services quote
+	// their ETags.
+	uploadTo := `s3.amazonaws.com/my-bucket/"quoted" \ bag.tar`
+	etag := `"12345-2"`
+	for _, result := range []*cmd.BagCreateResult{
+		{Result: "OK", OutputPath: "/tmp/bag.tar", UploadTo: uploadTo, ETag: etag},
+		{Result: "UploadFailed", OutputPath: "/tmp/bag.tar", UploadTo: uploadTo},
+		{Result: "OK", UploadTo: uploadTo, ETag: etag, Streamed: true},
+		{Result: "UploadFailed", UploadTo: uploadTo, Streamed: true},
+	} {
+		parsed := make(map[string]interface{})
+		require.Nil(t, json.Unmarshal([]byte(result.JSON("")), &parsed), result.JSON(""))
+		assert.Equal(t, uploadTo, parsed["uploadTo"])
+		if result.ETag != "" {
+			assert.Equal(t, etag, parsed["etag"])
+		}
+	}
+}
+
+func TestRunBagCreate_DryRun(t *testing.T) {
+	opts := newBagCreateOptions(t)
+	opts.DryRun = true
+	opts.Format = cmd.BagFormatZip
+	result, err := cmd.RunBagCreate(opts)
+	require.Nil(t, err)
+	assert.True(t, result.DryRun)
+	assert.Nil(t, result.Bagger)
+	assert.Equal(t, 2, result.FileCount)
+	assert.EqualValues(t, 8, result.TotalBytes)
+	assert.Equal(t, path.Join(path.Dir(opts.OutputFile), "library.zip"), result.OutputPath)
+	assert.NoFileExists(t, result.OutputPath)
+	assert.Contains(t, result.JSON(""), `"wouldWrite": `)
+}
+
+func TestRunBagCreate_Errors(t *testing.T) {
+	opts := newBagCreateOptions(t)
+	opts.Profile, _ = cmd.LoadProfile("aptrust")
+	result, err := cmd.RunBagCreate(opts)
+	assert.Nil(t, result)
+	require.NotNil(t, err)
+	assert.Equal(t, cmd.EXIT_USER_ERR, cmd.BagCreateExitCode(err))
+	assert.Contains(t, err.Error(), "Required tag aptrust-info.txt/Title is missing.")
+
+	opts = newBagCreateOptions(t)
+	opts.Format = "rar"
+	_, err = cmd.RunBagCreate(opts)
+	require.NotNil(t, err)
+	assert.Equal(t, cmd.EXIT_USER_ERR, cmd.BagCreateExitCode(err))
+	assert.Contains(t, err.Error(), "Invalid --format 'rar'")
+
+	opts = newBagCreateOptions(t)
+	opts.BagDirs = []string{path.Join(t.TempDir(), "does-not-exist")}
+	_, err = cmd.RunBagCreate(opts)
+	require.NotNil(t, err)
+	assert.Equal(t, cmd.EXIT_USER_ERR, cmd.BagCreateExitCode(err))
+
+	opts = newBagCreateOptions(t)
+	opts.StrictTags = true
+	opts.Tags = append(opts.Tags, &bagit.TagDefinition{TagFile: "bag-info.txt", TagName: "Mascot", UserValue: "Pig"})
+	_, err = cmd.RunBagCreate(opts)
+	require.NotNil(t, err)
+	assert.Equal(t, cmd.EXIT_USER_ERR, cmd.BagCreateExitCode(err))
+	assert.Contains(t, err.Error(), "Tag bag-info.txt/Mascot is not defined in profile")
+	assert.NoFileExists(t, opts.OutputFile)
+
+	opts = newBagCreateOptions(t)
+	opts.ManifestAlgs = nil
+	assert.NotNil(t, opts.Validate())
+
+	// Missing S3 credentials are an error, not an exit, and nothing
+	// is bagged.
+	opts = newBagCreateOptions(t)
+	opts.UploadHost, opts.UploadBucket = "s3.amazonaws.com", "my-bucket"
+	_, err = cmd.RunBagCreate(opts)
+	require.NotNil(t, err)
+	assert.Equal(t, cmd.EXIT_USER_ERR, cmd.BagCreateExitCode(err))
+	assert.Contains(t, err.Error(), "Missing S3 connection info")
+	assert.NoFileExists(t, opts.OutputFile)
+	opts.Config = &cmd.Config{AWSKey: "key"}
+	_, err = cmd.RunBagCreate(opts)
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), "AWS Secret is missing")
+
+	assert.Equal(t, cmd.EXIT_OK, cmd.BagCreateExitCode(nil))
+	assert.Equal(t, cmd.EXIT_RUNTIME_ERR, cmd.BagCreateExitCode(os.ErrNotExist))
+}
+
+func TestPrepareProfile(t *testing.T) {
+	profile, err := cmd.LoadProfile("aptrust")
+	require.Nil(t, err)
+	profile.TagFilesRequired = []string{"aptrust-info.txt"}
+	tags := []*bagit.TagDefinition{
+		{TagFile: "aptrust-info.txt", TagName: "Title", UserValue: "Bag Title"},
+	}
+	prepared := cmd.PrepareProfile(profile, []string{"md5", "sha256"}, tags)
+	assert.Equal(t, []string{"md5", "sha256"}, prepared.ManifestsRequired)
+	assert.Equal(t, []string{"aptrust-info.txt"}, prepared.TagFilesRequired)
+	assert.Equal(t, "Bag Title", prepared.GetTagDef("aptrust-info.txt", "Title").UserValue)
+	assert.Equal(t, "", profile.GetTagDef("aptrust-info.txt", "Title").UserValue)
+}
+
+func TestRunBagCreate_Sha3(t *testing.T) {
+	opts := newBagCreateOptions(t)
+	opts.ManifestAlgs = []string{"sha3-256"}
+	_, err := cmd.RunBagCreate(opts)
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), "Manifest algorithm 'sha3-256' is not allowed in profile")
+	assert.NoFileExists(t, opts.OutputFile)
+
+	opts.Profile.ManifestsAllowed = append(opts.Profile.ManifestsAllowed, "sha3-256", "sha3-512")
+	opts.Profile.TagManifestsAllowed = append(opts.Profile.TagManifestsAllowed, "sha3-256", "sha3-512")
+	result, err := cmd.RunBagCreate(opts)
+	require.Nil(t, err)
+	assert.Equal(t, "OK", result.Result)
+
+	// The bagger's stand-in sha256 manifests are gone.
+	names := tarFileNames(t, opts.OutputFile)
+	assert.Contains(t, names, "library/manifest-sha3-256.txt")
+	assert.Contains(t, names, "library/tagmanifest-sha3-256.txt")
+	assert.NotContains(t, names, "library/manifest-sha256.txt")
+	assert.NotContains(t, names, "library/tagmanifest-sha256.txt")
+	manifest := tarFileContent(t, opts.OutputFile, "library/manifest-sha3-256.txt")
+	assert.Equal(t, "efda893aa850b0c0e61f33325615b9d93bcf6b42d60d8f5d37ebc720fd4e3daf  data/files/file.txt\nefda893aa850b0c0e61f33325615b9d93bcf6b42d60d8f5d37ebc720fd4e3daf  data/files/sub/copy.txt\n", manifest)
+	tagManifest := tarFileContent(t, opts.OutputFile, "library/tagmanifest-sha3-256.txt")
+	assert.Contains(t, tagManifest, "  bag-info.txt\n")
+	assert.Contains(t, tagManifest, "  manifest-sha3-256.txt\n")
+
+	validator, err := cmd.ValidateBag(context.Background(), opts.OutputFile, cmd.PrepareProfile(opts.Profile, opts.ManifestAlgs, nil))
+	require.Nil(t, err)
+	assert.Empty(t, validator.Errors)
+
+	// Mixed with other algorithms, and re-encoded.
+	opts = newBagCreateOptions(t)
+	opts.Profile.ManifestsAllowed = append(opts.Profile.ManifestsAllowed, "sha3-512")
+	opts.Profile.TagManifestsAllowed = append(opts.Profile.TagManifestsAllowed, "sha3-512")
+	opts.ManifestAlgs = []string{"md5", "sha3-512"}
+	opts.HashEncoding = cmd.HashEncodingBase64
+	opts.Format = cmd.BagFormatDirectory
+	result, err = cmd.RunBagCreate(opts)
+	require.Nil(t, err)
+	for _, name := range []string{"manifest-md5.txt", "manifest-sha3-512.txt", "tagmanifest-md5.txt", "tagmanifest-sha3-512.txt"} {
+		assert.FileExists(t, path.Join(result.OutputPath, name))
+	}
+	validator, err = cmd.ValidateBag(context.Background(), result.OutputPath, cmd.PrepareProfile(opts.Profile, opts.ManifestAlgs, nil))
+	require.Nil(t, err)
+	assert.Empty(t, validator.Errors)
+
+	// Changing a file breaks the sha3 manifest.
+	require.Nil(t, os.WriteFile(path.Join(result.OutputPath, "data", "files", "file.txt"), []byte("atad"), 0644))
+	validator, err = cmd.ValidateBag(context.Background(), result.OutputPath, cmd.PrepareProfile(opts.Profile, opts.ManifestAlgs, nil))
+	require.Nil(t, err)
+	assert.Contains(t, validator.Errors["data/files/file.txt"], "does not match")
+}
+
+func TestRunBagCreate_ExistingBag(t *testing.T) {
+	opts := newBagCreateOptions(t)
+	require.Nil(t, os.WriteFile(opts.OutputFile, []byte("old bag"), 0644))
+	opts.NoClobber = true
+	_, err := cmd.RunBagCreate(opts)
+	require.NotNil(t, err)
+	assert.Equal(t, cmd.EXIT_USER_ERR, cmd.BagCreateExitCode(err))
+	assert.Contains(t, err.Error(), "already exists")
+	data, err := os.ReadFile(opts.OutputFile)
+	require.Nil(t, err)
+	assert.Equal(t, "old bag", string(data))
+
+	opts.Force = true
+	_, err = cmd.RunBagCreate(opts)
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), "--no-clobber can't be used with --force")
+
+	// By default, tar files are replaced.
+	opts.NoClobber, opts.Force = false, false
+	_, err = cmd.RunBagCreate(opts)
+	require.Nil(t, err)
+	assert.NotEmpty(t, tarFileContent(t, opts.OutputFile, "library/bagit.txt"))
+
+	// Zip files are replaced only with Force.
+	opts.Format = cmd.BagFormatZip
+	pathToZip := cmd.BagOutputPath(opts.OutputFile, cmd.BagFormatZip)
+	require.Nil(t, os.WriteFile(pathToZip, []byte("old bag"), 0644))
+	_, err = cmd.RunBagCreate(opts)
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), "already exists")
+	opts.Force = true
+	result, err := cmd.RunBagCreate(opts)
+	require.Nil(t, err)
+	assert.Equal(t, pathToZip, result.OutputPath)
+	stat, err := os.Stat(pathToZip)
+	require.Nil(t, err)
+	assert.Greater(t, stat.Size(), int64(len("old bag")))
+
+	// Directories never are.
+	opts.Format = cmd.BagFormatDirectory
+	require.Nil(t, os.MkdirAll(cmd.BagOutputPath(opts.OutputFile, cmd.BagFormatDirectory), 0755))
+	_, err = cmd.RunBagCreate(opts)
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), "already exists")
+}
+
+func TestRunBagCreate_Verify(t *testing.T) {
+	opts := newBagCreateOptions(t)
+	opts.Verify = true
+	result, err := cmd.RunBagCreate(opts)
+	require.Nil(t, err)
+	assert.Equal(t, "OK", result.Result)
+	assert.Empty(t, result.ValidationErrors)
+
+	opts.SkipValidation = true
+	_, err = cmd.RunBagCreate(opts)
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), "--verify can't be used with --skip-validation")
+}
+
+func TestRunBagCreate_Canceled(t *testing.T) {
+	opts := newBagCreateOptions(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	opts.Context = ctx
+	_, err := cmd.RunBagCreate(opts)
+	require.NotNil(t, err)
+	assert.Equal(t, cmd.EXIT_CANCELED, cmd.BagCreateExitCode(err))
+
+	// Canceled after bagging, the partial bag and its temp tar are
+	// removed.
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	opts.Context = ctx
+	opts.OutputFile = path.Join(t.TempDir(), "library.tar.gz")
+	opts.AfterBagging = func(pathToTar string) error {
+		cancel()
+		return nil
+	}
+	_, err = cmd.RunBagCreate(opts)
+	require.NotNil(t, err)
+	assert.Equal(t, cmd.EXIT_CANCELED, cmd.BagCreateExitCode(err))
+	entries, err := os.ReadDir(path.Dir(opts.OutputFile))
+	require.Nil(t, err)
+	assert.Empty(t, entries)
+}
+
+func TestRunBagCreate_Symlinks(t *testing.T) {
+	opts := newBagCreateOptions(t)
+	outside := t.TempDir()
+	require.Nil(t, os.WriteFile(path.Join(outside, "linked.txt"), []byte("linked data"), 0644))
+	require.Nil(t, os.Symlink(path.Join(outside, "linked.txt"), path.Join(opts.BagDirs[0], "linked.txt")))
+
+	// By default, links are left out.
+	result, err := cmd.RunBagCreate(opts)
+	require.Nil(t, err, err)
+	assert.NotContains(t, tarFileNames(t, result.OutputPath), "library/data/files/linked.txt")
+
+	opts.Symlinks = cmd.SymlinksFollow
+	opts.Verify = true
+	result, err = cmd.RunBagCreate(opts)
+	require.Nil(t, err, err)
+	assert.Equal(t, "linked data", tarFileContent(t, result.OutputPath, "library/data/files/linked.txt"))
+	assert.Contains(t, tarFileContent(t, result.OutputPath, "library/bag-info.txt"), "Payload-Oxum: 19.3")
+
+	opts.Symlinks = cmd.SymlinksError
+	_, err = cmd.RunBagCreate(opts)
+	require.NotNil(t, err)
+	assert.Equal(t, cmd.EXIT_USER_ERR, cmd.BagCreateExitCode(err))
+	assert.Contains(t, err.Error(), "symbolic links")
+
+	opts.Symlinks = "sometimes"
+	_, err = cmd.RunBagCreate(opts)
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), "Invalid --symlinks")
+}
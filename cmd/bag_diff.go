@@ -0,0 +1,316 @@
+package cmd
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/APTrust/dart-runner/bagit"
+	"github.com/APTrust/dart-runner/constants"
+	"github.com/APTrust/dart-runner/util"
+	"github.com/spf13/cobra"
+)
+
+// bagDiffCmd represents the bag diff command
+var bagDiffCmd = &cobra.Command{
+	Use:     "diff",
+	Short:   "Compare the payloads and tags of two bags",
+	Example: `apt-cmd bag diff --a=photos.tar --b=migrated/photos.tar`,
+	Long: `Compare two bags, to check that a migrated or re-created bag has the
+same payload as the original. bag diff reads .tar, .tar.gz, .tgz and .zip
+bags, and bag directories. It compares the bags' payload manifests, by
+path and digest, and the tags in their tag files. It doesn't calculate
+any checksums, so run bag validate first if you need to know that each
+bag matches its own manifests.
+
+  apt-cmd bag diff --a=photos.tar --b=migrated/photos.tar
+
+Payloads are compared using every manifest algorithm the two bags have
+in common. If they have none in common, bag diff exits with status 3.
+
+bag diff prints a JSON object describing the differences:
+
+  "result"      "OK" if the bags are the same, or "Different"
+  "algorithms"  the manifest algorithms it compared
+  "onlyInA"     payload files that are only in bag a
+  "onlyInB"     payload files that are only in bag b
+  "changed"     payload files in both bags with different digests, with
+                the first algorithm whose digests differ
+  "tagChanges"  tags with different values in the two bags, with the
+                values in each, in order. A tag or tag file that's
+                missing from one bag has no values there.
+
+For example:
+
+  { "result": "Different", "a": "photos.tar", "b": "copy.tar",
+    "algorithms": [ "md5", "sha256" ], "onlyInA": [], "onlyInB": [],
+    "changed": [ { "path": "data/img/001.jpg", "algorithm": "md5",
+                   "a": "8d77...26dc", "b": "4f1a...93e0" } ],
+    "tagChanges": [ { "tagFile": "bag-info.txt", "tagName": "Bagging-Date",
+                      "a": [ "2023-06-01" ], "b": [ "2023-07-15" ] } ] }
+
+bag diff exits with status 0 if the bags are the same, and with status 2
+if they differ. Tags such as Bagging-Date differ between bags that were
+made at different times, so add --payload-only to compare only the
+payloads.
+
+Full online documentation:
+
+https://aptrust.github.io/userguide/partner_tools/
+
+`,
+	Run: func(cmd *cobra.Command, args []string) {
+		pathToA := cmd.Flag("a").Value.String()
+		pathToB := cmd.Flag("b").Value.String()
+		if pathToA == "" || pathToB == "" {
+			Fail(EXIT_USER_ERR, "--a and --b are required.")
+		}
+		payloadOnly, _ := cmd.Flags().GetBool("payload-only")
+		diff, err := DiffBags(pathToA, pathToB, payloadOnly)
+		if errors.Is(err, ErrNoCommonAlgorithm) {
+			Fail(EXIT_USER_ERR, err.Error())
+		}
+		if err != nil {
+			Fail(EXIT_RUNTIME_ERR, "Can't compare bags.", err.Error())
+		}
+		printResult(diff)
+		if diff.Result != "OK" {
+			os.Exit(EXIT_BAG_INVALID)
+		}
+		os.Exit(EXIT_OK)
+	},
+}
+
+func init() {
+	bagCmd.AddCommand(bagDiffCmd)
+	bagDiffCmd.Flags().String("a", "", "Path to the first tarred, zipped or directory bag")
+	bagDiffCmd.Flags().String("b", "", "Path to the second tarred, zipped or directory bag")
+	bagDiffCmd.Flags().Bool("payload-only", false, "Compare only the payload manifests, not the tag files")
+}
+
+// ErrNoCommonAlgorithm means that DiffBags can't compare two bags'
+// payloads, because they have no manifest algorithm in common.
+var ErrNoCommonAlgorithm = errors.New("bags have no manifest algorithm in common")
+
+// BagDiff describes the differences between two bags, A and B, as bag
+// diff prints them. Algorithms are the manifest algorithms both bags
+// have, which DiffBags compared. Result is "OK" if the bags are the
+// same, or "Different".
+type BagDiff struct {
+	Result     string            `json:"result"`
+	A          string            `json:"a"`
+	B          string            `json:"b"`
+	Algorithms []string          `json:"algorithms"`
+	OnlyInA    []string          `json:"onlyInA"`
+	OnlyInB    []string          `json:"onlyInB"`
+	Changed    []BagDiffFile     `json:"changed"`
+	TagChanges []BagDiffTagValue `json:"tagChanges"`
+}
+
+// BagDiffFile is a payload file that's in both bags, with different
+// digests. A and B are its digests in each bag with Algorithm, the
+// first of the compared algorithms whose digests differ.
+type BagDiffFile struct {
+	Path      string `json:"path"`
+	Algorithm string `json:"algorithm"`
+	A         string `json:"a"`
+	B         string `json:"b"`
+}
+
+// BagDiffTagValue is a tag whose values differ in the two bags. A and B
+// are its values in each bag, in order.
+type BagDiffTagValue struct {
+	TagFile string   `json:"tagFile"`
+	TagName string   `json:"tagName"`
+	A       []string `json:"a"`
+	B       []string `json:"b"`
+}
+
+// diffedBag is what DiffBags reads from each bag: the digests in each
+// payload manifest, keyed by algorithm, then by path in the bag, and the
+// values of the tags in each tag file, keyed by tag file, then by tag
+// name.
+type diffedBag struct {
+	manifests map[string]map[string]string
+	tags      map[string]map[string][]string
+}
+
+// DiffBags compares the payload manifests and, unless payloadOnly is
+// set, the tag files of the bags at pathToA and pathToB, which may be
+// .tar, .tar.gz, .tgz or .zip files, or directories. Digests are
+// compared in lowercase hex, so bags with different hash encodings can
+// be the same. Like GetBagInfo, this doesn't read payload files, so it
+// doesn't check that either bag is valid. The error wraps
+// ErrNoCommonAlgorithm if the bags have no manifest algorithm in
+// common.
+func DiffBags(pathToA, pathToB string, payloadOnly bool) (*BagDiff, error) {
+	a, err := readDiffedBag(pathToA)
+	if err != nil {
+		return nil, err
+	}
+	b, err := readDiffedBag(pathToB)
+	if err != nil {
+		return nil, err
+	}
+	diff := &BagDiff{
+		Result:     "OK",
+		A:          pathToA,
+		B:          pathToB,
+		Algorithms: make([]string, 0),
+		OnlyInA:    make([]string, 0),
+		OnlyInB:    make([]string, 0),
+		Changed:    make([]BagDiffFile, 0),
+		TagChanges: make([]BagDiffTagValue, 0),
+	}
+	for alg := range a.manifests {
+		if _, ok := b.manifests[alg]; ok {
+			diff.Algorithms = append(diff.Algorithms, alg)
+		}
+	}
+	if len(diff.Algorithms) == 0 {
+		return nil, fmt.Errorf("can't compare %s and %s: %w", pathToA, pathToB, ErrNoCommonAlgorithm)
+	}
+	sort.Strings(diff.Algorithms)
+
+	for _, pathInBag := range sortedUnion(a.payloadPaths(diff.Algorithms), b.payloadPaths(diff.Algorithms)) {
+		if !a.hasPayloadFile(pathInBag, diff.Algorithms) {
+			diff.OnlyInB = append(diff.OnlyInB, pathInBag)
+			continue
+		}
+		if !b.hasPayloadFile(pathInBag, diff.Algorithms) {
+			diff.OnlyInA = append(diff.OnlyInA, pathInBag)
+			continue
+		}
+		for _, alg := range diff.Algorithms {
+			digestA := a.manifests[alg][pathInBag]
+			digestB := b.manifests[alg][pathInBag]
+			if digestA != digestB {
+				diff.Changed = append(diff.Changed, BagDiffFile{Path: pathInBag, Algorithm: alg, A: digestA, B: digestB})
+				break
+			}
+		}
+	}
+
+	if !payloadOnly {
+		for _, tagFile := range sortedUnion(a.tagFiles(), b.tagFiles()) {
+			for _, tagName := range sortedUnion(a.tagNames(tagFile), b.tagNames(tagFile)) {
+				valuesA := nonNilList(a.tags[tagFile][tagName])
+				valuesB := nonNilList(b.tags[tagFile][tagName])
+				if !reflect.DeepEqual(valuesA, valuesB) {
+					diff.TagChanges = append(diff.TagChanges, BagDiffTagValue{TagFile: tagFile, TagName: tagName, A: valuesA, B: valuesB})
+				}
+			}
+		}
+	}
+	if len(diff.OnlyInA)+len(diff.OnlyInB)+len(diff.Changed)+len(diff.TagChanges) > 0 {
+		diff.Result = "Different"
+	}
+	return diff, nil
+}
+
+// readDiffedBag reads the payload manifests and tag files of the bag at
+// pathToBag for DiffBags.
+func readDiffedBag(pathToBag string) (*diffedBag, error) {
+	bag := &diffedBag{
+		manifests: make(map[string]map[string]string),
+		tags:      make(map[string]map[string][]string),
+	}
+	err := walkBag(pathToBag, func(entry *archiveEntry, reader io.Reader) error {
+		parts := strings.SplitN(strings.TrimPrefix(entry.Name, "./"), "/", 2)
+		if entry.IsDir || len(parts) < 2 {
+			return nil
+		}
+		pathInBag := parts[1]
+		match := manifestRegex.FindStringSubmatch(pathInBag)
+		isTagFile := match == nil && pathInBag != FetchTxtFile && util.BagFileType(pathInBag) == constants.FileTypeTag
+		if (match == nil || match[1] == "tag") && !isTagFile {
+			return nil
+		}
+		data, err := io.ReadAll(reader)
+		if err != nil {
+			return err
+		}
+		if match != nil {
+			digests := make(map[string]string)
+			for path, digest := range parseManifest(data) {
+				digests[path] = NormalizeDigest(digest)
+			}
+			bag.manifests[match[2]] = digests
+			return nil
+		}
+		tags, err := bagit.ParseTagFile(bytes.NewReader(data), pathInBag)
+		if err != nil {
+			return err
+		}
+		bag.tags[pathInBag] = make(map[string][]string)
+		for _, tag := range tags {
+			bag.tags[pathInBag][tag.TagName] = append(bag.tags[pathInBag][tag.TagName], tag.Value)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return bag, nil
+}
+
+// payloadPaths returns the paths listed in the bag's manifests for
+// algs.
+func (bag *diffedBag) payloadPaths(algs []string) []string {
+	paths := make([]string, 0)
+	for _, alg := range algs {
+		for pathInBag := range bag.manifests[alg] {
+			paths = append(paths, pathInBag)
+		}
+	}
+	return paths
+}
+
+// tagFiles returns the paths of the bag's tag files.
+func (bag *diffedBag) tagFiles() []string {
+	tagFiles := make([]string, 0, len(bag.tags))
+	for tagFile := range bag.tags {
+		tagFiles = append(tagFiles, tagFile)
+	}
+	return tagFiles
+}
+
+// tagNames returns the names of the tags in the bag's tagFile.
+func (bag *diffedBag) tagNames(tagFile string) []string {
+	tagNames := make([]string, 0, len(bag.tags[tagFile]))
+	for tagName := range bag.tags[tagFile] {
+		tagNames = append(tagNames, tagName)
+	}
+	return tagNames
+}
+
+// hasPayloadFile returns true if any of the bag's manifests for algs
+// lists pathInBag.
+func (bag *diffedBag) hasPayloadFile(pathInBag string, algs []string) bool {
+	for _, alg := range algs {
+		if _, ok := bag.manifests[alg][pathInBag]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// sortedUnion returns the strings in a and b, sorted, without
+// duplicates.
+func sortedUnion(a, b []string) []string {
+	seen := make(map[string]bool)
+	union := make([]string, 0, len(a)+len(b))
+	for _, s := range append(append([]string{}, a...), b...) {
+		if !seen[s] {
+			seen[s] = true
+			union = append(union, s)
+		}
+	}
+	sort.Strings(union)
+	return union
+}
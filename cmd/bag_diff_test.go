@@ -0,0 +1,95 @@
+package cmd_test
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/APTrust/apt-cmd/cmd"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDiffBags(t *testing.T) {
+	pathToA := writeTestTar(t, map[string]string{
+		"bagit.txt":           "BagIt-Version: 1.0\nTag-File-Character-Encoding: UTF-8\n",
+		"bag-info.txt":        "Bagging-Date: 2023-06-01\nContact-Name: One\nContact-Name: Two\n",
+		"manifest-md5.txt":    "aaa  data/same.txt\nbbb  data/changed.txt\nccc  data/only-a.txt\n",
+		"manifest-sha256.txt": "111  data/same.txt\n222  data/changed.txt\n333  data/only-a.txt\n",
+		"data/same.txt":       "same",
+	})
+	pathToB := writeTestTar(t, map[string]string{
+		"bagit.txt":         "BagIt-Version: 1.0\nTag-File-Character-Encoding: UTF-8\n",
+		"bag-info.txt":      "Bagging-Date: 2023-07-15\nContact-Name: One\n",
+		"extra-info.txt":    "Note: new\n",
+		"manifest-md5.txt":  "AAA  data/same.txt\nddd  data/changed.txt\neee  data/only-b.txt\n",
+		"manifest-sha1.txt": "999  data/same.txt\n",
+	})
+
+	diff, err := cmd.DiffBags(pathToA, pathToB, false)
+	require.Nil(t, err)
+	assert.Equal(t, "Different", diff.Result)
+	assert.Equal(t, []string{"md5"}, diff.Algorithms)
+	assert.Equal(t, []string{"data/only-a.txt"}, diff.OnlyInA)
+	assert.Equal(t, []string{"data/only-b.txt"}, diff.OnlyInB)
+	assert.Equal(t, []cmd.BagDiffFile{{Path: "data/changed.txt", Algorithm: "md5", A: "bbb", B: "ddd"}}, diff.Changed)
+	assert.Equal(t, []cmd.BagDiffTagValue{
+		{TagFile: "bag-info.txt", TagName: "Bagging-Date", A: []string{"2023-06-01"}, B: []string{"2023-07-15"}},
+		{TagFile: "bag-info.txt", TagName: "Contact-Name", A: []string{"One", "Two"}, B: []string{"One"}},
+		{TagFile: "extra-info.txt", TagName: "Note", A: []string{}, B: []string{"new"}},
+	}, diff.TagChanges)
+
+	diff, err = cmd.DiffBags(pathToA, pathToB, true)
+	require.Nil(t, err)
+	assert.Empty(t, diff.TagChanges)
+
+	// A bag is the same as itself.
+	diff, err = cmd.DiffBags(pathToA, pathToA, false)
+	require.Nil(t, err)
+	assert.Equal(t, "OK", diff.Result)
+	assert.Equal(t, []string{"md5", "sha256"}, diff.Algorithms)
+	assert.Empty(t, diff.OnlyInA)
+	assert.Empty(t, diff.Changed)
+
+	pathToSha512 := writeTestTar(t, map[string]string{"manifest-sha512.txt": "fff  data/same.txt\n"})
+	_, err = cmd.DiffBags(pathToA, pathToSha512, false)
+	require.NotNil(t, err)
+	assert.True(t, errors.Is(err, cmd.ErrNoCommonAlgorithm))
+}
+
+func TestBagDiff(t *testing.T) {
+	opts := newBagCreateOptions(t)
+	opts.Reproducible = true
+	_, err := cmd.RunBagCreate(opts)
+	require.Nil(t, err)
+	pathToA := opts.OutputFile
+
+	// A reproducible bag of the same files is the same.
+	opts.OutputFile = path.Join(t.TempDir(), "library.tar")
+	_, err = cmd.RunBagCreate(opts)
+	require.Nil(t, err)
+	exitCode, stdout, stderr := execCmd(t, "go", "run", "../main.go", "bag", "diff", "--a="+pathToA, "--b="+opts.OutputFile)
+	require.Equal(t, cmd.EXIT_OK, exitCode, stderr)
+	diff := &cmd.BagDiff{}
+	require.Nil(t, json.Unmarshal([]byte(stdout), diff), stdout)
+	assert.Equal(t, "OK", diff.Result)
+
+	require.Nil(t, os.WriteFile(path.Join(opts.BagDirs[0], "file.txt"), []byte("changed"), 0644))
+	opts.OutputFile = path.Join(t.TempDir(), "library.tar")
+	_, err = cmd.RunBagCreate(opts)
+	require.Nil(t, err)
+	exitCode, stdout, stderr = execCmd(t, "go", "run", "../main.go", "bag", "diff", "--a="+pathToA, "--b="+opts.OutputFile)
+	assert.NotEqual(t, cmd.EXIT_OK, exitCode)
+	assert.Contains(t, stderr, "exit status 2")
+	require.Nil(t, json.Unmarshal([]byte(stdout), diff), stdout)
+	assert.Equal(t, "Different", diff.Result)
+	require.Len(t, diff.Changed, 1)
+	assert.Equal(t, "data/files/file.txt", diff.Changed[0].Path)
+
+	exitCode, _, stderr = execCmd(t, "go", "run", "../main.go", "bag", "diff", "--a="+pathToA)
+	assert.NotEqual(t, cmd.EXIT_OK, exitCode)
+	assert.Contains(t, stderr, "--a and --b are required.")
+	assert.Contains(t, stderr, "exit status 3")
+}
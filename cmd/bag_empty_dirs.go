@@ -0,0 +1,156 @@
+package cmd
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/APTrust/dart-runner/util"
+)
+
+// KeepFile is the empty placeholder file that bag create
+// --keep-empty-dirs adds to each empty payload directory, since BagIt
+// bags list only files, and tools that unpack bags may drop empty
+// directories.
+const KeepFile = ".keep"
+
+var payloadOxumRegex = regexp.MustCompile(`(?m)^(Payload-Oxum:\s*)(\d+)\.(\d+)`)
+
+// AddKeepFiles adds an empty KeepFile to each directory in the payload
+// of the tarred bag at pathToTar that has nothing else in it, including
+// directories whose contents were all excluded. The placeholders are
+// payload files like any other, so this adds them to the payload
+// manifests and to the Payload-Oxum in bag-info.txt, and updates the
+// tag manifests to match. Call this before RewriteManifestEncoding,
+// since it expects hex digests. Like WriteManifests, this writes a new
+// tar file next to the original, then replaces the original.
+//
+// This returns the placeholders' paths in the bag, sorted.
+func AddKeepFiles(pathToTar string) ([]string, error) {
+	dirs, files, err := readBagStructure(pathToTar)
+	if err != nil {
+		return nil, err
+	}
+	keepFiles := make([]string, 0)
+	for _, dir := range dirs {
+		if dir != "data" && strings.HasPrefix(dir, "data/") && !files[dir] {
+			keepFiles = append(keepFiles, dir+"/"+KeepFile)
+		}
+	}
+	sort.Strings(keepFiles)
+	if len(keepFiles) == 0 {
+		return keepFiles, nil
+	}
+
+	replacements := make(map[string][]byte)
+	for _, keepFile := range keepFiles {
+		replacements[keepFile] = []byte{}
+	}
+	changed, err := readTarFiles(pathToTar, func(pathInBag string) bool {
+		return pathInBag == "bag-info.txt" || manifestRegex.MatchString(pathInBag)
+	})
+	if err != nil {
+		return nil, err
+	}
+	for name, data := range changed {
+		match := manifestRegex.FindStringSubmatch(name)
+		if match == nil || match[1] == "tag" {
+			continue
+		}
+		digests := parseManifest(data)
+		emptyDigest, err := hexDigest(match[2], []byte{})
+		if err != nil {
+			return nil, err
+		}
+		for _, keepFile := range keepFiles {
+			digests[keepFile] = emptyDigest
+		}
+		replacements[name] = manifestContents(digests)
+	}
+	if bagInfo, ok := changed["bag-info.txt"]; ok {
+		replacements["bag-info.txt"] = payloadOxumRegex.ReplaceAllFunc(bagInfo, func(oxum []byte) []byte {
+			match := payloadOxumRegex.FindSubmatch(oxum)
+			count, _ := strconv.Atoi(string(match[3]))
+			return []byte(fmt.Sprintf("%s%s.%d", match[1], match[2], count+len(keepFiles)))
+		})
+	}
+	if err = updateTagManifests(changed, replacements); err != nil {
+		return nil, err
+	}
+
+	tmpPath := pathToTar + ".tmp"
+	err = copyTarReplacing(pathToTar, tmpPath, replacements, nil)
+	if err != nil {
+		os.Remove(tmpPath)
+		return nil, err
+	}
+	return keepFiles, os.Rename(tmpPath, pathToTar)
+}
+
+// readBagStructure returns the paths in the bag of the directories in
+// the tarred bag at pathToTar, plus a set of the directories that have
+// something in them.
+func readBagStructure(pathToTar string) ([]string, map[string]bool, error) {
+	file, err := os.Open(pathToTar)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer file.Close()
+	dirs := make([]string, 0)
+	notEmpty := make(map[string]bool)
+	reader := tar.NewReader(file)
+	for {
+		header, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		pathInBag, err := util.TarPathToBagPath(strings.TrimSuffix(header.Name, "/"))
+		if err != nil {
+			continue
+		}
+		if header.Typeflag == tar.TypeDir {
+			dirs = append(dirs, pathInBag)
+		}
+		if i := strings.LastIndex(pathInBag, "/"); i > 0 {
+			notEmpty[pathInBag[:i]] = true
+		}
+	}
+	return dirs, notEmpty, nil
+}
+
+// readTarFiles returns the contents of the files in a tarred bag for
+// which wanted returns true, keyed by path in the bag.
+func readTarFiles(pathToTar string, wanted func(pathInBag string) bool) (map[string][]byte, error) {
+	file, err := os.Open(pathToTar)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	contents := make(map[string][]byte)
+	reader := tar.NewReader(file)
+	for {
+		header, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		pathInBag, err := util.TarPathToBagPath(header.Name)
+		if err != nil || !wanted(pathInBag) {
+			continue
+		}
+		if contents[pathInBag], err = io.ReadAll(reader); err != nil {
+			return nil, err
+		}
+	}
+	return contents, nil
+}
@@ -0,0 +1,59 @@
+package cmd_test
+
+import (
+	"context"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/APTrust/apt-cmd/cmd"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRunBagCreate_KeepEmptyDirs(t *testing.T) {
+	opts := newBagCreateOptions(t)
+	bagDir := opts.BagDirs[0]
+	for _, dir := range []string{"empty", "nested/empty/deeper", "nested/also-empty", "logs"} {
+		require.Nil(t, os.MkdirAll(path.Join(bagDir, dir), 0755))
+	}
+	// logs is empty once its only file is excluded.
+	require.Nil(t, os.WriteFile(path.Join(bagDir, "logs", "debug.log"), []byte("log"), 0644))
+	opts.ExcludePatterns = []string{"*.log"}
+	opts.KeepEmptyDirs = true
+	opts.Verify = true
+	opts.Format = cmd.BagFormatDirectory
+	result, err := cmd.RunBagCreate(opts)
+	require.Nil(t, err, err)
+	assert.Equal(t, "OK", result.Result)
+	assert.Equal(t, []string{
+		"data/files/empty/.keep",
+		"data/files/logs/.keep",
+		"data/files/nested/also-empty/.keep",
+		"data/files/nested/empty/deeper/.keep",
+	}, result.KeepFiles)
+	assert.Contains(t, result.JSON(""), `"keepFiles": ["data/files/empty/.keep",`)
+
+	// The directories survive unpacking, and the bag is still valid.
+	for _, keepFile := range result.KeepFiles {
+		assert.FileExists(t, path.Join(result.OutputPath, keepFile))
+	}
+	assert.NoFileExists(t, path.Join(bagDir, "empty", ".keep"))
+	manifest, err := os.ReadFile(path.Join(result.OutputPath, "manifest-md5.txt"))
+	require.Nil(t, err)
+	assert.Contains(t, string(manifest), "d41d8cd98f00b204e9800998ecf8427e  data/files/nested/empty/deeper/.keep\n")
+	bagInfo, err := os.ReadFile(path.Join(result.OutputPath, "bag-info.txt"))
+	require.Nil(t, err)
+	assert.Contains(t, string(bagInfo), "Payload-Oxum: 8.6")
+	validator, err := cmd.ValidateBag(context.Background(), result.OutputPath, opts.Profile)
+	require.Nil(t, err)
+	assert.Empty(t, validator.Errors)
+
+	// Without the flag, there are no placeholders.
+	opts = newBagCreateOptions(t)
+	require.Nil(t, os.Mkdir(path.Join(opts.BagDirs[0], "empty"), 0755))
+	result, err = cmd.RunBagCreate(opts)
+	require.Nil(t, err, err)
+	assert.Nil(t, result.KeepFiles)
+	assert.NotContains(t, tarFileNames(t, result.OutputPath), "library/data/files/empty/.keep")
+}
@@ -0,0 +1,432 @@
+package cmd
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/APTrust/dart-runner/util"
+	"github.com/spf13/cobra"
+)
+
+// bagExtractCmd represents the bag extract command
+var bagExtractCmd = &cobra.Command{
+	Use:     "extract",
+	Short:   "Unpack a tarred, gzipped or zipped bag into a directory",
+	Example: `apt-cmd bag extract --file=my_bag.tar --output-dir=/path/to/dir`,
+	Long: `Unpack a serialized bag into a directory, so you can inspect its files.
+bag extract reads .tar, .tar.gz, .tgz and .zip bags, and writes the bag's
+top-level directory, with everything in it, into --output-dir. It keeps
+the files' permissions and modification times.
+
+  apt-cmd bag extract --file=photos.tar --output-dir=/home/josie/unpacked
+
+This creates /home/josie/unpacked/photos. --output-dir is created if it
+doesn't exist, but bag extract won't write into an existing bag
+directory.
+
+Unsafe entries:
+
+bag extract checks every entry in the archive before it writes anything.
+If an entry would land outside of --output-dir, as entries with ../ in
+their paths or absolute paths do, or if the archive holds links or other
+special files, or entries outside of a single top-level directory, bag
+extract exits with status 3 and extracts nothing.
+
+Verifying checksums:
+
+Add --verify to check the files against the bag's manifests and tag
+manifests as they're extracted. Each file is read only once. If a file
+doesn't match its digest, is missing, or is a payload file that isn't in
+a payload manifest, bag extract exits with status 2 and lists the
+problems. The extracted files stay in place, so you can look at them.
+Payload files listed in fetch.txt don't have to be in the bag. For full
+validation against a BagIt profile, run bag validate on the extracted
+directory.
+
+  apt-cmd bag extract --verify --file=photos.tar.gz --output-dir=unpacked
+
+Output:
+
+bag extract prints a JSON object describing the bag. "bagDir" is the name
+of the bag's top-level directory in --output-dir:
+
+  { "result": "OK", "bag": "photos.tar", "outputDir": "unpacked",
+    "bagDir": "photos", "fileCount": 12, "verified": true }
+
+"result" is "Invalid" if --verify found problems, and "errors" lists
+them.
+
+Full online documentation:
+
+https://aptrust.github.io/userguide/partner_tools/
+
+`,
+	Run: func(cmd *cobra.Command, args []string) {
+		pathToBag := cmd.Flag("file").Value.String()
+		if len(args) > 0 {
+			if pathToBag != "" && pathToBag != args[0] {
+				Fail(EXIT_USER_ERR, "Pass the bag with --file or as an argument, not both.")
+			}
+			pathToBag = args[0]
+		}
+		outputDir := cmd.Flag("output-dir").Value.String()
+		if pathToBag == "" || outputDir == "" {
+			Fail(EXIT_USER_ERR, "--file and --output-dir are required.")
+		}
+		verify, _ := cmd.Flags().GetBool("verify")
+		result, err := ExtractBag(cmd.Context(), pathToBag, outputDir, verify)
+		if err != nil {
+			ExitIfCanceled(cmd.Context())
+			if extractErr, ok := err.(*BagExtractError); ok {
+				Fail(extractErr.ExitCode, extractErr.Error())
+			}
+			Fail(EXIT_RUNTIME_ERR, err.Error())
+		}
+		printResult(result)
+		if result.Result != "OK" {
+			os.Exit(EXIT_BAG_INVALID)
+		}
+		os.Exit(EXIT_OK)
+	},
+}
+
+func init() {
+	bagCmd.AddCommand(bagExtractCmd)
+	bagExtractCmd.Flags().StringP("file", "f", "", "Path to the .tar, .tar.gz, .tgz or .zip bag to extract, if you don't pass it as an argument")
+	bagExtractCmd.Flags().StringP("output-dir", "o", "", "Directory to extract the bag into")
+	bagExtractCmd.Flags().Bool("verify", false, "Check the extracted files against the bag's manifests")
+}
+
+// BagExtractResult describes a bag that ExtractBag extracted. BagDir
+// is the name of the bag's top-level directory in OutputDir. Result is
+// "OK", or "Invalid" if Verify found problems, which Errors lists.
+type BagExtractResult struct {
+	Result    string   `json:"result"`
+	Bag       string   `json:"bag"`
+	OutputDir string   `json:"outputDir"`
+	BagDir    string   `json:"bagDir"`
+	FileCount int      `json:"fileCount"`
+	Verified  bool     `json:"verified"`
+	Errors    []string `json:"errors,omitempty"`
+}
+
+// BagExtractError is an error that keeps ExtractBag from extracting a
+// bag, with the exit code bag extract exits with.
+type BagExtractError struct {
+	ExitCode int
+	Err      error
+}
+
+func (e *BagExtractError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *BagExtractError) Unwrap() error {
+	return e.Err
+}
+
+// archiveEntry is a file or directory in a tar or zip file. Typeflag
+// is the entry's tar type, such as tar.TypeReg or tar.TypeDir. Zip
+// entries get the tar type for what they are.
+type archiveEntry struct {
+	Name     string
+	IsDir    bool
+	Typeflag byte
+	Mode     os.FileMode
+	ModTime  time.Time
+	Size     int64
+}
+
+// archiveEntryFunc is called for each entry in an archive. Param
+// reader reads the entry's contents.
+type archiveEntryFunc func(entry *archiveEntry, reader io.Reader) error
+
+// ExtractBag extracts the .tar, .tar.gz, .tgz or .zip bag at pathToBag
+// into outputDir, creating outputDir if it doesn't exist. It checks
+// every entry first, and extracts nothing if any entry would land
+// outside of outputDir, isn't a regular file or directory, or isn't in
+// the bag's top-level directory, after cleaning its path. It won't
+// replace an existing bag directory, or a symlink in its place, and it
+// never writes over an existing file. With verify, it checksums the files as it extracts them,
+// and checks them against the manifests and tag manifests. Problems
+// with the bag's contents are in the result's Errors. Errors that keep
+// it from extracting the bag are BagExtractErrors.
+func ExtractBag(ctx context.Context, pathToBag, outputDir string, verify bool) (*BagExtractResult, error) {
+	absOutputDir, err := filepath.Abs(outputDir)
+	if err != nil {
+		return nil, &BagExtractError{ExitCode: EXIT_RUNTIME_ERR, Err: err}
+	}
+	result := &BagExtractResult{Result: "OK", Bag: pathToBag, OutputDir: outputDir, Verified: verify}
+
+	// Check the whole archive before writing anything.
+	algs := make([]string, 0)
+	err = walkArchive(pathToBag, func(entry *archiveEntry, reader io.Reader) error {
+		target, err := extractTarget(absOutputDir, entry.Name)
+		if err != nil {
+			return err
+		}
+		// Check the path we'll write to, not the entry's name.
+		relPath, err := filepath.Rel(absOutputDir, target)
+		if err != nil || relPath == "." {
+			return fmt.Errorf("%s isn't a bag: entry %s isn't in a top-level directory", pathToBag, entry.Name)
+		}
+		parts := strings.SplitN(filepath.ToSlash(relPath), "/", 2)
+		if result.BagDir == "" {
+			result.BagDir = parts[0]
+		}
+		if parts[0] != result.BagDir || (len(parts) == 1 && !entry.IsDir) {
+			return fmt.Errorf("%s isn't a bag: entry %s isn't in the top-level directory %s", pathToBag, entry.Name, result.BagDir)
+		}
+		if len(parts) == 2 {
+			if match := manifestRegex.FindStringSubmatch(parts[1]); match != nil && !util.StringListContains(algs, match[2]) {
+				algs = append(algs, match[2])
+			}
+		}
+		return ctx.Err()
+	})
+	if err == nil && result.BagDir == "" {
+		err = fmt.Errorf("%s is empty", pathToBag)
+	}
+	if ctx.Err() != nil {
+		return nil, &BagExtractError{ExitCode: EXIT_CANCELED, Err: ctx.Err()}
+	}
+	if err != nil {
+		return nil, &BagExtractError{ExitCode: EXIT_USER_ERR, Err: err}
+	}
+	bagPath := filepath.Join(absOutputDir, result.BagDir)
+	// Lstat, so a symlink in outputDir can't send the bag elsewhere.
+	if _, err = os.Lstat(bagPath); err == nil {
+		return nil, &BagExtractError{ExitCode: EXIT_USER_ERR, Err: fmt.Errorf("not extracting bag because %s already exists", bagPath)}
+	}
+	if err = os.MkdirAll(absOutputDir, 0755); err != nil {
+		return nil, &BagExtractError{ExitCode: EXIT_RUNTIME_ERR, Err: err}
+	}
+
+	// Extract, checksumming the files with the manifests' algorithms.
+	digests := make(map[string]map[string]string)
+	manifests := make(map[string][]byte)
+	fetchTxt := []byte(nil)
+	err = walkArchive(pathToBag, func(entry *archiveEntry, reader io.Reader) error {
+		target, _ := extractTarget(absOutputDir, entry.Name)
+		if target != bagPath && !strings.HasPrefix(target, bagPath+string(os.PathSeparator)) {
+			return fmt.Errorf("entry %s is outside of %s", entry.Name, bagPath)
+		}
+		if entry.IsDir {
+			return os.MkdirAll(target, 0755)
+		}
+		pathInBag, _ := filepath.Rel(bagPath, target)
+		pathInBag = filepath.ToSlash(pathInBag)
+		var tagFile bytes.Buffer
+		isManifest := manifestRegex.MatchString(pathInBag)
+		if verify {
+			hashes := GetHashes(algs)
+			writers := make([]io.Writer, 0, len(hashes)+1)
+			for _, hash := range hashes {
+				writers = append(writers, hash)
+			}
+			if isManifest || pathInBag == FetchTxtFile {
+				writers = append(writers, &tagFile)
+			}
+			reader = io.TeeReader(reader, io.MultiWriter(writers...))
+			defer func() {
+				digests[pathInBag] = make(map[string]string)
+				for alg, hash := range hashes {
+					digests[pathInBag][alg] = fmt.Sprintf("%x", hash.Sum(nil))
+				}
+				if isManifest {
+					manifests[pathInBag] = tagFile.Bytes()
+				} else if pathInBag == FetchTxtFile {
+					fetchTxt = tagFile.Bytes()
+				}
+			}()
+		}
+		header := &tar.Header{Name: entry.Name, Mode: int64(entry.Mode.Perm()), ModTime: entry.ModTime}
+		if err := extractTarFile(reader, header, target); err != nil {
+			return err
+		}
+		result.FileCount++
+		return ctx.Err()
+	})
+	if err != nil {
+		return nil, &BagExtractError{ExitCode: EXIT_RUNTIME_ERR, Err: err}
+	}
+	if verify {
+		result.Errors = verifyExtractedBag(digests, manifests, fetchTxt)
+		if len(result.Errors) > 0 {
+			result.Result = "Invalid"
+		}
+	}
+	return result, nil
+}
+
+// verifyExtractedBag checks the digests of the files ExtractBag
+// extracted, keyed by path in the bag and algorithm, against the
+// manifests, and returns a sorted list of the problems it finds.
+func verifyExtractedBag(digests map[string]map[string]string, manifests map[string][]byte, fetchTxt []byte) []string {
+	problems := make([]string, 0)
+	if len(manifests) == 0 {
+		return append(problems, "Bag has no manifests.")
+	}
+	fetched := make(map[string]bool)
+	if fetchTxt != nil {
+		entries, err := ParseFetchTxt(fetchTxt)
+		if err != nil {
+			problems = append(problems, err.Error())
+		}
+		for _, entry := range entries {
+			fetched[entry.Path] = true
+		}
+	}
+	inPayloadManifest := make(map[string]bool)
+	for name, data := range manifests {
+		match := manifestRegex.FindStringSubmatch(name)
+		alg := match[2]
+		if GetHashes([]string{alg})[alg] == nil {
+			problems = append(problems, fmt.Sprintf("%s: algorithm %s is not supported.", name, alg))
+			continue
+		}
+		for pathInBag, digest := range parseManifest(data) {
+			pathInBag = decodeFetchPath(pathInBag)
+			if match[1] != "tag" {
+				inPayloadManifest[pathInBag] = true
+			}
+			fileDigests, ok := digests[pathInBag]
+			if !ok {
+				if !fetched[pathInBag] {
+					problems = append(problems, fmt.Sprintf("%s: file is in %s but not in the bag.", pathInBag, name))
+				}
+				continue
+			}
+			if NormalizeDigest(digest) != fileDigests[alg] {
+				problems = append(problems, fmt.Sprintf("%s: %s digest %s doesn't match the %s in %s.", pathInBag, alg, fileDigests[alg], digest, name))
+			}
+		}
+	}
+	for pathInBag := range digests {
+		if strings.HasPrefix(pathInBag, "data/") && !inPayloadManifest[pathInBag] {
+			problems = append(problems, fmt.Sprintf("%s: payload file is not in any payload manifest.", pathInBag))
+		}
+	}
+	sort.Strings(problems)
+	return problems
+}
+
+// extractTarget returns the path to which an archive entry named name
+// extracts in absDestDir. It returns an error if the entry would land
+// outside of absDestDir.
+func extractTarget(absDestDir, name string) (string, error) {
+	// Clean would hide a .. that climbs back into absDestDir, as in
+	// bag/../other, so reject them all before joining.
+	for _, part := range strings.Split(filepath.ToSlash(name), "/") {
+		if part == ".." {
+			return "", fmt.Errorf("entry %s is outside of %s", name, absDestDir)
+		}
+	}
+	target := filepath.Join(absDestDir, filepath.FromSlash(name))
+	if filepath.IsAbs(filepath.FromSlash(name)) || (target != absDestDir && !strings.HasPrefix(target, absDestDir+string(os.PathSeparator))) {
+		return "", fmt.Errorf("entry %s is outside of %s", name, absDestDir)
+	}
+	return target, nil
+}
+
+// walkArchive calls fn for each entry in the tar, gzipped tar or zip
+// file at pathToArchive, in order. It returns an error for entries that
+// aren't regular files or directories, such as links.
+func walkArchive(pathToArchive string, fn archiveEntryFunc) error {
+	return walkArchiveEntries(pathToArchive, func(entry *archiveEntry, reader io.Reader) error {
+		if entry.Typeflag != tar.TypeReg && entry.Typeflag != tar.TypeDir {
+			return fmt.Errorf("entry %s has unsupported type %c", entry.Name, entry.Typeflag)
+		}
+		return fn(entry, reader)
+	})
+}
+
+// walkArchiveEntries is walkArchive for every entry, including links
+// and other special files. It tells tar, gzipped tar and zip files
+// apart by their contents, and returns an error that wraps
+// ErrUnsupportedBagFormat for anything else.
+func walkArchiveEntries(pathToArchive string, fn archiveEntryFunc) error {
+	format, err := DetectBagFormat(pathToArchive)
+	if err != nil {
+		return err
+	}
+	switch format {
+	case BagFormatZip:
+		return walkZip(pathToArchive, fn)
+	case BagFormatDirectory:
+		return fmt.Errorf("%s is a directory, not a tar or zip file: %w", pathToArchive, ErrUnsupportedBagFormat)
+	}
+	file, err := os.Open(pathToArchive)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	var in io.Reader = file
+	if format == BagFormatTgz {
+		gzipReader, err := gzip.NewReader(file)
+		if err != nil {
+			return fmt.Errorf("can't read %s: %w", pathToArchive, err)
+		}
+		defer gzipReader.Close()
+		in = gzipReader
+	}
+	reader := tar.NewReader(in)
+	for {
+		header, err := reader.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("can't read %s: %w", pathToArchive, err)
+		}
+		entry := &archiveEntry{Name: header.Name, Typeflag: header.Typeflag, Mode: header.FileInfo().Mode(), ModTime: header.ModTime, Size: header.Size}
+		switch header.Typeflag {
+		case tar.TypeDir:
+			entry.IsDir = true
+		case tar.TypeRegA:
+			entry.Typeflag = tar.TypeReg
+		}
+		if err = fn(entry, reader); err != nil {
+			return err
+		}
+	}
+}
+
+func walkZip(pathToZip string, fn archiveEntryFunc) error {
+	reader, err := zip.OpenReader(pathToZip)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	for _, f := range reader.File {
+		entry := &archiveEntry{Name: f.Name, Typeflag: tar.TypeReg, Mode: f.Mode(), ModTime: f.Modified, Size: int64(f.UncompressedSize64), IsDir: f.FileInfo().IsDir()}
+		switch {
+		case entry.IsDir:
+			entry.Typeflag = tar.TypeDir
+		case entry.Mode&os.ModeSymlink != 0:
+			entry.Typeflag = tar.TypeSymlink
+		case !entry.Mode.IsRegular():
+			entry.Typeflag = tar.TypeChar
+		}
+		contents, err := f.Open()
+		if err != nil {
+			return err
+		}
+		err = fn(entry, contents)
+		contents.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
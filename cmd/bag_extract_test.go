@@ -0,0 +1,134 @@
+package cmd_test
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/json"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/APTrust/apt-cmd/cmd"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExtractBag(t *testing.T) {
+	for _, format := range []string{cmd.BagFormatTar, cmd.BagFormatTgz, cmd.BagFormatZip} {
+		opts := newBagCreateOptions(t)
+		opts.Format = format
+		created, err := cmd.RunBagCreate(opts)
+		require.Nil(t, err, err)
+
+		outputDir := path.Join(t.TempDir(), "unpacked")
+		result, err := cmd.ExtractBag(context.Background(), created.OutputPath, outputDir, true)
+		require.Nil(t, err, format)
+		assert.Equal(t, "OK", result.Result, format)
+		assert.Equal(t, "library", result.BagDir, format)
+		assert.True(t, result.Verified)
+		assert.Empty(t, result.Errors, format)
+		// Two payload files, bagit.txt, bag-info.txt, and a manifest and
+		// tag manifest for each algorithm.
+		assert.Equal(t, 8, result.FileCount, format)
+		data, err := os.ReadFile(path.Join(outputDir, "library", "data", "files", "sub", "copy.txt"))
+		require.Nil(t, err)
+		assert.Equal(t, "data", string(data))
+
+		// The extracted bag is a valid bag directory.
+		validator, err := cmd.ValidateBag(context.Background(), path.Join(outputDir, "library"), opts.Profile)
+		require.Nil(t, err)
+		assert.Empty(t, validator.Errors, format)
+
+		// An existing bag directory isn't replaced.
+		_, err = cmd.ExtractBag(context.Background(), created.OutputPath, outputDir, false)
+		require.NotNil(t, err)
+		assert.Contains(t, err.Error(), "already exists")
+	}
+}
+
+func TestExtractBag_Verify(t *testing.T) {
+	pathToTar := writeTestTar(t, map[string]string{
+		"bagit.txt":        "BagIt-Version: 1.0\nTag-File-Character-Encoding: UTF-8\n",
+		"data/a.txt":       "data",
+		"data/extra.txt":   "extra",
+		"manifest-md5.txt": "00000000000000000000000000000000  data/a.txt\n8d777f385d3dfec8815d20f7496026dc  data/gone.txt\n",
+	})
+	result, err := cmd.ExtractBag(context.Background(), pathToTar, t.TempDir(), true)
+	require.Nil(t, err)
+	assert.Equal(t, "Invalid", result.Result)
+	assert.Equal(t, []string{
+		"data/a.txt: md5 digest 8d777f385d3dfec8815d20f7496026dc doesn't match the 00000000000000000000000000000000 in manifest-md5.txt.",
+		"data/extra.txt: payload file is not in any payload manifest.",
+		"data/gone.txt: file is in manifest-md5.txt but not in the bag.",
+	}, result.Errors)
+
+	// Without --verify, the files are just extracted.
+	result, err = cmd.ExtractBag(context.Background(), pathToTar, t.TempDir(), false)
+	require.Nil(t, err)
+	assert.Equal(t, "OK", result.Result)
+	assert.Nil(t, result.Errors)
+}
+
+func TestExtractBag_UnsafeEntries(t *testing.T) {
+	outputDir := path.Join(t.TempDir(), "unpacked")
+	pathToTar := writeTestTar(t, map[string]string{"../../evil.txt": "evil"})
+	_, err := cmd.ExtractBag(context.Background(), pathToTar, outputDir, false)
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), "is outside of")
+	assert.NoDirExists(t, outputDir)
+
+	// A .. that climbs back into outputDir still escapes the bag
+	// directory, so it could replace files next to it.
+	require.Nil(t, os.MkdirAll(outputDir, 0755))
+	victim := path.Join(outputDir, "victim.txt")
+	require.Nil(t, os.WriteFile(victim, []byte("safe"), 0644))
+	pathToTar = writeTestTar(t, map[string]string{"../victim.txt": "PWNED"})
+	_, err = cmd.ExtractBag(context.Background(), pathToTar, outputDir, false)
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), "is outside of")
+	data, err := os.ReadFile(victim)
+	require.Nil(t, err)
+	assert.Equal(t, "safe", string(data))
+	assert.NoDirExists(t, path.Join(outputDir, "test_bag"))
+
+	// A symlink where the bag directory would go counts as an
+	// existing bag, even if it points nowhere yet.
+	elsewhere := path.Join(t.TempDir(), "elsewhere")
+	require.Nil(t, os.Symlink(elsewhere, path.Join(outputDir, "test_bag")))
+	pathToTar = writeTestTar(t, map[string]string{"bagit.txt": "BagIt-Version: 1.0\n"})
+	_, err = cmd.ExtractBag(context.Background(), pathToTar, outputDir, false)
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), "already exists")
+	assert.NoDirExists(t, elsewhere)
+	require.Nil(t, os.RemoveAll(outputDir))
+
+	// Links could point anywhere.
+	pathToTar = path.Join(t.TempDir(), "linked.tar")
+	file, err := os.Create(pathToTar)
+	require.Nil(t, err)
+	writer := tar.NewWriter(file)
+	require.Nil(t, writer.WriteHeader(&tar.Header{Name: "linked/data/passwd", Typeflag: tar.TypeSymlink, Linkname: "/etc/passwd"}))
+	require.Nil(t, writer.Close())
+	require.Nil(t, file.Close())
+	_, err = cmd.ExtractBag(context.Background(), pathToTar, outputDir, false)
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), "unsupported type")
+	assert.NoDirExists(t, outputDir)
+}
+
+func TestBagExtract(t *testing.T) {
+	opts := newBagCreateOptions(t)
+	_, err := cmd.RunBagCreate(opts)
+	require.Nil(t, err)
+	outputDir := t.TempDir()
+	exitCode, stdout, _ := execCmd(t, "go", "run", "../main.go", "bag", "extract", "--verify", "--file="+opts.OutputFile, "--output-dir="+outputDir)
+	require.Equal(t, cmd.EXIT_OK, exitCode, stdout)
+	result := &cmd.BagExtractResult{}
+	require.Nil(t, json.Unmarshal([]byte(stdout), result))
+	assert.Equal(t, "library", result.BagDir)
+	assert.FileExists(t, path.Join(outputDir, "library", "bag-info.txt"))
+
+	exitCode, _, stderr := execCmd(t, "go", "run", "../main.go", "bag", "extract", "--file="+opts.OutputFile)
+	assert.NotEqual(t, cmd.EXIT_OK, exitCode)
+	assert.Contains(t, stderr, "--output-dir are required")
+}
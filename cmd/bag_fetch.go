@@ -0,0 +1,215 @@
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/APTrust/dart-runner/bagit"
+	"github.com/APTrust/dart-runner/constants"
+	"github.com/APTrust/dart-runner/util"
+)
+
+// FetchTxtFile is the tag file that lists payload files that aren't in
+// the bag, and where to fetch them from.
+const FetchTxtFile = "fetch.txt"
+
+var fetchLineRegex = regexp.MustCompile(`^(\S+)\s+(\S+)\s+(.+)$`)
+
+// FetchEntry is one line of a fetch.txt file. Path is the file's path
+// in the bag, starting with data/. Length is its size in bytes, or -1
+// if the size is unknown, which fetch.txt writes as "-".
+type FetchEntry struct {
+	URL    string
+	Length int64
+	Path   string
+}
+
+// ParseFetchEntry parses a fetch.txt line, in the form
+// URL LENGTH FILENAME. The file name may contain spaces. As in
+// manifests, CR, LF and % in the file name are percent-encoded as %0D,
+// %0A and %25.
+func ParseFetchEntry(line string) (*FetchEntry, error) {
+	match := fetchLineRegex.FindStringSubmatch(strings.TrimSpace(line))
+	if match == nil {
+		return nil, fmt.Errorf("'%s' is not in the form URL LENGTH FILENAME", line)
+	}
+	entry := &FetchEntry{URL: match[1], Length: -1, Path: decodeFetchPath(match[3])}
+	if u, err := url.Parse(entry.URL); err != nil || u.Scheme == "" || u.Host == "" {
+		return nil, fmt.Errorf("'%s' is not a valid URL", entry.URL)
+	}
+	if match[2] != "-" {
+		length, err := strconv.ParseInt(match[2], 10, 64)
+		if err != nil || length < 0 {
+			return nil, fmt.Errorf("length '%s' of %s must be a number of bytes or -", match[2], entry.Path)
+		}
+		entry.Length = length
+	}
+	if !strings.HasPrefix(entry.Path, "data/") {
+		return nil, fmt.Errorf("%s is not in the bag's data directory", entry.Path)
+	}
+	for _, part := range strings.Split(entry.Path, "/") {
+		if part == "" || part == "." || part == ".." {
+			return nil, fmt.Errorf("%s is not a valid path in the bag", entry.Path)
+		}
+	}
+	return entry, nil
+}
+
+// String returns the entry as a fetch.txt line, without a newline.
+func (e *FetchEntry) String() string {
+	length := "-"
+	if e.Length >= 0 {
+		length = strconv.FormatInt(e.Length, 10)
+	}
+	return e.URL + " " + length + " " + encodeFetchPath(e.Path)
+}
+
+func decodeFetchPath(pathInBag string) string {
+	return strings.NewReplacer("%0D", "\r", "%0d", "\r", "%0A", "\n", "%0a", "\n", "%25", "%").Replace(pathInBag)
+}
+
+func encodeFetchPath(pathInBag string) string {
+	return strings.NewReplacer("%", "%25", "\r", "%0D", "\n", "%0A").Replace(pathInBag)
+}
+
+// ParseFetchTxt parses the contents of a fetch.txt file. It skips blank
+// lines.
+func ParseFetchTxt(data []byte) ([]*FetchEntry, error) {
+	entries := make([]*FetchEntry, 0)
+	for i, line := range strings.Split(string(data), "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		entry, err := ParseFetchEntry(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d of %s: %w", i+1, FetchTxtFile, err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// ReadFetchFile reads the fetch entries for --fetch-from, one per line.
+// As in --exclude-from files, blank lines and lines starting with # are
+// ignored.
+func ReadFetchFile(pathToFile string) ([]*FetchEntry, error) {
+	file, err := os.Open(pathToFile)
+	if err != nil {
+		return nil, fmt.Errorf("can't read fetch file %s: %w", pathToFile, err)
+	}
+	defer file.Close()
+	entries := make([]*FetchEntry, 0)
+	scanner := bufio.NewScanner(file)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		entry, err := ParseFetchEntry(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d of %s: %w", lineNumber, pathToFile, err)
+		}
+		entries = append(entries, entry)
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, fmt.Errorf("can't read fetch file %s: %w", pathToFile, err)
+	}
+	return entries, nil
+}
+
+// CheckFetchEntries checks entries against the payload files of a bag
+// the bagger just wrote. Each entry must name a different payload file,
+// and its length, if known, must match the file's size. This fills in
+// unknown lengths from the payload files.
+func CheckFetchEntries(entries []*FetchEntry, payloadFiles *bagit.FileMap) error {
+	// The bagger's paths include the bag name as the top-level
+	// directory.
+	records := make(map[string]*bagit.FileRecord)
+	for name, fileRecord := range payloadFiles.Files {
+		if pathInBag, err := util.TarPathToBagPath(name); err == nil && !strings.HasPrefix(name, "data/") {
+			name = pathInBag
+		}
+		records[name] = fileRecord
+	}
+	seen := make(map[string]bool)
+	for _, entry := range entries {
+		if seen[entry.Path] {
+			return fmt.Errorf("%s is listed more than once in the fetch entries", entry.Path)
+		}
+		seen[entry.Path] = true
+		fileRecord := records[entry.Path]
+		if fileRecord == nil {
+			return fmt.Errorf("fetch entry %s is not a payload file in the bag", entry.Path)
+		}
+		if entry.Length < 0 {
+			entry.Length = fileRecord.Size
+		} else if entry.Length != fileRecord.Size {
+			return fmt.Errorf("fetch entry %s has length %d, but the file is %d bytes", entry.Path, entry.Length, fileRecord.Size)
+		}
+	}
+	return nil
+}
+
+// WriteFetchTxt removes the payload files in entries from the tarred
+// bag at pathToTar, adds a fetch.txt listing them, and adds fetch.txt to
+// the tag manifests. The payload manifests still list the removed files,
+// and the bag's Payload-Oxum still counts them, since both describe the
+// complete payload. Call CheckFetchEntries first. Like WriteManifests,
+// this writes a new tar file next to the original, then replaces the
+// original.
+func WriteFetchTxt(pathToTar string, entries []*FetchEntry) error {
+	var contents strings.Builder
+	remove := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		contents.WriteString(entry.String() + "\n")
+		remove = append(remove, entry.Path)
+	}
+	replacements := map[string][]byte{FetchTxtFile: []byte(contents.String())}
+	manifests, err := readManifests(pathToTar)
+	if err != nil {
+		return err
+	}
+	for name, data := range manifests {
+		match := manifestRegex.FindStringSubmatch(name)
+		if match[1] != "tag" {
+			continue
+		}
+		alg := match[2]
+		hashes := GetHashes([]string{alg})
+		if hashes[alg] == nil {
+			return fmt.Errorf("unsupported algorithm %s", alg)
+		}
+		hashes[alg].Write(replacements[FetchTxtFile])
+		digests := parseManifest(data)
+		digests[FetchTxtFile] = fmt.Sprintf("%x", hashes[alg].Sum(nil))
+		replacements[name] = manifestContents(digests)
+	}
+	tmpPath := pathToTar + ".tmp"
+	err = copyTarReplacing(pathToTar, tmpPath, replacements, remove)
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return os.Rename(tmpPath, pathToTar)
+}
+
+// acceptFetchedFiles records the manifest digests of each payload file
+// in fetched as the file's own digests, so the validator doesn't report
+// files that haven't been fetched yet as missing. We can't check files
+// that aren't in the bag. Call this after NormalizeManifestDigests, so
+// the digests match the ones the validator calculates for other files.
+func acceptFetchedFiles(validator *bagit.Validator, fetched []string) {
+	for _, pathInBag := range fetched {
+		fileRecord := validator.PayloadFiles.Files[pathInBag]
+		for _, checksum := range fileRecord.Checksums {
+			if checksum.Source == constants.FileTypeManifest {
+				fileRecord.AddChecksum(constants.FileTypePayload, checksum.Algorithm, checksum.Digest)
+			}
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package cmd_test
+
+import (
+	"context"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/APTrust/apt-cmd/cmd"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseFetchEntry(t *testing.T) {
+	entry, err := cmd.ParseFetchEntry("https://example.com/files/big%20video.mov 1024 data/videos/big video.mov")
+	require.Nil(t, err)
+	assert.Equal(t, "https://example.com/files/big%20video.mov", entry.URL)
+	assert.EqualValues(t, 1024, entry.Length)
+	assert.Equal(t, "data/videos/big video.mov", entry.Path)
+	assert.Equal(t, "https://example.com/files/big%20video.mov 1024 data/videos/big video.mov", entry.String())
+
+	entry, err = cmd.ParseFetchEntry("https://example.com/a - data/100%25%0Adone.txt")
+	require.Nil(t, err)
+	assert.EqualValues(t, -1, entry.Length)
+	assert.Equal(t, "data/100%\ndone.txt", entry.Path)
+	assert.Equal(t, "https://example.com/a - data/100%25%0Adone.txt", entry.String())
+
+	invalid := []string{
+		"https://example.com/a data/a.txt",
+		"example.com/a 10 data/a.txt",
+		"https://example.com/a ten data/a.txt",
+		"https://example.com/a -10 data/a.txt",
+		"https://example.com/a 10 bag-info.txt",
+		"https://example.com/a 10 data/../bag-info.txt",
+	}
+	for _, line := range invalid {
+		_, err = cmd.ParseFetchEntry(line)
+		assert.NotNil(t, err, line)
+	}
+}
+
+func TestParseFetchTxt(t *testing.T) {
+	entries, err := cmd.ParseFetchTxt([]byte("https://example.com/a 1 data/a.txt\n\nhttps://example.com/b 2 data/b.txt\n"))
+	require.Nil(t, err)
+	require.Equal(t, 2, len(entries))
+	assert.Equal(t, "data/b.txt", entries[1].Path)
+
+	_, err = cmd.ParseFetchTxt([]byte("https://example.com/a 1 data/a.txt\nnonsense\n"))
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), "line 2 of fetch.txt")
+}
+
+func TestReadFetchFile(t *testing.T) {
+	fetchFile := path.Join(t.TempDir(), "fetch-list.txt")
+	require.Nil(t, os.WriteFile(fetchFile, []byte("# Remote files\nhttps://example.com/a 1 data/a.txt\n\n  https://example.com/b - data/b.txt\n"), 0644))
+	entries, err := cmd.ReadFetchFile(fetchFile)
+	require.Nil(t, err)
+	require.Equal(t, 2, len(entries))
+	assert.Equal(t, "data/a.txt", entries[0].Path)
+	assert.EqualValues(t, -1, entries[1].Length)
+
+	_, err = cmd.ReadFetchFile(path.Join(t.TempDir(), "does-not-exist.txt"))
+	assert.NotNil(t, err)
+}
+
+func TestRunBagCreate_Fetch(t *testing.T) {
+	opts := newBagCreateOptions(t)
+	opts.Fetch = []*cmd.FetchEntry{{URL: "https://example.com/copy.txt", Length: -1, Path: "data/files/sub/copy.txt"}}
+	opts.Verify = true
+	result, err := cmd.RunBagCreate(opts)
+	require.Nil(t, err, err)
+	assert.Equal(t, "OK", result.Result)
+
+	names := tarFileNames(t, opts.OutputFile)
+	assert.Contains(t, names, "library/data/files/file.txt")
+	assert.NotContains(t, names, "library/data/files/sub/copy.txt")
+	assert.Equal(t, "https://example.com/copy.txt 4 data/files/sub/copy.txt\n", tarFileContent(t, opts.OutputFile, "library/fetch.txt"))
+	assert.Contains(t, tarFileContent(t, opts.OutputFile, "library/manifest-md5.txt"), "  data/files/sub/copy.txt\n")
+	assert.Contains(t, tarFileContent(t, opts.OutputFile, "library/tagmanifest-md5.txt"), "  fetch.txt\n")
+	assert.Contains(t, tarFileContent(t, opts.OutputFile, "library/bag-info.txt"), "Payload-Oxum: 8.2")
+
+	// Profiles that don't allow fetch.txt reject the bag.
+	btr, err := cmd.LoadProfile("btr")
+	require.Nil(t, err)
+	btr.ManifestsRequired = []string{}
+	validator, err := cmd.ValidateBag(context.Background(), opts.OutputFile, btr)
+	require.Nil(t, err)
+	assert.Equal(t, "Profile does not allow fetch.txt", validator.Errors["fetch.txt"])
+
+	// Entries must name payload files, with the right lengths.
+	opts = newBagCreateOptions(t)
+	opts.Fetch = []*cmd.FetchEntry{{URL: "https://example.com/copy.txt", Length: 10, Path: "data/files/sub/copy.txt"}}
+	_, err = cmd.RunBagCreate(opts)
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), "has length 10, but the file is 4 bytes")
+	assert.NoFileExists(t, opts.OutputFile)
+	opts.Fetch = []*cmd.FetchEntry{{URL: "https://example.com/copy.txt", Length: -1, Path: "data/files/nope.txt"}}
+	_, err = cmd.RunBagCreate(opts)
+	require.NotNil(t, err)
+	assert.Equal(t, cmd.EXIT_USER_ERR, cmd.BagCreateExitCode(err))
+
+	// The profile must allow fetch.txt.
+	opts.Profile = btr
+	_, err = cmd.RunBagCreate(opts)
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), "doesn't allow fetch.txt")
+}
@@ -0,0 +1,325 @@
+package cmd
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Output formats for bag create.
+const (
+	BagFormatTar       = "tar"
+	BagFormatDirectory = "directory"
+	BagFormatZip       = "zip"
+	BagFormatTgz       = "tgz"
+)
+
+// DefaultCompressionLevel is the gzip level for --format=tgz bags when
+// the user doesn't specify --compression-level. It's the same as gzip's
+// own default.
+const DefaultCompressionLevel = 6
+
+// BagFormats lists the supported values for --format.
+var BagFormats = []string{
+	BagFormatTar,
+	BagFormatDirectory,
+	BagFormatZip,
+	BagFormatTgz,
+}
+
+// ErrUnsupportedBagFormat means a bag isn't a directory, or a file in
+// one of the formats bag validate can read.
+var ErrUnsupportedBagFormat = errors.New("unsupported bag format")
+
+// BagOutputPath returns the path of the bag that bag create writes for
+// --output-file in the given format. For tar, that's outputFile itself.
+// For directory, it's outputFile without its .tar extension, if any.
+// For zip, it's outputFile with a .zip extension instead of .tar. For
+// tgz, it's outputFile with a .tar.gz extension, unless it already ends
+// in .tar.gz or .tgz.
+func BagOutputPath(outputFile, format string) string {
+	switch format {
+	case BagFormatTgz:
+		if strings.HasSuffix(outputFile, ".tar.gz") || strings.HasSuffix(outputFile, ".tgz") {
+			return outputFile
+		}
+		return strings.TrimSuffix(outputFile, ".tar") + ".tar.gz"
+	case BagFormatDirectory:
+		return strings.TrimSuffix(outputFile, ".tar")
+	case BagFormatZip:
+		if strings.HasSuffix(outputFile, ".zip") {
+			return outputFile
+		}
+		return strings.TrimSuffix(outputFile, ".tar") + ".zip"
+	}
+	return outputFile
+}
+
+// ValidateBagName checks a --bag-name. The name becomes a file name
+// and the bag's top-level directory, so it can't contain path
+// separators or control characters, and it can't start with a dot,
+// which would hide the bag or, as . or .., refer to another directory.
+func ValidateBagName(bagName string) error {
+	if strings.TrimSpace(bagName) == "" {
+		return fmt.Errorf("bag name can't be empty")
+	}
+	if strings.ContainsAny(bagName, "/\\") {
+		return fmt.Errorf("bag name '%s' can't contain path separators", bagName)
+	}
+	if strings.HasPrefix(bagName, ".") {
+		return fmt.Errorf("bag name '%s' can't start with a dot", bagName)
+	}
+	for _, r := range bagName {
+		if r < ' ' || r == 0x7f {
+			return fmt.Errorf("bag name '%s' can't contain control characters", bagName)
+		}
+	}
+	return nil
+}
+
+// TempTarPath returns the path at which the bagger should write a tar
+// file that we'll convert to a bag at outputPath, plus a function that
+// removes the temp directory containing it. The bagger names the bag
+// after the tar file, so the tar file has the same base name as
+// outputPath, minus any .zip, .gz or .tgz extension. The temp directory
+// is next to outputPath, so that we don't fill up the system's temp
+// directory with large bags.
+func TempTarPath(outputPath string) (string, func(), error) {
+	tempDir, err := os.MkdirTemp(filepath.Dir(outputPath), ".apt-cmd-bag-")
+	if err != nil {
+		return "", func() {}, err
+	}
+	bagName := filepath.Base(outputPath)
+	for _, ext := range []string{".zip", ".gz", ".tgz"} {
+		bagName = strings.TrimSuffix(bagName, ext)
+	}
+	tarName := strings.TrimSuffix(bagName, ".tar") + ".tar"
+	return filepath.Join(tempDir, tarName), func() { os.RemoveAll(tempDir) }, nil
+}
+
+// ConvertTarredBag converts the tarred bag at pathToTar to format,
+// writing it to outputPath. The tarred bag's top-level directory must
+// have the same name as the bag name in outputPath, as it does when
+// pathToTar comes from TempTarPath. Param compressionLevel is the gzip
+// level for tgz, from 1 to 9. Other formats ignore it. This doesn't
+// remove pathToTar.
+func ConvertTarredBag(pathToTar, outputPath, format string, compressionLevel int) error {
+	switch format {
+	case BagFormatTar:
+		if pathToTar == outputPath {
+			return nil
+		}
+		return os.Rename(pathToTar, outputPath)
+	case BagFormatDirectory:
+		return ExtractTar(pathToTar, filepath.Dir(outputPath))
+	case BagFormatZip:
+		return ZipTar(pathToTar, outputPath)
+	case BagFormatTgz:
+		return GzipTar(pathToTar, outputPath, compressionLevel)
+	}
+	return fmt.Errorf("unknown bag format '%s'", format)
+}
+
+// DetectBagFormat returns the format of the bag at pathToBag:
+// BagFormatDirectory, BagFormatTar, BagFormatTgz or BagFormatZip. It
+// goes by the file's contents, not its name. The error wraps
+// ErrUnsupportedBagFormat if the bag isn't in any of these formats.
+func DetectBagFormat(pathToBag string) (string, error) {
+	info, err := os.Stat(pathToBag)
+	if err != nil {
+		return "", err
+	}
+	if info.IsDir() {
+		return BagFormatDirectory, nil
+	}
+	file, err := os.Open(pathToBag)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	// A tar header is 512 bytes, with its magic at offset 257.
+	header := make([]byte, 512)
+	n, err := io.ReadFull(file, header)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return "", fmt.Errorf("%s is empty: %w", pathToBag, ErrUnsupportedBagFormat)
+	}
+	header = header[:n]
+	switch {
+	case bytes.HasPrefix(header, []byte{0x1f, 0x8b}):
+		return BagFormatTgz, nil
+	case bytes.HasPrefix(header, []byte("PK\x03\x04")), bytes.HasPrefix(header, []byte("PK\x05\x06")):
+		return BagFormatZip, nil
+	case len(header) >= 262 && string(header[257:262]) == "ustar":
+		return BagFormatTar, nil
+	}
+	return "", fmt.Errorf("%s is not a directory, tar file, gzipped tar file or zip file: %w", pathToBag, ErrUnsupportedBagFormat)
+}
+
+// ExtractTar extracts the tar file at pathToTar into destDir, keeping
+// the permissions and modification times of the files. It returns an
+// error if any entry would land outside of destDir.
+func ExtractTar(pathToTar, destDir string) error {
+	file, err := os.Open(pathToTar)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	absDestDir, err := filepath.Abs(destDir)
+	if err != nil {
+		return err
+	}
+	reader := tar.NewReader(file)
+	for {
+		header, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		target, err := extractTarget(absDestDir, header.Name)
+		if err != nil {
+			return err
+		}
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if err = os.MkdirAll(target, 0755); err != nil {
+				return err
+			}
+		case tar.TypeReg, tar.TypeRegA:
+			if err = extractTarFile(reader, header, target); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("tar entry %s has unsupported type %c", header.Name, header.Typeflag)
+		}
+	}
+	return nil
+}
+
+func extractTarFile(reader io.Reader, header *tar.Header, target string) error {
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+	mode := header.FileInfo().Mode().Perm()
+	if mode == 0 {
+		mode = 0644
+	}
+	// O_EXCL, so an entry never replaces a file that's already there,
+	// or writes through a symlink.
+	out, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_EXCL, mode)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(out, reader); err != nil {
+		out.Close()
+		return err
+	}
+	if err = out.Close(); err != nil {
+		return err
+	}
+	if !header.ModTime.IsZero() {
+		return os.Chtimes(target, header.ModTime, header.ModTime)
+	}
+	return nil
+}
+
+// ZipTar copies the entries of the tar file at pathToTar into a new
+// zip file at pathToZip, in the same order, with the same names and
+// modification times. It streams one entry at a time, so it never
+// holds more than a small buffer of the bag in memory. The manifests
+// and tag manifests come across as they are, since they describe the
+// files, not the tar file.
+func ZipTar(pathToTar, pathToZip string) error {
+	file, err := os.Open(pathToTar)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	out, err := os.Create(pathToZip)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	reader := tar.NewReader(file)
+	writer := zip.NewWriter(out)
+	for {
+		header, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if err = copyTarEntryToZip(reader, header, writer); err != nil {
+			return err
+		}
+	}
+	if err = writer.Close(); err != nil {
+		return err
+	}
+	return out.Close()
+}
+
+// GzipTar compresses the tar file at pathToTar into a new gzip file at
+// pathToGzip, at the specified gzip level. The tar file is copied as it
+// is, so the manifests still match the payload files once the bag is
+// unzipped and untarred.
+func GzipTar(pathToTar, pathToGzip string, level int) error {
+	file, err := os.Open(pathToTar)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	out, err := os.Create(pathToGzip)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	writer, err := gzip.NewWriterLevel(out, level)
+	if err != nil {
+		return err
+	}
+	writer.Name = filepath.Base(pathToTar)
+	if _, err = io.Copy(writer, file); err != nil {
+		return err
+	}
+	if err = writer.Close(); err != nil {
+		return err
+	}
+	return out.Close()
+}
+
+func copyTarEntryToZip(reader io.Reader, header *tar.Header, writer *zip.Writer) error {
+	zipHeader := &zip.FileHeader{
+		Name:     header.Name,
+		Modified: header.ModTime,
+		Method:   zip.Deflate,
+	}
+	switch header.Typeflag {
+	case tar.TypeDir:
+		if !strings.HasSuffix(zipHeader.Name, "/") {
+			zipHeader.Name += "/"
+		}
+		zipHeader.Method = zip.Store
+	case tar.TypeReg, tar.TypeRegA:
+	default:
+		return fmt.Errorf("tar entry %s has unsupported type %c", header.Name, header.Typeflag)
+	}
+	zipHeader.SetMode(header.FileInfo().Mode())
+	entry, err := writer.CreateHeader(zipHeader)
+	if err != nil {
+		return err
+	}
+	if header.Typeflag != tar.TypeDir {
+		_, err = io.Copy(entry, reader)
+	}
+	return err
+}
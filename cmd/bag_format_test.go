@@ -0,0 +1,103 @@
+package cmd_test
+
+import (
+	"archive/zip"
+	"compress/gzip"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/APTrust/apt-cmd/cmd"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBagOutputPath(t *testing.T) {
+	assert.Equal(t, "/bags/photos.tar", cmd.BagOutputPath("/bags/photos.tar", cmd.BagFormatTar))
+	assert.Equal(t, "/bags/photos", cmd.BagOutputPath("/bags/photos.tar", cmd.BagFormatDirectory))
+	assert.Equal(t, "/bags/photos", cmd.BagOutputPath("/bags/photos", cmd.BagFormatDirectory))
+	assert.Equal(t, "/bags/photos.zip", cmd.BagOutputPath("/bags/photos.tar", cmd.BagFormatZip))
+	assert.Equal(t, "/bags/photos.zip", cmd.BagOutputPath("/bags/photos.zip", cmd.BagFormatZip))
+	assert.Equal(t, "/bags/photos.zip", cmd.BagOutputPath("/bags/photos", cmd.BagFormatZip))
+	assert.Equal(t, "/bags/photos.tar.gz", cmd.BagOutputPath("/bags/photos.tar", cmd.BagFormatTgz))
+	assert.Equal(t, "/bags/photos.tar.gz", cmd.BagOutputPath("/bags/photos", cmd.BagFormatTgz))
+	assert.Equal(t, "/bags/photos.tar.gz", cmd.BagOutputPath("/bags/photos.tar.gz", cmd.BagFormatTgz))
+	assert.Equal(t, "/bags/photos.tgz", cmd.BagOutputPath("/bags/photos.tgz", cmd.BagFormatTgz))
+}
+
+func TestValidateBagName(t *testing.T) {
+	for _, name := range []string{"coll-2023-017", "My Bag", "photos.v2"} {
+		assert.Nil(t, cmd.ValidateBagName(name), name)
+	}
+	for _, name := range []string{"", " ", "a/b", `a\b`, ".hidden", ".", "..", "tab\tname"} {
+		assert.NotNil(t, cmd.ValidateBagName(name), name)
+	}
+}
+
+func TestTempTarPath(t *testing.T) {
+	outputDir := t.TempDir()
+	for _, outputPath := range []string{"photos", "photos.tar", "photos.zip", "photos.tar.gz", "photos.tgz"} {
+		tarPath, cleanup, err := cmd.TempTarPath(path.Join(outputDir, outputPath))
+		require.Nil(t, err)
+		assert.Equal(t, "photos.tar", path.Base(tarPath))
+		assert.Equal(t, outputDir, path.Dir(path.Dir(tarPath)))
+		cleanup()
+		assert.NoDirExists(t, path.Dir(tarPath))
+	}
+}
+
+func TestExtractTar(t *testing.T) {
+	pathToTar := writeTestTar(t, map[string]string{"bagit.txt": "BagIt-Version: 1.0\n", "data/file.txt": "data"})
+	destDir := t.TempDir()
+	require.Nil(t, cmd.ExtractTar(pathToTar, destDir))
+	data, err := os.ReadFile(path.Join(destDir, "test_bag", "data", "file.txt"))
+	require.Nil(t, err)
+	assert.Equal(t, "data", string(data))
+
+	// Entries can't escape destDir.
+	pathToTar = writeTestTar(t, map[string]string{"../../escaped.txt": "data"})
+	err = cmd.ExtractTar(pathToTar, destDir)
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), "outside of")
+	assert.NoFileExists(t, path.Join(path.Dir(destDir), "escaped.txt"))
+}
+
+func TestGzipTar(t *testing.T) {
+	pathToTar := writeTestTar(t, map[string]string{"bagit.txt": "BagIt-Version: 1.0\n", "data/file.txt": strings.Repeat("data", 1000)})
+	tarData, err := os.ReadFile(pathToTar)
+	require.Nil(t, err)
+	for _, level := range []int{gzip.BestSpeed, cmd.DefaultCompressionLevel, gzip.BestCompression} {
+		pathToGzip := path.Join(t.TempDir(), "test_bag.tar.gz")
+		require.Nil(t, cmd.GzipTar(pathToTar, pathToGzip, level))
+		file, err := os.Open(pathToGzip)
+		require.Nil(t, err)
+		reader, err := gzip.NewReader(file)
+		require.Nil(t, err)
+		data, err := io.ReadAll(reader)
+		file.Close()
+		require.Nil(t, err)
+		assert.Equal(t, tarData, data, level)
+	}
+	assert.NotNil(t, cmd.GzipTar(pathToTar, path.Join(t.TempDir(), "bad.tar.gz"), 42))
+}
+
+func TestZipTar(t *testing.T) {
+	files := map[string]string{"bagit.txt": "BagIt-Version: 1.0\n", "data/file.txt": "data"}
+	pathToZip := path.Join(t.TempDir(), "test_bag.zip")
+	require.Nil(t, cmd.ZipTar(writeTestTar(t, files), pathToZip))
+	reader, err := zip.OpenReader(pathToZip)
+	require.Nil(t, err)
+	defer reader.Close()
+	require.Len(t, reader.File, len(files))
+	for _, file := range reader.File {
+		name := strings.TrimPrefix(file.Name, "test_bag/")
+		entry, err := file.Open()
+		require.Nil(t, err)
+		data, err := io.ReadAll(entry)
+		entry.Close()
+		require.Nil(t, err)
+		assert.Equal(t, files[name], string(data), file.Name)
+	}
+}
@@ -0,0 +1,222 @@
+package cmd
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/APTrust/dart-runner/bagit"
+	"github.com/APTrust/dart-runner/constants"
+	"github.com/APTrust/dart-runner/util"
+	"github.com/spf13/cobra"
+)
+
+// bagInfoCmd represents the bag info command
+var bagInfoCmd = &cobra.Command{
+	Use:     "info",
+	Short:   "Summarize a bag's tags and manifests without validating it",
+	Example: `apt-cmd bag info --file=my_bag.tar`,
+	Long: `Print a quick JSON summary of a bag, to triage bags before you validate
+them. bag info reads .tar, .tar.gz, .tgz and .zip bags, and bag
+directories. It reads the tag files and the list of files in the bag,
+but doesn't calculate any checksums, so it's fast even for large bags.
+
+  apt-cmd bag info --file=photos.tar
+  apt-cmd bag info photos.tar.gz
+
+The summary includes:
+
+  "tags"                   the tags in each tag file, such as bag-info.txt
+                           and aptrust-info.txt, in the order they appear
+  "manifestAlgorithms"     the algorithms of the payload manifests
+  "tagManifestAlgorithms"  the algorithms of the tag manifests
+  "payloadFileCount"       the number of files under data/
+  "payloadBytes"           the total size of the files under data/
+  "payloadOxum"            the Payload-Oxum from bag-info.txt, if any
+  "hasFetchTxt"            whether the bag has a fetch.txt
+
+For example:
+
+  { "bag": "photos.tar", "bagName": "photos",
+    "tags": { "bag-info.txt": [ { "name": "Source-Organization",
+                                  "value": "Faber College" } ] },
+    "manifestAlgorithms": [ "md5", "sha256" ],
+    "tagManifestAlgorithms": [ "md5", "sha256" ],
+    "payloadFileCount": 12, "payloadBytes": 41822,
+    "payloadOxum": "41822.12", "hasFetchTxt": false }
+
+A payloadFileCount or payloadBytes that doesn't match the payloadOxum
+is a sign that the bag is incomplete, unless files are listed in
+fetch.txt. Nothing is validated, so use bag validate to check the bag.
+
+Full online documentation:
+
+https://aptrust.github.io/userguide/partner_tools/
+
+`,
+	Run: func(cmd *cobra.Command, args []string) {
+		pathToBag := cmd.Flag("file").Value.String()
+		if len(args) > 0 {
+			if pathToBag != "" && pathToBag != args[0] {
+				Fail(EXIT_USER_ERR, "Pass the bag with --file or as an argument, not both.")
+			}
+			pathToBag = args[0]
+		}
+		if pathToBag == "" {
+			Fail(EXIT_USER_ERR, "Path to bag is required.")
+		}
+		info, err := GetBagInfo(pathToBag)
+		if err != nil {
+			Fail(EXIT_RUNTIME_ERR, "Can't read bag.", err.Error())
+		}
+		printResult(info)
+		os.Exit(EXIT_OK)
+	},
+}
+
+func init() {
+	bagCmd.AddCommand(bagInfoCmd)
+	bagInfoCmd.Flags().StringP("file", "f", "", "Path to the tarred, zipped or directory bag, if you don't pass it as an argument")
+}
+
+// BagInfoTag is one tag in a tag file.
+type BagInfoTag struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// BagInfo is the summary of a bag that bag info prints. Tags maps each
+// tag file's path in the bag to its tags, in order. PayloadFileCount
+// and PayloadBytes describe the files under data/ that are in the bag,
+// while PayloadOxum is what bag-info.txt says.
+type BagInfo struct {
+	Bag                   string                  `json:"bag"`
+	BagName               string                  `json:"bagName"`
+	Tags                  map[string][]BagInfoTag `json:"tags"`
+	ManifestAlgorithms    []string                `json:"manifestAlgorithms"`
+	TagManifestAlgorithms []string                `json:"tagManifestAlgorithms"`
+	PayloadFileCount      int                     `json:"payloadFileCount"`
+	PayloadBytes          int64                   `json:"payloadBytes"`
+	PayloadOxum           string                  `json:"payloadOxum"`
+	HasFetchTxt           bool                    `json:"hasFetchTxt"`
+}
+
+// GetBagInfo summarizes the bag at pathToBag, which may be a .tar,
+// .tar.gz, .tgz or .zip file, or a directory. It reads the tag files
+// and lists the other files, without reading them, so it doesn't check
+// that the bag is valid.
+func GetBagInfo(pathToBag string) (*BagInfo, error) {
+	info := &BagInfo{
+		Bag:                   pathToBag,
+		Tags:                  make(map[string][]BagInfoTag),
+		ManifestAlgorithms:    make([]string, 0),
+		TagManifestAlgorithms: make([]string, 0),
+	}
+	err := walkBag(pathToBag, func(entry *archiveEntry, reader io.Reader) error {
+		parts := strings.SplitN(strings.TrimPrefix(entry.Name, "./"), "/", 2)
+		if info.BagName == "" {
+			info.BagName = parts[0]
+		}
+		if entry.IsDir || len(parts) < 2 {
+			return nil
+		}
+		pathInBag := parts[1]
+		if match := manifestRegex.FindStringSubmatch(pathInBag); match != nil {
+			if match[1] == "tag" {
+				info.TagManifestAlgorithms = append(info.TagManifestAlgorithms, match[2])
+			} else {
+				info.ManifestAlgorithms = append(info.ManifestAlgorithms, match[2])
+			}
+			return nil
+		}
+		switch {
+		case strings.HasPrefix(pathInBag, "data/"):
+			info.PayloadFileCount++
+			info.PayloadBytes += entry.Size
+		case pathInBag == FetchTxtFile:
+			info.HasFetchTxt = true
+		case util.BagFileType(pathInBag) == constants.FileTypeTag:
+			data, err := io.ReadAll(reader)
+			if err != nil {
+				return err
+			}
+			tags, err := bagit.ParseTagFile(bytes.NewReader(data), pathInBag)
+			if err != nil {
+				return err
+			}
+			info.Tags[pathInBag] = make([]BagInfoTag, len(tags))
+			for i, tag := range tags {
+				info.Tags[pathInBag][i] = BagInfoTag{Name: tag.TagName, Value: tag.Value}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if info.BagName == "" {
+		return nil, fmt.Errorf("%s is empty", pathToBag)
+	}
+	for _, tag := range info.Tags["bag-info.txt"] {
+		if tag.Name == "Payload-Oxum" {
+			info.PayloadOxum = tag.Value
+		}
+	}
+	sort.Strings(info.ManifestAlgorithms)
+	sort.Strings(info.TagManifestAlgorithms)
+	return info, nil
+}
+
+// walkBag calls fn for each entry in the bag at pathToBag, as
+// walkArchive does. If pathToBag is a directory, entry names start with
+// the directory's name, as they would in a tarred bag.
+func walkBag(pathToBag string, fn archiveEntryFunc) error {
+	if !util.IsDirectory(pathToBag) {
+		return walkArchive(pathToBag, fn)
+	}
+	bagName := filepath.Base(filepath.Clean(pathToBag))
+	return filepath.WalkDir(pathToBag, func(filePath string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		relPath, _ := filepath.Rel(pathToBag, filePath)
+		fileInfo, err := d.Info()
+		if err != nil {
+			return err
+		}
+		entry := &archiveEntry{
+			Name:     bagName + "/" + filepath.ToSlash(relPath),
+			IsDir:    d.IsDir(),
+			Typeflag: tar.TypeReg,
+			Mode:     fileInfo.Mode(),
+			ModTime:  fileInfo.ModTime(),
+			Size:     fileInfo.Size(),
+		}
+		switch {
+		case entry.IsDir:
+			entry.Typeflag = tar.TypeDir
+		case entry.Mode&os.ModeSymlink != 0:
+			entry.Typeflag = tar.TypeSymlink
+		case !entry.Mode.IsRegular():
+			entry.Typeflag = tar.TypeChar
+		}
+		if relPath == "." {
+			entry.Name = bagName + "/"
+		}
+		if entry.IsDir || !entry.Mode.IsRegular() {
+			return fn(entry, bytes.NewReader(nil))
+		}
+		file, err := os.Open(filePath)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		return fn(entry, file)
+	})
+}
@@ -0,0 +1,49 @@
+package cmd_test
+
+import (
+	"encoding/json"
+	"path"
+	"testing"
+
+	"github.com/APTrust/apt-cmd/cmd"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetBagInfo(t *testing.T) {
+	for _, format := range []string{cmd.BagFormatTar, cmd.BagFormatTgz, cmd.BagFormatZip, cmd.BagFormatDirectory} {
+		opts := newBagCreateOptions(t)
+		opts.Format = format
+		created, err := cmd.RunBagCreate(opts)
+		require.Nil(t, err, err)
+
+		info, err := cmd.GetBagInfo(created.OutputPath)
+		require.Nil(t, err, format)
+		assert.Equal(t, "library", info.BagName, format)
+		assert.Equal(t, []string{"md5", "sha256"}, info.ManifestAlgorithms, format)
+		assert.Equal(t, []string{"md5", "sha256"}, info.TagManifestAlgorithms, format)
+		assert.Equal(t, 2, info.PayloadFileCount, format)
+		assert.EqualValues(t, 8, info.PayloadBytes, format)
+		assert.Equal(t, "8.2", info.PayloadOxum, format)
+		assert.False(t, info.HasFetchTxt)
+		assert.Contains(t, info.Tags["bag-info.txt"], cmd.BagInfoTag{Name: "Source-Organization", Value: "Faber College"}, format)
+		assert.Contains(t, info.Tags["bagit.txt"], cmd.BagInfoTag{Name: "BagIt-Version", Value: "1.0"}, format)
+	}
+
+	_, err := cmd.GetBagInfo(path.Join(t.TempDir(), "nope.tar"))
+	assert.NotNil(t, err)
+}
+
+func TestBagInfo(t *testing.T) {
+	opts := newBagCreateOptions(t)
+	_, err := cmd.RunBagCreate(opts)
+	require.Nil(t, err)
+	exitCode, stdout, _ := execCmd(t, "go", "run", "../main.go", "bag", "info", "--file="+opts.OutputFile)
+	require.Equal(t, cmd.EXIT_OK, exitCode, stdout)
+	info := &cmd.BagInfo{}
+	require.Nil(t, json.Unmarshal([]byte(stdout), info))
+	assert.Equal(t, "8.2", info.PayloadOxum)
+
+	exitCode, _, _ = execCmd(t, "go", "run", "../main.go", "bag", "info")
+	assert.NotEqual(t, cmd.EXIT_OK, exitCode)
+}
@@ -0,0 +1,242 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/APTrust/dart-runner/util"
+	"github.com/spf13/cobra"
+)
+
+// bagManifestCmd represents the bag manifest command
+var bagManifestCmd = &cobra.Command{
+	Use:     "manifest",
+	Short:   "Print the payload manifests of a directory without bagging it",
+	Example: `apt-cmd bag manifest --bag-dir=/home/josie/photos --algs=sha256,md5`,
+	Long: `Calculate the checksums of the files in a directory and print them as
+BagIt payload manifests, without creating a bag. This is handy for audits,
+when you want to compare the files you have against the manifest of a bag
+you deposited earlier.
+
+  apt-cmd bag manifest --bag-dir=/home/josie/photos --algs=sha256
+
+Each line has a digest, two spaces and the file's path in the bag, sorted
+by path, just as in a bag's manifest-sha256.txt. Paths are the ones bag
+create would give the files, so /home/josie/photos/img/001.jpg is listed
+as data/photos/img/001.jpg. bag manifest leaves out the same files bag
+create would: symbolic links, unless you add --symlinks=follow, files
+matching --exclude, and files matching the patterns in the directory's
+.bagignore file, unless you add --no-bagignore.
+
+With more than one algorithm, bag manifest prints one manifest for each
+algorithm, in the order you list them. Each starts with a line naming
+the manifest file it stands for, such as "# manifest-md5.txt".
+
+Add --output-file to write the manifests to a file instead of stdout.
+Use --hash-encoding to match a bag whose digests aren't lowercase hex.
+
+To compare a directory with a bag you deposited:
+
+  apt-cmd bag manifest --bag-dir=/home/josie/photos > current.txt
+  tar -xOf photos.tar photos/manifest-sha256.txt | diff - current.txt
+
+Full online documentation:
+
+https://aptrust.github.io/userguide/partner_tools/
+
+`,
+	Run: func(cmd *cobra.Command, args []string) {
+		bagDir := cmd.Flag("bag-dir").Value.String()
+		if bagDir == "" {
+			Fail(EXIT_USER_ERR, "--bag-dir is required.")
+		}
+		algs, _ := cmd.Flags().GetStringSlice("algs")
+		noBagignore, _ := cmd.Flags().GetBool("no-bagignore")
+		excludes, _ := cmd.Flags().GetStringArray("exclude")
+		opts := BagManifestOptions{
+			BagDir:          bagDir,
+			Algs:            algs,
+			HashEncoding:    cmd.Flag("hash-encoding").Value.String(),
+			Symlinks:        cmd.Flag("symlinks").Value.String(),
+			ExcludePatterns: excludes,
+			NoBagignore:     noBagignore,
+		}
+		manifests, err := PayloadManifests(cmd.Context(), opts)
+		if err != nil {
+			ExitIfCanceled(cmd.Context())
+			Fail(BagCreateExitCode(err), err.Error())
+		}
+		out := io.Writer(os.Stdout)
+		outputFile := cmd.Flag("output-file").Value.String()
+		var file *os.File
+		if outputFile != "" {
+			if file, err = os.Create(outputFile); err != nil {
+				Fail(EXIT_RUNTIME_ERR, "Can't create --output-file:", err)
+			}
+			out = file
+		}
+		err = WritePayloadManifests(out, opts.Algs, manifests)
+		if file != nil {
+			if closeErr := file.Close(); err == nil {
+				err = closeErr
+			}
+		}
+		if err != nil {
+			Fail(EXIT_RUNTIME_ERR, "Error writing manifests:", err)
+		}
+		os.Exit(EXIT_OK)
+	},
+}
+
+func init() {
+	bagCmd.AddCommand(bagManifestCmd)
+	bagManifestCmd.Flags().StringP("bag-dir", "d", "", "Directory whose files you want checksums of")
+	bagManifestCmd.Flags().StringSliceP("algs", "a", []string{DefaultManifestAlg}, "Manifest algorithms. Specify one, or use comma-separated list for multiple. Supported algorithms: md5, sha1, sha256, sha512, sha3-256, sha3-512.")
+	bagManifestCmd.Flags().StringP("output-file", "o", "", "Write the manifests to this file instead of stdout")
+	bagManifestCmd.Flags().String("hash-encoding", HashEncodingHexLower, "Encoding of the digests: hex-lower, hex-upper, or base64")
+	bagManifestCmd.Flags().String("symlinks", SymlinksSkip, "What to do with symbolic links: skip them, follow them and list what they point to, or exit with an error")
+	bagManifestCmd.Flags().StringArray("exclude", []string{}, "Leave out files and directories matching this glob pattern, as bag create does. You can specify this flag multiple times.")
+	bagManifestCmd.Flags().Bool("no-bagignore", false, "Ignore the .bagignore file in --bag-dir")
+	registerFlagCompletion(bagManifestCmd, "algs", completeValues(SupportedManifestAlgorithms...))
+	registerFlagCompletion(bagManifestCmd, "hash-encoding", completeValues(HashEncodings...))
+	registerFlagCompletion(bagManifestCmd, "symlinks", completeValues(SymlinkPolicies...))
+}
+
+// BagManifestOptions describes the directory whose payload manifests
+// PayloadManifests calculates, and which of its files to include, as
+// with the same options of BagCreateOptions.
+type BagManifestOptions struct {
+	BagDir          string
+	Algs            []string
+	HashEncoding    string
+	Symlinks        string
+	ExcludePatterns []string
+	NoBagignore     bool
+}
+
+// PayloadManifests returns the payload manifests bag create would write
+// for the files in opts.BagDir, keyed by algorithm, without creating a
+// bag. Files are hashed as the bagger hashes them, and named as it
+// names them. Each file is read once, whatever the number of
+// algorithms. Errors are BagCreateErrors, with EXIT_USER_ERR for bad
+// options, or EXIT_CANCELED if ctx is canceled.
+func PayloadManifests(ctx context.Context, opts BagManifestOptions) (map[string][]byte, error) {
+	if len(opts.Algs) == 0 {
+		return nil, bagCreateError(EXIT_USER_ERR, "at least one manifest algorithm is required")
+	}
+	for _, alg := range opts.Algs {
+		if !util.StringListContains(SupportedManifestAlgorithms, alg) {
+			return nil, bagCreateError(EXIT_USER_ERR, "Manifest algorithm '%s' is not supported. Supported algorithms: %s.", alg, strings.Join(SupportedManifestAlgorithms, ", "))
+		}
+	}
+	if opts.HashEncoding == "" {
+		opts.HashEncoding = HashEncodingHexLower
+	}
+	if !util.StringListContains(HashEncodings, opts.HashEncoding) {
+		return nil, bagCreateError(EXIT_USER_ERR, "Invalid --hash-encoding '%s'. Use one of: %s", opts.HashEncoding, strings.Join(HashEncodings, ", "))
+	}
+	absDir, err := filepath.Abs(opts.BagDir)
+	if err != nil {
+		return nil, &BagCreateError{ExitCode: EXIT_USER_ERR, Err: err}
+	}
+	if info, err := os.Stat(absDir); err != nil || !info.IsDir() {
+		return nil, bagCreateError(EXIT_USER_ERR, "%s is not a directory", opts.BagDir)
+	}
+	createOpts := BagCreateOptions{
+		Symlinks:        opts.Symlinks,
+		ExcludePatterns: opts.ExcludePatterns,
+		NoBagignore:     opts.NoBagignore,
+	}
+	createOpts.setDefaults()
+	files, _, err := createOpts.listFiles([]string{absDir})
+	if err != nil {
+		return nil, err
+	}
+	paths := make([]string, len(files))
+	for i, f := range files {
+		paths[i] = f.FullPath
+	}
+	prefix := util.FindCommonPrefix(paths)
+	digests := make(map[string]map[string]string)
+	for _, alg := range opts.Algs {
+		digests[alg] = make(map[string]string)
+	}
+	for _, f := range files {
+		if ctx.Err() != nil {
+			return nil, &BagCreateError{ExitCode: EXIT_CANCELED, Err: ctx.Err()}
+		}
+		if f.IsDir() {
+			continue
+		}
+		checksums, err := fileDigests(f.FullPath, opts.Algs)
+		if err != nil {
+			return nil, &BagCreateError{ExitCode: EXIT_RUNTIME_ERR, Err: err}
+		}
+		pathInBag := payloadPathInBag(prefix, f.FullPath)
+		for alg, digest := range checksums {
+			if digests[alg][pathInBag], err = EncodeDigest(digest, opts.HashEncoding); err != nil {
+				return nil, &BagCreateError{ExitCode: EXIT_RUNTIME_ERR, Err: err}
+			}
+		}
+	}
+	manifests := make(map[string][]byte)
+	for alg, algDigests := range digests {
+		manifests[alg] = manifestContents(algDigests)
+	}
+	return manifests, nil
+}
+
+// WritePayloadManifests writes manifests, as PayloadManifests returns
+// them, to out in the order of algs, as bag manifest prints them.
+func WritePayloadManifests(out io.Writer, algs []string, manifests map[string][]byte) error {
+	for _, alg := range algs {
+		if len(algs) > 1 {
+			if _, err := fmt.Fprintf(out, "# manifest-%s.txt\n", alg); err != nil {
+				return err
+			}
+		}
+		if _, err := out.Write(manifests[alg]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fileDigests returns the hex digests of the file at pathToFile, keyed
+// by algorithm.
+func fileDigests(pathToFile string, algs []string) (map[string]string, error) {
+	file, err := os.Open(pathToFile)
+	if err != nil {
+		return nil, fmt.Errorf("can't read %s: %w", pathToFile, err)
+	}
+	defer file.Close()
+	hashes := GetHashes(algs)
+	writers := make([]io.Writer, 0, len(algs))
+	for _, alg := range algs {
+		writers = append(writers, hashes[alg])
+	}
+	if _, err = io.Copy(io.MultiWriter(writers...), file); err != nil {
+		return nil, fmt.Errorf("can't read %s: %w", pathToFile, err)
+	}
+	checksums := make(map[string]string)
+	for _, alg := range algs {
+		checksums[alg] = fmt.Sprintf("%x", hashes[alg].Sum(nil))
+	}
+	return checksums, nil
+}
+
+// payloadPathInBag returns the path in the bag of the payload file at
+// fullPath, as the bagger names it: data/ followed by the path below
+// prefix, the longest common prefix of the paths of all of the bag's
+// files.
+func payloadPathInBag(prefix, fullPath string) string {
+	shortPath := filepath.ToSlash(strings.Replace(fullPath, prefix, "", 1))
+	if !strings.HasPrefix(shortPath, "/") {
+		shortPath = "/" + shortPath
+	}
+	return "data" + shortPath
+}
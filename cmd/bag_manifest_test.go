@@ -0,0 +1,80 @@
+package cmd_test
+
+import (
+	"context"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/APTrust/apt-cmd/cmd"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPayloadManifests(t *testing.T) {
+	opts := newBagCreateOptions(t)
+	opts.ManifestAlgs = []string{"md5", "sha256", "sha3-256"}
+	opts.Profile.ManifestsAllowed = append(opts.Profile.ManifestsAllowed, "sha3-256")
+	require.Nil(t, os.WriteFile(path.Join(opts.BagDirs[0], "skip.tmp"), []byte("skip"), 0644))
+	opts.ExcludePatterns = []string{"*.tmp"}
+	_, err := cmd.RunBagCreate(opts)
+	require.Nil(t, err)
+
+	// The manifests match the ones bag create writes.
+	manifests, err := cmd.PayloadManifests(context.Background(), cmd.BagManifestOptions{
+		BagDir:          opts.BagDirs[0],
+		Algs:            opts.ManifestAlgs,
+		ExcludePatterns: opts.ExcludePatterns,
+	})
+	require.Nil(t, err)
+	require.Len(t, manifests, 3)
+	for _, alg := range opts.ManifestAlgs {
+		assert.Equal(t, tarFileContent(t, opts.OutputFile, "library/manifest-"+alg+".txt"), string(manifests[alg]), alg)
+	}
+	assert.Contains(t, string(manifests["md5"]), "8d777f385d3dfec8815d20f7496026dc  data/files/file.txt\n")
+	assert.NotContains(t, string(manifests["md5"]), "skip.tmp")
+
+	manifests, err = cmd.PayloadManifests(context.Background(), cmd.BagManifestOptions{
+		BagDir:       opts.BagDirs[0],
+		Algs:         []string{"md5"},
+		HashEncoding: cmd.HashEncodingHexUpper,
+	})
+	require.Nil(t, err)
+	assert.Contains(t, string(manifests["md5"]), "8D777F385D3DFEC8815D20F7496026DC  data/files/file.txt\n")
+	assert.Contains(t, string(manifests["md5"]), "  data/files/skip.tmp\n")
+
+	var out strings.Builder
+	require.Nil(t, cmd.WritePayloadManifests(&out, []string{"md5"}, manifests))
+	assert.Equal(t, string(manifests["md5"]), out.String())
+
+	_, err = cmd.PayloadManifests(context.Background(), cmd.BagManifestOptions{BagDir: opts.BagDirs[0], Algs: []string{"crc32"}})
+	require.NotNil(t, err)
+	assert.Equal(t, cmd.EXIT_USER_ERR, cmd.BagCreateExitCode(err))
+	_, err = cmd.PayloadManifests(context.Background(), cmd.BagManifestOptions{BagDir: path.Join(t.TempDir(), "missing"), Algs: []string{"md5"}})
+	require.NotNil(t, err)
+	assert.Equal(t, cmd.EXIT_USER_ERR, cmd.BagCreateExitCode(err))
+}
+
+func TestBagManifest(t *testing.T) {
+	bagDir := path.Join(t.TempDir(), "photos")
+	require.Nil(t, os.Mkdir(bagDir, 0755))
+	require.Nil(t, os.WriteFile(path.Join(bagDir, "file.txt"), []byte("data"), 0644))
+
+	exitCode, stdout, stderr := execCmd(t, "go", "run", "../main.go", "bag", "manifest", "--bag-dir="+bagDir, "--algs=sha256")
+	require.Equal(t, cmd.EXIT_OK, exitCode, stderr)
+	assert.Equal(t, "3a6eb0790f39ac87c94f3856b2dd2c5d110e6811602261a9a923d3bb23adc8b7  data/photos/file.txt\n", stdout)
+
+	outputFile := path.Join(t.TempDir(), "manifests.txt")
+	exitCode, stdout, stderr = execCmd(t, "go", "run", "../main.go", "bag", "manifest", "--bag-dir="+bagDir, "--algs=sha256,md5", "--output-file="+outputFile)
+	require.Equal(t, cmd.EXIT_OK, exitCode, stderr)
+	assert.Empty(t, stdout)
+	data, err := os.ReadFile(outputFile)
+	require.Nil(t, err)
+	assert.Equal(t, "# manifest-sha256.txt\n3a6eb0790f39ac87c94f3856b2dd2c5d110e6811602261a9a923d3bb23adc8b7  data/photos/file.txt\n# manifest-md5.txt\n8d777f385d3dfec8815d20f7496026dc  data/photos/file.txt\n", string(data))
+
+	exitCode, _, stderr = execCmd(t, "go", "run", "../main.go", "bag", "manifest", "--algs=sha256")
+	assert.NotEqual(t, cmd.EXIT_OK, exitCode)
+	assert.Contains(t, stderr, "--bag-dir is required.")
+	assert.Contains(t, stderr, "exit status 3")
+}
@@ -0,0 +1,210 @@
+package cmd
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/APTrust/dart-runner/bagit"
+	psbagit "github.com/APTrust/preservation-services/bagit"
+	"github.com/APTrust/preservation-services/constants"
+	"github.com/APTrust/preservation-services/models/registry"
+	"github.com/APTrust/preservation-services/models/service"
+	"github.com/spf13/cobra"
+)
+
+// BagMetadata contains the registry fields we can derive from a
+// tarred bag before it's deposited.
+type BagMetadata struct {
+	IntellectualObject *registry.IntellectualObject `json:"intellectual_object"`
+	WorkItem           *registry.WorkItem           `json:"work_item"`
+}
+
+// bagMetadataCmd represents the bag metadata command
+var bagMetadataCmd = &cobra.Command{
+	Use:     "metadata",
+	Short:   "Extract registry metadata from a tarred bag",
+	Example: `apt-cmd bag metadata --institution=example.edu /path/to/my_bag.tar`,
+	Long: `Read the tag files of a tarred bag and print, as JSON, the fields
+the APTrust registry will record for the bag's intellectual object and
+ingest work item. This uses the same tags and defaults as APTrust
+ingest, so you can pre-register or check a bag's metadata before you
+upload it.
+
+The intellectual object's title, description, access, storage option,
+alt identifier, bag group identifier, source organization and BagIt
+profile identifier come from the bag's tags. Bag name and size come from
+the tar file, payload file count and size come from Payload-Oxum, and the
+work item's bag date comes from Bagging-Date.
+
+Add --institution with your institution's identifier to get the object
+identifier the registry will assign to the bag. Fields the registry sets
+during ingest, such as ids, etags and timestamps, are empty.
+
+Examples:
+
+  apt-cmd bag metadata my_bag.tar
+  apt-cmd bag metadata --institution=example.edu my_bag.tar
+
+Full online documentation:
+
+https://aptrust.github.io/userguide/partner_tools/
+
+`,
+	Run: func(cmd *cobra.Command, args []string) {
+		pathToBag := ""
+		if len(args) > 0 {
+			pathToBag = args[0]
+		}
+		if pathToBag == "" {
+			Fail(EXIT_USER_ERR, "Path to bag is required.")
+		}
+		institution := cmd.Flags().Lookup("institution").Value.String()
+		metadata, err := GetBagMetadata(pathToBag, institution)
+		if err != nil {
+			Fail(EXIT_RUNTIME_ERR, "Can't read bag metadata.", err.Error())
+		}
+		printResult(metadata)
+		os.Exit(EXIT_OK)
+	},
+}
+
+func init() {
+	bagCmd.AddCommand(bagMetadataCmd)
+	bagMetadataCmd.Flags().StringP("institution", "i", "", "Identifier of the depositing institution, e.g. example.edu")
+}
+
+// GetBagMetadata reads the tag files in the tarred bag at pathToBag
+// and returns the intellectual object and work item fields the
+// registry will record when the bag is ingested. Param institution
+// is the identifier of the depositing institution. If it's empty,
+// the object's identifier will be empty too.
+func GetBagMetadata(pathToBag, institution string) (*BagMetadata, error) {
+	stat, err := os.Stat(pathToBag)
+	if err != nil {
+		return nil, err
+	}
+	tagFiles, err := readTagFiles(pathToBag, DefaultPayloadDir)
+	if err != nil {
+		return nil, err
+	}
+	fileCount, err := countTarFiles(pathToBag)
+	if err != nil {
+		return nil, err
+	}
+	ingestObject := &service.IngestObject{
+		FileCount:     fileCount,
+		Institution:   institution,
+		S3Key:         path.Base(pathToBag),
+		Size:          stat.Size(),
+		StorageOption: constants.StorageStandard,
+		Tags:          make([]*psbagit.Tag, 0),
+	}
+	for tagFile, data := range tagFiles {
+		tags, err := bagit.ParseTagFile(bytes.NewReader(data), tagFile)
+		if err != nil {
+			return nil, err
+		}
+		for _, tag := range tags {
+			ingestObject.Tags = append(ingestObject.Tags, psbagit.NewTag(tag.TagFile, tag.TagName, tag.Value))
+		}
+	}
+	// This matches ingest. BTR bags have no aptrust-info.txt, but
+	// they may set the storage option in bag-info.txt.
+	storageOption := ingestObject.GetTagValue("aptrust-info.txt", "Storage-Option", "")
+	if storageOption == "" {
+		storageOption = ingestObject.GetTagValue("bag-info.txt", "APTrust-Storage-Option", "")
+	}
+	if storageOption != "" {
+		ingestObject.StorageOption = storageOption
+	}
+
+	obj := ingestObject.ToIntellectualObject()
+	obj.State = ""
+	if institution == "" {
+		obj.Identifier = ""
+	}
+	obj.PayloadSize, obj.PayloadFileCount = parsePayloadOxum(ingestObject.GetTagValue("bag-info.txt", "Payload-Oxum", ""))
+
+	workItem := &registry.WorkItem{
+		Action:           constants.ActionIngest,
+		Name:             ingestObject.S3Key,
+		ObjectIdentifier: obj.Identifier,
+		Size:             ingestObject.Size,
+		StorageOption:    obj.StorageOption,
+	}
+	workItem.BagDate = parseBaggingDate(ingestObject.GetTagValue("bag-info.txt", "Bagging-Date", ""))
+	return &BagMetadata{
+		IntellectualObject: obj,
+		WorkItem:           workItem,
+	}, nil
+}
+
+// baggingDateFormats are the date formats we've seen in Bagging-Date
+// tags. The BagIt spec says to use YYYY-MM-DD, but many tools include
+// the time as well.
+var baggingDateFormats = []string{
+	time.RFC3339Nano,
+	"2006-01-02T15:04:05.999999999-0700",
+	"2006-01-02",
+}
+
+// parseBaggingDate parses a Bagging-Date value. It returns the zero
+// time if the value is empty or is in a format we don't recognize.
+func parseBaggingDate(value string) time.Time {
+	value = strings.TrimSpace(value)
+	for _, format := range baggingDateFormats {
+		if date, err := time.Parse(format, value); err == nil {
+			return date.UTC()
+		}
+	}
+	return time.Time{}
+}
+
+// parsePayloadOxum parses a Payload-Oxum value, which has the format
+// <bytes>.<file count>, and returns the byte count and file count.
+// It returns zeros if the value is missing or malformed.
+func parsePayloadOxum(oxum string) (int64, int64) {
+	parts := strings.Split(strings.TrimSpace(oxum), ".")
+	if len(parts) != 2 {
+		return 0, 0
+	}
+	size, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return 0, 0
+	}
+	count, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return 0, 0
+	}
+	return size, count
+}
+
+// countTarFiles returns the number of regular files in a tar file.
+func countTarFiles(pathToTar string) (int, error) {
+	file, err := os.Open(pathToTar)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	count := 0
+	tarReader := tar.NewReader(file)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return 0, err
+		}
+		if header.Typeflag == tar.TypeReg || header.Typeflag == tar.TypeRegA {
+			count++
+		}
+	}
+	return count, nil
+}
@@ -0,0 +1,74 @@
+package cmd_test
+
+import (
+	"encoding/json"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/APTrust/apt-cmd/cmd"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetBagMetadata_APTrust(t *testing.T) {
+	pathToBag := path.Join("..", "testbags", "aptrust", "example.edu.tagsample_good.tar")
+	metadata, err := cmd.GetBagMetadata(pathToBag, "example.edu")
+	require.Nil(t, err)
+
+	obj := metadata.IntellectualObject
+	assert.Equal(t, "Thirteen Ways of Looking at a Blackbird", obj.Title)
+	assert.Equal(t, "institution", obj.Access)
+	assert.Equal(t, "Standard", obj.StorageOption)
+	assert.Equal(t, "uva-internal-id-0001", obj.AltIdentifier)
+	assert.Equal(t, "Charley Horse", obj.BagGroupIdentifier)
+	assert.Equal(t, "virginia.edu", obj.SourceOrganization)
+	assert.Equal(t, "example.edu.tagsample_good", obj.BagName)
+	assert.Equal(t, "example.edu/example.edu.tagsample_good", obj.Identifier)
+	assert.Equal(t, "example.edu", obj.InstitutionIdentifier)
+	assert.Equal(t, int64(13821), obj.PayloadSize)
+	assert.Equal(t, int64(4), obj.PayloadFileCount)
+	assert.True(t, obj.FileCount > obj.PayloadFileCount)
+	assert.True(t, obj.Size > 0)
+
+	item := metadata.WorkItem
+	assert.Equal(t, "Ingest", item.Action)
+	assert.Equal(t, "example.edu.tagsample_good.tar", item.Name)
+	assert.Equal(t, obj.Identifier, item.ObjectIdentifier)
+	assert.Equal(t, obj.Size, item.Size)
+	assert.Equal(t, "Standard", item.StorageOption)
+	assert.Equal(t, time.Date(2014, 4, 14, 15, 55, 26, 170000000, time.UTC), item.BagDate)
+}
+
+func TestGetBagMetadata_BTR(t *testing.T) {
+	// BTR bags have no aptrust-info.txt, so the storage option
+	// comes from bag-info.txt, and there's no identifier without
+	// an institution.
+	pathToBag := path.Join("..", "testbags", "btr", "test.edu.btr-wasabi-or.tar")
+	metadata, err := cmd.GetBagMetadata(pathToBag, "")
+	require.Nil(t, err)
+	obj := metadata.IntellectualObject
+	assert.Equal(t, "Wasabi-OR", obj.StorageOption)
+	assert.Equal(t, "institution", obj.Access)
+	assert.Equal(t, "", obj.Identifier)
+	assert.Equal(t, "", metadata.WorkItem.ObjectIdentifier)
+	assert.Equal(t, "test.edu.btr-wasabi-or", obj.BagName)
+
+	_, err = cmd.GetBagMetadata(path.Join("..", "testbags", "does-not-exist.tar"), "")
+	assert.NotNil(t, err)
+}
+
+func TestBagMetadata(t *testing.T) {
+	pathToBag := path.Join("..", "testbags", "aptrust", "example.edu.sample_good.tar")
+	exitCode, stdout, stderr := execCmd(t, "go", "run", "../main.go", "bag", "metadata", "--institution=example.edu", pathToBag)
+	assert.Equal(t, 0, exitCode)
+	assert.Empty(t, stderr)
+	metadata := &cmd.BagMetadata{}
+	require.Nil(t, json.Unmarshal([]byte(stdout), metadata))
+	assert.Equal(t, "example.edu/example.edu.sample_good", metadata.IntellectualObject.Identifier)
+	assert.Equal(t, "example.edu.sample_good.tar", metadata.WorkItem.Name)
+
+	exitCode, _, stderr = execCmd(t, "go", "run", "../main.go", "bag", "metadata")
+	assert.NotEqual(t, 0, exitCode)
+	assert.Contains(t, stderr, "Path to bag is required.")
+}
@@ -0,0 +1,133 @@
+package cmd
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/APTrust/dart-runner/util"
+)
+
+// DefaultPayloadDir is the payload directory the BagIt spec names, and
+// the one the bagger writes.
+const DefaultPayloadDir = "data"
+
+// ValidatePayloadDir returns an error if payloadDir can't be the name
+// of a bag's payload directory. It must be a single directory at the
+// top of the bag, and can't look like a tag file or manifest.
+func ValidatePayloadDir(payloadDir string) error {
+	switch {
+	case payloadDir == "":
+		return fmt.Errorf("payload directory name can't be empty")
+	case strings.ContainsAny(payloadDir, `/\`):
+		return fmt.Errorf("payload directory name '%s' can't contain / or \\", payloadDir)
+	case strings.HasPrefix(payloadDir, "."):
+		return fmt.Errorf("payload directory name '%s' can't start with a dot", payloadDir)
+	case strings.HasSuffix(payloadDir, ".txt"), payloadDir == FetchTxtFile:
+		return fmt.Errorf("payload directory name '%s' looks like a tag file", payloadDir)
+	}
+	return nil
+}
+
+// RenamePayloadDir renames the data directory of the tarred bag at
+// pathToTar to payloadDir, and rewrites the paths in the payload
+// manifests to match. It updates the tag manifests, since the payload
+// manifests change. The bagger always writes data/, so call this after
+// WriteManifests, and before RewriteManifestEncoding, since it expects
+// hex digests. Like WriteManifests, this writes a new tar file next to
+// the original, then replaces the original.
+func RenamePayloadDir(pathToTar, payloadDir string) error {
+	if payloadDir == DefaultPayloadDir {
+		return nil
+	}
+	manifests, err := readManifests(pathToTar)
+	if err != nil {
+		return err
+	}
+	replacements := make(map[string][]byte)
+	for name, data := range manifests {
+		match := manifestRegex.FindStringSubmatch(name)
+		if match == nil || match[1] == "tag" {
+			continue
+		}
+		digests := make(map[string]string)
+		for pathInBag, digest := range parseManifest(data) {
+			digests[payloadDir+strings.TrimPrefix(pathInBag, DefaultPayloadDir)] = digest
+		}
+		replacements[name] = manifestContents(digests)
+	}
+	if err = updateTagManifests(manifests, replacements); err != nil {
+		return err
+	}
+
+	in, err := os.Open(pathToTar)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	tmpPath := pathToTar + ".tmp"
+	out, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	reader := tar.NewReader(in)
+	writer := tar.NewWriter(out)
+	for {
+		header, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err == nil {
+			err = copyTarEntryRenamingPayload(reader, header, writer, payloadDir, replacements)
+		}
+		if err != nil {
+			os.Remove(tmpPath)
+			return err
+		}
+	}
+	if err = writer.Close(); err == nil {
+		err = out.Close()
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return os.Rename(tmpPath, pathToTar)
+}
+
+// copyTarEntryRenamingPayload copies one entry for RenamePayloadDir,
+// moving it into payloadDir if it's in data/, or writing its
+// replacement instead if it has one.
+func copyTarEntryRenamingPayload(reader io.Reader, header *tar.Header, writer *tar.Writer, payloadDir string, replacements map[string][]byte) error {
+	pathInBag, _ := util.TarPathToBagPath(strings.TrimSuffix(header.Name, "/"))
+	if pathInBag == DefaultPayloadDir || strings.HasPrefix(pathInBag, DefaultPayloadDir+"/") {
+		bagDir := header.Name[:strings.Index(header.Name, "/")+1]
+		header.Name = bagDir + payloadDir + header.Name[len(bagDir)+len(DefaultPayloadDir):]
+	}
+	if data, ok := replacements[pathInBag]; ok && header.Typeflag != tar.TypeDir {
+		header.Size = int64(len(data))
+		if err := writer.WriteHeader(header); err != nil {
+			return err
+		}
+		_, err := writer.Write(data)
+		return err
+	}
+	if err := writer.WriteHeader(header); err != nil {
+		return err
+	}
+	_, err := io.Copy(writer, reader)
+	return err
+}
+
+// inPayloadDir returns pathInBag as the validator sees it, with
+// payloadDir replaced by data, and whether it's in payloadDir. The
+// validator, like the BagIt spec, knows only data/.
+func inPayloadDir(pathInBag, payloadDir string) (string, bool) {
+	if !strings.HasPrefix(pathInBag, payloadDir+"/") {
+		return pathInBag, false
+	}
+	return DefaultPayloadDir + strings.TrimPrefix(pathInBag, payloadDir), true
+}
@@ -0,0 +1,68 @@
+package cmd_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/APTrust/apt-cmd/cmd"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRunBagCreate_PayloadDir(t *testing.T) {
+	opts := newBagCreateOptions(t)
+	opts.PayloadDir = "payload"
+	opts.Verify = true
+	result, err := cmd.RunBagCreate(opts)
+	require.Nil(t, err, err)
+	assert.Equal(t, "OK", result.Result)
+
+	names := tarFileNames(t, opts.OutputFile)
+	assert.Contains(t, names, "library/payload/files/sub/copy.txt")
+	for _, name := range names {
+		assert.NotContains(t, name, "library/data/")
+	}
+	manifest := tarFileContent(t, opts.OutputFile, "library/manifest-sha256.txt")
+	assert.Contains(t, manifest, "  payload/files/file.txt\n")
+	assert.NotContains(t, manifest, "data/")
+
+	// It's valid only with the same payload directory.
+	validator, err := cmd.ValidateBagWithPayloadDir(context.Background(), opts.OutputFile, opts.Profile, "payload")
+	require.Nil(t, err)
+	assert.Empty(t, validator.Errors)
+	validator, err = cmd.ValidateBag(context.Background(), opts.OutputFile, opts.Profile)
+	require.Nil(t, err)
+	assert.NotEmpty(t, validator.Errors)
+
+	opts.PayloadDir = "../payload"
+	assert.NotNil(t, opts.Validate())
+	opts.PayloadDir = "notes.txt"
+	assert.NotNil(t, opts.Validate())
+}
+
+func TestValidateBagWithPayloadDir_Inconsistent(t *testing.T) {
+	bagitTxt := "BagIt-Version: 1.0\nTag-File-Character-Encoding: UTF-8\n"
+	profile, err := cmd.LoadProfile("empty")
+	require.Nil(t, err)
+
+	// The manifest lists a file outside the payload directory.
+	pathToTar := writeTestTar(t, map[string]string{
+		"bagit.txt":        bagitTxt,
+		"payload/a.txt":    "data",
+		"manifest-md5.txt": "8d777f385d3dfec8815d20f7496026dc  data/a.txt\n",
+	})
+	validator, err := cmd.ValidateBagWithPayloadDir(context.Background(), pathToTar, profile, "payload")
+	require.Nil(t, err)
+	assert.Equal(t, "manifest-md5.txt lists data/a.txt, which is not in payload directory payload", validator.Errors["Bag"])
+
+	// The bag has a data directory as well.
+	pathToTar = writeTestTar(t, map[string]string{
+		"bagit.txt":        bagitTxt,
+		"payload/a.txt":    "data",
+		"data/b.txt":       "data",
+		"manifest-md5.txt": "8d777f385d3dfec8815d20f7496026dc  payload/a.txt\n",
+	})
+	validator, err = cmd.ValidateBagWithPayloadDir(context.Background(), pathToTar, profile, "payload")
+	require.Nil(t, err)
+	assert.Equal(t, "bag has a data directory, but its payload directory is payload", validator.Errors["Bag"])
+}
@@ -0,0 +1,184 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/APTrust/dart-runner/util"
+)
+
+// ProgressInterval is how often --progress reports on a bag.
+const ProgressInterval = time.Second
+
+// BagProgress describes how far the bagger has gotten. Phase is
+// "hashing" while the bagger hashes payload files and writes them into
+// the bag, "writing" while it writes tag files and manifests, and
+// "done" when it's finished. CurrentFile is the payload file the bagger
+// is working on. It's empty once the bagger has finished the payload.
+// Percent covers the payload, since it's nearly all of the work.
+type BagProgress struct {
+	Phase          string `json:"phase"`
+	CurrentFile    string `json:"currentFile"`
+	BytesProcessed int64  `json:"bytesProcessed"`
+	TotalBytes     int64  `json:"totalBytes"`
+	Percent        int    `json:"percent"`
+}
+
+// bagProgressTracker estimates a BagProgress from the size of the tar
+// file the bagger is writing. The bagger doesn't report its progress,
+// but it writes the payload files into the tar file one at a time, in
+// the order we give them, so the tar file's size tells us which file
+// it's on and how much of it it has written.
+type bagProgressTracker struct {
+	files []*util.ExtendedFileInfo
+	// tarEnds[i] is the tar file size after the bagger writes files[i].
+	tarEnds []int64
+	// bytesBefore[i] is the total size of the files before files[i].
+	bytesBefore     []int64
+	payloadBytes    int64
+	payloadTarBytes int64
+}
+
+func newBagProgressTracker(files []*util.ExtendedFileInfo) *bagProgressTracker {
+	tracker := &bagProgressTracker{
+		files:       files,
+		tarEnds:     make([]int64, len(files)),
+		bytesBefore: make([]int64, len(files)),
+	}
+	// Each tar entry is a 512-byte header, followed by the file's
+	// data padded to a multiple of 512 bytes.
+	tarSize := int64(0)
+	for i, f := range files {
+		tracker.bytesBefore[i] = tracker.payloadBytes
+		tarSize += 512
+		tarSize += (fileSize(f) + 511) / 512 * 512
+		tracker.payloadBytes += fileSize(f)
+		tracker.tarEnds[i] = tarSize
+	}
+	tracker.payloadTarBytes = tarSize
+	return tracker
+}
+
+// fileSize returns the size of f's data, which is zero for directories
+// and files we couldn't stat.
+func fileSize(f *util.ExtendedFileInfo) int64 {
+	if f.FileInfo != nil && f.Mode().IsRegular() {
+		return f.Size()
+	}
+	return 0
+}
+
+// progress returns the progress for a tar file of tarSize bytes.
+func (t *bagProgressTracker) progress(tarSize int64) BagProgress {
+	progress := BagProgress{
+		Phase:          "writing",
+		BytesProcessed: t.payloadBytes,
+		TotalBytes:     t.payloadBytes,
+		Percent:        100,
+	}
+	i := sort.Search(len(t.tarEnds), func(i int) bool { return t.tarEnds[i] > tarSize })
+	if i == len(t.files) {
+		return progress
+	}
+	size := fileSize(t.files[i])
+	written := tarSize - (t.tarEnds[i] - (size+511)/512*512)
+	if written < 0 {
+		written = 0
+	} else if written > size {
+		written = size
+	}
+	progress.Phase = "hashing"
+	progress.CurrentFile = t.files[i].FullPath
+	progress.BytesProcessed = t.bytesBefore[i] + written
+	progress.Percent = 0
+	if t.payloadBytes > 0 {
+		progress.Percent = int(progress.BytesProcessed * 100 / t.payloadBytes)
+	}
+	// We're not done until the bagger finishes.
+	if progress.Percent > 99 {
+		progress.Percent = 99
+	}
+	return progress
+}
+
+// WatchBagProgress calls callback every interval with the progress of
+// the bagger writing files into the tar file at pathToTar, skipping
+// intervals in which the bagger made no progress. This returns a
+// function that stops watching. Call it when the bagger finishes, and
+// it calls callback once more with phase "done".
+func WatchBagProgress(pathToTar string, files []*util.ExtendedFileInfo, interval time.Duration, callback func(BagProgress)) func() {
+	tracker := newBagProgressTracker(files)
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		lastSize := int64(-1)
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				stat, err := os.Stat(pathToTar)
+				if err != nil || stat.Size() == lastSize {
+					continue
+				}
+				lastSize = stat.Size()
+				callback(tracker.progress(lastSize))
+			}
+		}
+	}()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			close(stop)
+			<-stopped
+			progress := tracker.progress(tracker.payloadTarBytes)
+			progress.Phase = "done"
+			callback(progress)
+		})
+	}
+}
+
+// ProgressPrinter writes BagProgress reports for --progress. In text
+// mode, meant for terminals, it rewrites a single line in place. In
+// JSON mode, it writes each report as a line of JSON, which scripts
+// and log collectors can parse.
+type ProgressPrinter struct {
+	out      io.Writer
+	jsonMode bool
+	mutex    sync.Mutex
+}
+
+// NewProgressPrinter returns a printer that writes to out.
+func NewProgressPrinter(out io.Writer, jsonMode bool) *ProgressPrinter {
+	return &ProgressPrinter{out: out, jsonMode: jsonMode}
+}
+
+// Print writes one progress report. In text mode, it ends the line
+// when the bagger is done, so the next output starts on a line of its
+// own.
+func (p *ProgressPrinter) Print(progress BagProgress) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.jsonMode {
+		// Marshalling this struct can't fail.
+		data, _ := json.Marshal(progress)
+		fmt.Fprintln(p.out, string(data))
+		return
+	}
+	line := fmt.Sprintf("%s: %3d%% (%s of %s)", progress.Phase, progress.Percent, FormatSize(progress.BytesProcessed, sizeUnits), FormatSize(progress.TotalBytes, sizeUnits))
+	if progress.CurrentFile != "" {
+		line += " " + progress.CurrentFile
+	}
+	fmt.Fprintf(p.out, "\r%s\033[K", line)
+	if progress.Phase == "done" {
+		fmt.Fprintln(p.out)
+	}
+}
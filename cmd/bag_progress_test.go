@@ -0,0 +1,89 @@
+package cmd_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/APTrust/apt-cmd/cmd"
+	"github.com/APTrust/dart-runner/util"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWatchBagProgress(t *testing.T) {
+	dir := t.TempDir()
+	files := make([]*util.ExtendedFileInfo, 0)
+	for _, name := range []string{"one.txt", "two.txt"} {
+		filePath := path.Join(dir, name)
+		require.Nil(t, os.WriteFile(filePath, bytes.Repeat([]byte("x"), 1000), 0644))
+		info, err := os.Stat(filePath)
+		require.Nil(t, err)
+		files = append(files, util.NewExtendedFileInfo(filePath, info))
+	}
+
+	var mutex sync.Mutex
+	reports := make([]cmd.BagProgress, 0)
+	callback := func(progress cmd.BagProgress) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		reports = append(reports, progress)
+	}
+	lastReport := func() cmd.BagProgress {
+		mutex.Lock()
+		defer mutex.Unlock()
+		if len(reports) == 0 {
+			return cmd.BagProgress{}
+		}
+		return reports[len(reports)-1]
+	}
+
+	// Pretend to be the bagger writing a tar file. Each file is a
+	// 512-byte header plus 1000 bytes padded to 1024.
+	pathToTar := path.Join(dir, "bag.tar")
+	stop := cmd.WatchBagProgress(pathToTar, files, 10*time.Millisecond, callback)
+	require.Nil(t, os.WriteFile(pathToTar, make([]byte, 512+500), 0644))
+	require.Eventually(t, func() bool { return lastReport().BytesProcessed == 500 }, time.Second, 10*time.Millisecond)
+	assert.Equal(t, cmd.BagProgress{Phase: "hashing", CurrentFile: files[0].FullPath, BytesProcessed: 500, TotalBytes: 2000, Percent: 25}, lastReport())
+
+	require.Nil(t, os.WriteFile(pathToTar, make([]byte, 1536+512+1000), 0644))
+	require.Eventually(t, func() bool { return lastReport().BytesProcessed == 2000 }, time.Second, 10*time.Millisecond)
+	assert.Equal(t, cmd.BagProgress{Phase: "hashing", CurrentFile: files[1].FullPath, BytesProcessed: 2000, TotalBytes: 2000, Percent: 99}, lastReport())
+
+	require.Nil(t, os.WriteFile(pathToTar, make([]byte, 4000), 0644))
+	require.Eventually(t, func() bool { return lastReport().Phase == "writing" }, time.Second, 10*time.Millisecond)
+
+	stop()
+	assert.Equal(t, cmd.BagProgress{Phase: "done", BytesProcessed: 2000, TotalBytes: 2000, Percent: 100}, lastReport())
+	count := len(reports)
+	stop()
+	assert.Equal(t, count, len(reports))
+}
+
+func TestProgressPrinter(t *testing.T) {
+	hashing := cmd.BagProgress{Phase: "hashing", CurrentFile: "/photos/001.tif", BytesProcessed: 500, TotalBytes: 2000, Percent: 25}
+	done := cmd.BagProgress{Phase: "done", BytesProcessed: 2000, TotalBytes: 2000, Percent: 100}
+
+	out := &bytes.Buffer{}
+	printer := cmd.NewProgressPrinter(out, true)
+	printer.Print(hashing)
+	printer.Print(done)
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	require.Len(t, lines, 2)
+	var progress cmd.BagProgress
+	require.Nil(t, json.Unmarshal([]byte(lines[0]), &progress))
+	assert.Equal(t, hashing, progress)
+	assert.Equal(t, `{"phase":"done","currentFile":"","bytesProcessed":2000,"totalBytes":2000,"percent":100}`, lines[1])
+
+	out = &bytes.Buffer{}
+	printer = cmd.NewProgressPrinter(out, false)
+	printer.Print(hashing)
+	assert.Equal(t, "\rhashing:  25% (500 B of 2.0 kB) /photos/001.tif\033[K", out.String())
+	printer.Print(done)
+	assert.True(t, strings.HasSuffix(out.String(), "\rdone: 100% (2.0 kB of 2.0 kB)\033[K\n"))
+}
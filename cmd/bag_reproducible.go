@@ -0,0 +1,157 @@
+package cmd
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/APTrust/dart-runner/bagit"
+	"github.com/APTrust/dart-runner/constants"
+	"github.com/APTrust/dart-runner/util"
+)
+
+var baggingDateRegex = regexp.MustCompile(`(?m)^Bagging-Date:.*\n`)
+
+// ReproducibleTimestamp returns the modification time that
+// --reproducible gives every entry in the bag: the Bagging-Date in tags,
+// if there is one, or else the Unix epoch. It returns an error if the
+// Bagging-Date isn't a date we can parse.
+func ReproducibleTimestamp(tags []*bagit.TagDefinition) (time.Time, error) {
+	tag := FindTag(tags, "bag-info.txt", "Bagging-Date")
+	if tag == nil {
+		return time.Unix(0, 0).UTC(), nil
+	}
+	timestamp := parseBaggingDate(tag.GetValue())
+	if timestamp.IsZero() {
+		return timestamp, fmt.Errorf("Bagging-Date '%s' must be a date like 2023-06-01 or a timestamp like 2023-06-01T12:00:00Z", tag.GetValue())
+	}
+	return timestamp, nil
+}
+
+// MakeReproducible rewrites the tarred bag at pathToTar so that bagging
+// the same files with the same options always gives the same bytes. The
+// bagger stamps the bag with the time it was made, so this sets the
+// modification time of every entry to timestamp, and the owner and
+// group to 0, with no user or group names. With removeBaggingDate, it
+// removes the Bagging-Date from bag-info.txt, and updates the tag
+// manifests to match. Otherwise, call OverrideAutoTags first to pin
+// the Bagging-Date. Entries are sorted by path: the payload first, then the tag
+// files, the manifests and the tag manifests, which is the order the
+// bagger writes them in.
+//
+// Call this before RewriteManifestEncoding, since it expects hex
+// digests. Like WriteManifests, this writes a new tar file next to the
+// original, then replaces the original.
+func MakeReproducible(pathToTar string, timestamp time.Time, removeBaggingDate bool) error {
+	file, err := os.Open(pathToTar)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	// Note where each entry's data starts, so we can copy the entries
+	// in a different order.
+	type tarEntry struct {
+		header    *tar.Header
+		pathInBag string
+		offset    int64
+	}
+	entries := make([]*tarEntry, 0)
+	reader := tar.NewReader(file)
+	for {
+		header, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		offset, err := file.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return err
+		}
+		pathInBag, _ := util.TarPathToBagPath(strings.TrimSuffix(header.Name, "/"))
+		entries = append(entries, &tarEntry{header: header, pathInBag: pathInBag, offset: offset})
+	}
+	rank := func(entry *tarEntry) int {
+		switch {
+		case entry.pathInBag == "":
+			return 0
+		case entry.pathInBag == "data" || strings.HasPrefix(entry.pathInBag, "data/"):
+			return 1
+		}
+		switch util.BagFileType(entry.pathInBag) {
+		case constants.FileTypeManifest:
+			return 3
+		case constants.FileTypeTagManifest:
+			return 4
+		}
+		return 2
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		if rank(entries[i]) != rank(entries[j]) {
+			return rank(entries[i]) < rank(entries[j])
+		}
+		return entries[i].header.Name < entries[j].header.Name
+	})
+
+	replacements := make(map[string][]byte)
+	manifests, err := readManifests(pathToTar)
+	if err != nil {
+		return err
+	}
+	bagInfo, err := readTarFiles(pathToTar, func(pathInBag string) bool { return pathInBag == "bag-info.txt" })
+	if err != nil {
+		return err
+	}
+	if data, ok := bagInfo["bag-info.txt"]; ok && removeBaggingDate {
+		replacements["bag-info.txt"] = baggingDateRegex.ReplaceAll(data, nil)
+	}
+	if err = updateTagManifests(manifests, replacements); err != nil {
+		return err
+	}
+
+	tmpPath := pathToTar + ".tmp"
+	out, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	writer := tar.NewWriter(out)
+	for _, entry := range entries {
+		header := *entry.header
+		header.ModTime = timestamp
+		header.AccessTime = time.Time{}
+		header.ChangeTime = time.Time{}
+		header.Uid, header.Gid = 0, 0
+		header.Uname, header.Gname = "", ""
+		header.PAXRecords = nil
+		header.Format = tar.FormatUnknown
+		var data io.Reader = io.NewSectionReader(file, entry.offset, entry.header.Size)
+		if replacement, ok := replacements[entry.pathInBag]; ok && header.Typeflag != tar.TypeDir {
+			header.Size = int64(len(replacement))
+			data = bytes.NewReader(replacement)
+		}
+		if err = writer.WriteHeader(&header); err == nil {
+			_, err = io.Copy(writer, data)
+		}
+		if err != nil {
+			os.Remove(tmpPath)
+			return err
+		}
+	}
+	if err = writer.Close(); err == nil {
+		err = out.Close()
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return os.Rename(tmpPath, pathToTar)
+}
@@ -0,0 +1,103 @@
+package cmd_test
+
+import (
+	"archive/tar"
+	"context"
+	"io"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/APTrust/apt-cmd/cmd"
+	"github.com/APTrust/dart-runner/bagit"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRunBagCreate_Reproducible(t *testing.T) {
+	opts := newBagCreateOptions(t)
+	opts.Reproducible = true
+	opts.Verify = true
+	result, err := cmd.RunBagCreate(opts)
+	require.Nil(t, err, err)
+	assert.Equal(t, "OK", result.Result)
+	first, err := os.ReadFile(opts.OutputFile)
+	require.Nil(t, err)
+
+	// Bagging again later, after the files were touched, gives the same
+	// bytes.
+	later := time.Now().Add(time.Hour)
+	require.Nil(t, os.Chtimes(path.Join(opts.BagDirs[0], "file.txt"), later, later))
+	opts.OutputFile = path.Join(t.TempDir(), "library.tar")
+	_, err = cmd.RunBagCreate(opts)
+	require.Nil(t, err, err)
+	second, err := os.ReadFile(opts.OutputFile)
+	require.Nil(t, err)
+	assert.Equal(t, first, second)
+
+	assert.NotContains(t, tarFileContent(t, opts.OutputFile, "library/bag-info.txt"), "Bagging-Date")
+	file, err := os.Open(opts.OutputFile)
+	require.Nil(t, err)
+	defer file.Close()
+	names := make([]string, 0)
+	reader := tar.NewReader(file)
+	for {
+		header, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		require.Nil(t, err)
+		names = append(names, header.Name)
+		assert.True(t, header.ModTime.Equal(time.Unix(0, 0)), header.Name)
+		assert.Equal(t, 0, header.Uid)
+		assert.Equal(t, "", header.Uname)
+	}
+	assert.Equal(t, "library/data/files/file.txt", names[2])
+	assert.Equal(t, "library/tagmanifest-sha256.txt", names[len(names)-1])
+
+	// Without the flag, the bag records when it was made.
+	opts.Reproducible = false
+	opts.OutputFile = path.Join(t.TempDir(), "library.tar")
+	_, err = cmd.RunBagCreate(opts)
+	require.Nil(t, err, err)
+	assert.Contains(t, tarFileContent(t, opts.OutputFile, "library/bag-info.txt"), "Bagging-Date: 20")
+}
+
+func TestRunBagCreate_ReproduciblePinnedDate(t *testing.T) {
+	opts := newBagCreateOptions(t)
+	opts.Reproducible = true
+	opts.Format = cmd.BagFormatTgz
+	opts.Tags = append(opts.Tags, &bagit.TagDefinition{TagFile: "bag-info.txt", TagName: "Bagging-Date", UserValue: "2023-06-01"})
+	_, err := cmd.RunBagCreate(opts)
+	require.Nil(t, err, err)
+	first, err := os.ReadFile(cmd.BagOutputPath(opts.OutputFile, opts.Format))
+	require.Nil(t, err)
+	opts.OutputFile = path.Join(t.TempDir(), "library.tar")
+	result, err := cmd.RunBagCreate(opts)
+	require.Nil(t, err, err)
+	second, err := os.ReadFile(result.OutputPath)
+	require.Nil(t, err)
+	assert.Equal(t, first, second)
+
+	// The tar file keeps the pinned date, and the bag is still valid.
+	opts.Format = cmd.BagFormatTar
+	opts.OutputFile = path.Join(t.TempDir(), "library.tar")
+	_, err = cmd.RunBagCreate(opts)
+	require.Nil(t, err, err)
+	assert.Contains(t, tarFileContent(t, opts.OutputFile, "library/bag-info.txt"), "Bagging-Date: 2023-06-01\n")
+	validator, err := cmd.ValidateBag(context.Background(), opts.OutputFile, opts.Profile)
+	require.Nil(t, err)
+	assert.Empty(t, validator.Errors)
+
+	// The pinned date must be a date.
+	opts.Tags[len(opts.Tags)-1].UserValue = "last Tuesday"
+	_, err = cmd.RunBagCreate(opts)
+	require.NotNil(t, err)
+	assert.Equal(t, cmd.EXIT_USER_ERR, cmd.BagCreateExitCode(err))
+
+	// Streaming can't make a reproducible bag.
+	opts.Stream = true
+	opts.UploadHost = "localhost:9899"
+	assert.NotNil(t, opts.Validate())
+}
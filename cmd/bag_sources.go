@@ -0,0 +1,193 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/APTrust/dart-runner/util"
+)
+
+// AbsBagDirs returns the absolute paths of the directories in the
+// --bag-dir flags, in order. The bagger puts each directory into the
+// bag's data directory under its own name, so this returns an error if
+// two of them have the same name, since their files would collide, or
+// if one is inside another, since its files would be bagged twice.
+func AbsBagDirs(bagDirs []string) ([]string, error) {
+	absDirs := make([]string, 0, len(bagDirs))
+	for _, bagDir := range bagDirs {
+		absDir, err := filepath.Abs(bagDir)
+		if err != nil {
+			return nil, fmt.Errorf("can't convert %s to absolute path: %w", bagDir, err)
+		}
+		for _, other := range absDirs {
+			if filepath.Base(absDir) == filepath.Base(other) {
+				return nil, fmt.Errorf("--bag-dir %s and %s would both be bagged as data/%s. Rename one of them, or bag their common parent directory instead", other, absDir, filepath.Base(absDir))
+			}
+			if isInside(absDir, other) || isInside(other, absDir) {
+				return nil, fmt.Errorf("--bag-dir %s and %s overlap. Bag only the outer one", other, absDir)
+			}
+		}
+		absDirs = append(absDirs, absDir)
+	}
+	return absDirs, nil
+}
+
+// isInside returns true if dir is parent or is inside it.
+func isInside(dir, parent string) bool {
+	rel, err := filepath.Rel(parent, dir)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// Values for --symlinks, which says what bag create does with symbolic
+// links in the directories it bags.
+const (
+	SymlinksSkip   = "skip"
+	SymlinksFollow = "follow"
+	SymlinksError  = "error"
+)
+
+// SymlinkPolicies lists the supported values for --symlinks.
+var SymlinkPolicies = []string{
+	SymlinksSkip,
+	SymlinksFollow,
+	SymlinksError,
+}
+
+// ListBagDirFiles returns the files in each of absDirs, including the
+// directories themselves, one directory after another. Param symlinks,
+// one of SymlinkPolicies, says what to do with symbolic links in the
+// directories. SymlinksSkip leaves them out. SymlinksFollow lists the
+// file or directory each link points to in the link's place, and
+// returns an error for a link to a directory that contains the link,
+// since following it would loop forever. A followed link whose target
+// is missing is listed without file info, like a file the walk couldn't
+// stat. SymlinksError returns an error listing all of the links. The
+// directories in absDirs are always followed, even if they're links.
+//
+// This also returns the paths of the links it skipped or followed.
+func ListBagDirFiles(absDirs []string, symlinks string) ([]*util.ExtendedFileInfo, []string, error) {
+	walker := &bagDirWalker{
+		symlinks: symlinks,
+		files:    make([]*util.ExtendedFileInfo, 0),
+		links:    make([]string, 0),
+	}
+	for _, absDir := range absDirs {
+		info, err := os.Stat(absDir)
+		if err != nil || !info.IsDir() {
+			walker.files = append(walker.files, util.NewExtendedFileInfo(absDir, info))
+			continue
+		}
+		if err = walker.walk(absDir, info, nil); err != nil {
+			return nil, nil, err
+		}
+	}
+	if symlinks == SymlinksError && len(walker.links) > 0 {
+		lines := append([]string{"The following files are symbolic links. Use --symlinks=follow to bag the files they point to, or --symlinks=skip to leave them out."}, walker.links...)
+		return nil, nil, fmt.Errorf("%s", strings.Join(lines, "\n"))
+	}
+	return walker.files, walker.links, nil
+}
+
+// bagDirWalker lists files for ListBagDirFiles.
+type bagDirWalker struct {
+	symlinks string
+	files    []*util.ExtendedFileInfo
+	links    []string
+}
+
+// walk lists dirPath, whose file info is info, and everything in it, in
+// lexical order, as filepath.Walk would. Param ancestors holds the file
+// info of the directories above dirPath, so we can tell when a link
+// leads back to one of them.
+func (w *bagDirWalker) walk(dirPath string, info os.FileInfo, ancestors []os.FileInfo) error {
+	w.files = append(w.files, util.NewExtendedFileInfo(dirPath, info))
+	entries, err := os.ReadDir(dirPath)
+	if err != nil {
+		// FindUnreadableFiles will report the directory.
+		return nil
+	}
+	ancestors = append(ancestors, info)
+	for _, entry := range entries {
+		entryPath := filepath.Join(dirPath, entry.Name())
+		entryInfo, err := entry.Info()
+		if err != nil {
+			w.files = append(w.files, util.NewExtendedFileInfo(entryPath, nil))
+			continue
+		}
+		if entryInfo.Mode()&os.ModeSymlink != 0 {
+			w.links = append(w.links, entryPath)
+			if w.symlinks != SymlinksFollow {
+				continue
+			}
+			if entryInfo, err = os.Stat(entryPath); err != nil {
+				w.files = append(w.files, util.NewExtendedFileInfo(entryPath, nil))
+				continue
+			}
+			for _, ancestor := range ancestors {
+				if entryInfo.IsDir() && os.SameFile(ancestor, entryInfo) {
+					return fmt.Errorf("symbolic link %s points to a directory that contains it, so following it would loop forever. Remove the link, or use --symlinks=skip", entryPath)
+				}
+			}
+		}
+		if entryInfo.IsDir() {
+			if err = w.walk(entryPath, entryInfo, ancestors); err != nil {
+				return err
+			}
+			continue
+		}
+		w.files = append(w.files, util.NewExtendedFileInfo(entryPath, entryInfo))
+	}
+	return nil
+}
+
+// StageBagDirs arranges for the bagger to bag several directories
+// into one bag. The bagger names files in the bag by their paths below
+// the longest common prefix of the files it's given, so on its own it
+// would bag /a/metadata and /b/payload as data/a/metadata and
+// data/b/payload. StageBagDirs creates a temp directory with a symlink
+// to each of absDirs. Pass it to StagedFiles to get file paths that go
+// through the symlinks, and the bagger bags them as data/metadata and
+// data/payload, just as it would bag a single directory. This also
+// returns a function that removes the temp directory.
+func StageBagDirs(absDirs []string) (string, func(), error) {
+	stageDir, err := os.MkdirTemp("", "apt-cmd-bag-dirs-")
+	if err != nil {
+		return "", func() {}, err
+	}
+	removeStageDir := func() { os.RemoveAll(stageDir) }
+	for _, absDir := range absDirs {
+		if err = os.Symlink(absDir, filepath.Join(stageDir, filepath.Base(absDir))); err != nil {
+			removeStageDir()
+			return "", func() {}, fmt.Errorf("can't link to %s: %w", absDir, err)
+		}
+	}
+	return stageDir, removeStageDir, nil
+}
+
+// StagedFiles returns copies of files, which come from
+// ListBagDirFiles(absDirs), with their paths rewritten to go through
+// the symlinks that StageBagDirs created in stageDir. Only the bagger
+// should see these paths. Use the original list for messages, since
+// users won't recognize the temp directory.
+func StagedFiles(stageDir string, absDirs []string, files []*util.ExtendedFileInfo) ([]*util.ExtendedFileInfo, error) {
+	staged := make([]*util.ExtendedFileInfo, 0, len(files))
+	for _, f := range files {
+		found := false
+		for _, absDir := range absDirs {
+			if !isInside(f.FullPath, absDir) {
+				continue
+			}
+			rel, _ := filepath.Rel(absDir, f.FullPath)
+			stagedPath := filepath.Join(stageDir, filepath.Base(absDir), rel)
+			staged = append(staged, util.NewExtendedFileInfo(stagedPath, f.FileInfo))
+			found = true
+			break
+		}
+		if !found {
+			return nil, fmt.Errorf("%s is not in any --bag-dir", f.FullPath)
+		}
+	}
+	return staged, nil
+}
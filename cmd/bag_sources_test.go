@@ -0,0 +1,117 @@
+package cmd_test
+
+import (
+	"os"
+	"path"
+	"testing"
+
+	"github.com/APTrust/apt-cmd/cmd"
+	"github.com/APTrust/dart-runner/util"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAbsBagDirs(t *testing.T) {
+	absDirs, err := cmd.AbsBagDirs([]string{"/a/metadata", "/b/scans"})
+	require.Nil(t, err)
+	assert.Equal(t, []string{"/a/metadata", "/b/scans"}, absDirs)
+
+	_, err = cmd.AbsBagDirs([]string{"/a/files", "/b/files"})
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), "would both be bagged as data/files")
+
+	_, err = cmd.AbsBagDirs([]string{"/a/files", "/a/files/photos"})
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), "overlap")
+
+	// Names that merely start the same aren't nested.
+	_, err = cmd.AbsBagDirs([]string{"/a/files", "/a/files2"})
+	assert.Nil(t, err)
+}
+
+func TestStagedFiles(t *testing.T) {
+	metadataDir := path.Join(t.TempDir(), "metadata")
+	scansDir := path.Join(t.TempDir(), "scans")
+	for _, dir := range []string{metadataDir, scansDir} {
+		require.Nil(t, os.Mkdir(dir, 0755))
+		require.Nil(t, os.WriteFile(path.Join(dir, "README.txt"), []byte(path.Base(dir)), 0644))
+	}
+	absDirs := []string{metadataDir, scansDir}
+	files, _, err := cmd.ListBagDirFiles(absDirs, cmd.SymlinksSkip)
+	require.Nil(t, err)
+	require.Len(t, files, 4)
+
+	stageDir, removeStageDir, err := cmd.StageBagDirs(absDirs)
+	require.Nil(t, err)
+	staged, err := cmd.StagedFiles(stageDir, absDirs, files)
+	require.Nil(t, err)
+	require.Len(t, staged, 4)
+	assert.Equal(t, path.Join(stageDir, "metadata"), staged[0].FullPath)
+	assert.Equal(t, path.Join(stageDir, "metadata", "README.txt"), staged[1].FullPath)
+	assert.Equal(t, path.Join(stageDir, "scans", "README.txt"), staged[3].FullPath)
+
+	// The staged paths reach the original files.
+	data, err := os.ReadFile(staged[3].FullPath)
+	require.Nil(t, err)
+	assert.Equal(t, "scans", string(data))
+
+	removeStageDir()
+	assert.NoDirExists(t, stageDir)
+	assert.DirExists(t, scansDir)
+}
+
+func TestListBagDirFiles_Symlinks(t *testing.T) {
+	outside := t.TempDir()
+	require.Nil(t, os.Mkdir(path.Join(outside, "photos"), 0755))
+	require.Nil(t, os.WriteFile(path.Join(outside, "photos", "01.jpg"), []byte("photo"), 0644))
+	require.Nil(t, os.WriteFile(path.Join(outside, "notes.txt"), []byte("some notes"), 0644))
+	bagDir := path.Join(t.TempDir(), "files")
+	require.Nil(t, os.Mkdir(bagDir, 0755))
+	require.Nil(t, os.WriteFile(path.Join(bagDir, "README.txt"), []byte("read me"), 0644))
+	require.Nil(t, os.Symlink(path.Join(outside, "notes.txt"), path.Join(bagDir, "notes.txt")))
+	require.Nil(t, os.Symlink(path.Join(outside, "photos"), path.Join(bagDir, "photos")))
+	fileLink, dirLink := path.Join(bagDir, "notes.txt"), path.Join(bagDir, "photos")
+
+	paths := func(files []*util.ExtendedFileInfo) []string {
+		list := make([]string, 0, len(files))
+		for _, f := range files {
+			list = append(list, f.FullPath)
+		}
+		return list
+	}
+
+	files, links, err := cmd.ListBagDirFiles([]string{bagDir}, cmd.SymlinksSkip)
+	require.Nil(t, err)
+	assert.Equal(t, []string{bagDir, path.Join(bagDir, "README.txt")}, paths(files))
+	assert.Equal(t, []string{fileLink, dirLink}, links)
+
+	// Followed links look like the files and directories they point to.
+	files, links, err = cmd.ListBagDirFiles([]string{bagDir}, cmd.SymlinksFollow)
+	require.Nil(t, err)
+	assert.Equal(t, []string{bagDir, path.Join(bagDir, "README.txt"), fileLink, dirLink, path.Join(dirLink, "01.jpg")}, paths(files))
+	assert.Equal(t, []string{fileLink, dirLink}, links)
+	assert.EqualValues(t, 10, files[2].Size())
+	assert.True(t, files[3].IsDir())
+
+	_, _, err = cmd.ListBagDirFiles([]string{bagDir}, cmd.SymlinksError)
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), fileLink)
+	assert.Contains(t, err.Error(), dirLink)
+
+	// A link back up the tree would loop forever.
+	require.Nil(t, os.Symlink(bagDir, path.Join(outside, "photos", "loop")))
+	_, _, err = cmd.ListBagDirFiles([]string{bagDir}, cmd.SymlinksFollow)
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), "loop forever")
+	files, _, err = cmd.ListBagDirFiles([]string{bagDir}, cmd.SymlinksSkip)
+	require.Nil(t, err)
+	assert.Len(t, files, 2)
+
+	// A link to a missing file can't be read.
+	require.Nil(t, os.Remove(path.Join(outside, "photos", "loop")))
+	require.Nil(t, os.Remove(path.Join(outside, "notes.txt")))
+	files, _, err = cmd.ListBagDirFiles([]string{bagDir}, cmd.SymlinksFollow)
+	require.Nil(t, err)
+	_, unreadable := cmd.FindUnreadableFiles(files)
+	assert.Contains(t, unreadable, fileLink)
+}
@@ -0,0 +1,117 @@
+package cmd
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/APTrust/dart-runner/util"
+)
+
+// TarEntrySize returns the number of bytes a file of size bytes takes
+// up in a tar file: a 512-byte header, followed by the file's data
+// padded to a multiple of 512 bytes.
+func TarEntrySize(size int64) int64 {
+	return 512 + (size+511)/512*512
+}
+
+// PartitionFiles splits the regular files in files, which come from
+// ListBagDirFiles, into parts whose tar entries total no more than
+// maxBagSize bytes. Files stay in the order of files, so files in the
+// same directory usually end up in the same part. Each part lists the
+// files' absolute paths. This returns an error listing any files that
+// are too big to fit in a part on their own.
+func PartitionFiles(files []*util.ExtendedFileInfo, maxBagSize int64) ([][]string, error) {
+	parts := make([][]string, 0)
+	tooBig := make([]string, 0)
+	var part []string
+	partSize := int64(0)
+	for _, f := range files {
+		if f.FileInfo == nil || !f.Mode().IsRegular() {
+			continue
+		}
+		size := TarEntrySize(f.Size())
+		if size > maxBagSize {
+			tooBig = append(tooBig, f.FullPath)
+			continue
+		}
+		if part != nil && partSize+size > maxBagSize {
+			parts = append(parts, part)
+			part, partSize = nil, 0
+		}
+		part = append(part, f.FullPath)
+		partSize += size
+	}
+	if len(tooBig) > 0 {
+		lines := append([]string{"The following files are too big to fit in a bag with the --max-bag-size you chose:"}, tooBig...)
+		return nil, fmt.Errorf("%s", strings.Join(lines, "\n"))
+	}
+	if part != nil {
+		parts = append(parts, part)
+	}
+	return parts, nil
+}
+
+// PlanBagParts returns the parts that bag create --max-bag-size splits
+// the payload opts describes into, as PartitionFiles does. It lists the
+// files just as RunBagCreate would, leaving out excluded files. Pass
+// each part to RunBagCreate in opts.Files, with its own OutputFile and
+// Bag-Count tag. If the payload fits in one bag, there's one part.
+// Errors are BagCreateErrors.
+func PlanBagParts(opts BagCreateOptions, maxBagSize int64) ([][]string, error) {
+	opts.setDefaults()
+	absDirs, err := AbsBagDirs(opts.BagDirs)
+	if err != nil {
+		return nil, &BagCreateError{ExitCode: EXIT_USER_ERR, Err: err}
+	}
+	files, _, err := opts.listFiles(absDirs)
+	if err != nil {
+		return nil, err
+	}
+	parts, err := PartitionFiles(files, maxBagSize)
+	if err != nil {
+		return nil, &BagCreateError{ExitCode: EXIT_USER_ERR, Err: err}
+	}
+	if len(parts) == 0 {
+		return nil, bagCreateError(EXIT_USER_ERR, "There are no files to bag.")
+	}
+	return parts, nil
+}
+
+// OnlyFiles returns the entries in files whose paths are in paths, plus
+// the directories that hold them.
+func OnlyFiles(files []*util.ExtendedFileInfo, paths []string) []*util.ExtendedFileInfo {
+	wanted := make(map[string]bool)
+	for _, filePath := range paths {
+		for !wanted[filePath] {
+			wanted[filePath] = true
+			parent := filepath.Dir(filePath)
+			if parent == filePath {
+				break
+			}
+			filePath = parent
+		}
+	}
+	kept := make([]*util.ExtendedFileInfo, 0, len(paths))
+	for _, f := range files {
+		if wanted[f.FullPath] {
+			kept = append(kept, f)
+		}
+	}
+	return kept
+}
+
+// MultipartOutputFile returns the output file for part number part of
+// a bag split into count parts. It adds the part number and count to
+// the name, before the extension, so photos.tar becomes
+// photos_001_of_003.tar.
+func MultipartOutputFile(outputFile string, part, count int) string {
+	ext := ""
+	for _, knownExt := range []string{".tar.gz", ".tgz", ".zip", ".tar"} {
+		if strings.HasSuffix(outputFile, knownExt) {
+			ext = knownExt
+			break
+		}
+	}
+	return fmt.Sprintf("%s_%03d_of_%03d%s", strings.TrimSuffix(outputFile, ext), part, count, ext)
+}
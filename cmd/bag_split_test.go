@@ -0,0 +1,94 @@
+package cmd_test
+
+import (
+	"os"
+	"path"
+	"testing"
+
+	"github.com/APTrust/apt-cmd/cmd"
+	"github.com/APTrust/dart-runner/util"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTarEntrySize(t *testing.T) {
+	assert.EqualValues(t, 512, cmd.TarEntrySize(0))
+	assert.EqualValues(t, 1024, cmd.TarEntrySize(1))
+	assert.EqualValues(t, 1024, cmd.TarEntrySize(512))
+	assert.EqualValues(t, 1536, cmd.TarEntrySize(513))
+}
+
+func TestPartitionFiles(t *testing.T) {
+	dir := t.TempDir()
+	require.Nil(t, os.Mkdir(path.Join(dir, "sub"), 0755))
+	sizes := map[string]int{"a.txt": 1000, "b.txt": 400, "sub/c.txt": 1000}
+	for name, size := range sizes {
+		require.Nil(t, os.WriteFile(path.Join(dir, name), make([]byte, size), 0644))
+	}
+	files, err := util.RecursiveFileList(dir)
+	require.Nil(t, err)
+
+	// a.txt and b.txt take 1536 and 1024 bytes of tar, so they fit
+	// together in 2560 bytes, but c.txt doesn't fit with them.
+	parts, err := cmd.PartitionFiles(files, 2560)
+	require.Nil(t, err)
+	require.Len(t, parts, 2)
+	assert.Equal(t, []string{path.Join(dir, "a.txt"), path.Join(dir, "b.txt")}, parts[0])
+	assert.Equal(t, []string{path.Join(dir, "sub/c.txt")}, parts[1])
+
+	parts, err = cmd.PartitionFiles(files, 100000)
+	require.Nil(t, err)
+	assert.Len(t, parts, 1)
+
+	_, err = cmd.PartitionFiles(files, 1500)
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), path.Join(dir, "a.txt"))
+	assert.Contains(t, err.Error(), path.Join(dir, "sub/c.txt"))
+	assert.NotContains(t, err.Error(), path.Join(dir, "b.txt"))
+}
+
+func TestOnlyFiles(t *testing.T) {
+	dir := t.TempDir()
+	require.Nil(t, os.MkdirAll(path.Join(dir, "sub", "deeper"), 0755))
+	require.Nil(t, os.Mkdir(path.Join(dir, "other"), 0755))
+	for _, name := range []string{"a.txt", "sub/deeper/b.txt", "other/c.txt"} {
+		require.Nil(t, os.WriteFile(path.Join(dir, name), []byte(name), 0644))
+	}
+	files, err := util.RecursiveFileList(dir)
+	require.Nil(t, err)
+	kept := cmd.OnlyFiles(files, []string{path.Join(dir, "sub/deeper/b.txt")})
+	paths := make([]string, 0)
+	for _, f := range kept {
+		paths = append(paths, f.FullPath)
+	}
+	assert.ElementsMatch(t, []string{dir, path.Join(dir, "sub"), path.Join(dir, "sub/deeper"), path.Join(dir, "sub/deeper/b.txt")}, paths)
+}
+
+func TestMultipartOutputFile(t *testing.T) {
+	assert.Equal(t, "/bags/photos_001_of_003.tar", cmd.MultipartOutputFile("/bags/photos.tar", 1, 3))
+	assert.Equal(t, "/bags/photos_012_of_120.tar.gz", cmd.MultipartOutputFile("/bags/photos.tar.gz", 12, 120))
+	assert.Equal(t, "/bags/photos_002_of_002.zip", cmd.MultipartOutputFile("/bags/photos.zip", 2, 2))
+	assert.Equal(t, "/bags/photos_002_of_002", cmd.MultipartOutputFile("/bags/photos", 2, 2))
+}
+
+func TestPlanBagParts(t *testing.T) {
+	opts := newBagCreateOptions(t)
+	parts, err := cmd.PlanBagParts(opts, 1024)
+	require.Nil(t, err)
+	require.Len(t, parts, 2)
+	assert.Equal(t, []string{path.Join(opts.BagDirs[0], "file.txt")}, parts[0])
+	assert.Equal(t, []string{path.Join(opts.BagDirs[0], "sub", "copy.txt")}, parts[1])
+
+	opts.Files = parts[1]
+	result, err := cmd.RunBagCreate(opts)
+	require.Nil(t, err, err)
+	names := tarFileNames(t, result.OutputPath)
+	assert.Contains(t, names, "library/data/files/sub/copy.txt")
+	assert.NotContains(t, names, "library/data/files/file.txt")
+	assert.Contains(t, tarFileContent(t, result.OutputPath, "library/bag-info.txt"), "Payload-Oxum: 4.1")
+
+	opts.ExcludePatterns = []string{"*.txt"}
+	_, err = cmd.PlanBagParts(opts, 1024)
+	require.NotNil(t, err)
+	assert.Equal(t, cmd.EXIT_USER_ERR, cmd.BagCreateExitCode(err))
+}
@@ -0,0 +1,418 @@
+package cmd
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/APTrust/dart-runner/bagit"
+	"github.com/APTrust/dart-runner/constants"
+	"github.com/APTrust/dart-runner/util"
+	"github.com/minio/minio-go/v7"
+)
+
+// StreamPartSize is the size of each part of the multipart upload when
+// bag create --stream sends a bag to S3. We hold one part in memory at
+// a time, and S3 allows at most 10,000 parts, so this limits streamed
+// bags to about 1.2 TiB.
+const StreamPartSize = 128 * 1024 * 1024
+
+// StreamBag writes a tarred bag of files to out in a single pass, so
+// that the bag never has to be written to disk. The bag has the same
+// layout as the bagger's tarred bags, with entries in the same order:
+// the payload files, then the tag files, then the manifests, and last
+// the tag manifests, which have to come after everything they list.
+// Since the files are hashed as they're written, bag-info.txt can have
+// the Payload-Oxum, and the manifests can have every payload digest,
+// by the time we get to them.
+//
+// Param outputPath names the bag, as it does for the bagger. Manifest
+// digests are in hashEncoding. This returns a Bagger describing the
+// bag's files, as the bagger would.
+func StreamBag(out io.Writer, outputPath string, profile *bagit.Profile, files []*util.ExtendedFileInfo, hashEncoding string) (*bagit.Bagger, error) {
+	bagger := bagit.NewBagger(outputPath, profile, files)
+	stream := &bagStream{
+		writer:  tar.NewWriter(out),
+		algs:    tagManifestAlgorithms(profile),
+		rootDir: util.CleanBagName(path.Base(outputPath)),
+	}
+	bagName := strings.TrimSuffix(path.Base(outputPath), path.Ext(outputPath))
+	bagName = strings.TrimSuffix(bagName, ".tar")
+
+	// Name payload files below the longest common prefix of their
+	// paths, as the bagger does.
+	paths := make([]string, len(files))
+	for i, f := range files {
+		paths[i] = f.FullPath
+	}
+	prefix := util.FindCommonPrefix(paths)
+	if err := stream.addRootDir(); err != nil {
+		return nil, err
+	}
+	for _, f := range files {
+		pathInBag := bagName + "/" + payloadPathInBag(prefix, f.FullPath)
+		uid, gid := f.OwnerAndGroup()
+		header := &tar.Header{
+			Name:     pathInBag,
+			Mode:     int64(f.Mode().Perm()),
+			ModTime:  f.ModTime(),
+			Uid:      uid,
+			Gid:      gid,
+			Typeflag: tar.TypeDir,
+		}
+		if f.IsDir() {
+			if err := stream.writer.WriteHeader(header); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		header.Typeflag = tar.TypeReg
+		header.Size = f.Size()
+		file, err := os.Open(f.FullPath)
+		if err != nil {
+			return nil, fmt.Errorf("can't read %s: %w", f.FullPath, err)
+		}
+		checksums, err := stream.addFile(header, file)
+		file.Close()
+		if err != nil {
+			return nil, fmt.Errorf("error adding %s to bag: %w", f.FullPath, err)
+		}
+		stream.record(bagger.PayloadFiles, constants.FileTypePayload, pathInBag, header.Size, checksums)
+	}
+
+	// We now know the Payload-Oxum and Bag-Size. The user's values
+	// for the other tags override ours.
+	userValues := userAutoTagValues(profile)
+	setBagInfoAutoValues(profile, bagger.PayloadFiles)
+	for _, tag := range userValues {
+		profile.SetTagValue(tag.TagFile, tag.TagName, tag.UserValue)
+	}
+	for _, tagFileName := range profile.TagFileNames() {
+		contents, err := profile.GetTagFileContents(tagFileName)
+		if err != nil {
+			return nil, fmt.Errorf("error getting contents of %s: %w", tagFileName, err)
+		}
+		if err = stream.addTagFile(bagger.TagFiles, bagName+"/"+tagFileName, []byte(contents)); err != nil {
+			return nil, err
+		}
+	}
+
+	// Tag manifests list the payload manifests along with the tag
+	// files, so we hash the manifests as tag files.
+	for _, alg := range profile.ManifestsRequired {
+		contents, err := manifestFor(constants.FileTypePayload, alg, bagName, hashEncoding, bagger.PayloadFiles)
+		if err != nil {
+			return nil, err
+		}
+		if err = stream.addTagFile(bagger.PayloadManifests, fmt.Sprintf("%s/manifest-%s.txt", bagName, alg), contents); err != nil {
+			return nil, err
+		}
+	}
+	for _, alg := range stream.algs {
+		contents, err := manifestFor(constants.FileTypeTag, alg, bagName, hashEncoding, bagger.TagFiles, bagger.PayloadManifests)
+		if err != nil {
+			return nil, err
+		}
+		pathInBag := fmt.Sprintf("%s/tagmanifest-%s.txt", bagName, alg)
+		if err = stream.addTagFile(bagger.TagManifests, pathInBag, contents); err != nil {
+			return nil, err
+		}
+	}
+	return bagger, stream.writer.Close()
+}
+
+// bagStream writes the entries of a tarred bag, hashing each file with
+// algs as it goes.
+type bagStream struct {
+	writer  *tar.Writer
+	algs    []string
+	rootDir string
+}
+
+// addRootDir writes the entry for the bag's top-level directory, which
+// the bagger writes first.
+func (stream *bagStream) addRootDir() error {
+	return stream.writer.WriteHeader(&tar.Header{
+		Name:     stream.rootDir,
+		Mode:     0755,
+		ModTime:  time.Now(),
+		Typeflag: tar.TypeDir,
+	})
+}
+
+// addFile writes header and the contents of reader, and returns the
+// file's digests, keyed by algorithm.
+func (stream *bagStream) addFile(header *tar.Header, reader io.Reader) (map[string]string, error) {
+	if err := stream.writer.WriteHeader(header); err != nil {
+		return nil, err
+	}
+	hashes := GetHashes(stream.algs)
+	writers := []io.Writer{stream.writer}
+	for _, alg := range stream.algs {
+		writers = append(writers, hashes[alg])
+	}
+	written, err := io.Copy(io.MultiWriter(writers...), reader)
+	if err != nil {
+		return nil, err
+	}
+	if written != header.Size {
+		return nil, fmt.Errorf("copied only %d of %d bytes", written, header.Size)
+	}
+	checksums := make(map[string]string)
+	for _, alg := range stream.algs {
+		checksums[alg] = fmt.Sprintf("%x", hashes[alg].Sum(nil))
+	}
+	return checksums, nil
+}
+
+// addTagFile writes a tag file, manifest or tag manifest, and records
+// its digests in fileMap as a tag file's.
+func (stream *bagStream) addTagFile(fileMap *bagit.FileMap, pathInBag string, contents []byte) error {
+	header := &tar.Header{
+		Name:     pathInBag,
+		Size:     int64(len(contents)),
+		Mode:     0644,
+		ModTime:  time.Now(),
+		Typeflag: tar.TypeReg,
+	}
+	checksums, err := stream.addFile(header, bytes.NewReader(contents))
+	if err != nil {
+		return fmt.Errorf("error adding %s to bag: %w", path.Base(pathInBag), err)
+	}
+	stream.record(fileMap, constants.FileTypeTag, pathInBag, header.Size, checksums)
+	return nil
+}
+
+// record adds a file's size and digests to fileMap, under the file
+// type that the manifests listing it will ask for.
+func (stream *bagStream) record(fileMap *bagit.FileMap, fileType, pathInBag string, size int64, checksums map[string]string) {
+	fileRecord := bagit.NewFileRecord()
+	fileRecord.Size = size
+	for alg, digest := range checksums {
+		fileRecord.AddChecksum(fileType, alg, digest)
+	}
+	fileMap.Files[pathInBag] = fileRecord
+}
+
+// manifestFor returns the contents of the alg manifest of the files in
+// fileMaps, whose digests were recorded as fileType's. The manifest has
+// digests in hashEncoding, and paths relative to the top of the bag.
+func manifestFor(fileType, alg, bagName, hashEncoding string, fileMaps ...*bagit.FileMap) ([]byte, error) {
+	digests := make(map[string]string)
+	for _, fileMap := range fileMaps {
+		for pathInBag, record := range fileMap.Files {
+			checksum := record.GetChecksum(alg, fileType)
+			if checksum == nil {
+				return nil, fmt.Errorf("no %s digest for %s", alg, pathInBag)
+			}
+			digest, err := EncodeDigest(checksum.Digest, hashEncoding)
+			if err != nil {
+				return nil, err
+			}
+			digests[strings.TrimPrefix(pathInBag, bagName+"/")] = digest
+		}
+	}
+	return manifestContents(digests), nil
+}
+
+// setBagInfoAutoValues sets the bag-info.txt tags that the bagger
+// fills in itself, from the payload files.
+func setBagInfoAutoValues(profile *bagit.Profile, payloadFiles *bagit.FileMap) {
+	profile.SetTagValue("bag-info.txt", "Bagging-Date", time.Now().UTC().Format(time.RFC3339))
+	profile.SetTagValue("bag-info.txt", "Bagging-Software", constants.AppVersion)
+	profile.SetTagValue("bag-info.txt", "Payload-Oxum", payloadFiles.Oxum())
+	profile.SetTagValue("bag-info.txt", "Bag-Size", util.ToHumanSize(payloadFiles.TotalBytes(), 1024))
+	profileIdentifier := "http://example.com/unspecified_profile_identifier"
+	if profile.BagItProfileInfo.BagItProfileIdentifier != "" {
+		profileIdentifier = profile.BagItProfileInfo.BagItProfileIdentifier
+	}
+	profile.SetTagValue("bag-info.txt", "BagIt-Profile-Identifier", profileIdentifier)
+}
+
+// singlePassUpload returns true if RunBagCreate can write the bag to
+// OutputFile and upload it in a single pass, with streamBagToS3. That
+// works for tar bags that don't need anything done to them after
+// they're bagged, which validateStream makes sure of for Stream with
+// KeepLocal. RunBagCreate bags and uploads the others in two passes.
+func (opts *BagCreateOptions) singlePassUpload() bool {
+	return opts.UploadHost != "" && opts.Format == BagFormatTar &&
+		!opts.RehashChanged && opts.AfterBagging == nil && !opts.Progress && !opts.TUI &&
+		len(opts.Fetch) == 0 && !opts.KeepEmptyDirs && !opts.Reproducible && opts.PayloadDir == DefaultPayloadDir
+}
+
+// uploadTee writes a bag to a local file and to an upload. If a write
+// to the upload fails, it keeps writing the local file, so the user
+// still gets the bag.
+type uploadTee struct {
+	local     io.Writer
+	upload    io.Writer
+	uploadErr error
+}
+
+func (tee *uploadTee) Write(p []byte) (int, error) {
+	n, err := tee.local.Write(p)
+	if err != nil {
+		return n, err
+	}
+	if tee.uploadErr == nil {
+		_, tee.uploadErr = tee.upload.Write(p)
+	}
+	return n, nil
+}
+
+// streamBagToS3 does the work of RunBagCreate for opts.Stream, and for
+// uploads that can be done in a single pass. It bags files straight
+// into an S3 upload through a pipe. The upload can't finish until we
+// close the pipe, so if anything goes wrong while bagging, we close it
+// with an error, and S3 discards what it has received. That includes
+// files changing while we bag them, since we can't go back and bag
+// them again.
+//
+// If localPath isn't empty, the bag goes to the file at localPath as
+// well, in the same pass, and the pipe isn't closed until that file
+// has been validated, so an invalid bag is never uploaded.
+func streamBagToS3(opts BagCreateOptions, result *BagCreateResult, profile *bagit.Profile, absDirs []string, files []*util.ExtendedFileInfo, localPath string) (*BagCreateResult, error) {
+	ctx, log := opts.Context, opts.Logger
+	bagFiles := files
+	if len(absDirs) > 1 {
+		stageDir, removeStageDir, err := StageBagDirs(absDirs)
+		if err != nil {
+			return nil, bagCreateError(EXIT_RUNTIME_ERR, "Error staging directories to bag: %v", err)
+		}
+		defer removeStageDir()
+		// This can't fail, since files all come from absDirs.
+		bagFiles, _ = StagedFiles(stageDir, absDirs, files)
+	}
+
+	key := opts.UploadKey
+	if key == "" {
+		key = path.Base(result.OutputPath)
+	}
+	uploadTo := opts.UploadHost + "/" + opts.UploadBucket + "/" + key
+	reader, writer := io.Pipe()
+	var out io.Writer = writer
+	var localFile *os.File
+	if localPath != "" {
+		var err error
+		if localFile, err = os.Create(localPath); err != nil {
+			return nil, bagCreateError(EXIT_RUNTIME_ERR, "Error creating bag %s: %v", localPath, err)
+		}
+		out = &uploadTee{local: localFile, upload: writer}
+		log.Debugf("Writing bag %s and uploading it to %s", localPath, uploadTo)
+	} else {
+		log.Debugf("Streaming bag to %s", uploadTo)
+	}
+	var bagger *bagit.Bagger
+	var duplicates [][]string
+	var bagErr error
+	// keepLocal is true if bagErr is about a bag we finished, which we
+	// leave in place so the user can see what's wrong with it.
+	keepLocal := false
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		bagger, bagErr = StreamBag(out, result.OutputPath, profile, bagFiles, opts.HashEncoding)
+		if localFile != nil {
+			if err := localFile.Close(); bagErr == nil {
+				bagErr = err
+			}
+		}
+		if bagErr == nil {
+			if _, changed := FindChangedFiles(files); len(changed) > 0 {
+				lines := append([]string{"The following files changed while they were being bagged, so the bag was not uploaded. Bag them when they're not in use."}, changed...)
+				bagErr = bagCreateError(EXIT_RUNTIME_ERR, "%s", strings.Join(lines, "\n"))
+			}
+		}
+		if bagErr == nil && (opts.ReportDuplicates || opts.FailOnDuplicates) {
+			duplicates = FindDuplicateFiles(bagger.PayloadFiles)
+			if opts.FailOnDuplicates && len(duplicates) > 0 {
+				lines := []string{"Bag was not uploaded because the following sets of files have identical contents:"}
+				for _, set := range duplicates {
+					lines = append(lines, strings.Join(set, ", "))
+				}
+				bagErr = bagCreateError(EXIT_RUNTIME_ERR, "%s", strings.Join(lines, "\n"))
+			}
+		}
+		if bagErr == nil && localPath != "" && (opts.Verify || !opts.SkipValidation) {
+			bagErr = validateBeforeUpload(opts, result, profile, localPath)
+			keepLocal = bagErr != nil
+		}
+		// A nil error closes the pipe normally, which completes the
+		// upload.
+		writer.CloseWithError(bagErr)
+	}()
+	putOptions := minio.PutObjectOptions{PartSize: StreamPartSize}
+	uploadInfo, err := opts.S3Client.PutObject(ctx, opts.UploadBucket, key, reader, -1, putOptions)
+	// If the upload failed first, this stops the bagging, unless we're
+	// writing a local copy, which uploadTee finishes.
+	reader.CloseWithError(fmt.Errorf("upload stopped"))
+	<-done
+	if ctx.Err() != nil {
+		if localPath != "" {
+			os.Remove(localPath)
+		}
+		return nil, &BagCreateError{ExitCode: EXIT_CANCELED, Err: ctx.Err()}
+	}
+	if bagErr != nil {
+		if keepLocal {
+			return result, bagErr
+		}
+		if localPath != "" {
+			os.Remove(localPath)
+		}
+		var bagCreateErr *BagCreateError
+		if !errors.As(bagErr, &bagCreateErr) {
+			bagErr = bagCreateError(EXIT_RUNTIME_ERR, "Error streaming bag to %s: %v", uploadTo, bagErr)
+		}
+		return nil, bagErr
+	}
+	result.Bagger = bagger
+	result.UploadTo = uploadTo
+	result.Streamed = localPath == ""
+	if opts.ReportDuplicates || opts.FailOnDuplicates {
+		result.Duplicates = append([][]string{}, duplicates...)
+	}
+	if err != nil {
+		result.Result = "UploadFailed"
+		if localPath != "" {
+			return result, bagCreateError(EXIT_REQUEST_ERROR, "Bag was created at %s, but upload to %s/%s failed: %v", localPath, opts.UploadHost, opts.UploadBucket, err)
+		}
+		return result, bagCreateError(EXIT_REQUEST_ERROR, "Upload to %s failed: %v", uploadTo, err)
+	}
+	result.ETag = uploadInfo.ETag
+	return result, nil
+}
+
+// validateBeforeUpload validates the bag at pathToTar for
+// streamBagToS3, as RunBagCreate does for bags it uploads in two
+// passes. It returns an error, and sets result's Result and
+// ValidationErrors, if the bag can't be validated or is invalid.
+func validateBeforeUpload(opts BagCreateOptions, result *BagCreateResult, profile *bagit.Profile, pathToTar string) error {
+	opts.Logger.Debugf("Validating bag %s before upload", pathToTar)
+	validator, err := ValidateBagWithPayloadDir(opts.Context, pathToTar, profile, opts.PayloadDir)
+	if err != nil {
+		result.Result = "ValidationFailed"
+		return bagCreateError(EXIT_RUNTIME_ERR, "Bag was created at %s, but it was not uploaded because it can't be validated: %v", pathToTar, err)
+	}
+	if len(validator.Errors) == 0 {
+		return nil
+	}
+	result.ValidationErrors = validator.Errors
+	message, exitCode := "but verification failed", EXIT_RUNTIME_ERR
+	result.Result = "VerifyFailed"
+	if !opts.Verify {
+		message, exitCode = "but it was not uploaded because it is invalid", EXIT_BAG_INVALID
+		result.Result = "Invalid"
+	}
+	lines := []string{fmt.Sprintf("Bag was created at %s, %s due to the following errors:", pathToTar, message)}
+	for key, value := range validator.Errors {
+		lines = append(lines, key+" :  "+value)
+	}
+	return bagCreateError(exitCode, "%s", strings.Join(lines, "\n"))
+}
@@ -0,0 +1,104 @@
+package cmd_test
+
+import (
+	"context"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/APTrust/apt-cmd/cmd"
+	"github.com/APTrust/dart-runner/bagit"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStreamBag(t *testing.T) {
+	opts := newBagCreateOptions(t)
+	opts.ManifestAlgs = []string{"sha256", "sha3-256"}
+	opts.Profile.ManifestsAllowed = append(opts.Profile.ManifestsAllowed, "sha3-256")
+	opts.Profile.TagManifestsAllowed = append(opts.Profile.TagManifestsAllowed, "sha3-256")
+	opts.Tags = append(opts.Tags, &bagit.TagDefinition{TagFile: "bag-info.txt", TagName: "Bagging-Date", UserValue: "2009-04-17"})
+	profile := cmd.PrepareProfile(opts.Profile, opts.ManifestAlgs, opts.Tags)
+	files, _, err := cmd.ListBagDirFiles(opts.BagDirs, cmd.SymlinksSkip)
+	require.Nil(t, err)
+
+	tarPath := path.Join(t.TempDir(), "streamed.tar")
+	out, err := os.Create(tarPath)
+	require.Nil(t, err)
+	bagger, err := cmd.StreamBag(out, tarPath, profile, files, cmd.HashEncodingHexUpper)
+	require.Nil(t, err)
+	require.Nil(t, out.Close())
+	require.NotNil(t, bagger)
+	assert.Equal(t, 2, len(bagger.PayloadFiles.Files))
+	assert.Equal(t, 2, len(bagger.PayloadManifests.Files))
+	assert.Equal(t, 2, len(bagger.TagManifests.Files))
+
+	bagInfo := tarFileContent(t, tarPath, "streamed/bag-info.txt")
+	assert.Contains(t, bagInfo, "Source-Organization: Faber College")
+	assert.Contains(t, bagInfo, "Payload-Oxum: 8.2")
+	assert.Contains(t, bagInfo, "Bagging-Date: 2009-04-17\n")
+	manifest := tarFileContent(t, tarPath, "streamed/manifest-sha256.txt")
+	assert.Contains(t, manifest, "  data/files/file.txt\n")
+	assert.Contains(t, manifest, "3A6EB0790F39AC87C94F3856B2DD2C5D110E6811602261A9A923D3BB23ADC8B7")
+	tagManifest := tarFileContent(t, tarPath, "streamed/tagmanifest-sha3-256.txt")
+	assert.Contains(t, tagManifest, "  manifest-sha256.txt\n")
+	assert.Contains(t, tagManifest, "  bag-info.txt\n")
+
+	validator, err := cmd.ValidateBag(context.Background(), tarPath, profile)
+	require.Nil(t, err)
+	assert.Empty(t, validator.Errors)
+}
+
+func TestRunBagCreate_StreamErrors(t *testing.T) {
+	opts := newBagCreateOptions(t)
+	opts.Stream = true
+	err := opts.Validate()
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), "--stream requires --upload-to")
+
+	opts.UploadHost, opts.UploadBucket = "s3.amazonaws.com", "my-bucket"
+	opts.Format = cmd.BagFormatZip
+	err = opts.Validate()
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), "--format=tar")
+
+	opts.Format = cmd.BagFormatTar
+	opts.Verify = true
+	err = opts.Validate()
+	require.NotNil(t, err)
+	assert.Equal(t, cmd.EXIT_USER_ERR, cmd.BagCreateExitCode(err))
+	assert.Contains(t, err.Error(), "--verify can't be used with --stream")
+
+	// With a local copy, there's something to verify.
+	opts.KeepLocal = true
+	assert.Nil(t, opts.Validate())
+
+	opts.Verify = false
+	opts.KeepLocal = false
+	assert.Nil(t, opts.Validate())
+
+	opts = newBagCreateOptions(t)
+	opts.KeepLocal = true
+	err = opts.Validate()
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), "--keep-local requires --stream")
+
+	opts = newBagCreateOptions(t)
+	opts.UploadKey = "bag.tar"
+	err = opts.Validate()
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), "--upload-key requires --upload-to")
+}
+
+func TestBagCreateResult_JSONStreamed(t *testing.T) {
+	result := &cmd.BagCreateResult{
+		Result:     "OK",
+		OutputPath: "/tmp/bag.tar",
+		UploadTo:   "s3.amazonaws.com/my-bucket/bag.tar",
+		ETag:       "12345",
+		Streamed:   true,
+	}
+	assert.Equal(t, `{ "result": "OK", "uploadTo": "s3.amazonaws.com/my-bucket/bag.tar", "etag": "12345", "streamed": true }`, result.JSON(""))
+	result.Result = "UploadFailed"
+	assert.Equal(t, `{ "result": "UploadFailed", "uploadTo": "s3.amazonaws.com/my-bucket/bag.tar", "streamed": true }`, result.JSON(""))
+}
@@ -1,12 +1,23 @@
 package cmd
 
 import (
+	"archive/tar"
+	"bytes"
+	"context"
 	"embed"
+	"errors"
 	"fmt"
+	"io"
 	"os"
+	"sort"
+	"strings"
+	"unicode/utf8"
 
 	"github.com/APTrust/dart-runner/bagit"
+	"github.com/APTrust/dart-runner/constants"
+	"github.com/APTrust/dart-runner/util"
 	"github.com/spf13/cobra"
+	"golang.org/x/text/encoding/ianaindex"
 )
 
 //go:embed profiles
@@ -14,11 +25,13 @@ var profiles embed.FS
 
 // validateCmd represents the validate command
 var validateCmd = &cobra.Command{
-	Use:   "validate",
-	Short: "Validate a bag using the APTrust, BTR, or empty BagIt profile.",
+	Use:     "validate",
+	Short:   "Validate a bag using the APTrust, BTR, empty, or a custom BagIt profile.",
+	Example: `apt-cmd bag validate --profile=aptrust /path/to/my_bag.tar`,
 	Long: `Validate a bag according to a specific BagIt profile.
-Currently, this supports only tarred bags. The following commands
-validate a bag according to the APTrust BagIt profile:
+This supports tarred bags and unserialized bags, which are plain
+directories. The following commands validate a bag according to the
+APTrust BagIt profile:
 
   apt-cmd bag validate my_bag.tar
   apt-cmd bag validate -p aptrust my_bag.tar
@@ -32,11 +45,114 @@ To validate a bag using the empty profile:
   apt-cmd bag validate -p empty my_bag.tar
 
 The empty profile simply ensures the bag is valid according to the general
-BagIt specification. 
+BagIt specification.
+
+To validate a bag using your own BagIt profile, in DART or bagit-profiles
+JSON format, pass the path to the profile's .json file:
+
+  apt-cmd bag validate -p /path/to/my_profile.json my_bag.tar
+
+In addition to the profile's requirements, the validator checks that
+bagit.txt declares a BagIt-Version the profile accepts, and that the
+bag's tag files really are encoded as bagit.txt's
+Tag-File-Character-Encoding says they are.
+
+Manifest digests may be lowercase hex, uppercase hex, or base64.
+
+Before calculating any checksums, the validator compares the
+Payload-Oxum in bag-info.txt, which gives the payload's size in bytes
+and its number of files, with the files in the bag. That only takes
+the files' sizes, so a bag with missing or extra files fails quickly,
+with an error saying what the payload really holds. A bag without a
+Payload-Oxum is still validated, with a warning on stderr, or in the
+"warnings" field of the --format=json output.
+
+Unserialized bags:
+
+To validate a bag that's a directory on disk, pass the directory
+instead of a tar file:
+
+  apt-cmd bag validate -p btr /path/to/my_bag
+
+The validator reads the directory's manifests and tag files, and
+checksums the files under data/, directly from disk, so there's no need
+to tar the bag first. It runs the same checks as for a tarred bag and
+reports problems the same way. Note that a profile may require bags to
+be serialized. The APTrust profile does, so an APTrust bag that's a
+directory is reported as invalid, with a Serialization error.
+
+You can pass the bag with --file instead of as an argument:
+
+  apt-cmd bag validate --profile=aptrust --file=my_bag.tar
+
+Exit status and output:
+
+bag validate exits with status 0 if the bag is valid, 2 if it's invalid,
+and 3 if it can't run, for example because the profile is missing. By
+default, it prints a line of text saying the bag is valid, or a list of
+errors. Add --format=json to print a JSON object instead, with one entry
+in "errors" for each problem the validator found:
+
+  { "result": "Invalid", "bag": "my_bag.tar", "profile": "aptrust",
+    "errors": [ { "field": "data/photo.jpg", "message": "..." } ] }
+
+Errors are sorted by field. "result" is "OK" for a valid bag, and the
+errors list is empty. With --report-duplicates, the object's
+"duplicates" field lists each set of duplicate files. --format=json
+can't be combined with --compare-with-registry.
+
+Duplicate files:
+
+Add --report-duplicates to list payload files whose contents are
+identical, based on the checksums the validator computes. Each set of
+duplicates is printed on its own line after the validation result. This
+is informational only, unless you add --fail-on-duplicates, which treats
+duplicates as a validation error. Empty files are not reported.
+
+  apt-cmd bag validate --report-duplicates my_bag.tar
+
+Comparing with the registry:
+
+After a bag is ingested, add --compare-with-registry with the object's
+identifier to check that the registry recorded exactly what you sent.
+Once the bag passes validation, this compares the bag's payload files with
+the object's active files in the registry: the number of files, each
+file's size, and each checksum the bag and the registry have in common.
+This catches partial ingests that a work item's status wouldn't reveal.
+It requires the registry settings in your config file, and exits with
+an error listing all discrepancies if the bag and the registry disagree.
+
+  apt-cmd bag validate --compare-with-registry=example.edu/my_bag my_bag.tar
+
+Fetched files:
+
+If the bag has a fetch.txt file, the payload files it lists don't have
+to be in the bag. The validator doesn't report them missing, but it
+can't check their checksums until they're fetched. Every file in
+fetch.txt must be in the payload manifests, and the Payload-Oxum must
+count the files in fetch.txt with the lengths it gives them. If fetch.txt
+gives a file's length as -, the Payload-Oxum isn't checked. The aptrust
+and btr profiles don't allow fetch.txt.
+
+Payload directory:
+
+BagIt bags keep their payload in data/. For a bag made with a different
+payload directory, such as one from bag create --payload-dir, pass the
+directory's name with --payload-dir:
+
+  apt-cmd bag validate -p empty --payload-dir=payload my_bag.tar
+
+The bag is invalid if it also has a data/ directory, or if its payload
+manifests list files outside the payload directory. Errors about
+payload files name them as if they were in data/.
 
 Limitations:
 
-The validator only works with tarred bags and will not validate fetch.txt files.
+The validator works with tarred bags, gzipped tarred bags (.tar.gz or
+.tgz), zipped bags, and directories. It tells them apart by their
+contents, not their names. For any other kind of file, it exits with
+code 3 (EXIT_USER_ERR) and an "unsupported bag format" error, without
+validating anything.
 
 Full online documentation:
 
@@ -45,35 +161,92 @@ https://aptrust.github.io/userguide/partner_tools/
 `,
 	Run: func(cmd *cobra.Command, args []string) {
 		profileName := cmd.Flag("profile").Value.String()
-		pathToBag := ""
+		pathToBag := cmd.Flag("file").Value.String()
 		if len(args) > 0 {
+			if pathToBag != "" && pathToBag != args[0] {
+				Fail(EXIT_USER_ERR, "Pass the bag with --file or as an argument, not both.")
+			}
 			pathToBag = args[0]
 		}
+		format := cmd.Flag("format").Value.String()
+		if !util.StringListContains(ValidateOutputFormats, format) {
+			Failf(EXIT_USER_ERR, "Invalid --format '%s'. Use text or json.", format)
+		}
+		objIdentifier := cmd.Flag("compare-with-registry").Value.String()
+		if format == "json" && objIdentifier != "" {
+			Fail(EXIT_USER_ERR, "--format=json can't be used with --compare-with-registry.")
+		}
 		if profileName == "" || pathToBag == "" {
+			if jsonErrors {
+				ExitWithErrors(EXIT_USER_ERR, "Profile and path to bag are required.")
+			}
 			fmt.Println("Profile and path to bag are required.")
 			os.Exit(EXIT_USER_ERR)
 		}
 		profile, err := LoadProfile(profileName)
 		if err != nil {
-			fmt.Fprintln(os.Stderr, err.Error())
-			os.Exit(EXIT_RUNTIME_ERR)
+			Fail(EXIT_USER_ERR, err.Error())
 		}
 		logger.Debugf("Validating bag %s using profile %s", pathToBag, profile.Name)
-		validator, err := bagit.NewValidator(pathToBag, profile)
-		if err != nil {
-			fmt.Fprintln(os.Stderr, "Can't create validator.", err.Error())
-			os.Exit(EXIT_RUNTIME_ERR)
+		payloadDir := cmd.Flag("payload-dir").Value.String()
+		if err = ValidatePayloadDir(payloadDir); err != nil {
+			Fail(EXIT_USER_ERR, "Invalid --payload-dir:", err)
+		}
+		validator, err := ValidateBagWithPayloadDir(cmd.Context(), pathToBag, profile, payloadDir)
+		if errors.Is(err, ErrUnsupportedBagFormat) {
+			Fail(EXIT_USER_ERR, err.Error())
 		}
-		err = validator.ScanBag()
 		if err != nil {
-			fmt.Println("Bag is invalid due to the following errors:")
-			fmt.Println(err.Error())
-			os.Exit(EXIT_BAG_INVALID)
+			ExitIfCanceled(cmd.Context())
+			Fail(EXIT_RUNTIME_ERR, err.Error())
+		}
+		failOnDuplicates, _ := cmd.Flags().GetBool("fail-on-duplicates")
+		reportDuplicates, _ := cmd.Flags().GetBool("report-duplicates")
+		duplicates := make([][]string, 0)
+		if reportDuplicates || failOnDuplicates {
+			duplicates = FindDuplicateFiles(validator.PayloadFiles)
+		}
+		if failOnDuplicates && len(duplicates) > 0 {
+			validator.Errors["Duplicate files"] = fmt.Sprintf("Bag contains %d sets of duplicate files: %s", len(duplicates), formatDuplicates(duplicates))
 		}
-		if validator.Validate() {
+		warnings := ValidationWarnings(validator)
+		if format == "json" {
+			result := NewBagValidationResult(pathToBag, profileName, validator.Errors, duplicates)
+			result.Warnings = warnings
+			printResult(result)
+			if len(validator.Errors) > 0 {
+				os.Exit(EXIT_BAG_INVALID)
+			}
+			os.Exit(EXIT_OK)
+		}
+		for _, warning := range warnings {
+			fmt.Fprintln(os.Stderr, "Warning:", warning)
+		}
+		if len(validator.Errors) == 0 {
 			fmt.Println("Bag is valid according to", profileName, "profile.")
+			if len(duplicates) > 0 {
+				fmt.Println("Duplicate files:")
+				for _, set := range duplicates {
+					fmt.Println(strings.Join(set, ", "))
+				}
+			}
+			if objIdentifier != "" {
+				compareBagWithRegistry(cmd, validator, objIdentifier)
+			}
 			os.Exit(EXIT_OK)
 		}
+		if jsonErrors {
+			keys := make([]string, 0, len(validator.Errors))
+			for key := range validator.Errors {
+				keys = append(keys, key)
+			}
+			sort.Strings(keys)
+			errs := make([]string, len(keys))
+			for i, key := range keys {
+				errs[i] = key + ": " + validator.Errors[key]
+			}
+			ExitWithErrors(EXIT_BAG_INVALID, errs...)
+		}
 		fmt.Println("Bag is invalid due to the following errors:")
 		for key, value := range validator.Errors {
 			fmt.Println(key, ": ", value)
@@ -84,5 +257,345 @@ https://aptrust.github.io/userguide/partner_tools/
 
 func init() {
 	bagCmd.AddCommand(validateCmd)
-	validateCmd.Flags().StringP("profile", "p", "", "BagIt profile: 'aptrust', 'btr' or 'empty'")
+	validateCmd.Flags().StringP("profile", "p", "", "BagIt profile: 'aptrust', 'btr', 'empty', or the path to a .json profile")
+	validateCmd.Flags().StringP("file", "f", "", "Path to the tarred bag or bag directory to validate, if you don't pass it as an argument")
+	validateCmd.Flags().String("format", "text", "Output format: 'text' or 'json'")
+	validateCmd.Flags().Bool("report-duplicates", false, "List payload files with identical contents")
+	validateCmd.Flags().Bool("fail-on-duplicates", false, "Treat payload files with identical contents as a validation error")
+	validateCmd.Flags().String("payload-dir", DefaultPayloadDir, "Name of the bag's payload directory, if it isn't data")
+	validateCmd.Flags().String("compare-with-registry", "", "Identifier of the ingested object to compare with this bag, e.g. example.edu/my_bag")
+	registerFlagCompletion(validateCmd, "profile", completeProfile)
+	registerFlagCompletion(validateCmd, "format", completeValues(ValidateOutputFormats...))
+}
+
+// BagValidationError describes one problem that bag validate found.
+// Field is the validator's name for the part of the bag with the
+// problem, such as a file path or tag name.
+type BagValidationError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// BagValidationResult is what bag validate prints for --format=json.
+// Result is "OK" or "Invalid". Warnings, from ValidationWarnings, don't
+// make the bag invalid.
+type BagValidationResult struct {
+	Result     string               `json:"result"`
+	Bag        string               `json:"bag"`
+	Profile    string               `json:"profile"`
+	Errors     []BagValidationError `json:"errors"`
+	Warnings   []string             `json:"warnings,omitempty"`
+	Duplicates [][]string           `json:"duplicates,omitempty"`
+}
+
+// NewBagValidationResult returns the result of validating the bag at
+// pathToBag with profileName, given the validator's errors. The errors
+// are sorted by field, so the output is the same every time.
+func NewBagValidationResult(pathToBag, profileName string, errors map[string]string, duplicates [][]string) *BagValidationResult {
+	result := &BagValidationResult{
+		Result:     "OK",
+		Bag:        pathToBag,
+		Profile:    profileName,
+		Errors:     make([]BagValidationError, 0, len(errors)),
+		Duplicates: duplicates,
+	}
+	for field, message := range errors {
+		result.Errors = append(result.Errors, BagValidationError{Field: field, Message: message})
+	}
+	sort.Slice(result.Errors, func(i, j int) bool { return result.Errors[i].Field < result.Errors[j].Field })
+	if len(result.Errors) > 0 {
+		result.Result = "Invalid"
+	}
+	return result
+}
+
+// ValidateBag runs full validation on the bag at pathToBag: the
+// profile's requirements, the manifests, and the BagIt declarations in
+// bagit.txt. The bag may be a tar file, a gzipped tar file, a zip
+// file or a directory. It returns the validator, whose Errors are empty
+// if the bag is valid. It returns an error only if it can't run the
+// validator or read the tag files, if ctx is canceled during
+// validation, or if the bag is in none of those formats, in which case
+// the error wraps ErrUnsupportedBagFormat.
+func ValidateBag(ctx context.Context, pathToBag string, profile *bagit.Profile) (*bagit.Validator, error) {
+	return ValidateBagWithPayloadDir(ctx, pathToBag, profile, DefaultPayloadDir)
+}
+
+// ValidateBagWithPayloadDir is ValidateBag for a bag whose payload is
+// in payloadDir instead of data. The bag is invalid if it has a data
+// directory as well, or if its payload manifests list files outside
+// payloadDir. Errors about payload files name them as if they were in
+// data/, as the bagit validator sees them.
+func ValidateBagWithPayloadDir(ctx context.Context, pathToBag string, profile *bagit.Profile, payloadDir string) (*bagit.Validator, error) {
+	format, err := DetectBagFormat(pathToBag)
+	if err != nil {
+		return nil, err
+	}
+	validator, err := bagit.NewValidator(pathToBag, profile)
+	if err != nil {
+		return nil, fmt.Errorf("can't create validator: %w", err)
+	}
+	// Our reader handles directories, gzipped tar files, zip files, and
+	// the manifest algorithms the validator's tarred bag reader doesn't.
+	reader := NewTarredBagReader(validator)
+	if format == BagFormatDirectory {
+		reader = NewDirectoryBagReader(validator)
+	}
+	reader.PayloadDir = payloadDir
+	if err = reader.ScanBag(); err != nil {
+		validator.Errors["Bag"] = err.Error()
+		return validator, nil
+	}
+	// Accept uppercase hex and base64 digests.
+	NormalizeManifestDigests(validator)
+	acceptFetchedFiles(validator, reader.Fetched)
+	isValid := false
+	if err = RunCancelable(ctx, func() { isValid = validator.Validate() }); err != nil {
+		return nil, fmt.Errorf("validation canceled: %w", err)
+	}
+	if validator.TagFiles.Files[FetchTxtFile] != nil && !profile.AllowFetchTxt {
+		validator.Errors[FetchTxtFile] = "Profile does not allow fetch.txt"
+	}
+	if reader.FetchedLengthUnknown {
+		// We can't count bytes we don't have.
+		delete(validator.Errors, "Payload-Oxum")
+		isValid = len(validator.Errors) == 0
+	}
+	declarationErrors, err := validateBagItDeclarations(pathToBag, profile, payloadDir)
+	if err != nil {
+		return nil, fmt.Errorf("can't read tag files: %w", err)
+	}
+	for key, value := range declarationErrors {
+		validator.Errors[key] = value
+	}
+	if !isValid && len(validator.Errors) == 0 {
+		validator.Errors["Bag"] = "Validation failed"
+	}
+	return validator, nil
+}
+
+// ValidationWarnings returns problems with a validated bag that don't
+// make it invalid, such as a missing Payload-Oxum, without which
+// validation can't quickly catch missing or extra files.
+func ValidationWarnings(validator *bagit.Validator) []string {
+	warnings := make([]string, 0)
+	if len(validator.GetTags("bag-info.txt", "Payload-Oxum")) == 0 {
+		warnings = append(warnings, "bag-info.txt has no Payload-Oxum, so the payload's size and file count weren't checked before its checksums.")
+	}
+	return warnings
+}
+
+// compareBagWithRegistry compares a valid bag's payload files with the
+// registry's record of the ingested object and prints the result. It
+// exits with EXIT_BAG_INVALID if they don't match.
+func compareBagWithRegistry(cmd *cobra.Command, validator *bagit.Validator, objIdentifier string) {
+	client, err := NewRegistryClient(config)
+	if err != nil {
+		Fail(EXIT_USER_ERR, "Error getting Registry client:", err)
+	}
+	logger.Debugf("Comparing bag %s with registry object %s", validator.PathToBag, objIdentifier)
+	registryFiles, err := FetchRegistryFiles(cmd.Context(), client, objIdentifier)
+	if err != nil {
+		ExitIfCanceled(cmd.Context())
+		Fail(EXIT_REQUEST_ERROR, err.Error())
+	}
+	discrepancies := CompareWithRegistry(validator.PayloadFiles, registryFiles)
+	if len(discrepancies) > 0 {
+		if jsonErrors {
+			ExitWithErrors(EXIT_BAG_INVALID, discrepancies...)
+		}
+		fmt.Println("Bag does not match registry object", objIdentifier, "due to the following discrepancies:")
+		for _, discrepancy := range discrepancies {
+			fmt.Println(discrepancy)
+		}
+		os.Exit(EXIT_BAG_INVALID)
+	}
+	fmt.Printf("Bag matches registry object %s: %d payload files with matching sizes and checksums.\n", objIdentifier, len(validator.PayloadFiles.Files))
+}
+
+// FindDuplicateFiles returns sets of payload files in fileMap that have
+// identical contents, based on the checksums computed from the files
+// themselves, rather than the checksums in the manifests. Each set is
+// sorted, and the sets are sorted by their first path. Paths are relative
+// to the bag, as in the manifests. Empty files aren't included, since
+// they don't waste any space.
+func FindDuplicateFiles(fileMap *bagit.FileMap) [][]string {
+	sets := make(map[string][]string)
+	for name, record := range fileMap.Files {
+		if record.Size == 0 {
+			continue
+		}
+		key := ""
+		for _, alg := range constants.PreferredAlgsInOrder {
+			if checksum := record.GetChecksum(alg, constants.FileTypePayload); checksum != nil {
+				key = fmt.Sprintf("%s:%d:%s", alg, record.Size, checksum.Digest)
+				break
+			}
+		}
+		if key == "" {
+			continue
+		}
+		// The bagger's paths include the bag name as the top-level
+		// directory. The validator's don't.
+		if !strings.HasPrefix(name, "data/") {
+			if pathInBag, err := util.TarPathToBagPath(name); err == nil {
+				name = pathInBag
+			}
+		}
+		sets[key] = append(sets[key], name)
+	}
+	duplicates := make([][]string, 0)
+	for _, set := range sets {
+		if len(set) > 1 {
+			sort.Strings(set)
+			duplicates = append(duplicates, set)
+		}
+	}
+	sort.Slice(duplicates, func(i, j int) bool { return duplicates[i][0] < duplicates[j][0] })
+	return duplicates
+}
+
+// formatDuplicates returns duplicate sets as a single line of text,
+// with each set in parentheses.
+func formatDuplicates(duplicates [][]string) string {
+	sets := make([]string, len(duplicates))
+	for i, set := range duplicates {
+		sets[i] = "(" + strings.Join(set, ", ") + ")"
+	}
+	return strings.Join(sets, " ")
+}
+
+// ValidateBagItDeclarations checks that the bagit.txt file in the tarred
+// bag at pathToBag declares a BagIt-Version accepted by the profile, and
+// that the bag's tag files are actually encoded in the declared
+// Tag-File-Character-Encoding. Per the BagIt spec, bagit.txt itself must
+// always be UTF-8. The bagit validator checks checksums and tag values,
+// but not the bytes of the tag files, so a bag can pass that validation
+// and still be non-conformant.
+//
+// This returns a map of errors, with tag file names or tag names as keys.
+// The error return value is for problems reading the bag.
+func ValidateBagItDeclarations(pathToBag string, profile *bagit.Profile) (map[string]string, error) {
+	return validateBagItDeclarations(pathToBag, profile, DefaultPayloadDir)
+}
+
+func validateBagItDeclarations(pathToBag string, profile *bagit.Profile, payloadDir string) (map[string]string, error) {
+	errors := make(map[string]string)
+	tagFiles, err := readTagFiles(pathToBag, payloadDir)
+	if err != nil {
+		return nil, err
+	}
+	bagitTxt, ok := tagFiles["bagit.txt"]
+	if !ok {
+		errors["bagit.txt"] = "File bagit.txt is missing."
+		return errors, nil
+	}
+	tags, err := bagit.ParseTagFile(bytes.NewReader(bagitTxt), "bagit.txt")
+	if err != nil {
+		errors["bagit.txt"] = err.Error()
+		return errors, nil
+	}
+	version := ""
+	encodingName := ""
+	for _, tag := range tags {
+		if strings.EqualFold(tag.TagName, "BagIt-Version") {
+			version = tag.Value
+		} else if strings.EqualFold(tag.TagName, "Tag-File-Character-Encoding") {
+			encodingName = tag.Value
+		}
+	}
+	if version == "" {
+		errors["bagit.txt/BagIt-Version"] = "bagit.txt does not declare a BagIt-Version."
+	} else if !util.StringListContains(profile.AcceptBagItVersion, version) {
+		errors["bagit.txt/BagIt-Version"] = fmt.Sprintf("BagIt-Version %s is not supported. Supported versions are: %s.", version, strings.Join(profile.AcceptBagItVersion, ","))
+	}
+	if !looksLikeEncoding(bagitTxt, "UTF-8") {
+		errors["bagit.txt"] = "File bagit.txt must be encoded as UTF-8."
+	}
+	if encodingName == "" {
+		errors["bagit.txt/Tag-File-Character-Encoding"] = "bagit.txt does not declare a Tag-File-Character-Encoding."
+		return errors, nil
+	}
+	if !isKnownEncoding(encodingName) {
+		errors["bagit.txt/Tag-File-Character-Encoding"] = fmt.Sprintf("Tag-File-Character-Encoding %s is not a recognized character encoding.", encodingName)
+		return errors, nil
+	}
+	for name, data := range tagFiles {
+		if name == "bagit.txt" {
+			continue
+		}
+		if !looksLikeEncoding(data, encodingName) {
+			errors[name] = fmt.Sprintf("Contents of %s do not match declared Tag-File-Character-Encoding %s.", name, encodingName)
+		}
+	}
+	return errors, nil
+}
+
+// readTagFiles returns the contents of all tag files in a tarred,
+// gzipped tar, zipped or unserialized bag, keyed by their paths within
+// the bag. It skips the files in the payload directory, payloadDir,
+// which is usually data.
+func readTagFiles(pathToBag, payloadDir string) (map[string][]byte, error) {
+	if util.IsDirectory(pathToBag) {
+		return readDirectoryTagFiles(pathToBag, payloadDir)
+	}
+	tagFiles := make(map[string][]byte)
+	err := walkArchiveEntries(pathToBag, func(entry *archiveEntry, reader io.Reader) error {
+		if entry.Typeflag != tar.TypeReg {
+			return nil
+		}
+		pathInBag, err := util.TarPathToBagPath(entry.Name)
+		if err != nil {
+			return err
+		}
+		if _, isPayload := inPayloadDir(pathInBag, payloadDir); isPayload || util.BagFileType(pathInBag) != constants.FileTypeTag {
+			return nil
+		}
+		data, err := io.ReadAll(reader)
+		if err != nil {
+			return err
+		}
+		tagFiles[pathInBag] = data
+		return nil
+	})
+	return tagFiles, err
+}
+
+// isKnownEncoding returns true if name is an IANA character set name
+// that we know how to decode.
+func isKnownEncoding(name string) bool {
+	switch normalizeEncodingName(name) {
+	case "UTF8", "ASCII", "USASCII":
+		return true
+	}
+	enc, err := ianaindex.IANA.Encoding(name)
+	return err == nil && enc != nil
+}
+
+// looksLikeEncoding returns true if data is valid in the named
+// character encoding. For single-byte encodings like ISO-8859-1,
+// almost any data is valid, so this mostly catches UTF-8 and ASCII
+// declarations on files that contain something else.
+func looksLikeEncoding(data []byte, name string) bool {
+	switch normalizeEncodingName(name) {
+	case "UTF8":
+		return utf8.Valid(data)
+	case "ASCII", "USASCII":
+		for _, b := range data {
+			if b > 0x7f {
+				return false
+			}
+		}
+		return true
+	}
+	enc, err := ianaindex.IANA.Encoding(name)
+	if err != nil || enc == nil {
+		return false
+	}
+	decoded, err := enc.NewDecoder().Bytes(data)
+	return err == nil && !bytes.ContainsRune(decoded, utf8.RuneError)
+}
+
+func normalizeEncodingName(name string) string {
+	return strings.ToUpper(strings.ReplaceAll(name, "-", ""))
 }
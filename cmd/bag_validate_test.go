@@ -0,0 +1,334 @@
+package cmd_test
+
+import (
+	"archive/tar"
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/APTrust/apt-cmd/cmd"
+	"github.com/APTrust/dart-runner/bagit"
+	"github.com/APTrust/dart-runner/constants"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeTestTar writes a minimal tarred bag containing the
+// specified tag files and returns the path to the tar file.
+func writeTestTar(t *testing.T, files map[string]string) string {
+	pathToTar := path.Join(t.TempDir(), "test_bag.tar")
+	file, err := os.Create(pathToTar)
+	require.Nil(t, err)
+	defer file.Close()
+	writer := tar.NewWriter(file)
+	for name, contents := range files {
+		header := &tar.Header{
+			Name:     "test_bag/" + name,
+			Mode:     0644,
+			Size:     int64(len(contents)),
+			Typeflag: tar.TypeReg,
+		}
+		require.Nil(t, writer.WriteHeader(header))
+		_, err = writer.Write([]byte(contents))
+		require.Nil(t, err)
+	}
+	require.Nil(t, writer.Close())
+	return pathToTar
+}
+
+func TestValidateBagItDeclarations(t *testing.T) {
+	profile, err := cmd.LoadProfile("aptrust")
+	require.Nil(t, err)
+
+	// Existing good bags should pass.
+	for _, bag := range []string{"example.edu.sample_good.tar", "example.edu.tagsample_good.tar"} {
+		errors, err := cmd.ValidateBagItDeclarations(path.Join("..", "testbags", "aptrust", bag), profile)
+		require.Nil(t, err)
+		assert.Empty(t, errors, bag)
+	}
+
+	// Declared UTF-8, but bag-info.txt is Latin-1
+	pathToTar := writeTestTar(t, map[string]string{
+		"bagit.txt":     "BagIt-Version: 1.0\nTag-File-Character-Encoding: UTF-8\n",
+		"bag-info.txt":  "Source-Organization: Universit\xe9 de Montr\xe9al\n",
+		"data/file.txt": "Payload encoding doesn't matter: \xff\xfe",
+	})
+	errors, err := cmd.ValidateBagItDeclarations(pathToTar, profile)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(errors))
+	assert.Equal(t, "Contents of bag-info.txt do not match declared Tag-File-Character-Encoding UTF-8.", errors["bag-info.txt"])
+
+	// Same content is fine if we declare ISO-8859-1
+	pathToTar = writeTestTar(t, map[string]string{
+		"bagit.txt":    "BagIt-Version: 1.0\nTag-File-Character-Encoding: ISO-8859-1\n",
+		"bag-info.txt": "Source-Organization: Universit\xe9 de Montr\xe9al\n",
+	})
+	errors, err = cmd.ValidateBagItDeclarations(pathToTar, profile)
+	require.Nil(t, err)
+	assert.Empty(t, errors)
+
+	// Declared ASCII, but contains UTF-8
+	pathToTar = writeTestTar(t, map[string]string{
+		"bagit.txt":        "BagIt-Version: 1.0\nTag-File-Character-Encoding: US-ASCII\n",
+		"aptrust-info.txt": "Title: Café Photos\n",
+	})
+	errors, err = cmd.ValidateBagItDeclarations(pathToTar, profile)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(errors))
+	assert.Contains(t, errors["aptrust-info.txt"], "do not match declared Tag-File-Character-Encoding US-ASCII")
+
+	// Unsupported version and unknown encoding
+	pathToTar = writeTestTar(t, map[string]string{
+		"bagit.txt": "BagIt-Version: 0.96\nTag-File-Character-Encoding: Klingon\n",
+	})
+	errors, err = cmd.ValidateBagItDeclarations(pathToTar, profile)
+	require.Nil(t, err)
+	require.Equal(t, 2, len(errors))
+	assert.Equal(t, "BagIt-Version 0.96 is not supported. Supported versions are: 0.97,1.0.", errors["bagit.txt/BagIt-Version"])
+	assert.Equal(t, "Tag-File-Character-Encoding Klingon is not a recognized character encoding.", errors["bagit.txt/Tag-File-Character-Encoding"])
+
+	// Missing declarations
+	pathToTar = writeTestTar(t, map[string]string{
+		"bagit.txt": "\n",
+	})
+	errors, err = cmd.ValidateBagItDeclarations(pathToTar, profile)
+	require.Nil(t, err)
+	require.Equal(t, 2, len(errors))
+	assert.Contains(t, errors["bagit.txt/BagIt-Version"], "does not declare")
+	assert.Contains(t, errors["bagit.txt/Tag-File-Character-Encoding"], "does not declare")
+
+	// Missing bagit.txt
+	pathToTar = writeTestTar(t, map[string]string{
+		"bag-info.txt": "Source-Organization: Faber College\n",
+	})
+	errors, err = cmd.ValidateBagItDeclarations(pathToTar, profile)
+	require.Nil(t, err)
+	assert.Equal(t, "File bagit.txt is missing.", errors["bagit.txt"])
+}
+
+func TestFindDuplicateFiles(t *testing.T) {
+	fileMap := bagit.NewFileMap(constants.FileTypePayload)
+	addFile := func(name string, size int64, sha256, md5 string) {
+		record := bagit.NewFileRecord()
+		record.Size = size
+		record.AddChecksum(constants.FileTypePayload, constants.AlgSha256, sha256)
+		record.AddChecksum(constants.FileTypePayload, constants.AlgMd5, md5)
+		// Manifest checksums don't count.
+		record.AddChecksum(constants.FileTypeManifest, constants.AlgSha256, "manifest")
+		fileMap.Files[name] = record
+	}
+	// Bagger paths start with the bag name.
+	addFile("my_bag/data/photos/b.jpg", 100, "aaa", "111")
+	addFile("my_bag/data/a.jpg", 100, "aaa", "111")
+	addFile("my_bag/data/c.jpg", 100, "aaa", "111")
+	addFile("my_bag/data/unique.jpg", 100, "bbb", "222")
+	addFile("my_bag/data/copy1.txt", 10, "ccc", "333")
+	addFile("my_bag/data/copy2.txt", 10, "ccc", "333")
+	addFile("my_bag/data/empty1.txt", 0, "ddd", "444")
+	addFile("my_bag/data/empty2.txt", 0, "ddd", "444")
+	// Same md5, different sha256, so not duplicates.
+	addFile("my_bag/data/collision.jpg", 100, "eee", "111")
+
+	expected := [][]string{
+		{"data/a.jpg", "data/c.jpg", "data/photos/b.jpg"},
+		{"data/copy1.txt", "data/copy2.txt"},
+	}
+	assert.Equal(t, expected, cmd.FindDuplicateFiles(fileMap))
+
+	// Validator paths don't start with the bag name.
+	fileMap = bagit.NewFileMap(constants.FileTypePayload)
+	addFile("data/one.txt", 10, "ccc", "333")
+	addFile("data/two.txt", 10, "ccc", "333")
+	assert.Equal(t, [][]string{{"data/one.txt", "data/two.txt"}}, cmd.FindDuplicateFiles(fileMap))
+
+	assert.Empty(t, cmd.FindDuplicateFiles(bagit.NewFileMap(constants.FileTypePayload)))
+}
+
+func TestValidateBag(t *testing.T) {
+	profile, err := cmd.LoadProfile("btr")
+	require.Nil(t, err)
+
+	validator, err := cmd.ValidateBag(context.Background(), path.Join("..", "testbags", "btr", "test.edu.btr_good_sha256.tar"), profile)
+	require.Nil(t, err)
+	assert.Empty(t, validator.Errors)
+
+	validator, err = cmd.ValidateBag(context.Background(), path.Join("..", "testbags", "btr", "test.edu.btr_bad_checksums.tar"), profile)
+	require.Nil(t, err)
+	assert.NotEmpty(t, validator.Errors)
+}
+
+func TestValidateBag_Gzipped(t *testing.T) {
+	profile, err := cmd.LoadProfile("btr")
+	require.Nil(t, err)
+	for _, bagName := range []string{"test.edu.btr_good_sha256", "test.edu.btr_bad_checksums"} {
+		pathToTar := path.Join("..", "testbags", "btr", bagName+".tar")
+		pathToTgz := path.Join(t.TempDir(), bagName+".tar.gz")
+		require.Nil(t, cmd.GzipTar(pathToTar, pathToTgz, 6))
+		format, err := cmd.DetectBagFormat(pathToTgz)
+		require.Nil(t, err)
+		assert.Equal(t, cmd.BagFormatTgz, format)
+
+		// The gzipped bag gets the same errors as the tar file.
+		tarValidator, err := cmd.ValidateBag(context.Background(), pathToTar, bagit.CloneProfile(profile))
+		require.Nil(t, err, bagName)
+		tgzValidator, err := cmd.ValidateBag(context.Background(), pathToTgz, bagit.CloneProfile(profile))
+		require.Nil(t, err, bagName)
+		assert.Equal(t, tarValidator.Errors, tgzValidator.Errors, bagName)
+		assert.Equal(t, len(tarValidator.PayloadFiles.Files), len(tgzValidator.PayloadFiles.Files), bagName)
+	}
+}
+
+func TestValidateBag_Zipped(t *testing.T) {
+	profile, err := cmd.LoadProfile("btr")
+	require.Nil(t, err)
+	for _, bagName := range []string{"test.edu.btr_good_sha256", "test.edu.btr_bad_checksums"} {
+		pathToTar := path.Join("..", "testbags", "btr", bagName+".tar")
+		pathToZip := path.Join(t.TempDir(), bagName+".zip")
+		require.Nil(t, cmd.ZipTar(pathToTar, pathToZip))
+		format, err := cmd.DetectBagFormat(pathToZip)
+		require.Nil(t, err)
+		assert.Equal(t, cmd.BagFormatZip, format)
+
+		// The zipped bag gets the same errors as the tar file.
+		tarValidator, err := cmd.ValidateBag(context.Background(), pathToTar, bagit.CloneProfile(profile))
+		require.Nil(t, err, bagName)
+		zipValidator, err := cmd.ValidateBag(context.Background(), pathToZip, bagit.CloneProfile(profile))
+		require.Nil(t, err, bagName)
+		assert.Equal(t, tarValidator.Errors, zipValidator.Errors, bagName)
+		assert.Equal(t, len(tarValidator.PayloadFiles.Files), len(zipValidator.PayloadFiles.Files), bagName)
+	}
+}
+
+func TestValidateBag_UnsupportedFormat(t *testing.T) {
+	profile, err := cmd.LoadProfile("empty")
+	require.Nil(t, err)
+	pathToBag := path.Join(t.TempDir(), "bag.rar")
+	require.Nil(t, os.WriteFile(pathToBag, []byte(strings.Repeat("not a bag ", 100)), 0644))
+	_, err = cmd.DetectBagFormat(pathToBag)
+	assert.ErrorIs(t, err, cmd.ErrUnsupportedBagFormat)
+	_, err = cmd.ValidateBag(context.Background(), pathToBag, profile)
+	assert.ErrorIs(t, err, cmd.ErrUnsupportedBagFormat)
+
+	exitCode, _, stderr := execCmd(t, "go", "run", "../main.go", "bag", "validate", "--profile=empty", pathToBag)
+	assert.NotEqual(t, 0, exitCode)
+	assert.Contains(t, stderr, "is not a directory, tar file, gzipped tar file or zip file")
+	assert.Contains(t, stderr, fmt.Sprintf("exit status %d", cmd.EXIT_USER_ERR))
+}
+
+func TestNewBagValidationResult(t *testing.T) {
+	result := cmd.NewBagValidationResult("my_bag.tar", "empty", map[string]string{}, nil)
+	assert.Equal(t, "OK", result.Result)
+	assert.NotNil(t, result.Errors)
+	assert.Empty(t, result.Errors)
+
+	errors := map[string]string{
+		"data/photo.jpg": "Digest does not match",
+		"Payload-Oxum":   "Payload-Oxum does not match payload",
+	}
+	result = cmd.NewBagValidationResult("my_bag.tar", "aptrust", errors, [][]string{{"data/a.txt", "data/b.txt"}})
+	assert.Equal(t, "Invalid", result.Result)
+	assert.Equal(t, "my_bag.tar", result.Bag)
+	assert.Equal(t, "aptrust", result.Profile)
+	assert.Equal(t, []cmd.BagValidationError{
+		{Field: "Payload-Oxum", Message: "Payload-Oxum does not match payload"},
+		{Field: "data/photo.jpg", Message: "Digest does not match"},
+	}, result.Errors)
+	assert.Equal(t, [][]string{{"data/a.txt", "data/b.txt"}}, result.Duplicates)
+}
+
+func TestValidateBag_Directory(t *testing.T) {
+	profile, err := cmd.LoadProfile("btr")
+	require.Nil(t, err)
+	bagNames := []string{
+		"test.edu.btr_good_sha256",
+		"test.edu.btr_good_sha512",
+		"test.edu.btr_bad_checksums",
+		"test.edu.btr_bad_extraneous_file",
+		"test.edu.btr_bad_missing_payload_file",
+		"test.edu.btr_bad_missing_required_tags",
+	}
+	for _, bagName := range bagNames {
+		pathToTar := path.Join("..", "testbags", "btr", bagName+".tar")
+		destDir := t.TempDir()
+		require.Nil(t, cmd.ExtractTar(pathToTar, destDir), bagName)
+		entries, err := os.ReadDir(destDir)
+		require.Nil(t, err)
+		require.Len(t, entries, 1, bagName)
+		pathToDir := path.Join(destDir, entries[0].Name())
+
+		// Both kinds of bag get the same errors.
+		tarValidator, err := cmd.ValidateBag(context.Background(), pathToTar, bagit.CloneProfile(profile))
+		require.Nil(t, err, bagName)
+		dirValidator, err := cmd.ValidateBag(context.Background(), pathToDir, bagit.CloneProfile(profile))
+		require.Nil(t, err, bagName)
+		assert.Equal(t, tarValidator.Errors, dirValidator.Errors, bagName)
+		assert.Equal(t, len(tarValidator.PayloadFiles.Files), len(dirValidator.PayloadFiles.Files), bagName)
+		if strings.Contains(bagName, "good") {
+			assert.Empty(t, dirValidator.Errors, bagName)
+		} else {
+			assert.NotEmpty(t, dirValidator.Errors, bagName)
+		}
+	}
+}
+
+func TestValidateBag_DirectoryChangedPayload(t *testing.T) {
+	profile, err := cmd.LoadProfile("btr")
+	require.Nil(t, err)
+	destDir := t.TempDir()
+	require.Nil(t, cmd.ExtractTar(path.Join("..", "testbags", "btr", "test.edu.btr_good_sha256.tar"), destDir))
+	entries, err := os.ReadDir(destDir)
+	require.Nil(t, err)
+	pathToDir := path.Join(destDir, entries[0].Name())
+
+	// Change a payload file without changing its size, so the
+	// Payload-Oxum still matches and only the checksum catches it.
+	var payloadFile string
+	err = filepath.Walk(path.Join(pathToDir, "data"), func(filePath string, info os.FileInfo, err error) error {
+		if err == nil && payloadFile == "" && info.Mode().IsRegular() && info.Size() > 0 {
+			payloadFile = filePath
+		}
+		return err
+	})
+	require.Nil(t, err)
+	require.NotEmpty(t, payloadFile)
+	data, err := os.ReadFile(payloadFile)
+	require.Nil(t, err)
+	data[0] ^= 0xff
+	require.Nil(t, os.WriteFile(payloadFile, data, 0644))
+
+	validator, err := cmd.ValidateBag(context.Background(), pathToDir, profile)
+	require.Nil(t, err)
+	relPath, _ := filepath.Rel(pathToDir, payloadFile)
+	assert.Contains(t, validator.Errors, filepath.ToSlash(relPath))
+}
+
+func TestValidateBag_PayloadOxum(t *testing.T) {
+	opts := newBagCreateOptions(t)
+	opts.Format = cmd.BagFormatDirectory
+	created, err := cmd.RunBagCreate(opts)
+	require.Nil(t, err, err)
+	bagDir := created.OutputPath
+	require.Nil(t, os.WriteFile(path.Join(bagDir, "data", "extra.txt"), []byte("extra"), 0644))
+
+	// The Payload-Oxum fails the bag before any checksums are calculated.
+	validator, err := cmd.ValidateBag(context.Background(), bagDir, opts.Profile)
+	require.Nil(t, err)
+	assert.Equal(t, "Payload-Oxum does not match payload: bag-info.txt says 8.2, but the payload has 13 bytes in 3 files", validator.Errors["Payload-Oxum"])
+	assert.Nil(t, validator.PayloadFiles.Files["data/files/file.txt"].GetChecksum("md5", constants.FileTypePayload))
+	assert.Empty(t, cmd.ValidationWarnings(validator))
+
+	// Without a Payload-Oxum, validation goes on, with a warning.
+	bagInfoPath := path.Join(bagDir, "bag-info.txt")
+	bagInfo, err := os.ReadFile(bagInfoPath)
+	require.Nil(t, err)
+	require.Nil(t, os.WriteFile(bagInfoPath, []byte(strings.Replace(string(bagInfo), "Payload-Oxum: 8.2\n", "", 1)), 0644))
+	validator, err = cmd.ValidateBag(context.Background(), bagDir, opts.Profile)
+	require.Nil(t, err)
+	assert.Empty(t, validator.Errors["Payload-Oxum"])
+	assert.NotNil(t, validator.PayloadFiles.Files["data/files/file.txt"].GetChecksum("md5", constants.FileTypePayload))
+	assert.Equal(t, []string{"bag-info.txt has no Payload-Oxum, so the payload's size and file count weren't checked before its checksums."}, cmd.ValidationWarnings(validator))
+}
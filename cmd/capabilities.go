@@ -0,0 +1,82 @@
+package cmd
+
+import (
+	"os"
+	"sort"
+
+	"github.com/APTrust/dart-runner/util"
+	"github.com/spf13/cobra"
+)
+
+// Capabilities describes what this build of apt-cmd can do.
+// Serializations are the values of bag create's --format, and
+// OutputFormats the values of the other commands' --format flags.
+// Tools that wrap apt-cmd can use this to build valid command
+// lines without hardcoding lists that change from release to
+// release.
+type Capabilities struct {
+	Version            string   `json:"version"`
+	Profiles           []string `json:"profiles"`
+	ManifestAlgorithms []string `json:"manifestAlgorithms"`
+	Serializations     []string `json:"serializations"`
+	Compression        []string `json:"compression"`
+	OutputFormats      []string `json:"outputFormats"`
+}
+
+// GetCapabilities returns a description of the profiles, algorithms,
+// and formats this build supports.
+func GetCapabilities() *Capabilities {
+	return &Capabilities{
+		Version:            Version,
+		Profiles:           BuiltInProfileNames(),
+		ManifestAlgorithms: SupportedManifestAlgorithms,
+		Serializations:     BagFormats,
+		Compression:        SupportedCompression,
+		OutputFormats:      allOutputFormats(),
+	}
+}
+
+// allOutputFormats returns the values that any command's --format flag
+// accepts, other than bag create's, which are in Serializations.
+func allOutputFormats() []string {
+	formats := []string{}
+	for _, list := range [][]string{OutputFormats, ListOutputFormats, S3ListOutputFormats, ValidateOutputFormats} {
+		for _, format := range list {
+			if !util.StringListContains(formats, format) {
+				formats = append(formats, format)
+			}
+		}
+	}
+	sort.Strings(formats)
+	return formats
+}
+
+var capabilitiesCmd = &cobra.Command{
+	Use:     "capabilities",
+	Short:   "Print supported profiles, algorithms and formats as JSON",
+	Example: `apt-cmd capabilities`,
+	Long: `Print a JSON description of the BagIt profiles, manifest
+algorithms, bag serialization and compression formats, and output
+formats this build of apt-cmd supports.
+
+This is intended for GUIs and scripts that wrap apt-cmd and need to
+know which options are valid for the version they're running.
+
+Example:
+
+  apt-cmd capabilities
+
+Full online documentation:
+
+https://aptrust.github.io/userguide/partner_tools/
+
+`,
+	Run: func(cmd *cobra.Command, args []string) {
+		printResult(GetCapabilities())
+		os.Exit(EXIT_OK)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(capabilitiesCmd)
+}
@@ -0,0 +1,36 @@
+package cmd_test
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/APTrust/apt-cmd/cmd"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetCapabilities(t *testing.T) {
+	caps := cmd.GetCapabilities()
+	assert.Equal(t, []string{"aptrust", "btr", "empty"}, caps.Profiles)
+	assert.Equal(t, []string{"md5", "sha1", "sha256", "sha512", "sha3-256", "sha3-512"}, caps.ManifestAlgorithms)
+	assert.Equal(t, cmd.BagFormats, caps.Serializations)
+	assert.Equal(t, []string{"gzip"}, caps.Compression)
+	assert.Equal(t, []string{"json", "jsonl", "table", "text", "yaml"}, caps.OutputFormats)
+
+	// Every profile we advertise should load.
+	for _, name := range caps.Profiles {
+		profile, err := cmd.LoadProfile(name)
+		require.Nil(t, err, name)
+		assert.NotEmpty(t, profile.Name, name)
+	}
+}
+
+func TestCapabilitiesCommand(t *testing.T) {
+	exitCode, stdout, stderr := execCmd(t, "go", "run", "../main.go", "capabilities")
+	assert.Equal(t, cmd.EXIT_OK, exitCode)
+	assert.Empty(t, stderr)
+	caps := &cmd.Capabilities{}
+	require.Nil(t, json.Unmarshal([]byte(stdout), caps))
+	assert.Equal(t, cmd.GetCapabilities().Profiles, caps.Profiles)
+	assert.NotNil(t, caps.Compression)
+}
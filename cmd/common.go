@@ -2,20 +2,30 @@ package cmd
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"net"
 	"net/url"
 	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
 
 	"github.com/APTrust/dart-runner/bagit"
+	"github.com/APTrust/dart-runner/util"
 	"github.com/APTrust/preservation-services/network"
+	"github.com/dustin/go-humanize"
 	"github.com/minio/minio-go/v7"
 	"github.com/minio/minio-go/v7/pkg/credentials"
+	"github.com/op/go-logging"
 	"github.com/spf13/pflag"
 	"golang.org/x/text/cases"
 	"golang.org/x/text/language"
+	"gopkg.in/yaml.v3"
 )
 
 const (
@@ -42,12 +52,61 @@ const (
 	// with a 4xx or 5xx HTTP status code.
 	EXIT_REQUEST_ERROR = 4
 
+	// EXIT_CANCELED means the operation was interrupted,
+	// usually because the user pressed Ctrl-C. Like most
+	// shells, we use 128 + SIGINT.
+	EXIT_CANCELED = 130
+
 	// EXIT_NO_OP means the user requested help message or
 	// version info. The program printed the info, and no other
 	// operations were performed.
 	EXIT_NO_OP = 100
 )
 
+// DefaultConcurrency is the default value of the global --concurrency
+// flag. This matches the number of parallel part uploads the minio
+// client uses when it isn't told otherwise.
+const DefaultConcurrency = 4
+
+// BuiltInProfiles maps the profile names users can pass to --profile
+// to the embedded JSON files that define those profiles.
+var BuiltInProfiles = map[string]string{
+	"aptrust": "profiles/aptrust-v2.2.json",
+	"btr":     "profiles/btr-v1.0.json",
+	"empty":   "profiles/empty_profile.json",
+}
+
+// SupportedManifestAlgorithms lists the digest algorithms
+// we can use in manifests and tag manifests.
+var SupportedManifestAlgorithms = []string{
+	"md5",
+	"sha1",
+	"sha256",
+	"sha512",
+	AlgSha3_256,
+	AlgSha3_512,
+}
+
+// SupportedCompression lists the compression formats we can
+// apply to serialized bags.
+var SupportedCompression = []string{
+	"gzip",
+}
+
+const (
+	// SizeUnitsSI formats sizes in powers of 1000: kB, MB, GB.
+	SizeUnitsSI = "si"
+
+	// SizeUnitsIEC formats sizes in powers of 1024: KiB, MiB, GiB.
+	SizeUnitsIEC = "iec"
+)
+
+// SupportedSizeUnits lists the values accepted by --size-units.
+var SupportedSizeUnits = []string{
+	SizeUnitsSI,
+	SizeUnitsIEC,
+}
+
 var ErrImbalancedArgPair = errors.New("odd number of filter args")
 
 type ArgPair struct {
@@ -57,7 +116,9 @@ type ArgPair struct {
 
 // ParseArgPairs converts command-line args that look like
 // key-value pairs into ArgPair objects. It ignores flags
-// and args that do not contain an equal sign.
+// and args that do not contain an equal sign. It splits
+// on the first equal sign only, so values may contain
+// equal signs, as in "Token=abc=def==".
 func ParseArgPairs(args []string) []ArgPair {
 	pairs := make([]ArgPair, 0)
 	for _, arg := range args {
@@ -90,6 +151,65 @@ func GetUrlValues(args []string) url.Values {
 // Format is "tagfile.txt/Tag-Name=Value". If tag file name
 // is missing from param, it's assumed to be bag-info.txt,
 // which is the only customizable tag file in the BagIt standard.
+// See ParseTagSpec for details on how each spec is parsed.
+//
+// Values may be templates, such as {{.Date}}, which RunBagCreate
+// expands for each bag with ExpandTagTemplates. This checks that each
+// template expands, so a malformed template or an undefined variable is
+// reported before bagging starts.
+//
+// This returns an error describing the first malformed spec it
+// finds. Empty specs are ignored, since the --tags flag defaults
+// to an empty string.
+func GetTagValues(args []string) ([]*bagit.TagDefinition, error) {
+	tagDefs := make([]*bagit.TagDefinition, 0)
+	for _, arg := range args {
+		if strings.TrimSpace(arg) == "" {
+			continue
+		}
+		tagDef, err := ParseTagSpec(arg)
+		if err != nil {
+			return nil, err
+		}
+		if _, err = ExpandTagTemplates([]*bagit.TagDefinition{tagDef}, NewTagTemplateData("bag")); err != nil {
+			return nil, err
+		}
+		tagDefs = append(tagDefs, tagDef)
+	}
+	return tagDefs, nil
+}
+
+// MergeTags merges layers of tag values, from lowest to highest
+// precedence. A tag in a later layer replaces every tag with the same
+// tag file and name, ignoring case, in earlier layers. Repeated tags
+// within the same layer are all kept.
+func MergeTags(layers ...[]*bagit.TagDefinition) []*bagit.TagDefinition {
+	merged := make([]*bagit.TagDefinition, 0)
+	for _, layer := range layers {
+		replaced := make(map[string]bool)
+		for _, tag := range layer {
+			replaced[tagKey(tag.TagFile, tag.TagName)] = true
+		}
+		kept := make([]*bagit.TagDefinition, 0, len(merged)+len(layer))
+		for _, tag := range merged {
+			if !replaced[tagKey(tag.TagFile, tag.TagName)] {
+				kept = append(kept, tag)
+			}
+		}
+		merged = append(kept, layer...)
+	}
+	return merged
+}
+
+// ParseTagSpec parses a single tag spec from the --tags flag.
+//
+// The spec is split on the first equal sign, so the value may contain
+// equal signs. The part before that is the tag file and tag name. If it
+// contains ".txt/", everything through ".txt" is the tag file and the
+// rest is the tag name. Otherwise the whole thing is the tag name, and
+// the tag goes into bag-info.txt. This means "Source/Format=x" sets tag
+// "Source/Format" in bag-info.txt, while "custom/info.txt/Name=x" sets
+// tag "Name" in custom/info.txt.
 //
 // As with the LOC's BagIt-Python library, we convert the first
 // letter of each word in tag names to upper-case. For example,
@@ -101,62 +221,83 @@ func GetUrlValues(args []string) url.Values {
 // use title-cased tag names. Some parses may expect or demand
 // title-cased names when validating bags, so we will stick to title
 // case for now.
-func GetTagValues(args []string) []*bagit.TagDefinition {
-	pairs := ParseArgPairs(args)
-	titleCase := cases.Title(language.English)
-	tagDefs := make([]*bagit.TagDefinition, 0)
-	for _, pair := range pairs {
-		var tagDef *bagit.TagDefinition
-		parts := strings.SplitN(pair.Name, "/", 2)
-		if len(parts) == 1 {
-			tagDef = &bagit.TagDefinition{
-				TagFile:   "bag-info.txt",
-				TagName:   titleCase.String(strings.ToLower(pair.Name)),
-				UserValue: pair.Value,
-			}
-		} else {
-			tagDef = &bagit.TagDefinition{
-				TagFile:   parts[0],
-				TagName:   titleCase.String(strings.ToLower(parts[1])),
-				UserValue: pair.Value,
-			}
-		}
-		tagDefs = append(tagDefs, tagDef)
+func ParseTagSpec(spec string) (*bagit.TagDefinition, error) {
+	parts := strings.SplitN(spec, "=", 2)
+	if len(parts) < 2 {
+		return nil, fmt.Errorf("invalid tag '%s': tags must be in the format tagfile.txt/Tag-Name=Value or Tag-Name=Value", spec)
+	}
+	key, value := parts[0], parts[1]
+	tagFile := "bag-info.txt"
+	tagName := key
+	if idx := strings.Index(strings.ToLower(key), ".txt/"); idx > -1 {
+		tagFile = key[:idx+len(".txt")]
+		tagName = key[idx+len(".txt/"):]
+	}
+	tagName, err := normalizeTagName(tagName)
+	if err != nil {
+		return nil, fmt.Errorf("invalid tag '%s': %w", spec, err)
 	}
-	return tagDefs
+	return &bagit.TagDefinition{
+		TagFile:   strings.TrimSpace(tagFile),
+		TagName:   tagName,
+		UserValue: value,
+	}, nil
+}
+
+// normalizeTagName trims and title-cases a tag name the user supplied,
+// as described in ParseTagSpec. It returns an error if the name is
+// empty or contains characters that can't appear in a tag name.
+func normalizeTagName(tagName string) (string, error) {
+	tagName = strings.TrimSpace(tagName)
+	if tagName == "" {
+		return "", fmt.Errorf("tag name is missing")
+	}
+	if strings.ContainsAny(tagName, ":\r\n") {
+		return "", fmt.Errorf("tag names cannot contain colons or line breaks")
+	}
+	titleCase := cases.Title(language.English)
+	return titleCase.String(strings.ToLower(tagName)), nil
 }
 
 // NewRegistryClient returns a new client that can talk to
 // the APTrust Registry. It will return an error if the
-// config lacks essential Registry settings.
-func NewRegistryClient(config *Config) (*network.RegistryClient, error) {
+// config lacks essential Registry settings. The client's
+// policy for reads comes from the registry command's
+// --timeout, --retries and --retry-backoff flags.
+func NewRegistryClient(config *Config) (*RegistryClient, error) {
 	err := config.ValidateRegistryConfig()
 	if err != nil {
 		return nil, err
 	}
+	// logger is set only once a command runs, and the registry
+	// client can't do without one.
+	clientLogger := logger
+	if clientLogger == nil {
+		clientLogger = logging.MustGetLogger("aptrust")
+	}
 	client, err := network.NewRegistryClient(
 		config.RegistryURL,
 		config.RegistryAPIVersion,
 		config.RegistryEmail,
 		config.RegistryAPIKey,
-		logger,
+		clientLogger,
 	)
-	if client != nil {
-		client.UseMemberAPI()
+	if err != nil {
+		return nil, err
 	}
-	return client, err
+	client.UseMemberAPI()
+	return &RegistryClient{RegistryClient: client, Policy: registryRequestPolicy(false)}, nil
 }
 
 // InitRegistryRequest initializes a registry REST client
 // and the params to be sent in a query string.
-func InitRegistryRequest(config *Config, args []string) (*network.RegistryClient, url.Values) {
+func InitRegistryRequest(config *Config, args []string) (*RegistryClient, url.Values) {
 	urlValues := GetUrlValues(args)
 	client, err := NewRegistryClient(config)
 	if err != nil {
 		// Only error here is that user didn't supply valid
 		// Registry config or Registry crendentials
-		fmt.Fprintln(os.Stderr, "Error getting Registry client:", err)
-		os.Exit(EXIT_USER_ERR)
+		Fail(EXIT_USER_ERR, "Error getting Registry client:", err)
 	}
 	return client, urlValues
 }
@@ -173,39 +314,371 @@ func EnsureDefaultListParams(values url.Values) {
 	}
 }
 
+// RunCancelable runs fn and waits until it finishes or until ctx is
+// canceled, whichever comes first. It returns ctx.Err() if the context
+// was canceled before fn finished.
+//
+// This is for long-running calls like the bagger, the validator and the
+// registry client, which don't accept a context. If ctx is canceled,
+// fn keeps running in its goroutine until it returns, so callers should
+// clean up and exit rather than carrying on.
+func RunCancelable(ctx context.Context, fn func()) error {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		fn()
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// jsonErrors is the global --json-errors flag.
+var jsonErrors bool
+
+// ErrorTypes names the kind of failure that each exit code means, for
+// --json-errors.
+var ErrorTypes = map[int]string{
+	EXIT_RUNTIME_ERR:   "RuntimeError",
+	EXIT_BAG_INVALID:   "BagInvalid",
+	EXIT_USER_ERR:      "UserError",
+	EXIT_REQUEST_ERROR: "RequestError",
+	EXIT_CANCELED:      "Canceled",
+}
+
+// ErrorResult describes a failed command. With --json-errors, commands
+// print it on stdout instead of printing error messages on stderr.
+// ErrorType is the ErrorTypes name for ExitCode, so scripts can tell
+// kinds of failures apart without parsing the messages in Errors.
+type ErrorResult struct {
+	Result    string   `json:"result"`
+	ErrorType string   `json:"errorType"`
+	ExitCode  int      `json:"exitCode"`
+	Errors    []string `json:"errors"`
+}
+
+// NewErrorResult returns an ErrorResult for a command that failed with
+// exitCode because of errs.
+func NewErrorResult(exitCode int, errs ...string) *ErrorResult {
+	errorType, ok := ErrorTypes[exitCode]
+	if !ok {
+		errorType = ErrorTypes[EXIT_RUNTIME_ERR]
+	}
+	return &ErrorResult{
+		Result:    "error",
+		ErrorType: errorType,
+		ExitCode:  exitCode,
+		Errors:    errs,
+	}
+}
+
+// JSON returns the result as a single line of JSON. extras is added to
+// the end of the JSON object, as in BagCreateResult.JSON.
+func (r *ErrorResult) JSON(extras string) string {
+	// Marshalling a string slice can't fail.
+	errorBytes, _ := json.Marshal(r.Errors)
+	return fmt.Sprintf(`{ "result": "%s", "errorType": "%s", "exitCode": %d, "errors": %s%s }`, r.Result, r.ErrorType, r.ExitCode, string(errorBytes), extras)
+}
+
+// ExitWithErrors reports errs and exits with exitCode. It prints errs on
+// stderr, one per line, or with --json-errors, prints an ErrorResult on
+// stdout.
+func ExitWithErrors(exitCode int, errs ...string) {
+	if jsonErrors {
+		fmt.Println(NewErrorResult(exitCode, errs...).JSON(""))
+	} else {
+		fmt.Fprintln(os.Stderr, strings.Join(errs, "\n"))
+	}
+	os.Exit(exitCode)
+}
+
+// Fail prints args as fmt.Println would and exits with exitCode. Each
+// line of the message is one error in the --json-errors output.
+func Fail(exitCode int, args ...interface{}) {
+	ExitWithErrors(exitCode, strings.Split(strings.TrimSuffix(fmt.Sprintln(args...), "\n"), "\n")...)
+}
+
+// Failf is like Fail, but formats its message as fmt.Printf would.
+func Failf(exitCode int, format string, args ...interface{}) {
+	ExitWithErrors(exitCode, strings.Split(fmt.Sprintf(format, args...), "\n")...)
+}
+
+// ExitIfCanceled exits with EXIT_CANCELED if ctx has been canceled.
+// Call this when an operation fails, so that the user sees that the
+// operation was interrupted instead of a confusing network or I/O
+// error caused by the interruption.
+func ExitIfCanceled(ctx context.Context) {
+	if ctx.Err() != nil {
+		Fail(EXIT_CANCELED, "Operation canceled.")
+	}
+}
+
+// DoRegistryRequest runs a registry client request that only reads
+// data, and returns the response. It gives up on the request after
+// --timeout, and retries timeouts, connection errors and 5xx responses
+// up to --retries times. The registry client doesn't take a context, so
+// this uses RunCancelable to stop waiting on the request, and exits
+// with EXIT_CANCELED, if ctx is canceled.
+func DoRegistryRequest(ctx context.Context, request func() *network.RegistryResponse) *network.RegistryResponse {
+	return registryRequestPolicy(false).Do(ctx, request)
+}
+
+// DoRegistryWrite is like DoRegistryRequest, for requests that create
+// or change records. These are retried only with --retry-writes.
+func DoRegistryWrite(ctx context.Context, request func() *network.RegistryResponse) *network.RegistryResponse {
+	return registryRequestPolicy(true).Do(ctx, request)
+}
+
+// jsonString returns s as a quoted and escaped JSON string.
+func jsonString(s string) string {
+	// Marshalling a string can't fail.
+	data, _ := json.Marshal(s)
+	return string(data)
+}
+
 // PrettyPrintJSON converts unformatted JSON, such as that returned by
 // the Registry, to formatted JSON.
 func PrettyPrintJSON(jsonBytes []byte) {
 	pretty := new(bytes.Buffer)
 	err := json.Indent(pretty, jsonBytes, "", "  ")
 	if err != nil {
-		fmt.Fprintln(os.Stderr, "Error formatting JSON:", err)
-		fmt.Fprintln(os.Stderr, "Response body:", string(jsonBytes))
-		os.Exit(EXIT_RUNTIME_ERR)
+		Failf(EXIT_RUNTIME_ERR, "Error formatting JSON: %v\nResponse body: %s", err, string(jsonBytes))
 	}
-	fmt.Println(pretty.String())
+	WriteResult(pretty.String() + "\n")
 }
 
-// NewS3Client returns a client that can talk to an S3 endpoint.
+// printResult prints obj, a command's result, as indented JSON followed
+// by a newline, with WriteResult. A json.RawMessage is printed as it
+// is, for results that are already JSON, such as BagCreateResult.JSON.
+// This exits with EXIT_RUNTIME_ERR if obj can't be marshalled.
+func printResult(obj interface{}) {
+	data, ok := obj.(json.RawMessage)
+	if !ok {
+		var err error
+		data, err = json.MarshalIndent(obj, "", "  ")
+		if err != nil {
+			Fail(EXIT_RUNTIME_ERR, "Error serializing result:", err)
+		}
+	}
+	WriteResult(strings.TrimRight(string(data), "\n") + "\n")
+}
+
+// resultFile is the --output flag of registry commands and s3 download.
+var resultFile string
+
+// WriteResult prints a command's result to stdout, or with --output, to
+// the named file. Only the result goes to the file. Logs, progress and
+// errors still go to stderr. This exits with EXIT_RUNTIME_ERR if it
+// can't write the file.
+func WriteResult(result string) {
+	if resultFile == "" {
+		fmt.Print(result)
+		return
+	}
+	if err := WriteFileAtomic(resultFile, []byte(result)); err != nil {
+		Fail(EXIT_RUNTIME_ERR, "Error writing --output file:", err)
+	}
+}
+
+// WriteFileAtomic writes data to a temp file in the same directory as
+// filePath, then renames the temp file to filePath. Since the rename is
+// atomic, anyone reading filePath sees either the old file or the
+// complete new one, and an interrupted write leaves no partial file
+// behind.
+func WriteFileAtomic(filePath string, data []byte) error {
+	temp, err := os.CreateTemp(filepath.Dir(filePath), "."+filepath.Base(filePath)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	_, err = temp.Write(data)
+	if err == nil {
+		err = temp.Sync()
+	}
+	if closeErr := temp.Close(); err == nil {
+		err = closeErr
+	}
+	// CreateTemp makes the file readable only by its owner.
+	if err == nil {
+		err = os.Chmod(temp.Name(), 0644)
+	}
+	if err == nil {
+		err = os.Rename(temp.Name(), filePath)
+	}
+	if err != nil {
+		os.Remove(temp.Name())
+	}
+	return err
+}
+
+// Output formats for registry get and list, s3 list, and bag validate.
+// Only registry list supports OutputFormatTable.
+const (
+	OutputFormatJSON  = "json"
+	OutputFormatJSONL = "jsonl"
+	OutputFormatYAML  = "yaml"
+	OutputFormatTable = "table"
+	OutputFormatText  = "text"
+)
+
+// OutputFormats lists the supported values for registry get's --format
+// flag.
+var OutputFormats = []string{
+	OutputFormatJSON,
+	OutputFormatYAML,
+}
+
+// ListOutputFormats lists the supported values for registry list's
+// --format flag.
+var ListOutputFormats = []string{
+	OutputFormatJSON,
+	OutputFormatYAML,
+	OutputFormatTable,
+}
+
+// S3ListOutputFormats lists the supported values for s3 list's --format
+// flag.
+var S3ListOutputFormats = []string{
+	OutputFormatJSON,
+	OutputFormatJSONL,
+	OutputFormatText,
+}
+
+// ValidateOutputFormats lists the supported values for bag validate's
+// --format flag.
+var ValidateOutputFormats = []string{
+	OutputFormatText,
+	OutputFormatJSON,
+}
+
+// GetOutputFormat returns the value of the --format flag in flags. It
+// exits with EXIT_USER_ERR if the format isn't one of formats, so call
+// it before making any requests.
+func GetOutputFormat(flags *pflag.FlagSet, formats []string) string {
+	format, _ := flags.GetString("format")
+	if !util.StringListContains(formats, format) {
+		Failf(EXIT_USER_ERR, "Invalid --format '%s'. Use one of: %s", format, strings.Join(formats, ", "))
+	}
+	return format
+}
+
+// PrintJSONAs prints JSON, such as that returned by the Registry, in
+// the specified output format. As with PrettyPrintJSON, it exits with
+// EXIT_RUNTIME_ERR if the data isn't valid JSON.
+func PrintJSONAs(jsonBytes []byte, format string) {
+	if format != OutputFormatYAML {
+		PrettyPrintJSON(jsonBytes)
+		return
+	}
+	yamlBytes, err := JSONToYAML(jsonBytes)
+	if err != nil {
+		Failf(EXIT_RUNTIME_ERR, "Error formatting YAML: %v\nResponse body: %s", err, string(jsonBytes))
+	}
+	WriteResult(string(yamlBytes))
+}
+
+// JSONToYAML converts JSON to block-style YAML. Since JSON is YAML, we
+// parse it as YAML, which keeps object keys in their original order.
+func JSONToYAML(jsonBytes []byte) ([]byte, error) {
+	if !json.Valid(jsonBytes) {
+		return nil, fmt.Errorf("invalid JSON")
+	}
+	var node yaml.Node
+	if err := yaml.Unmarshal(jsonBytes, &node); err != nil {
+		return nil, err
+	}
+	clearYAMLStyle(&node)
+	var out bytes.Buffer
+	encoder := yaml.NewEncoder(&out)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(&node); err != nil {
+		return nil, err
+	}
+	if err := encoder.Close(); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+// clearYAMLStyle resets the JSON flow style and quoting of node and
+// its children, so the encoder writes block-style YAML and quotes only
+// the strings that need it.
+func clearYAMLStyle(node *yaml.Node) {
+	node.Style = 0
+	for _, child := range node.Content {
+		clearYAMLStyle(child)
+	}
+}
+
+// NewS3Client returns a client that can talk to an S3 endpoint, as
+// CreateS3Client does. It exits with EXIT_USER_ERR if the config is
+// lacking S3 authentication settings.
+func NewS3Client(config *Config, s3Host string) *minio.Client {
+	client, err := CreateS3Client(config, s3Host)
+	if err != nil {
+		Fail(EXIT_USER_ERR, err.Error())
+	}
+	return client
+}
+
+// CreateS3Client returns a client that can talk to an S3 endpoint.
 // It will return an error if the config is lacking S3 authentication
 // settings.
-func NewS3Client(config *Config, s3Host string) *minio.Client {
+//
+// The client connects to config.S3Port, if it's set, and uses plain
+// HTTP if config.S3Insecure is set or the host is localhost. If
+// config.S3PathStyle is set, bucket names go in the URL path rather
+// than the host name, which MinIO and many on-premises gateways need.
+// If config.AWSRegion is empty, the client asks S3 for each bucket's
+// region. config.AWSSessionToken is needed only for temporary
+// credentials, such as those from AWS STS.
+func CreateS3Client(config *Config, s3Host string) (*minio.Client, error) {
+	if config == nil {
+		config = &Config{}
+	}
 	err := config.ValidateAWSCredentials()
 	if err != nil {
-		fmt.Fprintln(os.Stderr, "Missing S3 connection info:", err)
-		os.Exit(EXIT_USER_ERR)
+		return nil, fmt.Errorf("Missing S3 connection info: %w", err)
+	}
+	endpoint, err := S3Endpoint(s3Host, config.S3Port)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid S3 connection info: %w", err)
+	}
+	bucketLookup := minio.BucketLookupAuto
+	if config.S3PathStyle {
+		bucketLookup = minio.BucketLookupPath
 	}
 	client, err := minio.New(
-		s3Host,
+		endpoint,
 		&minio.Options{
-			Creds:  credentials.NewStaticV4(config.AWSKey, config.AWSSecret, ""),
-			Secure: !strings.Contains(s3Host, "localhost") && !strings.Contains(s3Host, "127.0.0.1"),
+			Creds:        credentials.NewStaticV4(config.AWSKey, config.AWSSecret, config.AWSSessionToken),
+			Secure:       !config.S3Insecure && !strings.Contains(s3Host, "localhost") && !strings.Contains(s3Host, "127.0.0.1"),
+			BucketLookup: bucketLookup,
+			Region:       config.AWSRegion,
 		})
 	if err != nil {
-		fmt.Fprintln(os.Stderr, "Error creating S3 client:", err)
-		os.Exit(EXIT_RUNTIME_ERR)
+		return nil, fmt.Errorf("Error creating S3 client: %w", err)
 	}
-	return client
+	return client, nil
+}
+
+// S3Endpoint returns the host and port to connect to for s3Host. If
+// port is zero, that's just s3Host, which may include its own port, as
+// in localhost:9899. Otherwise, port replaces any port in s3Host.
+func S3Endpoint(s3Host string, port int) (string, error) {
+	if port == 0 {
+		return s3Host, nil
+	}
+	if port < 0 || port > 65535 {
+		return "", fmt.Errorf("port %d is out of range", port)
+	}
+	host := s3Host
+	if h, _, err := net.SplitHostPort(s3Host); err == nil {
+		host = h
+	}
+	return net.JoinHostPort(host, strconv.Itoa(port)), nil
 }
 
 // LooksLikePreservationBucket returns true if the bucket name
@@ -240,26 +713,58 @@ func LooksLikePreservationBucket(bucket string) bool {
 func GetFlagValue(flags *pflag.FlagSet, flagName, errMsg string) string {
 	paramValue := flags.Lookup(flagName).Value.String()
 	if paramValue == "" && errMsg != "" {
-		fmt.Fprintln(os.Stderr, errMsg)
-		os.Exit(EXIT_USER_ERR)
+		Fail(EXIT_USER_ERR, errMsg)
 	}
 	return paramValue
 }
 
-// LoadProfile loads a BagIt profile.
+// GetConcurrency returns the number of parallel operations a command
+// should run. Commands inherit the global --concurrency flag, but a
+// command that defines its own --concurrency flag overrides the global
+// setting, since cobra gives local flags precedence over persistent
+// flags of the same name. This exits with EXIT_USER_ERR if the value
+// is less than one.
+func GetConcurrency(flags *pflag.FlagSet) int {
+	value, err := flags.GetInt("concurrency")
+	if err != nil {
+		return DefaultConcurrency
+	}
+	if value < 1 {
+		Fail(EXIT_USER_ERR, "Flag --concurrency must be one or greater.")
+	}
+	return value
+}
+
+// GetRateLimiter returns a RateLimiter for a command's --rate-limit
+// flag, or nil if the flag is empty, meaning no limit. This exits with
+// EXIT_USER_ERR if the value isn't a valid rate.
+func GetRateLimiter(flags *pflag.FlagSet) *RateLimiter {
+	value, err := flags.GetString("rate-limit")
+	if err != nil {
+		return nil
+	}
+	bytesPerSecond, err := ParseRateLimit(value)
+	if err != nil {
+		Fail(EXIT_USER_ERR, "Flag --rate-limit:", err.Error())
+	}
+	return NewRateLimiter(bytesPerSecond)
+}
+
+// LoadProfile loads a BagIt profile. Param name is the name of a
+// built-in profile or the path to a BagIt profile .json file, which
+// must pass ValidateProfile.
 func LoadProfile(name string) (*bagit.Profile, error) {
+	if IsProfileFile(name) {
+		return loadProfileFile(name)
+	}
 	profile := &bagit.Profile{}
 	var data []byte
 	var err error
-	switch name {
-	case "aptrust":
-		data, err = profiles.ReadFile("profiles/aptrust-v2.2.json")
-	case "btr":
-		data, err = profiles.ReadFile("profiles/btr-v1.0.json")
-	case "empty":
-		data, err = profiles.ReadFile("profiles/empty_profile.json")
-	default:
-		err = fmt.Errorf("missing or invalid profile. Only 'aptrust', 'btr' and 'empty' are supported")
+	fileName, ok := BuiltInProfiles[name]
+	if ok {
+		data, err = profiles.ReadFile(fileName)
+	} else {
+		err = fmt.Errorf("missing or invalid profile. Use %s, or the path to a BagIt profile .json file", quotedList(BuiltInProfileNames()))
 	}
 	if err == nil && len(data) > 1 {
 		err = json.Unmarshal(data, profile)
@@ -267,6 +772,52 @@ func LoadProfile(name string) (*bagit.Profile, error) {
 	return profile, err
 }
 
+// BuiltInProfileNames returns the names of the BagIt profiles
+// built into this tool, in alphabetical order.
+func BuiltInProfileNames() []string {
+	names := make([]string, 0, len(BuiltInProfiles))
+	for name := range BuiltInProfiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// quotedList converts a list like [a b c] to the string
+// "'a', 'b' and 'c'" for use in help and error messages.
+func quotedList(items []string) string {
+	quoted := make([]string, len(items))
+	for i, item := range items {
+		quoted[i] = fmt.Sprintf("'%s'", item)
+	}
+	if len(quoted) < 2 {
+		return strings.Join(quoted, "")
+	}
+	return strings.Join(quoted[:len(quoted)-1], ", ") + " and " + quoted[len(quoted)-1]
+}
+
+// FormatSize returns a human-readable version of size, in SI units
+// (1 kB = 1000 bytes) or IEC units (1 KiB = 1024 bytes). The output
+// does not depend on the user's locale, so scripts can parse it.
+// Any units other than SizeUnitsIEC are treated as SI.
+func FormatSize(size int64, units string) string {
+	if units == SizeUnitsIEC {
+		return humanize.IBytes(uint64(size))
+	}
+	return humanize.Bytes(uint64(size))
+}
+
+// WriteChecksumFile writes digest into a sidecar file next to
+// pathToFile, named after the algorithm. For example, the sha256
+// digest of photo.jpg goes into photo.jpg.sha256. The sidecar uses
+// the same format as BagIt manifests and sha256sum: digest, two
+// spaces, file name. Returns the path to the sidecar file.
+func WriteChecksumFile(pathToFile, alg, digest string) (string, error) {
+	checksumFile := fmt.Sprintf("%s.%s", pathToFile, alg)
+	line := fmt.Sprintf("%s  %s\n", digest, path.Base(pathToFile))
+	return checksumFile, os.WriteFile(checksumFile, []byte(line), 0644)
+}
+
 func PrintErrors(errors []string) {
 	for _, err := range errors {
 		fmt.Fprintln(os.Stderr, err)
@@ -1,12 +1,16 @@
 package cmd_test
 
 import (
+	"context"
 	"io/ioutil"
 	"net/url"
 	"os"
+	"path"
 	"testing"
+	"time"
 
 	"github.com/APTrust/apt-cmd/cmd"
+	"github.com/spf13/pflag"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -45,10 +49,16 @@ func TestGetUrlValues(t *testing.T) {
 }
 
 func TestGetTagValues(t *testing.T) {
-	tagArgs := append(testArgs, "aptrust-info.txt/Title=Bag Title")
-	tagArgs = append(tagArgs, "random-info.txt/Quarterback=Jim Plunkett")
-	tagArgs = append(tagArgs, "bag-info.txt/state-name=Virginia")
-	tags := cmd.GetTagValues(tagArgs)
+	tagArgs := []string{
+		"pair1=value1",
+		"pair2=value2",
+		"pair3=value3",
+		"aptrust-info.txt/Title=Bag Title",
+		"random-info.txt/Quarterback=Jim Plunkett",
+		"bag-info.txt/state-name=Virginia",
+	}
+	tags, err := cmd.GetTagValues(tagArgs)
+	require.Nil(t, err)
 	require.Equal(t, 6, len(tags))
 
 	// Note that tag names are converted to title case
@@ -142,6 +152,25 @@ func TestPrettyPrintJSON(t *testing.T) {
 	assert.Equal(t, expected, string(prettyJson))
 }
 
+func TestJSONToYAML(t *testing.T) {
+	data := []byte(`{"count":1,"next":null,"results":[{"id":1,"identifier":"test.edu/bag","size":"123","tags":[],"active":true}]}`)
+	expected := `count: 1
+next: null
+results:
+  - id: 1
+    identifier: test.edu/bag
+    size: "123"
+    tags: []
+    active: true
+`
+	yamlBytes, err := cmd.JSONToYAML(data)
+	require.Nil(t, err)
+	assert.Equal(t, expected, string(yamlBytes))
+
+	_, err = cmd.JSONToYAML([]byte(`<html>Bad Gateway</html>`))
+	assert.NotNil(t, err)
+}
+
 func TestNewS3Client(t *testing.T) {
 	config := getTestConfig(true)
 	client := cmd.NewS3Client(config, "s3.amazonaws.com")
@@ -149,6 +178,42 @@ func TestNewS3Client(t *testing.T) {
 	assert.Equal(t, "s3.amazonaws.com", client.EndpointURL().Host)
 }
 
+func TestNewS3ClientOptions(t *testing.T) {
+	config := getTestConfig(true)
+	config.S3Port = 9000
+	config.S3Insecure = true
+	config.S3PathStyle = true
+	client := cmd.NewS3Client(config, "minio.example.edu")
+	assert.Equal(t, "minio.example.edu:9000", client.EndpointURL().Host)
+	assert.Equal(t, "http", client.EndpointURL().Scheme)
+
+	config = getTestConfig(true)
+	client = cmd.NewS3Client(config, "minio.example.edu:9000")
+	assert.Equal(t, "minio.example.edu:9000", client.EndpointURL().Host)
+	assert.Equal(t, "https", client.EndpointURL().Scheme)
+}
+
+func TestS3Endpoint(t *testing.T) {
+	endpoint, err := cmd.S3Endpoint("s3.amazonaws.com", 0)
+	require.Nil(t, err)
+	assert.Equal(t, "s3.amazonaws.com", endpoint)
+
+	endpoint, err = cmd.S3Endpoint("localhost:9899", 0)
+	require.Nil(t, err)
+	assert.Equal(t, "localhost:9899", endpoint)
+
+	endpoint, err = cmd.S3Endpoint("minio.example.edu", 9000)
+	require.Nil(t, err)
+	assert.Equal(t, "minio.example.edu:9000", endpoint)
+
+	endpoint, err = cmd.S3Endpoint("localhost:9899", 9000)
+	require.Nil(t, err)
+	assert.Equal(t, "localhost:9000", endpoint)
+
+	_, err = cmd.S3Endpoint("localhost", 70000)
+	assert.EqualError(t, err, "port 70000 is out of range")
+}
+
 func TestLooksLikePreservationBucket(t *testing.T) {
 	yes := []string{
 		"aptrust.preservation.oregon",
@@ -191,4 +256,255 @@ func TestLoadProfile(t *testing.T) {
 	require.Nil(t, err)
 	require.NotNil(t, profile)
 	assert.Equal(t, "https://raw.githubusercontent.com/APTrust/dart/tree/master/profiles/empty_profile.json", profile.BagItProfileInfo.BagItProfileIdentifier)
+
+	_, err = cmd.LoadProfile("no-such-profile")
+	require.NotNil(t, err)
+	assert.Equal(t, "missing or invalid profile. Use 'aptrust', 'btr' and 'empty', or the path to a BagIt profile .json file", err.Error())
+}
+
+func TestBuiltInProfileNames(t *testing.T) {
+	assert.Equal(t, []string{"aptrust", "btr", "empty"}, cmd.BuiltInProfileNames())
+}
+
+func TestWriteFileAtomic(t *testing.T) {
+	tempDir := t.TempDir()
+	pathToFile := path.Join(tempDir, "results.json")
+	require.Nil(t, cmd.WriteFileAtomic(pathToFile, []byte("first")))
+	require.Nil(t, cmd.WriteFileAtomic(pathToFile, []byte("second")))
+	data, err := os.ReadFile(pathToFile)
+	require.Nil(t, err)
+	assert.Equal(t, "second", string(data))
+
+	// No temp files are left behind.
+	entries, err := os.ReadDir(tempDir)
+	require.Nil(t, err)
+	assert.Equal(t, 1, len(entries))
+
+	err = cmd.WriteFileAtomic(path.Join(tempDir, "no-such-dir", "results.json"), []byte("data"))
+	assert.NotNil(t, err)
+}
+
+func TestWriteChecksumFile(t *testing.T) {
+	tempDir := t.TempDir()
+	pathToFile := path.Join(tempDir, "photo.jpg")
+	checksumFile, err := cmd.WriteChecksumFile(pathToFile, "sha256", "1234abcd")
+	require.Nil(t, err)
+	assert.Equal(t, pathToFile+".sha256", checksumFile)
+	data, err := os.ReadFile(checksumFile)
+	require.Nil(t, err)
+	assert.Equal(t, "1234abcd  photo.jpg\n", string(data))
+}
+
+func TestGetConcurrency(t *testing.T) {
+	// No flag defined
+	flags := pflag.NewFlagSet("test", pflag.ContinueOnError)
+	assert.Equal(t, cmd.DefaultConcurrency, cmd.GetConcurrency(flags))
+
+	// Flag defined, but not set
+	flags.Int("concurrency", cmd.DefaultConcurrency, "")
+	assert.Equal(t, cmd.DefaultConcurrency, cmd.GetConcurrency(flags))
+
+	// Flag set by user
+	require.Nil(t, flags.Parse([]string{"--concurrency=12"}))
+	assert.Equal(t, 12, cmd.GetConcurrency(flags))
+}
+
+func TestFormatSize(t *testing.T) {
+	assert.Equal(t, "0 B", cmd.FormatSize(0, cmd.SizeUnitsSI))
+	assert.Equal(t, "999 B", cmd.FormatSize(999, cmd.SizeUnitsSI))
+	assert.Equal(t, "1.0 kB", cmd.FormatSize(1000, cmd.SizeUnitsSI))
+	assert.Equal(t, "1.5 MB", cmd.FormatSize(1500000, cmd.SizeUnitsSI))
+	assert.Equal(t, "1000 B", cmd.FormatSize(1000, cmd.SizeUnitsIEC))
+	assert.Equal(t, "1.0 KiB", cmd.FormatSize(1024, cmd.SizeUnitsIEC))
+	assert.Equal(t, "1.4 MiB", cmd.FormatSize(1500000, cmd.SizeUnitsIEC))
+
+	// Unknown units default to SI
+	assert.Equal(t, "1.5 MB", cmd.FormatSize(1500000, ""))
+}
+
+func TestParseArgPairs_EmbeddedEquals(t *testing.T) {
+	// We should split on the first equal sign only, so values
+	// like base64 strings and query strings stay intact.
+	pairs := cmd.ParseArgPairs([]string{
+		"Token=abc=def==",
+		"bag-info.txt/Query=a=1&b=2",
+		"Empty=",
+		"Equals===",
+	})
+	require.Equal(t, 4, len(pairs))
+	assert.Equal(t, "Token", pairs[0].Name)
+	assert.Equal(t, "abc=def==", pairs[0].Value)
+	assert.Equal(t, "bag-info.txt/Query", pairs[1].Name)
+	assert.Equal(t, "a=1&b=2", pairs[1].Value)
+	assert.Equal(t, "Empty", pairs[2].Name)
+	assert.Equal(t, "", pairs[2].Value)
+	assert.Equal(t, "Equals", pairs[3].Name)
+	assert.Equal(t, "==", pairs[3].Value)
+}
+
+func TestGetTagValues_EmbeddedEquals(t *testing.T) {
+	tags, err := cmd.GetTagValues([]string{
+		"Token=abc=def==",
+		"custom-info.txt/Signature=bG9uZyBzdHJpbmc=",
+	})
+	require.Nil(t, err)
+	require.Equal(t, 2, len(tags))
+	assert.Equal(t, "bag-info.txt", tags[0].TagFile)
+	assert.Equal(t, "Token", tags[0].TagName)
+	assert.Equal(t, "abc=def==", tags[0].UserValue)
+	assert.Equal(t, "custom-info.txt", tags[1].TagFile)
+	assert.Equal(t, "Signature", tags[1].TagName)
+	assert.Equal(t, "bG9uZyBzdHJpbmc=", tags[1].UserValue)
+}
+
+func TestGetTagValues_HelpForms(t *testing.T) {
+	// These are the forms shown in the bag create --help text.
+	tags, err := cmd.GetTagValues([]string{
+		"",
+		"bag-info.txt/Source-Organization=Faber College",
+		"Source-Organization=Faber College",
+		"aptrust-info.txt/Title=My Bag of Photos",
+		"aptrust-info.txt/Access=Institution",
+		"Custom-Tag=Single quoted because it {contains} $weird &characters",
+	})
+	require.Nil(t, err)
+	require.Equal(t, 5, len(tags))
+	for i := 0; i < 2; i++ {
+		assert.Equal(t, "bag-info.txt", tags[i].TagFile)
+		assert.Equal(t, "Source-Organization", tags[i].TagName)
+		assert.Equal(t, "Faber College", tags[i].UserValue)
+	}
+	assert.Equal(t, "aptrust-info.txt", tags[2].TagFile)
+	assert.Equal(t, "Title", tags[2].TagName)
+	assert.Equal(t, "My Bag of Photos", tags[2].UserValue)
+	assert.Equal(t, "aptrust-info.txt", tags[3].TagFile)
+	assert.Equal(t, "Access", tags[3].TagName)
+	assert.Equal(t, "Institution", tags[3].UserValue)
+	assert.Equal(t, "bag-info.txt", tags[4].TagFile)
+	assert.Equal(t, "Custom-Tag", tags[4].TagName)
+	assert.Equal(t, "Single quoted because it {contains} $weird &characters", tags[4].UserValue)
+}
+
+func TestParseTagSpec(t *testing.T) {
+	// Slash in tag name with no tag file
+	tag, err := cmd.ParseTagSpec("Source/Format=TIFF")
+	require.Nil(t, err)
+	assert.Equal(t, "bag-info.txt", tag.TagFile)
+	assert.Equal(t, "Source/Format", tag.TagName)
+	assert.Equal(t, "TIFF", tag.UserValue)
+
+	// Tag file names are case-insensitive.
+	tag, err = cmd.ParseTagSpec("BAG-INFO.TXT/source-organization=Faber College")
+	require.Nil(t, err)
+	assert.Equal(t, "BAG-INFO.TXT", tag.TagFile)
+	assert.Equal(t, "Source-Organization", tag.TagName)
+
+	// Slash in tag name with a tag file
+	tag, err = cmd.ParseTagSpec("bag-info.txt/Source/Format=TIFF")
+	require.Nil(t, err)
+	assert.Equal(t, "bag-info.txt", tag.TagFile)
+	assert.Equal(t, "Source/Format", tag.TagName)
+
+	// Tag file in a subdirectory
+	tag, err = cmd.ParseTagSpec("custom-tags/info.txt/Reviewer=Pat")
+	require.Nil(t, err)
+	assert.Equal(t, "custom-tags/info.txt", tag.TagFile)
+	assert.Equal(t, "Reviewer", tag.TagName)
+	assert.Equal(t, "Pat", tag.UserValue)
+
+	// Spaces in tag name
+	tag, err = cmd.ParseTagSpec(" source organization =Faber College")
+	require.Nil(t, err)
+	assert.Equal(t, "bag-info.txt", tag.TagFile)
+	assert.Equal(t, "Source Organization", tag.TagName)
+	assert.Equal(t, "Faber College", tag.UserValue)
+
+	// Malformed specs
+	_, err = cmd.ParseTagSpec("Source-Organization")
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), "Tag-Name=Value")
+	_, err = cmd.ParseTagSpec("=Faber College")
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), "tag name is missing")
+	_, err = cmd.ParseTagSpec("bag-info.txt/=Faber College")
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), "tag name is missing")
+	_, err = cmd.ParseTagSpec("Source:Organization=Faber College")
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), "colons")
+
+	_, err = cmd.GetTagValues([]string{"Title=Good", "Bad"})
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), "'Bad'")
+}
+
+func TestErrorResult(t *testing.T) {
+	result := cmd.NewErrorResult(cmd.EXIT_REQUEST_ERROR, "first", "second")
+	assert.Equal(t, "error", result.Result)
+	assert.Equal(t, "RequestError", result.ErrorType)
+	assert.Equal(t, cmd.EXIT_REQUEST_ERROR, result.ExitCode)
+	assert.Equal(t, `{ "result": "error", "errorType": "RequestError", "exitCode": 4, "errors": ["first","second"], "bagDir": "/tmp" }`, result.JSON(`, "bagDir": "/tmp"`))
+
+	// Unknown exit codes are runtime errors.
+	assert.Equal(t, "RuntimeError", cmd.NewErrorResult(99, "oops").ErrorType)
+}
+
+func TestRunCancelable(t *testing.T) {
+	// Function finishes before context is canceled
+	ran := false
+	err := cmd.RunCancelable(context.Background(), func() { ran = true })
+	require.Nil(t, err)
+	assert.True(t, ran)
+
+	// Context is canceled while function is still running
+	ctx, cancel := context.WithCancel(context.Background())
+	release := make(chan struct{})
+	defer close(release)
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		cancel()
+	}()
+	err = cmd.RunCancelable(ctx, func() { <-release })
+	assert.ErrorIs(t, err, context.Canceled)
+
+	// Context is already canceled
+	err = cmd.RunCancelable(ctx, func() { <-release })
+	assert.ErrorIs(t, err, context.Canceled)
+}
+
+func TestMergeTags(t *testing.T) {
+	configTags, err := cmd.GetTagValues([]string{
+		"Source-Organization=Config College",
+		"Contact-Name=Config Contact",
+		"Keyword=one",
+		"Keyword=two",
+	})
+	require.Nil(t, err)
+	cliTags, err := cmd.GetTagValues([]string{
+		"Contact-Name=CLI Contact",
+		"aptrust-info.txt/Title=CLI Title",
+	})
+	require.Nil(t, err)
+
+	tags := cmd.MergeTags(configTags, cliTags)
+	require.Len(t, tags, 5)
+	assert.Equal(t, "Config College", cmd.FindTag(tags, "bag-info.txt", "Source-Organization").GetValue())
+	assert.Equal(t, "CLI Contact", cmd.FindTag(tags, "bag-info.txt", "Contact-Name").GetValue())
+	assert.Equal(t, "CLI Title", cmd.FindTag(tags, "aptrust-info.txt", "Title").GetValue())
+	keywords := 0
+	for _, tag := range tags {
+		if tag.TagName == "Keyword" {
+			keywords++
+		}
+	}
+	assert.Equal(t, 2, keywords)
+
+	// Later layers replace all repeated values.
+	override, err := cmd.GetTagValues([]string{"Keyword=three"})
+	require.Nil(t, err)
+	tags = cmd.MergeTags(configTags, override)
+	require.Len(t, tags, 3)
+	assert.Equal(t, "three", cmd.FindTag(tags, "bag-info.txt", "Keyword").GetValue())
+
+	assert.Empty(t, cmd.MergeTags())
 }
@@ -0,0 +1,130 @@
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+// completionShells are the shells completion can write scripts for.
+var completionShells = []string{"bash", "zsh", "fish", "powershell"}
+
+var completionCmd = &cobra.Command{
+	Use:                   "completion [bash|zsh|fish|powershell]",
+	Short:                 "Print a shell completion script",
+	Example:               `apt-cmd completion bash`,
+	ValidArgs:             completionShells,
+	Args:                  cobra.MatchAll(cobra.ExactArgs(1), cobra.OnlyValidArgs),
+	DisableFlagsInUseLine: true,
+	Long: `Print a script that lets your shell complete apt-cmd's commands,
+flags and arguments when you press Tab. Besides command and flag names,
+it completes the built-in BagIt profiles for --profile, the values of
+flags like --format and --hash-encoding, and the filter params of the
+registry list commands, such as intellectual_object_id=.
+
+The script completes the command under the name you run it as, so run
+completion with the same name you use day to day.
+
+Bash, for the current shell, or for every new shell on Linux (this
+needs the bash-completion package):
+
+  source <(apt-cmd completion bash)
+  apt-cmd completion bash > /etc/bash_completion.d/apt-cmd
+
+Zsh, if you haven't enabled completion yet, add "autoload -U compinit;
+compinit" to ~/.zshrc first:
+
+  apt-cmd completion zsh > "${fpath[1]}/_apt-cmd"
+
+Fish:
+
+  apt-cmd completion fish > ~/.config/fish/completions/apt-cmd.fish
+
+PowerShell, for the current session, or add the same line to your
+PowerShell profile:
+
+  apt-cmd completion powershell | Out-String | Invoke-Expression
+
+Start a new shell for the script to take effect.
+`,
+	Run: func(cmd *cobra.Command, args []string) {
+		// The scripts complete the root command's name, so make it the
+		// name the user runs.
+		root := cmd.Root()
+		root.Use = programName()
+		var err error
+		switch args[0] {
+		case "bash":
+			err = root.GenBashCompletionV2(os.Stdout, true)
+		case "zsh":
+			err = root.GenZshCompletion(os.Stdout)
+		case "fish":
+			err = root.GenFishCompletion(os.Stdout, true)
+		case "powershell":
+			err = root.GenPowerShellCompletionWithDesc(os.Stdout)
+		}
+		if err != nil {
+			Fail(EXIT_RUNTIME_ERR, "Can't write completion script:", err)
+		}
+		os.Exit(EXIT_OK)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(completionCmd)
+}
+
+// programName returns the name this program was run as, without any
+// directory or .exe extension.
+func programName() string {
+	return strings.TrimSuffix(filepath.Base(os.Args[0]), ".exe")
+}
+
+// completeValues returns a completion function for a flag or argument
+// that takes one of values.
+func completeValues(values ...string) func(*cobra.Command, []string, string) ([]string, cobra.ShellCompDirective) {
+	return func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+		return values, cobra.ShellCompDirectiveNoFileComp
+	}
+}
+
+// completeProfile completes --profile with the built-in profiles or,
+// if what the user typed isn't the start of one, with .json files.
+func completeProfile(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	names := make([]string, 0)
+	for _, name := range BuiltInProfileNames() {
+		if strings.HasPrefix(name, toComplete) {
+			names = append(names, name)
+		}
+	}
+	if len(names) > 0 {
+		return names, cobra.ShellCompDirectiveNoFileComp
+	}
+	return []string{"json"}, cobra.ShellCompDirectiveFilterFileExt
+}
+
+// completeListParams returns a completion function for the name=value
+// filter args of the registry list command listName, whose records are
+// models. It completes the names of the params in ListParams, each
+// followed by an =.
+func completeListParams(listName string, model interface{}) func(*cobra.Command, []string, string) ([]string, cobra.ShellCompDirective) {
+	return func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+		if strings.Contains(toComplete, "=") {
+			return nil, cobra.ShellCompDirectiveNoFileComp
+		}
+		params := ListParams(listName, model)
+		completions := make([]string, len(params))
+		for i, param := range params {
+			completions[i] = param + "="
+		}
+		return completions, cobra.ShellCompDirectiveNoSpace | cobra.ShellCompDirectiveNoFileComp
+	}
+}
+
+// registerFlagCompletion registers fn to complete the flag named name
+// of cmd. The flag must already be defined.
+func registerFlagCompletion(cmd *cobra.Command, name string, fn func(*cobra.Command, []string, string) ([]string, cobra.ShellCompDirective)) {
+	cobra.CheckErr(cmd.RegisterFlagCompletionFunc(name, fn))
+}
@@ -0,0 +1,37 @@
+package cmd_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompletion(t *testing.T) {
+	for _, shell := range []string{"bash", "zsh", "fish", "powershell"} {
+		exitCode, stdout, _ := execCmd(t, "go", "run", "../main.go", "completion", shell)
+		require.Equal(t, 0, exitCode, shell)
+		assert.NotEmpty(t, stdout, shell)
+	}
+	exitCode, _, stderr := execCmd(t, "go", "run", "../main.go", "completion", "tcsh")
+	assert.NotEqual(t, 0, exitCode)
+	assert.Contains(t, stderr, `invalid argument "tcsh"`)
+}
+
+func TestCompletion_Values(t *testing.T) {
+	complete := func(args ...string) []string {
+		args = append([]string{"run", "../main.go", "__complete"}, args...)
+		exitCode, stdout, _ := execCmd(t, "go", args...)
+		require.Equal(t, 0, exitCode, args)
+		// The last line is the completion directive.
+		lines := strings.Split(strings.TrimSpace(stdout), "\n")
+		return lines[:len(lines)-1]
+	}
+	assert.Equal(t, []string{"aptrust", "btr", "empty"}, complete("bag", "validate", "--profile", ""))
+	assert.Equal(t, []string{"json"}, complete("bag", "create", "--profile", "./"))
+	assert.Equal(t, []string{"tar", "directory", "zip", "tgz"}, complete("bag", "create", "--format", ""))
+	assert.Contains(t, complete("registry", "list", "files", ""), "intellectual_object_id=")
+	assert.Contains(t, complete("registry", "list", "workitems", ""), "per_page=")
+	assert.Contains(t, complete("--log-format", ""), "json")
+}
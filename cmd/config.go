@@ -1,15 +1,128 @@
 package cmd
 
-import "fmt"
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/APTrust/dart-runner/util"
+	"github.com/spf13/viper"
+)
+
+// ConfigFileKeys maps the names of Config's fields to the settings
+// they hold. In JSON, TOML and YAML config files, settings can go
+// under either name, so these are the same:
+//
+//	{ "AWSKey": "my-key" }
+//	{ "APTRUST_AWS_KEY": "my-key" }
+//
+// Keys are case-insensitive, as they are for all settings.
+var ConfigFileKeys = map[string]string{
+	"RegistryURL":         "APTRUST_REGISTRY_URL",
+	"RegistryAPIVersion":  "APTRUST_REGISTRY_API_VERSION",
+	"RegistryEmail":       "APTRUST_REGISTRY_EMAIL",
+	"RegistryAPIKey":      "APTRUST_REGISTRY_API_KEY",
+	"AWSKey":              "APTRUST_AWS_KEY",
+	"AWSSecret":           "APTRUST_AWS_SECRET",
+	"AWSSessionToken":     "APTRUST_AWS_SESSION_TOKEN",
+	"AWSRegion":           "APTRUST_AWS_REGION",
+	"S3Port":              "APTRUST_S3_PORT",
+	"S3Insecure":          "APTRUST_S3_INSECURE",
+	"S3PathStyle":         "APTRUST_S3_PATH_STYLE",
+	"DefaultManifestAlgs": "APTRUST_DEFAULT_MANIFEST_ALGS",
+	"DefaultTags":         "APTRUST_TAGS",
+}
+
+// SetConfigFileType tells v how to parse the config file at
+// pathToFile. Files ending in .json, .toml, .yaml or .yml, or any
+// other extension viper supports, are parsed in that format. Anything
+// else, such as the extensionless $HOME/.aptrust, is parsed as an env
+// file.
+func SetConfigFileType(v *viper.Viper, pathToFile string) {
+	ext := strings.TrimPrefix(filepath.Ext(pathToFile), ".")
+	if !util.StringListContains(viper.SupportedExts, strings.ToLower(ext)) {
+		v.SetConfigType("env")
+	}
+}
+
+// ApplyConfigFileKeys copies settings from v's config file that are
+// under the names in ConfigFileKeys to their APTRUST_ names, where
+// apt-cmd looks for them. Copied settings come from the config file, so
+// environment variables and flags still override them. This returns an
+// error if the file has a setting under both names.
+func ApplyConfigFileKeys(v *viper.Viper) error {
+	settings := make(map[string]interface{})
+	fieldNames := make([]string, 0, len(ConfigFileKeys))
+	for fieldName := range ConfigFileKeys {
+		fieldNames = append(fieldNames, fieldName)
+	}
+	sort.Strings(fieldNames)
+	for _, fieldName := range fieldNames {
+		if !v.InConfig(fieldName) {
+			continue
+		}
+		setting := ConfigFileKeys[fieldName]
+		if v.InConfig(setting) {
+			return fmt.Errorf("config file %s sets both %s and %s. Use just one.", v.ConfigFileUsed(), fieldName, setting)
+		}
+		settings[setting] = v.Get(fieldName)
+	}
+	if len(settings) == 0 {
+		return nil
+	}
+	return v.MergeConfigMap(settings)
+}
+
+// ConfigFileCandidates returns the config files apt-cmd looks for when
+// --config is absent, in order of precedence: .aptrust.env in dir,
+// .aptrust/config.env in home, and aptrust/config.env in
+// xdgConfigHome, which defaults to home/.config, as the XDG spec says.
+// The last is the .aptrust file in home, which older versions of
+// apt-cmd read.
+func ConfigFileCandidates(dir, home, xdgConfigHome string) []string {
+	if xdgConfigHome == "" {
+		xdgConfigHome = filepath.Join(home, ".config")
+	}
+	return []string{
+		filepath.Join(dir, ".aptrust.env"),
+		filepath.Join(home, ".aptrust", "config.env"),
+		filepath.Join(xdgConfigHome, "aptrust", "config.env"),
+		filepath.Join(home, ".aptrust"),
+	}
+}
+
+// FindConfigFile returns the first of the ConfigFileCandidates for the
+// current directory and the user's home that is a regular file, or an
+// empty string if there's none.
+func FindConfigFile() string {
+	dir, _ := os.Getwd()
+	home, _ := os.UserHomeDir()
+	for _, candidate := range ConfigFileCandidates(dir, home, os.Getenv("XDG_CONFIG_HOME")) {
+		if stat, err := os.Stat(candidate); err == nil && stat.Mode().IsRegular() {
+			return candidate
+		}
+	}
+	return ""
+}
 
 type Config struct {
-	RegistryURL        string
-	RegistryAPIVersion string
-	RegistryEmail      string
-	RegistryAPIKey     string
-	AWSKey             string
-	AWSSecret          string
-	ConfigSource       string
+	RegistryURL         string
+	RegistryAPIVersion  string
+	RegistryEmail       string
+	RegistryAPIKey      string
+	AWSKey              string
+	AWSSecret           string
+	AWSSessionToken     string
+	AWSRegion           string
+	S3Port              int
+	S3Insecure          bool
+	S3PathStyle         bool
+	DefaultManifestAlgs string
+	DefaultTags         []string
+	ConfigSource        string
 }
 
 func (config *Config) ValidateRegistryConfig() error {
@@ -48,19 +161,52 @@ func (config *Config) ValidateAWSCredentials() error {
 	return nil
 }
 
-func (config *Config) String() string {
-	regAPIKey := "[redacted]"
-	if config.RegistryAPIKey == "" {
-		regAPIKey = "MISSING!"
+// SecretMask replaces the hidden part of secrets in logged configs.
+const SecretMask = "****"
+
+// MaskSecret returns secret with all but its first four characters
+// replaced by SecretMask, so logs show which credentials were used
+// without revealing them. Secrets shorter than 16 characters are
+// masked entirely, since four characters would give away too much of
+// them. Empty secrets stay empty.
+func MaskSecret(secret string) string {
+	if secret == "" {
+		return ""
 	}
-	awsKey := "[redacted]"
-	if config.AWSKey == "" {
-		awsKey = "MISSING!"
+	if len(secret) < 16 {
+		return SecretMask
 	}
-	awsSecret := "[redacted]"
-	if config.AWSSecret == "" {
-		awsSecret = "MISSING!"
+	return secret[:4] + SecretMask
+}
+
+// Redacted returns a copy of config that's safe to log, with the
+// registry API key, AWS credentials and any password in the registry
+// URL masked.
+func (config Config) Redacted() Config {
+	redacted := config
+	redacted.RegistryAPIKey = MaskSecret(config.RegistryAPIKey)
+	redacted.AWSKey = MaskSecret(config.AWSKey)
+	redacted.AWSSecret = MaskSecret(config.AWSSecret)
+	redacted.AWSSessionToken = MaskSecret(config.AWSSessionToken)
+	if registryURL, err := url.Parse(config.RegistryURL); err == nil {
+		redacted.RegistryURL = registryURL.Redacted()
 	}
+	redacted.DefaultTags = append([]string{}, config.DefaultTags...)
+	return redacted
+}
+
+// String describes the config for debug logs, with secrets masked as
+// Redacted masks them. Required secrets that are empty show as
+// MISSING!. This has a value receiver, so configs and pointers to them
+// print the same way.
+func (config Config) String() string {
+	redacted := config.Redacted()
+	for _, secret := range []*string{&redacted.RegistryAPIKey, &redacted.AWSKey, &redacted.AWSSecret} {
+		if *secret == "" {
+			*secret = "MISSING!"
+		}
+	}
+	// Session tokens are optional. Only temporary credentials have one.
 	return fmt.Sprintf(`Configuration:
 	RegistryURL:             %s
 	RegistryAPIVersion:      %s
@@ -68,12 +214,56 @@ func (config *Config) String() string {
 	RegistryAPIKey:          %s
 	AWSKey:                  %s
 	AWSSecret:               %s
+	AWSSessionToken:         %s
+	AWSRegion:               %s
+	S3Port:                  %d
+	S3Insecure:              %t
+	S3PathStyle:             %t
+	DefaultManifestAlgs:     %s
+	DefaultTags:             %d
 	ConfigSource:            %s`,
-		config.RegistryURL,
-		config.RegistryAPIVersion,
-		config.RegistryEmail,
-		regAPIKey,
-		awsKey,
-		awsSecret,
-		config.ConfigSource)
+		redacted.RegistryURL,
+		redacted.RegistryAPIVersion,
+		redacted.RegistryEmail,
+		redacted.RegistryAPIKey,
+		redacted.AWSKey,
+		redacted.AWSSecret,
+		redacted.AWSSessionToken,
+		redacted.AWSRegion,
+		redacted.S3Port,
+		redacted.S3Insecure,
+		redacted.S3PathStyle,
+		redacted.DefaultManifestAlgs,
+		len(redacted.DefaultTags),
+		redacted.ConfigSource)
+}
+
+// GoString masks secrets for %#v, too.
+func (config Config) GoString() string {
+	return config.String()
+}
+
+// ConfigTagSpecs converts the APTRUST_TAGS config setting into a list
+// of tag specs in the same format as the --tags flag. In YAML, JSON and
+// TOML config files, the setting is a list of specs. In env-style config
+// files and environment variables, it's a string with one spec per line.
+// Blank lines and lines beginning with # are ignored.
+func ConfigTagSpecs(value interface{}) []string {
+	specs := make([]string, 0)
+	switch v := value.(type) {
+	case []interface{}:
+		for _, item := range v {
+			specs = append(specs, fmt.Sprint(item))
+		}
+	case []string:
+		specs = append(specs, v...)
+	case string:
+		for _, line := range strings.Split(v, "\n") {
+			line = strings.TrimSpace(line)
+			if line != "" && !strings.HasPrefix(line, "#") {
+				specs = append(specs, line)
+			}
+		}
+	}
+	return specs
 }
@@ -0,0 +1,244 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/APTrust/dart-runner/util"
+	"github.com/spf13/cobra"
+)
+
+// ConfigAreas are the feature areas config check reports on.
+var ConfigAreas = []string{"registry", "s3"}
+
+// configAreaFields are the Config fields each of ConfigAreas requires.
+var configAreaFields = map[string][]string{
+	"registry": {"RegistryURL", "RegistryAPIVersion", "RegistryEmail", "RegistryAPIKey"},
+	"s3":       {"AWSKey", "AWSSecret"},
+}
+
+// ConfigField says whether a required Config field is set. Setting is
+// the field's APTRUST_ name. We never report the value, since it may
+// be a secret.
+type ConfigField struct {
+	Name    string `json:"name"`
+	Setting string `json:"setting"`
+	Present bool   `json:"present"`
+}
+
+// ConnectionCheck is the result of a config check --test-connection
+// test. Error is empty if the test passed.
+type ConnectionCheck struct {
+	Target string `json:"target"`
+	OK     bool   `json:"ok"`
+	Error  string `json:"error,omitempty"`
+}
+
+// ConfigAreaCheck describes the settings for one of ConfigAreas. It's
+// complete if all of its fields are present. Connection is nil if the
+// connection wasn't tested.
+type ConfigAreaCheck struct {
+	Area       string           `json:"area"`
+	Complete   bool             `json:"complete"`
+	Fields     []*ConfigField   `json:"fields"`
+	Connection *ConnectionCheck `json:"connection,omitempty"`
+}
+
+// ConfigCheck is the JSON output of config check. Result is "OK",
+// "Incomplete" if any area is missing settings, or "ConnectionFailed"
+// if every area is complete but a connection test failed.
+type ConfigCheck struct {
+	Result       string             `json:"result"`
+	ConfigSource string             `json:"configSource"`
+	Areas        []*ConfigAreaCheck `json:"areas"`
+}
+
+// CheckConfig reports which of the fields required for each of areas
+// are set in config.
+func CheckConfig(config *Config, areas []string) *ConfigCheck {
+	check := &ConfigCheck{
+		Result:       "OK",
+		ConfigSource: config.ConfigSource,
+		Areas:        make([]*ConfigAreaCheck, 0, len(areas)),
+	}
+	values := map[string]bool{
+		"RegistryURL":        config.RegistryURL != "",
+		"RegistryAPIVersion": config.RegistryAPIVersion != "",
+		"RegistryEmail":      config.RegistryEmail != "",
+		"RegistryAPIKey":     config.RegistryAPIKey != "",
+		"AWSKey":             config.AWSKey != "",
+		"AWSSecret":          config.AWSSecret != "",
+	}
+	for _, area := range areas {
+		areaCheck := &ConfigAreaCheck{Area: area, Complete: true}
+		for _, name := range configAreaFields[area] {
+			field := &ConfigField{Name: name, Setting: ConfigFileKeys[name], Present: values[name]}
+			areaCheck.Fields = append(areaCheck.Fields, field)
+			if !field.Present {
+				areaCheck.Complete = false
+			}
+		}
+		check.Areas = append(check.Areas, areaCheck)
+	}
+	check.UpdateResult()
+	return check
+}
+
+// UpdateResult sets check.Result from its areas' fields and connection
+// tests.
+func (check *ConfigCheck) UpdateResult() {
+	check.Result = "OK"
+	for _, area := range check.Areas {
+		if !area.Complete {
+			check.Result = "Incomplete"
+			return
+		}
+		if area.Connection != nil && !area.Connection.OK {
+			check.Result = "ConnectionFailed"
+		}
+	}
+}
+
+// CheckRegistryConnection sends a HEAD request to the registry URL in
+// config. Any response other than a server error passes, since the
+// request doesn't include credentials.
+func CheckRegistryConnection(ctx context.Context, config *Config) *ConnectionCheck {
+	check := &ConnectionCheck{Target: config.Redacted().RegistryURL}
+	ctx, cancel := context.WithTimeout(ctx, DefaultRegistryTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, config.RegistryURL, nil)
+	if err != nil {
+		check.Error = err.Error()
+		return check
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		check.Error = err.Error()
+		return check
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 500 {
+		check.Error = fmt.Sprintf("registry returned %s", resp.Status)
+		return check
+	}
+	check.OK = true
+	return check
+}
+
+// CheckS3Connection checks that bucket exists on s3Host, using the
+// credentials and S3 settings in config.
+func CheckS3Connection(ctx context.Context, config *Config, s3Host, bucket string) *ConnectionCheck {
+	check := &ConnectionCheck{Target: s3Host + "/" + bucket}
+	if _, err := S3Endpoint(s3Host, config.S3Port); err != nil {
+		check.Error = err.Error()
+		return check
+	}
+	exists, err := NewS3Client(config, s3Host).BucketExists(ctx, bucket)
+	if err != nil {
+		check.Error = err.Error()
+		return check
+	}
+	if !exists {
+		check.Error = fmt.Sprintf("bucket %s does not exist", bucket)
+		return check
+	}
+	check.OK = true
+	return check
+}
+
+// configCmd represents the config command
+var configCmd = &cobra.Command{
+	Use:   "config",
+	Short: "Check apt-cmd's settings.",
+	Long:  `Check apt-cmd's settings. See subcommands for more info.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		fmt.Println("Check apt-cmd's settings. See subcommands for more info.")
+	},
+}
+
+var configCheckCmd = &cobra.Command{
+	Use:     "check",
+	Short:   "Report which required settings are present or missing",
+	Example: `apt-cmd config check --test-connection --host=s3.amazonaws.com --bucket=my-bucket`,
+	Long: `Load apt-cmd's settings, from --config or the default config file,
+with environment variables overriding the file, just as other commands
+do, and report which of the settings each feature area requires are
+present or missing. The areas are:
+
+    registry: RegistryURL, RegistryAPIVersion, RegistryEmail, RegistryAPIKey
+    s3:       AWSKey, AWSSecret
+
+The report never shows the settings' values. Use --area to check only
+some areas.
+
+Add --test-connection to check that the settings work, too. For the
+registry, we send a HEAD request to RegistryURL, which shows that the
+registry is reachable, though not that your API key is valid. For S3,
+we check that --bucket exists on --host, which requires valid
+credentials. Without --host and --bucket, we skip the S3 test. Areas
+with missing settings aren't tested.
+
+    apt-cmd config check --test-connection \
+        --host=s3.amazonaws.com --bucket=my-receiving-bucket
+
+The output is JSON, with a result of "OK", "Incomplete" if any settings
+are missing, or "ConnectionFailed" if a connection test failed. config
+check exits with status 3 if settings are missing, 4 if a connection
+test failed, and 0 otherwise.
+
+Full online documentation:
+
+https://aptrust.github.io/userguide/partner_tools/
+
+`,
+	Run: func(cmd *cobra.Command, args []string) {
+		areas, _ := cmd.Flags().GetStringSlice("area")
+		for _, area := range areas {
+			if !util.StringListContains(ConfigAreas, area) {
+				Failf(EXIT_USER_ERR, "Invalid --area '%s'. Use one or more of: %s", area, strings.Join(ConfigAreas, ", "))
+			}
+		}
+		s3Host := cmd.Flag("host").Value.String()
+		bucket := cmd.Flag("bucket").Value.String()
+		if (s3Host == "") != (bucket == "") {
+			Fail(EXIT_USER_ERR, "--host and --bucket must be used together.")
+		}
+		check := CheckConfig(config, areas)
+		if testConnection, _ := cmd.Flags().GetBool("test-connection"); testConnection {
+			for _, area := range check.Areas {
+				if !area.Complete {
+					continue
+				}
+				if area.Area == "registry" {
+					logger.Debugf("Testing connection to registry %s", config.Redacted().RegistryURL)
+					area.Connection = CheckRegistryConnection(cmd.Context(), config)
+				} else if area.Area == "s3" && s3Host != "" {
+					logger.Debugf("Testing connection to %s/%s", s3Host, bucket)
+					area.Connection = CheckS3Connection(cmd.Context(), config, s3Host, bucket)
+				}
+			}
+			ExitIfCanceled(cmd.Context())
+			check.UpdateResult()
+		}
+		printResult(check)
+		switch check.Result {
+		case "Incomplete":
+			os.Exit(EXIT_USER_ERR)
+		case "ConnectionFailed":
+			os.Exit(EXIT_REQUEST_ERROR)
+		}
+		os.Exit(EXIT_OK)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(configCmd)
+	configCmd.AddCommand(configCheckCmd)
+	configCheckCmd.Flags().StringSlice("area", ConfigAreas, "Feature areas to check: registry, s3, or both, separated by a comma")
+	configCheckCmd.Flags().Bool("test-connection", false, "Test the connection to the registry, and with --host and --bucket, to S3")
+	configCheckCmd.Flags().StringP("host", "H", "", "S3 host name for --test-connection. E.g. s3.amazonaws.com.")
+	configCheckCmd.Flags().StringP("bucket", "b", "", "Bucket that --test-connection checks for")
+}
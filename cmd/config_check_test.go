@@ -0,0 +1,88 @@
+package cmd_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/APTrust/apt-cmd/cmd"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckConfig(t *testing.T) {
+	check := cmd.CheckConfig(getTestConfig(true), cmd.ConfigAreas)
+	assert.Equal(t, "OK", check.Result)
+	assert.Equal(t, "getTestConfig", check.ConfigSource)
+	require.Equal(t, 2, len(check.Areas))
+	assert.Equal(t, "registry", check.Areas[0].Area)
+	assert.True(t, check.Areas[0].Complete)
+	assert.Equal(t, 4, len(check.Areas[0].Fields))
+	assert.Equal(t, "s3", check.Areas[1].Area)
+	assert.True(t, check.Areas[1].Complete)
+
+	config := getTestConfig(true)
+	config.AWSSecret = ""
+	check = cmd.CheckConfig(config, cmd.ConfigAreas)
+	assert.Equal(t, "Incomplete", check.Result)
+	assert.True(t, check.Areas[0].Complete)
+	assert.False(t, check.Areas[1].Complete)
+	assert.Equal(t, &cmd.ConfigField{Name: "AWSSecret", Setting: "APTRUST_AWS_SECRET", Present: false}, check.Areas[1].Fields[1])
+
+	// Only the areas we ask about count.
+	check = cmd.CheckConfig(config, []string{"registry"})
+	assert.Equal(t, "OK", check.Result)
+	assert.Equal(t, 1, len(check.Areas))
+
+	check = cmd.CheckConfig(getTestConfig(true), cmd.ConfigAreas)
+	check.Areas[0].Connection = &cmd.ConnectionCheck{Target: "http://localhost", Error: "oops"}
+	check.UpdateResult()
+	assert.Equal(t, "ConnectionFailed", check.Result)
+}
+
+func TestCheckRegistryConnection(t *testing.T) {
+	status := http.StatusUnauthorized
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, http.MethodHead, r.Method)
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+	config := getTestConfig(true)
+	config.RegistryURL = server.URL
+	check := cmd.CheckRegistryConnection(context.Background(), config)
+	assert.True(t, check.OK)
+	assert.Empty(t, check.Error)
+
+	status = http.StatusBadGateway
+	check = cmd.CheckRegistryConnection(context.Background(), config)
+	assert.False(t, check.OK)
+	assert.Contains(t, check.Error, "502")
+
+	server.Close()
+	check = cmd.CheckRegistryConnection(context.Background(), config)
+	assert.False(t, check.OK)
+	assert.NotEmpty(t, check.Error)
+}
+
+func TestConfigCheckCommand(t *testing.T) {
+	exitCode, stdout, _ := execCmd(t, "go", "run", "../main.go", "config", "check", "--config=../testconfig.env")
+	assert.Equal(t, cmd.EXIT_OK, exitCode)
+	check := &cmd.ConfigCheck{}
+	require.Nil(t, json.Unmarshal([]byte(stdout), check))
+	assert.Equal(t, "OK", check.Result)
+
+	configFile := filepath.Join(t.TempDir(), "config.env")
+	require.Nil(t, os.WriteFile(configFile, []byte("APTRUST_AWS_KEY=key\n"), 0600))
+	exitCode, stdout, _ = execCmd(t, "go", "run", "../main.go", "config", "check", "--config="+configFile)
+	assert.NotEqual(t, cmd.EXIT_OK, exitCode)
+	require.Nil(t, json.Unmarshal([]byte(stdout), check))
+	assert.Equal(t, "Incomplete", check.Result)
+	assert.NotContains(t, stdout, `"key"`)
+
+	_, _, stderr := execCmd(t, "go", "run", "../main.go", "config", "check", "--config=../testconfig.env", "--area=ftp")
+	assert.Contains(t, stderr, "Invalid --area 'ftp'")
+}
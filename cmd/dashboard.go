@@ -0,0 +1,363 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dustin/go-humanize"
+)
+
+// DashboardInterval is how often the dashboard redraws.
+const DashboardInterval = 500 * time.Millisecond
+
+// dashboardLogInterval is how often the dashboard writes a progress
+// line when it's not drawing to a terminal.
+const dashboardLogInterval = 10 * time.Second
+
+// Phase is one step of a long-running job, such as hashing or
+// uploading. Done and Total are byte counts, unless Unit is "files".
+type Phase struct {
+	Name     string
+	Unit     string
+	Total    int64
+	Done     int64
+	Started  time.Time
+	Finished time.Time
+}
+
+// IsStarted returns true if the phase has started.
+func (p *Phase) IsStarted() bool {
+	return !p.Started.IsZero()
+}
+
+// IsFinished returns true if the phase has finished.
+func (p *Phase) IsFinished() bool {
+	return !p.Finished.IsZero()
+}
+
+// Rate returns the phase's throughput in units per second.
+func (p *Phase) Rate(now time.Time) float64 {
+	if !p.IsStarted() {
+		return 0
+	}
+	end := now
+	if p.IsFinished() {
+		end = p.Finished
+	}
+	elapsed := end.Sub(p.Started).Seconds()
+	if elapsed <= 0 {
+		return 0
+	}
+	return float64(p.Done) / elapsed
+}
+
+// ETA returns the estimated time until the phase is finished, or
+// zero if we can't estimate it.
+func (p *Phase) ETA(now time.Time) time.Duration {
+	rate := p.Rate(now)
+	if rate <= 0 || p.Total <= p.Done || p.IsFinished() {
+		return 0
+	}
+	return time.Duration(float64(p.Total-p.Done)/rate) * time.Second
+}
+
+// Dashboard shows the progress of each phase of a long-running job.
+// When interactive is true, it redraws all phases in place, which
+// only makes sense on a terminal. Otherwise, it writes a plain line
+// of text when each phase starts and finishes, plus a progress line
+// every few seconds.
+//
+// Methods on a nil *Dashboard do nothing, so callers don't need to
+// check whether the user asked for one.
+type Dashboard struct {
+	out         io.Writer
+	interactive bool
+	phases      []*Phase
+	linesDrawn  int
+	lastLog     time.Time
+	mutex       sync.Mutex
+	stop        chan struct{}
+	stopped     bool
+}
+
+// NewDashboard returns a dashboard that tracks the named phases, in
+// the order given. Call Run to start drawing it.
+func NewDashboard(out io.Writer, interactive bool, phaseNames ...string) *Dashboard {
+	dashboard := &Dashboard{
+		out:         out,
+		interactive: interactive,
+		stop:        make(chan struct{}),
+	}
+	for _, name := range phaseNames {
+		dashboard.phases = append(dashboard.phases, &Phase{Name: name})
+	}
+	return dashboard
+}
+
+// IsTerminal returns true if file is a terminal.
+func IsTerminal(file *os.File) bool {
+	stat, err := file.Stat()
+	return err == nil && stat.Mode()&os.ModeCharDevice != 0
+}
+
+// Phase returns the named phase, or nil if there's no such phase.
+func (d *Dashboard) Phase(name string) *Phase {
+	if d == nil {
+		return nil
+	}
+	for _, phase := range d.phases {
+		if phase.Name == name {
+			return phase
+		}
+	}
+	return nil
+}
+
+// Start starts the named phase. Param total is the number of bytes
+// or files the phase will process, or zero if that's unknown.
+func (d *Dashboard) Start(name, unit string, total int64) {
+	if d == nil {
+		return
+	}
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	phase := d.Phase(name)
+	if phase == nil {
+		return
+	}
+	phase.Unit = unit
+	phase.Total = total
+	phase.Done = 0
+	phase.Started = time.Now()
+	phase.Finished = time.Time{}
+	if !d.interactive {
+		fmt.Fprintf(d.out, "%s: started%s\n", name, phase.totalString())
+	}
+}
+
+// Set sets the number of bytes or files the named phase has
+// processed.
+func (d *Dashboard) Set(name string, done int64) {
+	if d == nil {
+		return
+	}
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if phase := d.Phase(name); phase != nil {
+		phase.Done = done
+	}
+}
+
+// Add adds n to the number of bytes or files the named phase has
+// processed.
+func (d *Dashboard) Add(name string, n int64) {
+	if d == nil {
+		return
+	}
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if phase := d.Phase(name); phase != nil {
+		phase.Done += n
+	}
+}
+
+// Finish marks the named phase as finished, with done bytes or files
+// processed, and redraws the dashboard.
+func (d *Dashboard) Finish(name string, done int64) {
+	if d == nil {
+		return
+	}
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	phase := d.Phase(name)
+	if phase == nil {
+		return
+	}
+	phase.Done = done
+	if phase.Total < done {
+		phase.Total = done
+	}
+	phase.Finished = time.Now()
+	if d.interactive {
+		d.draw()
+	} else {
+		fmt.Fprintln(d.out, phase.plainLine(time.Now()))
+	}
+}
+
+// Run redraws the dashboard every DashboardInterval until Stop is
+// called.
+func (d *Dashboard) Run() {
+	if d == nil {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(DashboardInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-d.stop:
+				return
+			case <-ticker.C:
+				d.mutex.Lock()
+				d.update()
+				d.mutex.Unlock()
+			}
+		}
+	}()
+}
+
+// Stop stops redrawing the dashboard. It doesn't redraw, so it won't
+// overwrite any error messages printed after the last redraw. It's
+// safe to call Stop more than once.
+func (d *Dashboard) Stop() {
+	if d == nil {
+		return
+	}
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if !d.stopped {
+		d.stopped = true
+		close(d.stop)
+	}
+}
+
+// Render returns the dashboard's current text, one line per phase.
+func (d *Dashboard) Render() string {
+	if d == nil {
+		return ""
+	}
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return d.render(time.Now())
+}
+
+// update redraws or logs progress. Caller must hold the mutex.
+func (d *Dashboard) update() {
+	if d.stopped {
+		return
+	}
+	now := time.Now()
+	if d.interactive {
+		d.draw()
+		return
+	}
+	if now.Sub(d.lastLog) < dashboardLogInterval {
+		return
+	}
+	d.lastLog = now
+	for _, phase := range d.phases {
+		if phase.IsStarted() && !phase.IsFinished() {
+			fmt.Fprintln(d.out, phase.plainLine(now))
+		}
+	}
+}
+
+// draw redraws the dashboard in place. Caller must hold the mutex.
+func (d *Dashboard) draw() {
+	if d.linesDrawn > 0 {
+		// Move the cursor back to the top of the dashboard.
+		fmt.Fprintf(d.out, "\033[%dA", d.linesDrawn)
+	}
+	text := d.render(time.Now())
+	for _, line := range strings.Split(text, "\n") {
+		fmt.Fprintf(d.out, "\r%s\033[K\n", line)
+	}
+	d.linesDrawn = len(d.phases)
+}
+
+func (d *Dashboard) render(now time.Time) string {
+	lines := make([]string, len(d.phases))
+	for i, phase := range d.phases {
+		lines[i] = phase.dashboardLine(now)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// percent returns the percentage of the phase that's done, or -1
+// if the total is unknown.
+func (p *Phase) percent() int {
+	if p.IsFinished() {
+		return 100
+	}
+	if p.Total <= 0 {
+		return -1
+	}
+	pct := int(p.Done * 100 / p.Total)
+	if pct > 99 {
+		pct = 99
+	}
+	return pct
+}
+
+func (p *Phase) amount(n int64) string {
+	if p.Unit == "files" {
+		return humanize.Comma(n) + " files"
+	}
+	return FormatSize(n, sizeUnits)
+}
+
+func (p *Phase) totalString() string {
+	if p.Total <= 0 {
+		return ""
+	}
+	return " (" + p.amount(p.Total) + ")"
+}
+
+func (p *Phase) status(now time.Time) string {
+	if !p.IsStarted() {
+		return "waiting"
+	}
+	progress := p.amount(p.Done)
+	if p.Total > 0 && !p.IsFinished() {
+		progress += " of " + p.amount(p.Total)
+	}
+	rate := p.Rate(now)
+	if p.Unit == "files" {
+		progress += fmt.Sprintf(", %.0f files/s", rate)
+	} else {
+		progress += ", " + FormatSize(int64(rate), sizeUnits) + "/s"
+	}
+	if p.IsFinished() {
+		return progress + ", done in " + p.Finished.Sub(p.Started).Round(time.Second).String()
+	}
+	if eta := p.ETA(now); eta > 0 {
+		progress += ", ETA " + eta.Round(time.Second).String()
+	}
+	return progress
+}
+
+func (p *Phase) dashboardLine(now time.Time) string {
+	const barWidth = 20
+	bar := strings.Repeat(".", barWidth)
+	pctString := "    "
+	if pct := p.percent(); pct >= 0 {
+		filled := pct * barWidth / 100
+		bar = strings.Repeat("#", filled) + strings.Repeat(".", barWidth-filled)
+		pctString = fmt.Sprintf("%3d%%", pct)
+	}
+	return fmt.Sprintf("%-10s [%s] %s  %s", p.Name, bar, pctString, p.status(now))
+}
+
+func (p *Phase) plainLine(now time.Time) string {
+	if pct := p.percent(); pct >= 0 {
+		return fmt.Sprintf("%s: %d%% (%s)", p.Name, pct, p.status(now))
+	}
+	return fmt.Sprintf("%s: %s", p.Name, p.status(now))
+}
+
+// progressReader counts bytes for a dashboard phase. The minio client
+// reads from PutObjectOptions.Progress as many bytes as it uploads.
+type progressReader struct {
+	dashboard *Dashboard
+	phase     string
+}
+
+func (r *progressReader) Read(p []byte) (int, error) {
+	r.dashboard.Add(r.phase, int64(len(p)))
+	return len(p), nil
+}
@@ -0,0 +1,72 @@
+package cmd_test
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/APTrust/apt-cmd/cmd"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDashboard(t *testing.T) {
+	out := &bytes.Buffer{}
+	dashboard := cmd.NewDashboard(out, true, "walking", "hashing", "uploading")
+	lines := strings.Split(dashboard.Render(), "\n")
+	require.Len(t, lines, 3)
+	for _, line := range lines {
+		assert.Contains(t, line, "waiting")
+	}
+
+	dashboard.Start("walking", "files", 0)
+	dashboard.Finish("walking", 1234)
+	dashboard.Start("hashing", "bytes", 4000)
+	dashboard.Add("hashing", 1000)
+	dashboard.Add("hashing", 1000)
+
+	lines = strings.Split(dashboard.Render(), "\n")
+	assert.Contains(t, lines[0], "walking")
+	assert.Contains(t, lines[0], "100%")
+	assert.Contains(t, lines[0], "1,234 files")
+	assert.Contains(t, lines[0], "done in")
+	assert.Contains(t, lines[1], "[##########..........]  50%")
+	assert.Contains(t, lines[1], "2.0 kB of 4.0 kB")
+	assert.Contains(t, lines[2], "waiting")
+
+	// Finish draws the dashboard on a terminal.
+	assert.Contains(t, out.String(), "walking")
+	assert.Contains(t, out.String(), "\033[K")
+
+	phase := dashboard.Phase("hashing")
+	require.NotNil(t, phase)
+	assert.True(t, phase.IsStarted())
+	assert.False(t, phase.IsFinished())
+	assert.Nil(t, dashboard.Phase("no-such-phase"))
+
+	dashboard.Stop()
+	dashboard.Stop()
+}
+
+func TestDashboard_Plain(t *testing.T) {
+	out := &bytes.Buffer{}
+	dashboard := cmd.NewDashboard(out, false, "hashing")
+	dashboard.Start("hashing", "bytes", 2000)
+	dashboard.Set("hashing", 500)
+	dashboard.Finish("hashing", 2000)
+	assert.Equal(t, "hashing: started (2.0 kB)\n", strings.SplitAfter(out.String(), "\n")[0])
+	assert.Contains(t, out.String(), "hashing: 100% (2.0 kB")
+	assert.NotContains(t, out.String(), "\033")
+}
+
+func TestDashboard_Nil(t *testing.T) {
+	// A nil dashboard does nothing, and doesn't panic.
+	var dashboard *cmd.Dashboard
+	dashboard.Run()
+	dashboard.Start("hashing", "bytes", 10)
+	dashboard.Add("hashing", 5)
+	dashboard.Finish("hashing", 10)
+	dashboard.Stop()
+	assert.Empty(t, dashboard.Render())
+	assert.Nil(t, dashboard.Phase("hashing"))
+}
@@ -0,0 +1,265 @@
+package cmd
+
+import (
+	"archive/tar"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/APTrust/dart-runner/constants"
+
+	"github.com/APTrust/dart-runner/util"
+	"golang.org/x/crypto/sha3"
+)
+
+// Manifest algorithms that we support but the bagger and validator
+// don't. We write and check these manifests ourselves.
+const (
+	AlgSha3_256 = "sha3-256"
+	AlgSha3_512 = "sha3-512"
+)
+
+// ExtraManifestAlgorithms lists the manifest algorithms in
+// SupportedManifestAlgorithms that the bagger can't calculate.
+var ExtraManifestAlgorithms = []string{
+	AlgSha3_256,
+	AlgSha3_512,
+}
+
+// GetHashes returns a hash for each of algs that we support, keyed by
+// algorithm. Unlike util.GetHashes, this includes the
+// ExtraManifestAlgorithms.
+func GetHashes(algs []string) map[string]hash.Hash {
+	hashes := util.GetHashes(algs)
+	if util.StringListContains(algs, AlgSha3_256) {
+		hashes[AlgSha3_256] = sha3.New256()
+	}
+	if util.StringListContains(algs, AlgSha3_512) {
+		hashes[AlgSha3_512] = sha3.New512()
+	}
+	return hashes
+}
+
+// BaggerAlgorithms returns the algorithms in algs that the bagger can
+// calculate, leaving out the ExtraManifestAlgorithms.
+func BaggerAlgorithms(algs []string) []string {
+	baggerAlgs := make([]string, 0, len(algs))
+	for _, alg := range algs {
+		if !util.StringListContains(ExtraManifestAlgorithms, alg) {
+			baggerAlgs = append(baggerAlgs, alg)
+		}
+	}
+	return baggerAlgs
+}
+
+// WriteManifests makes the manifests and tag manifests in a tarred bag
+// match manifestAlgs and tagManifestAlgs. The bagger can't write
+// manifests for the ExtraManifestAlgorithms, so we bag with the other
+// algorithms, or with a single stand-in algorithm, then call this to
+// add the missing manifests and remove the stand-in. Changing the
+// manifests changes the tag manifests, so this rewrites all of them.
+// Like RewriteManifestEncoding, this writes a new tar file next to the
+// original, then replaces the original. It does nothing if the bag
+// already has the right manifests.
+func WriteManifests(pathToTar string, manifestAlgs, tagManifestAlgs []string) error {
+	manifests, err := readManifests(pathToTar)
+	if err != nil {
+		return err
+	}
+	var remove, missing []string
+	changed := false
+	for name := range manifests {
+		match := manifestRegex.FindStringSubmatch(name)
+		wanted := manifestAlgs
+		if match[1] == "tag" {
+			wanted = tagManifestAlgs
+		}
+		if !util.StringListContains(wanted, match[2]) {
+			remove = append(remove, name)
+			changed = true
+		}
+	}
+	for _, alg := range manifestAlgs {
+		if _, ok := manifests["manifest-"+alg+".txt"]; !ok {
+			missing = append(missing, alg)
+			changed = true
+		}
+	}
+	for _, alg := range tagManifestAlgs {
+		if _, ok := manifests["tagmanifest-"+alg+".txt"]; !ok {
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+
+	// Calculate the missing payload digests, and the digests of the tag
+	// files and manifests we're keeping.
+	payloadDigests, tagDigests, err := tarDigests(pathToTar, missing, tagManifestAlgs, remove)
+	if err != nil {
+		return err
+	}
+	replacements := make(map[string][]byte)
+	for _, alg := range missing {
+		name := "manifest-" + alg + ".txt"
+		replacements[name] = manifestContents(payloadDigests[alg])
+		hashes := GetHashes(tagManifestAlgs)
+		for _, tagAlg := range tagManifestAlgs {
+			hashes[tagAlg].Write(replacements[name])
+			tagDigests[tagAlg][name] = fmt.Sprintf("%x", hashes[tagAlg].Sum(nil))
+		}
+	}
+	for _, alg := range tagManifestAlgs {
+		replacements["tagmanifest-"+alg+".txt"] = manifestContents(tagDigests[alg])
+	}
+
+	tmpPath := pathToTar + ".tmp"
+	err = copyTarReplacing(pathToTar, tmpPath, replacements, remove)
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return os.Rename(tmpPath, pathToTar)
+}
+
+// tarDigests reads the tarred bag at pathToTar, and returns the digests
+// of its payload files with each of payloadAlgs, and of its tag files
+// and payload manifests with each of tagAlgs, keyed by algorithm and
+// then by path in the bag. It skips tag manifests and the files in
+// skip.
+func tarDigests(pathToTar string, payloadAlgs, tagAlgs, skip []string) (map[string]map[string]string, map[string]map[string]string, error) {
+	payloadDigests := make(map[string]map[string]string)
+	for _, alg := range payloadAlgs {
+		payloadDigests[alg] = make(map[string]string)
+	}
+	tagDigests := make(map[string]map[string]string)
+	for _, alg := range tagAlgs {
+		tagDigests[alg] = make(map[string]string)
+	}
+	file, err := os.Open(pathToTar)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer file.Close()
+	reader := tar.NewReader(file)
+	for {
+		header, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		if header.Typeflag != tar.TypeReg && header.Typeflag != tar.TypeRegA {
+			continue
+		}
+		pathInBag, err := util.TarPathToBagPath(header.Name)
+		if err != nil || util.StringListContains(skip, pathInBag) {
+			continue
+		}
+		digests := tagDigests
+		algs := tagAlgs
+		switch util.BagFileType(pathInBag) {
+		case constants.FileTypeTagManifest:
+			continue
+		case constants.FileTypePayload:
+			digests = payloadDigests
+			algs = payloadAlgs
+		}
+		if len(algs) == 0 {
+			continue
+		}
+		hashes := GetHashes(algs)
+		writers := make([]io.Writer, len(algs))
+		for i, alg := range algs {
+			writers[i] = hashes[alg]
+		}
+		if _, err = io.Copy(io.MultiWriter(writers...), reader); err != nil {
+			return nil, nil, fmt.Errorf("can't read %s: %w", pathInBag, err)
+		}
+		for _, alg := range algs {
+			digests[alg][pathInBag] = fmt.Sprintf("%x", hashes[alg].Sum(nil))
+		}
+	}
+	return payloadDigests, tagDigests, nil
+}
+
+// manifestContents returns a manifest listing digests, which maps paths
+// in the bag to digests, sorted by path, as the bagger writes them.
+func manifestContents(digests map[string]string) []byte {
+	paths := make([]string, 0, len(digests))
+	for pathInBag := range digests {
+		paths = append(paths, pathInBag)
+	}
+	sort.Strings(paths)
+	var out strings.Builder
+	for _, pathInBag := range paths {
+		fmt.Fprintf(&out, "%s  %s\n", digests[pathInBag], pathInBag)
+	}
+	return []byte(out.String())
+}
+
+// parseManifest returns the digests in a manifest, keyed by path in the
+// bag. It's the reverse of manifestContents.
+func parseManifest(data []byte) map[string]string {
+	digests := make(map[string]string)
+	for _, line := range strings.Split(string(data), "\n") {
+		if match := manifestLineRegex.FindStringSubmatch(strings.TrimRight(line, "\r")); match != nil {
+			digests[strings.TrimSpace(match[2])] = match[1]
+		}
+	}
+	return digests
+}
+
+// updateTagManifests recalculates the digests of the files in
+// replacements, which maps paths in the bag to new contents, in each
+// tag manifest in manifests that lists them, and adds the updated tag
+// manifests to replacements. Param manifests maps the paths of a bag's
+// manifests and tag manifests to their contents, as readManifests
+// returns them. The digests must be hex.
+func updateTagManifests(manifests map[string][]byte, replacements map[string][]byte) error {
+	updated := make(map[string][]byte)
+	for name, data := range manifests {
+		match := manifestRegex.FindStringSubmatch(name)
+		if match == nil || match[1] != "tag" {
+			continue
+		}
+		if replacement, ok := replacements[name]; ok {
+			data = replacement
+		}
+		digests := parseManifest(data)
+		changed := false
+		for pathInBag, contents := range replacements {
+			if _, listed := digests[pathInBag]; !listed {
+				continue
+			}
+			digest, err := hexDigest(match[2], contents)
+			if err != nil {
+				return err
+			}
+			digests[pathInBag] = digest
+			changed = true
+		}
+		if changed {
+			updated[name] = manifestContents(digests)
+		}
+	}
+	for name, data := range updated {
+		replacements[name] = data
+	}
+	return nil
+}
+
+// hexDigest returns the hex digest of data with algorithm alg.
+func hexDigest(alg string, data []byte) (string, error) {
+	hashes := GetHashes([]string{alg})
+	if hashes[alg] == nil {
+		return "", fmt.Errorf("unsupported algorithm %s", alg)
+	}
+	hashes[alg].Write(data)
+	return fmt.Sprintf("%x", hashes[alg].Sum(nil)), nil
+}
@@ -0,0 +1,27 @@
+package cmd_test
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/APTrust/apt-cmd/cmd"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetHashes(t *testing.T) {
+	hashes := cmd.GetHashes([]string{"md5", "sha3-256", "sha3-512"})
+	require.Equal(t, 3, len(hashes))
+	for _, hash := range hashes {
+		hash.Write([]byte("data"))
+	}
+	assert.Equal(t, "8d777f385d3dfec8815d20f7496026dc", fmt.Sprintf("%x", hashes["md5"].Sum(nil)))
+	assert.Equal(t, "efda893aa850b0c0e61f33325615b9d93bcf6b42d60d8f5d37ebc720fd4e3daf", fmt.Sprintf("%x", hashes["sha3-256"].Sum(nil)))
+	assert.Equal(t, "ceca4daf960c2bbfb4a9edaca9b8137a801b65bae377e0f534ef9141c8684c0fedc1768d1afde9766572846c42b935f61177eaf97d355fa8dc2bca3fecfa754d", fmt.Sprintf("%x", hashes["sha3-512"].Sum(nil)))
+	assert.Empty(t, cmd.GetHashes([]string{"sha224"}))
+}
+
+func TestBaggerAlgorithms(t *testing.T) {
+	assert.Equal(t, []string{"md5", "sha256"}, cmd.BaggerAlgorithms([]string{"md5", "sha3-256", "sha256", "sha3-512"}))
+	assert.Empty(t, cmd.BaggerAlgorithms([]string{"sha3-256"}))
+}
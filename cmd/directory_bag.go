@@ -0,0 +1,363 @@
+package cmd
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/APTrust/dart-runner/bagit"
+	"github.com/APTrust/dart-runner/constants"
+	"github.com/APTrust/dart-runner/util"
+)
+
+// BagReader reads a bag into a validator. The validator's own readers
+// handle only tarred bags, and only the algorithms util.GetHashes
+// supports, so this does the same work as the validator's
+// TarredBagReader for unserialized bags, which are plain directories,
+// and for bags with manifests in the ExtraManifestAlgorithms. It
+// records the same file maps, tags and checksums, so the validator
+// reports problems the same way for every bag.
+type BagReader struct {
+	validator *bagit.Validator
+	walk      func(fn bagFileFunc) error
+
+	// Fetched lists the payload files in fetch.txt that aren't in the
+	// bag. ScanMetadata sets it. FetchedLengthUnknown is true if any of
+	// them has an unknown length, so the Payload-Oxum can't be checked.
+	Fetched              []string
+	FetchedLengthUnknown bool
+
+	// PayloadDir is the name of the bag's payload directory, if it
+	// isn't data. The reader gives the validator paths in data/ instead,
+	// since that's the only payload directory it knows.
+	PayloadDir string
+}
+
+// bagFileFunc handles one regular file in a bag. Its path in the bag
+// always uses forward slashes, as in the manifests. The reader holds
+// the file's contents, and is valid only until the function returns.
+type bagFileFunc func(pathInBag string, size int64, reader io.Reader) error
+
+// NewDirectoryBagReader returns a reader for the unserialized bag in
+// the directory at validator.PathToBag.
+func NewDirectoryBagReader(validator *bagit.Validator) *BagReader {
+	r := &BagReader{validator: validator}
+	r.walk = r.walkDirectory
+	return r
+}
+
+// NewTarredBagReader returns a reader for the tarred, gzipped tar or
+// zipped bag at validator.PathToBag.
+func NewTarredBagReader(validator *bagit.Validator) *BagReader {
+	r := &BagReader{validator: validator}
+	r.walk = r.walkTar
+	return r
+}
+
+// ScanBag does what validator.ScanBag does: it scans the bag's tag
+// files and manifests, then checks the Payload-Oxum, and if that
+// matches, or if validator.IgnoreOxumMismatch is set, it calculates
+// checksums for every file. See checkPayloadOxum.
+func (r *BagReader) ScanBag() error {
+	if err := r.ScanMetadata(); err != nil {
+		return err
+	}
+	if !r.validator.IgnoreOxumMismatch {
+		if err := r.checkPayloadOxum(); err != nil {
+			return err
+		}
+	}
+	return r.ScanPayload()
+}
+
+// checkPayloadOxum does what validator.AssertOxumsMatch does, but says
+// how the payload differs from the Payload-Oxum. It's a quick check,
+// since it needs only the files' sizes, so a bag with missing or extra
+// files fails before we calculate any checksums. A bag without a
+// Payload-Oxum passes, since the tag is optional.
+func (r *BagReader) checkPayloadOxum() error {
+	tags := r.validator.GetTags("bag-info.txt", "Payload-Oxum")
+	payload := r.validator.PayloadFiles
+	if len(tags) == 0 || payload.Oxum() == tags[0].Value {
+		return nil
+	}
+	err := fmt.Errorf("Payload-Oxum does not match payload: bag-info.txt says %s, but the payload has %d bytes in %d files", tags[0].Value, payload.TotalBytes(), payload.FileCount())
+	r.validator.Errors["Payload-Oxum"] = err.Error()
+	return err
+}
+
+// ScanMetadata records every file in the bag, and parses its manifests
+// and tag files.
+func (r *BagReader) ScanMetadata() error {
+	present := make(map[string]bool)
+	var fetchEntries []*FetchEntry
+	err := r.walkPayloadDir(func(pathInBag string, size int64, reader io.Reader) error {
+		fileType := util.BagFileType(pathInBag)
+		var err error
+		switch fileType {
+		case constants.FileTypePayload:
+			present[pathInBag] = true
+		case constants.FileTypeManifest:
+			err = r.parseManifest(reader, pathInBag, r.validator.PayloadFiles)
+		case constants.FileTypeTagManifest:
+			err = r.parseManifest(reader, pathInBag, r.validator.TagFiles)
+		case constants.FileTypeTag:
+			if pathInBag == FetchTxtFile {
+				fetchEntries = r.parseFetchTxt(reader)
+			} else {
+				r.parseTagFile(reader, pathInBag)
+			}
+		}
+		addOrUpdateFileRecord(r.validator.MapForPath(pathInBag), pathInBag, size)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	r.findFetchedFiles(fetchEntries, present)
+	return nil
+}
+
+// parseFetchTxt parses fetch.txt, and records an error if it can't.
+func (r *BagReader) parseFetchTxt(reader io.Reader) []*FetchEntry {
+	data, err := io.ReadAll(reader)
+	if err == nil {
+		var entries []*FetchEntry
+		if entries, err = ParseFetchTxt(data); err == nil {
+			return entries
+		}
+	}
+	r.validator.Errors[FetchTxtFile] = err.Error()
+	return nil
+}
+
+// findFetchedFiles sets r.Fetched to the files in fetchEntries that
+// aren't in the bag. Since the Payload-Oxum counts those files, it
+// records their sizes from fetch.txt. Every file in fetch.txt must be
+// in the payload manifests.
+func (r *BagReader) findFetchedFiles(fetchEntries []*FetchEntry, present map[string]bool) {
+	for _, entry := range fetchEntries {
+		if r.PayloadDir != "" {
+			entry.Path, _ = inPayloadDir(entry.Path, r.PayloadDir)
+		}
+		if present[entry.Path] {
+			continue
+		}
+		fileRecord := r.validator.PayloadFiles.Files[entry.Path]
+		if fileRecord == nil {
+			r.validator.Errors[FetchTxtFile] = fmt.Sprintf("%s lists %s, which is not in the payload manifests", FetchTxtFile, entry.Path)
+			continue
+		}
+		if entry.Length < 0 {
+			r.FetchedLengthUnknown = true
+			r.validator.IgnoreOxumMismatch = true
+		} else {
+			fileRecord.Size = entry.Length
+		}
+		r.Fetched = append(r.Fetched, entry.Path)
+	}
+}
+
+// ScanPayload calculates checksums for every file in the bag, using
+// the algorithms of the bag's manifests and tag manifests.
+func (r *BagReader) ScanPayload() error {
+	err := r.walkPayloadDir(func(pathInBag string, size int64, reader io.Reader) error {
+		fileRecord := addOrUpdateFileRecord(r.validator.MapForPath(pathInBag), pathInBag, size)
+		fileType := util.BagFileType(pathInBag)
+		var algs []string
+		var err error
+		if fileType == constants.FileTypePayload {
+			algs, err = r.validator.PayloadManifestAlgs()
+		} else {
+			algs, err = r.validator.TagManifestAlgs()
+		}
+		if err != nil {
+			return err
+		}
+		return addFileChecksums(reader, pathInBag, fileRecord, algs)
+	})
+	if err != nil {
+		return err
+	}
+	// As in the tarred bag reader, payload manifests' checksums from
+	// tag manifests belong in the tag file map as well.
+	for name, fileRecord := range r.validator.PayloadManifests.Files {
+		if tagFileRecord := r.validator.TagFiles.Files[name]; tagFileRecord != nil {
+			tagFileRecord.Size = fileRecord.Size
+			tagFileRecord.Checksums = append(tagFileRecord.Checksums, fileRecord.Checksums...)
+		}
+	}
+	return nil
+}
+
+// Close is here for symmetry with the validator's bag readers. There's
+// nothing to close, since we open and close the bag on each scan.
+func (r *BagReader) Close() {}
+
+// walkDirectory calls fn for each regular file in the bag's directory.
+// It skips directories, symlinks and other special files, as the
+// tarred bag reader does.
+func (r *BagReader) walkDirectory(fn bagFileFunc) error {
+	return filepath.Walk(r.validator.PathToBag, func(pathToFile string, info fs.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		relPath, err := filepath.Rel(r.validator.PathToBag, pathToFile)
+		if err != nil {
+			return err
+		}
+		file, err := os.Open(pathToFile)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		return fn(filepath.ToSlash(relPath), info.Size(), file)
+	})
+}
+
+// walkPayloadDir calls r.walk, giving fn the paths of files in
+// r.PayloadDir as if they were in data/. It returns an error if the bag
+// has files in data/ as well, since the bagit validator couldn't tell
+// them apart.
+func (r *BagReader) walkPayloadDir(fn bagFileFunc) error {
+	if r.PayloadDir == "" || r.PayloadDir == DefaultPayloadDir {
+		return r.walk(fn)
+	}
+	return r.walk(func(pathInBag string, size int64, reader io.Reader) error {
+		if strings.HasPrefix(pathInBag, DefaultPayloadDir+"/") {
+			return fmt.Errorf("bag has a %s directory, but its payload directory is %s", DefaultPayloadDir, r.PayloadDir)
+		}
+		pathInBag, _ = inPayloadDir(pathInBag, r.PayloadDir)
+		return fn(pathInBag, size, reader)
+	})
+}
+
+// walkTar calls fn for each regular file in the tarred, gzipped tar or
+// zipped bag. It skips links and other special files, as the
+// validator's tarred bag reader does.
+func (r *BagReader) walkTar(fn bagFileFunc) error {
+	return walkArchiveEntries(r.validator.PathToBag, func(entry *archiveEntry, reader io.Reader) error {
+		if entry.Typeflag != tar.TypeReg {
+			return nil
+		}
+		pathInBag, err := util.TarPathToBagPath(entry.Name)
+		if err != nil {
+			return err
+		}
+		return fn(pathInBag, entry.Size, reader)
+	})
+}
+
+func (r *BagReader) parseManifest(reader io.Reader, pathInBag string, fileMap *bagit.FileMap) error {
+	alg, err := util.AlgorithmFromManifestName(pathInBag)
+	if err != nil {
+		return err
+	}
+	entries, err := bagit.ParseManifest(reader)
+	if err != nil {
+		return err
+	}
+	for filePath, digest := range entries {
+		if fileMap == r.validator.PayloadFiles && r.PayloadDir != "" && r.PayloadDir != DefaultPayloadDir {
+			var ok bool
+			if filePath, ok = inPayloadDir(filePath, r.PayloadDir); !ok {
+				return fmt.Errorf("%s lists %s, which is not in payload directory %s", pathInBag, filePath, r.PayloadDir)
+			}
+		}
+		fileRecord := addOrUpdateFileRecord(fileMap, filePath, -1)
+		fileRecord.AddChecksum(constants.FileTypeManifest, alg, digest)
+	}
+	return nil
+}
+
+// parseTagFile parses .txt tag files, and records the ones it can't
+// parse. The validator decides later whether that's an error.
+func (r *BagReader) parseTagFile(reader io.Reader, pathInBag string) {
+	if !strings.HasSuffix(pathInBag, ".txt") {
+		return
+	}
+	tags, err := bagit.ParseTagFile(reader, pathInBag)
+	if err != nil {
+		r.validator.UnparsableTagFiles = append(r.validator.UnparsableTagFiles, pathInBag)
+		return
+	}
+	r.validator.Tags = append(r.validator.Tags, tags...)
+}
+
+// addOrUpdateFileRecord returns the record for pathInBag in fileMap,
+// adding one if necessary. A size of -1 means we found the file in a
+// manifest, and don't know its size yet.
+func addOrUpdateFileRecord(fileMap *bagit.FileMap, pathInBag string, size int64) *bagit.FileRecord {
+	fileRecord := fileMap.Files[pathInBag]
+	if fileRecord == nil {
+		fileRecord = bagit.NewFileRecord()
+		fileMap.Files[pathInBag] = fileRecord
+	}
+	if size >= 0 {
+		fileRecord.Size = size
+	}
+	return fileRecord
+}
+
+// addFileChecksums calculates the checksums of the file in reader with
+// each of algs in a single read, and adds them to fileRecord.
+func addFileChecksums(reader io.Reader, pathInBag string, fileRecord *bagit.FileRecord, algs []string) error {
+	hashes := GetHashes(algs)
+	writers := make([]io.Writer, 0, len(algs))
+	for _, alg := range algs {
+		if hashes[alg] == nil {
+			return fmt.Errorf("can't check %s: unsupported manifest algorithm %s", pathInBag, alg)
+		}
+		writers = append(writers, hashes[alg])
+	}
+	if _, err := io.Copy(io.MultiWriter(writers...), reader); err != nil {
+		return fmt.Errorf("can't read %s: %w", pathInBag, err)
+	}
+	// Manifests count as tag files here, because their checksums
+	// appear in tag manifests.
+	fileType := util.BagFileType(pathInBag)
+	if strings.Contains(fileType, "manifest") {
+		fileType = constants.FileTypeTag
+	}
+	for _, alg := range algs {
+		fileRecord.AddChecksum(fileType, alg, fmt.Sprintf("%x", hashes[alg].Sum(nil)))
+	}
+	return nil
+}
+
+// readDirectoryTagFiles returns the contents of all tag files in the
+// unserialized bag at pathToBag, keyed by their paths within the bag.
+// It skips the payload directory, payloadDir.
+func readDirectoryTagFiles(pathToBag, payloadDir string) (map[string][]byte, error) {
+	tagFiles := make(map[string][]byte)
+	err := filepath.Walk(pathToBag, func(pathToFile string, info fs.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		relPath, err := filepath.Rel(pathToBag, pathToFile)
+		if err != nil {
+			return err
+		}
+		pathInBag := filepath.ToSlash(relPath)
+		if info.IsDir() && pathInBag == payloadDir {
+			return filepath.SkipDir
+		}
+		if !info.Mode().IsRegular() || util.BagFileType(pathInBag) != constants.FileTypeTag {
+			return nil
+		}
+		data, err := os.ReadFile(pathToFile)
+		if err != nil {
+			return err
+		}
+		tagFiles[pathInBag] = data
+		return nil
+	})
+	return tagFiles, err
+}
@@ -0,0 +1,113 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DownloadProgressInterval is how often s3 download reports progress.
+const DownloadProgressInterval = time.Second
+
+// DownloadCounter is an io.Writer that counts the bytes written to it
+// and discards them. s3 download writes each download through one, so
+// it can report progress. It's safe for concurrent use, so parallel
+// range downloads can share one.
+type DownloadCounter struct {
+	bytes atomic.Int64
+}
+
+func (c *DownloadCounter) Write(p []byte) (int, error) {
+	c.bytes.Add(int64(len(p)))
+	return len(p), nil
+}
+
+// Bytes returns the number of bytes written so far.
+func (c *DownloadCounter) Bytes() int64 {
+	return c.bytes.Load()
+}
+
+// DownloadProgress describes how far a download has gotten.
+// BytesDownloaded and Percent include the part of the file that was
+// downloaded before a resume, but BytesPerSecond covers only this
+// download. Done is true for the last report.
+type DownloadProgress struct {
+	BytesDownloaded int64
+	TotalBytes      int64
+	Percent         int
+	BytesPerSecond  int64
+	Done            bool
+}
+
+// NewDownloadProgress returns the progress of a download of totalBytes
+// that started at offset and has written downloaded bytes since then,
+// over elapsed.
+func NewDownloadProgress(offset, downloaded, totalBytes int64, elapsed time.Duration) DownloadProgress {
+	progress := DownloadProgress{
+		BytesDownloaded: offset + downloaded,
+		TotalBytes:      totalBytes,
+		Percent:         100,
+	}
+	if totalBytes > 0 {
+		progress.Percent = int(progress.BytesDownloaded * 100 / totalBytes)
+	}
+	if elapsed > 0 {
+		progress.BytesPerSecond = int64(float64(downloaded) / elapsed.Seconds())
+	}
+	return progress
+}
+
+// WatchDownloadProgress calls callback every interval with the progress
+// of a download of totalBytes, which started at offset and counts its
+// bytes with counter. It skips intervals in which nothing arrived. This
+// returns a function that stops watching. Call it when the download
+// ends, and it calls callback once more with Done set.
+func WatchDownloadProgress(counter *DownloadCounter, offset, totalBytes int64, interval time.Duration, callback func(DownloadProgress)) func() {
+	start := time.Now()
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		lastBytes := int64(-1)
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				downloaded := counter.Bytes()
+				if downloaded == lastBytes {
+					continue
+				}
+				lastBytes = downloaded
+				callback(NewDownloadProgress(offset, downloaded, totalBytes, time.Since(start)))
+			}
+		}
+	}()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			close(stop)
+			<-stopped
+			progress := NewDownloadProgress(offset, counter.Bytes(), totalBytes, time.Since(start))
+			progress.Done = true
+			callback(progress)
+		})
+	}
+}
+
+// DownloadProgressPrinter returns a callback for WatchDownloadProgress
+// that rewrites a single line of out in place, for terminals. It ends
+// the line with the last report, so the next output starts on a line
+// of its own.
+func DownloadProgressPrinter(out io.Writer) func(DownloadProgress) {
+	return func(progress DownloadProgress) {
+		fmt.Fprintf(out, "\rdownloading: %3d%% (%s of %s, %s/s)\033[K", progress.Percent, FormatSize(progress.BytesDownloaded, sizeUnits), FormatSize(progress.TotalBytes, sizeUnits), FormatSize(progress.BytesPerSecond, sizeUnits))
+		if progress.Done {
+			fmt.Fprintln(out)
+		}
+	}
+}
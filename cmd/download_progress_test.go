@@ -0,0 +1,88 @@
+package cmd_test
+
+import (
+	"bytes"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/APTrust/apt-cmd/cmd"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewDownloadProgress(t *testing.T) {
+	progress := cmd.NewDownloadProgress(0, 250, 1000, 2*time.Second)
+	assert.Equal(t, int64(250), progress.BytesDownloaded)
+	assert.Equal(t, 25, progress.Percent)
+	assert.Equal(t, int64(125), progress.BytesPerSecond)
+
+	// Resumed downloads count the bytes we already had toward the
+	// percent, but not toward the speed.
+	progress = cmd.NewDownloadProgress(500, 250, 1000, time.Second)
+	assert.Equal(t, int64(750), progress.BytesDownloaded)
+	assert.Equal(t, 75, progress.Percent)
+	assert.Equal(t, int64(250), progress.BytesPerSecond)
+
+	progress = cmd.NewDownloadProgress(0, 0, 0, 0)
+	assert.Equal(t, 100, progress.Percent)
+	assert.Equal(t, int64(0), progress.BytesPerSecond)
+}
+
+func TestDownloadCounter(t *testing.T) {
+	counter := &cmd.DownloadCounter{}
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				counter.Write(make([]byte, 10))
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, int64(8000), counter.Bytes())
+}
+
+func TestWatchDownloadProgress(t *testing.T) {
+	counter := &cmd.DownloadCounter{}
+	var mutex sync.Mutex
+	reports := make([]cmd.DownloadProgress, 0)
+	callback := func(progress cmd.DownloadProgress) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		reports = append(reports, progress)
+	}
+	stop := cmd.WatchDownloadProgress(counter, 100, 1000, 10*time.Millisecond, callback)
+	counter.Write(make([]byte, 400))
+	require.Eventually(t, func() bool {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return len(reports) > 0
+	}, time.Second, 5*time.Millisecond)
+	counter.Write(make([]byte, 500))
+	stop()
+	stop()
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	assert.Equal(t, int64(500), reports[0].BytesDownloaded)
+	last := reports[len(reports)-1]
+	assert.True(t, last.Done)
+	assert.Equal(t, int64(1000), last.BytesDownloaded)
+	assert.Equal(t, 100, last.Percent)
+	for _, report := range reports[:len(reports)-1] {
+		assert.False(t, report.Done)
+	}
+}
+
+func TestDownloadProgressPrinter(t *testing.T) {
+	out := &bytes.Buffer{}
+	print := cmd.DownloadProgressPrinter(out)
+	print(cmd.DownloadProgress{BytesDownloaded: 500000, TotalBytes: 1000000, Percent: 50, BytesPerSecond: 250000})
+	assert.Equal(t, "\rdownloading:  50% (500 kB of 1.0 MB, 250 kB/s)\033[K", out.String())
+	print(cmd.DownloadProgress{BytesDownloaded: 1000000, TotalBytes: 1000000, Percent: 100, Done: true})
+	assert.True(t, strings.HasSuffix(out.String(), "\n"))
+}
@@ -0,0 +1,87 @@
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/minio/minio-go/v7"
+)
+
+// DownloadState records which S3 object a download is for, so that
+// s3 download --resume can tell whether a partial file on disk is the
+// start of the object it's about to download. s3 download writes the
+// state file before it starts copying, and removes it when the download
+// is complete.
+type DownloadState struct {
+	Bucket string `json:"bucket"`
+	Key    string `json:"key"`
+	Size   int64  `json:"size"`
+	ETag   string `json:"etag"`
+}
+
+// NewDownloadState returns the state for downloading an object.
+func NewDownloadState(bucket, key string, objInfo minio.ObjectInfo) *DownloadState {
+	return &DownloadState{
+		Bucket: bucket,
+		Key:    key,
+		Size:   objInfo.Size,
+		ETag:   objInfo.ETag,
+	}
+}
+
+// DownloadStatePath returns the path of the state file for a download
+// into pathToFile.
+func DownloadStatePath(pathToFile string) string {
+	return pathToFile + ".apt-cmd-download"
+}
+
+// ReadDownloadState reads the state file at pathToStateFile. It returns
+// nil and no error if the file doesn't exist.
+func ReadDownloadState(pathToStateFile string) (*DownloadState, error) {
+	data, err := os.ReadFile(pathToStateFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	state := &DownloadState{}
+	if err = json.Unmarshal(data, state); err != nil {
+		return nil, fmt.Errorf("can't parse download state file %s: %w", pathToStateFile, err)
+	}
+	return state, nil
+}
+
+// Write writes the state to pathToStateFile.
+func (state *DownloadState) Write(pathToStateFile string) error {
+	// Marshalling this struct can't fail.
+	data, _ := json.Marshal(state)
+	return os.WriteFile(pathToStateFile, data, 0644)
+}
+
+// ResumeOffset returns the offset at which to resume downloading the
+// object described by current into a partial file of localSize bytes,
+// which an earlier download described by previous left behind. It
+// returns an error if there's no record of the earlier download, or if
+// the object has changed since then, since appending to the partial
+// file would produce a file that matches neither version.
+func ResumeOffset(localSize int64, previous, current *DownloadState) (int64, error) {
+	if previous == nil {
+		return 0, fmt.Errorf("there's no record of a previous download of this object. Delete the file, or download it again without --resume")
+	}
+	if previous.Bucket != current.Bucket || previous.Key != current.Key {
+		return 0, fmt.Errorf("the partial file is from a download of %s/%s", previous.Bucket, previous.Key)
+	}
+	if previous.Size != current.Size {
+		return 0, fmt.Errorf("the object is %d bytes, but the partial file is from a download of a %d-byte object. The object has changed since then", current.Size, previous.Size)
+	}
+	if previous.ETag != current.ETag {
+		return 0, fmt.Errorf("the object's ETag is %s, but the partial file is from a download of an object with ETag %s. The object has changed since then", current.ETag, previous.ETag)
+	}
+	if localSize > current.Size {
+		return 0, fmt.Errorf("the partial file is %d bytes, which is larger than the %d-byte object", localSize, current.Size)
+	}
+	return localSize, nil
+}
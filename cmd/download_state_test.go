@@ -0,0 +1,52 @@
+package cmd_test
+
+import (
+	"path"
+	"testing"
+
+	"github.com/APTrust/apt-cmd/cmd"
+	"github.com/minio/minio-go/v7"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDownloadState(t *testing.T) {
+	statePath := cmd.DownloadStatePath(path.Join(t.TempDir(), "my_bag.tar"))
+	assert.Equal(t, "my_bag.tar.apt-cmd-download", path.Base(statePath))
+
+	state, err := cmd.ReadDownloadState(statePath)
+	require.Nil(t, err)
+	assert.Nil(t, state)
+
+	state = cmd.NewDownloadState("my-bucket", "my_bag.tar", minio.ObjectInfo{Size: 1000, ETag: "abc-2"})
+	require.Nil(t, state.Write(statePath))
+	saved, err := cmd.ReadDownloadState(statePath)
+	require.Nil(t, err)
+	assert.Equal(t, state, saved)
+}
+
+func TestResumeOffset(t *testing.T) {
+	current := &cmd.DownloadState{Bucket: "my-bucket", Key: "my_bag.tar", Size: 1000, ETag: "abc-2"}
+	same := *current
+	offset, err := cmd.ResumeOffset(400, &same, current)
+	require.Nil(t, err)
+	assert.Equal(t, int64(400), offset)
+	offset, err = cmd.ResumeOffset(1000, &same, current)
+	require.Nil(t, err)
+	assert.Equal(t, int64(1000), offset)
+
+	testCases := map[string]*cmd.DownloadState{
+		"no record of a previous download":       nil,
+		"from a download of my-bucket/other.tar": {Bucket: "my-bucket", Key: "other.tar", Size: 1000, ETag: "abc-2"},
+		"download of a 2000-byte object":         {Bucket: "my-bucket", Key: "my_bag.tar", Size: 2000, ETag: "abc-2"},
+		"object with ETag def-2":                 {Bucket: "my-bucket", Key: "my_bag.tar", Size: 1000, ETag: "def-2"},
+	}
+	for message, previous := range testCases {
+		_, err = cmd.ResumeOffset(400, previous, current)
+		require.NotNil(t, err, message)
+		assert.Contains(t, err.Error(), message)
+	}
+	_, err = cmd.ResumeOffset(1001, &same, current)
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), "larger than the 1000-byte object")
+}
@@ -0,0 +1,249 @@
+package cmd
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/minio/minio-go/v7"
+)
+
+// ErrETagUnverifiable means we can't check a file against an S3 ETag.
+// This happens when the object was encrypted with SSE-KMS or SSE-C,
+// in which case the ETag isn't based on an MD5 of the object's data,
+// or when we can't figure out what part size a multipart upload used.
+var ErrETagUnverifiable = errors.New("ETag can't be verified")
+
+// etagRegex matches simple and multipart ETags. A simple ETag is the
+// MD5 digest of the object. A multipart ETag is the MD5 digest of the
+// concatenated MD5 digests of the parts, followed by a dash and the
+// number of parts.
+var etagRegex = regexp.MustCompile(`^([0-9a-f]{32})(?:-([0-9]+))?$`)
+
+// commonPartSizes are part sizes used by popular S3 upload tools.
+// The AWS CLI uses 8 MiB by default, and minio uses 16 MiB or more.
+var commonPartSizes = []int64{
+	5 * 1024 * 1024,
+	8 * 1024 * 1024,
+	15 * 1024 * 1024,
+	16 * 1024 * 1024,
+	32 * 1024 * 1024,
+	64 * 1024 * 1024,
+	100 * 1024 * 1024,
+	128 * 1024 * 1024,
+	256 * 1024 * 1024,
+	512 * 1024 * 1024,
+	1024 * 1024 * 1024,
+}
+
+// ParseETag parses an S3 ETag, which may be wrapped in quotes. It returns
+// the hex digest, and the number of parts for multipart ETags, or zero
+// for simple ETags. It returns ErrETagUnverifiable if the ETag isn't an
+// MD5-based ETag.
+func ParseETag(etag string) (string, int, error) {
+	etag = strings.ToLower(strings.Trim(strings.TrimSpace(etag), `"`))
+	match := etagRegex.FindStringSubmatch(etag)
+	if match == nil {
+		return "", 0, fmt.Errorf("%w: '%s' is not an MD5 or multipart ETag. The object may be encrypted with SSE-KMS or SSE-C", ErrETagUnverifiable, etag)
+	}
+	partCount := 0
+	if match[2] != "" {
+		partCount, _ = strconv.Atoi(match[2])
+		if partCount < 1 {
+			return "", 0, fmt.Errorf("%w: '%s' has an invalid part count", ErrETagUnverifiable, etag)
+		}
+	}
+	return match[1], partCount, nil
+}
+
+// ETagPartSizes returns the part sizes that could have produced
+// partCount parts for an object of objectSize bytes, favoring the part
+// sizes that common tools, including this one, use. If partSize is
+// greater than zero, that's the only candidate.
+func ETagPartSizes(objectSize int64, partCount int, partSize int64) []int64 {
+	fits := func(size int64) bool {
+		return size > 0 && (objectSize+size-1)/size == int64(partCount)
+	}
+	if partSize > 0 {
+		if fits(partSize) {
+			return []int64{partSize}
+		}
+		return []int64{}
+	}
+	candidates := make([]int64, 0)
+	_, minioPartSize, _, err := minio.OptimalPartInfo(objectSize, 0)
+	if err == nil && fits(minioPartSize) {
+		candidates = append(candidates, minioPartSize)
+	}
+	for _, size := range commonPartSizes {
+		if fits(size) && size != minioPartSize {
+			candidates = append(candidates, size)
+		}
+	}
+	// If every part but the last is the same size, that size is
+	// object size divided by part count, rounded up to the nearest MiB
+	// by most tools. Try that, too.
+	if partCount > 1 {
+		const mib = 1024 * 1024
+		size := ((objectSize/int64(partCount) + mib - 1) / mib) * mib
+		if fits(size) && !int64ListContains(candidates, size) {
+			candidates = append(candidates, size)
+		}
+	}
+	return candidates
+}
+
+func int64ListContains(list []int64, value int64) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
+
+// ETagHasher computes the S3 ETags that the data written to it would
+// have for a number of different part sizes, in a single pass. A part
+// size of zero means a simple MD5 ETag.
+type ETagHasher struct {
+	partSizes []int64
+	states    []*etagState
+}
+
+type etagState struct {
+	partSize  int64
+	written   int64
+	hash      hash.Hash
+	partMD5s  []byte
+	partCount int
+}
+
+// NewETagHasher returns an ETagHasher that computes ETags for each
+// of the given part sizes.
+func NewETagHasher(partSizes []int64) *ETagHasher {
+	hasher := &ETagHasher{partSizes: partSizes}
+	for _, size := range partSizes {
+		hasher.states = append(hasher.states, &etagState{partSize: size, hash: md5.New()})
+	}
+	return hasher
+}
+
+// Write adds data to all of the ETag calculations.
+func (h *ETagHasher) Write(p []byte) (int, error) {
+	for _, state := range h.states {
+		data := p
+		for len(data) > 0 {
+			chunk := data
+			if state.partSize > 0 && state.written+int64(len(chunk)) > state.partSize {
+				chunk = data[:state.partSize-state.written]
+			}
+			state.hash.Write(chunk)
+			state.written += int64(len(chunk))
+			data = data[len(chunk):]
+			if state.partSize > 0 && state.written == state.partSize {
+				state.endPart()
+			}
+		}
+	}
+	return len(p), nil
+}
+
+func (state *etagState) endPart() {
+	state.partMD5s = append(state.partMD5s, state.hash.Sum(nil)...)
+	state.partCount++
+	state.hash.Reset()
+	state.written = 0
+}
+
+// ETags returns a map of part size to the ETag computed with that
+// part size. Call this after all data has been written.
+func (h *ETagHasher) ETags() map[int64]string {
+	etags := make(map[int64]string)
+	for _, state := range h.states {
+		if state.partSize == 0 {
+			etags[0] = hex.EncodeToString(state.hash.Sum(nil))
+			continue
+		}
+		partMD5s, partCount := state.partMD5s, state.partCount
+		if state.written > 0 || partCount == 0 {
+			partMD5s = append(append([]byte{}, partMD5s...), state.hash.Sum(nil)...)
+			partCount++
+		}
+		sum := md5.Sum(partMD5s)
+		etags[state.partSize] = fmt.Sprintf("%s-%d", hex.EncodeToString(sum[:]), partCount)
+	}
+	return etags
+}
+
+// NewETagHasherFor returns an ETagHasher set up to verify data against
+// etag, for an object of objectSize bytes. If partSize is greater than
+// zero, the hasher uses only that part size for multipart ETags.
+// Otherwise, it tries all of the likely part sizes. This returns
+// ErrETagUnverifiable if the ETag isn't MD5-based, or if no part size
+// fits the ETag's part count.
+func NewETagHasherFor(etag string, objectSize, partSize int64) (*ETagHasher, error) {
+	_, partCount, err := ParseETag(etag)
+	if err != nil {
+		return nil, err
+	}
+	if partCount == 0 {
+		return NewETagHasher([]int64{0}), nil
+	}
+	partSizes := ETagPartSizes(objectSize, partCount, partSize)
+	if len(partSizes) == 0 {
+		if partSize > 0 {
+			return nil, fmt.Errorf("%w: part size %d can't produce %d parts for an object of %d bytes", ErrETagUnverifiable, partSize, partCount, objectSize)
+		}
+		return nil, fmt.Errorf("%w: can't determine the part size of this %d-part upload. Use --part-size to specify it", ErrETagUnverifiable, partCount)
+	}
+	return NewETagHasher(partSizes), nil
+}
+
+// VerifyETag checks the ETags computed by hasher against etag. It
+// returns the matching part size, which is zero for simple ETags, or
+// an error describing the mismatch.
+func VerifyETag(hasher *ETagHasher, etag string) (int64, error) {
+	digest, partCount, err := ParseETag(etag)
+	if err != nil {
+		return 0, err
+	}
+	expected := digest
+	if partCount > 0 {
+		expected = fmt.Sprintf("%s-%d", digest, partCount)
+	}
+	etags := hasher.ETags()
+	sizes := make([]int64, 0, len(etags))
+	for size, computed := range etags {
+		if computed == expected {
+			return size, nil
+		}
+		sizes = append(sizes, size)
+	}
+	sort.Slice(sizes, func(i, j int) bool { return sizes[i] < sizes[j] })
+	if partCount == 0 {
+		return 0, fmt.Errorf("file MD5 %s does not match ETag %s", etags[0], expected)
+	}
+	return 0, fmt.Errorf("file does not match ETag %s with any likely part size. Tried %s", expected, strings.Trim(fmt.Sprint(sizes), "[]"))
+}
+
+// IsSimpleMD5ETag returns true if the object's ETag is the MD5 digest
+// of its data, which is the case for objects uploaded in a single part
+// without SSE-KMS or SSE-C encryption. Those encrypted objects have
+// ETags that look like MD5 digests, but aren't, so we check the
+// object's encryption headers, too.
+func IsSimpleMD5ETag(objInfo minio.ObjectInfo) bool {
+	_, partCount, err := ParseETag(objInfo.ETag)
+	if err != nil || partCount > 0 {
+		return false
+	}
+	if strings.HasPrefix(objInfo.Metadata.Get("X-Amz-Server-Side-Encryption"), "aws:kms") {
+		return false
+	}
+	return objInfo.Metadata.Get("X-Amz-Server-Side-Encryption-Customer-Algorithm") == ""
+}
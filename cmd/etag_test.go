@@ -0,0 +1,155 @@
+package cmd_test
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/APTrust/apt-cmd/cmd"
+	"github.com/minio/minio-go/v7"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const mib = 1024 * 1024
+
+// multipartETag computes a multipart ETag the slow, obvious way.
+func multipartETag(data []byte, partSize int) string {
+	partMD5s := make([]byte, 0)
+	partCount := 0
+	for start := 0; start < len(data); start += partSize {
+		end := start + partSize
+		if end > len(data) {
+			end = len(data)
+		}
+		sum := md5.Sum(data[start:end])
+		partMD5s = append(partMD5s, sum[:]...)
+		partCount++
+	}
+	sum := md5.Sum(partMD5s)
+	return fmt.Sprintf("%s-%d", hex.EncodeToString(sum[:]), partCount)
+}
+
+func testData(size int) []byte {
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = byte(i * 7 % 251)
+	}
+	return data
+}
+
+func TestParseETag(t *testing.T) {
+	digest, parts, err := cmd.ParseETag(`"9B2CF535F27731C974343645A3985328"`)
+	require.Nil(t, err)
+	assert.Equal(t, "9b2cf535f27731c974343645a3985328", digest)
+	assert.Equal(t, 0, parts)
+
+	digest, parts, err = cmd.ParseETag("d41d8cd98f00b204e9800998ecf8427e-38")
+	require.Nil(t, err)
+	assert.Equal(t, "d41d8cd98f00b204e9800998ecf8427e", digest)
+	assert.Equal(t, 38, parts)
+
+	for _, etag := range []string{"", "not-an-etag", "d41d8cd98f00b204e9800998ecf8427e-0", "abc123"} {
+		_, _, err = cmd.ParseETag(etag)
+		assert.ErrorIs(t, err, cmd.ErrETagUnverifiable, etag)
+	}
+}
+
+func TestETagPartSizes(t *testing.T) {
+	// Part size given, and it fits
+	assert.Equal(t, []int64{8 * mib}, cmd.ETagPartSizes(20*mib, 3, 8*mib))
+	// Part size given, and it doesn't fit
+	assert.Empty(t, cmd.ETagPartSizes(20*mib, 2, 8*mib))
+
+	// Detect 8 MiB, the AWS CLI default, and 16 MiB, the minio default
+	sizes := cmd.ETagPartSizes(20*mib, 3, 0)
+	assert.Contains(t, sizes, int64(8*mib))
+	sizes = cmd.ETagPartSizes(20*mib, 2, 0)
+	assert.Contains(t, sizes, int64(16*mib))
+	for _, size := range sizes {
+		assert.Equal(t, int64(2), (20*mib+size-1)/size)
+	}
+}
+
+func TestETagHasher(t *testing.T) {
+	data := testData(5*mib + 12345)
+	hasher := cmd.NewETagHasher([]int64{0, 1 * mib, 2 * mib})
+	// Write in odd-sized chunks, so writes straddle part boundaries.
+	_, err := io.CopyBuffer(hasher, bytes.NewReader(data), make([]byte, 77777))
+	require.Nil(t, err)
+	etags := hasher.ETags()
+	simple := md5.Sum(data)
+	assert.Equal(t, hex.EncodeToString(simple[:]), etags[0])
+	assert.Equal(t, multipartETag(data, 1*mib), etags[1*mib])
+	assert.Equal(t, multipartETag(data, 2*mib), etags[2*mib])
+	assert.True(t, strings.HasSuffix(etags[1*mib], "-6"))
+
+	// Data that ends exactly on a part boundary
+	data = testData(4 * mib)
+	hasher = cmd.NewETagHasher([]int64{2 * mib})
+	hasher.Write(data)
+	assert.Equal(t, multipartETag(data, 2*mib), hasher.ETags()[2*mib])
+}
+
+func TestVerifyETag(t *testing.T) {
+	data := testData(20 * mib)
+	etag := multipartETag(data, 8*mib)
+
+	// Detect the part size
+	hasher, err := cmd.NewETagHasherFor(`"`+etag+`"`, int64(len(data)), 0)
+	require.Nil(t, err)
+	hasher.Write(data)
+	partSize, err := cmd.VerifyETag(hasher, etag)
+	require.Nil(t, err)
+	assert.Equal(t, int64(8*mib), partSize)
+
+	// Corrupt data doesn't match
+	hasher, err = cmd.NewETagHasherFor(etag, int64(len(data)), 0)
+	require.Nil(t, err)
+	hasher.Write(data[:len(data)-1])
+	hasher.Write([]byte{0})
+	_, err = cmd.VerifyETag(hasher, etag)
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), "does not match ETag")
+
+	// Simple ETag
+	small := testData(1000)
+	sum := md5.Sum(small)
+	hasher, err = cmd.NewETagHasherFor(hex.EncodeToString(sum[:]), 1000, 0)
+	require.Nil(t, err)
+	hasher.Write(small)
+	partSize, err = cmd.VerifyETag(hasher, hex.EncodeToString(sum[:]))
+	require.Nil(t, err)
+	assert.Equal(t, int64(0), partSize)
+
+	// Part size that can't produce the ETag's part count
+	_, err = cmd.NewETagHasherFor(etag, int64(len(data)), 5*mib)
+	assert.ErrorIs(t, err, cmd.ErrETagUnverifiable)
+
+	// Part count we can't match to a likely part size
+	_, err = cmd.NewETagHasherFor(hex.EncodeToString(sum[:])+"-7", 1000, 0)
+	assert.ErrorIs(t, err, cmd.ErrETagUnverifiable)
+	assert.Contains(t, err.Error(), "--part-size")
+}
+
+func TestIsSimpleMD5ETag(t *testing.T) {
+	simple := `"8d777f385d3dfec8815d20f7496026dc"`
+	assert.True(t, cmd.IsSimpleMD5ETag(minio.ObjectInfo{ETag: simple}))
+	assert.False(t, cmd.IsSimpleMD5ETag(minio.ObjectInfo{ETag: "8d777f385d3dfec8815d20f7496026dc-3"}))
+	assert.False(t, cmd.IsSimpleMD5ETag(minio.ObjectInfo{ETag: "not-an-etag"}))
+
+	kms := http.Header{}
+	kms.Set("X-Amz-Server-Side-Encryption", "aws:kms")
+	assert.False(t, cmd.IsSimpleMD5ETag(minio.ObjectInfo{ETag: simple, Metadata: kms}))
+	sseC := http.Header{}
+	sseC.Set("X-Amz-Server-Side-Encryption-Customer-Algorithm", "AES256")
+	assert.False(t, cmd.IsSimpleMD5ETag(minio.ObjectInfo{ETag: simple, Metadata: sseC}))
+	sseS3 := http.Header{}
+	sseS3.Set("X-Amz-Server-Side-Encryption", "AES256")
+	assert.True(t, cmd.IsSimpleMD5ETag(minio.ObjectInfo{ETag: simple, Metadata: sseS3}))
+}
@@ -0,0 +1,173 @@
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/APTrust/dart-runner/util"
+)
+
+// ReadExcludeFile returns the exclusion patterns in the file at
+// pathToFile for --exclude-from. The file has one pattern per line.
+// Blank lines and lines starting with # are ignored.
+func ReadExcludeFile(pathToFile string) ([]string, error) {
+	file, err := os.Open(pathToFile)
+	if err != nil {
+		return nil, fmt.Errorf("can't read exclude file %s: %w", pathToFile, err)
+	}
+	defer file.Close()
+	patterns := make([]string, 0)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		patterns = append(patterns, line)
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, fmt.Errorf("can't read exclude file %s: %w", pathToFile, err)
+	}
+	return patterns, nil
+}
+
+// ValidateExcludePatterns returns an error describing the first
+// malformed pattern in patterns, such as one with an unclosed [.
+func ValidateExcludePatterns(patterns []string) error {
+	for _, pattern := range patterns {
+		for _, segment := range strings.Split(strings.Trim(strings.TrimPrefix(pattern, "!"), "/"), "/") {
+			if _, err := path.Match(segment, ""); err != nil {
+				return fmt.Errorf("invalid exclude pattern '%s': %w", pattern, err)
+			}
+		}
+	}
+	return nil
+}
+
+// BagignoreFile is the name of the file at the top of a directory
+// being bagged that lists patterns for files to leave out of the bag,
+// like a .gitignore file.
+const BagignoreFile = ".bagignore"
+
+// ReadBagignore returns the patterns in the .bagignore file in bagDir.
+// It returns no patterns and no error if there's no .bagignore file.
+func ReadBagignore(bagDir string) ([]string, error) {
+	pathToFile := filepath.Join(bagDir, BagignoreFile)
+	if !util.FileExists(pathToFile) {
+		return []string{}, nil
+	}
+	patterns, err := ReadExcludeFile(pathToFile)
+	if err == nil {
+		err = ValidateExcludePatterns(patterns)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", pathToFile, err)
+	}
+	return patterns, nil
+}
+
+// IsExcluded returns true if patterns exclude relPath, a slash-separated
+// path relative to the directory being bagged, or any of the
+// directories above it. Patterns follow the rules of path.Match, plus
+// these, which are the same as in a .gitignore file:
+//
+//   - A pattern without a slash matches a file or directory name at any
+//     depth, so *.tmp matches a.tmp and notes/b.tmp.
+//   - A pattern with a slash matches the whole relative path, so
+//     notes/*.tmp matches notes/b.tmp but not a.tmp. A leading slash is
+//     ignored.
+//   - ** matches any number of directories, including none, so
+//     **/.DS_Store matches .DS_Store and photos/.DS_Store, and .git/**
+//     matches .git and everything in it.
+//   - A pattern ending in a slash matches only directories.
+//   - A pattern starting with ! re-includes paths that an earlier
+//     pattern excluded. The last pattern that matches a path decides
+//     whether it's excluded. Use \! for a pattern that starts with a
+//     literal !.
+//
+// Excluding a directory excludes everything in it, and a ! pattern
+// can't re-include a file inside an excluded directory.
+func IsExcluded(relPath string, isDir bool, patterns []string) bool {
+	segments := strings.Split(relPath, "/")
+	for i := 1; i < len(segments); i++ {
+		if lastMatchExcludes(segments[:i], true, patterns) {
+			return true
+		}
+	}
+	return lastMatchExcludes(segments, isDir, patterns)
+}
+
+// lastMatchExcludes returns true if the last of patterns that matches
+// the path in segments excludes it.
+func lastMatchExcludes(segments []string, isDir bool, patterns []string) bool {
+	excluded := false
+	for _, pattern := range patterns {
+		negated := strings.HasPrefix(pattern, "!")
+		pattern = strings.TrimPrefix(pattern, "!")
+		if strings.HasSuffix(pattern, "/") && !isDir {
+			continue
+		}
+		pattern = strings.Trim(pattern, "/")
+		if !strings.Contains(pattern, "/") {
+			pattern = "**/" + pattern
+		}
+		if matchSegments(strings.Split(pattern, "/"), segments) {
+			excluded = !negated
+		}
+	}
+	return excluded
+}
+
+// matchSegments returns true if the path segments in pattern match the
+// path segments in name, with ** matching any number of segments.
+func matchSegments(pattern, name []string) bool {
+	if len(pattern) == 0 {
+		return len(name) == 0
+	}
+	if pattern[0] == "**" {
+		for i := 0; i <= len(name); i++ {
+			if matchSegments(pattern[1:], name[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(name) == 0 {
+		return false
+	}
+	// ValidateExcludePatterns has already rejected bad patterns.
+	matched, _ := path.Match(pattern[0], name[0])
+	return matched && matchSegments(pattern[1:], name[1:])
+}
+
+// ExcludeFiles removes the files that match patterns from files, which
+// come from ListBagDirFiles(absDirs). Each directory in absDirs has its
+// own patterns, keyed by the directory's path, which are matched
+// against the paths of the files in it, relative to the directory. This
+// returns the files to bag, plus the paths of the excluded files and
+// directories. The directories in absDirs are never excluded.
+func ExcludeFiles(absDirs []string, files []*util.ExtendedFileInfo, patterns map[string][]string) ([]*util.ExtendedFileInfo, []string) {
+	kept := make([]*util.ExtendedFileInfo, 0, len(files))
+	excluded := make([]string, 0)
+	for _, f := range files {
+		relPath, dirPatterns := "", []string(nil)
+		for _, absDir := range absDirs {
+			if isInside(f.FullPath, absDir) {
+				relPath, _ = filepath.Rel(absDir, f.FullPath)
+				dirPatterns = patterns[absDir]
+				break
+			}
+		}
+		isDir := f.FileInfo != nil && f.IsDir()
+		if len(dirPatterns) > 0 && relPath != "." && IsExcluded(filepath.ToSlash(relPath), isDir, dirPatterns) {
+			excluded = append(excluded, f.FullPath)
+			continue
+		}
+		kept = append(kept, f)
+	}
+	return kept, excluded
+}
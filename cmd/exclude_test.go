@@ -0,0 +1,117 @@
+package cmd_test
+
+import (
+	"os"
+	"path"
+	"testing"
+
+	"github.com/APTrust/apt-cmd/cmd"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIsExcluded(t *testing.T) {
+	patterns := []string{"*.tmp", ".git/**", "**/.DS_Store", "notes/*.txt", "build/"}
+	excluded := []string{
+		"a.tmp",
+		"photos/b.tmp",
+		".git",
+		".git/config",
+		".git/objects/ab/cdef",
+		".DS_Store",
+		"photos/2023/.DS_Store",
+		"notes/todo.txt",
+		"build",
+		"build/output.bin",
+		"src/build/output.bin",
+	}
+	for _, relPath := range excluded {
+		assert.True(t, cmd.IsExcluded(relPath, relPath == "build" || relPath == ".git", patterns), relPath)
+	}
+	kept := []string{
+		"a.tmp.txt",
+		"photos/img.jpg",
+		"photos/.git-notes",
+		"DS_Store",
+		"todo.txt",
+		"photos/notes/todo.txt",
+		"notes/todo.md",
+	}
+	for _, relPath := range kept {
+		assert.False(t, cmd.IsExcluded(relPath, false, patterns), relPath)
+	}
+
+	// build/ matches only directories.
+	assert.False(t, cmd.IsExcluded("build", false, patterns))
+
+	// The last matching pattern decides, but nothing re-includes a
+	// file in an excluded directory.
+	negated := []string{"*.log", "!keep.log", "logs/", "!logs/keep.log"}
+	assert.True(t, cmd.IsExcluded("debug.log", false, negated))
+	assert.False(t, cmd.IsExcluded("keep.log", false, negated))
+	assert.False(t, cmd.IsExcluded("photos/keep.log", false, negated))
+	assert.True(t, cmd.IsExcluded("logs/keep.log", false, negated))
+	assert.True(t, cmd.IsExcluded("keep.log", false, append(negated, "keep.*")))
+	assert.True(t, cmd.IsExcluded("!important", false, []string{`\!important`}))
+
+	// A leading slash is ignored.
+	assert.True(t, cmd.IsExcluded("notes/todo.txt", false, []string{"/notes/*.txt"}))
+	assert.False(t, cmd.IsExcluded("a.tmp", false, nil))
+}
+
+func TestValidateExcludePatterns(t *testing.T) {
+	assert.Nil(t, cmd.ValidateExcludePatterns([]string{"*.tmp", ".git/**", "[abc].txt"}))
+	err := cmd.ValidateExcludePatterns([]string{"*.tmp", "photos/[abc.txt"})
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), "photos/[abc.txt")
+}
+
+func TestReadExcludeFile(t *testing.T) {
+	excludeFile := path.Join(t.TempDir(), "ignore.txt")
+	require.Nil(t, os.WriteFile(excludeFile, []byte("# Editor files\n*.swp\n\n  *~  \r\n**/.DS_Store\n"), 0644))
+	patterns, err := cmd.ReadExcludeFile(excludeFile)
+	require.Nil(t, err)
+	assert.Equal(t, []string{"*.swp", "*~", "**/.DS_Store"}, patterns)
+
+	_, err = cmd.ReadExcludeFile(path.Join(t.TempDir(), "does-not-exist.txt"))
+	assert.NotNil(t, err)
+}
+
+func TestExcludeFiles(t *testing.T) {
+	bagDir := path.Join(t.TempDir(), "project")
+	require.Nil(t, os.MkdirAll(path.Join(bagDir, ".git"), 0755))
+	for _, name := range []string{"README.txt", "draft.tmp", ".git/config"} {
+		require.Nil(t, os.WriteFile(path.Join(bagDir, name), []byte(name), 0644))
+	}
+	absDirs := []string{bagDir}
+	files, _, err := cmd.ListBagDirFiles(absDirs, cmd.SymlinksSkip)
+	require.Nil(t, err)
+	kept, excluded := cmd.ExcludeFiles(absDirs, files, map[string][]string{bagDir: {"*.tmp", ".git"}})
+	keptPaths := make([]string, 0, len(kept))
+	for _, f := range kept {
+		keptPaths = append(keptPaths, f.FullPath)
+	}
+	assert.ElementsMatch(t, []string{bagDir, path.Join(bagDir, "README.txt")}, keptPaths)
+	assert.ElementsMatch(t, []string{path.Join(bagDir, ".git"), path.Join(bagDir, ".git", "config"), path.Join(bagDir, "draft.tmp")}, excluded)
+
+	kept, excluded = cmd.ExcludeFiles(absDirs, files, nil)
+	assert.Equal(t, files, kept)
+	assert.Empty(t, excluded)
+}
+
+func TestReadBagignore(t *testing.T) {
+	bagDir := t.TempDir()
+	patterns, err := cmd.ReadBagignore(bagDir)
+	require.Nil(t, err)
+	assert.Empty(t, patterns)
+
+	require.Nil(t, os.WriteFile(path.Join(bagDir, ".bagignore"), []byte("*.log\n!keep.log\n"), 0644))
+	patterns, err = cmd.ReadBagignore(bagDir)
+	require.Nil(t, err)
+	assert.Equal(t, []string{"*.log", "!keep.log"}, patterns)
+
+	require.Nil(t, os.WriteFile(path.Join(bagDir, ".bagignore"), []byte("[abc\n"), 0644))
+	_, err = cmd.ReadBagignore(bagDir)
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), ".bagignore")
+}
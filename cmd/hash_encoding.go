@@ -0,0 +1,280 @@
+package cmd
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/APTrust/dart-runner/bagit"
+	"github.com/APTrust/dart-runner/constants"
+	"github.com/APTrust/dart-runner/util"
+)
+
+// Encodings for digests in manifests and tag manifests. Most BagIt
+// tools write lowercase hex, and that's our default.
+const (
+	HashEncodingHexLower = "hex-lower"
+	HashEncodingHexUpper = "hex-upper"
+	HashEncodingBase64   = "base64"
+)
+
+// HashEncodings lists the supported values for --hash-encoding.
+var HashEncodings = []string{
+	HashEncodingHexLower,
+	HashEncodingHexUpper,
+	HashEncodingBase64,
+}
+
+var hexDigestRegex = regexp.MustCompile(`^[0-9a-fA-F]+$`)
+var manifestRegex = regexp.MustCompile(`^(tag)?manifest-([\w-]+)\.txt$`)
+var manifestLineRegex = regexp.MustCompile(`^(\S+)(\s+.*)$`)
+
+// digestSizes are the sizes, in bytes, of the digests we know about.
+// We use these to tell base64 digests from other strings.
+var digestSizes = map[int]bool{16: true, 20: true, 32: true, 48: true, 64: true}
+
+// EncodeDigest converts a hex digest, like the ones the bagger writes,
+// to the specified encoding.
+func EncodeDigest(hexDigest, encoding string) (string, error) {
+	switch encoding {
+	case HashEncodingHexLower:
+		return strings.ToLower(hexDigest), nil
+	case HashEncodingHexUpper:
+		return strings.ToUpper(hexDigest), nil
+	case HashEncodingBase64:
+		data, err := hex.DecodeString(hexDigest)
+		if err != nil {
+			return "", fmt.Errorf("digest '%s' is not hex: %w", hexDigest, err)
+		}
+		return base64.StdEncoding.EncodeToString(data), nil
+	}
+	return "", fmt.Errorf("unknown hash encoding '%s'. Use one of: %s", encoding, strings.Join(HashEncodings, ", "))
+}
+
+// NormalizeDigest converts a digest in any of our HashEncodings to
+// lowercase hex, which is what the validator computes. Values that
+// aren't digests in a known encoding are returned unchanged, so they
+// still fail validation.
+func NormalizeDigest(digest string) string {
+	if hexDigestRegex.MatchString(digest) {
+		return strings.ToLower(digest)
+	}
+	data, err := base64.StdEncoding.DecodeString(digest)
+	if err == nil && digestSizes[len(data)] {
+		return hex.EncodeToString(data)
+	}
+	return digest
+}
+
+// NormalizeManifestDigests converts the manifest and tag manifest
+// digests the validator read from a bag to lowercase hex, so that
+// validation doesn't fail on uppercase hex or base64 digests. Call
+// this after validator.ScanBag() and before validator.Validate().
+func NormalizeManifestDigests(validator *bagit.Validator) {
+	fileMaps := []*bagit.FileMap{
+		validator.PayloadFiles,
+		validator.PayloadManifests,
+		validator.TagFiles,
+		validator.TagManifests,
+	}
+	for _, fileMap := range fileMaps {
+		for _, record := range fileMap.Files {
+			for _, checksum := range record.Checksums {
+				if checksum.Source == constants.FileTypeManifest || checksum.Source == constants.FileTypeTagManifest {
+					checksum.Digest = NormalizeDigest(checksum.Digest)
+				}
+			}
+		}
+	}
+}
+
+// RewriteManifestEncoding rewrites the digests in the manifests and tag
+// manifests of a tarred bag in the specified encoding. Rewriting the
+// manifests changes their checksums, so this recalculates those in the
+// tag manifests. It writes a new tar file next to the original, then
+// replaces the original, so it needs enough free space for a second
+// copy of the bag.
+func RewriteManifestEncoding(pathToTar, encoding string) error {
+	if encoding == HashEncodingHexLower {
+		return nil
+	}
+	manifests, err := readManifests(pathToTar)
+	if err != nil {
+		return err
+	}
+
+	// Payload manifests first, since the tag manifests describe them.
+	rewritten := make(map[string][]byte)
+	for name, data := range manifests {
+		if !strings.HasPrefix(name, "tag") {
+			if rewritten[name], err = encodeManifest(data, encoding, nil, ""); err != nil {
+				return fmt.Errorf("can't rewrite %s: %w", name, err)
+			}
+		}
+	}
+	for name, data := range manifests {
+		if strings.HasPrefix(name, "tag") {
+			alg := manifestRegex.FindStringSubmatch(name)[2]
+			if rewritten[name], err = encodeManifest(data, encoding, rewritten, alg); err != nil {
+				return fmt.Errorf("can't rewrite %s: %w", name, err)
+			}
+		}
+	}
+
+	tmpPath := pathToTar + ".tmp"
+	err = copyTarReplacing(pathToTar, tmpPath, rewritten, nil)
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return os.Rename(tmpPath, pathToTar)
+}
+
+// readManifests returns the contents of the manifests and tag
+// manifests in a tarred bag, keyed by path in the bag.
+func readManifests(pathToTar string) (map[string][]byte, error) {
+	file, err := os.Open(pathToTar)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	manifests := make(map[string][]byte)
+	reader := tar.NewReader(file)
+	for {
+		header, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		pathInBag, err := util.TarPathToBagPath(header.Name)
+		if err != nil || !manifestRegex.MatchString(pathInBag) {
+			continue
+		}
+		data, err := io.ReadAll(reader)
+		if err != nil {
+			return nil, err
+		}
+		manifests[pathInBag] = data
+	}
+	return manifests, nil
+}
+
+// encodeManifest re-encodes each digest in a manifest. For tag
+// manifests, param rewritten contains new contents of files whose
+// digests must be recalculated with algorithm alg.
+func encodeManifest(data []byte, encoding string, rewritten map[string][]byte, alg string) ([]byte, error) {
+	var out bytes.Buffer
+	for _, line := range strings.SplitAfter(string(data), "\n") {
+		trimmed := strings.TrimRight(line, "\r\n")
+		match := manifestLineRegex.FindStringSubmatch(trimmed)
+		if match == nil {
+			out.WriteString(line)
+			continue
+		}
+		digest := match[1]
+		if newContent, ok := rewritten[strings.TrimSpace(match[2])]; ok {
+			hashes := GetHashes([]string{alg})
+			if hashes[alg] == nil {
+				return nil, fmt.Errorf("unsupported algorithm %s", alg)
+			}
+			hashes[alg].Write(newContent)
+			digest = hex.EncodeToString(hashes[alg].Sum(nil))
+		}
+		encoded, err := EncodeDigest(digest, encoding)
+		if err != nil {
+			return nil, err
+		}
+		out.WriteString(encoded + match[2] + line[len(trimmed):])
+	}
+	return out.Bytes(), nil
+}
+
+// copyTarReplacing copies the tar file at src to dest, replacing the
+// contents of files in replacements, which is keyed by path in the bag,
+// and leaving out the files in remove. Replacements for files that
+// aren't in the tar are added at the end, with the same owner, mode and
+// timestamp as the last file.
+func copyTarReplacing(src, dest string, replacements map[string][]byte, remove []string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(filepath.Clean(dest))
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	reader := tar.NewReader(in)
+	writer := tar.NewWriter(out)
+	written := make(map[string]bool)
+	var lastFile *tar.Header
+	for {
+		header, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		pathInBag, _ := util.TarPathToBagPath(header.Name)
+		if header.Typeflag == tar.TypeReg || header.Typeflag == tar.TypeRegA {
+			lastFile = header
+		}
+		if util.StringListContains(remove, pathInBag) {
+			continue
+		}
+		if data, ok := replacements[pathInBag]; ok {
+			written[pathInBag] = true
+			header.Size = int64(len(data))
+			if err = writer.WriteHeader(header); err != nil {
+				return err
+			}
+			if _, err = writer.Write(data); err != nil {
+				return err
+			}
+			continue
+		}
+		if err = writer.WriteHeader(header); err != nil {
+			return err
+		}
+		if _, err = io.Copy(writer, reader); err != nil {
+			return err
+		}
+	}
+	added := make([]string, 0)
+	for pathInBag := range replacements {
+		if !written[pathInBag] {
+			added = append(added, pathInBag)
+		}
+	}
+	if len(added) > 0 && lastFile == nil {
+		return fmt.Errorf("can't add %s to a tar file with no files", strings.Join(added, ", "))
+	}
+	sort.Strings(added)
+	for _, pathInBag := range added {
+		header := *lastFile
+		header.Name = strings.SplitN(lastFile.Name, "/", 2)[0] + "/" + pathInBag
+		header.Size = int64(len(replacements[pathInBag]))
+		if err = writer.WriteHeader(&header); err != nil {
+			return err
+		}
+		if _, err = writer.Write(replacements[pathInBag]); err != nil {
+			return err
+		}
+	}
+	if err = writer.Close(); err != nil {
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,40 @@
+package cmd_test
+
+import (
+	"testing"
+
+	"github.com/APTrust/apt-cmd/cmd"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const md5OfData = "8d777f385d3dfec8815d20f7496026dc"
+
+func TestEncodeDigest(t *testing.T) {
+	digest, err := cmd.EncodeDigest(md5OfData, cmd.HashEncodingHexLower)
+	require.Nil(t, err)
+	assert.Equal(t, md5OfData, digest)
+
+	digest, err = cmd.EncodeDigest(md5OfData, cmd.HashEncodingHexUpper)
+	require.Nil(t, err)
+	assert.Equal(t, "8D777F385D3DFEC8815D20F7496026DC", digest)
+
+	digest, err = cmd.EncodeDigest(md5OfData, cmd.HashEncodingBase64)
+	require.Nil(t, err)
+	assert.Equal(t, "jXd/OF09/siBXSD3SWAm3A==", digest)
+
+	_, err = cmd.EncodeDigest("not hex", cmd.HashEncodingBase64)
+	assert.NotNil(t, err)
+	_, err = cmd.EncodeDigest(md5OfData, "hex")
+	assert.NotNil(t, err)
+}
+
+func TestNormalizeDigest(t *testing.T) {
+	assert.Equal(t, md5OfData, cmd.NormalizeDigest(md5OfData))
+	assert.Equal(t, md5OfData, cmd.NormalizeDigest("8D777F385D3DFEC8815D20F7496026DC"))
+	assert.Equal(t, md5OfData, cmd.NormalizeDigest("jXd/OF09/siBXSD3SWAm3A=="))
+
+	// Not a digest in any encoding we know, so it's unchanged
+	assert.Equal(t, "not a digest", cmd.NormalizeDigest("not a digest"))
+	assert.Equal(t, "ZGF0YQ==", cmd.NormalizeDigest("ZGF0YQ=="))
+}
@@ -0,0 +1,70 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/APTrust/dart-runner/bagit"
+	"github.com/APTrust/dart-runner/constants"
+	"github.com/APTrust/dart-runner/core"
+)
+
+// NewDartJob returns a DART job that does what bag create does: bag
+// the files in bagDirs into outputFile, in the specified BagFormat, using
+// profile, which already has the user's tag values and manifest
+// algorithms, then validate the bag and, if uploadHost is set, upload
+// it.
+//
+// The job's storage service gets its S3 credentials from the
+// APTRUST_AWS_KEY and APTRUST_AWS_SECRET environment variables, using
+// DART's "env:" convention, so we never write secrets to the job file.
+func NewDartJob(profile *bagit.Profile, bagDirs []string, outputFile, format, uploadHost, uploadBucket string) (*core.Job, error) {
+	absBagDirs, err := AbsBagDirs(bagDirs)
+	if err != nil {
+		return nil, err
+	}
+	absOutputPath, err := filepath.Abs(BagOutputPath(outputFile, format))
+	if err != nil {
+		return nil, err
+	}
+	job := core.NewJob()
+	job.BagItProfile = bagit.CloneProfile(profile)
+	job.PackageOp = core.NewPackageOperation(filepath.Base(absOutputPath), absOutputPath, absBagDirs)
+	job.PackageOp.PackageFormat = constants.PackageFormatBagIt
+	if format != BagFormatDirectory {
+		job.PackageOp.BagItSerialization = "." + format
+	}
+	job.ValidationOp = core.NewValidationOperation(absOutputPath)
+	if uploadHost != "" {
+		ss := core.NewStorageService()
+		ss.Name = uploadHost + "/" + uploadBucket
+		ss.Protocol = constants.ProtocolS3
+		ss.Host = uploadHost
+		ss.Bucket = uploadBucket
+		ss.AllowsUpload = true
+		ss.Login = "env:APTRUST_AWS_KEY"
+		ss.Password = "env:APTRUST_AWS_SECRET"
+		if host, port, found := strings.Cut(uploadHost, ":"); found {
+			ss.Host = host
+			ss.Port, err = strconv.Atoi(port)
+			if err != nil {
+				return nil, fmt.Errorf("invalid port in upload host %s", uploadHost)
+			}
+		}
+		job.UploadOps = []*core.UploadOperation{core.NewUploadOperation(ss, []string{absOutputPath})}
+	}
+	return job, nil
+}
+
+// WriteDartJob writes job to pathToFile as JSON.
+func WriteDartJob(job *core.Job, pathToFile string) error {
+	data, err := json.MarshalIndent(job, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(pathToFile, data, 0644)
+}
@@ -0,0 +1,85 @@
+package cmd_test
+
+import (
+	"path"
+	"path/filepath"
+	"testing"
+
+	"github.com/APTrust/apt-cmd/cmd"
+	"github.com/APTrust/dart-runner/core"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewDartJob(t *testing.T) {
+	profile, err := cmd.LoadProfile("aptrust")
+	require.Nil(t, err)
+	profile.ManifestsRequired = []string{"md5", "sha256"}
+	profile.SetTagValue("aptrust-info.txt", "Title", "My Bag")
+
+	job, err := cmd.NewDartJob(profile, []string{"../testbags"}, "out/my_bag.tar", "tar", "127.0.0.1:9899", "test-bucket-1")
+	require.Nil(t, err)
+	absOutput, _ := filepath.Abs("out/my_bag.tar")
+	absBagDir, _ := filepath.Abs("../testbags")
+
+	require.NotNil(t, job.PackageOp)
+	assert.Equal(t, "my_bag.tar", job.PackageOp.PackageName)
+	assert.Equal(t, absOutput, job.PackageOp.OutputPath)
+	assert.Equal(t, []string{absBagDir}, job.PackageOp.SourceFiles)
+	assert.Equal(t, "BagIt", job.PackageOp.PackageFormat)
+	assert.Equal(t, ".tar", job.PackageOp.BagItSerialization)
+	require.NotNil(t, job.ValidationOp)
+	assert.Equal(t, absOutput, job.ValidationOp.PathToBag)
+
+	assert.Equal(t, []string{"md5", "sha256"}, job.BagItProfile.ManifestsRequired)
+	assert.Equal(t, "My Bag", job.BagItProfile.GetTagDef("aptrust-info.txt", "Title").UserValue)
+
+	// The job has its own copy of the profile.
+	profile.SetTagValue("aptrust-info.txt", "Title", "Changed")
+	assert.Equal(t, "My Bag", job.BagItProfile.GetTagDef("aptrust-info.txt", "Title").UserValue)
+
+	require.Len(t, job.UploadOps, 1)
+	ss := job.UploadOps[0].StorageService
+	assert.Equal(t, "s3", ss.Protocol)
+	assert.Equal(t, "127.0.0.1", ss.Host)
+	assert.Equal(t, 9899, ss.Port)
+	assert.Equal(t, "test-bucket-1", ss.Bucket)
+	assert.Equal(t, "env:APTRUST_AWS_KEY", ss.Login)
+	assert.Equal(t, "env:APTRUST_AWS_SECRET", ss.Password)
+	assert.Equal(t, []string{absOutput}, job.UploadOps[0].SourceFiles)
+
+	job, err = cmd.NewDartJob(profile, []string{"../testbags"}, "my_bag.tar", "tar", "", "")
+	require.Nil(t, err)
+	assert.Empty(t, job.UploadOps)
+
+	job, err = cmd.NewDartJob(profile, []string{"../testbags"}, "my_bag.tar", "directory", "", "")
+	require.Nil(t, err)
+	absDir, _ := filepath.Abs("my_bag")
+	assert.Equal(t, absDir, job.PackageOp.OutputPath)
+	assert.Equal(t, absDir, job.ValidationOp.PathToBag)
+	assert.Empty(t, job.PackageOp.BagItSerialization)
+
+	job, err = cmd.NewDartJob(profile, []string{"../testbags"}, "my_bag.tar", "zip", "", "")
+	require.Nil(t, err)
+	absZip, _ := filepath.Abs("my_bag.zip")
+	assert.Equal(t, absZip, job.PackageOp.OutputPath)
+	assert.Equal(t, ".zip", job.PackageOp.BagItSerialization)
+}
+
+func TestWriteDartJob(t *testing.T) {
+	profile, err := cmd.LoadProfile("empty")
+	require.Nil(t, err)
+	job, err := cmd.NewDartJob(profile, []string{"../testbags"}, "my_bag.tar", "tar", "s3.amazonaws.com", "my-bucket")
+	require.Nil(t, err)
+	jobFile := path.Join(t.TempDir(), "job.json")
+	require.Nil(t, cmd.WriteDartJob(job, jobFile))
+
+	// DART can read it back.
+	loaded, err := core.JobFromJson(jobFile)
+	require.Nil(t, err)
+	assert.Equal(t, job.PackageOp.OutputPath, loaded.PackageOp.OutputPath)
+	assert.Equal(t, job.BagItProfile.Name, loaded.BagItProfile.Name)
+	require.Len(t, loaded.UploadOps, 1)
+	assert.Equal(t, "s3.amazonaws.com", loaded.UploadOps[0].StorageService.Host)
+	assert.Equal(t, 0, loaded.UploadOps[0].StorageService.Port)
+}
@@ -0,0 +1,99 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/op/go-logging"
+)
+
+const (
+	LogFormatText = "text"
+	LogFormatJSON = "json"
+)
+
+// LogFormats are the values --log-format accepts.
+var LogFormats = []string{LogFormatText, LogFormatJSON}
+
+// LogFields are key/value pairs to log with a message. Pass them as the
+// last argument to the logger's Debug, Info, Warning or Error, not to
+// the methods that take a format string:
+//
+//	logger.Debug("Creating bag", LogFields{"outputFile": outputFile})
+//
+// With --log-format=json, each field is a key in the JSON object. With
+// --log-format=text, they follow the message as key=value pairs.
+type LogFields map[string]interface{}
+
+// String returns the fields as space-separated key=value pairs, sorted
+// by key. Values with spaces are quoted.
+func (fields LogFields) String() string {
+	keys := make([]string, 0, len(fields))
+	for key := range fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	pairs := make([]string, len(keys))
+	for i, key := range keys {
+		value := fmt.Sprint(fields[key])
+		if strings.ContainsAny(value, " \t\n\"") {
+			value = fmt.Sprintf("%q", value)
+		}
+		pairs[i] = key + "=" + value
+	}
+	return strings.Join(pairs, " ")
+}
+
+// JSONLogBackend writes each log record to its writer as one line of
+// JSON, with the record's level, time, module and message, plus any
+// LogFields passed with it. Fields named level, time, module or msg are
+// dropped, since they'd hide the record's own.
+type JSONLogBackend struct {
+	writer io.Writer
+}
+
+// NewJSONLogBackend returns a backend that writes JSON lines to writer.
+func NewJSONLogBackend(writer io.Writer) *JSONLogBackend {
+	return &JSONLogBackend{writer: writer}
+}
+
+// Log writes record as a line of JSON. It implements logging.Backend.
+func (b *JSONLogBackend) Log(level logging.Level, calldepth int, record *logging.Record) error {
+	entry := make(map[string]interface{})
+	msg := record.Message()
+	args := make([]interface{}, 0, len(record.Args))
+	for _, arg := range record.Args {
+		fields, ok := arg.(LogFields)
+		if !ok {
+			args = append(args, arg)
+			continue
+		}
+		for key, value := range fields {
+			entry[key] = value
+		}
+	}
+	if len(args) < len(record.Args) {
+		// The message is the other args, without the fields.
+		msg = strings.TrimSuffix(fmt.Sprintln(args...), "\n")
+	}
+	entry["level"] = level.String()
+	entry["time"] = record.Time.UTC().Format(time.RFC3339Nano)
+	entry["module"] = record.Module
+	entry["msg"] = msg
+	data, err := json.Marshal(entry)
+	if err != nil {
+		// A field can't be marshalled, so log the message without them.
+		data, _ = json.Marshal(map[string]string{
+			"level":  level.String(),
+			"time":   record.Time.UTC().Format(time.RFC3339Nano),
+			"module": record.Module,
+			"msg":    msg,
+		})
+	}
+	_, err = fmt.Fprintln(b.writer, string(data))
+	return err
+}
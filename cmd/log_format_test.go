@@ -0,0 +1,63 @@
+package cmd_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/APTrust/apt-cmd/cmd"
+	"github.com/op/go-logging"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestJSONLogBackend(t *testing.T) {
+	var buf bytes.Buffer
+	log := logging.MustGetLogger("json-log-test")
+	log.SetBackend(logging.AddModuleLevel(cmd.NewJSONLogBackend(&buf)))
+	log.Debug("Creating bag", cmd.LogFields{"outputFile": "photos.tar", "msg": "ignored"})
+	log.Warningf("File %s changed", "a.txt")
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	require.Len(t, lines, 2)
+	entry := make(map[string]interface{})
+	require.Nil(t, json.Unmarshal([]byte(lines[0]), &entry))
+	assert.Equal(t, "DEBUG", entry["level"])
+	assert.Equal(t, "Creating bag", entry["msg"])
+	assert.Equal(t, "photos.tar", entry["outputFile"])
+	assert.Equal(t, "json-log-test", entry["module"])
+	assert.NotEmpty(t, entry["time"])
+	require.Nil(t, json.Unmarshal([]byte(lines[1]), &entry))
+	assert.Equal(t, "WARNING", entry["level"])
+	assert.Equal(t, "File a.txt changed", entry["msg"])
+}
+
+func TestLogFieldsString(t *testing.T) {
+	fields := cmd.LogFields{"profile": "empty", "bagDirs": "a, b"}
+	assert.Equal(t, `bagDirs="a, b" profile=empty`, fields.String())
+}
+
+func TestLogFormatFlag(t *testing.T) {
+	pathToBag := "../testbags/aptrust/example.edu.sample_good.tar"
+	exitCode, stdout, stderr := execCmd(t, "go", "run", "../main.go", "bag", "validate", "--debug", "--log-format=json", "--profile=aptrust", pathToBag)
+	require.Equal(t, 0, exitCode)
+	assert.Equal(t, "Bag is valid according to aptrust profile.\n", stdout)
+	found := false
+	for _, line := range strings.Split(strings.TrimSpace(stderr), "\n") {
+		if !strings.HasPrefix(line, "{") {
+			continue
+		}
+		entry := make(map[string]interface{})
+		require.Nil(t, json.Unmarshal([]byte(line), &entry), line)
+		if strings.HasPrefix(entry["msg"].(string), "Validating bag") {
+			found = true
+		}
+	}
+	assert.True(t, found, stderr)
+
+	exitCode, _, stderr = execCmd(t, "go", "run", "../main.go", "version", "--log-format=xml")
+	assert.NotEqual(t, cmd.EXIT_OK, exitCode)
+	assert.Contains(t, stderr, "Invalid --log-format 'xml'")
+	assert.Contains(t, stderr, "exit status 3")
+}
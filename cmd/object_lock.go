@@ -0,0 +1,143 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+)
+
+// ObjectLock describes the S3 Object Lock settings for an upload.
+// Mode and RetainUntil go together. They're either both set or both
+// empty.
+type ObjectLock struct {
+	Mode        minio.RetentionMode
+	RetainUntil time.Time
+	LegalHold   bool
+}
+
+// AppliedObjectLock is the Object Lock settings S3 reports for an
+// object after upload. Confirmed is false if we couldn't read the
+// settings back from S3, in which case this describes the settings we
+// requested.
+type AppliedObjectLock struct {
+	Mode        string     `json:"mode"`
+	RetainUntil *time.Time `json:"retainUntil"`
+	LegalHold   string     `json:"legalHold"`
+	Confirmed   bool       `json:"confirmed"`
+}
+
+// retainUntilFormats are the formats we accept for --retain-until.
+var retainUntilFormats = []string{
+	time.RFC3339,
+	"2006-01-02",
+}
+
+// ParseObjectLock parses the --retention-mode, --retain-until and
+// --legal-hold flags. It returns nil if none of them is set. Mode is
+// case-insensitive. Param now is the current time, since the retain
+// until date must be in the future.
+func ParseObjectLock(mode, retainUntil string, legalHold bool, now time.Time) (*ObjectLock, error) {
+	if mode == "" && retainUntil == "" && !legalHold {
+		return nil, nil
+	}
+	lock := &ObjectLock{LegalHold: legalHold}
+	if mode == "" && retainUntil == "" {
+		return lock, nil
+	}
+	if mode == "" || retainUntil == "" {
+		return nil, fmt.Errorf("--retention-mode and --retain-until must be used together")
+	}
+	lock.Mode = minio.RetentionMode(strings.ToUpper(mode))
+	if !lock.Mode.IsValid() {
+		return nil, fmt.Errorf("invalid --retention-mode '%s'. Use GOVERNANCE or COMPLIANCE", mode)
+	}
+	for _, format := range retainUntilFormats {
+		if date, err := time.Parse(format, retainUntil); err == nil {
+			lock.RetainUntil = date.UTC()
+			break
+		}
+	}
+	if lock.RetainUntil.IsZero() {
+		return nil, fmt.Errorf("invalid --retain-until '%s'. Use a date like 2030-01-31 or a timestamp like 2030-01-31T12:00:00Z", retainUntil)
+	}
+	if !lock.RetainUntil.After(now) {
+		return nil, fmt.Errorf("--retain-until %s is not in the future", lock.RetainUntil.Format(time.RFC3339))
+	}
+	return lock, nil
+}
+
+// Requested returns the settings we asked S3 to apply, for when we
+// can't read back the settings S3 actually applied.
+func (lock *ObjectLock) Requested() *AppliedObjectLock {
+	requested := &AppliedObjectLock{
+		Mode:      lock.Mode.String(),
+		LegalHold: minio.LegalHoldDisabled.String(),
+	}
+	if !lock.RetainUntil.IsZero() {
+		retainUntil := lock.RetainUntil
+		requested.RetainUntil = &retainUntil
+	}
+	if lock.LegalHold {
+		requested.LegalHold = minio.LegalHoldEnabled.String()
+	}
+	return requested
+}
+
+// Apply sets the Object Lock fields of opts. S3 requires an MD5
+// digest on uploads with Object Lock settings, so this turns that on,
+// too.
+func (lock *ObjectLock) Apply(opts *minio.PutObjectOptions) {
+	if lock == nil {
+		return
+	}
+	opts.Mode = lock.Mode
+	opts.RetainUntilDate = lock.RetainUntil
+	if lock.LegalHold {
+		opts.LegalHold = minio.LegalHoldEnabled
+	}
+	opts.SendContentMd5 = true
+}
+
+// CheckBucketObjectLock returns an error if bucket doesn't have Object
+// Lock enabled, since S3 rejects, or on some services silently
+// ignores, retention settings on such buckets. Object Lock can only be
+// enabled when a bucket is created, so the user can't fix this by
+// retrying.
+func CheckBucketObjectLock(ctx context.Context, client *minio.Client, bucket string) error {
+	objectLock, _, _, _, err := client.GetObjectLockConfig(ctx, bucket)
+	if err != nil {
+		if minio.ToErrorResponse(err).Code == "ObjectLockConfigurationNotFoundError" {
+			return fmt.Errorf("bucket %s does not have Object Lock enabled, so it can't apply --retention-mode, --retain-until or --legal-hold", bucket)
+		}
+		return fmt.Errorf("can't get Object Lock configuration for bucket %s: %w", bucket, err)
+	}
+	if objectLock != "Enabled" {
+		return fmt.Errorf("bucket %s does not have Object Lock enabled, so it can't apply --retention-mode, --retain-until or --legal-hold", bucket)
+	}
+	return nil
+}
+
+// GetAppliedObjectLock returns the Object Lock settings S3 reports for
+// an object, so we can tell the user what was actually applied.
+func GetAppliedObjectLock(ctx context.Context, client *minio.Client, bucket, key, versionID string) (*AppliedObjectLock, error) {
+	applied := &AppliedObjectLock{Confirmed: true}
+	mode, retainUntil, err := client.GetObjectRetention(ctx, bucket, key, versionID)
+	if err != nil && minio.ToErrorResponse(err).Code != "NoSuchObjectLockConfiguration" {
+		return nil, err
+	}
+	if mode != nil {
+		applied.Mode = mode.String()
+	}
+	applied.RetainUntil = retainUntil
+	legalHold, err := client.GetObjectLegalHold(ctx, bucket, key, minio.GetObjectLegalHoldOptions{VersionID: versionID})
+	if err != nil && minio.ToErrorResponse(err).Code != "NoSuchObjectLockConfiguration" {
+		return nil, err
+	}
+	if legalHold != nil {
+		applied.LegalHold = legalHold.String()
+	}
+	return applied, nil
+}
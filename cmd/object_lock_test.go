@@ -0,0 +1,74 @@
+package cmd_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/APTrust/apt-cmd/cmd"
+	"github.com/minio/minio-go/v7"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseObjectLock(t *testing.T) {
+	now := time.Date(2023, 4, 6, 12, 0, 0, 0, time.UTC)
+
+	lock, err := cmd.ParseObjectLock("", "", false, now)
+	require.Nil(t, err)
+	assert.Nil(t, lock)
+
+	lock, err = cmd.ParseObjectLock("governance", "2030-01-31", false, now)
+	require.Nil(t, err)
+	assert.Equal(t, minio.Governance, lock.Mode)
+	assert.Equal(t, time.Date(2030, 1, 31, 0, 0, 0, 0, time.UTC), lock.RetainUntil)
+	assert.False(t, lock.LegalHold)
+
+	lock, err = cmd.ParseObjectLock("COMPLIANCE", "2030-01-31T12:30:00-05:00", true, now)
+	require.Nil(t, err)
+	assert.Equal(t, minio.Compliance, lock.Mode)
+	assert.Equal(t, time.Date(2030, 1, 31, 17, 30, 0, 0, time.UTC), lock.RetainUntil)
+	assert.True(t, lock.LegalHold)
+
+	// Legal hold doesn't need retention.
+	lock, err = cmd.ParseObjectLock("", "", true, now)
+	require.Nil(t, err)
+	assert.Equal(t, minio.RetentionMode(""), lock.Mode)
+	assert.True(t, lock.RetainUntil.IsZero())
+	assert.True(t, lock.LegalHold)
+
+	_, err = cmd.ParseObjectLock("GOVERNANCE", "", false, now)
+	assert.Contains(t, err.Error(), "must be used together")
+	_, err = cmd.ParseObjectLock("", "2030-01-31", false, now)
+	assert.Contains(t, err.Error(), "must be used together")
+	_, err = cmd.ParseObjectLock("FOREVER", "2030-01-31", false, now)
+	assert.Contains(t, err.Error(), "invalid --retention-mode")
+	_, err = cmd.ParseObjectLock("GOVERNANCE", "next year", false, now)
+	assert.Contains(t, err.Error(), "invalid --retain-until")
+	_, err = cmd.ParseObjectLock("GOVERNANCE", "2020-01-31", false, now)
+	assert.Contains(t, err.Error(), "is not in the future")
+}
+
+func TestObjectLockApply(t *testing.T) {
+	opts := minio.PutObjectOptions{}
+	var noLock *cmd.ObjectLock
+	noLock.Apply(&opts)
+	assert.Equal(t, minio.PutObjectOptions{}, opts)
+
+	retainUntil := time.Date(2030, 1, 31, 0, 0, 0, 0, time.UTC)
+	lock := &cmd.ObjectLock{Mode: minio.Compliance, RetainUntil: retainUntil, LegalHold: true}
+	lock.Apply(&opts)
+	assert.Equal(t, minio.Compliance, opts.Mode)
+	assert.Equal(t, retainUntil, opts.RetainUntilDate)
+	assert.Equal(t, minio.LegalHoldEnabled, opts.LegalHold)
+	assert.True(t, opts.SendContentMd5)
+
+	requested := lock.Requested()
+	assert.Equal(t, "COMPLIANCE", requested.Mode)
+	assert.Equal(t, retainUntil, *requested.RetainUntil)
+	assert.Equal(t, "ON", requested.LegalHold)
+	assert.False(t, requested.Confirmed)
+
+	requested = (&cmd.ObjectLock{LegalHold: false}).Requested()
+	assert.Nil(t, requested.RetainUntil)
+	assert.Equal(t, "OFF", requested.LegalHold)
+}
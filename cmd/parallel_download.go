@@ -0,0 +1,126 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+
+	"github.com/minio/minio-go/v7"
+)
+
+// ByteRange is an inclusive range of bytes in an S3 object, as in an
+// HTTP Range header.
+type ByteRange struct {
+	Start int64
+	End   int64
+}
+
+// Len returns the number of bytes in the range.
+func (r ByteRange) Len() int64 {
+	return r.End - r.Start + 1
+}
+
+// SplitByteRanges splits an object of objectSize bytes into at most
+// count ranges of nearly equal size, in order. It returns fewer ranges
+// if the object has fewer than count bytes, and none for an empty
+// object.
+func SplitByteRanges(objectSize int64, count int) []ByteRange {
+	ranges := make([]ByteRange, 0, count)
+	if objectSize <= 0 || count < 1 {
+		return ranges
+	}
+	rangeSize := (objectSize + int64(count) - 1) / int64(count)
+	for start := int64(0); start < objectSize; start += rangeSize {
+		end := start + rangeSize - 1
+		if end >= objectSize {
+			end = objectSize - 1
+		}
+		ranges = append(ranges, ByteRange{Start: start, End: end})
+	}
+	return ranges
+}
+
+// ParallelDownload downloads the object described by objInfo into file,
+// splitting it into concurrency byte ranges and downloading them at
+// the same time with ranged GetObject requests. Each request writes
+// its bytes at their own offset in the file. If any request fails, this
+// cancels the others and returns the first error. If the server
+// ignores the ranges, this downloads the object again in a single
+// request. The contents of file are undefined after an error, so the
+// caller should delete it. If counter isn't nil, it counts the bytes as
+// they arrive. If limiter isn't nil, all of the ranges together are
+// held to its limit. Each range retries according to retry, continuing
+// where it left off.
+func ParallelDownload(ctx context.Context, client *minio.Client, bucket, key string, objInfo minio.ObjectInfo, file *os.File, concurrency int, counter *DownloadCounter, limiter *RateLimiter, retry S3RetryPolicy) error {
+	// Set the file to its final size up front, in case the last range
+	// finishes first.
+	if err := file.Truncate(objInfo.Size); err != nil {
+		return err
+	}
+	counted := int64(0)
+	if counter != nil {
+		counted = counter.Bytes()
+	}
+	rangeCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var wg sync.WaitGroup
+	var once sync.Once
+	var firstErr error
+	var downloaded atomic.Int64
+	for _, byteRange := range SplitByteRanges(objInfo.Size, concurrency) {
+		wg.Add(1)
+		go func(byteRange ByteRange) {
+			defer wg.Done()
+			n, err := downloadRange(rangeCtx, client, bucket, key, objInfo.ETag, byteRange, file, counter, limiter, retry)
+			downloaded.Add(n)
+			if err != nil {
+				once.Do(func() {
+					firstErr = err
+					cancel()
+				})
+			}
+		}(byteRange)
+	}
+	wg.Wait()
+	if errors.Is(firstErr, ErrRangeIgnored) && ctx.Err() == nil {
+		if retry.Logger != nil {
+			retry.Logger.Warningf("Downloading %s in a single request, because %s", key, firstErr)
+		}
+		if counter != nil {
+			counter.bytes.Store(counted)
+		}
+		n, err := downloadRange(ctx, client, bucket, key, objInfo.ETag, ByteRange{Start: 0, End: objInfo.Size - 1}, file, counter, limiter, retry)
+		downloaded.Store(n)
+		firstErr = err
+	}
+	if firstErr != nil {
+		return firstErr
+	}
+	if downloaded.Load() != objInfo.Size {
+		return fmt.Errorf("downloaded %d bytes, but object is %d bytes", downloaded.Load(), objInfo.Size)
+	}
+	return nil
+}
+
+// downloadRange downloads one range of an object into file, and
+// returns the number of bytes it wrote. Requiring the object's ETag
+// ensures that every range comes from the same version of the object,
+// even if someone overwrites it mid-download.
+func downloadRange(ctx context.Context, client *minio.Client, bucket, key, etag string, byteRange ByteRange, file *os.File, counter *DownloadCounter, limiter *RateLimiter, retry S3RetryPolicy) (int64, error) {
+	var writer io.Writer = io.NewOffsetWriter(file, byteRange.Start)
+	if counter != nil {
+		writer = io.MultiWriter(writer, counter)
+	}
+	if limiter != nil {
+		writer = io.MultiWriter(writer, limiter.Writer(ctx))
+	}
+	n, err := retry.CopyObject(ctx, client, bucket, key, etag, byteRange.Start, byteRange.Len(), writer)
+	if err != nil {
+		return n, fmt.Errorf("error downloading bytes %d-%d: %w", byteRange.Start, byteRange.End, err)
+	}
+	return n, nil
+}
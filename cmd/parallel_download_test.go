@@ -0,0 +1,79 @@
+package cmd_test
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/APTrust/apt-cmd/cmd"
+	"github.com/minio/minio-go/v7"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSplitByteRanges(t *testing.T) {
+	ranges := cmd.SplitByteRanges(10, 3)
+	assert.Equal(t, []cmd.ByteRange{{Start: 0, End: 3}, {Start: 4, End: 7}, {Start: 8, End: 9}}, ranges)
+	total := int64(0)
+	for _, byteRange := range ranges {
+		total += byteRange.Len()
+	}
+	assert.Equal(t, int64(10), total)
+
+	assert.Equal(t, []cmd.ByteRange{{Start: 0, End: 99}}, cmd.SplitByteRanges(100, 1))
+	assert.Equal(t, []cmd.ByteRange{{Start: 0, End: 49}, {Start: 50, End: 99}}, cmd.SplitByteRanges(100, 2))
+
+	// Never more ranges than bytes, and none for an empty object.
+	assert.Equal(t, []cmd.ByteRange{{Start: 0, End: 0}, {Start: 1, End: 1}}, cmd.SplitByteRanges(2, 8))
+	assert.Empty(t, cmd.SplitByteRanges(0, 4))
+}
+
+func TestParallelDownload(t *testing.T) {
+	content := "0123456789ABCDEFGHIJ"
+	for _, ignoreRanges := range []bool{false, true} {
+		var mutex sync.Mutex
+		requests := make([]string, 0)
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mutex.Lock()
+			requests = append(requests, r.Header.Get("Range"))
+			mutex.Unlock()
+			w.Header().Set("ETag", `"etag"`)
+			w.Header().Set("Last-Modified", time.Now().UTC().Format(http.TimeFormat))
+			if ignoreRanges {
+				// Like a server without range support, send it all.
+				w.Header().Set("Content-Length", fmt.Sprint(len(content)))
+				fmt.Fprint(w, content)
+				return
+			}
+			http.ServeContent(w, r, "", time.Now(), strings.NewReader(content))
+		}))
+		config := &cmd.Config{AWSKey: "key", AWSSecret: "secret", AWSRegion: "us-east-1", S3PathStyle: true}
+		client := cmd.NewS3Client(config, strings.TrimPrefix(server.URL, "http://"))
+		file, err := os.Create(path.Join(t.TempDir(), "object.txt"))
+		require.Nil(t, err)
+		counter := &cmd.DownloadCounter{}
+		objInfo := minio.ObjectInfo{Key: "object.txt", Size: int64(len(content)), ETag: "etag"}
+		err = cmd.ParallelDownload(context.Background(), client, "bucket", "object.txt", objInfo, file, 4, counter, nil, cmd.S3RetryPolicy{})
+		require.Nil(t, err, ignoreRanges)
+		require.Nil(t, file.Close())
+		data, err := os.ReadFile(file.Name())
+		require.Nil(t, err)
+		assert.Equal(t, content, string(data), ignoreRanges)
+		assert.Equal(t, int64(len(content)), counter.Bytes(), ignoreRanges)
+		if ignoreRanges {
+			// Four ranges, then one request for the whole object.
+			assert.Equal(t, 5, len(requests))
+			assert.Equal(t, "bytes=0-19", requests[4])
+		} else {
+			assert.Equal(t, 4, len(requests))
+		}
+		server.Close()
+	}
+}
@@ -0,0 +1,30 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/spf13/cobra"
+)
+
+// profileCmd is the top-level command for BagIt profile operations
+var profileCmd = &cobra.Command{
+	Use:   "profile",
+	Short: "Inspect and validate BagIt profiles.",
+	Long: `Inspect and validate BagIt profiles.
+For more info, run:
+
+    apt-cmd profile validate --help
+
+Full online documentation:
+
+  https://aptrust.github.io/userguide/partner_tools/
+
+	`,
+	Run: func(cmd *cobra.Command, args []string) {
+		fmt.Println("Inspect and validate BagIt profiles. See subcommands for more info.")
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(profileCmd)
+}
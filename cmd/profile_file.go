@@ -0,0 +1,169 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/APTrust/dart-runner/bagit"
+)
+
+// IsProfileFile returns true if --profile names a BagIt profile file
+// rather than one of the built-in profiles.
+func IsProfileFile(name string) bool {
+	return strings.HasSuffix(strings.ToLower(name), ".json")
+}
+
+// standardProfile is a BagIt profile in the format described by the
+// bagit-profiles specification at
+// https://github.com/bagit-profiles/bagit-profiles-specification.
+type standardProfile struct {
+	BagItProfileInfo struct {
+		BagItProfileIdentifier string `json:"BagIt-Profile-Identifier"`
+		BagItProfileVersion    string `json:"BagIt-Profile-Version"`
+		ContactEmail           string `json:"Contact-Email"`
+		ContactName            string `json:"Contact-Name"`
+		ExternalDescription    string `json:"External-Description"`
+		SourceOrganization     string `json:"Source-Organization"`
+	} `json:"BagIt-Profile-Info"`
+	BagInfo map[string]struct {
+		Required    bool     `json:"required"`
+		Values      []string `json:"values"`
+		Pattern     string   `json:"pattern"`
+		Description string   `json:"description"`
+	} `json:"Bag-Info"`
+	ManifestsRequired    []string `json:"Manifests-Required"`
+	ManifestsAllowed     []string `json:"Manifests-Allowed"`
+	AllowFetchTxt        *bool    `json:"Allow-Fetch.txt"`
+	Serialization        string   `json:"Serialization"`
+	AcceptSerialization  []string `json:"Accept-Serialization"`
+	AcceptBagItVersion   []string `json:"Accept-BagIt-Version"`
+	TagManifestsRequired []string `json:"Tag-Manifests-Required"`
+	TagManifestsAllowed  []string `json:"Tag-Manifests-Allowed"`
+	TagFilesRequired     []string `json:"Tag-Files-Required"`
+	TagFilesAllowed      []string `json:"Tag-Files-Allowed"`
+}
+
+// ReadProfileFile parses the BagIt profile in the JSON file at
+// pathToFile. The file may be a DART-style profile, like the built-in
+// profiles, or a standard bagit-profiles profile, which we convert to
+// a DART profile. This doesn't check whether the profile makes sense.
+// Use ValidateProfile for that.
+func ReadProfileFile(pathToFile string) (*bagit.Profile, error) {
+	data, err := os.ReadFile(pathToFile)
+	if err != nil {
+		return nil, fmt.Errorf("can't read BagIt profile %s: %w", pathToFile, err)
+	}
+	var fields map[string]json.RawMessage
+	if err = json.Unmarshal(data, &fields); err != nil {
+		return nil, fmt.Errorf("can't parse BagIt profile %s: %w", pathToFile, err)
+	}
+	if _, ok := fields["BagIt-Profile-Info"]; ok {
+		standard := &standardProfile{}
+		if err = json.Unmarshal(data, standard); err != nil {
+			return nil, fmt.Errorf("can't parse BagIt profile %s: %w", pathToFile, err)
+		}
+		name := strings.TrimSuffix(filepath.Base(pathToFile), filepath.Ext(pathToFile))
+		return standard.toProfile(name), nil
+	}
+	profile := &bagit.Profile{}
+	if err = json.Unmarshal(data, profile); err != nil {
+		return nil, fmt.Errorf("can't parse BagIt profile %s: %w", pathToFile, err)
+	}
+	if err = readDARTTagPatterns(profile, data); err != nil {
+		return nil, fmt.Errorf("can't parse BagIt profile %s: %w", pathToFile, err)
+	}
+	return profile, nil
+}
+
+// toProfile converts a standard profile to a DART profile. The standard
+// format leaves out some settings, so we fill in the defaults the
+// specification describes, limited to what this tool supports.
+func (standard *standardProfile) toProfile(name string) *bagit.Profile {
+	profile := bagit.NewProfile()
+	profile.Name = name
+	profile.Description = standard.BagItProfileInfo.ExternalDescription
+	profile.BagItProfileInfo = bagit.ProfileInfo{
+		BagItProfileIdentifier: standard.BagItProfileInfo.BagItProfileIdentifier,
+		BagItProfileVersion:    standard.BagItProfileInfo.BagItProfileVersion,
+		ContactEmail:           standard.BagItProfileInfo.ContactEmail,
+		ContactName:            standard.BagItProfileInfo.ContactName,
+		ExternalDescription:    standard.BagItProfileInfo.ExternalDescription,
+		SourceOrganization:     standard.BagItProfileInfo.SourceOrganization,
+	}
+	profile.AllowFetchTxt = standard.AllowFetchTxt == nil || *standard.AllowFetchTxt
+	if standard.Serialization != "" {
+		profile.Serialization = standard.Serialization
+	}
+	if len(standard.AcceptSerialization) > 0 {
+		profile.AcceptSerialization = standard.AcceptSerialization
+	}
+	if len(standard.AcceptBagItVersion) > 0 {
+		profile.AcceptBagItVersion = standard.AcceptBagItVersion
+	}
+	profile.ManifestsRequired = nonNilList(standard.ManifestsRequired)
+	profile.ManifestsAllowed = allowedOrSupported(standard.ManifestsAllowed)
+	profile.TagManifestsRequired = nonNilList(standard.TagManifestsRequired)
+	profile.TagManifestsAllowed = allowedOrSupported(standard.TagManifestsAllowed)
+	profile.TagFilesRequired = nonNilList(standard.TagFilesRequired)
+	profile.TagFilesAllowed = nonNilList(standard.TagFilesAllowed)
+
+	// Every bag has these, but standard profiles don't describe them.
+	profile.Tags = append(profile.Tags,
+		&bagit.TagDefinition{TagFile: "bagit.txt", TagName: "BagIt-Version", Required: true, DefaultValue: "1.0"},
+		&bagit.TagDefinition{TagFile: "bagit.txt", TagName: "Tag-File-Character-Encoding", Required: true, DefaultValue: "UTF-8"},
+	)
+	// Sort the bag-info tags, so they come out in the same order
+	// every time.
+	tagNames := make([]string, 0, len(standard.BagInfo))
+	for tagName := range standard.BagInfo {
+		tagNames = append(tagNames, tagName)
+	}
+	sort.Strings(tagNames)
+	for _, tagName := range tagNames {
+		tag := standard.BagInfo[tagName]
+		profile.Tags = append(profile.Tags, &bagit.TagDefinition{
+			TagFile:  "bag-info.txt",
+			TagName:  tagName,
+			Required: tag.Required,
+			EmptyOK:  !tag.Required && len(tag.Values) == 0,
+			Values:   nonNilList(tag.Values),
+			Help:     tag.Description,
+		})
+		SetTagPattern(profile, "bag-info.txt", tagName, tag.Pattern)
+	}
+	return profile
+}
+
+// allowedOrSupported returns algs, or all of the manifest algorithms
+// we support if algs is empty, since standard profiles that don't list
+// allowed algorithms allow any algorithm.
+func allowedOrSupported(algs []string) []string {
+	if len(algs) > 0 {
+		return algs
+	}
+	return append([]string{}, SupportedManifestAlgorithms...)
+}
+
+func nonNilList(items []string) []string {
+	if items == nil {
+		return []string{}
+	}
+	return items
+}
+
+// loadProfileFile reads and checks the BagIt profile file for
+// LoadProfile, so we never bag or validate with a broken profile.
+func loadProfileFile(pathToFile string) (*bagit.Profile, error) {
+	profile, err := ReadProfileFile(pathToFile)
+	if err != nil {
+		return nil, err
+	}
+	if errors := ValidateProfile(profile); len(errors) > 0 {
+		return nil, fmt.Errorf("BagIt profile %s is invalid: %s", pathToFile, strings.Join(errors, " "))
+	}
+	return profile, nil
+}
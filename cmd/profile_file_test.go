@@ -0,0 +1,119 @@
+package cmd_test
+
+import (
+	"os"
+	"path"
+	"testing"
+
+	"github.com/APTrust/apt-cmd/cmd"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// standardProfileJSON is a profile in bagit-profiles format.
+const standardProfileJSON = `{
+  "BagIt-Profile-Info": {
+    "BagIt-Profile-Identifier": "https://example.edu/bagit-profile-v1.json",
+    "BagIt-Profile-Version": "1.0",
+    "Source-Organization": "Example University",
+    "External-Description": "Example University deposit profile",
+    "Version": "1.3.0"
+  },
+  "Bag-Info": {
+    "Source-Organization": {"required": true, "values": ["Example University"]},
+    "Contact-Email": {"required": false, "description": "Who to ask about this bag"}
+  },
+  "Manifests-Required": ["sha256"],
+  "Allow-Fetch.txt": false,
+  "Serialization": "optional",
+  "Accept-Serialization": ["application/tar"],
+  "Accept-BagIt-Version": ["1.0"],
+  "Tag-Files-Required": []
+}`
+
+func writeProfileFile(t *testing.T, name, contents string) string {
+	pathToFile := path.Join(t.TempDir(), name)
+	require.Nil(t, os.WriteFile(pathToFile, []byte(contents), 0644))
+	return pathToFile
+}
+
+func TestIsProfileFile(t *testing.T) {
+	assert.True(t, cmd.IsProfileFile("my_profile.json"))
+	assert.True(t, cmd.IsProfileFile("/profiles/MY_PROFILE.JSON"))
+	assert.False(t, cmd.IsProfileFile("aptrust"))
+	assert.False(t, cmd.IsProfileFile("profile.json.txt"))
+}
+
+func TestReadProfileFile(t *testing.T) {
+	// DART profiles load the same as the built-ins.
+	profile, err := cmd.ReadProfileFile("profiles/btr-v1.0.json")
+	require.Nil(t, err)
+	builtIn, err := cmd.LoadProfile("btr")
+	require.Nil(t, err)
+	assert.Equal(t, builtIn, profile)
+
+	profile, err = cmd.ReadProfileFile(writeProfileFile(t, "example.json", standardProfileJSON))
+	require.Nil(t, err)
+	assert.Equal(t, "example", profile.Name)
+	assert.Equal(t, "https://example.edu/bagit-profile-v1.json", profile.BagItProfileInfo.BagItProfileIdentifier)
+	assert.Equal(t, "Example University deposit profile", profile.Description)
+	assert.Equal(t, []string{"sha256"}, profile.ManifestsRequired)
+	assert.Equal(t, cmd.SupportedManifestAlgorithms, profile.ManifestsAllowed)
+	assert.Equal(t, []string{"1.0"}, profile.AcceptBagItVersion)
+	assert.False(t, profile.AllowFetchTxt)
+	sourceOrg := profile.GetTagDef("bag-info.txt", "Source-Organization")
+	require.NotNil(t, sourceOrg)
+	assert.True(t, sourceOrg.Required)
+	assert.Equal(t, []string{"Example University"}, sourceOrg.Values)
+	contactEmail := profile.GetTagDef("bag-info.txt", "Contact-Email")
+	require.NotNil(t, contactEmail)
+	assert.True(t, contactEmail.EmptyOK)
+	assert.Equal(t, "Who to ask about this bag", contactEmail.Help)
+	assert.NotNil(t, profile.GetTagDef("bagit.txt", "BagIt-Version"))
+	assert.Empty(t, cmd.ValidateProfile(profile))
+
+	_, err = cmd.ReadProfileFile(path.Join(t.TempDir(), "missing.json"))
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), "can't read BagIt profile")
+	assert.Contains(t, err.Error(), "missing.json")
+
+	_, err = cmd.ReadProfileFile(writeProfileFile(t, "broken.json", `{"name": `))
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), "can't parse BagIt profile")
+	assert.Contains(t, err.Error(), "broken.json")
+}
+
+func TestLoadProfileFile(t *testing.T) {
+	profile, err := cmd.LoadProfile(writeProfileFile(t, "example.json", standardProfileJSON))
+	require.Nil(t, err)
+	assert.Equal(t, "example", profile.Name)
+
+	// LoadProfile rejects profiles that parse but don't make sense.
+	invalid := writeProfileFile(t, "invalid.json", `{"name": "Invalid", "manifestsRequired": ["sha256"]}`)
+	_, err = cmd.LoadProfile(invalid)
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), "BagIt profile "+invalid+" is invalid")
+}
+
+func TestBagCreate_CustomProfile(t *testing.T) {
+	bagDir := path.Join(t.TempDir(), "files")
+	require.Nil(t, os.Mkdir(bagDir, 0755))
+	require.Nil(t, os.WriteFile(path.Join(bagDir, "file.txt"), []byte("data"), 0644))
+	profileFile := writeProfileFile(t, "example.json", standardProfileJSON)
+	tmpFile := path.Join(t.TempDir(), "custom-profile.tar")
+
+	exitCode, _, stderr := execCmd(t, "go", "run", "../main.go", "bag", "create", "--profile="+profileFile, "--manifest-algs=sha256", "--output-file="+tmpFile, "--bag-dir="+bagDir)
+	assert.NotEqual(t, 0, exitCode)
+	assert.Contains(t, stderr, "Required tag bag-info.txt/Source-Organization is missing")
+
+	exitCode, _, stderr = execCmd(t, "go", "run", "../main.go", "bag", "create", "--profile="+profileFile, "--manifest-algs=sha256", "--output-file="+tmpFile, "--bag-dir="+bagDir, "--tags=Source-Organization=Example University")
+	require.Equal(t, 0, exitCode, stderr)
+	exitCode, stdout, stderr := execCmd(t, "go", "run", "../main.go", "bag", "validate", "--profile="+profileFile, tmpFile)
+	assert.Equal(t, 0, exitCode, stderr)
+	assert.Contains(t, stdout, "Bag is valid")
+
+	missing := path.Join(t.TempDir(), "missing.json")
+	exitCode, _, stderr = execCmd(t, "go", "run", "../main.go", "bag", "validate", "--profile="+missing, tmpFile)
+	assert.NotEqual(t, 0, exitCode)
+	assert.Contains(t, stderr, missing)
+}
@@ -0,0 +1,153 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/APTrust/dart-runner/bagit"
+	"github.com/APTrust/dart-runner/util"
+	"github.com/spf13/cobra"
+)
+
+// profileValidateCmd represents the profile validate command
+var profileValidateCmd = &cobra.Command{
+	Use:     "validate",
+	Short:   "Check a custom BagIt profile for errors",
+	Example: `apt-cmd profile validate /path/to/my_profile.json`,
+	Long: `Parse a BagIt profile JSON file and check it for internal
+consistency before you use it to create or validate bags. This reports
+all of the problems it finds, not just the first one. The bag create
+and bag validate commands run the same checks on profiles you pass to
+--profile as .json files.
+
+The validator checks that:
+
+  * the file parses as a DART-style or bagit-profiles BagIt profile
+  * every required manifest and tag manifest algorithm is also allowed
+  * every tag definition has a tag file and a valid tag name
+  * no tag is defined more than once in the same tag file, ignoring case
+  * default values and emptyOK settings don't contradict the list of
+    allowed tag values
+  * each tag's "pattern", if it has one, is a valid regular expression,
+    and the tag doesn't also have a list of allowed values
+
+A tag definition's "pattern" is a regular expression that values of
+the tag must match when you create a bag, such as "^ACC-\\d{6}$" for
+accession numbers like ACC-004217. It matches anywhere in the value,
+unless it starts with ^ and ends with $. Patterns go in the tag
+definitions of DART-style profiles, and in the Bag-Info entries of
+bagit-profiles profiles. A tag can have a pattern or a list of allowed
+values, but not both.
+
+Example:
+
+  apt-cmd profile validate my_profile.json
+
+Full online documentation:
+
+https://aptrust.github.io/userguide/partner_tools/
+
+`,
+	Run: func(cmd *cobra.Command, args []string) {
+		pathToProfile := ""
+		if len(args) > 0 {
+			pathToProfile = args[0]
+		}
+		if pathToProfile == "" {
+			if jsonErrors {
+				ExitWithErrors(EXIT_USER_ERR, "Path to profile is required.")
+			}
+			fmt.Println("Path to profile is required.")
+			os.Exit(EXIT_USER_ERR)
+		}
+		logger.Debugf("Validating profile %s", pathToProfile)
+		profile, err := ReadProfileFile(pathToProfile)
+		if err != nil {
+			Fail(EXIT_USER_ERR, "Can't parse profile.", err.Error())
+		}
+		errors := ValidateProfile(profile)
+		if len(errors) > 0 {
+			if jsonErrors {
+				ExitWithErrors(EXIT_USER_ERR, errors...)
+			}
+			fmt.Println("Profile is invalid due to the following errors:")
+			for _, e := range errors {
+				fmt.Println(e)
+			}
+			os.Exit(EXIT_USER_ERR)
+		}
+		fmt.Println("Profile", profile.Name, "is valid.")
+		os.Exit(EXIT_OK)
+	},
+}
+
+func init() {
+	profileCmd.AddCommand(profileValidateCmd)
+}
+
+// ValidateProfile checks a BagIt profile for internal consistency and
+// returns a list of all the problems it finds. This includes the basic
+// checks in bagit.Profile.IsValid(), plus checks on manifest algorithms
+// and tag definitions that IsValid() doesn't cover.
+func ValidateProfile(profile *bagit.Profile) []string {
+	errors := make([]string, 0)
+	if !profile.IsValid() {
+		// Sort these so output is the same from one run to the next.
+		keys := make([]string, 0, len(profile.Errors))
+		for key := range profile.Errors {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			errors = append(errors, profile.Errors[key])
+		}
+	}
+	for _, alg := range profile.ManifestsRequired {
+		if !util.StringListContains(profile.ManifestsAllowed, alg) {
+			errors = append(errors, fmt.Sprintf("Required manifest algorithm '%s' is not in the list of allowed manifest algorithms.", alg))
+		}
+	}
+	for _, alg := range profile.TagManifestsRequired {
+		if !util.StringListContains(profile.TagManifestsAllowed, alg) {
+			errors = append(errors, fmt.Sprintf("Required tag manifest algorithm '%s' is not in the list of allowed tag manifest algorithms.", alg))
+		}
+	}
+	seen := make(map[string]bool)
+	for i, tagDef := range profile.Tags {
+		if strings.TrimSpace(tagDef.TagFile) == "" {
+			errors = append(errors, fmt.Sprintf("Tag definition %d (%s) has no tag file.", i, tagDef.TagName))
+		}
+		if strings.TrimSpace(tagDef.TagName) == "" {
+			errors = append(errors, fmt.Sprintf("Tag definition %d in %s has no tag name.", i, tagDef.TagFile))
+		} else if strings.ContainsAny(tagDef.TagName, ":\r\n") || strings.TrimSpace(tagDef.TagName) != tagDef.TagName {
+			// RFC 8493 allows spaces inside names, just not at either end.
+			errors = append(errors, fmt.Sprintf("Tag %s/%s has an illegal name. Tag names cannot contain colons or line breaks, or begin or end with whitespace.", tagDef.TagFile, tagDef.TagName))
+		}
+		key := tagDef.TagFile + "/" + tagDef.TagName
+		if seen[tagKey(tagDef.TagFile, tagDef.TagName)] {
+			errors = append(errors, fmt.Sprintf("Tag %s is defined more than once.", key))
+		}
+		seen[tagKey(tagDef.TagFile, tagDef.TagName)] = true
+		if pattern := TagPattern(profile, tagDef.TagFile, tagDef.TagName); pattern != "" {
+			if _, err := regexp.Compile(pattern); err != nil {
+				errors = append(errors, fmt.Sprintf("Tag %s has an invalid pattern %s: %v.", key, pattern, err))
+			}
+			if len(tagDef.Values) > 0 {
+				errors = append(errors, fmt.Sprintf("Tag %s has both a pattern and a list of allowed values. Use one or the other.", key))
+			}
+		}
+		if len(tagDef.Values) == 0 {
+			continue
+		}
+		if tagDef.EmptyOK && !util.StringListContains(tagDef.Values, "") {
+			errors = append(errors, fmt.Sprintf("Tag %s allows empty values, but empty string is not in its list of allowed values: %s.", key, strings.Join(tagDef.Values, ",")))
+		}
+		if tagDef.DefaultValue != "" && !tagDef.IsLegalValue(tagDef.DefaultValue) {
+			errors = append(errors, fmt.Sprintf("Tag %s has default value '%s', which is not in its list of allowed values: %s.", key, tagDef.DefaultValue, strings.Join(tagDef.Values, ",")))
+		}
+	}
+	return errors
+}
@@ -0,0 +1,69 @@
+package cmd_test
+
+import (
+	"testing"
+
+	"github.com/APTrust/apt-cmd/cmd"
+	"github.com/APTrust/dart-runner/bagit"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidateProfile(t *testing.T) {
+	// All of our built-in profiles should be valid.
+	for _, name := range []string{"aptrust", "btr", "empty"} {
+		profile, err := cmd.LoadProfile(name)
+		require.Nil(t, err)
+		errors := cmd.ValidateProfile(profile)
+		assert.Empty(t, errors, name)
+	}
+
+	profile, err := cmd.LoadProfile("aptrust")
+	require.Nil(t, err)
+	profile.ManifestsRequired = append(profile.ManifestsRequired, "sha512")
+	profile.TagManifestsRequired = append(profile.TagManifestsRequired, "sha1")
+	profile.Tags = append(profile.Tags,
+		&bagit.TagDefinition{TagFile: "", TagName: "No-File"},
+		&bagit.TagDefinition{TagFile: "custom.txt", TagName: ""},
+		&bagit.TagDefinition{TagFile: "custom.txt", TagName: "Bad: Name"},
+		&bagit.TagDefinition{TagFile: "aptrust-info.txt", TagName: "Title"},
+		&bagit.TagDefinition{TagFile: "custom.txt", TagName: "Color", EmptyOK: true, Values: []string{"red", "blue"}},
+		&bagit.TagDefinition{TagFile: "custom.txt", TagName: "Size", DefaultValue: "huge", Values: []string{"small", "large"}},
+	)
+
+	// Make sure we get all errors, not just the first.
+	errors := cmd.ValidateProfile(profile)
+	require.Equal(t, 8, len(errors))
+	assert.Contains(t, errors[0], "'sha512' is not in the list of allowed manifest")
+	assert.Contains(t, errors[1], "'sha1' is not in the list of allowed tag manifest")
+	assert.Contains(t, errors[2], "has no tag file")
+	assert.Contains(t, errors[3], "has no tag name")
+	assert.Contains(t, errors[4], "custom.txt/Bad: Name has an illegal name")
+	assert.Contains(t, errors[5], "aptrust-info.txt/Title is defined more than once")
+	assert.Contains(t, errors[6], "custom.txt/Color allows empty values")
+	assert.Contains(t, errors[7], "custom.txt/Size has default value 'huge'")
+
+	// Make sure we pick up errors from the profile's own IsValid()
+	profile, err = cmd.LoadProfile("empty")
+	require.Nil(t, err)
+	profile.ManifestsAllowed = []string{}
+	errors = cmd.ValidateProfile(profile)
+	require.Equal(t, 1, len(errors))
+	assert.Contains(t, errors[0], "must allow at least one manifest algorithm")
+
+	// RFC 8493 allows spaces inside tag names, but not at either end.
+	profile, err = cmd.LoadProfile("empty")
+	require.Nil(t, err)
+	profile.Tags = append(profile.Tags, &bagit.TagDefinition{TagFile: "custom.txt", TagName: "Box Number"})
+	assert.Empty(t, cmd.ValidateProfile(profile))
+	profile.Tags = append(profile.Tags,
+		&bagit.TagDefinition{TagFile: "custom.txt", TagName: " Leading"},
+		&bagit.TagDefinition{TagFile: "custom.txt", TagName: "Trailing\t"},
+		&bagit.TagDefinition{TagFile: "custom.txt", TagName: "Line\nBreak"},
+	)
+	errors = cmd.ValidateProfile(profile)
+	require.Equal(t, 3, len(errors))
+	assert.Contains(t, errors[0], "custom.txt/ Leading has an illegal name")
+	assert.Contains(t, errors[1], "has an illegal name")
+	assert.Contains(t, errors[2], "has an illegal name")
+}
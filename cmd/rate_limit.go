@@ -0,0 +1,114 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dustin/go-humanize"
+)
+
+// ParseRateLimit parses a --rate-limit value, such as 10MB/s, 500KiB/s
+// or 2MB, into bytes per second. The "/s" is optional. An empty value,
+// 0 or "unlimited" means no limit, which is 0.
+func ParseRateLimit(value string) (int64, error) {
+	value = strings.TrimSpace(value)
+	if value == "" || strings.EqualFold(value, "unlimited") {
+		return 0, nil
+	}
+	if len(value) > 2 && strings.EqualFold(value[len(value)-2:], "/s") {
+		value = value[:len(value)-2]
+	}
+	bytesPerSecond, err := humanize.ParseBytes(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid rate limit '%s': try a rate like 10MB/s or 500KiB/s", value)
+	}
+	return int64(bytesPerSecond), nil
+}
+
+// RateLimiter caps the combined rate of the bytes it's asked to wait
+// for, so that parallel downloads or upload threads share one limit
+// rather than each getting their own. It's safe for concurrent use. A
+// nil RateLimiter doesn't limit anything.
+type RateLimiter struct {
+	bytesPerSecond int64
+	mutex          sync.Mutex
+	next           time.Time
+}
+
+// NewRateLimiter returns a RateLimiter that allows bytesPerSecond, or
+// nil if bytesPerSecond is 0, meaning no limit.
+func NewRateLimiter(bytesPerSecond int64) *RateLimiter {
+	if bytesPerSecond <= 0 {
+		return nil
+	}
+	return &RateLimiter{bytesPerSecond: bytesPerSecond}
+}
+
+// Wait blocks until n more bytes fit within the limit, or until ctx is
+// canceled, in which case it returns ctx.Err(). Each call reserves its
+// bytes when it's made, so callers take turns in the order they call.
+// Time spent idle doesn't build up a burst allowance.
+func (l *RateLimiter) Wait(ctx context.Context, n int) error {
+	if l == nil || n <= 0 {
+		return ctx.Err()
+	}
+	l.mutex.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	start := l.next
+	l.next = l.next.Add(time.Duration(int64(n) * int64(time.Second) / l.bytesPerSecond))
+	l.mutex.Unlock()
+
+	wait := start.Sub(now)
+	if wait <= 0 {
+		return ctx.Err()
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Writer returns an io.Writer that discards what's written to it, after
+// waiting for it to fit within the limit. Adding it to the writers a
+// download is copied to slows the copy, and so the download, to the
+// limit. With a nil RateLimiter, it just discards.
+func (l *RateLimiter) Writer(ctx context.Context) io.Writer {
+	return &rateLimitedStream{ctx: ctx, limiter: l}
+}
+
+// ProgressReader returns an io.Reader for minio.PutObjectOptions.Progress.
+// minio reads the number of bytes it sent from the Progress reader after
+// each read of the upload, so waiting there slows every upload thread
+// to the limit.
+func (l *RateLimiter) ProgressReader(ctx context.Context) io.Reader {
+	return &rateLimitedStream{ctx: ctx, limiter: l}
+}
+
+// rateLimitedStream waits for each Read or Write to fit within the
+// limiter's limit.
+type rateLimitedStream struct {
+	ctx     context.Context
+	limiter *RateLimiter
+}
+
+func (s *rateLimitedStream) Write(p []byte) (int, error) {
+	if err := s.limiter.Wait(s.ctx, len(p)); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (s *rateLimitedStream) Read(p []byte) (int, error) {
+	return s.Write(p)
+}
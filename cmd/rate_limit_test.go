@@ -0,0 +1,70 @@
+package cmd_test
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/APTrust/apt-cmd/cmd"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseRateLimit(t *testing.T) {
+	rates := map[string]int64{
+		"":          0,
+		"0":         0,
+		"unlimited": 0,
+		"10MB/s":    10000000,
+		"10MB":      10000000,
+		"500KiB/s":  512000,
+		"1.5 MB/S":  1500000,
+		"2048":      2048,
+	}
+	for value, expected := range rates {
+		bytesPerSecond, err := cmd.ParseRateLimit(value)
+		require.Nil(t, err, value)
+		assert.Equal(t, expected, bytesPerSecond, value)
+	}
+	for _, value := range []string{"fast", "10MB/m", "-5MB/s"} {
+		_, err := cmd.ParseRateLimit(value)
+		assert.NotNil(t, err, value)
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	assert.Nil(t, cmd.NewRateLimiter(0))
+	var unlimited *cmd.RateLimiter
+	assert.Nil(t, unlimited.Wait(context.Background(), 1<<30))
+
+	// Four writers share the limit, so 40 KB at 100 KB/s takes about
+	// 0.4 seconds, less the first write, which doesn't wait.
+	limiter := cmd.NewRateLimiter(100000)
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			n, err := limiter.Writer(context.Background()).Write(make([]byte, 10000))
+			assert.Nil(t, err)
+			assert.Equal(t, 10000, n)
+		}()
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+	assert.True(t, elapsed >= 250*time.Millisecond, elapsed)
+	assert.True(t, elapsed < 2*time.Second, elapsed)
+
+	// Reads from the progress reader wait too, and return what they
+	// were asked for.
+	n, err := limiter.ProgressReader(context.Background()).Read(make([]byte, 100))
+	require.Nil(t, err)
+	assert.Equal(t, 100, n)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = limiter.Writer(ctx).Write(make([]byte, 100000))
+	assert.Equal(t, context.Canceled, err)
+}
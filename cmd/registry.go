@@ -10,11 +10,29 @@ import (
 var registryCmd = &cobra.Command{
 	Use:   "registry",
 	Short: "Get files, objects, and work items from the APTrust Registry",
-	Long: `Get files, objects, and work items from the APTrust Registry.
+	Long: `Get files, objects, and work items from the APTrust Registry,
+	and create or update work items.
+
+	Registry requests give up after --timeout, which defaults to 60s. Use
+	0 to wait as long as it takes. Requests that fail with a timeout, a
+	connection error or a 5xx response are retried up to --retries times,
+	waiting --retry-backoff before the first retry, and twice as long
+	before each retry after that. Add --debug to see each retry.
+
+	Requests that create or update records aren't retried, since a request
+	that timed out may have succeeded anyway. Add --retry-writes to retry
+	them too.
+
+	Use --output=results.json to write results to a file instead of
+	stdout. Only the results go to the file. Errors and --debug logs
+	still go to stderr. The file appears only once the results are
+	complete, so an interrupted command never leaves a partial file
+	behind.
+
 	Full online documentation:
 
       https://aptrust.github.io/userguide/partner_tools/
-		
+
 	`,
 	Run: func(cmd *cobra.Command, args []string) {
 		fmt.Println("Retrieve data from the APTrust registry. See subcommands for more info.")
@@ -23,4 +41,9 @@ var registryCmd = &cobra.Command{
 
 func init() {
 	rootCmd.AddCommand(registryCmd)
+	registryCmd.PersistentFlags().DurationVar(&registryTimeout, "timeout", DefaultRegistryTimeout, "give up on each registry request after this long (e.g. 30s or 2m). Zero means no timeout.")
+	registryCmd.PersistentFlags().IntVar(&registryRetries, "retries", DefaultRegistryRetries, "number of times to retry registry requests that fail with a timeout, connection error or 5xx response")
+	registryCmd.PersistentFlags().DurationVar(&registryRetryBackoff, "retry-backoff", DefaultRegistryRetryBackoff, "wait this long before the first retry, doubling the wait for each retry after that")
+	registryCmd.PersistentFlags().BoolVar(&registryRetryWrites, "retry-writes", false, "also retry requests that create or update records")
+	registryCmd.PersistentFlags().StringVar(&resultFile, "output", "", "write results to this file instead of stdout")
 }
@@ -0,0 +1,161 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+
+	"github.com/APTrust/preservation-services/models/registry"
+	"github.com/APTrust/preservation-services/network"
+)
+
+// ErrNotInRegistry means the registry has no record with the id or
+// identifier we asked for.
+var ErrNotInRegistry = errors.New("not in the registry")
+
+// RegistryClient talks to the APTrust Registry's member API. Its typed
+// methods, such as GetFile and ListWorkItems, return registry records
+// as registry.* structs, so Go programs can use them without running
+// apt-cmd and parsing its output. They return errors instead of
+// exiting, and ctx.Err() if ctx is canceled.
+//
+// Each request goes through Policy, which the registry commands set
+// from --timeout, --retries and --retry-backoff. The embedded
+// network.RegistryClient's methods return raw responses, which the
+// commands print as the registry sent them.
+type RegistryClient struct {
+	*network.RegistryClient
+	Policy RegistryRequestPolicy
+}
+
+// RegistryPage describes a page of results from one of RegistryClient's
+// list methods. Count is the registry's total number of records that
+// match the params, and Next is the params for the next page, or nil
+// if this is the last page.
+type RegistryPage struct {
+	Count int
+	Next  url.Values
+}
+
+// GetFile returns the file with the specified id.
+func (client *RegistryClient) GetFile(ctx context.Context, id int64) (*registry.GenericFile, error) {
+	resp, err := client.get(ctx, fmt.Sprintf("file %d", id), func() *network.RegistryResponse { return client.GenericFileByID(id) })
+	if err != nil {
+		return nil, err
+	}
+	return resp.GenericFile(), nil
+}
+
+// GetFileByIdentifier returns the file with the specified identifier,
+// such as example.edu/photos/data/image1.jpg.
+func (client *RegistryClient) GetFileByIdentifier(ctx context.Context, identifier string) (*registry.GenericFile, error) {
+	resp, err := client.get(ctx, "file "+identifier, func() *network.RegistryResponse { return client.GenericFileByIdentifier(identifier) })
+	if err != nil {
+		return nil, err
+	}
+	return resp.GenericFile(), nil
+}
+
+// ListFiles returns the page of files that params asks for, using the
+// same filters as registry list files.
+func (client *RegistryClient) ListFiles(ctx context.Context, params url.Values) ([]*registry.GenericFile, RegistryPage, error) {
+	resp, err := client.get(ctx, "files", func() *network.RegistryResponse { return client.GenericFileList(params) })
+	if err != nil {
+		return nil, RegistryPage{}, err
+	}
+	return resp.GenericFiles(), registryPage(resp), nil
+}
+
+// GetObject returns the intellectual object with the specified id.
+func (client *RegistryClient) GetObject(ctx context.Context, id int64) (*registry.IntellectualObject, error) {
+	resp, err := client.get(ctx, fmt.Sprintf("object %d", id), func() *network.RegistryResponse { return client.IntellectualObjectByID(id) })
+	if err != nil {
+		return nil, err
+	}
+	return resp.IntellectualObject(), nil
+}
+
+// GetObjectByIdentifier returns the intellectual object with the
+// specified identifier, such as example.edu/photos.
+func (client *RegistryClient) GetObjectByIdentifier(ctx context.Context, identifier string) (*registry.IntellectualObject, error) {
+	resp, err := client.get(ctx, "object "+identifier, func() *network.RegistryResponse { return client.IntellectualObjectByIdentifier(identifier) })
+	if err != nil {
+		return nil, err
+	}
+	return resp.IntellectualObject(), nil
+}
+
+// ListObjects returns the page of intellectual objects that params asks
+// for, using the same filters as registry list objects.
+func (client *RegistryClient) ListObjects(ctx context.Context, params url.Values) ([]*registry.IntellectualObject, RegistryPage, error) {
+	resp, err := client.get(ctx, "objects", func() *network.RegistryResponse { return client.IntellectualObjectList(params) })
+	if err != nil {
+		return nil, RegistryPage{}, err
+	}
+	return resp.IntellectualObjects(), registryPage(resp), nil
+}
+
+// GetWorkItem returns the work item with the specified id.
+func (client *RegistryClient) GetWorkItem(ctx context.Context, id int64) (*registry.WorkItem, error) {
+	resp, err := client.get(ctx, fmt.Sprintf("work item %d", id), func() *network.RegistryResponse { return client.WorkItemByID(id) })
+	if err != nil {
+		return nil, err
+	}
+	return resp.WorkItem(), nil
+}
+
+// ListWorkItems returns the page of work items that params asks for,
+// using the same filters as registry list workitems.
+func (client *RegistryClient) ListWorkItems(ctx context.Context, params url.Values) ([]*registry.WorkItem, RegistryPage, error) {
+	resp, err := client.get(ctx, "work items", func() *network.RegistryResponse { return client.WorkItemList(params) })
+	if err != nil {
+		return nil, RegistryPage{}, err
+	}
+	return resp.WorkItems(), registryPage(resp), nil
+}
+
+// ListChecksums returns the page of checksums that params asks for,
+// such as the checksums of the files of one object, with
+// intellectual_object_id.
+func (client *RegistryClient) ListChecksums(ctx context.Context, params url.Values) ([]*registry.Checksum, RegistryPage, error) {
+	resp, err := client.get(ctx, "checksums", func() *network.RegistryResponse { return client.ChecksumList(params) })
+	if err != nil {
+		return nil, RegistryPage{}, err
+	}
+	return resp.Checksums(), registryPage(resp), nil
+}
+
+// ListStorageRecords returns the page of storage records that params
+// asks for. The registry filters these only by generic_file_id, to get
+// the records that say where each copy of a file is stored.
+func (client *RegistryClient) ListStorageRecords(ctx context.Context, params url.Values) ([]*registry.StorageRecord, RegistryPage, error) {
+	resp, err := client.get(ctx, "storage records", func() *network.RegistryResponse { return client.StorageRecordList(params) })
+	if err != nil {
+		return nil, RegistryPage{}, err
+	}
+	return resp.StorageRecords(), registryPage(resp), nil
+}
+
+// get runs a request that reads what from the registry, according to
+// the client's policy. The error wraps ErrNotInRegistry if the registry
+// returned 404.
+func (client *RegistryClient) get(ctx context.Context, what string, request func() *network.RegistryResponse) (*network.RegistryResponse, error) {
+	resp, err := client.Policy.Run(ctx, request)
+	if err != nil {
+		return nil, err
+	}
+	if resp.Response != nil && resp.ObjectNotFound() {
+		return nil, fmt.Errorf("%s is %w", what, ErrNotInRegistry)
+	}
+	if resp.Error != nil {
+		return nil, fmt.Errorf("can't get %s from the registry: %w", what, resp.Error)
+	}
+	return resp, nil
+}
+
+// registryPage returns the count and next page params of a list
+// response.
+func registryPage(resp *network.RegistryResponse) RegistryPage {
+	return RegistryPage{Count: resp.Count, Next: resp.ParamsForNextPage()}
+}
@@ -0,0 +1,119 @@
+package cmd_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/APTrust/apt-cmd/cmd"
+	"github.com/APTrust/preservation-services/models/registry"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeRegistry returns a registry server with object 1,
+// example.edu/photos, which has files 11 and 12, listed one per page,
+// and checksum 21.
+func fakeRegistry(t *testing.T) *httptest.Server {
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/member-api/v3/objects/show/example.edu/photos":
+			json.NewEncoder(w).Encode(&registry.IntellectualObject{ID: 1, Identifier: "example.edu/photos"})
+		case "/member-api/v3/files/show/11":
+			json.NewEncoder(w).Encode(&registry.GenericFile{ID: 11, Identifier: "example.edu/photos/data/a.jpg"})
+		case "/member-api/v3/files":
+			assert.Equal(t, "1", r.URL.Query().Get("intellectual_object_id"))
+			if r.URL.Query().Get("page") == "2" {
+				fmt.Fprint(w, `{"count": 2, "next": null, "previous": null, "results": [{"id": 12, "identifier": "example.edu/photos/data/b.jpg"}]}`)
+				return
+			}
+			next := server.URL + "/member-api/v3/files?intellectual_object_id=1&page=2&per_page=1"
+			fmt.Fprintf(w, `{"count": 2, "next": "%s", "previous": null, "results": [{"id": 11, "identifier": "example.edu/photos/data/a.jpg"}]}`, next)
+		case "/member-api/v3/checksums":
+			fmt.Fprint(w, `{"count": 1, "next": null, "previous": null, "results": [{"id": 21, "generic_file_id": 11, "algorithm": "md5", "digest": "abc"}]}`)
+		case "/member-api/v3/items/show/7":
+			json.NewEncoder(w).Encode(&registry.WorkItem{ID: 7, Name: "photos.tar", Status: "Failed"})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"error": "Not found"}`)
+		}
+	}))
+	return server
+}
+
+func newTestRegistryClient(t *testing.T, server *httptest.Server) *cmd.RegistryClient {
+	config := &cmd.Config{
+		RegistryURL:        server.URL,
+		RegistryAPIVersion: "v3",
+		RegistryEmail:      "user@example.edu",
+		RegistryAPIKey:     "password",
+	}
+	client, err := cmd.NewRegistryClient(config)
+	require.Nil(t, err)
+	return client
+}
+
+func TestRegistryClient(t *testing.T) {
+	server := fakeRegistry(t)
+	defer server.Close()
+	client := newTestRegistryClient(t, server)
+	ctx := context.Background()
+
+	file, err := client.GetFile(ctx, 11)
+	require.Nil(t, err)
+	assert.Equal(t, "example.edu/photos/data/a.jpg", file.Identifier)
+
+	_, err = client.GetFile(ctx, 99)
+	require.NotNil(t, err)
+	assert.True(t, errors.Is(err, cmd.ErrNotInRegistry), err)
+	assert.Equal(t, "file 99 is not in the registry", err.Error())
+
+	item, err := client.GetWorkItem(ctx, 7)
+	require.Nil(t, err)
+	assert.Equal(t, "Failed", item.Status)
+
+	params := url.Values{}
+	params.Set("intellectual_object_id", "1")
+	files, page, err := client.ListFiles(ctx, params)
+	require.Nil(t, err)
+	require.Len(t, files, 1)
+	assert.Equal(t, int64(11), files[0].ID)
+	assert.Equal(t, 2, page.Count)
+	require.NotNil(t, page.Next)
+	assert.Equal(t, "2", page.Next.Get("page"))
+
+	files, page, err = client.ListFiles(ctx, page.Next)
+	require.Nil(t, err)
+	require.Len(t, files, 1)
+	assert.Equal(t, int64(12), files[0].ID)
+	assert.Nil(t, page.Next)
+
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	_, err = client.GetFile(canceled, 11)
+	assert.Equal(t, context.Canceled, err)
+}
+
+func TestFetchRegistryFiles(t *testing.T) {
+	server := fakeRegistry(t)
+	defer server.Close()
+	client := newTestRegistryClient(t, server)
+
+	result, err := cmd.FetchRegistryFiles(context.Background(), client, "example.edu/photos")
+	require.Nil(t, err)
+	assert.Equal(t, int64(1), result.Object.ID)
+	require.Len(t, result.Files, 2)
+	assert.Equal(t, "example.edu/photos/data/b.jpg", result.Files[1].Identifier)
+	require.Len(t, result.Checksums, 1)
+	assert.Equal(t, "abc", result.Checksums[0].Digest)
+
+	_, err = cmd.FetchRegistryFiles(context.Background(), client, "example.edu/missing")
+	require.NotNil(t, err)
+	assert.Equal(t, "object example.edu/missing is not in the registry", err.Error())
+}
@@ -0,0 +1,154 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/APTrust/dart-runner/bagit"
+	"github.com/APTrust/dart-runner/constants"
+	psconstants "github.com/APTrust/preservation-services/constants"
+	"github.com/APTrust/preservation-services/models/registry"
+)
+
+// RegistryFiles contains an ingested object's active files and their
+// checksums, as recorded in the registry.
+type RegistryFiles struct {
+	Object    *registry.IntellectualObject
+	Files     []*registry.GenericFile
+	Checksums []*registry.Checksum
+}
+
+// FetchRegistryFiles fetches the object with the specified identifier,
+// plus all of its active files and their checksums, from the registry.
+func FetchRegistryFiles(ctx context.Context, client *RegistryClient, identifier string) (*RegistryFiles, error) {
+	obj, err := client.GetObjectByIdentifier(ctx, identifier)
+	if err != nil {
+		return nil, err
+	}
+	files, err := FetchActiveFiles(ctx, client, obj)
+	if err != nil {
+		return nil, err
+	}
+	result := &RegistryFiles{
+		Object:    obj,
+		Files:     files,
+		Checksums: make([]*registry.Checksum, 0),
+	}
+
+	params := url.Values{}
+	params.Set("intellectual_object_id", strconv.FormatInt(obj.ID, 10))
+	EnsureDefaultListParams(params)
+	params.Set("per_page", "100")
+	for params != nil {
+		checksums, page, err := client.ListChecksums(ctx, params)
+		if err != nil {
+			return nil, fmt.Errorf("can't get checksums for object %s: %w", identifier, err)
+		}
+		result.Checksums = append(result.Checksums, checksums...)
+		params = page.Next
+	}
+	return result, nil
+}
+
+// FetchActiveFiles fetches all of obj's active files from the registry.
+func FetchActiveFiles(ctx context.Context, client *RegistryClient, obj *registry.IntellectualObject) ([]*registry.GenericFile, error) {
+	files := make([]*registry.GenericFile, 0)
+	params := url.Values{}
+	params.Set("intellectual_object_id", strconv.FormatInt(obj.ID, 10))
+	params.Set("state", psconstants.StateActive)
+	EnsureDefaultListParams(params)
+	params.Set("per_page", "100")
+	for params != nil {
+		batch, page, err := client.ListFiles(ctx, params)
+		if err != nil {
+			return nil, fmt.Errorf("can't get files for object %s: %w", obj.Identifier, err)
+		}
+		files = append(files, batch...)
+		params = page.Next
+	}
+	return files, nil
+}
+
+// CompareWithRegistry compares the payload files of a validated bag
+// with the files the registry recorded for the ingested object. It
+// returns a list of discrepancies, which is empty if the bag and the
+// registry agree on the list of payload files, their sizes, and their
+// checksums for every algorithm they have in common.
+//
+// The registry may have more than one checksum per file and algorithm
+// if a file was ingested more than once, so this uses the latest.
+func CompareWithRegistry(payloadFiles *bagit.FileMap, registryFiles *RegistryFiles) []string {
+	discrepancies := make([]string, 0)
+	prefix := registryFiles.Object.Identifier + "/"
+
+	// Latest registry checksum for each file id and algorithm
+	latest := make(map[int64]map[string]*registry.Checksum)
+	for _, checksum := range registryFiles.Checksums {
+		byAlg := latest[checksum.GenericFileID]
+		if byAlg == nil {
+			byAlg = make(map[string]*registry.Checksum)
+			latest[checksum.GenericFileID] = byAlg
+		}
+		if current := byAlg[checksum.Algorithm]; current == nil || checksum.DateTime.After(current.DateTime) {
+			byAlg[checksum.Algorithm] = checksum
+		}
+	}
+
+	inRegistry := make(map[string]*registry.GenericFile)
+	for _, gf := range registryFiles.Files {
+		pathInBag := strings.TrimPrefix(gf.Identifier, prefix)
+		if strings.HasPrefix(pathInBag, "data/") {
+			inRegistry[pathInBag] = gf
+		}
+	}
+	bagPaths := make([]string, 0, len(payloadFiles.Files))
+	for name := range payloadFiles.Files {
+		bagPaths = append(bagPaths, name)
+	}
+	sort.Strings(bagPaths)
+
+	if len(bagPaths) != len(inRegistry) {
+		discrepancies = append(discrepancies, fmt.Sprintf("Bag has %d payload files, but the registry has %d active payload files for %s.", len(bagPaths), len(inRegistry), registryFiles.Object.Identifier))
+	}
+	for _, pathInBag := range bagPaths {
+		record := payloadFiles.Files[pathInBag]
+		gf := inRegistry[pathInBag]
+		if gf == nil {
+			discrepancies = append(discrepancies, fmt.Sprintf("%s is in the bag but not in the registry.", pathInBag))
+			continue
+		}
+		if gf.Size != record.Size {
+			discrepancies = append(discrepancies, fmt.Sprintf("%s is %d bytes in the bag, but %d bytes in the registry.", pathInBag, record.Size, gf.Size))
+		}
+		compared := 0
+		for _, alg := range constants.PreferredAlgsInOrder {
+			bagChecksum := record.GetChecksum(alg, constants.FileTypePayload)
+			registryChecksum := latest[gf.ID][alg]
+			if bagChecksum == nil || registryChecksum == nil {
+				continue
+			}
+			compared++
+			if !strings.EqualFold(bagChecksum.Digest, registryChecksum.Digest) {
+				discrepancies = append(discrepancies, fmt.Sprintf("%s has %s %s in the bag, but %s in the registry.", pathInBag, alg, bagChecksum.Digest, registryChecksum.Digest))
+			}
+		}
+		if compared == 0 {
+			discrepancies = append(discrepancies, fmt.Sprintf("%s has no checksums in the registry for the bag's manifest algorithms.", pathInBag))
+		}
+	}
+	registryPaths := make([]string, 0, len(inRegistry))
+	for pathInBag := range inRegistry {
+		if payloadFiles.Files[pathInBag] == nil {
+			registryPaths = append(registryPaths, pathInBag)
+		}
+	}
+	sort.Strings(registryPaths)
+	for _, pathInBag := range registryPaths {
+		discrepancies = append(discrepancies, fmt.Sprintf("%s is in the registry but not in the bag.", pathInBag))
+	}
+	return discrepancies
+}
@@ -0,0 +1,80 @@
+package cmd_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/APTrust/apt-cmd/cmd"
+	"github.com/APTrust/dart-runner/bagit"
+	"github.com/APTrust/dart-runner/constants"
+	"github.com/APTrust/preservation-services/models/registry"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCompareWithRegistry(t *testing.T) {
+	payloadFiles := bagit.NewFileMap(constants.FileTypePayload)
+	addBagFile := func(name string, size int64, md5, sha256 string) {
+		record := bagit.NewFileRecord()
+		record.Size = size
+		record.AddChecksum(constants.FileTypePayload, constants.AlgMd5, md5)
+		record.AddChecksum(constants.FileTypePayload, constants.AlgSha256, sha256)
+		record.AddChecksum(constants.FileTypeManifest, constants.AlgSha256, "from-manifest")
+		payloadFiles.Files[name] = record
+	}
+	addBagFile("data/one.txt", 100, "md5-one", "sha-one")
+	addBagFile("data/two.txt", 200, "md5-two", "sha-two")
+
+	earlier := time.Now().Add(-24 * time.Hour)
+	later := time.Now()
+	newRegistryFiles := func() *cmd.RegistryFiles {
+		return &cmd.RegistryFiles{
+			Object: &registry.IntellectualObject{Identifier: "example.edu/bag"},
+			Files: []*registry.GenericFile{
+				{ID: 1, Identifier: "example.edu/bag/data/one.txt", Size: 100},
+				{ID: 2, Identifier: "example.edu/bag/data/two.txt", Size: 200},
+				// Tag files aren't compared.
+				{ID: 3, Identifier: "example.edu/bag/bag-info.txt", Size: 50},
+			},
+			Checksums: []*registry.Checksum{
+				{GenericFileID: 1, Algorithm: constants.AlgMd5, Digest: "MD5-ONE", DateTime: later},
+				{GenericFileID: 1, Algorithm: constants.AlgSha256, Digest: "old-sha-one", DateTime: earlier},
+				{GenericFileID: 1, Algorithm: constants.AlgSha256, Digest: "sha-one", DateTime: later},
+				{GenericFileID: 2, Algorithm: constants.AlgSha256, Digest: "sha-two", DateTime: later},
+				{GenericFileID: 3, Algorithm: constants.AlgSha256, Digest: "sha-tags", DateTime: later},
+			},
+		}
+	}
+
+	// Matching bag. Latest checksum wins, and hex case doesn't matter.
+	assert.Empty(t, cmd.CompareWithRegistry(payloadFiles, newRegistryFiles()))
+
+	// Size and checksum mismatch, and a file missing from the registry
+	registryFiles := newRegistryFiles()
+	registryFiles.Files[0].Size = 99
+	registryFiles.Checksums[3].Digest = "bad-sha-two"
+	registryFiles.Files = append(registryFiles.Files, &registry.GenericFile{ID: 4, Identifier: "example.edu/bag/data/three.txt", Size: 10})
+	addBagFile("data/four.txt", 10, "md5-four", "sha-four")
+	discrepancies := cmd.CompareWithRegistry(payloadFiles, registryFiles)
+	assert.Equal(t, []string{
+		"data/four.txt is in the bag but not in the registry.",
+		"data/one.txt is 100 bytes in the bag, but 99 bytes in the registry.",
+		"data/two.txt has sha256 sha-two in the bag, but bad-sha-two in the registry.",
+		"data/three.txt is in the registry but not in the bag.",
+	}, discrepancies)
+
+	// No checksums in common, and a count mismatch
+	delete(payloadFiles.Files, "data/four.txt")
+	registryFiles = newRegistryFiles()
+	registryFiles.Checksums = registryFiles.Checksums[:3]
+	registryFiles.Files = registryFiles.Files[:1]
+	discrepancies = cmd.CompareWithRegistry(payloadFiles, registryFiles)
+	assert.Equal(t, []string{
+		"Bag has 2 payload files, but the registry has 1 active payload files for example.edu/bag.",
+		"data/two.txt is in the bag but not in the registry.",
+	}, discrepancies)
+
+	registryFiles = newRegistryFiles()
+	registryFiles.Checksums = registryFiles.Checksums[:3]
+	discrepancies = cmd.CompareWithRegistry(payloadFiles, registryFiles)
+	assert.Equal(t, []string{"data/two.txt has no checksums in the registry for the bag's manifest algorithms."}, discrepancies)
+}
@@ -0,0 +1,127 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/APTrust/preservation-services/models/registry"
+	"github.com/spf13/cobra"
+)
+
+// countModels maps the resources that registry count accepts to the
+// models of their records, which say which filters each one accepts.
+var countModels = map[string]interface{}{
+	"files":     registry.GenericFile{},
+	"objects":   registry.IntellectualObject{},
+	"workitems": registry.WorkItem{},
+}
+
+// registryCountCmd represents the registry count command
+var registryCountCmd = &cobra.Command{
+	Use:     "count <files|objects|workitems> [filters...]",
+	Short:   "Count files, objects, or work items in the APTrust Registry",
+	Example: `apt-cmd registry count workitems action=Ingest status=Failed`,
+	Long: `Print the number of files, objects, or work items in the APTrust
+Registry that match the filters, without fetching the records themselves.
+This accepts the same filters as registry list, and checks them the same
+way.
+
+Examples:
+
+Count the failed ingests:
+
+  apt-cmd registry count workitems action='Ingest' status='Failed'
+
+Count the active files in object test.edu/my_bag:
+
+  apt-cmd registry count files intellectual_object_identifier='test.edu/my_bag' state='A'
+
+Count the objects created since April 6, 2023:
+
+  apt-cmd registry count objects created_at__gteq='2023-04-06'
+
+The output is just the number, so it's easy to use in scripts:
+
+  if [ "$(apt-cmd registry count workitems status=Failed)" -gt 0 ]; then ...
+
+Full online documentation:
+
+https://aptrust.github.io/userguide/partner_tools/
+
+`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) == 0 {
+			Fail(EXIT_USER_ERR, "Specify what to count: files, objects or workitems")
+		}
+		model, ok := countModels[args[0]]
+		if !ok {
+			Failf(EXIT_USER_ERR, "Can't count '%s' - try files, objects or workitems", args[0])
+		}
+		client, urlValues := InitRegistryRequest(config, args[1:])
+		if err := ValidateListParams(args[0], urlValues, model); err != nil {
+			Fail(EXIT_USER_ERR, err.Error())
+		}
+		count, err := CountRegistryRecords(cmd.Context(), client, args[0], urlValues)
+		if err != nil {
+			ExitIfCanceled(cmd.Context())
+			Fail(EXIT_REQUEST_ERROR, "Can't count records:", err.Error())
+		}
+		WriteResult(fmt.Sprintf("%d\n", count))
+		os.Exit(EXIT_OK)
+	},
+}
+
+func init() {
+	registryCmd.AddCommand(registryCountCmd)
+	registryCountCmd.ValidArgsFunction = completeCountArgs
+}
+
+// CountRegistryRecords returns the number of records of the resource
+// listName (files, objects or workitems) that match params. It asks for
+// a single record, and returns the registry's count of all matches, so
+// it's quick even when millions of records match.
+func CountRegistryRecords(ctx context.Context, client *RegistryClient, listName string, params url.Values) (int, error) {
+	values := url.Values{}
+	for key, value := range params {
+		values[key] = value
+	}
+	values.Set("page", "1")
+	values.Set("per_page", "1")
+	var page RegistryPage
+	var err error
+	switch listName {
+	case "files":
+		_, page, err = client.ListFiles(ctx, values)
+	case "objects":
+		_, page, err = client.ListObjects(ctx, values)
+	case "workitems":
+		_, page, err = client.ListWorkItems(ctx, values)
+	default:
+		return 0, fmt.Errorf("can't count '%s'", listName)
+	}
+	return page.Count, err
+}
+
+// completeCountArgs completes the resource names of registry count,
+// and then the names of the filters the resource accepts.
+func completeCountArgs(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	if len(args) == 0 {
+		names := make([]string, 0, len(countModels))
+		for name := range countModels {
+			if strings.HasPrefix(name, toComplete) {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+		return names, cobra.ShellCompDirectiveNoFileComp
+	}
+	model, ok := countModels[args[0]]
+	if !ok {
+		return nil, cobra.ShellCompDirectiveNoFileComp
+	}
+	return completeListParams(args[0], model)(cmd, args, toComplete)
+}
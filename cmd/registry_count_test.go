@@ -0,0 +1,49 @@
+package cmd_test
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"testing"
+
+	"github.com/APTrust/apt-cmd/cmd"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCountRegistryRecords(t *testing.T) {
+	server := fakeRegistry(t)
+	defer server.Close()
+	client := newTestRegistryClient(t, server)
+
+	params := url.Values{}
+	params.Set("intellectual_object_id", "1")
+	params.Set("per_page", "100")
+	count, err := cmd.CountRegistryRecords(context.Background(), client, "files", params)
+	require.Nil(t, err)
+	assert.Equal(t, 2, count)
+	// The caller's params are unchanged.
+	assert.Equal(t, "100", params.Get("per_page"))
+
+	_, err = cmd.CountRegistryRecords(context.Background(), client, "checksums", params)
+	assert.NotNil(t, err)
+}
+
+func TestRegistryCountErrors(t *testing.T) {
+	for _, test := range []struct {
+		args   []string
+		stderr string
+	}{
+		{[]string{}, "Specify what to count"},
+		{[]string{"events"}, "Can't count 'events'"},
+		{[]string{"workitems", "staus=Failed"}, "staus (did you mean status?)"},
+	} {
+		cmdArgs := append([]string{"run", "../main.go", "registry", "count"}, test.args...)
+		cmdArgs = append(cmdArgs, "--config=../testconfig.env")
+		exitCode, stdout, stderr := execCmd(t, "go", cmdArgs...)
+		assert.NotEqual(t, 0, exitCode, test.args)
+		assert.Empty(t, stdout, test.args)
+		assert.Contains(t, stderr, test.stderr, test.args)
+		assert.Contains(t, stderr, fmt.Sprintf("exit status %d", cmd.EXIT_USER_ERR), test.args)
+	}
+}
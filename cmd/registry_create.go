@@ -0,0 +1,138 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/APTrust/preservation-services/network"
+	"github.com/spf13/cobra"
+)
+
+// registryCreateCmd represents the registry create command
+var registryCreateCmd = &cobra.Command{
+	Use:   "create",
+	Short: "Create a work item in the APTrust Registry",
+	Long: `Create a record in the APTrust Registry. For more info, run:
+
+    apt-cmd registry create workitem --help
+
+Full online documentation:
+
+https://aptrust.github.io/userguide/partner_tools/
+
+`,
+	Run: func(cmd *cobra.Command, args []string) {
+		fmt.Println("Create records in the APTrust registry. See subcommands for more info.")
+	},
+}
+
+func init() {
+	registryCmd.AddCommand(registryCreateCmd)
+}
+
+// ReadDataFlag returns the JSON body from a --data flag. A value that
+// starts with @ names a file to read the JSON from. An empty value
+// means there's no body.
+func ReadDataFlag(data string) ([]byte, error) {
+	if data == "" {
+		return nil, nil
+	}
+	body := []byte(data)
+	if strings.HasPrefix(data, "@") {
+		var err error
+		body, err = os.ReadFile(strings.TrimPrefix(data, "@"))
+		if err != nil {
+			return nil, fmt.Errorf("can't read --data file: %w", err)
+		}
+	}
+	if !json.Valid(body) {
+		return nil, fmt.Errorf("--data is not valid JSON")
+	}
+	return body, nil
+}
+
+// ApplyModelFields sets fields of record, which should be a pointer to
+// a registry model, such as &registry.WorkItem{}. It first applies the
+// JSON object in data, if any, and then the field=value pairs in
+// values, which use the fields' JSON names. Values are converted to the
+// field's type, so needs_admin_review=true sets a bool and size=100
+// sets a number. Times use RFC3339 format. This returns an error if a
+// field doesn't exist or a value can't be converted.
+func ApplyModelFields(record interface{}, data []byte, values url.Values) error {
+	if len(data) > 0 {
+		if err := decodeModelFields(record, data); err != nil {
+			return fmt.Errorf("invalid --data: %w", err)
+		}
+	}
+	if len(values) == 0 {
+		return nil
+	}
+	fieldKinds := modelFieldKinds(reflect.TypeOf(record).Elem())
+	fields := make(map[string]interface{})
+	for name := range values {
+		kind, ok := fieldKinds[name]
+		if !ok {
+			return fmt.Errorf("unknown field '%s'. Valid fields are: %s", name, strings.Join(ModelFields(reflect.ValueOf(record).Elem().Interface()), ", "))
+		}
+		value := values.Get(name)
+		var err error
+		switch kind {
+		case reflect.Bool:
+			fields[name], err = strconv.ParseBool(value)
+		case reflect.Int, reflect.Int64:
+			fields[name], err = strconv.ParseInt(value, 10, 64)
+		case reflect.Struct:
+			fields[name], err = time.Parse(time.RFC3339, value)
+		default:
+			fields[name] = value
+		}
+		if err != nil {
+			return fmt.Errorf("invalid value '%s' for %s", value, name)
+		}
+	}
+	// Can't fail, since fields holds only strings, numbers, bools and
+	// times.
+	data, _ = json.Marshal(fields)
+	return decodeModelFields(record, data)
+}
+
+// decodeModelFields decodes the JSON object in data onto record,
+// rejecting misspelled fields, rather than silently ignoring them.
+func decodeModelFields(record interface{}, data []byte) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	return decoder.Decode(record)
+}
+
+// modelFieldKinds maps the JSON names of a model's fields to their
+// kinds.
+func modelFieldKinds(modelType reflect.Type) map[string]reflect.Kind {
+	kinds := make(map[string]reflect.Kind)
+	for i := 0; i < modelType.NumField(); i++ {
+		field := modelType.Field(i)
+		name := strings.Split(field.Tag.Get("json"), ",")[0]
+		if name != "" && name != "-" {
+			kinds[name] = field.Type.Kind()
+		}
+	}
+	return kinds
+}
+
+// PrintSaveResponse prints the record the registry returned after a
+// create or update request. If the request failed, this prints the
+// error, including the registry's response body, and exits with
+// EXIT_REQUEST_ERROR.
+func PrintSaveResponse(resp *network.RegistryResponse) {
+	if resp.Error != nil {
+		Fail(EXIT_REQUEST_ERROR, "Registry request failed:", resp.Error.Error())
+	}
+	data, _ := resp.RawResponseData()
+	PrettyPrintJSON(data)
+}
@@ -0,0 +1,151 @@
+package cmd_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/APTrust/apt-cmd/cmd"
+	"github.com/APTrust/preservation-services/models/registry"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadDataFlag(t *testing.T) {
+	data, err := cmd.ReadDataFlag("")
+	require.Nil(t, err)
+	assert.Nil(t, data)
+
+	data, err = cmd.ReadDataFlag(`{"note": "hello"}`)
+	require.Nil(t, err)
+	assert.Equal(t, `{"note": "hello"}`, string(data))
+
+	dataFile := path.Join(t.TempDir(), "workitem.json")
+	require.Nil(t, os.WriteFile(dataFile, []byte(`{"stage": "Receive"}`), 0600))
+	data, err = cmd.ReadDataFlag("@" + dataFile)
+	require.Nil(t, err)
+	assert.Equal(t, `{"stage": "Receive"}`, string(data))
+
+	_, err = cmd.ReadDataFlag("{not json")
+	assert.EqualError(t, err, "--data is not valid JSON")
+	_, err = cmd.ReadDataFlag("@" + dataFile + ".missing")
+	assert.NotNil(t, err)
+}
+
+func TestApplyModelFields(t *testing.T) {
+	item := &registry.WorkItem{ID: 12, Name: "bag.tar", Note: "old note", Size: 5}
+	values := url.Values{}
+	values.Set("note", "Requeued")
+	values.Set("retry", "true")
+	values.Set("size", "2048")
+	values.Set("bag_date", "2024-06-01T12:00:00Z")
+	data := []byte(`{"stage": "Receive", "note": "overridden"}`)
+	require.Nil(t, cmd.ApplyModelFields(item, data, values))
+	assert.Equal(t, int64(12), item.ID)
+	assert.Equal(t, "bag.tar", item.Name)
+	assert.Equal(t, "Receive", item.Stage)
+	assert.Equal(t, "Requeued", item.Note)
+	assert.True(t, item.Retry)
+	assert.Equal(t, int64(2048), item.Size)
+	assert.Equal(t, time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC), item.BagDate.UTC())
+
+	for _, test := range []struct {
+		name, value, message string
+	}{
+		{"colour", "blue", "unknown field 'colour'"},
+		{"retry", "maybe", "invalid value 'maybe' for retry"},
+		{"size", "big", "invalid value 'big' for size"},
+		{"bag_date", "yesterday", "invalid value 'yesterday' for bag_date"},
+	} {
+		values = url.Values{}
+		values.Set(test.name, test.value)
+		err := cmd.ApplyModelFields(&registry.WorkItem{}, nil, values)
+		require.NotNil(t, err, test.name)
+		assert.Contains(t, err.Error(), test.message)
+	}
+
+	err := cmd.ApplyModelFields(&registry.WorkItem{}, []byte(`{"colour": "blue"}`), nil)
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), "invalid --data")
+}
+
+func TestRegistryCreateWorkItemUserErrors(t *testing.T) {
+	// These fail before any request goes out.
+	for _, test := range []struct {
+		args    []string
+		message string
+	}{
+		{[]string{"create", "workitem", "name=bag.tar"}, "requires an institution_id"},
+		{[]string{"create", "workitem", "institution_id=3", "id=7"}, "New work items can't have an id"},
+		{[]string{"create", "workitem", "institution_id=3", "colour=blue"}, "unknown field 'colour'"},
+		{[]string{"create", "workitem", "--data={bad"}, "--data is not valid JSON"},
+		{[]string{"update", "workitem", "note=hello"}, "requires an id"},
+		{[]string{"update", "workitem", "id=7"}, "Specify the fields to change"},
+	} {
+		cmdArgs := append([]string{"run", "../main.go", "registry"}, test.args...)
+		cmdArgs = append(cmdArgs, "--config=../testconfig.env")
+		exitCode, stdout, stderr := execCmd(t, "go", cmdArgs...)
+		assert.NotEqual(t, 0, exitCode, test.args)
+		assert.Empty(t, stdout, test.args)
+		assert.Contains(t, stderr, test.message, test.args)
+	}
+}
+
+func TestRegistryUpdateWorkItem(t *testing.T) {
+	// A fake registry that has work item 7, and rejects updates to
+	// work items named locked.tar. Each PUT sends the work item it got
+	// over saved, since the handler runs in the server's goroutine.
+	saved := make(chan *registry.WorkItem, 3)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == "GET" && r.URL.Path == "/member-api/v3/items/show/7":
+			json.NewEncoder(w).Encode(&registry.WorkItem{ID: 7, Name: "bag.tar", InstitutionID: 3, Stage: "Cleanup", Status: "Failed"})
+		case r.Method == "PUT" && r.URL.Path == "/member-api/v3/items/update/7":
+			body, _ := io.ReadAll(r.Body)
+			item := &registry.WorkItem{}
+			json.Unmarshal(body, item)
+			saved <- item
+			if item.Name == "locked.tar" {
+				w.WriteHeader(http.StatusForbidden)
+				fmt.Fprint(w, `{"error": "Permission denied"}`)
+				return
+			}
+			w.Write(body)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+	configFile := path.Join(t.TempDir(), "config.env")
+	config := fmt.Sprintf("APTRUST_REGISTRY_URL='%s'\nAPTRUST_REGISTRY_API_VERSION='v3'\nAPTRUST_REGISTRY_EMAIL='user@inst1.edu'\nAPTRUST_REGISTRY_API_KEY='password'\n", server.URL)
+	require.Nil(t, os.WriteFile(configFile, []byte(config), 0600))
+
+	exitCode, stdout, stderr := execCmd(t, "go", "run", "../main.go", "registry", "update", "workitem", "id=7", "stage=Receive", "status=Pending", "--config="+configFile)
+	require.Equal(t, 0, exitCode, stderr)
+	require.Len(t, saved, 1)
+	item := <-saved
+	assert.Equal(t, "bag.tar", item.Name)
+	assert.Equal(t, int64(3), item.InstitutionID)
+	assert.Equal(t, "Receive", item.Stage)
+	assert.Equal(t, "Pending", item.Status)
+	printed := &registry.WorkItem{}
+	require.Nil(t, json.Unmarshal([]byte(stdout), printed))
+	assert.Equal(t, "Pending", printed.Status)
+
+	exitCode, stdout, stderr = execCmd(t, "go", "run", "../main.go", "registry", "update", "workitem", "id=7", "--data={\"name\": \"locked.tar\"}", "--config="+configFile)
+	assert.NotEqual(t, 0, exitCode)
+	assert.Empty(t, stdout)
+	assert.Contains(t, stderr, "403")
+	assert.Contains(t, stderr, "Permission denied")
+
+	exitCode, _, stderr = execCmd(t, "go", "run", "../main.go", "registry", "update", "workitem", "id=8", "note=hello", "--config="+configFile)
+	assert.NotEqual(t, 0, exitCode)
+	assert.Contains(t, stderr, "Can't get work item")
+}
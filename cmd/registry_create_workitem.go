@@ -0,0 +1,65 @@
+package cmd
+
+import (
+	"os"
+
+	"github.com/APTrust/preservation-services/models/registry"
+	"github.com/APTrust/preservation-services/network"
+	"github.com/spf13/cobra"
+)
+
+// createWorkitemCmd represents the create workitem command
+var createWorkitemCmd = &cobra.Command{
+	Use:     "workitem",
+	Short:   "Creates a WorkItem record in the APTrust Registry",
+	Example: `apt-cmd registry create workitem institution_id=3 name=bag.tar etag=1234 bucket=aptrust.receiving.test.edu action=Ingest stage=Receive status=Pending`,
+	Long: `Create a WorkItem record in the APTrust Registry, and print the
+record the registry saved.
+
+Set fields with field=value pairs, using the fields' JSON names, as
+shown by apt-cmd registry get workitem. Use --data to supply the fields
+as a JSON object instead, or @ and the name of a file that contains the
+JSON object. Pairs on the command line override fields in --data.
+
+apt-cmd registry create workitem institution_id=3 name=bag.tar ...
+apt-cmd registry create workitem --data=@workitem.json
+
+institution_id is required. Numbers, booleans and times (in RFC3339
+format, such as 2024-06-01T12:00:00Z) are converted to the right type.
+
+If the registry rejects the request, apt-cmd prints the registry's
+response and exits with status 4.
+
+Full online documentation:
+
+https://aptrust.github.io/userguide/partner_tools/
+
+`,
+	Run: func(cmd *cobra.Command, args []string) {
+		dataFlag, _ := cmd.Flags().GetString("data")
+		data, err := ReadDataFlag(dataFlag)
+		if err != nil {
+			Fail(EXIT_USER_ERR, err.Error())
+		}
+		client, urlValues := InitRegistryRequest(config, args)
+		item := &registry.WorkItem{}
+		err = ApplyModelFields(item, data, urlValues)
+		if err != nil {
+			Fail(EXIT_USER_ERR, err.Error())
+		}
+		if item.ID != 0 {
+			Fail(EXIT_USER_ERR, "New work items can't have an id. To change an existing work item, use registry update workitem.")
+		}
+		if item.InstitutionID < 1 {
+			Fail(EXIT_USER_ERR, "This call requires an institution_id (e.g. institution_id=3)")
+		}
+		resp := DoRegistryWrite(cmd.Context(), func() *network.RegistryResponse { return client.WorkItemSave(item) })
+		PrintSaveResponse(resp)
+		os.Exit(EXIT_OK)
+	},
+}
+
+func init() {
+	registryCreateCmd.AddCommand(createWorkitemCmd)
+	createWorkitemCmd.Flags().String("data", "", "JSON object of work item fields, or @file to read it from a file")
+}
@@ -0,0 +1,415 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/APTrust/preservation-services/models/registry"
+	"github.com/minio/minio-go/v7"
+	"github.com/op/go-logging"
+	"github.com/spf13/cobra"
+)
+
+// registryDownloadCmd represents the registry download command
+var registryDownloadCmd = &cobra.Command{
+	Use:     "download",
+	Short:   "Download all of an object's files from preservation storage",
+	Example: `apt-cmd registry download identifier=example.edu/photos --save-as=photos`,
+	Long: `Download all of the active files of an intellectual object from
+preservation storage, into a directory that mirrors the files' identifiers.
+The registry says which files the object has, and where each one is
+stored. For this to work, you will need APTRUST_AWS_KEY and
+APTRUST_AWS_SECRET for the preservation buckets, as well as your registry
+credentials.
+
+Examples:
+
+Download the files of object example.edu/photos into the directory
+photos, so that example.edu/photos/data/image1.jpg is saved as
+photos/data/image1.jpg:
+
+  apt-cmd registry download identifier=example.edu/photos
+
+Download the same files into /data/restored/photos, eight at a time, and
+check each one against its ETag:
+
+  apt-cmd registry download identifier=example.edu/photos \
+    --save-as=/data/restored/photos \
+    --concurrency=8 --verify
+
+If you omit --save-as, the directory is named after the last part of the
+object's identifier, and created in the current directory.
+
+Files with Standard storage have one copy in S3 and another in Glacier.
+This downloads the S3 copy. Glacier objects can't be downloaded until
+they're restored, so if the S3 copy isn't there, or S3 says a copy hasn't
+been restored, this tries the file's next copy. Files stored only in
+Glacier or Glacier Deep Archive fail, with an error saying so.
+apt-cmd uses the same AWS credentials for every storage host.
+
+--verify, --skip-existing, --rate-limit and --concurrency work as they do
+for s3 download --prefix. The default is four files at a time. Downloads
+that fail with a timeout, a lost connection or a 5xx response from S3 are
+retried according to --retries and --retry-backoff, continuing where
+they left off.
+
+The output is a JSON summary like that of s3 download --prefix, with
+each file's identifier, the storage URL it came from, and where it was
+saved. If any file fails to download, apt-cmd exits with status 1 after
+printing the summary.
+
+Full online documentation:
+
+https://aptrust.github.io/userguide/partner_tools/
+
+`,
+	Run: func(cmd *cobra.Command, args []string) {
+		client, urlValues := InitRegistryRequest(config, args)
+		identifier := urlValues.Get("identifier")
+		if identifier == "" {
+			Fail(EXIT_USER_ERR, "This call requires an object identifier (e.g. identifier=example.edu/photos)")
+		}
+		if err := config.ValidateAWSCredentials(); err != nil {
+			Fail(EXIT_USER_ERR, "Missing S3 connection info:", err)
+		}
+		saveAs := cmd.Flag("save-as").Value.String()
+		if saveAs == "" {
+			saveAs = LocalFileNameForKey(identifier)
+		}
+		if stat, err := os.Stat(saveAs); err == nil && !stat.IsDir() {
+			Failf(EXIT_USER_ERR, "--save-as %s must be a directory.", saveAs)
+		}
+		verify, _ := cmd.Flags().GetBool("verify")
+		skipExisting, _ := cmd.Flags().GetBool("skip-existing")
+		downloader := &ObjectDownloader{
+			Registry:     client,
+			NewS3Client:  func(host string) *minio.Client { return NewS3Client(config, host) },
+			Concurrency:  GetConcurrency(cmd.Flags()),
+			Verify:       verify,
+			SkipExisting: skipExisting,
+			Counter:      &DownloadCounter{},
+			Limiter:      GetRateLimiter(cmd.Flags()),
+			Retry:        GetS3RetryPolicy(cmd.Flags()),
+			Logger:       logger,
+		}
+
+		obj, err := client.GetObjectByIdentifier(cmd.Context(), identifier)
+		if err != nil {
+			ExitIfCanceled(cmd.Context())
+			Fail(EXIT_REQUEST_ERROR, "Can't get object:", err.Error())
+		}
+		files, err := FetchActiveFiles(cmd.Context(), client, obj)
+		if err != nil {
+			ExitIfCanceled(cmd.Context())
+			Fail(EXIT_REQUEST_ERROR, "Can't get object's files:", err.Error())
+		}
+		if len(files) == 0 {
+			Failf(EXIT_REQUEST_ERROR, "Object %s has no active files.", identifier)
+		}
+		totalBytes := int64(0)
+		for _, file := range files {
+			totalBytes += file.Size
+		}
+		stopProgress := func() {}
+		if !quiet && IsTerminal(os.Stderr) {
+			stopProgress = WatchDownloadProgress(downloader.Counter, 0, totalBytes, DownloadProgressInterval, DownloadProgressPrinter(os.Stderr))
+		}
+		logger.Debugf("Downloading %d files of %s into %s, %d at a time", len(files), identifier, saveAs, downloader.Concurrency)
+		results := downloader.Download(cmd.Context(), obj.Identifier, files, saveAs)
+		stopProgress()
+		ExitIfCanceled(cmd.Context())
+
+		summary := NewObjectDownloadSummary(obj.Identifier, saveAs, results)
+		// Marshalling this struct can't fail.
+		data, _ := json.MarshalIndent(summary, "", "  ")
+		WriteResult(string(data) + "\n")
+		if summary.FailedCount > 0 {
+			Failf(EXIT_RUNTIME_ERR, "Failed to download %d of %d files.", summary.FailedCount, len(results))
+		}
+		os.Exit(EXIT_OK)
+	},
+}
+
+func init() {
+	registryCmd.AddCommand(registryDownloadCmd)
+	registryDownloadCmd.Flags().StringP("save-as", "s", "", "Directory in which to save the files. Defaults to the last part of the object's identifier.")
+	registryDownloadCmd.Flags().Bool("verify", false, "Verify each download against its object's ETag, including multipart ETags")
+	registryDownloadCmd.Flags().Bool("skip-existing", false, "Don't download files that are already in --save-as, with the right size, and with --verify, the right ETag")
+	registryDownloadCmd.Flags().String("rate-limit", "", "Limit the downloads to this rate, e.g. 10MB/s, shared by all --concurrency downloads. The default is no limit.")
+}
+
+// ObjectDownloadResult describes the download of one file in registry
+// download. Result is "OK", "Skipped" or "Failed". URL is the storage
+// record of the copy we downloaded, or last tried to.
+type ObjectDownloadResult struct {
+	Identifier   string `json:"identifier"`
+	URL          string `json:"url,omitempty"`
+	File         string `json:"file"`
+	Size         int64  `json:"size"`
+	Result       string `json:"result"`
+	Error        string `json:"error,omitempty"`
+	ETagVerified bool   `json:"etagVerified,omitempty"`
+}
+
+// ObjectDownloadSummary is the JSON output of registry download. It
+// counts files the way PrefixDownloadSummary counts objects.
+type ObjectDownloadSummary struct {
+	Result       string                  `json:"result"`
+	Identifier   string                  `json:"identifier"`
+	SaveAs       string                  `json:"saveAs"`
+	FileCount    int                     `json:"fileCount"`
+	SkippedCount int                     `json:"skippedCount"`
+	FailedCount  int                     `json:"failedCount"`
+	TotalBytes   int64                   `json:"totalBytes"`
+	Files        []*ObjectDownloadResult `json:"files"`
+}
+
+// NewObjectDownloadSummary totals up results.
+func NewObjectDownloadSummary(identifier, saveAs string, results []*ObjectDownloadResult) *ObjectDownloadSummary {
+	summary := &ObjectDownloadSummary{
+		Result:     "OK",
+		Identifier: identifier,
+		SaveAs:     saveAs,
+		Files:      results,
+	}
+	for _, result := range results {
+		if result.Result == "Skipped" {
+			summary.SkippedCount++
+			continue
+		}
+		if result.Result != "OK" {
+			summary.Result = "Failed"
+			summary.FailedCount++
+			continue
+		}
+		summary.FileCount++
+		summary.TotalBytes += result.Size
+	}
+	return summary
+}
+
+// StorageLocation is the S3 host, bucket and key of one copy of a file
+// in preservation storage.
+type StorageLocation struct {
+	Host   string
+	Bucket string
+	Key    string
+}
+
+// ParseStorageURL returns the location in a storage record's URL, such
+// as https://s3.amazonaws.com/aptrust.preservation.storage/<uuid>. The
+// registry's URLs always have the bucket in the path.
+func ParseStorageURL(storageURL string) (StorageLocation, error) {
+	parsed, err := url.Parse(storageURL)
+	if err != nil {
+		return StorageLocation{}, err
+	}
+	parts := strings.SplitN(strings.TrimPrefix(parsed.Path, "/"), "/", 2)
+	if parsed.Host == "" || len(parts) < 2 || parts[0] == "" || parts[1] == "" {
+		return StorageLocation{}, fmt.Errorf("storage URL %s should look like https://host/bucket/key", storageURL)
+	}
+	return StorageLocation{Host: parsed.Host, Bucket: parts[0], Key: parts[1]}, nil
+}
+
+// IsGlacierStorageURL returns true if storageURL is in one of APTrust's
+// Glacier buckets, which have glacier in their names, or in
+// aptrust.preservation.oregon, which holds the Glacier copies of files
+// with Standard storage.
+func IsGlacierStorageURL(storageURL string) bool {
+	location, err := ParseStorageURL(storageURL)
+	if err != nil {
+		return false
+	}
+	bucket := strings.ToLower(location.Bucket)
+	return strings.Contains(bucket, "glacier") || bucket == "aptrust.preservation.oregon"
+}
+
+// PreferredStorageURLs returns the URLs of records in the order we
+// should try to download them: copies in S3 or Wasabi first, in the
+// registry's order, then copies in Glacier, which can't be downloaded
+// until they're restored.
+func PreferredStorageURLs(records []*registry.StorageRecord) []string {
+	urls := make([]string, 0, len(records))
+	glacierURLs := make([]string, 0)
+	for _, record := range records {
+		if IsGlacierStorageURL(record.URL) {
+			glacierURLs = append(glacierURLs, record.URL)
+		} else {
+			urls = append(urls, record.URL)
+		}
+	}
+	return append(urls, glacierURLs...)
+}
+
+// IsNotRestoredError returns true if err means S3 can't send an object
+// because it's in Glacier and hasn't been restored.
+func IsNotRestoredError(err error) bool {
+	return minio.ToErrorResponse(err).Code == "InvalidObjectState"
+}
+
+// ObjectDownloader downloads the files of an intellectual object from
+// the preservation storage their storage records point to. NewS3Client
+// returns a client for a storage host. The downloader creates one
+// client per host, and shares it among its downloads. The other fields
+// work as they do for DownloadPrefix. If Logger is nil, Download uses
+// the aptrust logger.
+type ObjectDownloader struct {
+	Registry     *RegistryClient
+	NewS3Client  func(host string) *minio.Client
+	Concurrency  int
+	Verify       bool
+	SkipExisting bool
+	Counter      *DownloadCounter
+	Limiter      *RateLimiter
+	Retry        S3RetryPolicy
+	Logger       *logging.Logger
+
+	mutex     sync.Mutex
+	s3Clients map[string]*minio.Client
+}
+
+// Download downloads files, which belong to the object with the
+// specified identifier, into a directory tree under saveAsDir, where
+// each file's path is its identifier, less the object's identifier. It
+// returns a result for each file, in the order of files. As with
+// DownloadPrefix, a failed download doesn't stop the others, and leaves
+// no file behind.
+func (downloader *ObjectDownloader) Download(ctx context.Context, identifier string, files []*registry.GenericFile, saveAsDir string) []*ObjectDownloadResult {
+	if downloader.Logger == nil {
+		downloader.Logger = logging.MustGetLogger("aptrust")
+	}
+	results := make([]*ObjectDownloadResult, len(files))
+	pathsTaken := make(map[string]string)
+	pending := make(chan int)
+	for i, file := range files {
+		results[i] = &ObjectDownloadResult{Identifier: file.Identifier, Size: file.Size, Result: "Failed"}
+		relativePath, err := LocalPathForPrefixKey(identifier+"/", file.Identifier)
+		if err != nil {
+			results[i].Error = err.Error()
+			continue
+		}
+		results[i].File = filepath.Join(saveAsDir, relativePath)
+		// Cleaning up file names can give two files the same path.
+		if other, ok := pathsTaken[results[i].File]; ok {
+			results[i].Error = fmt.Sprintf("file %s would be saved to the same file as %s", file.Identifier, other)
+			continue
+		}
+		pathsTaken[results[i].File] = file.Identifier
+		results[i].Result = ""
+	}
+	concurrency := downloader.Concurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range pending {
+				downloader.downloadFile(ctx, files[i], results[i])
+			}
+		}()
+	}
+	for i, result := range results {
+		if result.Result == "" {
+			pending <- i
+		}
+	}
+	close(pending)
+	wg.Wait()
+	return results
+}
+
+// downloadFile downloads file's preferred copy, or if that copy is in
+// Glacier and hasn't been restored, its next copy, and records the
+// outcome in result.
+func (downloader *ObjectDownloader) downloadFile(ctx context.Context, file *registry.GenericFile, result *ObjectDownloadResult) {
+	result.Result = "Failed"
+	records := file.StorageRecords
+	if len(records) == 0 {
+		var err error
+		if records, err = downloader.fetchStorageRecords(ctx, file); err != nil {
+			result.Error = err.Error()
+			return
+		}
+	}
+	urls := PreferredStorageURLs(records)
+	if len(urls) == 0 {
+		result.Error = fmt.Sprintf("the registry has no storage records for %s", file.Identifier)
+		return
+	}
+	// Report the first error other than a copy not being restored, since
+	// that's the one that kept us from getting a copy we could have had.
+	var firstErr, notRestoredErr error
+	for _, storageURL := range urls {
+		result.URL = storageURL
+		location, err := ParseStorageURL(storageURL)
+		if err == nil {
+			var skipped, verified bool
+			skipped, verified, err = downloadObject(ctx, downloader.s3Client(location.Host), location.Bucket, location.Key, result.File, downloader.Verify, downloader.SkipExisting, 0, downloader.Counter, downloader.Limiter, downloader.Retry)
+			if err == nil {
+				result.Result = "OK"
+				if skipped {
+					result.Result = "Skipped"
+				}
+				result.ETagVerified = verified
+				return
+			}
+		}
+		downloader.Logger.Debugf("Can't download %s from %s: %s", file.Identifier, storageURL, err)
+		if IsNotRestoredError(err) {
+			notRestoredErr = err
+		} else if firstErr == nil {
+			firstErr = err
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	if firstErr == nil {
+		firstErr = fmt.Errorf("%s is stored only in Glacier, and must be restored before it can be downloaded: %w", file.Identifier, notRestoredErr)
+	}
+	result.Error = firstErr.Error()
+}
+
+// fetchStorageRecords fetches file's storage records, for registries
+// that don't include them in file records.
+func (downloader *ObjectDownloader) fetchStorageRecords(ctx context.Context, file *registry.GenericFile) ([]*registry.StorageRecord, error) {
+	records := make([]*registry.StorageRecord, 0)
+	params := url.Values{}
+	params.Set("generic_file_id", strconv.FormatInt(file.ID, 10))
+	params.Set("per_page", "100")
+	for params != nil {
+		batch, page, err := downloader.Registry.ListStorageRecords(ctx, params)
+		if err != nil {
+			return nil, fmt.Errorf("can't get storage records for %s: %w", file.Identifier, err)
+		}
+		records = append(records, batch...)
+		params = page.Next
+	}
+	return records, nil
+}
+
+// s3Client returns the client for host, creating it the first time
+// it's needed.
+func (downloader *ObjectDownloader) s3Client(host string) *minio.Client {
+	downloader.mutex.Lock()
+	defer downloader.mutex.Unlock()
+	if downloader.s3Clients == nil {
+		downloader.s3Clients = make(map[string]*minio.Client)
+	}
+	client := downloader.s3Clients[host]
+	if client == nil {
+		client = downloader.NewS3Client(host)
+		downloader.s3Clients[host] = client
+	}
+	return client
+}
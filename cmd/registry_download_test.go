@@ -0,0 +1,167 @@
+package cmd_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/APTrust/apt-cmd/cmd"
+	"github.com/APTrust/preservation-services/models/registry"
+	"github.com/minio/minio-go/v7"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseStorageURL(t *testing.T) {
+	location, err := cmd.ParseStorageURL("https://s3.amazonaws.com/aptrust.preservation.storage/25452f41-1b18-47b7-b334-751dfd5d011e")
+	require.Nil(t, err)
+	assert.Equal(t, cmd.StorageLocation{Host: "s3.amazonaws.com", Bucket: "aptrust.preservation.storage", Key: "25452f41-1b18-47b7-b334-751dfd5d011e"}, location)
+
+	for _, storageURL := range []string{"https://s3.amazonaws.com/bucket", "https://s3.amazonaws.com/", "/bucket/key", "::"} {
+		_, err = cmd.ParseStorageURL(storageURL)
+		assert.NotNil(t, err, storageURL)
+	}
+}
+
+func TestPreferredStorageURLs(t *testing.T) {
+	records := []*registry.StorageRecord{
+		{URL: "https://s3.amazonaws.com/aptrust.preservation.oregon/uuid"},
+		{URL: "https://s3.amazonaws.com/aptrust.preservation.glacier.oh/uuid"},
+		{URL: "https://s3.amazonaws.com/aptrust.preservation.storage/uuid"},
+		{URL: "https://s3.us-east-1.wasabisys.com/aptrust.wasabi.va/uuid"},
+	}
+	assert.Equal(t, []string{
+		"https://s3.amazonaws.com/aptrust.preservation.storage/uuid",
+		"https://s3.us-east-1.wasabisys.com/aptrust.wasabi.va/uuid",
+		"https://s3.amazonaws.com/aptrust.preservation.oregon/uuid",
+		"https://s3.amazonaws.com/aptrust.preservation.glacier.oh/uuid",
+	}, cmd.PreferredStorageURLs(records))
+	assert.Empty(t, cmd.PreferredStorageURLs(nil))
+}
+
+// fakePreservationStorage returns a server that acts as both the
+// registry and S3. Object example.edu/photos has three files:
+// data/a.jpg, with a Glacier copy listed before its S3 copy,
+// data/b.jpg, whose storage records aren't in its file record, and
+// data/c.jpg, which is only in Glacier.
+func fakePreservationStorage(t *testing.T) *httptest.Server {
+	var server *httptest.Server
+	objects := map[string]string{
+		"/aptrust.preservation.storage/uuid-a": "photo a",
+		"/aptrust.preservation.storage/uuid-b": "photo b, which is longer",
+	}
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		storageURL := func(bucket, key string) string { return server.URL + "/" + bucket + "/" + key }
+		switch {
+		case r.URL.Path == "/member-api/v3/objects/show/example.edu/photos":
+			json.NewEncoder(w).Encode(&registry.IntellectualObject{ID: 1, Identifier: "example.edu/photos"})
+		case r.URL.Path == "/member-api/v3/files":
+			assert.Equal(t, "A", r.URL.Query().Get("state"))
+			files := []*registry.GenericFile{
+				{ID: 11, Identifier: "example.edu/photos/data/a.jpg", Size: 7, StorageRecords: []*registry.StorageRecord{
+					{URL: storageURL("aptrust.preservation.glacier.oh", "uuid-a")},
+					{URL: storageURL("aptrust.preservation.storage", "uuid-a")},
+				}},
+				{ID: 12, Identifier: "example.edu/photos/data/b.jpg", Size: 24},
+				{ID: 13, Identifier: "example.edu/photos/data/c.jpg", Size: 7, StorageRecords: []*registry.StorageRecord{
+					{URL: storageURL("aptrust.preservation.glacier.oh", "uuid-c")},
+				}},
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{"count": 3, "next": nil, "previous": nil, "results": files})
+		case r.URL.Path == "/member-api/v3/storage_records":
+			assert.Equal(t, "12", r.URL.Query().Get("generic_file_id"))
+			fmt.Fprintf(w, `{"count": 1, "next": null, "previous": null, "results": [{"id": 1, "generic_file_id": 12, "url": "%s"}]}`, storageURL("aptrust.preservation.storage", "uuid-b"))
+		case strings.HasPrefix(r.URL.Path, "/aptrust.preservation.glacier.oh/"):
+			if r.Method == http.MethodHead {
+				w.Header().Set("ETag", `"glacier"`)
+				w.Header().Set("Last-Modified", time.Now().UTC().Format(http.TimeFormat))
+				w.Header().Set("Content-Length", "7")
+				return
+			}
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprint(w, `<Error><Code>InvalidObjectState</Code><Message>The operation is not valid for the object's storage class</Message></Error>`)
+		default:
+			content, ok := objects[r.URL.Path]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				fmt.Fprint(w, `<Error><Code>NoSuchKey</Code><Message>The specified key does not exist.</Message></Error>`)
+				return
+			}
+			digest := md5.Sum([]byte(content))
+			w.Header().Set("ETag", `"`+hex.EncodeToString(digest[:])+`"`)
+			http.ServeContent(w, r, "", time.Now(), bytes.NewReader([]byte(content)))
+		}
+	}))
+	return server
+}
+
+func TestObjectDownloader(t *testing.T) {
+	server := fakePreservationStorage(t)
+	defer server.Close()
+	client := newTestRegistryClient(t, server)
+	s3Config := &cmd.Config{AWSKey: "key", AWSSecret: "secret", AWSRegion: "us-east-1", S3PathStyle: true}
+	downloader := &cmd.ObjectDownloader{
+		Registry:    client,
+		NewS3Client: func(host string) *minio.Client { return cmd.NewS3Client(s3Config, host) },
+		Concurrency: 2,
+	}
+	ctx := context.Background()
+	obj, err := client.GetObjectByIdentifier(ctx, "example.edu/photos")
+	require.Nil(t, err)
+	files, err := cmd.FetchActiveFiles(ctx, client, obj)
+	require.Nil(t, err)
+	require.Len(t, files, 3)
+
+	saveAs := filepath.Join(t.TempDir(), "photos")
+	results := downloader.Download(ctx, obj.Identifier, files, saveAs)
+	require.Len(t, results, 3)
+
+	// The S3 copy, not the Glacier copy listed first.
+	assert.Equal(t, "OK", results[0].Result, results[0].Error)
+	assert.Equal(t, server.URL+"/aptrust.preservation.storage/uuid-a", results[0].URL)
+	assert.Equal(t, filepath.Join(saveAs, "data", "a.jpg"), results[0].File)
+	data, err := os.ReadFile(results[0].File)
+	require.Nil(t, err)
+	assert.Equal(t, "photo a", string(data))
+
+	// Storage records fetched separately.
+	assert.Equal(t, "OK", results[1].Result, results[1].Error)
+	data, err = os.ReadFile(filepath.Join(saveAs, "data", "b.jpg"))
+	require.Nil(t, err)
+	assert.Equal(t, "photo b, which is longer", string(data))
+
+	// Only in Glacier.
+	assert.Equal(t, "Failed", results[2].Result)
+	assert.Contains(t, results[2].Error, "example.edu/photos/data/c.jpg is stored only in Glacier")
+	assert.NoFileExists(t, filepath.Join(saveAs, "data", "c.jpg"))
+
+	summary := cmd.NewObjectDownloadSummary(obj.Identifier, saveAs, results)
+	assert.Equal(t, "Failed", summary.Result)
+	assert.Equal(t, 2, summary.FileCount)
+	assert.Equal(t, 1, summary.FailedCount)
+	assert.Equal(t, int64(31), summary.TotalBytes)
+
+	// Files we already have are skipped.
+	downloader.SkipExisting = true
+	results = downloader.Download(ctx, obj.Identifier, files[:2], saveAs)
+	assert.Equal(t, "Skipped", results[0].Result, results[0].Error)
+	assert.Equal(t, "Skipped", results[1].Result, results[1].Error)
+}
+
+func TestRegistryDownloadErrors(t *testing.T) {
+	exitCode, stdout, stderr := execCmd(t, "go", "run", "../main.go", "registry", "download", "--config=../testconfig.env")
+	assert.NotEqual(t, 0, exitCode)
+	assert.Empty(t, stdout)
+	assert.Contains(t, stderr, "This call requires an object identifier")
+	assert.Contains(t, stderr, fmt.Sprintf("exit status %d", cmd.EXIT_USER_ERR))
+}
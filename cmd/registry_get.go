@@ -9,13 +9,16 @@ import (
 // getCmd represents the get command
 var getCmd = &cobra.Command{
 	Use:   "get",
-	Short: "A brief description of your command",
-	Long: `A longer description that spans multiple lines and likely contains examples
-and usage of using your command. For example:
+	Short: "Get a file, object, or work item from the APTrust Registry",
+	Long: `Get a single file, object, or work item record from the APTrust Registry.
+For more info, run:
 
-Cobra is a CLI library for Go that empowers applications.
-This application is a tool to generate the needed files
-to quickly create a Cobra application.
+    apt-cmd registry get file --help
+    apt-cmd registry get object --help
+    apt-cmd registry get workitem --help
+
+Records are JSON by default. Add --format=yaml to print the same record
+as YAML.
 
 Full online documentation:
 
@@ -29,4 +32,6 @@ https://aptrust.github.io/userguide/partner_tools/
 
 func init() {
 	registryCmd.AddCommand(getCmd)
+	getCmd.PersistentFlags().String("format", OutputFormatJSON, "Output format: json or yaml")
+	registerFlagCompletion(getCmd, "format", completeValues(OutputFormats...))
 }
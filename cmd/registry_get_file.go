@@ -1,7 +1,6 @@
 package cmd
 
 import (
-	"fmt"
 	"os"
 	"strconv"
 
@@ -11,16 +10,17 @@ import (
 
 // fileCmd represents the file command
 var fileCmd = &cobra.Command{
-	Use:   "file",
-	Short: "Retrieve file metadata from the APTrust Registry",
+	Use:     "file",
+	Short:   "Retrieve file metadata from the APTrust Registry",
+	Example: `apt-cmd registry get file identifier=example.edu/my_bag/data/image1.jpg`,
 	Long: `Retrieve a JSON record from the APTrust registry describing a
 generic file. File identifiers are strings,
 such as 'example.edu/photos/data/image1.jpg'. Ids are numeric.
 
 Examples:
 
-apt-cmd registry get file <file_identifier>
-apt-cmd registry get file <file_id>
+apt-cmd registry get file identifier=<file_identifier>
+apt-cmd registry get file id=<file_id>
 
 Full online documentation:
 
@@ -28,20 +28,20 @@ https://aptrust.github.io/userguide/partner_tools/
 
 `,
 	Run: func(cmd *cobra.Command, args []string) {
+		format := GetOutputFormat(cmd.Flags(), OutputFormats)
 		client, urlValues := InitRegistryRequest(config, args)
 		var resp *network.RegistryResponse
 		id, _ := strconv.ParseInt(urlValues.Get("id"), 10, 64)
 		identifier := urlValues.Get("identifier")
 		if id > 0 {
-			resp = client.GenericFileByID(id)
+			resp = DoRegistryRequest(cmd.Context(), func() *network.RegistryResponse { return client.GenericFileByID(id) })
 		} else if identifier != "" {
-			resp = client.GenericFileByIdentifier(identifier)
+			resp = DoRegistryRequest(cmd.Context(), func() *network.RegistryResponse { return client.GenericFileByIdentifier(identifier) })
 		} else {
-			fmt.Fprintln(os.Stderr, "This call requires either an id or an identifier")
-			os.Exit(EXIT_USER_ERR)
+			Fail(EXIT_USER_ERR, "This call requires either an id or an identifier")
 		}
 		data, _ := resp.RawResponseData()
-		PrettyPrintJSON(data)
+		PrintJSONAs(data, format)
 		os.Exit(EXIT_OK)
 	},
 }
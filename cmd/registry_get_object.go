@@ -1,7 +1,6 @@
 package cmd
 
 import (
-	"fmt"
 	"os"
 	"strconv"
 
@@ -11,16 +10,17 @@ import (
 
 // objectCmd represents the object command
 var objectCmd = &cobra.Command{
-	Use:   "object",
-	Short: "Retrieve object metadata from the APTrust Registry",
+	Use:     "object",
+	Short:   "Retrieve object metadata from the APTrust Registry",
+	Example: `apt-cmd registry get object identifier=example.edu/my_bag`,
 	Long: `Retrieve a JSON record from the APTrust registry describing an
 intellectual object. Object identifiers are strings,
 such as 'example.edu/photos'. Ids are numeric.
 
 Examples:
 
-apt-cmd registry get object <object_identifier>
-apt-cmd registry get object <object_id>
+apt-cmd registry get object identifier=<object_identifier>
+apt-cmd registry get object id=<object_id>
 
 Full online documentation:
 
@@ -28,20 +28,20 @@ https://aptrust.github.io/userguide/partner_tools/
 
 `,
 	Run: func(cmd *cobra.Command, args []string) {
+		format := GetOutputFormat(cmd.Flags(), OutputFormats)
 		client, urlValues := InitRegistryRequest(config, args)
 		var resp *network.RegistryResponse
 		id, _ := strconv.ParseInt(urlValues.Get("id"), 10, 64)
 		identifier := urlValues.Get("identifier")
 		if id > 0 {
-			resp = client.IntellectualObjectByID(id)
+			resp = DoRegistryRequest(cmd.Context(), func() *network.RegistryResponse { return client.IntellectualObjectByID(id) })
 		} else if identifier != "" {
-			resp = client.IntellectualObjectByIdentifier(identifier)
+			resp = DoRegistryRequest(cmd.Context(), func() *network.RegistryResponse { return client.IntellectualObjectByIdentifier(identifier) })
 		} else {
-			fmt.Fprintln(os.Stderr, "This call requires either an id or an identifier")
-			os.Exit(EXIT_USER_ERR)
+			Fail(EXIT_USER_ERR, "This call requires either an id or an identifier")
 		}
 		data, _ := resp.RawResponseData()
-		PrettyPrintJSON(data)
+		PrintJSONAs(data, format)
 		os.Exit(EXIT_OK)
 	},
 }
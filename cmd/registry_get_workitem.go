@@ -1,7 +1,6 @@
 package cmd
 
 import (
-	"fmt"
 	"os"
 	"strconv"
 
@@ -11,13 +10,14 @@ import (
 
 // workitemCmd represents the workitem command
 var workitemCmd = &cobra.Command{
-	Use:   "workitem",
-	Short: "Retrieves a WorkItem record from the APTrust Registry",
+	Use:     "workitem",
+	Short:   "Retrieves a WorkItem record from the APTrust Registry",
+	Example: `apt-cmd registry get workitem id=1234`,
 	Long: `Retrieve a WorkItem record from the APTrust Registry. Use this
 to check on the status of ingests, restorations and deletions. Id is a
 number.
 
-apt-cmd registry get workitem <id>
+apt-cmd registry get workitem id=<id>
 
 Full online documentation:
 
@@ -25,17 +25,17 @@ https://aptrust.github.io/userguide/partner_tools/
 
 `,
 	Run: func(cmd *cobra.Command, args []string) {
+		format := GetOutputFormat(cmd.Flags(), OutputFormats)
 		client, urlValues := InitRegistryRequest(config, args)
 		var resp *network.RegistryResponse
 		id, _ := strconv.ParseInt(urlValues.Get("id"), 10, 64)
 		if id > 0 {
-			resp = client.WorkItemByID(id)
+			resp = DoRegistryRequest(cmd.Context(), func() *network.RegistryResponse { return client.WorkItemByID(id) })
 		} else {
-			fmt.Fprintln(os.Stderr, "This call requires an id (e.g. id=1234)")
-			os.Exit(EXIT_USER_ERR)
+			Fail(EXIT_USER_ERR, "This call requires an id (e.g. id=1234)")
 		}
 		data, _ := resp.RawResponseData()
-		PrettyPrintJSON(data)
+		PrintJSONAs(data, format)
 		os.Exit(EXIT_OK)
 	},
 }
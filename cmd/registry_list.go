@@ -1,8 +1,22 @@
 package cmd
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
+	"github.com/APTrust/dart-runner/util"
+	"github.com/APTrust/preservation-services/network"
 	"github.com/spf13/cobra"
 )
 
@@ -11,9 +25,74 @@ var listCmd = &cobra.Command{
 	Use:   "list",
 	Short: "List files, objects, or work items from the APTrust Registry",
 	Long: `List files, objects, or work items from the APTrust Registry.
+
+	Use --sort to order results by one or more fields, separated by commas.
+	Add __desc to a field name to sort in descending order, or __asc for
+	ascending order, which is the default. For example:
+
+	  apt-cmd registry list objects --sort=institution_id,updated_at__desc
+
+	Sort fields are checked before the request goes to the registry.
+
+	So are the names of the params you filter on. Each list accepts the
+	fields of its records, such as state for files, plus page, per_page
+	and sort. A filter's name may end with an operator, such as __gteq,
+	__lteq, __in or __is_null. A typo fails with a list of the valid
+	params, instead of returning unfiltered results:
+
+	  apt-cmd registry list files stat=A
+	  invalid param(s) for registry list files: stat (did you mean state?) ...
+
+	To save a query for later, add --save-query with a name for the query.
+	This saves the query params and sort order, and then runs the query.
+
+	  apt-cmd registry list workitems action='Ingest' status='Failed' \
+	    --sort=date_processed__desc --save-query=failed-ingests
+
+	To run it again, use --run-query. Any params you add on the command line
+	replace the saved params with the same name.
+
+	  apt-cmd registry list workitems --run-query=failed-ingests per_page=100
+
+	Use --limit to get at most a given number of records. This fetches as
+	many pages as it takes to collect that many records, then stops. Unlike
+	per_page, which sets the size of each page, --limit caps the total.
+
+	  apt-cmd registry list files per_page=100 --limit=250
+
+	To get all matching records, use --all. This follows the registry's
+	next page links until there are no more pages, and prints all of the
+	records together, as if they were one page.
+
+	  apt-cmd registry list objects institution_id=3 per_page=100 --all
+
+	So that a query that matches far more records than you expected doesn't
+	run forever, --all stops after --max-records records, which defaults
+	to 10000. When that happens, apt-cmd prints a warning saying how many
+	records matched. Raise --max-records to get them all.
+
+	With --limit or --all, the output's count is the registry's total count
+	of matching records, and next and previous are null.
+
+	Results are JSON by default. Add --format=yaml to print the same
+	records as YAML, or --format=table to print an aligned text table,
+	which is easier to scan. The table shows a few fields of each record,
+	such as id, identifier, size and state for files. Use --columns to
+	pick the fields, using their JSON names:
+
+	  apt-cmd registry list files --format=table --columns=id,identifier,checksums
+
+	The table's last line says how many of the matching records it shows,
+	and which page to ask for next. If a column isn't a field of the
+	records, the results are printed as JSON instead.
+
+	Saved queries are stored in .aptrust_queries.json, in the same directory
+	as your config file. Each saved query belongs to the list command that
+	saved it.
+
 	Full online documentation:
 
-	  https://aptrust.github.io/userguide/partner_tools/		
+	  https://aptrust.github.io/userguide/partner_tools/
 	`,
 	Run: func(cmd *cobra.Command, args []string) {
 		fmt.Println("List metadata records from the APTrust registry. See subcommands for more info.")
@@ -22,4 +101,517 @@ var listCmd = &cobra.Command{
 
 func init() {
 	registryCmd.AddCommand(listCmd)
+	listCmd.PersistentFlags().String("sort", "", "Comma-separated list of fields to sort on. Add __desc to a field for descending order.")
+	listCmd.PersistentFlags().String("save-query", "", "Save this query's params under this name, then run it")
+	listCmd.PersistentFlags().String("run-query", "", "Run the saved query with this name")
+	listCmd.PersistentFlags().String("format", OutputFormatJSON, "Output format: json, yaml or table")
+	listCmd.PersistentFlags().String("columns", "", "With --format=table, comma-separated list of fields to show")
+	listCmd.PersistentFlags().Int("limit", 0, "Return at most this many records, fetching as many pages as needed. Zero means return one page.")
+	listCmd.PersistentFlags().Bool("all", false, "Fetch all pages of results")
+	listCmd.PersistentFlags().Int("max-records", DefaultMaxRecords, "With --all, stop after this many records")
+	registerFlagCompletion(listCmd, "format", completeValues(ListOutputFormats...))
+}
+
+// DefaultMaxRecords is the default for registry list --max-records.
+const DefaultMaxRecords = 10000
+
+// queryNameRegex describes valid names for saved queries.
+var queryNameRegex = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+
+// SavedQuery is a named set of registry list query params.
+type SavedQuery struct {
+	List   string     `json:"list"`
+	Params url.Values `json:"params"`
+}
+
+// QueriesFile returns the path to the file that holds saved registry
+// queries. This lives in the same directory as the config file, or in
+// the user's home directory if they didn't specify a config file.
+func QueriesFile() string {
+	dir := ""
+	if cfgFile != "" {
+		dir = filepath.Dir(cfgFile)
+	} else {
+		home, err := os.UserHomeDir()
+		cobra.CheckErr(err)
+		dir = home
+	}
+	return filepath.Join(dir, ".aptrust_queries.json")
+}
+
+// loadSavedQueries reads all saved queries from queriesFile. If the
+// file doesn't exist, this returns an empty map.
+func loadSavedQueries(queriesFile string) (map[string]*SavedQuery, error) {
+	queries := make(map[string]*SavedQuery)
+	data, err := os.ReadFile(queriesFile)
+	if os.IsNotExist(err) {
+		return queries, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(data, &queries)
+	if err != nil {
+		return nil, fmt.Errorf("can't parse saved queries in %s: %w", queriesFile, err)
+	}
+	return queries, nil
+}
+
+// SaveQuery saves params under the given name in queriesFile, for the
+// list command listName (files, objects or workitems). This replaces
+// any existing query with the same name.
+func SaveQuery(queriesFile, name, listName string, params url.Values) error {
+	if !queryNameRegex.MatchString(name) {
+		return fmt.Errorf("invalid query name '%s': use only letters, numbers, dots, dashes and underscores", name)
+	}
+	queries, err := loadSavedQueries(queriesFile)
+	if err != nil {
+		return err
+	}
+	queries[name] = &SavedQuery{List: listName, Params: params}
+	data, err := json.MarshalIndent(queries, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(queriesFile, data, 0600)
+}
+
+// LoadQuery returns the params of the saved query with the given name.
+// It returns an error if there's no such query, or if the query was
+// saved by a list command other than listName.
+func LoadQuery(queriesFile, name, listName string) (url.Values, error) {
+	queries, err := loadSavedQueries(queriesFile)
+	if err != nil {
+		return nil, err
+	}
+	query := queries[name]
+	if query == nil {
+		names := make([]string, 0, len(queries))
+		for queryName := range queries {
+			names = append(names, queryName)
+		}
+		sort.Strings(names)
+		return nil, fmt.Errorf("no saved query named '%s'. Saved queries: %s", name, strings.Join(names, ", "))
+	}
+	if query.List != listName {
+		return nil, fmt.Errorf("query '%s' is for registry list %s, not %s", name, query.List, listName)
+	}
+	return query.Params, nil
+}
+
+// ApplyQueryParams prepares the query params for a registry list
+// command. It merges in the --run-query params, if any, under the
+// params from the command line, checks their names against the params
+// listName accepts, applies the --sort flag, and then
+// saves the result if the user specified --save-query. This exits
+// with EXIT_USER_ERR on any error.
+func ApplyQueryParams(cmd *cobra.Command, listName string, values url.Values, model interface{}) {
+	runQuery := cmd.Flags().Lookup("run-query").Value.String()
+	if runQuery != "" {
+		saved, err := LoadQuery(QueriesFile(), runQuery, listName)
+		if err != nil {
+			Fail(EXIT_USER_ERR, err.Error())
+		}
+		for key, savedValues := range saved {
+			if _, ok := values[key]; !ok {
+				values[key] = savedValues
+			}
+		}
+		logger.Debugf("Running saved query %s: %s", runQuery, values.Encode())
+	}
+	if err := ValidateListParams(listName, values, model); err != nil {
+		Fail(EXIT_USER_ERR, err.Error())
+	}
+	ApplySortParams(cmd, values, model)
+	saveQuery := cmd.Flags().Lookup("save-query").Value.String()
+	if saveQuery != "" {
+		err := SaveQuery(QueriesFile(), saveQuery, listName, values)
+		if err != nil {
+			Fail(EXIT_USER_ERR, "Error saving query:", err.Error())
+		}
+		logger.Debugf("Saved query %s: %s", saveQuery, values.Encode())
+	}
+}
+
+// SortableFields returns the names of the fields of a registry model
+// that the registry can sort on. These are the JSON names of the
+// model's scalar and time fields. Lists, such as a file's checksums,
+// aren't sortable. Pass in an instance of the model, such as
+// registry.GenericFile{}.
+func SortableFields(model interface{}) []string {
+	timeType := reflect.TypeOf(time.Time{})
+	modelType := reflect.TypeOf(model)
+	fields := make([]string, 0, modelType.NumField())
+	for i := 0; i < modelType.NumField(); i++ {
+		field := modelType.Field(i)
+		switch field.Type.Kind() {
+		case reflect.Slice, reflect.Map, reflect.Ptr, reflect.Interface:
+			continue
+		case reflect.Struct:
+			if field.Type != timeType {
+				continue
+			}
+		}
+		name := strings.Split(field.Tag.Get("json"), ",")[0]
+		if name != "" && name != "-" {
+			fields = append(fields, name)
+		}
+	}
+	sort.Strings(fields)
+	return fields
+}
+
+// ParseSortKeys parses a comma-separated list of sort keys, such as
+// "identifier,updated_at__desc", and returns them in the format the
+// registry expects: one value per sort param, with "__desc" for
+// descending sorts and no suffix for ascending sorts. It returns an
+// error if any key isn't one of the allowed fields.
+func ParseSortKeys(sortKeys string, allowedFields []string) ([]string, error) {
+	keys := make([]string, 0)
+	invalid := make([]string, 0)
+	for _, key := range strings.Split(sortKeys, ",") {
+		key = strings.TrimSpace(key)
+		if key == "" {
+			continue
+		}
+		field, direction := key, ""
+		if strings.HasSuffix(key, "__desc") {
+			field, direction = strings.TrimSuffix(key, "__desc"), "__desc"
+		} else if strings.HasSuffix(key, "__asc") {
+			field = strings.TrimSuffix(key, "__asc")
+		}
+		if !util.StringListContains(allowedFields, field) {
+			invalid = append(invalid, key)
+			continue
+		}
+		keys = append(keys, field+direction)
+	}
+	if len(invalid) > 0 {
+		return nil, fmt.Errorf("invalid sort key(s): %s. Valid sort fields are: %s", strings.Join(invalid, ", "), strings.Join(allowedFields, ", "))
+	}
+	return keys, nil
+}
+
+// listExtraFilters lists the filters of each registry list command that
+// aren't fields of its records, such as the identifier of a file's
+// object, which the registry looks up for us.
+var listExtraFilters = map[string][]string{
+	"files": {"intellectual_object_identifier"},
+}
+
+// FilterOperators are the suffixes the registry accepts on the name of
+// a filter param, such as created_at__gteq or status__in.
+var FilterOperators = []string{
+	"__contains",
+	"__eq",
+	"__gt",
+	"__gteq",
+	"__in",
+	"__is_null",
+	"__lt",
+	"__lteq",
+	"__ne",
+	"__not_in",
+	"__not_null",
+	"__starts_with",
+}
+
+// ListParams returns the names of the params that the registry list
+// command listName accepts: the sortable fields of its records, which
+// are also its filters, any extra filters, and page, per_page and sort.
+// Filters may end with one of the FilterOperators.
+func ListParams(listName string, model interface{}) []string {
+	params := append(SortableFields(model), listExtraFilters[listName]...)
+	params = append(params, "page", "per_page", "sort")
+	sort.Strings(params)
+	return params
+}
+
+// ValidateListParams returns an error naming the params in values that
+// the registry list command listName doesn't accept, so a typo like
+// stat=A doesn't quietly return unfiltered results. The error suggests
+// the closest valid param, if there's a likely one, and lists the rest.
+func ValidateListParams(listName string, values url.Values, model interface{}) error {
+	allowed := ListParams(listName, model)
+	filters := append(SortableFields(model), listExtraFilters[listName]...)
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	invalid := make([]string, 0)
+	for _, name := range names {
+		field, operator := splitFilterOperator(name)
+		if util.StringListContains(allowed, name) || (operator != "" && util.StringListContains(filters, field)) {
+			continue
+		}
+		if suggestion := closestName(field, allowed); suggestion != "" {
+			name += fmt.Sprintf(" (did you mean %s%s?)", suggestion, operator)
+		}
+		invalid = append(invalid, name)
+	}
+	if len(invalid) > 0 {
+		return fmt.Errorf("invalid param(s) for registry list %s: %s. Valid params are: %s. Filters may end with an operator, such as __gteq or __in", listName, strings.Join(invalid, ", "), strings.Join(allowed, ", "))
+	}
+	return nil
+}
+
+// splitFilterOperator splits a param name such as created_at__gteq into
+// its field and its operator, if it ends with one of the FilterOperators.
+func splitFilterOperator(name string) (field, operator string) {
+	for _, operator := range FilterOperators {
+		if strings.HasSuffix(name, operator) && len(name) > len(operator) {
+			return strings.TrimSuffix(name, operator), operator
+		}
+	}
+	return name, ""
+}
+
+// ApplySortParams sets the sort params in values from the --sort flag,
+// if the user supplied it, replacing any raw sort= params. It then
+// checks all sort params against the sortable fields of model, so we
+// can report bad sort keys without a round trip to the registry.
+// This exits with EXIT_USER_ERR if any sort key is invalid.
+func ApplySortParams(cmd *cobra.Command, values url.Values, model interface{}) {
+	allowedFields := SortableFields(model)
+	sortKeys := cmd.Flags().Lookup("sort").Value.String()
+	if sortKeys == "" {
+		sortKeys = strings.Join(values["sort"], ",")
+	}
+	if sortKeys == "" {
+		return
+	}
+	keys, err := ParseSortKeys(sortKeys, allowedFields)
+	if err != nil {
+		Fail(EXIT_USER_ERR, err.Error())
+	}
+	values.Del("sort")
+	for _, key := range keys {
+		values.Add("sort", key)
+	}
+}
+
+// listPage is one page of results from a registry list request.
+// We leave the results as raw JSON, so this works for any model.
+type listPage struct {
+	Count    int               `json:"count"`
+	Next     *string           `json:"next"`
+	Previous *string           `json:"previous"`
+	Results  []json.RawMessage `json:"results"`
+}
+
+// FetchListPages calls fetch with values for successive pages of
+// results, starting at the page in values, or page 1, until it has
+// collected limit records or there are no more pages. It returns a
+// single page of JSON containing exactly limit records, or fewer if
+// there aren't that many. The page's count is the registry's total
+// count of matching records. Next and previous are null, since the
+// results don't line up with the registry's pages.
+//
+// The first page says how many records there are, and how many the
+// registry puts on a page, so this fetches the pages after it
+// concurrency at a time, asking only for the pages it needs.
+func FetchListPages(ctx context.Context, values url.Values, limit, concurrency int, fetch func(url.Values) *network.RegistryResponse) ([]byte, error) {
+	page := 1
+	if values.Get("page") != "" {
+		var err error
+		page, err = strconv.Atoi(values.Get("page"))
+		if err != nil || page < 1 {
+			return nil, fmt.Errorf("invalid page '%s'", values.Get("page"))
+		}
+	}
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	current, err := fetchListPage(ctx, values, page, fetch)
+	if err != nil {
+		return nil, err
+	}
+	combined := &listPage{Count: current.Count, Results: make([]json.RawMessage, 0, limit)}
+	combined.Results = append(combined.Results, current.Results...)
+	page++
+	for len(combined.Results) < limit && current.Next != nil && len(current.Results) > 0 {
+		// Every page but the last is full.
+		perPage := len(current.Results)
+		needed := limit - len(combined.Results)
+		if remaining := current.Count - (page-1)*perPage; remaining < needed {
+			needed = remaining
+		}
+		batchSize := (needed + perPage - 1) / perPage
+		if batchSize > concurrency {
+			batchSize = concurrency
+		}
+		if batchSize < 1 {
+			batchSize = 1
+		}
+		pages, err := fetchListPages(ctx, values, page, batchSize, fetch)
+		if err != nil {
+			return nil, err
+		}
+		for _, current = range pages {
+			combined.Count = current.Count
+			combined.Results = append(combined.Results, current.Results...)
+			if len(combined.Results) >= limit || current.Next == nil || len(current.Results) == 0 {
+				break
+			}
+		}
+		page += batchSize
+	}
+	if len(combined.Results) > limit {
+		combined.Results = combined.Results[:limit]
+	}
+	return json.Marshal(combined)
+}
+
+// fetchListPages fetches count pages at the same time, starting with
+// page first, and returns them in order. It returns the error of the
+// first page that failed.
+func fetchListPages(ctx context.Context, values url.Values, first, count int, fetch func(url.Values) *network.RegistryResponse) ([]*listPage, error) {
+	pages := make([]*listPage, count)
+	errs := make([]error, count)
+	var wg sync.WaitGroup
+	for i := 0; i < count; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			pages[i], errs[i] = fetchListPage(ctx, values, first+i, fetch)
+		}(i)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	return pages, nil
+}
+
+// fetchListPage fetches one page of list results. It gives fetch a copy
+// of values, so pages can be fetched at the same time.
+func fetchListPage(ctx context.Context, values url.Values, page int, fetch func(url.Values) *network.RegistryResponse) (*listPage, error) {
+	pageValues := url.Values{}
+	for key, value := range values {
+		pageValues[key] = value
+	}
+	pageValues.Set("page", strconv.Itoa(page))
+	resp := DoRegistryRequest(ctx, func() *network.RegistryResponse { return fetch(pageValues) })
+	data, err := resp.RawResponseData()
+	if err != nil {
+		return nil, err
+	}
+	if resp.Response != nil && resp.Response.StatusCode >= 400 {
+		return nil, fmt.Errorf("registry returned status %d for page %d: %s", resp.Response.StatusCode, page, string(data))
+	}
+	current := &listPage{}
+	if err = json.Unmarshal(data, current); err != nil {
+		return nil, fmt.Errorf("can't parse page %d of results: %w", page, err)
+	}
+	return current, nil
+}
+
+// FetchAllPages calls fetch for each page of results, starting with
+// the page in params, and passes each response to collect. It returns
+// the first error the registry client reports.
+func FetchAllPages(ctx context.Context, params url.Values, fetch func(url.Values) *network.RegistryResponse, collect func(*network.RegistryResponse)) error {
+	for params != nil {
+		resp := DoRegistryRequest(ctx, func() *network.RegistryResponse { return fetch(params) })
+		if resp.Error != nil {
+			return resp.Error
+		}
+		collect(resp)
+		params = resp.ParamsForNextPage()
+	}
+	return nil
+}
+
+// RunListRequest runs registry list request listName (files, objects or
+// workitems) and prints the results in the --format the user asked for.
+// If the user specified --limit, this fetches pages until it has that
+// many records. With --all, it fetches pages until there are no more,
+// or until it has --max-records. Otherwise, it prints the single page
+// the registry returns. Tables show the --columns of model that the user asked for,
+// or fall back to JSON if model has no such fields. This exits when
+// it's done.
+func RunListRequest(cmd *cobra.Command, listName string, values url.Values, model interface{}, fetch func(url.Values) *network.RegistryResponse) {
+	format := GetOutputFormat(cmd.Flags(), ListOutputFormats)
+	columnsFlag, _ := cmd.Flags().GetString("columns")
+	if columnsFlag != "" && format != OutputFormatTable {
+		Fail(EXIT_USER_ERR, "--columns can be used only with --format=table")
+	}
+	var columns []string
+	if format == OutputFormatTable {
+		var err error
+		columns, err = TableColumns(columnsFlag, listName, model)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s. Printing JSON instead.\n", err.Error())
+			format = OutputFormatJSON
+		}
+	}
+	limit, _ := cmd.Flags().GetInt("limit")
+	if limit < 0 {
+		Fail(EXIT_USER_ERR, "--limit must be zero or more")
+	}
+	all, _ := cmd.Flags().GetBool("all")
+	maxRecords, _ := cmd.Flags().GetInt("max-records")
+	if all && limit > 0 {
+		Fail(EXIT_USER_ERR, "Use either --all or --limit, not both")
+	}
+	if cmd.Flags().Changed("max-records") && !all {
+		Fail(EXIT_USER_ERR, "--max-records can be used only with --all")
+	}
+	if all {
+		if maxRecords < 1 {
+			Fail(EXIT_USER_ERR, "--max-records must be one or more")
+		}
+		limit = maxRecords
+	}
+	if limit == 0 {
+		resp := DoRegistryRequest(cmd.Context(), func() *network.RegistryResponse { return fetch(values) })
+		data, _ := resp.RawResponseData()
+		printListResults(data, format, columns)
+		os.Exit(EXIT_OK)
+	}
+	// Don't fetch more than we need. With --all, leave the page size
+	// to the registry, unless the user set it.
+	perPage, err := strconv.Atoi(values.Get("per_page"))
+	if (err != nil && !all) || perPage > limit {
+		values.Set("per_page", strconv.Itoa(limit))
+	}
+	data, err := FetchListPages(cmd.Context(), values, limit, GetConcurrency(cmd.Flags()), fetch)
+	if err != nil {
+		Fail(EXIT_REQUEST_ERROR, "Error fetching results:", err.Error())
+	}
+	if all {
+		warnIfTruncated(data)
+	}
+	printListResults(data, format, columns)
+	os.Exit(EXIT_OK)
+}
+
+// warnIfTruncated tells the user when --all stopped at --max-records
+// before it got all of the matching records.
+func warnIfTruncated(data []byte) {
+	page := &listPage{}
+	if err := json.Unmarshal(data, page); err != nil {
+		return
+	}
+	if page.Count > len(page.Results) {
+		fmt.Fprintf(os.Stderr, "Warning: stopped after %d records, per --max-records. The registry has %d matching records.\n", len(page.Results), page.Count)
+	}
+}
+
+// printListResults prints a page of list results in format. If the
+// page can't be shown as a table, such as when the registry returns an
+// error, this prints it as JSON.
+func printListResults(data []byte, format string, columns []string) {
+	if format == OutputFormatTable {
+		table, err := FormatTable(data, columns)
+		if err == nil {
+			WriteResult(table)
+			return
+		}
+		logger.Debugf("Printing results as JSON, since they can't be shown as a table: %s", err.Error())
+		format = OutputFormatJSON
+	}
+	PrintJSONAs(data, format)
 }
@@ -0,0 +1,439 @@
+package cmd_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/APTrust/apt-cmd/cmd"
+	"github.com/APTrust/preservation-services/models/registry"
+	"github.com/APTrust/preservation-services/network"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSortableFields(t *testing.T) {
+	fields := cmd.SortableFields(registry.GenericFile{})
+	assert.Contains(t, fields, "identifier")
+	assert.Contains(t, fields, "size")
+	assert.Contains(t, fields, "created_at")
+	assert.NotContains(t, fields, "checksums")
+	assert.NotContains(t, fields, "storage_records")
+
+	// Tags with omitempty should still give us the field name.
+	fields = cmd.SortableFields(registry.WorkItem{})
+	assert.Contains(t, fields, "date_processed")
+	assert.Contains(t, fields, "id")
+	assert.Contains(t, fields, "queued_at")
+}
+
+func TestParseSortKeys(t *testing.T) {
+	fields := cmd.SortableFields(registry.IntellectualObject{})
+
+	keys, err := cmd.ParseSortKeys("identifier", fields)
+	require.Nil(t, err)
+	assert.Equal(t, []string{"identifier"}, keys)
+
+	keys, err = cmd.ParseSortKeys("institution_id__asc, updated_at__desc,,", fields)
+	require.Nil(t, err)
+	assert.Equal(t, []string{"institution_id", "updated_at__desc"}, keys)
+
+	_, err = cmd.ParseSortKeys("identifier,colour__desc,bogus", fields)
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), "invalid sort key(s): colour__desc, bogus")
+	assert.Contains(t, err.Error(), "bag_name")
+
+	// Suffix alone isn't a field
+	_, err = cmd.ParseSortKeys("__desc", fields)
+	require.NotNil(t, err)
+}
+
+func TestRegistryListInvalidSort(t *testing.T) {
+	// These fail before any request goes out, so we don't
+	// need a registry, just syntactically valid config.
+	for _, args := range [][]string{
+		{"objects", "--sort=identifier,bogus__desc"},
+		{"files", "sort=colour"},
+		{"workitems", "--sort=size__sideways"},
+	} {
+		cmdArgs := append([]string{"run", "../main.go", "registry", "list"}, args...)
+		cmdArgs = append(cmdArgs, "--config=../testconfig.env")
+		exitCode, stdout, stderr := execCmd(t, "go", cmdArgs...)
+		assert.NotEqual(t, 0, exitCode, args)
+		assert.Empty(t, stdout, args)
+		assert.Contains(t, stderr, "invalid sort key(s)", args)
+	}
+}
+
+func TestValidateListParams(t *testing.T) {
+	params := url.Values{}
+	params.Set("state", "A")
+	params.Set("created_at__gteq", "2023-04-06")
+	params.Add("storage_option__in", "Standard")
+	params.Add("storage_option__in", "Glacier-OH")
+	params.Set("intellectual_object_identifier", "test.edu/my_bag")
+	params.Set("per_page", "10")
+	params.Set("sort", "identifier__desc")
+	require.Nil(t, cmd.ValidateListParams("files", params, registry.GenericFile{}))
+
+	params.Set("stat", "A")
+	params.Set("create_at__gteq", "2023-04-06")
+	params.Set("colour", "blue")
+	err := cmd.ValidateListParams("files", params, registry.GenericFile{})
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), "invalid param(s) for registry list files: colour, create_at__gteq (did you mean created_at__gteq?), stat (did you mean state?).")
+	assert.Contains(t, err.Error(), "Valid params are: created_at, file_format,")
+
+	// Extra filters belong to one list, and operators need a field.
+	params = url.Values{}
+	params.Set("intellectual_object_identifier", "test.edu/my_bag")
+	params.Set("__gteq", "1")
+	err = cmd.ValidateListParams("objects", params, registry.IntellectualObject{})
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), "registry list objects: __gteq, intellectual_object_identifier")
+	assert.Contains(t, cmd.ListParams("workitems", registry.WorkItem{}), "object_identifier")
+}
+
+func TestRegistryListInvalidParam(t *testing.T) {
+	exitCode, stdout, stderr := execCmd(t, "go", "run", "../main.go", "registry", "list", "files", "stat=A", "--config=../testconfig.env")
+	assert.NotEqual(t, 0, exitCode)
+	assert.Empty(t, stdout)
+	assert.Contains(t, stderr, "stat (did you mean state?)")
+	assert.Contains(t, stderr, fmt.Sprintf("exit status %d", cmd.EXIT_USER_ERR))
+}
+
+func TestRegistryInvalidFormat(t *testing.T) {
+	// Like bad sort keys, a bad format fails before any request.
+	for _, args := range [][]string{
+		{"list", "objects", "--format=xml"},
+		{"get", "file", "id=1", "--format=csv"},
+	} {
+		cmdArgs := append([]string{"run", "../main.go", "registry"}, args...)
+		cmdArgs = append(cmdArgs, "--config=../testconfig.env")
+		exitCode, stdout, stderr := execCmd(t, "go", cmdArgs...)
+		assert.NotEqual(t, 0, exitCode, args)
+		assert.Empty(t, stdout, args)
+		assert.Contains(t, stderr, "Invalid --format", args)
+	}
+}
+
+func TestRegistryListColumnsWithoutTable(t *testing.T) {
+	exitCode, stdout, stderr := execCmd(t, "go", "run", "../main.go", "registry", "list", "files", "--columns=id,size", "--config=../testconfig.env")
+	assert.NotEqual(t, 0, exitCode)
+	assert.Empty(t, stdout)
+	assert.Contains(t, stderr, "--columns can be used only with --format=table")
+}
+
+func TestModelFields(t *testing.T) {
+	fields := cmd.ModelFields(registry.GenericFile{})
+	assert.Contains(t, fields, "id")
+	assert.Contains(t, fields, "identifier")
+	assert.Contains(t, fields, "size")
+	assert.Contains(t, fields, "checksums")
+	assert.NotContains(t, fields, "")
+}
+
+func TestTableColumns(t *testing.T) {
+	columns, err := cmd.TableColumns("", "files", registry.GenericFile{})
+	require.Nil(t, err)
+	assert.Equal(t, []string{"id", "identifier", "size", "state"}, columns)
+
+	columns, err = cmd.TableColumns("", "workitems", registry.WorkItem{})
+	require.Nil(t, err)
+	assert.Equal(t, []string{"id", "name", "action", "stage", "status"}, columns)
+
+	columns, err = cmd.TableColumns(" identifier, size ,", "objects", registry.IntellectualObject{})
+	require.Nil(t, err)
+	assert.Equal(t, []string{"identifier", "size"}, columns)
+
+	// The defaults are all real fields.
+	for listName, model := range map[string]interface{}{
+		"files":     registry.GenericFile{},
+		"objects":   registry.IntellectualObject{},
+		"workitems": registry.WorkItem{},
+	} {
+		columns, err = cmd.TableColumns(strings.Join(cmd.DefaultTableColumns[listName], ","), listName, model)
+		assert.Nil(t, err, listName)
+	}
+
+	_, err = cmd.TableColumns("id,colour", "files", registry.GenericFile{})
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), "invalid column(s) for files: colour")
+}
+
+func TestFormatTable(t *testing.T) {
+	data := []byte(`{
+		"count": 143,
+		"next": "https://example.com/member-api/v3/files?page=2&per_page=2",
+		"previous": null,
+		"results": [
+			{"id": 1, "identifier": "test.edu/bag/data/file.txt", "size": 1024, "state": "A", "checksums": [{"algorithm": "md5"}]},
+			{"id": 22, "identifier": "test.edu/bag/data/tab\tname.txt", "size": 5, "state": null}
+		]
+	}`)
+	table, err := cmd.FormatTable(data, []string{"id", "identifier", "size", "state", "checksums"})
+	require.Nil(t, err)
+	lines := strings.Split(strings.TrimRight(table, "\n"), "\n")
+	require.Len(t, lines, 4)
+	assert.Equal(t, "ID  IDENTIFIER                      SIZE  STATE  CHECKSUMS", strings.TrimRight(lines[0], " "))
+	assert.Equal(t, `1   test.edu/bag/data/file.txt      1024  A      [{"algorithm":"md5"}]`, strings.TrimRight(lines[1], " "))
+	assert.Equal(t, "22  test.edu/bag/data/tab name.txt  5", strings.TrimRight(lines[2], " "))
+	assert.Equal(t, "Showing 2 of 143. For more, add page=2.", lines[3])
+
+	// Last page
+	table, err = cmd.FormatTable([]byte(`{"count": 1, "next": null, "results": [{"id": 1}]}`), []string{"id"})
+	require.Nil(t, err)
+	assert.Equal(t, "ID\n1\nShowing 1 of 1.\n", table)
+
+	// Errors aren't pages of results.
+	_, err = cmd.FormatTable([]byte(`{"error": "not found"}`), []string{"id"})
+	assert.NotNil(t, err)
+	_, err = cmd.FormatTable([]byte(`not json`), []string{"id"})
+	assert.NotNil(t, err)
+}
+
+func TestSaveAndLoadQuery(t *testing.T) {
+	queriesFile := path.Join(t.TempDir(), ".aptrust_queries.json")
+
+	// No file yet
+	_, err := cmd.LoadQuery(queriesFile, "failed", "workitems")
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), "no saved query named 'failed'")
+
+	failed := url.Values{}
+	failed.Set("status", "Failed")
+	failed.Add("sort", "date_processed__desc")
+	failed.Add("sort", "name")
+	require.Nil(t, cmd.SaveQuery(queriesFile, "failed", "workitems", failed))
+
+	big := url.Values{}
+	big.Set("size__gteq", "1000000000")
+	require.Nil(t, cmd.SaveQuery(queriesFile, "big-objects", "objects", big))
+
+	params, err := cmd.LoadQuery(queriesFile, "failed", "workitems")
+	require.Nil(t, err)
+	assert.Equal(t, failed, params)
+
+	params, err = cmd.LoadQuery(queriesFile, "big-objects", "objects")
+	require.Nil(t, err)
+	assert.Equal(t, big, params)
+
+	// Wrong list command
+	_, err = cmd.LoadQuery(queriesFile, "big-objects", "files")
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), "is for registry list objects, not files")
+
+	// Unknown query lists the ones we have
+	_, err = cmd.LoadQuery(queriesFile, "nope", "files")
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), "Saved queries: big-objects, failed")
+
+	// Saving with the same name replaces the old query
+	failed.Set("status", "Cancelled")
+	require.Nil(t, cmd.SaveQuery(queriesFile, "failed", "workitems", failed))
+	params, err = cmd.LoadQuery(queriesFile, "failed", "workitems")
+	require.Nil(t, err)
+	assert.Equal(t, "Cancelled", params.Get("status"))
+
+	assert.NotNil(t, cmd.SaveQuery(queriesFile, "has spaces", "files", big))
+	assert.NotNil(t, cmd.SaveQuery(queriesFile, "", "files", big))
+
+	// Corrupt file
+	require.Nil(t, os.WriteFile(queriesFile, []byte("{not json"), 0600))
+	_, err = cmd.LoadQuery(queriesFile, "failed", "workitems")
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), "can't parse saved queries")
+}
+
+func TestRegistryListRunQueryErrors(t *testing.T) {
+	configDir := t.TempDir()
+	configFile := path.Join(configDir, "config.env")
+	data, err := os.ReadFile("../testconfig.env")
+	require.Nil(t, err)
+	require.Nil(t, os.WriteFile(configFile, data, 0600))
+
+	params := url.Values{}
+	params.Set("name", "bag.tar")
+	require.Nil(t, cmd.SaveQuery(path.Join(configDir, ".aptrust_queries.json"), "my-bag", "workitems", params))
+
+	exitCode, _, stderr := execCmd(t, "go", "run", "../main.go", "registry", "list", "files", "--run-query=my-bag", "--config="+configFile)
+	assert.NotEqual(t, 0, exitCode)
+	assert.Contains(t, stderr, "query 'my-bag' is for registry list workitems, not files")
+
+	exitCode, _, stderr = execCmd(t, "go", "run", "../main.go", "registry", "list", "workitems", "--run-query=not-saved", "--config="+configFile)
+	assert.NotEqual(t, 0, exitCode)
+	assert.Contains(t, stderr, "no saved query named 'not-saved'")
+}
+
+func TestRegistryListAllFlagErrors(t *testing.T) {
+	for _, test := range []struct {
+		args    []string
+		message string
+	}{
+		{[]string{"--all", "--limit=10"}, "Use either --all or --limit, not both"},
+		{[]string{"--max-records=10"}, "--max-records can be used only with --all"},
+		{[]string{"--all", "--max-records=0"}, "--max-records must be one or more"},
+	} {
+		cmdArgs := append([]string{"run", "../main.go", "registry", "list", "objects"}, test.args...)
+		cmdArgs = append(cmdArgs, "--config=../testconfig.env")
+		exitCode, stdout, stderr := execCmd(t, "go", cmdArgs...)
+		assert.NotEqual(t, 0, exitCode, test.args)
+		assert.Empty(t, stdout, test.args)
+		assert.Contains(t, stderr, test.message, test.args)
+	}
+}
+
+// fakeListFetcher returns a fetch function that serves total records
+// from pages of the requested size, and records which pages it served.
+func fakeListFetcher(total int, pagesServed *[]string) func(url.Values) *network.RegistryResponse {
+	var mutex sync.Mutex
+	return func(values url.Values) *network.RegistryResponse {
+		pageNum, perPage := 0, 0
+		fmt.Sscanf(values.Get("page"), "%d", &pageNum)
+		fmt.Sscanf(values.Get("per_page"), "%d", &perPage)
+		mutex.Lock()
+		*pagesServed = append(*pagesServed, values.Get("page"))
+		mutex.Unlock()
+		results := make([]map[string]int, 0)
+		for id := (pageNum-1)*perPage + 1; id <= pageNum*perPage && id <= total; id++ {
+			results = append(results, map[string]int{"id": id})
+		}
+		var next *string
+		if pageNum*perPage < total {
+			nextURL := fmt.Sprintf("/files?page=%d&per_page=%d", pageNum+1, perPage)
+			next = &nextURL
+		}
+		body, _ := json.Marshal(map[string]interface{}{
+			"count":    total,
+			"next":     next,
+			"previous": nil,
+			"results":  results,
+		})
+		resp := network.NewRegistryResponse(network.RegistryGenericFile)
+		resp.Response = &http.Response{
+			StatusCode: http.StatusOK,
+			Body:       io.NopCloser(strings.NewReader(string(body))),
+		}
+		return resp
+	}
+}
+
+type limitTestPage struct {
+	Count    int              `json:"count"`
+	Next     *string          `json:"next"`
+	Previous *string          `json:"previous"`
+	Results  []map[string]int `json:"results"`
+}
+
+func TestFetchListPages(t *testing.T) {
+	// Limit spans pages, and we trim the last page
+	pagesServed := make([]string, 0)
+	values := url.Values{}
+	values.Set("per_page", "10")
+	data, err := cmd.FetchListPages(context.Background(), values, 25, 1, fakeListFetcher(100, &pagesServed))
+	require.Nil(t, err)
+	page := &limitTestPage{}
+	require.Nil(t, json.Unmarshal(data, page))
+	assert.Equal(t, 100, page.Count)
+	assert.Nil(t, page.Next)
+	require.Equal(t, 25, len(page.Results))
+	assert.Equal(t, 1, page.Results[0]["id"])
+	assert.Equal(t, 25, page.Results[24]["id"])
+	assert.Equal(t, []string{"1", "2", "3"}, pagesServed)
+
+	// Fewer records than the limit, so we stop when pages run out
+	pagesServed = make([]string, 0)
+	values = url.Values{}
+	values.Set("per_page", "10")
+	data, err = cmd.FetchListPages(context.Background(), values, 50, 1, fakeListFetcher(12, &pagesServed))
+	require.Nil(t, err)
+	page = &limitTestPage{}
+	require.Nil(t, json.Unmarshal(data, page))
+	assert.Equal(t, 12, len(page.Results))
+	assert.Equal(t, []string{"1", "2"}, pagesServed)
+
+	// Start at the user's page
+	pagesServed = make([]string, 0)
+	values = url.Values{}
+	values.Set("per_page", "10")
+	values.Set("page", "3")
+	data, err = cmd.FetchListPages(context.Background(), values, 5, 1, fakeListFetcher(100, &pagesServed))
+	require.Nil(t, err)
+	page = &limitTestPage{}
+	require.Nil(t, json.Unmarshal(data, page))
+	require.Equal(t, 5, len(page.Results))
+	assert.Equal(t, 21, page.Results[0]["id"])
+	assert.Equal(t, []string{"3"}, pagesServed)
+
+	// Pages after the first are fetched concurrency at a time, and only
+	// the pages needed to reach the limit.
+	pagesServed = make([]string, 0)
+	values = url.Values{}
+	values.Set("per_page", "10")
+	data, err = cmd.FetchListPages(context.Background(), values, 45, 4, fakeListFetcher(100, &pagesServed))
+	require.Nil(t, err)
+	page = &limitTestPage{}
+	require.Nil(t, json.Unmarshal(data, page))
+	require.Equal(t, 45, len(page.Results))
+	for i, result := range page.Results {
+		assert.Equal(t, i+1, result["id"])
+	}
+	sort.Strings(pagesServed)
+	assert.Equal(t, []string{"1", "2", "3", "4", "5"}, pagesServed)
+
+	// Concurrent fetches stop at the last page.
+	pagesServed = make([]string, 0)
+	data, err = cmd.FetchListPages(context.Background(), values, 100, 8, fakeListFetcher(23, &pagesServed))
+	require.Nil(t, err)
+	page = &limitTestPage{}
+	require.Nil(t, json.Unmarshal(data, page))
+	require.Equal(t, 23, len(page.Results))
+	assert.Equal(t, 23, page.Results[22]["id"])
+	sort.Strings(pagesServed)
+	assert.Equal(t, []string{"1", "2", "3"}, pagesServed)
+
+	values.Set("page", "zero")
+	_, err = cmd.FetchListPages(context.Background(), values, 5, 1, fakeListFetcher(100, &pagesServed))
+	assert.NotNil(t, err)
+}
+
+func TestFetchAllPages(t *testing.T) {
+	pagesServed := make([]string, 0)
+	fetch := fakeListFetcher(25, &pagesServed)
+	values := url.Values{}
+	values.Set("page", "1")
+	values.Set("per_page", "10")
+	ids := make([]int64, 0)
+	err := cmd.FetchAllPages(context.Background(), values, func(values url.Values) *network.RegistryResponse {
+		resp := fetch(values)
+		resp.UnmarshalJSONList()
+		return resp
+	}, func(resp *network.RegistryResponse) {
+		for _, gf := range resp.GenericFiles() {
+			ids = append(ids, gf.ID)
+		}
+	})
+	require.Nil(t, err)
+	assert.Equal(t, []string{"1", "2", "3"}, pagesServed)
+	require.Len(t, ids, 25)
+	assert.Equal(t, int64(25), ids[24])
+
+	// Errors stop paging.
+	err = cmd.FetchAllPages(context.Background(), values, func(values url.Values) *network.RegistryResponse {
+		resp := network.NewRegistryResponse(network.RegistryGenericFile)
+		resp.Error = fmt.Errorf("registry is down")
+		return resp
+	}, func(resp *network.RegistryResponse) {
+		assert.Fail(t, "collect should not be called after an error")
+	})
+	assert.EqualError(t, err, "registry is down")
+}
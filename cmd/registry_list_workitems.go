@@ -6,13 +6,15 @@ import (
 	"os"
 	"time"
 
+	"github.com/APTrust/preservation-services/models/registry"
 	"github.com/spf13/cobra"
 )
 
 // workitemsCmd represents the workitems command
 var workitemsCmd = &cobra.Command{
-	Use:   "workitems",
-	Short: "List work item records from the APTrust registry.",
+	Use:     "workitems",
+	Short:   "List work item records from the APTrust registry.",
+	Example: `apt-cmd registry list workitems action=Ingest sort=date_processed__desc`,
 	Long: `List work items from the APTrust registry, or run a report.
 
 Examples:
@@ -29,6 +31,10 @@ List failed work items:
 
   apt-cmd registry list workitems status='Failed' sort='date_processed__desc'
 
+List work items by status, then most recently processed:
+
+  apt-cmd registry list workitems --sort='status,date_processed__desc'
+
 List work items pertaining to a tar file you uploaded:
 
   apt-cmd registry list workitems name='bag-of-photos.tar'
@@ -62,6 +68,30 @@ List all restorations from the past 30 days:
 
 When running quick reports, this tool ignores all other query params.
 
+
+Watching:
+
+Add --watch to re-run the query every 30 seconds, or every --interval,
+and print only the work items that are new or have changed since the
+last poll. The first poll prints every item the query returns. Press
+Ctrl-C to stop.
+
+  apt-cmd registry list workitems action='Ingest' --watch --interval=10s
+  apt-cmd registry list workitems --report=inprocess --watch
+
+A work item has changed if its updated_at has changed. Each poll checks
+one page of results, sorted by updated_at__desc unless you specify a
+sort order, so raise per_page if many items change between polls.
+
+On a terminal, each poll that finds changes clears the screen and shows
+them as formatted JSON. When output goes to a file or another program,
+each new or changed item is appended as one line of JSON:
+
+  apt-cmd registry list workitems --watch | grep '"status":"Failed"'
+
+Registry errors during a watch are printed to stderr, and the next poll
+tries again. --watch can't be combined with --limit.
+
 Full online documentation:
 
   https://aptrust.github.io/userguide/partner_tools/
@@ -69,7 +99,6 @@ Full online documentation:
 	`,
 	Run: func(cmd *cobra.Command, args []string) {
 		client, urlValues := InitRegistryRequest(config, args)
-		EnsureDefaultListParams(urlValues)
 
 		report := cmd.Flags().Lookup("report").Value.String()
 		if report != "" {
@@ -77,21 +106,49 @@ Full online documentation:
 			logger.Debugf("Running WorkItem report %s", report)
 			urlValues, err = valuesForWorkItemReport(report)
 			if err != nil {
-				fmt.Fprintln(os.Stderr, err.Error())
-				os.Exit(EXIT_USER_ERR)
+				Fail(EXIT_USER_ERR, err.Error())
+			}
+			ApplySortParams(cmd, urlValues, registry.WorkItem{})
+		} else {
+			ApplyQueryParams(cmd, "workitems", urlValues, registry.WorkItem{})
+			EnsureDefaultListParams(urlValues)
+		}
+
+		watch, _ := cmd.Flags().GetBool("watch")
+		if watch {
+			interval, _ := cmd.Flags().GetDuration("interval")
+			limit, _ := cmd.Flags().GetInt("limit")
+			if interval < MinWatchInterval {
+				Failf(EXIT_USER_ERR, "--interval must be at least %s", MinWatchInterval)
+			}
+			if limit != 0 {
+				Fail(EXIT_USER_ERR, "--watch can't be used with --limit. Use per_page to set how many items each poll checks.")
+			}
+			if resultFile != "" {
+				Fail(EXIT_USER_ERR, "--watch can't be used with --output, since it never finishes writing results.")
+			}
+			// Recently changed items first, so changes show up
+			// on the page we poll.
+			if len(urlValues["sort"]) == 0 {
+				urlValues.Set("sort", "updated_at__desc")
 			}
+			logger.Debugf("Watching work items every %s: %s", interval, urlValues.Encode())
+			watcher := NewWorkItemWatcher(os.Stdout, os.Stderr, interval, IsTerminal(os.Stdout))
+			watcher.Watch(cmd.Context(), urlValues, client.WorkItemList)
+			os.Exit(EXIT_OK)
 		}
 
-		resp := client.WorkItemList(urlValues)
-		data, _ := resp.RawResponseData()
-		PrettyPrintJSON(data)
-		os.Exit(EXIT_OK)
+		RunListRequest(cmd, "workitems", urlValues, registry.WorkItem{}, client.WorkItemList)
 	},
 }
 
 func init() {
 	listCmd.AddCommand(workitemsCmd)
 	workitemsCmd.Flags().StringP("report", "r", "", "Run report: inprocess, problems, restorations")
+	workitemsCmd.Flags().Bool("watch", false, "Re-run the query every --interval and print only new or changed work items")
+	workitemsCmd.Flags().Duration("interval", 30*time.Second, "How often --watch re-runs the query, e.g. 10s or 5m")
+	workitemsCmd.ValidArgsFunction = completeListParams("workitems", registry.WorkItem{})
+	registerFlagCompletion(workitemsCmd, "report", completeValues("inprocess", "problems", "restorations"))
 }
 
 func valuesForWorkItemReport(report string) (url.Values, error) {
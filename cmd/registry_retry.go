@@ -0,0 +1,139 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/APTrust/preservation-services/network"
+	"github.com/op/go-logging"
+)
+
+// Defaults for the registry command's --timeout, --retries and
+// --retry-backoff flags.
+const (
+	DefaultRegistryTimeout      = 60 * time.Second
+	DefaultRegistryRetries      = 3
+	DefaultRegistryRetryBackoff = time.Second
+)
+
+var registryTimeout time.Duration
+var registryRetries int
+var registryRetryBackoff time.Duration
+var registryRetryWrites bool
+
+// RegistryRequestPolicy says how long to wait for a registry request,
+// and how many times to retry it if it fails with a connection error,
+// a timeout or a 5xx response. The wait before each retry is Backoff,
+// doubled after each attempt. A zero Timeout means wait as long as it
+// takes.
+type RegistryRequestPolicy struct {
+	Timeout time.Duration
+	Retries int
+	Backoff time.Duration
+	Logger  *logging.Logger
+}
+
+// registryRequestPolicy returns the policy from the registry command's
+// flags. Requests that change data, such as saving a work item, aren't
+// retried unless the user asked for --retry-writes, since a request
+// that timed out may have succeeded anyway.
+func registryRequestPolicy(isWrite bool) RegistryRequestPolicy {
+	policy := RegistryRequestPolicy{
+		Timeout: registryTimeout,
+		Retries: registryRetries,
+		Backoff: registryRetryBackoff,
+		Logger:  logger,
+	}
+	if isWrite && !registryRetryWrites {
+		policy.Retries = 0
+	}
+	return policy
+}
+
+// Do runs a registry client request, retrying it according to the
+// policy, and returns the last response. This exits with EXIT_CANCELED
+// if ctx is canceled, even while waiting to retry.
+func (policy RegistryRequestPolicy) Do(ctx context.Context, request func() *network.RegistryResponse) *network.RegistryResponse {
+	resp, err := policy.Run(ctx, request)
+	if err != nil {
+		ExitIfCanceled(ctx)
+	}
+	return resp
+}
+
+// Run is like Do, for callers that can't exit, such as RegistryClient.
+// If ctx is canceled, it stops waiting on the request, or to retry it,
+// and returns ctx.Err().
+func (policy RegistryRequestPolicy) Run(ctx context.Context, request func() *network.RegistryResponse) (*network.RegistryResponse, error) {
+	if policy.Logger == nil {
+		policy.Logger = logging.MustGetLogger("aptrust")
+	}
+	for attempt := 0; ; attempt++ {
+		resp, err := policy.try(ctx, request)
+		if err != nil {
+			return nil, err
+		}
+		if attempt >= policy.Retries || !IsRetryableRegistryError(resp) {
+			return resp, nil
+		}
+		wait := policy.Backoff << attempt
+		policy.Logger.Debugf("Registry request failed: %s. Retry %d of %d in %s.", resp.Error, attempt+1, policy.Retries, wait)
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+}
+
+// try runs request once. If it takes longer than the policy's timeout,
+// this returns a response whose error says so, and if ctx is canceled,
+// it returns ctx.Err(). The request's goroutine sends to a buffered
+// channel, so it can finish and exit after we've stopped waiting on it.
+func (policy RegistryRequestPolicy) try(ctx context.Context, request func() *network.RegistryResponse) (*network.RegistryResponse, error) {
+	requestCtx := ctx
+	if policy.Timeout > 0 {
+		var cancel context.CancelFunc
+		requestCtx, cancel = context.WithTimeout(ctx, policy.Timeout)
+		defer cancel()
+	}
+	responses := make(chan *network.RegistryResponse, 1)
+	if RunCancelable(requestCtx, func() { responses <- request() }) != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return &network.RegistryResponse{Error: &RegistryTimeoutError{Timeout: policy.Timeout}}, nil
+	}
+	return <-responses, nil
+}
+
+// RegistryTimeoutError means a registry request took longer than the
+// --timeout.
+type RegistryTimeoutError struct {
+	Timeout time.Duration
+}
+
+func (err *RegistryTimeoutError) Error() string {
+	return fmt.Sprintf("registry request timed out after %s", err.Timeout)
+}
+
+// IsRetryableRegistryError returns true if resp failed in a way that
+// might succeed if we try again: a timeout, a connection error, or a
+// 5xx response from the registry. Other errors, like 404s and requests
+// we couldn't build, will fail the same way every time.
+func IsRetryableRegistryError(resp *network.RegistryResponse) bool {
+	if resp == nil || resp.Error == nil {
+		return false
+	}
+	if _, ok := resp.Error.(*RegistryTimeoutError); ok {
+		return true
+	}
+	if resp.Response != nil {
+		return resp.Response.StatusCode >= http.StatusInternalServerError
+	}
+	// The client sets Request once it's built the request. No
+	// Response means we couldn't connect, or lost the connection.
+	return resp.Request != nil
+}
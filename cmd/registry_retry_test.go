@@ -0,0 +1,89 @@
+package cmd_test
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/APTrust/apt-cmd/cmd"
+	"github.com/APTrust/preservation-services/network"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeStatusResponse returns a response with the given status, as if
+// the registry client had sent a request and read the reply.
+func fakeStatusResponse(status int) *network.RegistryResponse {
+	resp := network.NewRegistryResponse(network.RegistryWorkItem)
+	resp.Request, _ = http.NewRequest("GET", "http://localhost/member-api/v3/items/show/1", nil)
+	resp.Response = &http.Response{
+		StatusCode: status,
+		Body:       io.NopCloser(strings.NewReader(`{"id": 1}`)),
+	}
+	if status >= 400 {
+		resp.Error = fmt.Errorf("Server returned status code %d", status)
+	}
+	return resp
+}
+
+func TestIsRetryableRegistryError(t *testing.T) {
+	assert.False(t, cmd.IsRetryableRegistryError(fakeStatusResponse(http.StatusOK)))
+	assert.False(t, cmd.IsRetryableRegistryError(fakeStatusResponse(http.StatusNotFound)))
+	assert.True(t, cmd.IsRetryableRegistryError(fakeStatusResponse(http.StatusServiceUnavailable)))
+	assert.True(t, cmd.IsRetryableRegistryError(fakeStatusResponse(http.StatusInternalServerError)))
+	assert.True(t, cmd.IsRetryableRegistryError(&network.RegistryResponse{Error: &cmd.RegistryTimeoutError{Timeout: time.Second}}))
+
+	// Connection refused: request sent, no response.
+	resp := fakeStatusResponse(http.StatusOK)
+	resp.Response = nil
+	resp.Error = fmt.Errorf("connection refused")
+	assert.True(t, cmd.IsRetryableRegistryError(resp))
+
+	// Couldn't build the request, so there's no point retrying.
+	assert.False(t, cmd.IsRetryableRegistryError(&network.RegistryResponse{Error: fmt.Errorf("bad url")}))
+}
+
+func TestRegistryRequestPolicy(t *testing.T) {
+	policy := cmd.RegistryRequestPolicy{Retries: 3, Backoff: time.Millisecond}
+
+	// Succeeds on the third attempt
+	statuses := []int{http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusOK}
+	attempts := 0
+	resp := policy.Do(context.Background(), func() *network.RegistryResponse {
+		attempts++
+		return fakeStatusResponse(statuses[attempts-1])
+	})
+	require.Nil(t, resp.Error)
+	assert.Equal(t, 3, attempts)
+
+	// Gives up after the last retry
+	attempts = 0
+	resp = policy.Do(context.Background(), func() *network.RegistryResponse {
+		attempts++
+		return fakeStatusResponse(http.StatusServiceUnavailable)
+	})
+	assert.NotNil(t, resp.Error)
+	assert.Equal(t, 4, attempts)
+
+	// Doesn't retry errors that won't go away
+	attempts = 0
+	resp = policy.Do(context.Background(), func() *network.RegistryResponse {
+		attempts++
+		return fakeStatusResponse(http.StatusNotFound)
+	})
+	assert.NotNil(t, resp.Error)
+	assert.Equal(t, 1, attempts)
+
+	// Times out slow requests
+	policy = cmd.RegistryRequestPolicy{Timeout: 20 * time.Millisecond}
+	resp = policy.Do(context.Background(), func() *network.RegistryResponse {
+		time.Sleep(time.Second)
+		return fakeStatusResponse(http.StatusOK)
+	})
+	require.NotNil(t, resp.Error)
+	assert.Equal(t, "registry request timed out after 20ms", resp.Error.Error())
+}
@@ -0,0 +1,125 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"reflect"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/APTrust/dart-runner/util"
+)
+
+// DefaultTableColumns are the columns registry list --format=table
+// shows for each kind of record, unless the user specifies --columns.
+var DefaultTableColumns = map[string][]string{
+	"files":     {"id", "identifier", "size", "state"},
+	"objects":   {"id", "identifier", "size", "state"},
+	"workitems": {"id", "name", "action", "stage", "status"},
+}
+
+// ModelFields returns the JSON names of all of the fields of a registry
+// model, such as registry.GenericFile{}.
+func ModelFields(model interface{}) []string {
+	modelType := reflect.TypeOf(model)
+	fields := make([]string, 0, modelType.NumField())
+	for i := 0; i < modelType.NumField(); i++ {
+		name := strings.Split(modelType.Field(i).Tag.Get("json"), ",")[0]
+		if name != "" && name != "-" {
+			fields = append(fields, name)
+		}
+	}
+	sort.Strings(fields)
+	return fields
+}
+
+// TableColumns returns the columns to show for registry list listName,
+// which are the comma-separated columns in columnsFlag, or the default
+// columns if that's empty. It returns an error if any column isn't a
+// field of model.
+func TableColumns(columnsFlag, listName string, model interface{}) ([]string, error) {
+	columns := make([]string, 0)
+	for _, column := range strings.Split(columnsFlag, ",") {
+		if column = strings.TrimSpace(column); column != "" {
+			columns = append(columns, column)
+		}
+	}
+	if len(columns) == 0 {
+		return DefaultTableColumns[listName], nil
+	}
+	fields := ModelFields(model)
+	invalid := make([]string, 0)
+	for _, column := range columns {
+		if !util.StringListContains(fields, column) {
+			invalid = append(invalid, column)
+		}
+	}
+	if len(invalid) > 0 {
+		return nil, fmt.Errorf("invalid column(s) for %s: %s. Valid columns are: %s", listName, strings.Join(invalid, ", "), strings.Join(fields, ", "))
+	}
+	return columns, nil
+}
+
+// FormatTable renders a page of registry list results as a text table
+// with the specified columns, aligned for reading on a terminal. The
+// footer says how many of the matching records the page shows, and
+// which page comes next, if any. It returns an error if data isn't a
+// page of results.
+func FormatTable(data []byte, columns []string) (string, error) {
+	page := &listPage{}
+	if err := json.Unmarshal(data, page); err != nil {
+		return "", fmt.Errorf("can't parse results: %w", err)
+	}
+	if page.Results == nil {
+		return "", fmt.Errorf("response has no results")
+	}
+	var out bytes.Buffer
+	writer := tabwriter.NewWriter(&out, 0, 0, 2, ' ', 0)
+	headers := make([]string, len(columns))
+	for i, column := range columns {
+		headers[i] = strings.ToUpper(column)
+	}
+	fmt.Fprintln(writer, strings.Join(headers, "\t"))
+	for _, result := range page.Results {
+		record := make(map[string]json.RawMessage)
+		if err := json.Unmarshal(result, &record); err != nil {
+			return "", fmt.Errorf("can't parse result: %w", err)
+		}
+		cells := make([]string, len(columns))
+		for i, column := range columns {
+			cells[i] = tableCell(record[column])
+		}
+		fmt.Fprintln(writer, strings.Join(cells, "\t"))
+	}
+	writer.Flush()
+	footer := fmt.Sprintf("Showing %d of %d", len(page.Results), page.Count)
+	if page.Next != nil {
+		if next, err := url.Parse(*page.Next); err == nil && next.Query().Get("page") != "" {
+			footer += fmt.Sprintf(". For more, add page=%s", next.Query().Get("page"))
+		}
+	}
+	fmt.Fprintln(&out, footer+".")
+	return out.String(), nil
+}
+
+// tableCell returns a JSON value as it should appear in a table:
+// strings without quotes, nulls as blanks, and everything else as
+// compact JSON.
+func tableCell(value json.RawMessage) string {
+	if len(value) == 0 || string(value) == "null" {
+		return ""
+	}
+	var s string
+	if err := json.Unmarshal(value, &s); err == nil {
+		// Keep the columns lined up.
+		return strings.NewReplacer("\t", " ", "\n", " ", "\r", " ").Replace(s)
+	}
+	var compact bytes.Buffer
+	if err := json.Compact(&compact, value); err != nil {
+		return string(value)
+	}
+	return compact.String()
+}
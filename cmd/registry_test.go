@@ -4,12 +4,14 @@ package cmd_test
 
 import (
 	"encoding/json"
+	"fmt"
 	"testing"
 
 	"github.com/APTrust/apt-cmd/cmd"
 	"github.com/APTrust/preservation-services/models/registry"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v3"
 )
 
 // Note: To run integration tests, run `scripts/test.rb integration`.
@@ -64,6 +66,31 @@ func TestRegistryFileGet(t *testing.T) {
 	assert.Equal(t, 4, len(gf.PremisEvents))
 }
 
+func TestRegistryFileGetYAML(t *testing.T) {
+	exitCode, stdout, stderr := execCmd(t, "go", "run", "../main.go", "registry", "get", "file", "id=1", "--format=yaml", "--config=../testconfig.env")
+	assert.Equal(t, cmd.EXIT_OK, exitCode)
+	assert.Equal(t, "", stderr)
+
+	gf := make(map[string]interface{})
+	err := yaml.Unmarshal([]byte(stdout), &gf)
+	require.Nil(t, err)
+	assert.Equal(t, 1, gf["id"])
+	assert.Equal(t, "institution1.edu/photos/picture1", gf["identifier"])
+	assert.Equal(t, 2, len(gf["checksums"].([]interface{})))
+}
+
+func TestRegistryFileListYAML(t *testing.T) {
+	exitCode, stdout, stderr := execCmd(t, "go", "run", "../main.go", "registry", "list", "files", "intellectual_object_id=3", "--format=yaml", "--config=../testconfig.env")
+	assert.Equal(t, cmd.EXIT_OK, exitCode)
+	assert.Equal(t, "", stderr)
+
+	list := make(map[string]interface{})
+	err := yaml.Unmarshal([]byte(stdout), &list)
+	require.Nil(t, err)
+	assert.Equal(t, 5, list["count"])
+	assert.Equal(t, 5, len(list["results"].([]interface{})))
+}
+
 func TestRegistryFileList(t *testing.T) {
 	exitCode, stdout, stderr := execCmd(t, "go", "run", "../main.go", "registry", "list", "files", "intellectual_object_id=3", "--config=../testconfig.env")
 	assert.Equal(t, cmd.EXIT_OK, exitCode)
@@ -172,3 +199,17 @@ func TestRegistryWorkItemList(t *testing.T) {
 	assert.Equal(t, int64(22), items[0].ID)
 	assert.Equal(t, int64(23), items[1].ID)
 }
+
+func TestRegistryCount(t *testing.T) {
+	// Count should match the list's count for the same filters.
+	exitCode, stdout, stderr := execCmd(t, "go", "run", "../main.go", "registry", "list", "workitems", "action=Ingest", "stage=Receive", "--config=../testconfig.env")
+	assert.Equal(t, cmd.EXIT_OK, exitCode)
+	assert.Equal(t, "", stderr)
+	resp := &WorkItemsResponse{}
+	require.Nil(t, json.Unmarshal([]byte(stdout), resp))
+
+	exitCode, stdout, stderr = execCmd(t, "go", "run", "../main.go", "registry", "count", "workitems", "action=Ingest", "stage=Receive", "--config=../testconfig.env")
+	assert.Equal(t, cmd.EXIT_OK, exitCode)
+	assert.Equal(t, "", stderr)
+	assert.Equal(t, fmt.Sprintf("%d\n", resp.Count), stdout)
+}
@@ -0,0 +1,29 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/spf13/cobra"
+)
+
+// registryUpdateCmd represents the registry update command
+var registryUpdateCmd = &cobra.Command{
+	Use:   "update",
+	Short: "Update a work item in the APTrust Registry",
+	Long: `Update a record in the APTrust Registry. For more info, run:
+
+    apt-cmd registry update workitem --help
+
+Full online documentation:
+
+https://aptrust.github.io/userguide/partner_tools/
+
+`,
+	Run: func(cmd *cobra.Command, args []string) {
+		fmt.Println("Update records in the APTrust registry. See subcommands for more info.")
+	},
+}
+
+func init() {
+	registryCmd.AddCommand(registryUpdateCmd)
+}
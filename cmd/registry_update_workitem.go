@@ -0,0 +1,70 @@
+package cmd
+
+import (
+	"os"
+	"strconv"
+
+	"github.com/APTrust/preservation-services/network"
+	"github.com/spf13/cobra"
+)
+
+// updateWorkitemCmd represents the update workitem command
+var updateWorkitemCmd = &cobra.Command{
+	Use:     "workitem",
+	Short:   "Updates a WorkItem record in the APTrust Registry",
+	Example: `apt-cmd registry update workitem id=1234 retry=true note="Requeued after fixing bucket permissions"`,
+	Long: `Update a WorkItem record in the APTrust Registry, and print the
+record the registry saved. Id is a number, and is required.
+
+This gets the current WorkItem, changes only the fields you specify,
+and then saves it. Set fields with field=value pairs, or with --data,
+as with apt-cmd registry create workitem.
+
+apt-cmd registry update workitem id=1234 stage=Receive status=Pending retry=true
+apt-cmd registry update workitem id=1234 --data='{"note": "Checked by hand"}'
+
+If the registry rejects the request, apt-cmd prints the registry's
+response and exits with status 4.
+
+Full online documentation:
+
+https://aptrust.github.io/userguide/partner_tools/
+
+`,
+	Run: func(cmd *cobra.Command, args []string) {
+		dataFlag, _ := cmd.Flags().GetString("data")
+		data, err := ReadDataFlag(dataFlag)
+		if err != nil {
+			Fail(EXIT_USER_ERR, err.Error())
+		}
+		client, urlValues := InitRegistryRequest(config, args)
+		id, _ := strconv.ParseInt(urlValues.Get("id"), 10, 64)
+		if id < 1 {
+			Fail(EXIT_USER_ERR, "This call requires an id (e.g. id=1234)")
+		}
+		urlValues.Del("id")
+		if len(data) == 0 && len(urlValues) == 0 {
+			Fail(EXIT_USER_ERR, "Specify the fields to change, as field=value pairs or with --data")
+		}
+		item, err := client.GetWorkItem(cmd.Context(), id)
+		if err != nil {
+			ExitIfCanceled(cmd.Context())
+			Fail(EXIT_REQUEST_ERROR, "Can't get work item:", err.Error())
+		}
+		err = ApplyModelFields(item, data, urlValues)
+		if err != nil {
+			Fail(EXIT_USER_ERR, err.Error())
+		}
+		if item.ID != id {
+			Fail(EXIT_USER_ERR, "You can't change a work item's id")
+		}
+		resp := DoRegistryWrite(cmd.Context(), func() *network.RegistryResponse { return client.WorkItemSave(item) })
+		PrintSaveResponse(resp)
+		os.Exit(EXIT_OK)
+	},
+}
+
+func init() {
+	registryUpdateCmd.AddCommand(updateWorkitemCmd)
+	updateWorkitemCmd.Flags().String("data", "", "JSON object of fields to change, or @file to read it from a file")
+}
@@ -0,0 +1,103 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"time"
+
+	"github.com/APTrust/preservation-services/models/registry"
+	"github.com/APTrust/preservation-services/network"
+)
+
+// MinWatchInterval is the shortest --interval we allow, so a forgotten
+// watch doesn't hammer the registry.
+const MinWatchInterval = time.Second
+
+// WorkItemWatcher re-runs a work item query and writes the items that
+// are new or have changed since the previous poll. It compares items
+// by ID and UpdatedAt, since the registry bumps UpdatedAt whenever a
+// work item changes stage, status or note.
+//
+// If Clear is true, which makes sense only on a terminal, each poll
+// that finds changes clears the screen and writes those changes as
+// formatted JSON under a timestamp. Otherwise, each item is appended to
+// Out as a single line of JSON, which suits tail, grep and files.
+type WorkItemWatcher struct {
+	Out      io.Writer
+	ErrOut   io.Writer
+	Interval time.Duration
+	Clear    bool
+	seen     map[int64]time.Time
+}
+
+// NewWorkItemWatcher returns a watcher that hasn't seen any items.
+func NewWorkItemWatcher(out, errOut io.Writer, interval time.Duration, clear bool) *WorkItemWatcher {
+	return &WorkItemWatcher{
+		Out:      out,
+		ErrOut:   errOut,
+		Interval: interval,
+		Clear:    clear,
+		seen:     make(map[int64]time.Time),
+	}
+}
+
+// Changes returns the items that are new or have changed since the
+// last call to Changes, in the order given, and remembers them for
+// next time. On the first call, every item is new.
+func (w *WorkItemWatcher) Changes(items []*registry.WorkItem) []*registry.WorkItem {
+	changed := make([]*registry.WorkItem, 0)
+	for _, item := range items {
+		updatedAt, ok := w.seen[item.ID]
+		if ok && updatedAt.Equal(item.UpdatedAt) {
+			continue
+		}
+		w.seen[item.ID] = item.UpdatedAt
+		changed = append(changed, item)
+	}
+	return changed
+}
+
+// Poll runs the query once and writes any new or changed items.
+// Registry errors are written to ErrOut, since they shouldn't stop a
+// watch. We'll try again at the next poll.
+func (w *WorkItemWatcher) Poll(ctx context.Context, values url.Values, fetch func(url.Values) *network.RegistryResponse) {
+	resp := DoRegistryRequest(ctx, func() *network.RegistryResponse { return fetch(values) })
+	if resp.Error != nil {
+		fmt.Fprintf(w.ErrOut, "%s Error fetching work items: %s\n", time.Now().Format(time.RFC3339), resp.Error)
+		return
+	}
+	changed := w.Changes(resp.WorkItems())
+	if len(changed) == 0 {
+		return
+	}
+	if w.Clear {
+		// Clear the screen and move the cursor to the top left.
+		fmt.Fprint(w.Out, "\033[H\033[2J")
+		fmt.Fprintf(w.Out, "%d new or changed work item(s) at %s. Checking every %s. Press Ctrl-C to stop.\n\n", len(changed), time.Now().Format(time.RFC3339), w.Interval)
+	}
+	for _, item := range changed {
+		var data []byte
+		if w.Clear {
+			data, _ = json.MarshalIndent(item, "", "  ")
+		} else {
+			data, _ = json.Marshal(item)
+		}
+		fmt.Fprintln(w.Out, string(data))
+	}
+}
+
+// Watch polls every Interval until ctx is canceled. The first poll
+// writes every item the query returns.
+func (w *WorkItemWatcher) Watch(ctx context.Context, values url.Values, fetch func(url.Values) *network.RegistryResponse) {
+	for {
+		w.Poll(ctx, values, fetch)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(w.Interval):
+		}
+	}
+}
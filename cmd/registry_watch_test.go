@@ -0,0 +1,102 @@
+package cmd_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/APTrust/apt-cmd/cmd"
+	"github.com/APTrust/preservation-services/models/registry"
+	"github.com/APTrust/preservation-services/network"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWorkItemWatcherChanges(t *testing.T) {
+	t1 := time.Date(2023, 4, 6, 12, 0, 0, 0, time.UTC)
+	t2 := t1.Add(time.Minute)
+	watcher := cmd.NewWorkItemWatcher(io.Discard, io.Discard, time.Second, false)
+
+	first := []*registry.WorkItem{{ID: 1, UpdatedAt: t1}, {ID: 2, UpdatedAt: t1}}
+	assert.Equal(t, first, watcher.Changes(first))
+	assert.Empty(t, watcher.Changes(first))
+
+	// Item 2 changed, item 3 is new, item 1 is the same.
+	second := []*registry.WorkItem{{ID: 3, UpdatedAt: t2}, {ID: 2, UpdatedAt: t2}, {ID: 1, UpdatedAt: t1}}
+	changed := watcher.Changes(second)
+	require.Len(t, changed, 2)
+	assert.Equal(t, int64(3), changed[0].ID)
+	assert.Equal(t, int64(2), changed[1].ID)
+	assert.Empty(t, watcher.Changes(second))
+}
+
+// fakeWorkItemFetcher returns a fetch function that serves items as
+// one page of work items, or an error if items is nil.
+func fakeWorkItemFetcher(items []*registry.WorkItem) func(url.Values) *network.RegistryResponse {
+	return func(values url.Values) *network.RegistryResponse {
+		resp := network.NewRegistryResponse(network.RegistryWorkItem)
+		if items == nil {
+			resp.Error = fmt.Errorf("registry is down")
+			return resp
+		}
+		body, _ := json.Marshal(map[string]interface{}{"count": len(items), "results": items})
+		resp.Response = &http.Response{
+			StatusCode: http.StatusOK,
+			Body:       io.NopCloser(strings.NewReader(string(body))),
+		}
+		resp.UnmarshalJSONList()
+		return resp
+	}
+}
+
+func TestWorkItemWatcherPoll(t *testing.T) {
+	t1 := time.Date(2023, 4, 6, 12, 0, 0, 0, time.UTC)
+	t2 := t1.Add(time.Minute)
+	first := []*registry.WorkItem{{ID: 1, Name: "one.tar", UpdatedAt: t1}, {ID: 2, Name: "two.tar", UpdatedAt: t1}}
+	second := []*registry.WorkItem{{ID: 1, Name: "one.tar", UpdatedAt: t1}, {ID: 2, Name: "two.tar", UpdatedAt: t2}}
+	ctx := context.Background()
+
+	// Registry errors don't stop the watch.
+	out, errOut := &bytes.Buffer{}, &bytes.Buffer{}
+	watcher := cmd.NewWorkItemWatcher(out, errOut, time.Second, false)
+	for _, items := range [][]*registry.WorkItem{first, nil, first, second} {
+		watcher.Poll(ctx, url.Values{}, fakeWorkItemFetcher(items))
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	require.Len(t, lines, 3)
+	assert.Contains(t, lines[0], `"name":"one.tar"`)
+	assert.Contains(t, lines[1], `"name":"two.tar"`)
+	assert.Contains(t, lines[2], `"name":"two.tar"`)
+	assert.Contains(t, lines[2], t2.Format(time.RFC3339))
+	assert.Contains(t, errOut.String(), "Error fetching work items: registry is down")
+
+	// Clear mode clears the screen for each poll that finds changes.
+	out, errOut = &bytes.Buffer{}, &bytes.Buffer{}
+	watcher = cmd.NewWorkItemWatcher(out, errOut, 30*time.Second, true)
+	for _, items := range [][]*registry.WorkItem{first, first, second} {
+		watcher.Poll(ctx, url.Values{}, fakeWorkItemFetcher(items))
+	}
+	assert.Equal(t, 2, strings.Count(out.String(), "\033[2J"))
+	assert.Contains(t, out.String(), "2 new or changed work item(s)")
+	assert.Contains(t, out.String(), "1 new or changed work item(s)")
+	assert.Contains(t, out.String(), "Checking every 30s")
+	assert.Contains(t, out.String(), `"name": "two.tar"`)
+	assert.Empty(t, errOut.String())
+}
+
+func TestRegistryListWorkItemsWatchErrors(t *testing.T) {
+	exitCode, _, stderr := execCmd(t, "go", "run", "../main.go", "registry", "list", "workitems", "--watch", "--interval=10ms", "--config=../testconfig.env")
+	assert.NotEqual(t, 0, exitCode)
+	assert.Contains(t, stderr, "--interval must be at least 1s")
+
+	exitCode, _, stderr = execCmd(t, "go", "run", "../main.go", "registry", "list", "workitems", "--watch", "--limit=10", "--config=../testconfig.env")
+	assert.NotEqual(t, 0, exitCode)
+	assert.Contains(t, stderr, "--watch can't be used with --limit")
+}
@@ -1,12 +1,15 @@
 package cmd
 
 import (
+	"context"
 	"fmt"
-	"io"
 	stdlog "log"
 	"os"
-	"path"
+	"os/signal"
+	"strings"
+	"syscall"
 
+	"github.com/APTrust/dart-runner/util"
 	"github.com/op/go-logging"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
@@ -19,22 +22,98 @@ var rootCmd = &cobra.Command{
 	Long: `APTrust partner tools.
 
     * Create and validate bags.
+    * Validate custom BagIt profiles.
     * Upload to and download from S3.
     * Report on WorkItems, objects and files in the registry.
+    * Check your settings.
+
+Without --config, apt-cmd reads its settings from the first of these
+files that exists, and otherwise from environment variables only:
+
+    ./.aptrust.env
+    $HOME/.aptrust/config.env
+    $XDG_CONFIG_HOME/aptrust/config.env (or $HOME/.config/aptrust/config.env)
+    $HOME/.aptrust
+
+Add --debug to see which file was loaded. Environment variables override
+settings in the file.
+
+Config files can be env files, with one NAME=value setting per line, or
+JSON, TOML or YAML files ending in .json, .toml, .yaml or .yml. Files
+with any other extension, or none, are read as env files. In JSON, TOML
+and YAML files, settings can use their APTRUST_ names or the shorter
+names below, so AWSKey and APTRUST_AWS_KEY are the same setting:
+
+    RegistryURL, RegistryAPIVersion, RegistryEmail, RegistryAPIKey,
+    AWSKey, AWSSecret, AWSSessionToken, AWSRegion, S3Port, S3Insecure,
+    S3PathStyle, DefaultManifestAlgs, DefaultTags (APTRUST_TAGS)
+
+Commands print errors on stderr. Add --json-errors to print them on
+stdout as JSON instead, with the same exit codes, so scripts can tell
+kinds of failures apart without parsing the messages:
+
+    { "result": "error", "errorType": "UserError", "exitCode": 3,
+      "errors": [ "Flag --bag-dir is required." ] }
+
+The errorType is RuntimeError (exit code 1), BagInvalid (2), UserError
+(3), RequestError (4) or Canceled (130).
+
+Ctrl-C (SIGINT) or SIGTERM stops the running command and exits with
+status 130. bag create removes the bag it was writing, and s3 download
+removes a partially downloaded file unless you used --resume.
+
+Warnings and errors always go to stderr. Add --debug to see debug and
+info messages too. Add --quiet to print only warnings and errors, with
+no info or debug logging and no download progress, even with --debug.
+--quiet never hides the results that commands print on stdout.
+
+Add --log-format=json to write log messages as JSON lines, for log
+aggregators, instead of as text. Each line has the message's "level",
+"time", "module" and "msg", and any other details as more keys:
+
+    {"level":"DEBUG","time":"2023-06-01T12:00:00Z","module":"aptrust",
+     "msg":"Creating bag","outputFile":"photos.tar","profile":"empty"}
+
+Log messages always go to stderr, never to stdout.
+
+Run apt-cmd completion --help to set up Tab completion in your shell.
 
 	Source: https://github.com/APTrust/apt-cmd
 	Docs: https://aptrust.github.io/userguide/partner_tools/
 
 `,
+	PersistentPreRun: func(cmd *cobra.Command, args []string) {
+		if printExample {
+			PrintExample(cmd)
+		}
+		if !util.StringListContains(SupportedSizeUnits, sizeUnits) {
+			Fail(EXIT_USER_ERR, "Flag --size-units must be one of:", strings.Join(SupportedSizeUnits, ", "))
+		}
+	},
 }
 
 var config *Config
 var debug bool
+var quiet bool
+var logFormat string
 var cfgFile string
 var logger *logging.Logger
+var printExample bool
+var concurrency int
+var sizeUnits string
 
+// Execute runs the root command. The command's context is canceled
+// on SIGINT or SIGTERM, so long-running operations can stop promptly.
 func Execute() {
-	err := rootCmd.Execute()
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	ExecuteContext(ctx)
+}
+
+// ExecuteContext runs the root command with the given context. Commands
+// stop hashing, validating and network transfers when ctx is canceled.
+func ExecuteContext(ctx context.Context) {
+	err := rootCmd.ExecuteContext(ctx)
 	if err != nil {
 		os.Exit(1)
 	}
@@ -43,59 +122,101 @@ func Execute() {
 func init() {
 	cobra.OnInitialize(initConfig)
 
-	rootCmd.PersistentFlags().StringVar(&cfgFile, "config", "", "config file (default is $HOME/.aptrust)")
+	rootCmd.PersistentFlags().StringVar(&cfgFile, "config", "", "config file (default is the first of ./.aptrust.env, $HOME/.aptrust/config.env, $XDG_CONFIG_HOME/aptrust/config.env and $HOME/.aptrust that exists)")
 	rootCmd.PersistentFlags().BoolVar(&debug, "debug", false, "print debug output to stderr")
+	rootCmd.PersistentFlags().BoolVar(&quiet, "quiet", false, "print only warnings and errors to stderr, even with --debug")
+	rootCmd.PersistentFlags().StringVar(&logFormat, "log-format", LogFormatText, "format of log messages: 'text' or 'json', for one JSON object per line")
+	rootCmd.PersistentFlags().BoolVar(&jsonErrors, "json-errors", false, "print errors on stdout as JSON, instead of on stderr as text")
+	rootCmd.PersistentFlags().IntVar(&concurrency, "concurrency", DefaultConcurrency, "maximum number of parallel operations for commands that work on multiple items")
+	rootCmd.PersistentFlags().StringVar(&sizeUnits, "size-units", SizeUnitsSI, "units for human-readable sizes: 'si' (1 kB = 1000 bytes) or 'iec' (1 KiB = 1024 bytes)")
+	rootCmd.PersistentFlags().BoolVar(&printExample, "print-example", false, "print a runnable example of this command and exit")
+	rootCmd.PersistentFlags().MarkHidden("print-example")
+	registerFlagCompletion(rootCmd, "log-format", completeValues(LogFormats...))
+	registerFlagCompletion(rootCmd, "size-units", completeValues(SupportedSizeUnits...))
 }
 
 func initConfig() {
 	initLogger()
 	useConfigFile := false
+	if cfgFile == "" {
+		cfgFile = FindConfigFile()
+	}
 	if cfgFile != "" {
 		viper.SetConfigFile(cfgFile)
+		SetConfigFileType(viper.GetViper(), cfgFile)
 		useConfigFile = true
-	} else {
-		home, err := os.UserHomeDir()
-		cobra.CheckErr(err)
-		if _, err := os.Stat(path.Join(home, ".aptrust")); !os.IsNotExist(err) {
-			viper.AddConfigPath(home)
-			viper.SetConfigType("env")
-			viper.SetConfigName(".aptrust")
-			useConfigFile = true
-		}
 	}
 	viper.AutomaticEnv()
 
 	if useConfigFile {
 		if err := viper.ReadInConfig(); err != nil {
-			fmt.Fprintln(os.Stderr, "Error reading config file:", err.Error())
-			os.Exit(EXIT_RUNTIME_ERR)
+			Fail(EXIT_RUNTIME_ERR, "Error reading config file:", err.Error())
+		}
+		if err := ApplyConfigFileKeys(viper.GetViper()); err != nil {
+			Fail(EXIT_RUNTIME_ERR, "Error reading config file:", err.Error())
 		}
 	}
 
 	configSource := "Environment Variables"
 	if useConfigFile {
 		configSource = viper.ConfigFileUsed()
+		logger.Debugf("Loaded config file %s", configSource)
+	} else {
+		logger.Debug("No config file found. Using environment variables.")
 	}
 	config = &Config{
-		RegistryEmail:      viper.GetString("APTRUST_REGISTRY_EMAIL"),
-		RegistryAPIKey:     viper.GetString("APTRUST_REGISTRY_API_KEY"),
-		RegistryURL:        viper.GetString("APTRUST_REGISTRY_URL"),
-		RegistryAPIVersion: viper.GetString("APTRUST_REGISTRY_API_VERSION"),
-		AWSKey:             viper.GetString("APTRUST_AWS_KEY"),
-		AWSSecret:          viper.GetString("APTRUST_AWS_SECRET"),
-		ConfigSource:       configSource,
+		RegistryEmail:       viper.GetString("APTRUST_REGISTRY_EMAIL"),
+		RegistryAPIKey:      viper.GetString("APTRUST_REGISTRY_API_KEY"),
+		RegistryURL:         viper.GetString("APTRUST_REGISTRY_URL"),
+		RegistryAPIVersion:  viper.GetString("APTRUST_REGISTRY_API_VERSION"),
+		AWSKey:              viper.GetString("APTRUST_AWS_KEY"),
+		AWSSecret:           viper.GetString("APTRUST_AWS_SECRET"),
+		AWSSessionToken:     viper.GetString("APTRUST_AWS_SESSION_TOKEN"),
+		AWSRegion:           viper.GetString("APTRUST_AWS_REGION"),
+		S3Port:              viper.GetInt("APTRUST_S3_PORT"),
+		S3Insecure:          viper.GetBool("APTRUST_S3_INSECURE"),
+		S3PathStyle:         viper.GetBool("APTRUST_S3_PATH_STYLE"),
+		DefaultManifestAlgs: viper.GetString("APTRUST_DEFAULT_MANIFEST_ALGS"),
+		DefaultTags:         ConfigTagSpecs(viper.Get("APTRUST_TAGS")),
+		ConfigSource:        configSource,
 	}
 	logger.Debug(config.String())
 }
 
+// initLogger sends warnings and errors to stderr. --debug adds debug
+// and info messages, unless --quiet drops them again. Messages are
+// text, or JSON lines with --log-format=json.
 func initLogger() {
-	outStream := io.Discard
-	if debug {
-		outStream = os.Stderr
-		fmt.Println("DEBUG = ", debug)
+	if !util.StringListContains(LogFormats, logFormat) {
+		Failf(EXIT_USER_ERR, "Invalid --log-format '%s'. Use text or json.", logFormat)
+	}
+	outStream := os.Stderr
+	level := logging.WARNING
+	prefix := ""
+	if debug && !quiet {
+		level = logging.DEBUG
+		prefix = "[debug] "
+		if logFormat == LogFormatText {
+			fmt.Println("DEBUG = ", debug)
+		}
 	}
 	logger = logging.MustGetLogger("aptrust")
-	logging.SetLevel(logging.DEBUG, "aptrust")
-	logBackend := logging.NewLogBackend(outStream, "[debug] ", stdlog.Lmsgprefix)
+	var logBackend logging.Backend = logging.NewLogBackend(outStream, prefix, stdlog.Lmsgprefix)
+	if logFormat == LogFormatJSON {
+		logBackend = NewJSONLogBackend(outStream)
+	}
 	logging.SetBackend(logBackend)
+	logging.SetLevel(level, "aptrust")
+}
+
+// PrintExample prints the example invocation for cmd and exits
+// with EXIT_NO_OP. The example is a single line with placeholder
+// values that users can copy and edit. Commands that have no
+// example print an error and exit with EXIT_USER_ERR.
+func PrintExample(cmd *cobra.Command) {
+	if cmd.Example == "" {
+		Fail(EXIT_USER_ERR, "No example available for", cmd.CommandPath())
+	}
+	fmt.Println(cmd.Example)
+	os.Exit(EXIT_NO_OP)
 }
@@ -0,0 +1,205 @@
+package cmd_test
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Each of these commands should print an example that is a valid
+// invocation of itself. Because we run the example back through the
+// command with --print-example, cobra will fail with an unknown flag
+// error if the example includes any flags the command doesn't support.
+var commandsWithExamples = [][]string{
+	{"bag", "create"},
+	{"bag", "validate"},
+	{"bag", "metadata"},
+	{"bag", "manifest"},
+	{"bag", "diff"},
+	{"profile", "validate"},
+	{"s3", "upload"},
+	{"s3", "download"},
+	{"s3", "list"},
+	{"s3", "delete"},
+	{"registry", "get", "file"},
+	{"registry", "get", "object"},
+	{"registry", "get", "workitem"},
+	{"registry", "list", "files"},
+	{"registry", "list", "objects"},
+	{"registry", "list", "workitems"},
+	{"registry", "count"},
+	{"registry", "download"},
+	{"version"},
+	{"capabilities"},
+}
+
+func TestPrintExample(t *testing.T) {
+	for _, command := range commandsWithExamples {
+		cmdName := strings.Join(command, " ")
+		args := append([]string{"run", "../main.go"}, command...)
+		args = append(args, "--print-example")
+		_, stdout, stderr := execCmd(t, "go", args...)
+		example := strings.TrimSpace(stdout)
+		require.True(t, strings.HasPrefix(example, "apt-cmd "+cmdName), cmdName)
+		assert.Equal(t, "exit status 100\n", stderr, cmdName)
+
+		// Now run the example itself, to be sure it parses.
+		args = append([]string{"run", "../main.go"}, strings.Fields(example)[1:]...)
+		args = append(args, "--print-example")
+		_, stdout, stderr = execCmd(t, "go", args...)
+		assert.Equal(t, example, strings.TrimSpace(stdout), cmdName)
+		assert.Equal(t, "exit status 100\n", stderr, cmdName)
+	}
+}
+
+func TestSizeUnitsFlag(t *testing.T) {
+	exitCode, _, stderr := execCmd(t, "go", "run", "../main.go", "version", "--size-units=metric")
+	assert.NotEqual(t, 0, exitCode)
+	assert.Contains(t, stderr, "Flag --size-units must be one of: si, iec")
+
+	exitCode, _, stderr = execCmd(t, "go", "run", "../main.go", "version", "--size-units=iec")
+	assert.Equal(t, 0, exitCode)
+	assert.Empty(t, stderr)
+}
+
+func TestQuietFlag(t *testing.T) {
+	pathToBag := "../testbags/aptrust/example.edu.sample_good.tar"
+	exitCode, stdout, stderr := execCmd(t, "go", "run", "../main.go", "bag", "validate", "--debug", "--profile=aptrust", pathToBag)
+	require.Equal(t, 0, exitCode)
+	assert.Contains(t, stdout, "DEBUG = ")
+	assert.Contains(t, stderr, "[debug] Validating bag")
+
+	// Debug logging is gone, but not the result.
+	exitCode, stdout, stderr = execCmd(t, "go", "run", "../main.go", "bag", "validate", "--debug", "--quiet", "--profile=aptrust", pathToBag)
+	require.Equal(t, 0, exitCode)
+	assert.Equal(t, "Bag is valid according to aptrust profile.\n", stdout)
+	assert.NotContains(t, stderr, "[debug]")
+}
+
+// Warnings go to stderr on a default run, without --debug or --quiet.
+func TestDefaultWarnings(t *testing.T) {
+	newBagDir := func(t *testing.T) string {
+		bagDir := path.Join(t.TempDir(), "files")
+		require.Nil(t, os.Mkdir(bagDir, 0755))
+		require.Nil(t, os.WriteFile(path.Join(bagDir, "file.txt"), []byte("data"), 0644))
+		return bagDir
+	}
+	bagCreate := func(t *testing.T, args ...string) string {
+		args = append([]string{"run", "../main.go", "bag", "create", "--profile=empty"}, args...)
+		exitCode, _, stderr := execCmd(t, "go", args...)
+		require.Equal(t, 0, exitCode, stderr)
+		return stderr
+	}
+
+	t.Run("replacing existing bag", func(t *testing.T) {
+		bagDir := newBagDir(t)
+		tmpFile := path.Join(t.TempDir(), "replace.tar")
+		bagCreate(t, "--output-file="+tmpFile, "--bag-dir="+bagDir)
+		stderr := bagCreate(t, "--output-file="+tmpFile, "--bag-dir="+bagDir)
+		assert.Contains(t, stderr, "Replacing existing bag "+tmpFile)
+	})
+
+	t.Run("skipping symlinks", func(t *testing.T) {
+		bagDir := newBagDir(t)
+		link := path.Join(bagDir, "link.txt")
+		require.Nil(t, os.Symlink(path.Join(bagDir, "file.txt"), link))
+		stderr := bagCreate(t, "--output-file="+path.Join(t.TempDir(), "links.tar"), "--bag-dir="+bagDir)
+		assert.Contains(t, stderr, "Skipping symbolic link "+link)
+	})
+
+	t.Run("skipping unreadable files", func(t *testing.T) {
+		bagDir := newBagDir(t)
+		badFile := path.Join(bagDir, "bad.txt")
+		require.Nil(t, os.Symlink(path.Join(bagDir, "does-not-exist"), badFile))
+		stderr := bagCreate(t, "--output-file="+path.Join(t.TempDir(), "unreadable.tar"), "--bag-dir="+bagDir, "--symlinks=follow", "--skip-unreadable")
+		assert.Contains(t, stderr, "Skipping unreadable file "+badFile)
+	})
+
+	t.Run("rehashing changed files", func(t *testing.T) {
+		bagDir := newBagDir(t)
+		bigFile := path.Join(bagDir, "big.bin")
+		require.Nil(t, os.WriteFile(bigFile, make([]byte, 64<<20), 0644))
+		tmpFile := path.Join(t.TempDir(), "rehash.tar")
+		// Touch the file once the bagger starts writing the bag.
+		done := make(chan struct{})
+		go func() {
+			for {
+				select {
+				case <-done:
+					return
+				case <-time.After(time.Millisecond):
+				}
+				if _, err := os.Stat(tmpFile); err == nil {
+					later := time.Now().Add(time.Hour)
+					os.Chtimes(bigFile, later, later)
+					return
+				}
+			}
+		}()
+		stderr := bagCreate(t, "--output-file="+tmpFile, "--bag-dir="+bagDir, "--rehash-changed")
+		close(done)
+		assert.Contains(t, stderr, "File "+bigFile+" changed while it was being bagged. Bagging it again.")
+	})
+
+	t.Run("split-by-dir loose files", func(t *testing.T) {
+		bagDir := newBagDir(t)
+		require.Nil(t, os.Mkdir(path.Join(bagDir, "box_01"), 0755))
+		require.Nil(t, os.WriteFile(path.Join(bagDir, "box_01", "contents.txt"), []byte("box"), 0644))
+		stderr := bagCreate(t, "--output-file="+t.TempDir(), "--bag-dir="+bagDir, "--split-by-dir")
+		assert.Contains(t, stderr, "Not bagging "+path.Join(bagDir, "file.txt")+" because --split-by-dir bags only directories.")
+	})
+
+	t.Run("max-bag-size overflow", func(t *testing.T) {
+		bagDir := path.Join(t.TempDir(), "photos")
+		require.Nil(t, os.Mkdir(bagDir, 0755))
+		for _, name := range []string{"01.jpg", "02.jpg", "03.jpg"} {
+			require.Nil(t, os.WriteFile(path.Join(bagDir, name), make([]byte, 2000), 0644))
+		}
+		stderr := bagCreate(t, "--output-file="+path.Join(t.TempDir(), "photos.tar"), "--bag-dir="+bagDir, "--max-bag-size=6KB")
+		assert.Contains(t, stderr, "which is more than --max-bag-size, because of its tag files and manifests.")
+	})
+
+	t.Run("download retries", func(t *testing.T) {
+		content := "0123456789"
+		gets := 0
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("ETag", `"etag"`)
+			w.Header().Set("Last-Modified", time.Now().UTC().Format(http.TimeFormat))
+			if r.Method == http.MethodGet {
+				gets++
+			}
+			if gets == 1 {
+				// Drop the connection partway through the first download.
+				w.Header().Set("Content-Length", fmt.Sprint(len(content)))
+				w.WriteHeader(http.StatusPartialContent)
+				fmt.Fprint(w, content[:4])
+				w.(http.Flusher).Flush()
+				conn, _, err := w.(http.Hijacker).Hijack()
+				require.Nil(t, err)
+				conn.Close()
+				return
+			}
+			http.ServeContent(w, r, "", time.Now(), strings.NewReader(content))
+		}))
+		defer server.Close()
+		configFile := path.Join(t.TempDir(), "s3.env")
+		require.Nil(t, os.WriteFile(configFile, []byte("APTRUST_AWS_KEY=key\nAPTRUST_AWS_SECRET=secret\nAPTRUST_AWS_REGION=us-east-1\nAPTRUST_S3_PATH_STYLE=true\n"), 0644))
+		saveAs := path.Join(t.TempDir(), "object.txt")
+		exitCode, _, stderr := execCmd(t, "go", "run", "../main.go", "s3", "download", "--config="+configFile,
+			"--host="+strings.TrimPrefix(server.URL, "http://"), "--bucket=bucket", "--key=object.txt", "--save-as="+saveAs, "--retry-backoff=1ms")
+		require.Equal(t, 0, exitCode, stderr)
+		assert.Contains(t, stderr, "Download of object.txt failed at byte 4")
+		assert.Contains(t, stderr, "Retry 1 of 3")
+		data, err := os.ReadFile(saveAs)
+		require.Nil(t, err)
+		assert.Equal(t, content, string(data))
+	})
+}
@@ -4,24 +4,52 @@ import (
 	"fmt"
 
 	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
 )
 
 // s3Cmd is the top-level command for s3 operations
 var s3Cmd = &cobra.Command{
 	Use:   "s3",
-	Short: "Upload, download, list and delete S3 objects",
-	Long: `Upload, download, list and delete S3 objects.
+	Short: "Upload, download, list, delete and presign S3 objects",
+	Long: `Upload, download, list, delete and presign S3 objects.
 For more info, run:
 
     apt-cmd s3 upload --help
     apt-cmd s3 download --help
     apt-cmd s3 list --help
     apt-cmd s3 delete --help
+    apt-cmd s3 presign --help
+
+To use MinIO or another S3-compatible service, you may need --port,
+--insecure to connect over plain HTTP instead of HTTPS, and --path-style
+to put the bucket name in the URL path instead of in the host name.
+For example:
+
+    apt-cmd s3 list --host=minio.example.edu --port=9000 --insecure \
+        --path-style --bucket=my-bucket
+
+You can also set these in your config file with APTRUST_S3_PORT,
+APTRUST_S3_INSECURE and APTRUST_S3_PATH_STYLE. The config settings also
+apply to bags uploaded with apt-cmd bag create --upload-to. Connections
+to localhost and 127.0.0.1 always use plain HTTP.
+
+Use --region, or APTRUST_AWS_REGION in your config file, to set the
+bucket's region, such as us-east-2. Without it, apt-cmd asks S3 where
+the bucket is, which some S3-compatible services don't support. If the
+region doesn't match the bucket's, S3 rejects requests with errors about
+signatures or authorization headers, rather than saying the region is
+wrong, so check the region first when you see those.
+
+If you use temporary credentials, such as those from AWS STS or an IAM
+role, set APTRUST_AWS_SESSION_TOKEN in your config file or environment
+along with APTRUST_AWS_KEY and APTRUST_AWS_SECRET, or pass the token
+with --session-token. Like the region and other settings above, the
+config setting applies to bag create --upload-to as well.
 
 Full online documentation:
 
   https://aptrust.github.io/userguide/partner_tools/
-	
+
 	`,
 	Run: func(cmd *cobra.Command, args []string) {
 		fmt.Println("Manage files in S3. See subcommands for more info.")
@@ -30,4 +58,15 @@ Full online documentation:
 
 func init() {
 	rootCmd.AddCommand(s3Cmd)
+	s3Cmd.PersistentFlags().Int("port", 0, "S3 port, if the service doesn't use the standard HTTP or HTTPS port")
+	s3Cmd.PersistentFlags().Bool("insecure", false, "connect over plain HTTP instead of HTTPS")
+	s3Cmd.PersistentFlags().Bool("path-style", false, "use path-style bucket addressing, as MinIO and many gateways require")
+	s3Cmd.PersistentFlags().String("region", "", "S3 region of the bucket, e.g. us-east-1")
+	s3Cmd.PersistentFlags().String("session-token", "", "session token for temporary AWS credentials")
+	// The flags override the config file settings.
+	viper.BindPFlag("APTRUST_S3_PORT", s3Cmd.PersistentFlags().Lookup("port"))
+	viper.BindPFlag("APTRUST_S3_INSECURE", s3Cmd.PersistentFlags().Lookup("insecure"))
+	viper.BindPFlag("APTRUST_S3_PATH_STYLE", s3Cmd.PersistentFlags().Lookup("path-style"))
+	viper.BindPFlag("APTRUST_AWS_REGION", s3Cmd.PersistentFlags().Lookup("region"))
+	viper.BindPFlag("APTRUST_AWS_SESSION_TOKEN", s3Cmd.PersistentFlags().Lookup("session-token"))
 }
@@ -1,7 +1,6 @@
 package cmd
 
 import (
-	"context"
 	"fmt"
 	"os"
 
@@ -10,19 +9,20 @@ import (
 )
 
 var s3deleteCmd = &cobra.Command{
-	Use:   "delete",
-	Short: "Delete an object from S3 storage",
+	Use:     "delete",
+	Short:   "Delete an object from S3 storage",
+	Example: `apt-cmd s3 delete --host=s3.amazonaws.com --bucket=my-bucket --key=my_bag.tar`,
 	Long: `Delete an object from any S3-compatible service. For this to work,
-you will need to have APTRUST_AWS_KEY and APTRUST_AWS_SECRET set in your 
+you will need to have APTRUST_AWS_KEY and APTRUST_AWS_SECRET set in your
 environment, or in a config file specified with the --config flag.
-	
+
 Example:
-	
+
 Delete object photo.jpg from my-bucket on AWS S3:
-	
-    apt-cmd s3 delete --host=s3.amazonaws.com --bucket="my-bucket" --key='photo.jpg' 
 
-Note: This returns exit status zero and '{ "result": "OK" }' if the key is 
+    apt-cmd s3 delete --host=s3.amazonaws.com --bucket="my-bucket" --key='photo.jpg'
+
+Note: This returns exit status zero and '{ "result": "OK" }' if the key is
 successfully deleted or if the key wasn't in the bucket to begin with.
 
 Full online documentation:
@@ -37,19 +37,17 @@ Full online documentation:
 		bucket := GetFlagValue(cmd.Flags(), "bucket", "Missing required param --bucket")
 		key := GetFlagValue(cmd.Flags(), "key", "Missing required param --key")
 		if LooksLikePreservationBucket(bucket) {
-			fmt.Fprintln(os.Stderr, "Deletion from preservation bucket not allowed")
-			os.Exit(EXIT_USER_ERR)
+			Fail(EXIT_USER_ERR, "Deletion from preservation bucket not allowed")
 		}
 
 		logger.Debugf("Deleting object %s from %s/%s", key, s3Host, bucket)
 		client := NewS3Client(config, s3Host)
-		err := client.RemoveObject(context.Background(), bucket, key, minio.RemoveObjectOptions{})
+		err := client.RemoveObject(cmd.Context(), bucket, key, minio.RemoveObjectOptions{})
 		if err != nil {
-			fmt.Fprintln(os.Stderr, "Error deleting object: ", err)
-			os.Exit(EXIT_REQUEST_ERROR)
+			ExitIfCanceled(cmd.Context())
+			Fail(EXIT_REQUEST_ERROR, "Error deleting object: ", err)
 		}
-		fmt.Printf(`{ "result": "OK", "message": "Deleted %s/%s" }`, bucket, key)
-		fmt.Println("")
+		printResult(&s3DeleteResult{Result: "OK", Message: fmt.Sprintf("Deleted %s/%s", bucket, key)})
 		os.Exit(EXIT_OK)
 	},
 }
@@ -60,3 +58,9 @@ func init() {
 	s3deleteCmd.Flags().StringP("bucket", "b", "", "Bucket containing object to delete")
 	s3deleteCmd.Flags().StringP("key", "k", "", "Key (name of object) to delete")
 }
+
+// s3DeleteResult is what s3 delete prints when it deletes an object.
+type s3DeleteResult struct {
+	Result  string `json:"result"`
+	Message string `json:"message"`
+}
@@ -1,29 +1,41 @@
 package cmd
 
 import (
-	"context"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
+	"hash"
 	"io"
+	"net/url"
 	"os"
 	"path"
+	"path/filepath"
+	"strings"
 
+	"github.com/APTrust/dart-runner/util"
+	"github.com/dustin/go-humanize"
 	"github.com/minio/minio-go/v7"
 	"github.com/spf13/cobra"
 )
 
+// DefaultRangeConcurrency is the number of byte ranges s3 download
+// downloads a single object in, unless --concurrency is set.
+const DefaultRangeConcurrency = 1
+
 // s3downloadCmd represents the s3download command
 var s3downloadCmd = &cobra.Command{
-	Use:   "download",
-	Short: "Download a file from S3 storage",
+	Use:     "download",
+	Short:   "Download a file from S3 storage",
+	Example: `apt-cmd s3 download --host=s3.amazonaws.com --bucket=my-bucket --key=my_bag.tar --save-as=/path/to/my_bag.tar`,
 	Long: `Download a file from any S3 storage. For this to work,
-you will need to have APTRUST_AWS_KEY and APTRUST_AWS_SECRET set in your 
+you will need to have APTRUST_AWS_KEY and APTRUST_AWS_SECRET set in your
 environment, or in a config file specified with the --config flag.
 
 Examples:
 
 Download a file from Amazon's S3 service into the current directory:
 
-    apt-cmd s3 download --host=s3.amazonaws.com --bucket="my-bucket" --key='photo_001.jpg' 
+    apt-cmd s3 download --host=s3.amazonaws.com --bucket="my-bucket" --key='photo_001.jpg'
 
 Download the same file and save it with a custom name on your desktop:
 
@@ -32,46 +44,414 @@ Download the same file and save it with a custom name on your desktop:
                --key='photo_001.jpg' \
                --save-as="$HOME/Desktop/vacation.jpg"
 
+Download a file and write its sha256 digest, calculated during the
+download, into the sidecar file photo_001.jpg.sha256:
+
+    apt-cmd s3 download --host=s3.amazonaws.com \
+               --bucket="my-bucket" \
+               --key='photo_001.jpg' \
+               --write-checksum=sha256
+
+To verify the download against the object's ETag, add --verify. For
+objects uploaded in a single part, the ETag is the object's MD5 digest.
+For multipart uploads, it's the MD5 of the parts' MD5 digests, followed
+by the number of parts. This depends on the part size the uploader used.
+We try the part sizes used by common tools, or you can specify the part
+size with --part-size. If the download doesn't match, we delete it and
+exit with an error. We can't verify objects encrypted with SSE-KMS or
+SSE-C, since their ETags aren't based on MD5.
+
+    apt-cmd s3 download --host=s3.amazonaws.com \
+               --bucket="my-bucket" \
+               --key='my_bag.tar' \
+               --verify --part-size=8MiB
+
+Without --verify, we still check downloads of objects whose ETag is a
+simple MD5 digest, since that costs nothing extra. We skip the check for
+multipart and encrypted objects.
+
+If you know the object's digest, pass it with --expected-md5 or
+--expected-sha256, in hex or base64. We calculate the digest during the
+download, and if it doesn't match, we delete the file and exit with an
+error. This works for any object, including multipart and encrypted
+objects, and we skip the ETag check when you use it.
+
+    apt-cmd s3 download --host=s3.amazonaws.com \
+               --bucket="my-bucket" \
+               --key='my_bag.tar' \
+               --expected-sha256=5891b5b522d5df086d0ff0b110fbd9d21bb4fc7163af34d08286a2e846f6be03
+
+If you omit --save-as, or if --save-as is a directory, the local file
+name is the last part of the key, after the last slash. Percent-encoded
+characters in that name are decoded, and characters that aren't allowed in
+file names on Windows, Mac or Linux are replaced with underscores. Spaces,
+plus signs, and unicode characters are kept as they are. The request to S3
+always uses the key exactly as you typed it. For example, this saves the
+file as "my file (1).jpg":
+
+    apt-cmd s3 download --host=s3.amazonaws.com \
+               --bucket="my-bucket" \
+               --key='photos/my file (1).jpg'
+
+The sidecar file uses the same format as a BagIt manifest or the output
+of sha256sum: the digest, two spaces, and the name of the file.
+
+Resuming downloads:
+
+If a download fails partway through, the partial file stays on disk.
+Run the same command again with --resume to download only the rest of
+the object and append it to the file. This also works after Ctrl-C if
+you used --resume the first time; otherwise, Ctrl-C deletes the partial
+file.
+
+    apt-cmd s3 download --host=s3.amazonaws.com \
+               --bucket="my-bucket" \
+               --key='my_bag.tar' \
+               --save-as=/data/my_bag.tar --resume
+
+To make sure the partial file is the start of the same object, s3
+download records the object's bucket, key, size and ETag in a file next
+to the download, named like my_bag.tar.apt-cmd-download, and deletes that
+file when the download is complete. --resume refuses to continue, and
+exits with status 3, if there's no such record, or if the object's size
+or ETag has changed since the partial download. --verify, --expected-md5,
+--expected-sha256 and --write-checksum all cover the whole file, including
+the part downloaded earlier. If --save-as doesn't exist yet, --resume
+downloads the whole object.
+
+Skipping files you already have:
+
+To sync a bucket without downloading objects again, add --skip-existing.
+If --save-as is already the object's size, s3 download skips the
+download and prints a result of "Skipped" instead of "OK". Add --verify
+to also check the file against the object's ETag, which means reading
+the whole file. A file that doesn't match is downloaded again, and so is
+a partial file left by an interrupted download, even if it's the right
+size. With --prefix, each object is checked this way, and the summary
+counts the objects it skipped as "skippedCount".
+
+    apt-cmd s3 download --host=s3.amazonaws.com \
+               --bucket="my-bucket" \
+               --prefix='photos/2023/' \
+               --save-as="$HOME/Pictures" \
+               --skip-existing --verify
+
+Retries:
+
+If a download fails with a timeout, a lost connection or a 5xx response
+from S3, s3 download tries again up to --retries times, which defaults
+to 3. It waits --retry-backoff, 1s by default, before the first retry,
+and twice as long before each retry after that. Each retry asks only for
+the bytes it doesn't have yet, and only if the object's ETag hasn't
+changed, so the file is never a mix of two versions. Errors that won't
+go away, like 403 and 404 responses, fail right away with status 4. Use
+--retries=0 to turn retries off. Add --debug to see each retry.
+
+Parallel downloads:
+
+To download a large object faster, add --concurrency=N. This splits the
+object into N byte ranges of about the same size, downloads them at the
+same time, and writes each one into its place in the file. For a single
+object, the default is 1, which downloads the object in a single
+request, whatever the global --concurrency default is. If any range
+fails, we cancel the others, delete the file, and exit with an error. If
+the server ignores the ranges, we download the object in a single
+request instead. Since the ranges arrive out of order, --verify,
+--expected-md5, --expected-sha256 and --write-checksum read the file
+back after the download. You can't combine --concurrency with --resume.
+
+    apt-cmd s3 download --host=s3.amazonaws.com \
+               --bucket="my-bucket" \
+               --key='my_bag.tar' \
+               --concurrency=8
+
+Bandwidth:
+
+To avoid saturating a shared link, add --rate-limit with a rate such as
+10MB/s or 500KiB/s. The limit applies to the whole download, shared by
+all of its --concurrency ranges, or with --prefix, by all of the objects
+downloading at the same time. The default is no limit.
+
+    apt-cmd s3 download --host=s3.amazonaws.com \
+               --bucket="my-bucket" \
+               --key='my_bag.tar' \
+               --rate-limit=10MB/s
+
+Progress:
+
+When stderr is a terminal, s3 download shows the percent complete, the
+number of bytes downloaded, and the download speed on a single line,
+updated every second. Add --quiet to hide it. When stderr isn't a
+terminal, as when you redirect it to a file, s3 download doesn't show
+progress. Progress never goes to stdout, which has only the result JSON,
+so scripts can parse it as before. Use --output=result.json to write
+the result JSON to a file instead. The file appears only once the
+download is finished, so it never holds a partial result.
+
+Downloading a prefix:
+
+To download every object whose key starts with a prefix, use --prefix
+instead of --key, or end --key with a slash. The objects are saved in a
+directory tree under --save-as, which defaults to the current directory,
+mirroring the part of each key after the prefix's last slash. This saves
+photos/2023/june/beach.jpg as $HOME/Pictures/june/beach.jpg:
+
+    apt-cmd s3 download --host=s3.amazonaws.com \
+               --bucket="my-bucket" \
+               --prefix='photos/2023/' \
+               --save-as="$HOME/Pictures"
+
+Directories are created as needed, and file names are cleaned up as for
+single downloads. With --prefix, --concurrency is the number of objects
+to download at the same time, four by default, rather than the number
+of ranges per object. Each object is checked against its ETag as a single download
+would be, and --verify and --part-size work as they do for one object.
+--resume, --expected-md5, --expected-sha256 and --write-checksum apply
+only to single objects. When the downloads are done, s3 download prints
+a summary with the result, local file and size of each object, and
+totals for all of them. If any object fails, the others are still
+downloaded, the failed one is left off the disk, and s3 download exits
+with status 1.
+
 Full online documentation:
 
   https://aptrust.github.io/userguide/partner_tools/
-							  
+
 `,
 	Run: func(cmd *cobra.Command, args []string) {
 		config.ValidateAWSCredentials()
 
 		s3Host := GetFlagValue(cmd.Flags(), "host", "Missing required param --host")
 		bucket := GetFlagValue(cmd.Flags(), "bucket", "Missing required param --bucket")
-		key := GetFlagValue(cmd.Flags(), "key", "Missing required param --key")
+		key := cmd.Flag("key").Value.String()
+		prefix := cmd.Flag("prefix").Value.String()
+		if key != "" && prefix != "" {
+			Fail(EXIT_USER_ERR, "Use either --key or --prefix, not both.")
+		}
+		if strings.HasSuffix(key, "/") {
+			prefix = key
+		}
+		if prefix != "" {
+			downloadPrefix(cmd, s3Host, bucket, prefix)
+		}
+		if key == "" {
+			Fail(EXIT_USER_ERR, "Missing required param --key")
+		}
 
 		saveas := cmd.Flags().Lookup("save-as").Value.String()
 		if saveas == "" {
-			saveas = key
+			saveas = LocalFileNameForKey(key)
 		}
 		_stat, _ := os.Stat(saveas)
 		if _stat != nil && _stat.IsDir() {
-			saveas = path.Join(saveas, key)
+			saveas = filepath.Join(saveas, LocalFileNameForKey(key))
+		}
+		checksumAlg := cmd.Flags().Lookup("write-checksum").Value.String()
+		var hasher hash.Hash
+		if checksumAlg != "" {
+			hasher = util.GetHashes([]string{checksumAlg})[checksumAlg]
+			if hasher == nil {
+				Fail(EXIT_USER_ERR, "Unsupported checksum algorithm", checksumAlg, "- try md5, sha1, sha256, or sha512")
+			}
+		}
+		expectedDigests, err := ParseExpectedDigests(cmd.Flag("expected-md5").Value.String(), cmd.Flag("expected-sha256").Value.String())
+		if err != nil {
+			Fail(EXIT_USER_ERR, err.Error())
+		}
+		verify, _ := cmd.Flags().GetBool("verify")
+		partSize := int64(0)
+		if partSizeFlag := cmd.Flags().Lookup("part-size").Value.String(); partSizeFlag != "" {
+			size, err := humanize.ParseBytes(partSizeFlag)
+			if err != nil || size == 0 {
+				Fail(EXIT_USER_ERR, "Invalid --part-size", partSizeFlag, "- try a number of bytes, or a size like 8MiB")
+			}
+			partSize = int64(size)
+		}
+		resume, _ := cmd.Flags().GetBool("resume")
+		skipExisting, _ := cmd.Flags().GetBool("skip-existing")
+		// Ranged downloads of one object are opt-in. The global default
+		// is for fanning out over many objects.
+		concurrency := DefaultRangeConcurrency
+		if cmd.Flags().Changed("concurrency") {
+			concurrency = GetConcurrency(cmd.Flags())
+		}
+		limiter := GetRateLimiter(cmd.Flags())
+		retryPolicy := GetS3RetryPolicy(cmd.Flags())
+		if resume && concurrency > 1 {
+			Fail(EXIT_USER_ERR, "Can't use --resume with --concurrency greater than 1, since a parallel download doesn't leave the start of the object on disk if it fails.")
 		}
 		logger.Debugf("Downloading object %s from %s/%s", key, s3Host, bucket)
 		client := NewS3Client(config, s3Host)
-		obj, err := client.GetObject(context.Background(), bucket, key, minio.GetObjectOptions{})
+		objInfo, err := client.StatObject(cmd.Context(), bucket, key, minio.StatObjectOptions{})
 		if err != nil {
-			fmt.Fprintln(os.Stderr, "Error retrieving S3 object:", err)
-			os.Exit(EXIT_REQUEST_ERROR)
+			ExitIfCanceled(cmd.Context())
+			Fail(EXIT_REQUEST_ERROR, "Error retrieving S3 object:", err)
 		}
-		defer obj.Close()
-		outfile, err := os.Create(saveas)
-		if err != nil {
-			fmt.Fprintln(os.Stderr, "Error opening output file:", err)
-			os.Exit(EXIT_RUNTIME_ERR)
+
+		if skipExisting {
+			matches, err := LocalFileMatchesObject(saveas, objInfo, verify, partSize)
+			if err != nil {
+				Fail(EXIT_RUNTIME_ERR, "Can't check the existing", saveas, "-", err.Error())
+			}
+			if matches {
+				logger.Debugf("Skipping %s, since %s matches it", key, saveas)
+				resultExtras := fmt.Sprintf(`, "size": %d`, objInfo.Size)
+				if verify {
+					resultExtras += fmt.Sprintf(`, "etag": %s, "etagVerified": true`, jsonString(objInfo.ETag))
+				}
+				WriteResult(fmt.Sprintf(`{ "result": "Skipped", "message": %s%s }`, jsonString(fmt.Sprintf("%s already matches S3 object %s", saveas, key)), resultExtras) + "\n")
+				os.Exit(EXIT_OK)
+			}
+		}
+
+		// With --resume, pick up where an earlier download of this
+		// object left off, if it left a partial file behind.
+		statePath := DownloadStatePath(saveas)
+		state := NewDownloadState(bucket, key, objInfo)
+		offset := int64(0)
+		if stat, err := os.Stat(saveas); resume && err == nil {
+			previous, err := ReadDownloadState(statePath)
+			if err == nil {
+				offset, err = ResumeOffset(stat.Size(), previous, state)
+			}
+			if err != nil {
+				Failf(EXIT_USER_ERR, "Can't resume download of %s into %s: %s", key, saveas, err.Error())
+			}
+			logger.Debugf("Resuming download of %s at byte %d of %d", key, offset, objInfo.Size)
+		}
+
+		var etagHasher *ETagHasher
+		if verify {
+			etagHasher, err = NewETagHasherFor(objInfo.ETag, objInfo.Size, partSize)
+			if err != nil {
+				Fail(EXIT_RUNTIME_ERR, "Can't verify", key, "-", err.Error())
+			}
+		} else if len(expectedDigests) == 0 && IsSimpleMD5ETag(objInfo) {
+			logger.Debugf("Verifying %s against its MD5 ETag %s", key, objInfo.ETag)
+			etagHasher = NewETagHasher([]int64{0})
+		}
+		digestHashers := make(map[string]hash.Hash)
+		for alg := range expectedDigests {
+			digestHashers[alg] = util.GetHashes([]string{alg})[alg]
+		}
+		hashers := make([]io.Writer, 0)
+		if hasher != nil {
+			hashers = append(hashers, hasher)
+		}
+		if etagHasher != nil {
+			hashers = append(hashers, etagHasher)
+		}
+		for _, digestHasher := range digestHashers {
+			hashers = append(hashers, digestHasher)
+		}
+
+		if err = state.Write(statePath); err != nil {
+			Fail(EXIT_RUNTIME_ERR, "Error writing download state file:", err)
+		}
+		var outfile *os.File
+		if offset > 0 {
+			// Checksums cover the whole file, so hash the part we
+			// already have before appending the rest.
+			if len(hashers) > 0 {
+				err = hashFilePrefix(saveas, offset, io.MultiWriter(hashers...))
+			}
+			if err == nil {
+				outfile, err = os.OpenFile(saveas, os.O_WRONLY|os.O_APPEND, 0)
+			}
+		} else {
+			outfile, err = os.Create(saveas)
 		}
-		_, err = io.Copy(outfile, obj)
 		if err != nil {
-			fmt.Fprintln(os.Stderr, "Error writing output file:", err)
-			os.Exit(EXIT_RUNTIME_ERR)
+			Fail(EXIT_RUNTIME_ERR, "Error opening output file:", err)
+		}
+		// Progress goes to stderr, and only on a terminal, so stdout
+		// has only the result JSON.
+		counter := &DownloadCounter{}
+		stopProgress := func() {}
+		if !quiet && IsTerminal(os.Stderr) && offset < objInfo.Size {
+			stopProgress = WatchDownloadProgress(counter, offset, objInfo.Size, DownloadProgressInterval, DownloadProgressPrinter(os.Stderr))
+		}
+		written := offset
+		if concurrency > 1 && objInfo.Size > 0 {
+			logger.Debugf("Downloading %s in %d parallel ranges", key, concurrency)
+			err = ParallelDownload(cmd.Context(), client, bucket, key, objInfo, outfile, concurrency, counter, limiter, retryPolicy)
+			stopProgress()
+			outfile.Close()
+			if err == nil && len(hashers) > 0 {
+				// The ranges arrive out of order, so hash the file
+				// once it's complete.
+				err = hashFilePrefix(saveas, objInfo.Size, io.MultiWriter(hashers...))
+			}
+			if err != nil {
+				// The file has holes where the failed ranges should be,
+				// so there's nothing worth keeping.
+				os.Remove(saveas)
+				os.Remove(statePath)
+				ExitIfCanceled(cmd.Context())
+				Fail(EXIT_RUNTIME_ERR, "Error downloading S3 object:", err)
+			}
+		} else if offset < objInfo.Size {
+			writers := append([]io.Writer{outfile, counter}, hashers...)
+			if limiter != nil {
+				writers = append(writers, limiter.Writer(cmd.Context()))
+			}
+			var copied int64
+			copied, err = retryPolicy.CopyObject(cmd.Context(), client, bucket, key, objInfo.ETag, offset, objInfo.Size-offset, io.MultiWriter(writers...))
+			stopProgress()
+			written += copied
+			if err != nil {
+				outfile.Close()
+				if cmd.Context().Err() != nil && !resume {
+					// Don't leave a partial download behind.
+					os.Remove(saveas)
+					os.Remove(statePath)
+				}
+				ExitIfCanceled(cmd.Context())
+				if minio.ToErrorResponse(err).StatusCode != 0 {
+					Fail(EXIT_REQUEST_ERROR, "Error retrieving S3 object:", err)
+				}
+				Failf(EXIT_RUNTIME_ERR, "Error writing output file: %v\nRun this command again with --resume to download the rest of the file.", err)
+			}
+		}
+		outfile.Close()
+		os.Remove(statePath)
+
+		// Extra fields for the result JSON
+		resultExtras := ""
+		if offset > 0 {
+			resultExtras += fmt.Sprintf(`, "resumedAt": %d`, offset)
+		}
+		if err = VerifyDigests(digestHashers, expectedDigests); err != nil {
+			// Don't let anyone mistake this for a good download.
+			os.Remove(saveas)
+			Fail(EXIT_RUNTIME_ERR, "Downloaded file failed verification and was deleted:", err.Error())
+		}
+		for _, alg := range []string{"md5", "sha256"} {
+			if _, ok := expectedDigests[alg]; ok {
+				resultExtras += fmt.Sprintf(`, "%sVerified": true`, alg)
+			}
+		}
+		if etagHasher != nil {
+			matchingPartSize, err := VerifyETag(etagHasher, objInfo.ETag)
+			if err != nil {
+				// Don't let anyone mistake this for a good download.
+				os.Remove(saveas)
+				Fail(EXIT_RUNTIME_ERR, "Downloaded file failed verification and was deleted:", err.Error())
+			}
+			resultExtras += fmt.Sprintf(`, "etag": %s, "etagVerified": true`, jsonString(objInfo.ETag))
+			if matchingPartSize > 0 {
+				resultExtras += fmt.Sprintf(`, "partSize": %d`, matchingPartSize)
+			}
 		}
-		fmt.Printf(`{ "result": "OK", "message": "S3 object %s saved to file %s" }`, key, saveas)
-		fmt.Println("")
+		if hasher != nil {
+			digest := fmt.Sprintf("%x", hasher.Sum(nil))
+			checksumFile, err := WriteChecksumFile(saveas, checksumAlg, digest)
+			if err != nil {
+				Fail(EXIT_RUNTIME_ERR, "Error writing checksum file:", err)
+			}
+			resultExtras += fmt.Sprintf(`, "%s": "%s", "checksumFile": %s`, checksumAlg, digest, jsonString(checksumFile))
+		}
+		WriteResult(fmt.Sprintf(`{ "result": "OK", "message": %s%s }`, jsonString(fmt.Sprintf("S3 object %s saved to file %s", key, saveas)), resultExtras) + "\n")
 		os.Exit(EXIT_OK)
 	},
 }
@@ -81,5 +461,194 @@ func init() {
 	s3downloadCmd.Flags().StringP("host", "H", "", "S3 host name. E.g. s3.amazonaws.com.")
 	s3downloadCmd.Flags().StringP("bucket", "b", "", "Bucket to download from")
 	s3downloadCmd.Flags().StringP("key", "k", "", "Key (name of object) to download")
-	s3downloadCmd.Flags().StringP("save-as", "s", "", "Name the file in which to save the download")
+	s3downloadCmd.Flags().StringP("prefix", "p", "", "Download all objects with this prefix into a directory tree under --save-as")
+	s3downloadCmd.Flags().StringP("save-as", "s", "", "Name the file in which to save the download, or with --prefix, the directory")
+	s3downloadCmd.Flags().Bool("verify", false, "Verify the download against the object's ETag, including multipart ETags")
+	s3downloadCmd.Flags().String("part-size", "", "Part size used to upload a multipart object, e.g. 8MiB. Used with --verify. If omitted, we try likely part sizes.")
+	s3downloadCmd.Flags().String("rate-limit", "", "Limit the download to this rate, e.g. 10MB/s, shared by all --concurrency downloads. The default is no limit.")
+	s3downloadCmd.Flags().Int("retries", DefaultS3Retries, "Number of times to retry a download that fails with a timeout, lost connection or 5xx response, continuing where it left off")
+	s3downloadCmd.Flags().Duration("retry-backoff", DefaultS3RetryBackoff, "Wait this long before the first retry, doubling the wait for each retry after that")
+	s3downloadCmd.Flags().Bool("skip-existing", false, "Don't download the object if --save-as already has its size, and with --verify, matches its ETag")
+	s3downloadCmd.Flags().Bool("resume", false, "If --save-as is a partial file from an earlier download of this object, download only the rest of the object")
+	s3downloadCmd.Flags().String("expected-md5", "", "Fail, and delete the download, if its MD5 digest doesn't match this hex or base64 digest")
+	s3downloadCmd.Flags().String("expected-sha256", "", "Fail, and delete the download, if its SHA-256 digest doesn't match this hex or base64 digest")
+	s3downloadCmd.Flags().StringVar(&resultFile, "output", "", "Write the result JSON to this file instead of stdout")
+	s3downloadCmd.Flags().StringP("write-checksum", "c", "", "Calculate a checksum during download and write it to a sidecar file: md5, sha1, sha256, or sha512")
+}
+
+// downloadPrefix does the work of s3 download --prefix, or --key with
+// a trailing slash, then exits.
+func downloadPrefix(cmd *cobra.Command, s3Host, bucket, prefix string) {
+	for _, flag := range []string{"resume", "expected-md5", "expected-sha256", "write-checksum"} {
+		if cmd.Flags().Changed(flag) {
+			Failf(EXIT_USER_ERR, "--%s can't be used with --prefix.", flag)
+		}
+	}
+	partSize := int64(0)
+	if partSizeFlag := cmd.Flag("part-size").Value.String(); partSizeFlag != "" {
+		size, err := humanize.ParseBytes(partSizeFlag)
+		if err != nil || size == 0 {
+			Fail(EXIT_USER_ERR, "Invalid --part-size", partSizeFlag, "- try a number of bytes, or a size like 8MiB")
+		}
+		partSize = int64(size)
+	}
+	verify, _ := cmd.Flags().GetBool("verify")
+	skipExisting, _ := cmd.Flags().GetBool("skip-existing")
+	saveAs := cmd.Flag("save-as").Value.String()
+	if saveAs == "" {
+		saveAs = "."
+	}
+	if stat, err := os.Stat(saveAs); err == nil && !stat.IsDir() {
+		Failf(EXIT_USER_ERR, "--save-as %s must be a directory when downloading a prefix.", saveAs)
+	}
+
+	client := NewS3Client(config, s3Host)
+	logger.Debugf("Listing objects with prefix '%s' in %s/%s", prefix, s3Host, bucket)
+	objects, err := ListPrefix(cmd.Context(), client, bucket, prefix)
+	if err != nil {
+		ExitIfCanceled(cmd.Context())
+		Fail(EXIT_REQUEST_ERROR, "Error listing S3 objects:", err)
+	}
+	if len(objects) == 0 {
+		Failf(EXIT_REQUEST_ERROR, "No objects in %s have prefix '%s'.", bucket, prefix)
+	}
+	totalBytes := int64(0)
+	for _, obj := range objects {
+		totalBytes += obj.Size
+	}
+	counter := &DownloadCounter{}
+	stopProgress := func() {}
+	if !quiet && IsTerminal(os.Stderr) {
+		stopProgress = WatchDownloadProgress(counter, 0, totalBytes, DownloadProgressInterval, DownloadProgressPrinter(os.Stderr))
+	}
+	concurrency := GetConcurrency(cmd.Flags())
+	limiter := GetRateLimiter(cmd.Flags())
+	retryPolicy := GetS3RetryPolicy(cmd.Flags())
+	logger.Debugf("Downloading %d objects into %s, %d at a time", len(objects), saveAs, concurrency)
+	results := DownloadPrefix(cmd.Context(), client, bucket, prefix, objects, saveAs, concurrency, verify, skipExisting, partSize, counter, limiter, retryPolicy)
+	stopProgress()
+	ExitIfCanceled(cmd.Context())
+
+	summary := NewPrefixDownloadSummary(prefix, saveAs, results)
+	// Marshalling this struct can't fail.
+	data, _ := json.MarshalIndent(summary, "", "  ")
+	WriteResult(string(data) + "\n")
+	if summary.FailedCount > 0 {
+		Failf(EXIT_RUNTIME_ERR, "Failed to download %d of %d objects.", summary.FailedCount, len(results))
+	}
+	os.Exit(EXIT_OK)
+}
+
+// hashFilePrefix writes the first n bytes of the file at pathToFile to
+// writer.
+func hashFilePrefix(pathToFile string, n int64, writer io.Writer) error {
+	file, err := os.Open(pathToFile)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = io.CopyN(writer, file, n)
+	return err
+}
+
+// LocalFileMatchesObject returns true if the file at filePath looks like
+// a complete download of the object described by objInfo, so that s3
+// download --skip-existing can skip it. The file must be the object's
+// size, and with verify, it must also match the object's ETag, using
+// partSize for multipart ETags as --verify does. A missing file doesn't
+// match, and neither does a file with a download state file next to it,
+// since that download never finished. The error says why the file
+// can't be checked against the ETag.
+func LocalFileMatchesObject(filePath string, objInfo minio.ObjectInfo, verify bool, partSize int64) (bool, error) {
+	stat, err := os.Stat(filePath)
+	if err != nil || stat.IsDir() || stat.Size() != objInfo.Size {
+		return false, nil
+	}
+	if _, err := os.Stat(DownloadStatePath(filePath)); err == nil {
+		return false, nil
+	}
+	if !verify {
+		return true, nil
+	}
+	etagHasher, err := NewETagHasherFor(objInfo.ETag, objInfo.Size, partSize)
+	if err != nil {
+		return false, err
+	}
+	if err = hashFilePrefix(filePath, objInfo.Size, etagHasher); err != nil {
+		return false, err
+	}
+	_, err = VerifyETag(etagHasher, objInfo.ETag)
+	return err == nil, nil
+}
+
+// expectedDigestLengths is the length of hex digests for the
+// algorithms we accept in --expected-md5 and --expected-sha256.
+var expectedDigestLengths = map[string]int{
+	"md5":    32,
+	"sha256": 64,
+}
+
+// ParseExpectedDigests returns the digests from --expected-md5 and
+// --expected-sha256, keyed by algorithm and converted to lowercase hex.
+// Empty digests are left out, so this returns an empty map if the user
+// didn't specify either flag.
+func ParseExpectedDigests(expectedMD5, expectedSHA256 string) (map[string]string, error) {
+	digests := make(map[string]string)
+	for alg, value := range map[string]string{"md5": expectedMD5, "sha256": expectedSHA256} {
+		value = strings.TrimSpace(value)
+		if value == "" {
+			continue
+		}
+		digest := NormalizeDigest(value)
+		if len(digest) != expectedDigestLengths[alg] || !hexDigestRegex.MatchString(digest) {
+			return nil, fmt.Errorf("invalid --expected-%s '%s'. Use a %d-character hex digest, or its base64 equivalent", alg, value, expectedDigestLengths[alg])
+		}
+		digests[alg] = digest
+	}
+	return digests, nil
+}
+
+// VerifyDigests returns an error if any of the hashers' digests doesn't
+// match the expected digest for its algorithm. Call this after writing
+// all of the data to the hashers.
+func VerifyDigests(hashers map[string]hash.Hash, expected map[string]string) error {
+	for _, alg := range []string{"md5", "sha256"} {
+		digest, ok := expected[alg]
+		if !ok {
+			continue
+		}
+		computed := hex.EncodeToString(hashers[alg].Sum(nil))
+		if computed != digest {
+			return fmt.Errorf("file %s %s does not match expected %s %s", alg, computed, alg, digest)
+		}
+	}
+	return nil
+}
+
+// LocalFileNameForKey returns a safe local file name for an S3 key.
+// This is the last element of the key, after the last slash, with
+// percent-encoded characters decoded, and with characters that are
+// illegal in file names on common file systems replaced with
+// underscores. Note that this is only for naming the local file.
+// Requests to S3 should always use the raw key.
+func LocalFileNameForKey(key string) string {
+	name := path.Base(key)
+	if strings.HasSuffix(key, "/") {
+		name = ""
+	}
+	if decoded, err := url.PathUnescape(name); err == nil {
+		name = decoded
+	}
+	name = strings.Map(func(r rune) rune {
+		if r < 32 || r == 127 || strings.ContainsRune(`<>:"/\|?*`, r) {
+			return '_'
+		}
+		return r
+	}, name)
+	// Windows doesn't allow names ending in dots or spaces.
+	name = strings.TrimRight(name, ". ")
+	if name == "" {
+		name = "download"
+	}
+	return name
 }
@@ -0,0 +1,229 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/minio/minio-go/v7"
+)
+
+// PrefixDownloadResult describes the download of one object in
+// s3 download --prefix. Result is "OK", "Skipped" or "Failed".
+type PrefixDownloadResult struct {
+	Key          string `json:"key"`
+	File         string `json:"file"`
+	Size         int64  `json:"size"`
+	Result       string `json:"result"`
+	Error        string `json:"error,omitempty"`
+	ETagVerified bool   `json:"etagVerified,omitempty"`
+}
+
+// PrefixDownloadSummary is the JSON output of s3 download --prefix.
+// Result is "OK" if every object was downloaded or skipped, and
+// "Failed" otherwise. FileCount and TotalBytes count only the objects
+// that were downloaded.
+type PrefixDownloadSummary struct {
+	Result       string                  `json:"result"`
+	Prefix       string                  `json:"prefix"`
+	SaveAs       string                  `json:"saveAs"`
+	FileCount    int                     `json:"fileCount"`
+	SkippedCount int                     `json:"skippedCount"`
+	FailedCount  int                     `json:"failedCount"`
+	TotalBytes   int64                   `json:"totalBytes"`
+	Files        []*PrefixDownloadResult `json:"files"`
+}
+
+// NewPrefixDownloadSummary totals up results.
+func NewPrefixDownloadSummary(prefix, saveAs string, results []*PrefixDownloadResult) *PrefixDownloadSummary {
+	summary := &PrefixDownloadSummary{
+		Result: "OK",
+		Prefix: prefix,
+		SaveAs: saveAs,
+		Files:  results,
+	}
+	for _, result := range results {
+		if result.Result == "Skipped" {
+			summary.SkippedCount++
+			continue
+		}
+		if result.Result != "OK" {
+			summary.Result = "Failed"
+			summary.FailedCount++
+			continue
+		}
+		summary.FileCount++
+		summary.TotalBytes += result.Size
+	}
+	return summary
+}
+
+// LocalPathForPrefixKey returns the path, relative to the download
+// directory, at which s3 download --prefix saves key. The path mirrors
+// the part of the key after the last slash in prefix, so downloading
+// prefix photos/2023/ saves photos/2023/june/beach.jpg as
+// june/beach.jpg. Each part of the path is cleaned up as
+// LocalFileNameForKey cleans up file names. This returns an error for
+// keys with . or .. in their paths, which could otherwise land outside
+// the download directory.
+func LocalPathForPrefixKey(prefix, key string) (string, error) {
+	relativeKey := strings.TrimPrefix(key, prefix[:strings.LastIndex(prefix, "/")+1])
+	parts := make([]string, 0)
+	for _, part := range strings.Split(relativeKey, "/") {
+		if part == "" {
+			continue
+		}
+		if part == "." || part == ".." {
+			return "", fmt.Errorf("key %s has '%s' in its path", key, part)
+		}
+		parts = append(parts, LocalFileNameForKey(part))
+	}
+	if len(parts) == 0 {
+		return "", fmt.Errorf("key %s has no file name", key)
+	}
+	return filepath.Join(parts...), nil
+}
+
+// ListPrefix returns all of the objects in bucket whose keys start
+// with prefix, except for the empty objects that some tools create as
+// folder markers, whose keys end with a slash.
+func ListPrefix(ctx context.Context, client *minio.Client, bucket, prefix string) ([]minio.ObjectInfo, error) {
+	objects := make([]minio.ObjectInfo, 0)
+	for obj := range client.ListObjects(ctx, bucket, minio.ListObjectsOptions{Prefix: prefix, Recursive: true}) {
+		if obj.Err != nil {
+			return nil, obj.Err
+		}
+		if strings.HasSuffix(obj.Key, "/") {
+			continue
+		}
+		objects = append(objects, obj)
+	}
+	return objects, nil
+}
+
+// DownloadPrefix downloads objects, which are the result of ListPrefix
+// for prefix, into a directory tree under saveAsDir, concurrency
+// objects at a time. It checks each download against the object's
+// ETag, as s3 download does for a single object. With verify, it checks
+// multipart ETags too, using partSize if it's greater than zero. With
+// skipExisting, it skips objects whose files already match them, as
+// LocalFileMatchesObject decides. If
+// counter isn't nil, it counts the bytes as they arrive. If limiter
+// isn't nil, all of the downloads together are held to its limit. Each
+// download retries according to retry, continuing where it left off.
+//
+// This returns a result for each object, in the order of objects. A
+// failed download doesn't stop the others, and leaves no file behind.
+// If ctx is canceled, the remaining downloads fail.
+func DownloadPrefix(ctx context.Context, client *minio.Client, bucket, prefix string, objects []minio.ObjectInfo, saveAsDir string, concurrency int, verify, skipExisting bool, partSize int64, counter *DownloadCounter, limiter *RateLimiter, retry S3RetryPolicy) []*PrefixDownloadResult {
+	results := make([]*PrefixDownloadResult, len(objects))
+	pathsTaken := make(map[string]string)
+	for i, obj := range objects {
+		results[i] = &PrefixDownloadResult{Key: obj.Key, Size: obj.Size, Result: "Failed"}
+		relativePath, err := LocalPathForPrefixKey(prefix, obj.Key)
+		if err != nil {
+			results[i].Error = err.Error()
+			continue
+		}
+		results[i].File = filepath.Join(saveAsDir, relativePath)
+		// Cleaning up file names can give two keys the same path.
+		if otherKey, ok := pathsTaken[results[i].File]; ok {
+			results[i].Error = fmt.Sprintf("key %s would be saved to the same file as %s", obj.Key, otherKey)
+			continue
+		}
+		pathsTaken[results[i].File] = obj.Key
+		results[i].Result = ""
+	}
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	pending := make(chan *PrefixDownloadResult)
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for result := range pending {
+				skipped, verified, err := downloadObject(ctx, client, bucket, result.Key, result.File, verify, skipExisting, partSize, counter, limiter, retry)
+				if err != nil {
+					result.Result = "Failed"
+					result.Error = err.Error()
+					continue
+				}
+				result.Result = "OK"
+				if skipped {
+					result.Result = "Skipped"
+				}
+				result.ETagVerified = verified
+			}
+		}()
+	}
+	for _, result := range results {
+		if result.Result == "" {
+			pending <- result
+		}
+	}
+	close(pending)
+	wg.Wait()
+	return results
+}
+
+// downloadObject downloads key into filePath, creating its directory
+// if necessary. It returns true for skipped if skipExisting is set and
+// filePath already matches the object, and true for verified if it
+// checked the download, or the file it skipped, against the object's
+// ETag. It deletes the file if the download fails.
+func downloadObject(ctx context.Context, client *minio.Client, bucket, key, filePath string, verify, skipExisting bool, partSize int64, counter *DownloadCounter, limiter *RateLimiter, retry S3RetryPolicy) (skipped, verified bool, err error) {
+	objInfo, err := client.StatObject(ctx, bucket, key, minio.StatObjectOptions{})
+	if err != nil {
+		return false, false, err
+	}
+	if skipExisting {
+		matches, err := LocalFileMatchesObject(filePath, objInfo, verify, partSize)
+		if err != nil || matches {
+			return matches, matches && verify, err
+		}
+	}
+	var etagHasher *ETagHasher
+	if verify {
+		if etagHasher, err = NewETagHasherFor(objInfo.ETag, objInfo.Size, partSize); err != nil {
+			return false, false, err
+		}
+	} else if IsSimpleMD5ETag(objInfo) {
+		etagHasher = NewETagHasher([]int64{0})
+	}
+	if err = os.MkdirAll(filepath.Dir(filePath), 0755); err != nil {
+		return false, false, err
+	}
+	outfile, err := os.Create(filePath)
+	if err != nil {
+		return false, false, err
+	}
+	writers := []io.Writer{outfile}
+	if etagHasher != nil {
+		writers = append(writers, etagHasher)
+	}
+	if counter != nil {
+		writers = append(writers, counter)
+	}
+	if limiter != nil {
+		writers = append(writers, limiter.Writer(ctx))
+	}
+	_, err = retry.CopyObject(ctx, client, bucket, key, objInfo.ETag, 0, objInfo.Size, io.MultiWriter(writers...))
+	if closeErr := outfile.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil && etagHasher != nil {
+		_, err = VerifyETag(etagHasher, objInfo.ETag)
+	}
+	if err != nil {
+		// Don't let anyone mistake this for a good download.
+		os.Remove(filePath)
+		return false, false, err
+	}
+	return false, etagHasher != nil, nil
+}
@@ -0,0 +1,210 @@
+package cmd_test
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/APTrust/apt-cmd/cmd"
+	"github.com/minio/minio-go/v7"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLocalFileNameForKey(t *testing.T) {
+	testCases := map[string]string{
+		"photo.jpg":                   "photo.jpg",
+		"my file (1).jpg":             "my file (1).jpg",
+		"photos/2023/my file (1).jpg": "my file (1).jpg",
+		"a+b=c.txt":                   "a+b=c.txt",
+		"résumé – 履歴書.pdf":            "résumé – 履歴書.pdf",
+		"my%20file%20%281%29.jpg":     "my file (1).jpg",
+		"100%.txt":                    "100%.txt",
+		"what?<is>:this|*.txt":        "what__is__this__.txt",
+		`back\slash"quote".txt`:       "back_slash_quote_.txt",
+		"tab\there.txt":               "tab_here.txt",
+		"encoded%2Fslash.txt":         "encoded_slash.txt",
+		"trailing dots...":            "trailing dots",
+		"photos/":                     "download",
+		"..":                          "download",
+		"":                            "download",
+	}
+	for key, expected := range testCases {
+		assert.Equal(t, expected, cmd.LocalFileNameForKey(key), key)
+	}
+}
+
+func TestParseExpectedDigests(t *testing.T) {
+	digests, err := cmd.ParseExpectedDigests("", "")
+	require.Nil(t, err)
+	assert.Empty(t, digests)
+
+	// Hex in any case, or base64.
+	digests, err = cmd.ParseExpectedDigests("8D777F385D3DFEC8815D20F7496026DC", "Om6weQ85rIfJTzhWst0sXREOaBFgImGpqSPTuyOtyLc=")
+	require.Nil(t, err)
+	assert.Equal(t, map[string]string{
+		"md5":    "8d777f385d3dfec8815d20f7496026dc",
+		"sha256": "3a6eb0790f39ac87c94f3856b2dd2c5d110e6811602261a9a923d3bb23adc8b7",
+	}, digests)
+
+	_, err = cmd.ParseExpectedDigests("not-a-digest", "")
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), "invalid --expected-md5 'not-a-digest'")
+
+	// A valid digest for the wrong algorithm.
+	_, err = cmd.ParseExpectedDigests("", "8d777f385d3dfec8815d20f7496026dc")
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), "invalid --expected-sha256")
+}
+
+func TestVerifyDigests(t *testing.T) {
+	hashers := map[string]hash.Hash{"md5": md5.New(), "sha256": sha256.New()}
+	for _, hasher := range hashers {
+		hasher.Write([]byte("data"))
+	}
+	expected := map[string]string{
+		"md5":    "8d777f385d3dfec8815d20f7496026dc",
+		"sha256": "3a6eb0790f39ac87c94f3856b2dd2c5d110e6811602261a9a923d3bb23adc8b7",
+	}
+	assert.Nil(t, cmd.VerifyDigests(hashers, expected))
+	assert.Nil(t, cmd.VerifyDigests(map[string]hash.Hash{}, map[string]string{}))
+
+	expected["sha256"] = "0000000000000000000000000000000000000000000000000000000000000000"
+	err := cmd.VerifyDigests(hashers, expected)
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), "file sha256 3a6eb0790f39ac87c94f3856b2dd2c5d110e6811602261a9a923d3bb23adc8b7 does not match expected sha256 0000")
+}
+
+func TestLocalPathForPrefixKey(t *testing.T) {
+	paths := map[string]string{
+		"photos/2023/june/beach.jpg": filepath.Join("june", "beach.jpg"),
+		"photos/2023/top.jpg":        "top.jpg",
+		"photos/2023//what?.jpg":     "what_.jpg",
+		"photos/2023/a%2Fb.jpg":      "a_b.jpg",
+	}
+	for key, expected := range paths {
+		localPath, err := cmd.LocalPathForPrefixKey("photos/2023/", key)
+		require.Nil(t, err, key)
+		assert.Equal(t, expected, localPath, key)
+	}
+
+	// Without a trailing slash, paths start after the last slash.
+	localPath, err := cmd.LocalPathForPrefixKey("photos/20", "photos/2023/top.jpg")
+	require.Nil(t, err)
+	assert.Equal(t, filepath.Join("2023", "top.jpg"), localPath)
+	localPath, err = cmd.LocalPathForPrefixKey("pho", "photos/top.jpg")
+	require.Nil(t, err)
+	assert.Equal(t, filepath.Join("photos", "top.jpg"), localPath)
+
+	for _, key := range []string{"photos/2023/../../etc/passwd", "photos/2023/./x", "photos/2023/"} {
+		_, err = cmd.LocalPathForPrefixKey("photos/2023/", key)
+		assert.NotNil(t, err, key)
+	}
+}
+
+func TestNewPrefixDownloadSummary(t *testing.T) {
+	results := []*cmd.PrefixDownloadResult{
+		{Key: "a/one.txt", File: "one.txt", Size: 10, Result: "OK"},
+		{Key: "a/two.txt", File: "two.txt", Size: 20, Result: "OK"},
+	}
+	summary := cmd.NewPrefixDownloadSummary("a/", "/tmp", results)
+	assert.Equal(t, "OK", summary.Result)
+	assert.Equal(t, 2, summary.FileCount)
+	assert.Equal(t, 0, summary.FailedCount)
+	assert.Equal(t, int64(30), summary.TotalBytes)
+
+	results = append(results, &cmd.PrefixDownloadResult{Key: "a/three.txt", Size: 30, Result: "Failed", Error: "oops"})
+	summary = cmd.NewPrefixDownloadSummary("a/", "/tmp", results)
+	assert.Equal(t, "Failed", summary.Result)
+	assert.Equal(t, 2, summary.FileCount)
+	assert.Equal(t, 1, summary.FailedCount)
+	assert.Equal(t, int64(30), summary.TotalBytes)
+
+	// Skipped files don't fail the download, and don't count as
+	// downloaded.
+	results[2].Result = "Skipped"
+	summary = cmd.NewPrefixDownloadSummary("a/", "/tmp", results)
+	assert.Equal(t, "OK", summary.Result)
+	assert.Equal(t, 2, summary.FileCount)
+	assert.Equal(t, 1, summary.SkippedCount)
+	assert.Equal(t, 0, summary.FailedCount)
+	assert.Equal(t, int64(30), summary.TotalBytes)
+}
+
+func TestLocalFileMatchesObject(t *testing.T) {
+	filePath := filepath.Join(t.TempDir(), "file.txt")
+	objInfo := minio.ObjectInfo{Key: "file.txt", Size: 4, ETag: "8d777f385d3dfec8815d20f7496026dc"}
+	matches, err := cmd.LocalFileMatchesObject(filePath, objInfo, true, 0)
+	require.Nil(t, err)
+	assert.False(t, matches, "missing file")
+
+	require.Nil(t, os.WriteFile(filePath, []byte("data"), 0644))
+	for _, verify := range []bool{false, true} {
+		matches, err = cmd.LocalFileMatchesObject(filePath, objInfo, verify, 0)
+		require.Nil(t, err)
+		assert.True(t, matches, verify)
+	}
+
+	// Only --verify catches a file of the right size with the wrong
+	// contents.
+	require.Nil(t, os.WriteFile(filePath, []byte("date"), 0644))
+	matches, _ = cmd.LocalFileMatchesObject(filePath, objInfo, false, 0)
+	assert.True(t, matches)
+	matches, err = cmd.LocalFileMatchesObject(filePath, objInfo, true, 0)
+	require.Nil(t, err)
+	assert.False(t, matches)
+
+	require.Nil(t, os.WriteFile(filePath, []byte("data, and more"), 0644))
+	matches, _ = cmd.LocalFileMatchesObject(filePath, objInfo, false, 0)
+	assert.False(t, matches, "wrong size")
+
+	// A download that never finished doesn't match, even at full size.
+	require.Nil(t, os.WriteFile(filePath, []byte("data"), 0644))
+	require.Nil(t, os.WriteFile(cmd.DownloadStatePath(filePath), []byte("{}"), 0644))
+	matches, _ = cmd.LocalFileMatchesObject(filePath, objInfo, false, 0)
+	assert.False(t, matches, "unfinished download")
+}
+
+func TestS3DownloadSkipExistingVerify(t *testing.T) {
+	// Our local minio doesn't return MD5 ETags, so serve an object
+	// whose ETag is its real MD5 digest.
+	content := "0123456789"
+	digest := md5.Sum([]byte(content))
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", fmt.Sprintf(`"%s"`, hex.EncodeToString(digest[:])))
+		http.ServeContent(w, r, "", time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), strings.NewReader(content))
+	}))
+	defer server.Close()
+	configFile := filepath.Join(t.TempDir(), "s3.env")
+	require.Nil(t, os.WriteFile(configFile, []byte("APTRUST_AWS_KEY=key\nAPTRUST_AWS_SECRET=secret\nAPTRUST_AWS_REGION=us-east-1\nAPTRUST_S3_PATH_STYLE=true\n"), 0644))
+	saveAs := filepath.Join(t.TempDir(), "object.txt")
+	args := []string{"run", "../main.go", "s3", "download", "--config=" + configFile, "--host=" + strings.TrimPrefix(server.URL, "http://"),
+		"--bucket=bucket", "--key=object.txt", "--save-as=" + saveAs, "--skip-existing"}
+
+	// Same size, different contents: only --verify notices.
+	require.Nil(t, os.WriteFile(saveAs, []byte("X123456789"), 0644))
+	exitCode, stdout, stderr := execCmd(t, "go", args...)
+	require.Equal(t, cmd.EXIT_OK, exitCode, stderr)
+	assert.Contains(t, stdout, `"result": "Skipped"`)
+
+	exitCode, stdout, stderr = execCmd(t, "go", append(args, "--verify")...)
+	require.Equal(t, cmd.EXIT_OK, exitCode, stderr)
+	assert.Contains(t, stdout, `"result": "OK"`)
+	data, err := os.ReadFile(saveAs)
+	require.Nil(t, err)
+	assert.Equal(t, content, string(data))
+
+	exitCode, stdout, stderr = execCmd(t, "go", append(args, "--verify")...)
+	require.Equal(t, cmd.EXIT_OK, exitCode, stderr)
+	assert.Contains(t, stdout, `"result": "Skipped"`)
+	assert.Contains(t, stdout, `"etagVerified": true`)
+}
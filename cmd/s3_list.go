@@ -1,13 +1,13 @@
 package cmd
 
 import (
-	"context"
 	"encoding/json"
 	"fmt"
 	"os"
 	"strconv"
 	"time"
 
+	"github.com/APTrust/dart-runner/util"
 	"github.com/dustin/go-humanize"
 	"github.com/minio/minio-go/v7"
 	"github.com/spf13/cobra"
@@ -15,13 +15,19 @@ import (
 
 // s3ListCmd represents the list bucket command
 var s3ListCmd = &cobra.Command{
-	Use:   "list",
-	Short: "List items in an S3 bucket",
+	Use:     "list",
+	Short:   "List items in an S3 bucket",
+	Example: `apt-cmd s3 list --host=s3.amazonaws.com --bucket=my-bucket --prefix=photos/ --maxitems=10 --format=json`,
 	Long: `You can list files from any S3-compatible service. For this to
 work, you will need to have APTRUST_AWS_KEY and APTRUST_AWS_SECRET set in
 your environment, or in a config file specified with the --config flag.
 
 List output is in JSON format, unless you specify --format=text.
+--format=jsonl prints one line of JSON per object, with just its key,
+size, lastModified and etag, which is easy to feed into scripts that
+download each object with apt-cmd s3 download.
+Text output shows sizes in SI units (1 kB = 1000 bytes) unless you
+specify --size-units=iec (1 KiB = 1024 bytes).
 
 Examples:
 
@@ -48,6 +54,17 @@ List items in a nested folder. Again, note the trailing slash:
                     --bucket=my_bucket \
                     --prefix=music/danielle_ponder/
 
+Print the keys of up to 100 tar files under "bags/", one per line, and
+download each of them:
+
+    apt-cmd s3 list --host=s3.amazonaws.com \
+                    --bucket=my_bucket \
+                    --prefix=bags/ \
+                    --max=100 \
+                    --format=jsonl | jq -r .key | grep '\.tar$' | \
+      while read key; do
+        apt-cmd s3 download --host=s3.amazonaws.com --bucket=my_bucket --key="$key"
+      done
 
 Full online documentation:
 
@@ -57,16 +74,14 @@ Full online documentation:
 	Run: func(cmd *cobra.Command, args []string) {
 		bucket := cmd.Flags().Lookup("bucket").Value.String()
 		if bucket == "" {
-			fmt.Fprintln(os.Stderr, "Missing required param --bucket")
-			os.Exit(EXIT_USER_ERR)
+			Fail(EXIT_USER_ERR, "Missing required param --bucket")
 		}
 		s3Host := cmd.Flags().Lookup("host").Value.String()
 		if s3Host == "" {
-			fmt.Fprintln(os.Stderr, "Missing required param --host")
-			os.Exit(EXIT_USER_ERR)
+			Fail(EXIT_USER_ERR, "Missing required param --host")
 		}
 		format := cmd.Flags().Lookup("format").Value.String()
-		if format != "" && format != "text" && format != "json" {
+		if format != "" && !util.StringListContains(S3ListOutputFormats, format) {
 			fmt.Fprintln(os.Stderr, "Unknown format:", format, ". Defaulting to json.")
 		}
 		prefix := cmd.Flags().Lookup("prefix").Value.String()
@@ -75,12 +90,18 @@ Full online documentation:
 			maxKeys = 50
 			logger.Debug("Could not parse maxitems. Defaulting to 50.")
 		}
+		if cmd.Flags().Changed("max") {
+			maxKeys, _ = cmd.Flags().GetInt("max")
+		}
+		if maxKeys < 1 {
+			Fail(EXIT_USER_ERR, "--max must be one or greater")
+		}
 		logger.Debugf("Listing up to %d items from %s/%s with prefix '%s'", maxKeys, s3Host, bucket, prefix)
 		client := NewS3Client(config, s3Host)
 
 		doneCh := make(chan struct{})
 		defer close(doneCh)
-		objectCh := client.ListObjects(context.Background(), bucket, minio.ListObjectsOptions{
+		objectCh := client.ListObjects(cmd.Context(), bucket, minio.ListObjectsOptions{
 			Prefix:    prefix,
 			Recursive: false,
 			MaxKeys:   maxKeys,
@@ -90,15 +111,20 @@ Full online documentation:
 		for obj := range objectCh {
 			objCount += 1
 			if obj.Err != nil {
+				ExitIfCanceled(cmd.Context())
 				fmt.Fprintf(os.Stderr, "Error reading %s: %v", bucket, obj.Err)
 				continue
 			}
 			if format == "text" {
 				fmt.Println("Key:     ", obj.Key)
 				fmt.Println("Etag:    ", obj.ETag)
-				fmt.Println("Size:    ", humanize.Comma(obj.Size), "(", humanize.Bytes(uint64(obj.Size)), ")")
+				fmt.Println("Size:    ", humanize.Comma(obj.Size), "(", FormatSize(obj.Size, sizeUnits), ")")
 				fmt.Println("Modified:", obj.LastModified.Format(time.RFC3339))
 				fmt.Println("----------------------------------------------------")
+			} else if format == "jsonl" {
+				// Marshalling this struct can't fail.
+				data, _ := json.Marshal(NewS3ListEntry(obj))
+				fmt.Println(string(data))
 			} else {
 				data, err := json.MarshalIndent(obj, "", "  ")
 				if err != nil {
@@ -124,5 +150,26 @@ func init() {
 	s3ListCmd.Flags().StringP("bucket", "b", "", "Bucket to list")
 	s3ListCmd.Flags().StringP("prefix", "p", "", "List objects with this prefix")
 	s3ListCmd.Flags().IntP("maxitems", "m", 50, "Maximum number of items to list (default = 50)")
-	s3ListCmd.Flags().StringP("format", "f", "", "Output format: 'text' or 'json' (default = 'json')")
+	s3ListCmd.Flags().Int("max", 50, "Same as --maxitems")
+	s3ListCmd.Flags().StringP("format", "f", "", "Output format: 'text', 'json' or 'jsonl' (default = 'json')")
+	registerFlagCompletion(s3ListCmd, "format", completeValues(S3ListOutputFormats...))
+}
+
+// S3ListEntry is the summary of an object that s3 list prints for
+// --format=jsonl.
+type S3ListEntry struct {
+	Key          string    `json:"key"`
+	Size         int64     `json:"size"`
+	LastModified time.Time `json:"lastModified"`
+	ETag         string    `json:"etag"`
+}
+
+// NewS3ListEntry returns the summary of obj.
+func NewS3ListEntry(obj minio.ObjectInfo) S3ListEntry {
+	return S3ListEntry{
+		Key:          obj.Key,
+		Size:         obj.Size,
+		LastModified: obj.LastModified,
+		ETag:         obj.ETag,
+	}
 }
@@ -0,0 +1,86 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// DefaultPresignExpires is how long presigned URLs last if the user
+// doesn't specify --expires.
+const DefaultPresignExpires = time.Hour
+
+// MaxPresignExpires is the longest S3 lets a presigned URL last.
+const MaxPresignExpires = 7 * 24 * time.Hour
+
+var s3presignCmd = &cobra.Command{
+	Use:     "presign",
+	Short:   "Print a time-limited download URL for an S3 object",
+	Example: `apt-cmd s3 presign --host=s3.amazonaws.com --bucket=my-bucket --key=my_bag.tar --expires=24h`,
+	Long: `Print a presigned URL that lets anyone who has it download an object
+from any S3-compatible service, without credentials, until the URL
+expires. For this to work, you will need to have APTRUST_AWS_KEY and
+APTRUST_AWS_SECRET set in your environment, or in a config file
+specified with the --config flag. The URL works only as long as those
+credentials can read the object.
+
+--expires says how long the URL lasts, such as 30m, 12h or 168h. It
+defaults to 1h, and can be at most 168h (7 days), which is the limit
+S3 sets. URLs signed with temporary credentials stop working when the
+credentials expire, even if that's sooner.
+
+Example:
+
+Print a URL for photo.jpg in my-bucket on AWS S3 that lasts one day:
+
+    apt-cmd s3 presign --host=s3.amazonaws.com --bucket="my-bucket" \
+        --key='photo.jpg' --expires=24h
+
+Full online documentation:
+
+  https://aptrust.github.io/userguide/partner_tools/
+
+	`,
+	Run: func(cmd *cobra.Command, args []string) {
+		s3Host := GetFlagValue(cmd.Flags(), "host", "Missing required param --host")
+		bucket := GetFlagValue(cmd.Flags(), "bucket", "Missing required param --bucket")
+		key := GetFlagValue(cmd.Flags(), "key", "Missing required param --key")
+		expires, _ := cmd.Flags().GetDuration("expires")
+		err := ValidatePresignExpires(expires)
+		if err != nil {
+			Fail(EXIT_USER_ERR, err.Error())
+		}
+
+		logger.Debugf("Presigning object %s in %s/%s for %s", key, s3Host, bucket, expires)
+		client := NewS3Client(config, s3Host)
+		presignedURL, err := client.PresignedGetObject(cmd.Context(), bucket, key, expires, nil)
+		if err != nil {
+			ExitIfCanceled(cmd.Context())
+			Fail(EXIT_REQUEST_ERROR, "Error presigning URL: ", err)
+		}
+		fmt.Println(presignedURL.String())
+		os.Exit(EXIT_OK)
+	},
+}
+
+func init() {
+	s3Cmd.AddCommand(s3presignCmd)
+	s3presignCmd.Flags().StringP("host", "H", "", "S3 host name. E.g. s3.amazonaws.com.")
+	s3presignCmd.Flags().StringP("bucket", "b", "", "Bucket containing the object")
+	s3presignCmd.Flags().StringP("key", "k", "", "Key (name of object) to presign")
+	s3presignCmd.Flags().Duration("expires", DefaultPresignExpires, "How long the URL lasts, e.g. 30m or 24h. At most 168h (7 days).")
+}
+
+// ValidatePresignExpires returns an error if expires is out of the range
+// S3 allows for presigned URLs, which is one second to seven days.
+func ValidatePresignExpires(expires time.Duration) error {
+	if expires < time.Second {
+		return fmt.Errorf("--expires must be at least 1s")
+	}
+	if expires > MaxPresignExpires {
+		return fmt.Errorf("--expires can be at most 168h (7 days), which is the longest S3 allows")
+	}
+	return nil
+}
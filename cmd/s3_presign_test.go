@@ -0,0 +1,30 @@
+package cmd_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/APTrust/apt-cmd/cmd"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidatePresignExpires(t *testing.T) {
+	assert.Nil(t, cmd.ValidatePresignExpires(time.Second))
+	assert.Nil(t, cmd.ValidatePresignExpires(cmd.DefaultPresignExpires))
+	assert.Nil(t, cmd.ValidatePresignExpires(cmd.MaxPresignExpires))
+	assert.EqualError(t, cmd.ValidatePresignExpires(0), "--expires must be at least 1s")
+	assert.EqualError(t, cmd.ValidatePresignExpires(-time.Hour), "--expires must be at least 1s")
+	assert.EqualError(t, cmd.ValidatePresignExpires(cmd.MaxPresignExpires+time.Second), "--expires can be at most 168h (7 days), which is the longest S3 allows")
+}
+
+func TestS3PresignInvalidExpires(t *testing.T) {
+	exitCode, stdout, stderr := execCmd(t, "go", "run", "../main.go", "s3", "presign", "--host=127.0.0.1:9899", "--bucket=test-bucket-1", "--key=config.go", "--expires=8d", "--config=../testconfig.env")
+	assert.NotEqual(t, 0, exitCode)
+	assert.Empty(t, stdout)
+	assert.Contains(t, stderr, "--expires")
+
+	exitCode, stdout, stderr = execCmd(t, "go", "run", "../main.go", "s3", "presign", "--host=127.0.0.1:9899", "--bucket=test-bucket-1", "--key=config.go", "--expires=200h", "--config=../testconfig.env")
+	assert.NotEqual(t, 0, exitCode)
+	assert.Empty(t, stdout)
+	assert.Contains(t, stderr, "--expires can be at most 168h")
+}
@@ -0,0 +1,153 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/op/go-logging"
+	"github.com/spf13/pflag"
+)
+
+// Defaults for s3 download's --retries and --retry-backoff flags.
+const (
+	DefaultS3Retries      = 3
+	DefaultS3RetryBackoff = time.Second
+)
+
+// S3RetryPolicy says how many times to retry an S3 download that fails
+// with a timeout, a lost connection or a 5xx response. The wait before
+// each retry is Backoff, doubled after each attempt. The zero policy
+// doesn't retry.
+type S3RetryPolicy struct {
+	Retries int
+	Backoff time.Duration
+	Logger  *logging.Logger
+}
+
+// GetS3RetryPolicy returns the policy from a command's --retries and
+// --retry-backoff flags. This exits with EXIT_USER_ERR if either is
+// negative.
+func GetS3RetryPolicy(flags *pflag.FlagSet) S3RetryPolicy {
+	policy := S3RetryPolicy{Logger: logger}
+	policy.Retries, _ = flags.GetInt("retries")
+	policy.Backoff, _ = flags.GetDuration("retry-backoff")
+	if policy.Retries < 0 || policy.Backoff < 0 {
+		Fail(EXIT_USER_ERR, "Flags --retries and --retry-backoff can't be negative.")
+	}
+	return policy
+}
+
+// CopyObject copies length bytes of key, starting at byte start, to
+// writer, and returns the number of bytes it copied. If the download
+// fails with an error that IsRetryableS3Error accepts, this asks for
+// the rest of the bytes again, starting after the last one it copied,
+// so the writer gets every byte once, in order. If etag isn't empty,
+// S3 sends the bytes only if the object still has that ETag, so a
+// retry can't mix the bytes of two versions of the object. Unlike the
+// registry's policy, this returns ctx.Err() if ctx is canceled, so the
+// caller can clean up.
+func (policy S3RetryPolicy) CopyObject(ctx context.Context, client *minio.Client, bucket, key, etag string, start, length int64, writer io.Writer) (int64, error) {
+	if policy.Logger == nil {
+		policy.Logger = logging.MustGetLogger("aptrust")
+	}
+	copied := int64(0)
+	for attempt := 0; ; attempt++ {
+		n, err := copyObjectRange(ctx, client, bucket, key, etag, start+copied, length-copied, writer)
+		copied += n
+		if err == nil {
+			return copied, nil
+		}
+		if ctx.Err() != nil {
+			return copied, ctx.Err()
+		}
+		if attempt >= policy.Retries || !IsRetryableS3Error(err) {
+			return copied, err
+		}
+		wait := policy.Backoff << attempt
+		policy.Logger.Warningf("Download of %s failed at byte %d: %s. Retry %d of %d in %s.", key, start+copied, err, attempt+1, policy.Retries, wait)
+		select {
+		case <-ctx.Done():
+			return copied, ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+}
+
+// ErrRangeIgnored means S3 sent something other than the byte range we
+// asked for, as servers that don't support ranged GETs do by sending
+// the whole object. Retrying won't help.
+var ErrRangeIgnored = errors.New("server ignored the requested byte range")
+
+// copyObjectRange makes one request for length bytes of key, starting
+// at byte start, and copies them to writer. Getting fewer bytes than
+// that is an io.ErrUnexpectedEOF, since it means S3 or the network
+// dropped the connection. The response must be a 206 whose
+// Content-Range is the range we asked for, or a 200 with exactly
+// length bytes, if we asked for the whole object. Anything else is an
+// ErrRangeIgnored, and nothing is copied.
+func copyObjectRange(ctx context.Context, client *minio.Client, bucket, key, etag string, start, length int64, writer io.Writer) (int64, error) {
+	if length <= 0 {
+		return 0, nil
+	}
+	opts := minio.GetObjectOptions{}
+	end := start + length - 1
+	if err := opts.SetRange(start, end); err != nil {
+		return 0, err
+	}
+	if etag != "" {
+		if err := opts.SetMatchETag(etag); err != nil {
+			return 0, err
+		}
+	}
+	body, objInfo, header, err := minio.Core{Client: client}.GetObject(ctx, bucket, key, opts)
+	if err != nil {
+		return 0, err
+	}
+	defer body.Close()
+	contentRange := header.Get("Content-Range")
+	if contentRange == "" {
+		if start != 0 || objInfo.Size != length {
+			return 0, fmt.Errorf("asked for bytes %d-%d, got %d bytes with no Content-Range: %w", start, end, objInfo.Size, ErrRangeIgnored)
+		}
+	} else if !strings.HasPrefix(contentRange, fmt.Sprintf("bytes %d-%d/", start, end)) {
+		return 0, fmt.Errorf("asked for bytes %d-%d, got %s: %w", start, end, contentRange, ErrRangeIgnored)
+	}
+	copied, err := io.Copy(writer, io.LimitReader(body, length))
+	if err == nil && copied < length {
+		err = fmt.Errorf("got %d of %d bytes: %w", copied, length, io.ErrUnexpectedEOF)
+	}
+	return copied, err
+}
+
+// IsRetryableS3Error returns true if err is an S3 failure that might
+// succeed if we try again: a timeout, a lost or refused connection, a
+// request S3 asked us to slow down on, or a 5xx response. Other errors,
+// like 403s, 404s and ETags that no longer match, will fail the same
+// way every time.
+func IsRetryableS3Error(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) {
+		return false
+	}
+	if resp := minio.ToErrorResponse(err); resp.StatusCode != 0 {
+		return resp.StatusCode >= http.StatusInternalServerError ||
+			resp.StatusCode == http.StatusRequestTimeout ||
+			resp.StatusCode == http.StatusTooManyRequests ||
+			resp.Code == "SlowDown" || resp.Code == "RequestTimeout"
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	return errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, syscall.EPIPE)
+}
@@ -0,0 +1,103 @@
+package cmd_test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/APTrust/apt-cmd/cmd"
+	"github.com/minio/minio-go/v7"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIsRetryableS3Error(t *testing.T) {
+	assert.False(t, cmd.IsRetryableS3Error(nil))
+	assert.False(t, cmd.IsRetryableS3Error(context.Canceled))
+	assert.False(t, cmd.IsRetryableS3Error(minio.ErrorResponse{StatusCode: http.StatusNotFound, Code: "NoSuchKey"}))
+	assert.False(t, cmd.IsRetryableS3Error(minio.ErrorResponse{StatusCode: http.StatusForbidden, Code: "AccessDenied"}))
+	assert.False(t, cmd.IsRetryableS3Error(minio.ErrorResponse{StatusCode: http.StatusPreconditionFailed, Code: "PreconditionFailed"}))
+	assert.True(t, cmd.IsRetryableS3Error(minio.ErrorResponse{StatusCode: http.StatusServiceUnavailable, Code: "SlowDown"}))
+	assert.True(t, cmd.IsRetryableS3Error(minio.ErrorResponse{StatusCode: http.StatusInternalServerError, Code: "InternalError"}))
+	assert.True(t, cmd.IsRetryableS3Error(fmt.Errorf("read: %w", syscall.ECONNRESET)))
+	assert.True(t, cmd.IsRetryableS3Error(io.ErrUnexpectedEOF))
+	assert.False(t, cmd.IsRetryableS3Error(fmt.Errorf("disk full")))
+}
+
+func TestS3RetryPolicy_CopyObject(t *testing.T) {
+	content := "0123456789"
+	ranges := make([]string, 0)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/bucket/object.txt" {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `<Error><Code>NoSuchKey</Code><Message>The specified key does not exist.</Message></Error>`)
+			return
+		}
+		assert.Equal(t, `"etag"`, r.Header.Get("If-Match"))
+		ranges = append(ranges, r.Header.Get("Range"))
+		var start, end int
+		fmt.Sscanf(r.Header.Get("Range"), "bytes=%d-%d", &start, &end)
+		w.Header().Set("ETag", `"etag"`)
+		w.Header().Set("Last-Modified", time.Now().UTC().Format(http.TimeFormat))
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, len(content)))
+		w.Header().Set("Content-Length", fmt.Sprint(end-start+1))
+		w.WriteHeader(http.StatusPartialContent)
+		if len(ranges) == 1 {
+			// Drop the connection partway through the first response.
+			fmt.Fprint(w, content[start:start+4])
+			w.(http.Flusher).Flush()
+			conn, _, err := w.(http.Hijacker).Hijack()
+			require.Nil(t, err)
+			conn.Close()
+			return
+		}
+		fmt.Fprint(w, content[start:end+1])
+	}))
+	defer server.Close()
+	config := &cmd.Config{AWSKey: "key", AWSSecret: "secret", AWSRegion: "us-east-1", S3PathStyle: true}
+	client := cmd.NewS3Client(config, strings.TrimPrefix(server.URL, "http://"))
+	policy := cmd.S3RetryPolicy{Retries: 2, Backoff: time.Millisecond}
+
+	var buf bytes.Buffer
+	copied, err := policy.CopyObject(context.Background(), client, "bucket", "object.txt", "etag", 1, 9, &buf)
+	require.Nil(t, err)
+	assert.Equal(t, int64(9), copied)
+	assert.Equal(t, "123456789", buf.String())
+	// The retry asks only for the bytes we didn't get.
+	assert.Equal(t, []string{"bytes=1-9", "bytes=5-9"}, ranges)
+
+	// Without retries, the dropped connection is an error.
+	ranges = ranges[:0]
+	buf.Reset()
+	copied, err = cmd.S3RetryPolicy{}.CopyObject(context.Background(), client, "bucket", "object.txt", "etag", 0, 10, &buf)
+	require.NotNil(t, err)
+	assert.True(t, cmd.IsRetryableS3Error(err), err)
+	assert.Equal(t, int64(4), copied)
+
+	// A server that ignores the range can't be trusted to resume.
+	ignoring := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"etag"`)
+		w.Header().Set("Last-Modified", time.Now().UTC().Format(http.TimeFormat))
+		fmt.Fprint(w, content)
+	}))
+	defer ignoring.Close()
+	buf.Reset()
+	copied, err = policy.CopyObject(context.Background(), cmd.NewS3Client(config, strings.TrimPrefix(ignoring.URL, "http://")), "bucket", "object.txt", "etag", 5, 5, &buf)
+	require.NotNil(t, err)
+	assert.ErrorIs(t, err, cmd.ErrRangeIgnored)
+	assert.False(t, cmd.IsRetryableS3Error(err))
+	assert.Equal(t, int64(0), copied)
+	assert.Empty(t, buf.String())
+
+	// A missing object isn't retried.
+	_, err = policy.CopyObject(context.Background(), client, "bucket", "missing.txt", "etag", 0, 10, &buf)
+	require.NotNil(t, err)
+	assert.Equal(t, http.StatusNotFound, minio.ToErrorResponse(err).StatusCode)
+}
@@ -1,11 +1,10 @@
 package cmd
 
 import (
-	"context"
-	"encoding/json"
 	"fmt"
 	"os"
 	"path"
+	"time"
 
 	"github.com/minio/minio-go/v7"
 	"github.com/spf13/cobra"
@@ -13,29 +12,65 @@ import (
 
 // s3uploadCmd represents the s3upload command
 var s3uploadCmd = &cobra.Command{
-	Use:   "upload",
-	Short: "Upload a file to an S3-compatible service",
+	Use:     "upload",
+	Short:   "Upload a file to an S3-compatible service",
+	Example: `apt-cmd s3 upload --host=s3.amazonaws.com --bucket=my-bucket --key=my_bag.tar /path/to/my_bag.tar`,
 	Long: `Upload a file to any S3-compatible service. For this to work,
-you will need to have APTRUST_AWS_KEY and APTRUST_AWS_SECRET set in your 
+you will need to have APTRUST_AWS_KEY and APTRUST_AWS_SECRET set in your
 environment, or in a config file specified with the --config flag.
-	
+
 Examples:
-	
+
 Upload file photo.jpg to Amazon's S3 service:
-	
-    apt-cmd s3 upload --host=s3.amazonaws.com --bucket="my-bucket" photo.jpg 
-	
+
+    apt-cmd s3 upload --host=s3.amazonaws.com --bucket="my-bucket" photo.jpg
+
 Upload the same file, but call it renamed.jpg in S3:
-	
+
     apt-cmd s3 upload --host=s3.amazonaws.com  \
              --bucket="my-bucket" \
              --key='renamed.jpg' \
              photo.jpg
 
+Object Lock:
+
+Buckets with S3 Object Lock enabled can retain uploads so they can't be
+overwritten or deleted until a given date. Use --retention-mode and
+--retain-until together to set retention, and --legal-hold to put a
+legal hold on the object, which lasts until someone removes it.
+
+    apt-cmd s3 upload --host=s3.amazonaws.com \
+             --bucket="my-locked-bucket" \
+             --retention-mode=GOVERNANCE \
+             --retain-until=2030-01-31 \
+             photo.jpg
+
+In GOVERNANCE mode, users with special permissions can shorten or remove
+retention. In COMPLIANCE mode, no one can, not even the account's root
+user, and you'll pay to store the object until the retention date. Be
+sure that's what you want.
+
+Before uploading, we check that the bucket has Object Lock enabled, and
+refuse to upload if it doesn't. After uploading, we read the settings
+back from S3 and include them in the output as "objectLock". If S3
+doesn't confirm them, "confirmed" is false and "objectLock" shows the
+settings we requested.
+
+Bandwidth:
+
+To avoid saturating a shared link, add --rate-limit with a rate such as
+10MB/s or 500KiB/s. The limit applies to the whole upload, however many
+--concurrency threads send its parts. The default is no limit.
+
+    apt-cmd s3 upload --host=s3.amazonaws.com \
+             --bucket="my-bucket" \
+             --rate-limit=10MB/s \
+             my_bag.tar
+
 Full online documentation:
 
   https://aptrust.github.io/userguide/partner_tools/
-						  
+
 	`,
 	Run: func(cmd *cobra.Command, args []string) {
 		config.ValidateAWSCredentials()
@@ -44,24 +79,20 @@ Full online documentation:
 			file = args[0]
 		}
 		if file == "" {
-			fmt.Fprintln(os.Stderr, "Missing required arg file")
-			os.Exit(EXIT_USER_ERR)
+			Fail(EXIT_USER_ERR, "Missing required arg file")
 		}
 		fstat, err := os.Stat(file)
 		if err != nil {
-			fmt.Fprintln(os.Stderr, "File", file, "is missing or unreadable")
-			os.Exit(EXIT_USER_ERR)
+			Fail(EXIT_USER_ERR, "File", file, "is missing or unreadable")
 		}
 		if fstat.IsDir() {
-			fmt.Fprintln(os.Stderr, "File", file, "is a directory")
-			os.Exit(EXIT_USER_ERR)
+			Fail(EXIT_USER_ERR, "File", file, "is a directory")
 		}
 		s3Host := GetFlagValue(cmd.Flags(), "host", "Missing required param --host")
 		bucket := GetFlagValue(cmd.Flags(), "bucket", "Missing required param --bucket")
 
 		if LooksLikePreservationBucket(bucket) {
-			fmt.Fprintln(os.Stderr, "Upload to preservation bucket not allowed")
-			os.Exit(EXIT_USER_ERR)
+			Fail(EXIT_USER_ERR, "Upload to preservation bucket not allowed")
 		}
 
 		key := cmd.Flags().Lookup("key").Value.String()
@@ -69,19 +100,45 @@ Full online documentation:
 			key = path.Base(file)
 		}
 
-		logger.Debugf("Uploading file %s to %s/%s/%s", file, s3Host, bucket, key)
-		client := NewS3Client(config, s3Host)
-		uploadInfo, err := client.FPutObject(context.Background(), bucket, key, file, minio.PutObjectOptions{})
+		retainUntil := cmd.Flags().Lookup("retain-until").Value.String()
+		retentionMode := cmd.Flags().Lookup("retention-mode").Value.String()
+		legalHold, _ := cmd.Flags().GetBool("legal-hold")
+		objectLock, err := ParseObjectLock(retentionMode, retainUntil, legalHold, time.Now())
 		if err != nil {
-			fmt.Fprintln(os.Stderr, "Error uploading file:", err)
-			os.Exit(EXIT_REQUEST_ERROR)
+			Fail(EXIT_USER_ERR, err.Error())
+		}
+
+		numThreads := GetConcurrency(cmd.Flags())
+		limiter := GetRateLimiter(cmd.Flags())
+		client := NewS3Client(config, s3Host)
+		putOptions := minio.PutObjectOptions{NumThreads: uint(numThreads)}
+		if limiter != nil {
+			putOptions.Progress = limiter.ProgressReader(cmd.Context())
+		}
+		if objectLock != nil {
+			// Retention can't be undone, so check before we upload.
+			if err = CheckBucketObjectLock(cmd.Context(), client, bucket); err != nil {
+				ExitIfCanceled(cmd.Context())
+				Fail(EXIT_USER_ERR, err.Error())
+			}
+			objectLock.Apply(&putOptions)
+			logger.Debugf("Object Lock: mode %s, retain until %s, legal hold %t", objectLock.Mode, objectLock.RetainUntil, objectLock.LegalHold)
 		}
-		data, err := json.MarshalIndent(uploadInfo, "", "  ")
+		logger.Debugf("Uploading file %s to %s/%s/%s using %d threads", file, s3Host, bucket, key, numThreads)
+		uploadInfo, err := client.FPutObject(cmd.Context(), bucket, key, file, putOptions)
 		if err != nil {
-			fmt.Fprintln(os.Stderr, "Error serializing JSON response from S3 server:", err)
-			os.Exit(EXIT_RUNTIME_ERR)
+			ExitIfCanceled(cmd.Context())
+			Fail(EXIT_REQUEST_ERROR, "Error uploading file:", err)
 		}
-		fmt.Println(string(data))
+		result := &uploadResult{UploadInfo: uploadInfo}
+		if objectLock != nil {
+			result.ObjectLock, err = GetAppliedObjectLock(cmd.Context(), client, bucket, key, uploadInfo.VersionID)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "File was uploaded, but S3 did not confirm its Object Lock settings:", err)
+				result.ObjectLock = objectLock.Requested()
+			}
+		}
+		printResult(result)
 		os.Exit(EXIT_OK)
 
 	},
@@ -92,4 +149,15 @@ func init() {
 	s3uploadCmd.Flags().StringP("host", "H", "", "S3 host name. E.g. s3.amazonaws.com.")
 	s3uploadCmd.Flags().StringP("bucket", "b", "", "Bucket to upload from")
 	s3uploadCmd.Flags().StringP("key", "k", "", "Key (name of object) to download")
+	s3uploadCmd.Flags().String("retention-mode", "", "Object Lock retention mode: GOVERNANCE or COMPLIANCE. Requires --retain-until.")
+	s3uploadCmd.Flags().String("retain-until", "", "Retain the object until this date, e.g. 2030-01-31 or 2030-01-31T12:00:00Z. Requires --retention-mode.")
+	s3uploadCmd.Flags().Bool("legal-hold", false, "Put an Object Lock legal hold on the object")
+	s3uploadCmd.Flags().String("rate-limit", "", "Limit the upload to this rate, e.g. 10MB/s, shared by all --concurrency upload threads. The default is no limit.")
+}
+
+// uploadResult is the JSON output of s3 upload. ObjectLock is set
+// only if the user asked for Object Lock settings.
+type uploadResult struct {
+	minio.UploadInfo
+	ObjectLock *AppliedObjectLock `json:"objectLock,omitempty"`
 }
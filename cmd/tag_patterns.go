@@ -0,0 +1,84 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sync"
+
+	"github.com/APTrust/dart-runner/bagit"
+)
+
+// tagPatterns holds the regular expressions that a profile's tag values
+// must match, keyed by profile, then by tag file and tag name. The
+// bagit package's tag definitions have no place for a pattern, so we
+// keep them here. Most profiles have none.
+var tagPatterns = make(map[*bagit.Profile]map[string]string)
+var tagPatternsMutex sync.RWMutex
+
+// SetTagPattern requires values of the tag tagFile/tagName in profile
+// to match the regular expression pattern, as ValidateTags checks. The
+// pattern matches anywhere in the value, so use ^ and $ to match all of
+// it. An empty pattern removes the requirement. A tag can have a
+// pattern or a list of allowed values, but not both. ValidateProfile
+// checks that, and that the pattern compiles.
+func SetTagPattern(profile *bagit.Profile, tagFile, tagName, pattern string) {
+	tagPatternsMutex.Lock()
+	defer tagPatternsMutex.Unlock()
+	key := tagFile + "/" + tagName
+	if pattern == "" {
+		delete(tagPatterns[profile], key)
+		return
+	}
+	if tagPatterns[profile] == nil {
+		tagPatterns[profile] = make(map[string]string)
+	}
+	tagPatterns[profile][key] = pattern
+}
+
+// TagPattern returns the pattern that values of the tag tagFile/tagName
+// in profile must match, or an empty string if they needn't match one.
+func TagPattern(profile *bagit.Profile, tagFile, tagName string) string {
+	tagPatternsMutex.RLock()
+	defer tagPatternsMutex.RUnlock()
+	return tagPatterns[profile][tagFile+"/"+tagName]
+}
+
+// tagPatternProblem describes the problem if value doesn't match the
+// pattern of tagDef in profile, as ValidateTags reports it, or returns
+// an empty string. Empty values aren't checked here. Whether a tag can
+// be empty is up to its Required and EmptyOK settings.
+func tagPatternProblem(profile *bagit.Profile, tagDef *bagit.TagDefinition, value string) string {
+	pattern := TagPattern(profile, tagDef.TagFile, tagDef.TagName)
+	if pattern == "" || value == "" {
+		return ""
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return fmt.Sprintf("Tag %s/%s has an invalid pattern %s: %v.", tagDef.TagFile, tagDef.TagName, pattern, err)
+	}
+	if !re.MatchString(value) {
+		return fmt.Sprintf("Tag %s/%s assigned illegal value '%s'. Values must match the pattern %s.", tagDef.TagFile, tagDef.TagName, value, pattern)
+	}
+	return ""
+}
+
+// readDARTTagPatterns records the patterns of the tags in a DART
+// profile's JSON, data, for profile. Each tag definition may have one
+// in its "pattern" field, which bagit.TagDefinition doesn't read.
+func readDARTTagPatterns(profile *bagit.Profile, data []byte) error {
+	var withPatterns struct {
+		Tags []struct {
+			TagFile string `json:"tagFile"`
+			TagName string `json:"tagName"`
+			Pattern string `json:"pattern"`
+		} `json:"tags"`
+	}
+	if err := json.Unmarshal(data, &withPatterns); err != nil {
+		return err
+	}
+	for _, tag := range withPatterns.Tags {
+		SetTagPattern(profile, tag.TagFile, tag.TagName, tag.Pattern)
+	}
+	return nil
+}
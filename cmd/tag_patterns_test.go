@@ -0,0 +1,62 @@
+package cmd_test
+
+import (
+	"testing"
+
+	"github.com/APTrust/apt-cmd/cmd"
+	"github.com/APTrust/dart-runner/bagit"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const patternProfileJSON = `{
+  "BagIt-Profile-Info": {
+    "BagIt-Profile-Identifier": "https://example.edu/accessions.json",
+    "Source-Organization": "Example University"
+  },
+  "Bag-Info": {
+    "Accession-Number": {"required": true, "pattern": "^ACC-\\d{6}$"},
+    "Source-Organization": {"required": false}
+  },
+  "Manifests-Required": ["sha256"]
+}`
+
+func TestValidateTags_Pattern(t *testing.T) {
+	profile, err := cmd.LoadProfile(writeProfileFile(t, "accessions.json", patternProfileJSON))
+	require.Nil(t, err)
+	assert.Equal(t, `^ACC-\d{6}$`, cmd.TagPattern(profile, "bag-info.txt", "Accession-Number"))
+
+	tags := cmd.EnsureDefaultTags([]*bagit.TagDefinition{{TagFile: "bag-info.txt", TagName: "Accession-Number", UserValue: "ACC-004217"}})
+	assert.Empty(t, cmd.ValidateTags(profile, tags))
+	tags[0].UserValue = "ACC-42"
+	assert.Equal(t, []string{`Tag bag-info.txt/Accession-Number assigned illegal value 'ACC-42'. Values must match the pattern ^ACC-\d{6}$.`}, cmd.ValidateTags(profile, tags))
+
+	// Patterns don't make empty values legal.
+	tags[0].UserValue = ""
+	assert.Equal(t, []string{"Tag bag-info.txt/Accession-Number is present but value cannot be empty. Please assign a value."}, cmd.ValidateTags(profile, tags))
+}
+
+func TestValidateProfile_Patterns(t *testing.T) {
+	profile, err := cmd.LoadProfile("empty")
+	require.Nil(t, err)
+	profile.Tags = append(profile.Tags,
+		&bagit.TagDefinition{TagFile: "bag-info.txt", TagName: "Accession-Number"},
+		&bagit.TagDefinition{TagFile: "bag-info.txt", TagName: "Shelf", Values: []string{"A", "B"}},
+	)
+	cmd.SetTagPattern(profile, "bag-info.txt", "Accession-Number", "ACC-(")
+	cmd.SetTagPattern(profile, "bag-info.txt", "Shelf", "^[AB]$")
+	errors := cmd.ValidateProfile(profile)
+	assert.Contains(t, errors, "Tag bag-info.txt/Accession-Number has an invalid pattern ACC-(: error parsing regexp: missing closing ): `ACC-(`.")
+	assert.Contains(t, errors, "Tag bag-info.txt/Shelf has both a pattern and a list of allowed values. Use one or the other.")
+
+	cmd.SetTagPattern(profile, "bag-info.txt", "Accession-Number", "")
+	cmd.SetTagPattern(profile, "bag-info.txt", "Shelf", "")
+	assert.Empty(t, cmd.ValidateProfile(profile))
+
+	// DART profiles have patterns in their tag definitions.
+	pathToProfile := writeProfileFile(t, "dart.json", `{"name": "dart", "acceptBagItVersion": ["1.0"], "tags": [
+	  {"tagFile": "bag-info.txt", "tagName": "Accession-Number", "pattern": "^ACC-"}]}`)
+	profile, err = cmd.ReadProfileFile(pathToProfile)
+	require.Nil(t, err)
+	assert.Equal(t, "^ACC-", cmd.TagPattern(profile, "bag-info.txt", "Accession-Number"))
+}
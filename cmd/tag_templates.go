@@ -0,0 +1,76 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/APTrust/dart-runner/bagit"
+)
+
+// TagTemplateData is what tag values can refer to in templates, such
+// as --tags='bag-info.txt/Bagging-Date={{.Date}}'. Date is today's date,
+// like 2023-06-01, and BagName is the name of the bag being created.
+// Templates can also read environment variables with {{.Env "NAME"}}.
+type TagTemplateData struct {
+	Date    string
+	BagName string
+}
+
+// NewTagTemplateData returns the template data for a bag named bagName,
+// made today.
+func NewTagTemplateData(bagName string) *TagTemplateData {
+	return &TagTemplateData{
+		Date:    time.Now().Format("2006-01-02"),
+		BagName: bagName,
+	}
+}
+
+// Env returns the value of the environment variable name. It returns
+// an error if the variable isn't set, so a typo in a template doesn't
+// quietly leave a tag empty.
+func (data *TagTemplateData) Env(name string) (string, error) {
+	value, ok := os.LookupEnv(name)
+	if !ok {
+		return "", fmt.Errorf("environment variable %s is not set", name)
+	}
+	return value, nil
+}
+
+// ExpandTagTemplate expands the template in a tag value with data.
+// Values without {{ are returned as they are.
+func ExpandTagTemplate(value string, data *TagTemplateData) (string, error) {
+	if !strings.Contains(value, "{{") {
+		return value, nil
+	}
+	tmpl, err := template.New("tag").Option("missingkey=error").Parse(value)
+	if err != nil {
+		return "", err
+	}
+	var out strings.Builder
+	if err = tmpl.Execute(&out, data); err != nil {
+		return "", err
+	}
+	return out.String(), nil
+}
+
+// ExpandTagTemplates returns copies of tags with the templates in their
+// values expanded with data. The error names the first tag whose
+// template is malformed or refers to something undefined.
+func ExpandTagTemplates(tags []*bagit.TagDefinition, data *TagTemplateData) ([]*bagit.TagDefinition, error) {
+	expanded := make([]*bagit.TagDefinition, len(tags))
+	for i, tag := range tags {
+		value, err := ExpandTagTemplate(tag.UserValue, data)
+		if err != nil {
+			return nil, fmt.Errorf("invalid template in tag %s/%s: %w", tag.TagFile, tag.TagName, err)
+		}
+		expanded[i] = tag
+		if value != tag.UserValue {
+			expanded[i] = tag.Copy()
+			expanded[i].UserValue = value
+		}
+	}
+	return expanded, nil
+}
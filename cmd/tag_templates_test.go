@@ -0,0 +1,103 @@
+package cmd_test
+
+import (
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/APTrust/apt-cmd/cmd"
+	"github.com/APTrust/dart-runner/bagit"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExpandTagTemplate(t *testing.T) {
+	t.Setenv("APT_CMD_TEST_BUILD", "build-42")
+	data := &cmd.TagTemplateData{Date: "2023-06-01", BagName: "photos"}
+	value, err := cmd.ExpandTagTemplate(`{{.BagName}} {{.Date}} {{.Env "APT_CMD_TEST_BUILD"}}`, data)
+	require.Nil(t, err)
+	assert.Equal(t, "photos 2023-06-01 build-42", value)
+
+	// Values without templates are left alone, even if they'd be
+	// malformed templates.
+	value, err = cmd.ExpandTagTemplate("{.Date} $HOME }}", data)
+	require.Nil(t, err)
+	assert.Equal(t, "{.Date} $HOME }}", value)
+
+	_, err = cmd.ExpandTagTemplate(`{{.Env "APT_CMD_TEST_UNSET"}}`, data)
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), "environment variable APT_CMD_TEST_UNSET is not set")
+	_, err = cmd.ExpandTagTemplate("{{.Time}}", data)
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), "can't evaluate field Time")
+	_, err = cmd.ExpandTagTemplate("{{.Date", data)
+	assert.NotNil(t, err)
+}
+
+func TestGetTagValues_Templates(t *testing.T) {
+	tags, err := cmd.GetTagValues([]string{"Bagging-Date={{.Date}}"})
+	require.Nil(t, err)
+	// The value is expanded for each bag, when its name is known.
+	assert.Equal(t, "{{.Date}}", tags[0].UserValue)
+
+	_, err = cmd.GetTagValues([]string{"Title={{.Nope}}"})
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), "invalid template in tag bag-info.txt/Title")
+}
+
+func TestRunBagCreate_TagTemplates(t *testing.T) {
+	opts := newBagCreateOptions(t)
+	opts.Tags = append(opts.Tags,
+		&bagit.TagDefinition{TagFile: "bag-info.txt", TagName: "Bagging-Date", UserValue: "{{.Date}}"},
+		&bagit.TagDefinition{TagFile: "bag-info.txt", TagName: "External-Identifier", UserValue: "{{.BagName}}-1"},
+	)
+	_, err := cmd.RunBagCreate(opts)
+	require.Nil(t, err, err)
+	bagInfo := tarFileContent(t, opts.OutputFile, "library/bag-info.txt")
+	assert.Contains(t, bagInfo, "Bagging-Date: "+time.Now().Format("2006-01-02")+"\n")
+	assert.Contains(t, bagInfo, "External-Identifier: library-1\n")
+	// The caller's tags keep their templates.
+	assert.Equal(t, "{{.BagName}}-1", opts.Tags[len(opts.Tags)-1].UserValue)
+
+	// A templated Bagging-Date pins a reproducible bag's timestamp.
+	opts = newBagCreateOptions(t)
+	opts.Reproducible = true
+	opts.Tags = append(opts.Tags, &bagit.TagDefinition{TagFile: "bag-info.txt", TagName: "Bagging-Date", UserValue: "{{.Date}}"})
+	assert.Nil(t, opts.Validate())
+}
+
+func TestBagCreate_TagTemplateFlag(t *testing.T) {
+	// The template's quotes have to survive flag parsing.
+	t.Setenv("APT_CMD_TEST_BUILD", "build-42")
+	tmpFile := path.Join(t.TempDir(), "templates.tar")
+	bagDir := path.Join(t.TempDir(), "files")
+	require.Nil(t, os.Mkdir(bagDir, 0755))
+	require.Nil(t, os.WriteFile(path.Join(bagDir, "file.txt"), []byte("data"), 0644))
+	exitCode, _, stderr := execCmd(t, "go", "run", "../main.go", "bag", "create", "--profile=empty", "--output-file="+tmpFile, "--bag-dir="+bagDir,
+		`--tags=Internal-Sender-Identifier={{.Env "APT_CMD_TEST_BUILD"}}`)
+	require.Equal(t, 0, exitCode, stderr)
+	assert.Contains(t, tarFileContent(t, tmpFile, "templates/bag-info.txt"), "Internal-Sender-Identifier: build-42\n")
+}
+
+func TestBagCreate_TagTemplateEnumerated(t *testing.T) {
+	// Values are checked against the profile after they're expanded.
+	bagDir := path.Join(t.TempDir(), "files")
+	require.Nil(t, os.Mkdir(bagDir, 0755))
+	require.Nil(t, os.WriteFile(path.Join(bagDir, "file.txt"), []byte("data"), 0644))
+	args := func(tmpFile string) []string {
+		return []string{"run", "../main.go", "bag", "create", "--profile=aptrust", "--output-file=" + tmpFile, "--bag-dir=" + bagDir, "--manifest-algs=md5,sha256",
+			"--tags=aptrust-info.txt/Title=Templates", "--tags=aptrust-info.txt/Storage-Option=Standard", "--tags=Source-Organization=Faber College",
+			`--tags=aptrust-info.txt/Access={{.Env "APT_CMD_TEST_ACCESS"}}`}
+	}
+	t.Setenv("APT_CMD_TEST_ACCESS", "Consortia")
+	tmpFile := path.Join(t.TempDir(), "templates.tar")
+	exitCode, _, stderr := execCmd(t, "go", args(tmpFile)...)
+	require.Equal(t, 0, exitCode, stderr)
+	assert.Contains(t, tarFileContent(t, tmpFile, "templates/aptrust-info.txt"), "Access: Consortia\n")
+
+	t.Setenv("APT_CMD_TEST_ACCESS", "Everyone")
+	exitCode, _, stderr = execCmd(t, "go", args(path.Join(t.TempDir(), "templates.tar"))...)
+	assert.NotEqual(t, 0, exitCode)
+	assert.Contains(t, stderr, "Tag aptrust-info.txt/Access assigned illegal value 'Everyone'")
+}
@@ -0,0 +1,184 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/APTrust/dart-runner/bagit"
+)
+
+// tagsFileEntry is one tag in a JSON tags file.
+type tagsFileEntry struct {
+	TagFile string `json:"tagFile"`
+	TagName string `json:"tagName"`
+	Value   string `json:"value"`
+}
+
+// ReadTagsFile parses the tag values in the file at pathToFile for
+// --tags-file. The file is either a JSON array of objects with tagFile,
+// tagName and value fields, or a CSV file with a header row naming
+// those columns. Files ending in .json are JSON, files ending in .csv
+// are CSV, and other files are JSON if they start with [. As with
+// --tags, tagFile defaults to bag-info.txt, and tag names are
+// title-cased. Errors include the line number of the problem.
+func ReadTagsFile(pathToFile string) ([]*bagit.TagDefinition, error) {
+	data, err := os.ReadFile(pathToFile)
+	if err != nil {
+		return nil, fmt.Errorf("can't read tags file %s: %w", pathToFile, err)
+	}
+	ext := strings.ToLower(filepath.Ext(pathToFile))
+	isJSON := ext == ".json" || (ext != ".csv" && bytes.HasPrefix(bytes.TrimSpace(data), []byte("[")))
+	var tags []*bagit.TagDefinition
+	if isJSON {
+		tags, err = parseJSONTags(data)
+	} else {
+		tags, err = parseCSVTags(data)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid tags file %s: %w", pathToFile, err)
+	}
+	return tags, nil
+}
+
+// parseJSONTags parses a JSON array of tags. We decode one element at a
+// time, so that errors can say which line the bad element starts on.
+func parseJSONTags(data []byte) ([]*bagit.TagDefinition, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	token, err := decoder.Token()
+	if err != nil {
+		return nil, jsonError(data, decoder.InputOffset(), err)
+	}
+	if delim, ok := token.(json.Delim); !ok || delim != '[' {
+		return nil, fmt.Errorf("line %d: expected a JSON array of tags", lineAt(data, decoder.InputOffset()))
+	}
+	tags := make([]*bagit.TagDefinition, 0)
+	for decoder.More() {
+		// The element starts after any whitespace and the comma
+		// that separates it from the previous one.
+		start := decoder.InputOffset()
+		for start < int64(len(data)) && strings.ContainsRune(" \t\r\n,", rune(data[start])) {
+			start++
+		}
+		var raw json.RawMessage
+		if err = decoder.Decode(&raw); err != nil {
+			return nil, jsonError(data, decoder.InputOffset(), err)
+		}
+		// Reject misspelled fields, rather than silently leaving
+		// tags empty.
+		entry := tagsFileEntry{}
+		elementDecoder := json.NewDecoder(bytes.NewReader(raw))
+		elementDecoder.DisallowUnknownFields()
+		if err = elementDecoder.Decode(&entry); err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineAt(data, start), err)
+		}
+		tag, err := newFileTag(entry.TagFile, entry.TagName, entry.Value)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineAt(data, start), err)
+		}
+		tags = append(tags, tag)
+	}
+	if _, err = decoder.Token(); err != nil {
+		return nil, jsonError(data, decoder.InputOffset(), err)
+	}
+	return tags, nil
+}
+
+// jsonError adds the line number to an error from the JSON decoder.
+func jsonError(data []byte, offset int64, err error) error {
+	var syntaxError *json.SyntaxError
+	if errors.As(err, &syntaxError) {
+		offset = syntaxError.Offset
+	}
+	if err == io.EOF {
+		err = fmt.Errorf("unexpected end of file")
+	}
+	return fmt.Errorf("line %d: %w", lineAt(data, offset), err)
+}
+
+// lineAt returns the line number of the byte at offset in data,
+// counting from one.
+func lineAt(data []byte, offset int64) int {
+	if offset > int64(len(data)) {
+		offset = int64(len(data))
+	}
+	return bytes.Count(data[:offset], []byte("\n")) + 1
+}
+
+// parseCSVTags parses CSV tags. The header row names the tagFile,
+// tagName and value columns, in any order. tagFile is optional.
+func parseCSVTags(data []byte) ([]*bagit.TagDefinition, error) {
+	reader := csv.NewReader(bytes.NewReader(data))
+	reader.TrimLeadingSpace = true
+	header, err := reader.Read()
+	if err != nil {
+		return nil, csvError(err)
+	}
+	columns := make(map[string]int)
+	for i, name := range header {
+		columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	for _, name := range []string{"tagname", "value"} {
+		if _, ok := columns[name]; !ok {
+			return nil, fmt.Errorf("line 1: the header row must name the tagFile, tagName and value columns")
+		}
+	}
+	tags := make([]*bagit.TagDefinition, 0)
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, csvError(err)
+		}
+		line, _ := reader.FieldPos(0)
+		tagFile := ""
+		if i, ok := columns["tagfile"]; ok {
+			tagFile = record[i]
+		}
+		tag, err := newFileTag(tagFile, record[columns["tagname"]], record[columns["value"]])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		tags = append(tags, tag)
+	}
+	return tags, nil
+}
+
+// csvError makes CSV parse errors start with the line number, like
+// our other tags file errors.
+func csvError(err error) error {
+	var parseError *csv.ParseError
+	if errors.As(err, &parseError) {
+		return fmt.Errorf("line %d: %w", parseError.Line, parseError.Err)
+	}
+	if err == io.EOF {
+		return fmt.Errorf("line 1: the file is empty")
+	}
+	return err
+}
+
+// newFileTag returns a tag from a tags file, following the same rules
+// as --tags.
+func newFileTag(tagFile, tagName, value string) (*bagit.TagDefinition, error) {
+	tagFile = strings.TrimSpace(tagFile)
+	if tagFile == "" {
+		tagFile = "bag-info.txt"
+	}
+	tagName, err := normalizeTagName(tagName)
+	if err != nil {
+		return nil, err
+	}
+	return &bagit.TagDefinition{
+		TagFile:   tagFile,
+		TagName:   tagName,
+		UserValue: value,
+	}, nil
+}
@@ -0,0 +1,96 @@
+package cmd_test
+
+import (
+	"os"
+	"path"
+	"testing"
+
+	"github.com/APTrust/apt-cmd/cmd"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeTagsFile(t *testing.T, name, content string) string {
+	pathToFile := path.Join(t.TempDir(), name)
+	require.Nil(t, os.WriteFile(pathToFile, []byte(content), 0644))
+	return pathToFile
+}
+
+func TestReadTagsFile_JSON(t *testing.T) {
+	pathToFile := writeTagsFile(t, "tags.json", `[
+  { "tagFile": "bag-info.txt", "tagName": "Source-Organization", "value": "Faber College" },
+  { "tagFile": "aptrust-info.txt", "tagName": "access", "value": "Institution" },
+  { "tagName": "Contact-Name", "value": "Kent Dorfman" }
+]`)
+	tags, err := cmd.ReadTagsFile(pathToFile)
+	require.Nil(t, err)
+	require.Equal(t, 3, len(tags))
+	assert.Equal(t, "bag-info.txt", tags[0].TagFile)
+	assert.Equal(t, "Source-Organization", tags[0].TagName)
+	assert.Equal(t, "Faber College", tags[0].UserValue)
+	assert.Equal(t, "aptrust-info.txt", tags[1].TagFile)
+	assert.Equal(t, "Access", tags[1].TagName)
+	assert.Equal(t, "bag-info.txt", tags[2].TagFile)
+	assert.Equal(t, "Kent Dorfman", tags[2].UserValue)
+
+	// No extension, but it looks like JSON.
+	pathToFile = writeTagsFile(t, "tags", `[{"tagName": "Title", "value": "Animal House"}]`)
+	tags, err = cmd.ReadTagsFile(pathToFile)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(tags))
+	assert.Equal(t, "Title", tags[0].TagName)
+}
+
+func TestReadTagsFile_CSV(t *testing.T) {
+	pathToFile := writeTagsFile(t, "tags.csv", `value,tagName,TagFile
+Faber College,Source-Organization,bag-info.txt
+"Institution",access,aptrust-info.txt
+"Delta House, 1962",Title,
+`)
+	tags, err := cmd.ReadTagsFile(pathToFile)
+	require.Nil(t, err)
+	require.Equal(t, 3, len(tags))
+	assert.Equal(t, "Source-Organization", tags[0].TagName)
+	assert.Equal(t, "Faber College", tags[0].UserValue)
+	assert.Equal(t, "aptrust-info.txt", tags[1].TagFile)
+	assert.Equal(t, "Access", tags[1].TagName)
+	assert.Equal(t, "bag-info.txt", tags[2].TagFile)
+	assert.Equal(t, "Delta House, 1962", tags[2].UserValue)
+
+	// tagFile column is optional
+	pathToFile = writeTagsFile(t, "tags.csv", "tagName,value\nTitle,Animal House\n")
+	tags, err = cmd.ReadTagsFile(pathToFile)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(tags))
+	assert.Equal(t, "bag-info.txt", tags[0].TagFile)
+}
+
+func TestReadTagsFile_Errors(t *testing.T) {
+	testCases := []struct {
+		name    string
+		content string
+		message string
+	}{
+		{"syntax.json", "[\n  {\"tagName\": \"Title\", \"value\": \"A\"},\n  {\"tagName\": \"Title\" \"value\": \"B\"}\n]", "line 3:"},
+		{"unknown.json", "[\n  {\"tagName\": \"Title\", \"value\": \"A\"},\n  {\"tagname\": \"Title\", \"valu\": \"B\"}\n]", "line 3: json: unknown field \"valu\""},
+		{"missing-name.json", "[\n  {\"value\": \"A\"}\n]", "line 2: tag name is missing"},
+		{"colon.json", "[\n\n  {\"tagName\": \"Ti:tle\", \"value\": \"A\"}\n]", "line 3: tag names cannot contain colons"},
+		{"object.json", "{\"tagName\": \"Title\"}", "line 1: expected a JSON array of tags"},
+		{"unclosed.json", "[\n  {\"tagName\": \"Title\", \"value\": \"A\"}\n", "line 3: unexpected end"},
+		{"header.csv", "name,value\nTitle,A\n", "line 1: the header row must name"},
+		{"columns.csv", "tagName,value\nTitle,A\nTitle,A,extra\n", "line 3: wrong number of fields"},
+		{"colon.csv", "tagName,value\nTitle,A\n\nTi:tle,B\n", "line 4: tag names cannot contain colons"},
+		{"empty.csv", "", "line 1: the file is empty"},
+	}
+	for _, tc := range testCases {
+		pathToFile := writeTagsFile(t, tc.name, tc.content)
+		_, err := cmd.ReadTagsFile(pathToFile)
+		require.NotNil(t, err, tc.name)
+		assert.Contains(t, err.Error(), "invalid tags file "+pathToFile, tc.name)
+		assert.Contains(t, err.Error(), tc.message, tc.name)
+	}
+
+	_, err := cmd.ReadTagsFile(path.Join(t.TempDir(), "missing.json"))
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), "can't read tags file")
+}
@@ -13,9 +13,10 @@ var CommitId string
 var BuildDate string
 
 var versionCmd = &cobra.Command{
-	Use:   "version",
-	Short: "Print version info and exit",
-	Long:  `Print version info and exit`,
+	Use:     "version",
+	Short:   "Print version info and exit",
+	Example: `apt-cmd version`,
+	Long:    `Print version info and exit`,
 	Run: func(cmd *cobra.Command, args []string) {
 		fmt.Println("  apt-cmd (APTrust partner tools)")
 		fmt.Printf("  Version %s on %s %s\n", Version, runtime.GOOS, runtime.GOARCH)